@@ -21,6 +21,8 @@ load("@io_bazel_rules_go//go/private:repositories.bzl", "go_repositories")
 load("@io_bazel_rules_go//go/private:go_repository.bzl", "go_repository", "new_go_repository")
 load("@io_bazel_rules_go//go/private:go_prefix.bzl", "go_prefix")
 load("@io_bazel_rules_go//go/private:embed_data.bzl", "go_embed_data")
+load("@io_bazel_rules_go//go/private:go_path.bzl", "go_path")
+load("@io_bazel_rules_go//go/private:nogo.bzl", "nogo", _nogo_aspect = "nogo_aspect")
 load("@io_bazel_rules_go//go/private:cgo.bzl", "cgo_library", "cgo_genrule")
 load("@io_bazel_rules_go//go/private:gazelle.bzl", "gazelle")
 load("@io_bazel_rules_go//go/private:wrappers.bzl",
@@ -107,7 +109,8 @@ go_test = _go_test_macro
         "srcs": attr.label_list(),
         "deps": attr.label_list(),
         "data": attr.label_list(allow_files = True, cfg = "data"),
-        "library": attr.label(),
+        "embed": attr.label_list(),
+        "library": attr.label(), # Deprecated; use embed
         # compile options
         "gc_goopts": attr.string_list(), # Options for the go compiler if using gc
         "gccgo_goopts": attr.string_list(), # Options for the go compiler if using gcc
@@ -123,3 +126,11 @@ go_test = _go_test_macro
         "copts": attr.string_list(), # Options for the the c compiler
         "clinkopts": attr.string_list(), # Options for the linker
 """
+
+nogo_aspect = _nogo_aspect
+"""
+    nogo_aspect runs the analyzers of the nogo selected with
+    go_repositories(nogo = ...) on Go libraries while they're built.
+    Enable it with:
+        --aspects=@io_bazel_rules_go//go:def.bzl%nogo_aspect --output_groups=+nogo
+"""
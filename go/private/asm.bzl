@@ -14,23 +14,37 @@
 
 load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain")
 
+def get_asm_includes(go_toolchain, hdrs):
+  """Returns the include directories for assembling sources that may include
+  hdrs and the headers provided by the toolchain, like textflag.h."""
+  includes = depset()
+  includes += [f.dirname for f in hdrs]
+  includes += [f.dirname for f in go_toolchain.headers.cc.transitive_headers]
+  return includes
+
 def emit_go_asm_action(ctx, source, hdrs, out_obj):
   """Construct the command line for compiling Go Assembly code.
   Constructs a symlink tree to accomodate for workspace name.
   Args:
     ctx: The skylark Context.
     source: a source code artifact
-    hdrs: list of .h files that may be included
+    hdrs: list of .h files that may be included. Headers provided by the
+      toolchain, like textflag.h, are always available and don't need to
+      be listed.
     out_obj: the artifact (configured target?) that should be produced
   """
   go_toolchain = get_go_toolchain(ctx)
-  includes = depset()
-  includes += [f.dirname for f in hdrs]
-  includes += [f.dirname for f in go_toolchain.headers.cc.transitive_headers]
+  includes = get_asm_includes(go_toolchain, hdrs)
   inputs = hdrs + list(go_toolchain.headers.cc.transitive_headers) + go_toolchain.tools + [source]
   asm_args = [go_toolchain.go.path, source.path, "--", "-o", out_obj.path]
   for inc in includes:
     asm_args += ["-I", inc]
+  # Like "go build", define the target platform so sources can use
+  # "#ifdef GOARCH_amd64".
+  asm_args += [
+      "-D", "GOOS_" + go_toolchain.env["GOOS"],
+      "-D", "GOARCH_" + go_toolchain.env["GOARCH"],
+  ]
   ctx.action(
       inputs = inputs,
       outputs = [out_obj],
@@ -12,8 +12,8 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 
-load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "go_filetype")
-load("@io_bazel_rules_go//go/private:library.bzl", "emit_library_actions")
+load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "get_instrument", "get_stdlib_pkg", "go_filetype")
+load("@io_bazel_rules_go//go/private:library.bzl", "emit_library_actions", "get_embed")
 load("@io_bazel_rules_go//go/private:providers.bzl", "GoLibrary", "GoBinary")
 
 def _go_binary_impl(ctx):
@@ -22,7 +22,7 @@ def _go_binary_impl(ctx):
       sources = depset(ctx.files.srcs),
       deps = ctx.attr.deps,
       cgo_object = None,
-      library = ctx.attr.library,
+      embed = get_embed(ctx),
       want_coverage = False,
   )
 
@@ -36,6 +36,7 @@ def _go_binary_impl(ctx):
       executable=ctx.outputs.executable,
       gc_linkopts=gc_linkopts(ctx),
       x_defs=ctx.attr.x_defs,
+      instrument=get_instrument(ctx),
   )
 
   # Static linking (in the 'static' output group)
@@ -53,6 +54,7 @@ def _go_binary_impl(ctx):
       executable=static_executable,
       gc_linkopts=gc_linkopts(ctx) + static_linkopts,
       x_defs=ctx.attr.x_defs,
+      instrument=get_instrument(ctx),
   )
 
   # with race detector
@@ -64,8 +66,9 @@ def _go_binary_impl(ctx):
     cgo_deps=lib_result.transitive_cgo_deps,
     libs=depset([lib_result.race]),
     executable=race_executable,
-    gc_linkopts=gc_linkopts(ctx) + ["-race"],
+    gc_linkopts=gc_linkopts(ctx),
     x_defs=ctx.attr.x_defs,
+    instrument="race",
   )
 
   return [
@@ -96,6 +99,7 @@ go_binary = rule(
         "deps": attr.label_list(providers = [GoLibrary]),
         "importpath": attr.string(),
         "library": attr.label(providers = [GoLibrary]),
+        "embed": attr.label_list(providers = [GoLibrary]),
         "gc_goopts": attr.string_list(),
         "gc_linkopts": attr.string_list(),
         "linkstamp": attr.string(),
@@ -165,8 +169,12 @@ def _extract_extldflags(gc_linkopts, extldflags):
   return filtered_gc_linkopts, extldflags
 
 def emit_go_link_action(ctx, transitive_go_library_paths, transitive_go_libraries, cgo_deps, libs,
-                         executable, gc_linkopts, x_defs):
-  """Sets up a symlink tree to libraries to link together."""
+                         executable, gc_linkopts, x_defs, instrument=""):
+  """Sets up a symlink tree to libraries to link together.
+
+  instrument is "race" or "msan" to link instrumented code. The
+  libraries must have been compiled with the same mode.
+  """
   go_toolchain = get_go_toolchain(ctx)
   config_strip = len(ctx.configuration.bin_dir.path) + 1
   pkg_depth = executable.dirname[config_strip:].count('/') + 1
@@ -187,16 +195,23 @@ def emit_go_link_action(ctx, transitive_go_library_paths, transitive_go_librarie
   ]
   for path in transitive_go_library_paths:
     link_opts += ["-L", path]
+  stdlib_inputs = []
+  stdlib_pkg = get_stdlib_pkg(go_toolchain, instrument)
+  if stdlib_pkg:
+    stdlib_inputs = [stdlib_pkg]
+    link_opts += ["-L", stdlib_pkg.path]
   link_opts += [
       "-o", executable.path,
   ] + gc_linkopts
 
   # Process x_defs, either adding them directly to linker options, or
-  # saving them to process through stamping support.
+  # saving them to process through stamping support. Values that may
+  # reference workspace status variables, like "v{STABLE_VERSION}", are
+  # expanded by the link wrapper.
   stamp_x_defs = {}
   for k, v in x_defs.items():
-    if v.startswith("{") and v.endswith("}"):
-      stamp_x_defs[k] = v[1:-1]
+    if "{" in v and "}" in v:
+      stamp_x_defs[k] = v
     else:
       link_opts += ["-X", "%s=%s" % (k, v)]
 
@@ -206,6 +221,8 @@ def emit_go_link_action(ctx, transitive_go_library_paths, transitive_go_librarie
   ] + [lib.path for lib in libs]
 
   link_args = [go_toolchain.go.path]
+  if instrument:
+    link_args += ["-instrument", instrument]
   # Stamping support
   stamp_inputs = []
   if stamp_x_defs or ctx.attr.linkstamp:
@@ -224,7 +241,8 @@ def emit_go_link_action(ctx, transitive_go_library_paths, transitive_go_librarie
 
   ctx.action(
       inputs = list(transitive_go_libraries + [lib] + cgo_deps +
-                go_toolchain.tools + go_toolchain.crosstool + stamp_inputs),
+                go_toolchain.tools + go_toolchain.crosstool + stamp_inputs +
+                stdlib_inputs),
       outputs = [executable],
       mnemonic = "GoLink",
       executable = go_toolchain.link,
@@ -12,7 +12,7 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 
-load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "go_exts", "hdr_exts", "c_exts", "asm_exts", "pkg_dir")
+load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "get_instrument", "go_exts", "hdr_exts", "c_exts", "asm_exts", "pkg_dir")
 load("@io_bazel_rules_go//go/private:library.bzl", "go_library")
 load("@io_bazel_rules_go//go/private:binary.bzl", "c_linker_options")
 
@@ -55,7 +55,7 @@ def cgo_library(name, srcs,
     go_library(
         name = "go_default_library",
         srcs = ["pure-go.go"],
-        library = ":cgo_enabled",
+        embed = [":cgo_enabled"],
     )
     ```
   """
@@ -89,6 +89,9 @@ def _cgo_codegen_impl(ctx):
   srcs = ctx.files.srcs
   linkopts = ctx.attr.linkopts
   copts = ctx.fragments.cpp.c_options + ctx.attr.copts
+  if get_instrument(ctx) == "msan":
+    copts += ["-fsanitize=memory"]
+    linkopts += ["-fsanitize=memory"]
   deps = depset([], order="topological")
   cgo_export_h = ctx.new_file(ctx.attr.out_dir + "/_cgo_export.h")
   cgo_export_c = ctx.new_file(ctx.attr.out_dir + "/_cgo_export.c")
@@ -97,7 +100,8 @@ def _cgo_codegen_impl(ctx):
   out_dir = cgo_main.dirname
 
   cc = ctx.fragments.cpp.compiler_executable
-  args = [go_toolchain.go.path, "-cc", str(cc), "-objdir", out_dir]
+  srcdir = pkg_dir(ctx.label.workspace_root, ctx.label.package)
+  args = [go_toolchain.go.path, "-cc", str(cc), "-objdir", out_dir, "-srcdir", srcdir]
 
   c_outs = depset([cgo_export_h, cgo_export_c])
   go_outs = depset([cgo_types])
@@ -126,26 +130,37 @@ def _cgo_codegen_impl(ctx):
     else:
       fail("Unknown source type {0} in {1}".format(src.basename, ctx.label))
 
+  # Include directories, defines, and frameworks of the cc_library
+  # dependencies are passed to the cgo wrapper separately, so it can drop
+  # duplicates and find relative directories from the execution root.
   for d in ctx.attr.deps:
     srcs += list(d.cc.transitive_headers)
     deps += d.cc.libs
-    copts += ['-D' + define for define in d.cc.defines]
+    for define in d.cc.defines:
+      args += ["-cdep_define", define]
     for inc in d.cc.include_directories:
-      copts += ['-I', _exec_path(inc)]
+      args += ["-cdep_include", inc]
     for inc in d.cc.quote_include_directories:
-      copts += ['-iquote', _exec_path(inc)]
+      args += ["-cdep_quote_include", inc]
     for inc in d.cc.system_include_directories:
-      copts += ['-isystem', _exec_path(inc)]
+      args += ["-cdep_system_include", inc]
     for lib in d.cc.libs:
       if lib.basename.startswith('lib') and lib.basename.endswith('.so'):
         linkopts += ['-L', lib.dirname, '-l', lib.basename[3:-3]]
       else:
         linkopts += [lib.path]
-    linkopts += d.cc.link_flags
-
-  # The first -- below is to stop the cgo from processing args, the
-  # second is an actual arg to forward to the underlying go tool
-  args += ["--", "--"] + copts
+    link_flags, framework_dirs, frameworks = _extract_frameworks(d.cc.link_flags)
+    linkopts += link_flags
+    for dir in framework_dirs:
+      args += ["-cdep_framework_dir", dir]
+    for framework in frameworks:
+      args += ["-cdep_framework", framework]
+  for opt in linkopts:
+    args += ["-linkopt", opt]
+
+  # The -- below stops the cgo wrapper from processing args. The rest are
+  # options for the C compiler.
+  args += ["--"] + copts
   inputs = srcs + go_toolchain.tools + go_toolchain.crosstool
   outputs = list(c_outs + go_outs + [cgo_main])
   ctx.action(
@@ -155,9 +170,7 @@ def _cgo_codegen_impl(ctx):
       progress_message = "CGoCodeGen %s" % ctx.label,
       executable = go_toolchain.cgo,
       arguments = args,
-      env = go_toolchain.env + {
-          "CGO_LDFLAGS": " ".join(linkopts),
-      },
+      env = go_toolchain.env,
   )
   return struct(
       label = ctx.label,
@@ -287,10 +300,32 @@ _cgo_object = rule(
 )
 
 
-def _exec_path(path):
-  if path.startswith('/'):
-    return path
-  return '${execroot}/' + path
+def _extract_frameworks(link_flags):
+  """Splits "-framework name" and "-Fdir" flags out of link_flags, returning
+  the remaining flags, the framework directories, and the framework names."""
+  filtered = []
+  framework_dirs = []
+  frameworks = []
+  is_framework = False
+  for flag in link_flags:
+    if is_framework:
+      frameworks += [flag]
+      is_framework = False
+    elif flag == "-framework":
+      is_framework = True
+    elif flag.startswith("-F") and len(flag) > 2:
+      framework_dirs += [flag[2:]]
+    else:
+      filtered += [flag]
+  return filtered, framework_dirs, frameworks
+
+def _expand_srcdir(opts, srcdir):
+  """Replaces ${SRCDIR} in opts with srcdir, as the cgo wrapper does, for
+  the C rules that compile the generated sources. Options set with select
+  are left alone."""
+  if type(opts) != "list":
+    return opts
+  return [opt.replace("${SRCDIR}", srcdir) for opt in opts]
 
 
 """Generates _all.o to be archived together with Go objects.
@@ -313,6 +348,8 @@ def setup_cgo_library(name, srcs, cdeps, copts, clinkopts):
       "external/" + REPOSITORY_NAME[1:] if len(REPOSITORY_NAME) > 1 else "",
       PACKAGE_NAME)
   copts += ["-I", base_dir]
+  cc_copts = _expand_srcdir(copts, base_dir)
+  cc_linkopts = _expand_srcdir(clinkopts, base_dir)
 
   cgo_codegen_name = name + ".cgo_codegen"
   _cgo_codegen_rule(
@@ -347,18 +384,24 @@ def setup_cgo_library(name, srcs, cdeps, copts, clinkopts):
       "//conditions:default": ["-pthread"],
   })
   platform_linkopts = platform_copts
+  # The memory sanitizer needs the C code to be instrumented too. The Go
+  # linker adds -fsanitize=memory to the final link itself.
+  instrument_opts = select({
+      "@io_bazel_rules_go//go/private:msan": ["-fsanitize=memory"],
+      "//conditions:default": [],
+  })
 
   cgo_lib_name = name + ".cgo_c_lib"
   native.cc_library(
       name = cgo_lib_name,
       srcs = [cgo_codegen_name],
       deps = cdeps,
-      copts = copts + platform_copts + [
+      copts = cc_copts + platform_copts + instrument_opts + [
           "-I", "$(BINDIR)/" + base_dir + "/" + cgo_codegen_dir,
           # The generated thunks often contain unused variables.
           "-Wno-unused-variable",
       ],
-      linkopts = clinkopts + platform_linkopts,
+      linkopts = cc_linkopts + platform_linkopts + instrument_opts,
       linkstatic = 1,
       # _cgo_.o and _all.o keep all objects in this archive.
       # But it should not be very annoying in the final binary target
@@ -374,8 +417,8 @@ def setup_cgo_library(name, srcs, cdeps, copts, clinkopts):
       name = cgo_o_name,
       srcs = [select_main_c],
       deps = cdeps + [cgo_lib_name],
-      copts = copts,
-      linkopts = clinkopts,
+      copts = cc_copts + instrument_opts,
+      linkopts = cc_linkopts + instrument_opts,
       visibility = ["//visibility:private"],
   )
 
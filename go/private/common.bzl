@@ -58,6 +58,27 @@ cgo_filetype = FileType(go_exts + asm_exts + c_exts)
 def get_go_toolchain(ctx):
   return ctx.attr._go_toolchain[go_toolchain_type]
 
+# Instrumentation modes supported by the compile and link wrappers. The empty
+# mode builds uninstrumented code.
+INSTRUMENT_MODES = ["", "race", "msan"]
+
+def get_instrument(ctx):
+  """Returns the instrumentation mode set with --define go_instrument=mode,
+  or "" if none was set."""
+  instrument = ctx.var.get("go_instrument", "")
+  if instrument not in INSTRUMENT_MODES:
+    fail("go_instrument is %s; want race or msan" % instrument)
+  return instrument
+
+def get_stdlib_pkg(go_toolchain, instrument):
+  """Returns the directory of standard library archives compiled by
+  go_stdlib for go_toolchain with the given instrumentation mode. None is
+  returned if the toolchain doesn't have one, in which case the pkg directory
+  of the Go distribution is used."""
+  if instrument:
+    return getattr(go_toolchain, "stdlib_pkg_" + instrument)
+  return go_toolchain.stdlib_pkg
+
 def pkg_dir(workspace_root, package_name):
   """Returns a relative path to a package directory from the root of the
   sandbox. Useful at execution-time or run-time."""
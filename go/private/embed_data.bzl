@@ -43,6 +43,8 @@ def _go_embed_data_impl(ctx):
     args += ["-flatten"]
   if ctx.attr.string:
     args += ["-string"]
+  if ctx.attr.compress:
+    args += ["-compress"]
   args += [f.path for f in srcs]
 
   ctx.action(
@@ -63,6 +65,7 @@ go_embed_data = rule(
         "srcs": attr.label_list(allow_files = True),
         "flatten": attr.bool(),
         "string": attr.bool(),
+        "compress": attr.bool(),
         "_embed": attr.label(
             default = Label("@io_bazel_rules_go//go/tools/builders:embed"),
             executable = True,
@@ -90,4 +93,6 @@ go_embed_data has the following attributes:
         of relative paths.
     string: If true, the embedded data will be stored as string instead
         of []byte.
+    compress: If true, the contents of each file are compressed with gzip
+        before they're embedded. Read them with compress/gzip.
 """
@@ -0,0 +1,149 @@
+# Copyright 2017 The Bazel Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load("@io_bazel_rules_go//go/private:providers.bzl", "GoLibrary")
+
+_GoPathInfo = provider()
+
+def _go_path_aspect_impl(target, ctx):
+  deps = list(getattr(ctx.rule.attr, "deps", []))
+  embed = list(getattr(ctx.rule.attr, "embed", []))
+  library = getattr(ctx.rule.attr, "library", None)
+  if library:
+    embed += [library]
+  deps += embed
+
+  pkgs = []
+  seen = {}
+  for dep in deps:
+    if _GoPathInfo not in dep:
+      continue
+    for pkg in dep[_GoPathInfo].pkgs:
+      if pkg.label not in seen:
+        seen[pkg.label] = True
+        pkgs += [pkg]
+
+  if GoLibrary in target:
+    # Sources of an embedded library are compiled into this package, so they
+    # go in its directory too.
+    srcs = list(ctx.rule.files.srcs)
+    for library in embed:
+      if _GoPathInfo not in library:
+        continue
+      for pkg in library[_GoPathInfo].pkgs:
+        if pkg.label == str(library.label):
+          srcs += pkg.srcs
+    pkgs += [struct(
+        label = str(target.label),
+        importpath = target[GoLibrary].importpath,
+        srcs = srcs,
+    )]
+  return [_GoPathInfo(pkgs = pkgs)]
+
+_go_path_aspect = aspect(
+    _go_path_aspect_impl,
+    attr_aspects = ["deps", "embed", "library"],
+)
+
+def _go_path_impl(ctx):
+  pkgs = []
+  seen = {}
+  for dep in ctx.attr.deps:
+    for pkg in dep[_GoPathInfo].pkgs:
+      if pkg.label not in seen:
+        seen[pkg.label] = True
+        pkgs += [pkg]
+
+  entries = []
+  inputs = []
+  srcs_by_dst = {}
+  for pkg in pkgs:
+    for src in pkg.srcs:
+      dst = "src/%s/%s" % (pkg.importpath, src.basename)
+      if dst in srcs_by_dst:
+        if srcs_by_dst[dst] != src.path:
+          fail("%s: %s and %s would both be written to %s" % (ctx.label, srcs_by_dst[dst], src.path, dst))
+        continue
+      srcs_by_dst[dst] = src.path
+      entries += [struct(src = src.path, dst = dst)]
+      inputs += [src]
+  if not entries:
+    fail("%s: deps have no sources" % ctx.label)
+
+  manifest = ctx.new_file(ctx.label.name + "~manifest.json")
+  ctx.file_action(output = manifest, content = struct(entries = entries).to_json())
+
+  if ctx.attr.mode == "archive":
+    outputs = [ctx.new_file(ctx.label.name + ".zip")]
+    out = outputs[0].path
+  else:
+    outputs = [ctx.new_file(ctx.label.name + "/" + e.dst) for e in entries]
+    out = outputs[0].path[:-len(entries[0].dst) - 1]
+
+  # Links point to sources outside the sandbox, so they're only valid when
+  # the action runs locally.
+  execution_requirements = {}
+  if ctx.attr.mode == "symlink":
+    execution_requirements = {"local": "1"}
+  ctx.action(
+      inputs = inputs + [manifest],
+      outputs = outputs,
+      executable = ctx.executable._go_path,
+      arguments = [
+          "-manifest", manifest.path,
+          "-out", out,
+          "-mode", ctx.attr.mode,
+      ],
+      mnemonic = "GoPath",
+      execution_requirements = execution_requirements,
+  )
+  return [DefaultInfo(
+      files = depset(outputs),
+      runfiles = ctx.runfiles(files = outputs),
+  )]
+
+go_path = rule(
+    _go_path_impl,
+    attrs = {
+        "deps": attr.label_list(
+            providers = [GoLibrary],
+            aspects = [_go_path_aspect],
+        ),
+        "mode": attr.string(
+            default = "copy",
+            values = ["copy", "symlink", "archive"],
+        ),
+        "_go_path": attr.label(
+            default = Label("@io_bazel_rules_go//go/tools/builders:go_path"),
+            executable = True,
+            cfg = "host",
+        ),
+    },
+)
+"""go_path assembles a GOPATH-shaped tree from the sources of Go libraries
+and everything they depend on, for tools that expect that layout, like golint
+and mockgen.
+
+Each library's sources are placed in src/<importpath>. The tree is written to
+a directory named after the rule, or to <name>.zip in archive mode.
+
+go_path has the following attributes:
+    deps: Go libraries whose sources, and whose dependencies' sources, are
+        put in the tree.
+    mode: How files are put in the tree. "copy" copies them. "symlink" links
+        to the sources in the workspace, so the tree is cheap to create, but
+        it's only valid until the workspace changes. "archive" writes a zip
+        file with the tree's contents.
+"""
@@ -21,19 +21,46 @@ def _go_repository_impl(ctx):
       fail("cannot specify both of urls and commit", "commit")
     if ctx.attr.tag:
       fail("cannot specify both of urls and tag", "tag")
+    if ctx.attr.version:
+      fail("cannot specify both of urls and version", "version")
     ctx.download_and_extract(
         url = ctx.attr.urls,
         sha256 = ctx.attr.sha256,
         stripPrefix = ctx.attr.strip_prefix,
         type = ctx.attr.type,
     )
+  elif ctx.attr.version:
+    # module proxy download
+    if ctx.attr.commit or ctx.attr.tag:
+      fail("cannot specify both of version and commit or tag", "version")
+    if ctx.attr.vcs and not ctx.attr.remote:
+      fail("if vcs is specified, remote must also be")
+    result = env_execute(
+        ctx,
+        [
+            ctx.path(ctx.attr._fetch_repo),
+            '--dest', ctx.path(''),
+            '--importpath', ctx.attr.importpath,
+            '--version', ctx.attr.version,
+            '--sum', ctx.attr.sum,
+            '--remote', ctx.attr.remote,
+            '--vcs', ctx.attr.vcs,
+        ] + _fetch_repo_cache_args(ctx),
+        environment = _fetch_repo_env(ctx),
+    )
+    if result.return_code:
+      fail("failed to fetch %s: %s" % (ctx.name, result.stderr))
   else:
+    if ctx.attr.sum:
+      fail("sum may only be specified with version", "sum")
+    if ctx.attr.shallow and ctx.attr.vcs not in ("", "git"):
+      fail("shallow may only be specified for git repositories", "shallow")
     if ctx.attr.commit and ctx.attr.tag:
       fail("cannot specify both of commit and tag", "commit")
     if ctx.attr.commit:
-      rev = ctx.attr.commit
+      rev_flag, rev = "commit", ctx.attr.commit
     elif ctx.attr.tag:
-      rev = ctx.attr.tag
+      rev_flag, rev = "tag", ctx.attr.tag
     else:
       fail("neither commit or tag is specified", "commit")
     
@@ -41,12 +68,6 @@ def _go_repository_impl(ctx):
     if ctx.attr.vcs and not ctx.attr.remote:
       fail("if vcs is specified, remote must also be")
 
-    fetch_repo_env = {
-        "PATH": ctx.os.environ["PATH"],  # to find git
-    }
-    if "SSH_AUTH_SOCK" in ctx.os.environ:
-      fetch_repo_env["SSH_AUTH_SOCK"] = ctx.os.environ["SSH_AUTH_SOCK"]
-
     # TODO(yugui): support submodule?
     # c.f. https://www.bazel.io/versions/master/docs/be/workspace.html#git_repository.init_submodules
     result = env_execute(
@@ -55,11 +76,12 @@ def _go_repository_impl(ctx):
             ctx.path(ctx.attr._fetch_repo),
             '--dest', ctx.path(''),
             '--remote', ctx.attr.remote,
-            '--rev', rev,
+            '--%s' % rev_flag, rev,
             '--vcs', ctx.attr.vcs,
             '--importpath', ctx.attr.importpath,
-        ],
-        environment = fetch_repo_env,
+            '--shallow=%s' % ("true" if ctx.attr.shallow else "false"),
+        ] + _fetch_repo_cache_args(ctx),
+        environment = _fetch_repo_env(ctx),
     )
     if result.return_code:
       fail("failed to fetch %s: %s" % (ctx.name, result.stderr))
@@ -80,6 +102,8 @@ def _go_repository_impl(ctx):
             "--build_tags", ",".join(ctx.attr.build_tags)]
     if ctx.attr.build_file_name:
         cmds += ["--build_file_name", ctx.attr.build_file_name]
+    if ctx.attr.build_file_proto_mode:
+        cmds += ["--proto", ctx.attr.build_file_proto_mode]
     cmds += [ctx.path('')]
     result = env_execute(ctx, cmds)
     if result.return_code:
@@ -98,6 +122,11 @@ go_repository = repository_rule(
         # Attributes for a repository that cannot be inferred from the import path
         "vcs": attr.string(default="", values=["", "git", "hg", "svn", "bzr"]),
         "remote": attr.string(),
+        "shallow": attr.bool(default = False),
+
+        # Attributes for a Go module downloaded from GOPROXY
+        "version": attr.string(),
+        "sum": attr.string(),
 
         # Attributes for a repository that comes from a source blob not a vcs
         "urls": attr.string_list(),
@@ -108,6 +137,7 @@ go_repository = repository_rule(
         # Attributes for a repository that needs automatic build file generation
         "build_file_name": attr.string(default="BUILD.bazel,BUILD"),
         "build_file_generation": attr.string(default="auto", values=["on", "auto", "off"]),
+        "build_file_proto_mode": attr.string(default="", values=["", "default", "legacy", "disable"]),
         "build_tags": attr.string_list(),
 
         # Hidden attributes for tool dependancies
@@ -128,6 +158,38 @@ go_repository = repository_rule(
     },
 )
 
+# Environment variables passed through to fetch_repo. The GO* variables
+# select module proxies and private modules, like they do for the go command.
+_FETCH_REPO_ENV_VARS = [
+    "SSH_AUTH_SOCK",
+    "HTTP_PROXY",
+    "HTTPS_PROXY",
+    "NO_PROXY",
+    "GOPROXY",
+    "GOPRIVATE",
+    "GONOPROXY",
+    "GONOSUMDB",
+]
+
+def _fetch_repo_env(ctx):
+  env = {
+      "PATH": ctx.os.environ["PATH"],  # to find git
+  }
+  for name in _FETCH_REPO_ENV_VARS:
+    if name in ctx.os.environ:
+      env[name] = ctx.os.environ[name]
+  return env
+
+# GO_REPOSITORY_CACHE names a directory where fetch_repo keeps git mirrors and
+# module zips, shared by all go_repository rules and workspaces on a machine.
+_CACHE_ENV_VAR = "GO_REPOSITORY_CACHE"
+
+def _fetch_repo_cache_args(ctx):
+  cache_dir = ctx.os.environ.get(_CACHE_ENV_VAR, "")
+  if not cache_dir:
+    return []
+  return ['--cache_dir', cache_dir]
+
 # This is for legacy compatability
 # Originally this was the only rule that triggered BUILD file generation.
 def new_go_repository(name, **kwargs):
@@ -62,6 +62,9 @@ def _go_toolchain_impl(ctx):
       root = ctx.attr.root,
       tools = ctx.files.tools,
       stdlib = ctx.files.stdlib,
+      stdlib_pkg = ctx.file.stdlib_pkg,
+      stdlib_pkg_race = ctx.file.stdlib_pkg_race,
+      stdlib_pkg_msan = ctx.file.stdlib_pkg_msan,
       headers = ctx.attr.headers,
       filter_tags = ctx.executable.filter_tags,
       asm = ctx.executable.asm,
@@ -69,6 +72,7 @@ def _go_toolchain_impl(ctx):
       link = ctx.executable.link,
       cgo = ctx.executable.cgo,
       test_generator = ctx.executable.test_generator,
+      test_xml_report = ctx.file.test_xml_report,
       extract_package = ctx.executable.extract_package,
       link_flags = ctx.attr.link_flags,
       cgo_link_flags = ctx.attr.cgo_link_flags,
@@ -90,12 +94,16 @@ go_toolchain_attrs = go_toolchain_core_attrs + {
     "is_cross": attr.bool(),
     "goos": attr.string(),
     "goarch": attr.string(),
+    "stdlib_pkg": attr.label(allow_files = True, single_file = True),
+    "stdlib_pkg_race": attr.label(allow_files = True, single_file = True),
+    "stdlib_pkg_msan": attr.label(allow_files = True, single_file = True),
     "filter_tags": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/builders:filter_tags")),
     "asm": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/builders:asm")),
     "compile": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/builders:compile")),
     "link": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/builders:link")),
     "cgo": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/builders:cgo")),
     "test_generator": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/builders:generate_test_main")),
+    "test_xml_report": attr.label(allow_files = True, single_file = True, default=Label("//go/tools/builders:xml_report.go")),
     "extract_package": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/extract_package")),
     "link_flags": attr.string_list(default=[]),
     "cgo_link_flags": attr.string_list(default=[]),
@@ -12,11 +12,11 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 
-load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "DEFAULT_LIB", "VENDOR_PREFIX", "go_filetype")
-load("@io_bazel_rules_go//go/private:asm.bzl", "emit_go_asm_action")
+load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "get_instrument", "get_stdlib_pkg", "DEFAULT_LIB", "VENDOR_PREFIX", "go_filetype")
+load("@io_bazel_rules_go//go/private:asm.bzl", "emit_go_asm_action", "get_asm_includes")
 load("@io_bazel_rules_go//go/private:providers.bzl", "GoLibrary", "GoSource")
 
-def emit_library_actions(ctx, sources, deps, cgo_object, library, want_coverage):
+def emit_library_actions(ctx, sources, deps, cgo_object, embed, want_coverage):
   go_toolchain = get_go_toolchain(ctx)
 
   go_srcs = depset([s for s in sources if s.basename.endswith('.go')])
@@ -24,7 +24,7 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library, want_coverage)
   asm_hdrs = [s for s in sources if s.basename.endswith('.h')]
   dep_runfiles = [d.data_runfiles for d in deps]
 
-  if library:
+  for library in embed:
     golib = library[GoLibrary]
     gosrc = library[GoSource]
     go_srcs += gosrc.go_sources
@@ -36,7 +36,7 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library, want_coverage)
       if cgo_object:
         fail("go_library %s cannot have cgo_object because the package " +
              "already has cgo_object in %s" % (ctx.label.name,
-                                               golib.name))
+                                               golib.label))
       cgo_object = golib.cgo_object
   if not go_srcs:
     fail("may not be empty", "srcs")
@@ -53,7 +53,8 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library, want_coverage)
     extra_objects += [obj]
 
   importpath = go_importpath(ctx)
-  lib_name = importpath + ".a"
+  importmap = go_importmap(ctx, importpath)
+  lib_name = importmap + ".a"
   out_lib = ctx.new_file("~lib~/"+lib_name)
   out_object = ctx.new_file("~lib~/" + ctx.label.name + ".o")
   searchpath = out_lib.path[:-len(lib_name)]
@@ -61,6 +62,9 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library, want_coverage)
   race_object = ctx.new_file("~race~/" + ctx.label.name + ".o")
   searchpath_race = race_lib.path[:-len(lib_name)]
   gc_goopts = get_gc_goopts(ctx)
+  importmap_opts = []
+  if importmap != importpath:
+    importmap_opts += ["-p", importmap]
   direct_go_library_deps = []
   direct_go_library_deps_race = []
   direct_search_paths = []
@@ -77,14 +81,22 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library, want_coverage)
     direct_search_paths += [golib.searchpath]
     direct_search_paths_race += [golib.searchpath_race]
     direct_import_paths += [golib.importpath]
+    if golib.importmap != golib.importpath:
+      importmap_opts += ["-importmap", "%s=%s" % (golib.importpath, golib.importmap)]
     transitive_go_library_deps += golib.transitive_go_libraries
     transitive_go_library_deps_race += golib.transitive_go_libraries_race
     transitive_cgo_deps += golib.transitive_cgo_deps
     transitive_go_library_paths += golib.transitive_go_library_paths
     transitive_go_library_paths_race += golib.transitive_go_library_paths_race
 
+  cover_vars = []
   if want_coverage:
-    go_srcs = _emit_go_cover_action(ctx, out_object, go_srcs)
+    go_srcs, cover_vars = _emit_go_cover_action(ctx, out_object, go_srcs, importpath, importmap)
+  transitive_cover_vars = depset(cover_vars)
+  for library in embed:
+    transitive_cover_vars += library[GoLibrary].transitive_cover_vars
+  for dep in deps:
+    transitive_cover_vars += dep[GoLibrary].transitive_cover_vars
 
   emit_go_compile_action(ctx,
       sources = go_srcs,
@@ -92,7 +104,10 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library, want_coverage)
       lib_paths = direct_search_paths,
       direct_paths = direct_import_paths,
       out_object = out_object,
-      gc_goopts = gc_goopts,
+      gc_goopts = gc_goopts + importmap_opts,
+      instrument = get_instrument(ctx),
+      asm_srcs = asm_srcs,
+      asm_hdrs = asm_hdrs,
   )
   emit_go_pack_action(ctx, out_lib, [out_object] + extra_objects)
   emit_go_compile_action(ctx,
@@ -101,7 +116,10 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library, want_coverage)
       lib_paths = direct_search_paths_race,
       direct_paths = direct_import_paths,
       out_object = race_object,
-      gc_goopts = gc_goopts + ["-race"],
+      gc_goopts = gc_goopts + importmap_opts,
+      instrument = "race",
+      asm_srcs = asm_srcs,
+      asm_hdrs = asm_hdrs,
   )
   emit_go_pack_action(ctx, race_lib, [race_object] + extra_objects)
 
@@ -125,6 +143,7 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library, want_coverage)
     asm_sources = asm_srcs,
     asm_headers = asm_hdrs,
     importpath = importpath,
+    importmap = importmap,
     cgo_object = cgo_object,
     direct_deps = deps,
     transitive_cgo_deps = transitive_cgo_deps,
@@ -132,6 +151,7 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library, want_coverage)
     transitive_go_libraries_race = transitive_go_library_deps_race + [race_lib],
     transitive_go_library_paths = transitive_go_library_paths,
     transitive_go_library_paths_race = transitive_go_library_paths_race,
+    transitive_cover_vars = transitive_cover_vars,
     gc_goopts = gc_goopts,
   )
 
@@ -144,7 +164,7 @@ def _go_library_impl(ctx):
       sources = depset(ctx.files.srcs),
       deps = ctx.attr.deps,
       cgo_object = cgo_object,
-      library = ctx.attr.library,
+      embed = get_embed(ctx),
       want_coverage = ctx.coverage_instrumented(),
   )
 
@@ -156,6 +176,7 @@ def _go_library_impl(ctx):
           searchpath = lib_result.searchpath,
           searchpath_race = lib_result.searchpath_race,
           importpath = lib_result.importpath,
+          importmap = lib_result.importmap,
           cgo_object = lib_result.cgo_object,
           direct_deps = lib_result.direct_deps,
           transitive_cgo_deps = lib_result.transitive_cgo_deps,
@@ -163,6 +184,7 @@ def _go_library_impl(ctx):
           transitive_go_libraries_race = lib_result.transitive_go_libraries_race,
           transitive_go_library_paths = lib_result.transitive_go_library_paths,
           transitive_go_library_paths_race = lib_result.transitive_go_library_paths_race,
+          transitive_cover_vars = lib_result.transitive_cover_vars,
           gc_goopts = lib_result.gc_goopts,
       ),
       GoSource(
@@ -186,7 +208,9 @@ go_library = rule(
         "srcs": attr.label_list(allow_files = go_filetype),
         "deps": attr.label_list(providers = [GoLibrary]),
         "importpath": attr.string(),
+        "importmap": attr.string(),
         "library": attr.label(providers = [GoLibrary]),
+        "embed": attr.label_list(providers = [GoLibrary]),
         "gc_goopts": attr.string_list(),
         "cgo_object": attr.label(
             providers = [
@@ -226,13 +250,54 @@ def go_importpath(ctx):
     path = path[1:]
   return path
 
+def go_importmap(ctx, importpath):
+  """Returns the path the go_library being built is compiled and linked as.
+
+  This is the importmap attribute, if set, and importpath otherwise. Packages
+  with the same importpath, like copies of a package vendored in different
+  places, must have different importmaps to be linked into the same binary.
+  Libraries without the attribute, like the one built for a go_test, use the
+  importmap of the library they embed.
+
+  Args:
+    ctx: The skylark Context
+    importpath: the importpath of the library, from go_importpath
+
+  Returns:
+    Go importmap of the library
+  """
+  if getattr(ctx.attr, "importmap", ""):
+    return ctx.attr.importmap
+  for library in get_embed(ctx):
+    if library[GoLibrary].importpath == importpath:
+      return library[GoLibrary].importmap
+  return importpath
+
+def get_embed(ctx):
+  """Returns the libraries whose sources are compiled into the rule being built.
+
+  These are the libraries in the embed attribute, and the library in the
+  deprecated library attribute, if it's set.
+
+  Args:
+    ctx: The skylark Context
+
+  Returns:
+    List of targets providing GoLibrary and GoSource
+  """
+  embed = list(ctx.attr.embed)
+  if ctx.attr.library:
+    embed = [ctx.attr.library] + embed
+  return embed
+
 def get_gc_goopts(ctx):
   gc_goopts = ctx.attr.gc_goopts
-  if ctx.attr.library:
-    gc_goopts += ctx.attr.library[GoLibrary].gc_goopts
+  for library in get_embed(ctx):
+    gc_goopts += library[GoLibrary].gc_goopts
   return gc_goopts
 
-def emit_go_compile_action(ctx, sources, libs, lib_paths, direct_paths, out_object, gc_goopts):
+def emit_go_compile_action(ctx, sources, libs, lib_paths, direct_paths, out_object, gc_goopts, instrument="",
+                           asm_srcs=[], asm_hdrs=[]):
   """Construct the command line for compiling Go code.
 
   Args:
@@ -244,6 +309,11 @@ def emit_go_compile_action(ctx, sources, libs, lib_paths, direct_paths, out_obje
       including those in the library attribute. Used for strict dep checking.
     out_object: the object file that should be produced
     gc_goopts: additional flags to pass to the compiler.
+    instrument: "race" or "msan" to instrument the code, which also
+      selects the standard library compiled the same way.
+    asm_srcs: assembly sources in the same package. Go 1.12 and later need
+      the ABIs of the functions they define to compile the Go sources.
+    asm_hdrs: headers the assembly sources may include.
   """
   go_toolchain = get_go_toolchain(ctx)
   gc_goopts = [ctx.expand_make_variables("gc_goopts", f, {}) for f in gc_goopts]
@@ -258,6 +328,18 @@ def emit_go_compile_action(ctx, sources, libs, lib_paths, direct_paths, out_obje
   args += ["-o", out_object.path, "-trimpath", ".", "-I", "."]
   for path in lib_paths:
     args += ["-I", path]
+  stdlib_pkg = get_stdlib_pkg(go_toolchain, instrument)
+  if stdlib_pkg:
+    inputs += [stdlib_pkg]
+    args += ["-I", stdlib_pkg.path]
+  if instrument:
+    args += ["-instrument", instrument]
+  if asm_srcs:
+    inputs += asm_srcs + asm_hdrs + list(go_toolchain.headers.cc.transitive_headers)
+    for src in asm_srcs:
+      args += ["-asmsrc", src.path]
+    for inc in get_asm_includes(go_toolchain, asm_hdrs):
+      args += ["-asm_include", inc]
   args += ["--"] + gc_goopts + cgo_sources
   ctx.action(
       inputs = list(inputs),
@@ -286,7 +368,7 @@ def emit_go_pack_action(ctx, out_lib, objects):
       env = go_toolchain.env,
   )
 
-def _emit_go_cover_action(ctx, out_object, sources):
+def _emit_go_cover_action(ctx, out_object, sources, importpath, importmap):
   """Construct the command line for test coverage instrument.
 
   Args:
@@ -294,12 +376,18 @@ def _emit_go_cover_action(ctx, out_object, sources):
     out_object: the object file for the library being compiled. Used to name
       cover files.
     sources: an iterable of Go source files.
+    importpath: the import path of the library, used to name files in
+      coverage profiles.
+    importmap: the path the library is compiled as.
 
   Returns:
-    A list of Go source code files which might be coverage instrumented.
+    A list of Go source code files which might be coverage instrumented, and
+    a list of "<importmap>=<var>=<file>" strings describing the coverage
+    variables, for the test main generator's --cover flag.
   """
   go_toolchain = get_go_toolchain(ctx)
   outputs = []
+  cover_vars = []
   # TODO(linuxerwang): make the mode configurable.
   count = 0
 
@@ -313,6 +401,7 @@ def _emit_go_cover_action(ctx, out_object, sources):
     cover_var = "GoCover_%d" % count
     out = ctx.new_file(out_object, out_object.basename + '_' + src.basename[:-3] + '_' + cover_var + '.cover.go')
     outputs += [out]
+    cover_vars += ["%s=%s=%s/%s" % (importmap, cover_var, importpath, src.basename)]
     ctx.action(
         inputs = [src] + go_toolchain.tools,
         outputs = [out],
@@ -323,4 +412,4 @@ def _emit_go_cover_action(ctx, out_object, sources):
     )
     count += 1
 
-  return outputs
+  return outputs, cover_vars
@@ -0,0 +1,205 @@
+# Copyright 2017 The Bazel Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load("@io_bazel_rules_go//go/private:common.bzl", "get_stdlib_pkg")
+load("@io_bazel_rules_go//go/private:go_toolchain.bzl", "go_toolchain_type")
+load("@io_bazel_rules_go//go/private:providers.bzl", "GoLibrary", "GoSource")
+load("@io_bazel_rules_go//go/private:wrappers.bzl", "go_binary_macro")
+
+NogoInfo = provider()
+
+_NogoOutputs = provider()
+
+_NOGO_MAIN_TEMPLATE = """// Generated by nogo for {label}. DO NOT EDIT.
+
+package main
+
+import (
+	"github.com/bazelbuild/rules_go/go/tools/nogo"
+{imports}
+)
+
+func main() {{
+	nogo.Main(
+{analyzers}
+	)
+}}
+"""
+
+def _nogo_main_impl(ctx):
+  imports = []
+  analyzers = []
+  for i, dep in enumerate(ctx.attr.deps):
+    imports += ['\ta%d "%s"' % (i, dep[GoLibrary].importpath)]
+    analyzers += ["\t\ta%d.Analyzer," % i]
+  ctx.file_action(
+      output = ctx.outputs.out,
+      content = _NOGO_MAIN_TEMPLATE.format(
+          label = str(ctx.label),
+          imports = "\n".join(imports),
+          analyzers = "\n".join(analyzers),
+      ),
+  )
+
+_nogo_main = rule(
+    _nogo_main_impl,
+    attrs = {
+        "deps": attr.label_list(providers = [GoLibrary]),
+        "out": attr.output(mandatory = True),
+    },
+)
+
+def _nogo_impl(ctx):
+  return [NogoInfo(
+      binary = ctx.executable.binary,
+      config = ctx.file.config,
+  )]
+
+_nogo = rule(
+    _nogo_impl,
+    attrs = {
+        "binary": attr.label(executable = True, cfg = "host", mandatory = True),
+        "config": attr.label(allow_single_file = True),
+    },
+)
+
+def nogo(name, deps, config = None, visibility = None):
+  """nogo builds a program that runs static analyzers on Go packages.
+
+  Each library in deps must have an exported variable named Analyzer of type
+  *golang.org/x/tools/go/analysis.Analyzer, like the libraries in
+  golang.org/x/tools/go/analysis/passes. The program is run on each
+  go_library by nogo_aspect, once it's selected with
+  go_repositories(nogo = ...).
+
+  Args:
+    name: A unique name for this rule.
+    deps: Libraries providing the analyzers to run.
+    config: Optional JSON file mapping analyzer names to files they should
+        or shouldn't report findings for. See go/tools/nogo for the format.
+  """
+  _nogo_main(
+      name = name + "_main",
+      deps = deps,
+      out = name + "_main.go",
+  )
+  go_binary_macro(
+      name = name + "_bin",
+      srcs = [name + "_main.go"],
+      deps = deps + ["@io_bazel_rules_go//go/tools/nogo:go_default_library"],
+      visibility = ["//visibility:private"],
+  )
+  _nogo(
+      name = name,
+      binary = name + "_bin",
+      config = config,
+      visibility = visibility,
+  )
+
+def _nogo_aspect_impl(target, ctx):
+  outputs = depset()
+  deps = list(getattr(ctx.rule.attr, "deps", []))
+  deps += getattr(ctx.rule.attr, "embed", [])
+  library = getattr(ctx.rule.attr, "library", None)
+  if library:
+    deps += [library]
+  for dep in deps:
+    if _NogoOutputs in dep:
+      outputs += dep[_NogoOutputs].outputs
+
+  # Libraries in other repositories aren't checked, since their findings
+  # can't be fixed here.
+  if (NogoInfo in ctx.attr._nogo and GoLibrary in target and
+      ctx.rule.kind == "go_library" and not target.label.workspace_root):
+    nogo = ctx.attr._nogo[NogoInfo]
+    golib = target[GoLibrary]
+    go_toolchain = ctx.rule.attr._go_toolchain[go_toolchain_type]
+    sources = list(target[GoSource].go_sources)
+    out = ctx.new_file(ctx.label.name + ".nogo.txt")
+    stdlib_pkg = get_stdlib_pkg(go_toolchain, "")
+    if stdlib_pkg:
+      stdlib_dir = stdlib_pkg.path
+      inputs = sources + [stdlib_pkg]
+    else:
+      stdlib_dir = "%s/pkg/%s_%s" % (go_toolchain.env["GOROOT"], go_toolchain.env["GOOS"], go_toolchain.env["GOARCH"])
+      inputs = sources + go_toolchain.stdlib
+    args = [
+        "-importpath", golib.importpath,
+        "-stdlib", stdlib_dir,
+        "-o", out.path,
+    ]
+    if nogo.config:
+      args += ["-config", nogo.config.path]
+      inputs += [nogo.config]
+    for dep in golib.direct_deps:
+      deplib = dep[GoLibrary]
+      args += ["-archive", "%s=%s" % (deplib.importpath, deplib.library.path)]
+      inputs += [deplib.library]
+    ctx.action(
+        inputs = inputs,
+        outputs = [out],
+        executable = nogo.binary,
+        arguments = args + [s.path for s in sources],
+        env = go_toolchain.env,
+        mnemonic = "GoNogo",
+        progress_message = "Checking %s with nogo" % ctx.label,
+    )
+    outputs += [out]
+
+  return [
+      _NogoOutputs(outputs = outputs),
+      OutputGroupInfo(nogo = outputs),
+  ]
+
+nogo_aspect = aspect(
+    _nogo_aspect_impl,
+    attr_aspects = ["deps", "embed", "library"],
+    attrs = {
+        "_nogo": attr.label(
+            default = Label("@io_bazel_rules_nogo//:nogo"),
+            cfg = "host",
+        ),
+    },
+)
+"""nogo_aspect runs the nogo program selected with go_repositories(nogo = ...)
+on each go_library in the main repository that the targets it's applied to
+depend on. Findings are written to files in the nogo output group, and the
+build fails if there are any. To check every build, add this to .bazelrc:
+
+    build --aspects=@io_bazel_rules_go//go:def.bzl%nogo_aspect
+    build --output_groups=+nogo
+"""
+
+_NOGO_BUILD_FILE = """
+alias(
+    name = "nogo",
+    actual = "{nogo}",
+    visibility = ["//visibility:public"],
+)
+"""
+
+def _nogo_repository_impl(ctx):
+  nogo = ctx.attr.nogo
+  if nogo.startswith("//"):
+    # Labels in the main repository must name it explicitly here.
+    nogo = "@" + nogo
+  ctx.file("BUILD.bazel", _NOGO_BUILD_FILE.format(nogo = nogo))
+
+nogo_repository = repository_rule(
+    _nogo_repository_impl,
+    attrs = {
+        "nogo": attr.string(default = "@io_bazel_rules_go//go/private:nogo_disabled"),
+    },
+)
@@ -17,6 +17,7 @@
 load("@io_bazel_rules_go//go/private:toolchain.bzl", "go_sdk_repository", "go_repository_select")
 load("@io_bazel_rules_go//go/private:repository_tools.bzl", "go_repository_tools")
 load("@io_bazel_rules_go//go/private:go_repository.bzl", "go_repository")
+load("@io_bazel_rules_go//go/private:nogo.bzl", "nogo_repository")
 
 _sdk_repositories = {
     # 1.8.3 repositories
@@ -58,7 +59,8 @@ _sdk_repositories = {
 def go_repositories(
     go_version = None,
     go_linux = None,
-    go_darwin = None):
+    go_darwin = None,
+    nogo = None):
 
   for filename, sha256 in _sdk_repositories.items():
     name = filename
@@ -81,14 +83,20 @@ def go_repositories(
       type = "zip",
   )
 
-  # Needed for fetch repo
-  go_repository(
-      name = "org_golang_x_tools",
-      importpath = "golang.org/x/tools",
-      urls = ["https://codeload.github.com/golang/tools/zip/3d92dd60033c312e3ae7cac319c792271cf67e37"],
-      strip_prefix = "tools-3d92dd60033c312e3ae7cac319c792271cf67e37",
-      type = "zip",
-  )
+  # Needed for fetch repo. nogo needs a newer version with go/analysis, so
+  # a version declared before go_repositories is used instead.
+  if "org_golang_x_tools" not in native.existing_rules():
+    go_repository(
+        name = "org_golang_x_tools",
+        importpath = "golang.org/x/tools",
+        urls = ["https://codeload.github.com/golang/tools/zip/3d92dd60033c312e3ae7cac319c792271cf67e37"],
+        strip_prefix = "tools-3d92dd60033c312e3ae7cac319c792271cf67e37",
+        type = "zip",
+    )
 
   go_repository_select(name = "io_bazel_rules_go_toolchain", go_version = go_version)
   go_repository_tools(name = "io_bazel_rules_go_repository_tools")
+  if nogo:
+    nogo_repository(name = "io_bazel_rules_nogo", nogo = nogo)
+  else:
+    nogo_repository(name = "io_bazel_rules_nogo")
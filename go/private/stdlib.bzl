@@ -0,0 +1,70 @@
+# Copyright 2017 The Bazel Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+def _go_stdlib_impl(ctx):
+  # The set of archives depends on the Go version and platform, so the
+  # output is a directory rather than a list of files.
+  out = ctx.experimental_new_directory(ctx.label.name)
+  args = [ctx.executable.go.path, "-out", out.path]
+  if ctx.attr.instrument:
+    args += ["-instrument", ctx.attr.instrument]
+  if ctx.attr.build_tags:
+    args += ["-tags", ",".join(ctx.attr.build_tags)]
+  ctx.action(
+      inputs = ctx.files.srcs + ctx.files.tools + [ctx.executable.go],
+      outputs = [out],
+      mnemonic = "GoStdlib",
+      executable = ctx.executable._stdlib,
+      arguments = args,
+      env = {
+          "GOROOT": ctx.attr.root.path,
+          "GOOS": ctx.attr.goos,
+          "GOARCH": ctx.attr.goarch,
+      },
+  )
+  return [DefaultInfo(files = depset([out]))]
+
+go_stdlib = rule(
+    _go_stdlib_impl,
+    attrs = {
+        "root": attr.label(mandatory = True),
+        "go": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", mandatory = True),
+        "tools": attr.label(allow_files = True),
+        "srcs": attr.label(allow_files = True),
+        "goos": attr.string(mandatory = True),
+        "goarch": attr.string(mandatory = True),
+        "instrument": attr.string(values = ["", "race", "msan"]),
+        "build_tags": attr.string_list(),
+        "_stdlib": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/builders:stdlib")),
+    },
+)
+"""Compiles the Go standard library once for a platform.
+
+The archives are written to a directory named after the rule, which compile
+and link actions search before the distribution's pkg directory. Toolchains
+declare one go_stdlib for their target platform and one for each
+instrumentation mode, so every action with the same GOOS, GOARCH, tags, and
+mode shares the same cached archives.
+
+Args:
+  root: the go_root of the distribution.
+  go: the go binary.
+  tools: the distribution's pkg/tool files.
+  srcs: the standard library sources.
+  goos, goarch: the target platform.
+  instrument: "race" or "msan" to compile instrumented code. The
+    modes need cgo, so they can't be used when cross-compiling.
+  build_tags: build tags to compile with.
+"""
@@ -12,8 +12,8 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 
-load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "go_filetype", "pkg_dir")
-load("@io_bazel_rules_go//go/private:library.bzl", "emit_library_actions", "go_importpath", "emit_go_compile_action", "get_gc_goopts", "emit_go_pack_action")
+load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "get_instrument", "go_filetype", "pkg_dir")
+load("@io_bazel_rules_go//go/private:library.bzl", "emit_library_actions", "get_embed", "go_importpath", "emit_go_compile_action", "get_gc_goopts", "emit_go_pack_action")
 load("@io_bazel_rules_go//go/private:binary.bzl", "emit_go_link_action", "gc_linkopts")
 load("@io_bazel_rules_go//go/private:providers.bzl", "GoLibrary", "GoBinary")
 
@@ -28,7 +28,7 @@ def _go_test_impl(ctx):
       sources = depset(ctx.files.srcs),
       deps = ctx.attr.deps,
       cgo_object = None,
-      library = ctx.attr.library,
+      embed = get_embed(ctx),
       want_coverage = False,
   )
   main_go = ctx.new_file(ctx.label.name + "_main_test.go")
@@ -36,6 +36,23 @@ def _go_test_impl(ctx):
   main_lib = ctx.new_file(ctx.label.name + "_main_test.a")
   run_dir = pkg_dir(ctx.label.workspace_root, ctx.label.package)
 
+  # Packages instrumented for coverage are imported by the generated main, so
+  # it can register their counters. They're imported by the path they're
+  # compiled as, so they're found without -importmap flags.
+  cover_vars = list(lib_result.transitive_cover_vars)
+  covered_paths = {}
+  for v in cover_vars:
+    covered_paths[v.split("=", 1)[0]] = True
+  covered_paths = sorted(covered_paths.keys())
+
+  # With xml_report, the generated main calls a function defined in a source
+  # file from the toolchain, which is compiled into the same package.
+  main_srcs = [main_go]
+  gen_args = []
+  if ctx.attr.xml_report:
+    main_srcs.append(go_toolchain.test_xml_report)
+    gen_args.append("--xml_report")
+
   ctx.action(
       inputs = list(lib_result.go_sources),
       outputs = [main_go],
@@ -48,19 +65,41 @@ def _go_test_impl(ctx):
           run_dir,
           '--output',
           main_go.path,
-      ] + [src.path for src in lib_result.go_sources],
+      ] + gen_args + ['--cover=' + v for v in cover_vars] + [src.path for src in lib_result.go_sources],
       env = dict(go_toolchain.env, RUNDIR=ctx.label.package)
   )
 
-  if "race" not in ctx.features:
+  # The generated main package imports the library by its importpath, which
+  # may need to be mapped to the path the library was compiled as.
+  main_importmap = []
+  if lib_result.importmap != lib_result.importpath:
+    main_importmap = ["-importmap", "%s=%s" % (lib_result.importpath, lib_result.importmap)]
+
+  main_libs = [lib_result.library]
+  main_libs_race = [lib_result.race]
+  main_lib_paths = [lib_result.searchpath]
+  main_lib_paths_race = [lib_result.searchpath_race]
+  if covered_paths:
+    # The library under test comes first, so it's found instead of the
+    # version of the package without tests.
+    main_libs += list(lib_result.transitive_go_libraries)
+    main_libs_race += list(lib_result.transitive_go_libraries_race)
+    main_lib_paths += list(lib_result.transitive_go_library_paths)
+    main_lib_paths_race += list(lib_result.transitive_go_library_paths_race)
+
+  # The race detector is enabled with --features=race or the race attribute.
+  # Other modes use the libraries compiled with --define go_instrument.
+  if "race" not in ctx.features and not ctx.attr.race:
+    instrument = get_instrument(ctx)
     emit_go_compile_action(
       ctx,
-      sources=depset([main_go]),
-      libs=[lib_result.library],
-      lib_paths=[lib_result.searchpath],
-      direct_paths=[lib_result.importpath],
+      sources=depset(main_srcs),
+      libs=main_libs,
+      lib_paths=main_lib_paths,
+      direct_paths=[lib_result.importpath] + covered_paths,
       out_object=main_object,
-      gc_goopts=get_gc_goopts(ctx),
+      gc_goopts=get_gc_goopts(ctx) + main_importmap,
+      instrument=instrument,
     )
     emit_go_pack_action(ctx, main_lib, [main_object])
     emit_go_link_action(
@@ -71,16 +110,18 @@ def _go_test_impl(ctx):
       libs=[main_lib],
       executable=ctx.outputs.executable,
       gc_linkopts=gc_linkopts(ctx),
-      x_defs=ctx.attr.x_defs)
+      x_defs=ctx.attr.x_defs,
+      instrument=instrument)
   else:
     emit_go_compile_action(
       ctx,
-      sources=depset([main_go]),
-      libs=[lib_result.race],
-      lib_paths=[lib_result.searchpath_race],
-      direct_paths=[lib_result.importpath],
+      sources=depset(main_srcs),
+      libs=main_libs_race,
+      lib_paths=main_lib_paths_race,
+      direct_paths=[lib_result.importpath] + covered_paths,
       out_object=main_object,
-      gc_goopts=get_gc_goopts(ctx) + ["-race"],
+      gc_goopts=get_gc_goopts(ctx) + main_importmap,
+      instrument="race",
     )
     emit_go_pack_action(ctx, main_lib, [main_object])
     emit_go_link_action(
@@ -90,8 +131,9 @@ def _go_test_impl(ctx):
       cgo_deps=lib_result.transitive_cgo_deps,
       libs=[main_lib],
       executable=ctx.outputs.executable,
-      gc_linkopts=gc_linkopts(ctx) + ["-race"],
-      x_defs=ctx.attr.x_defs)
+      gc_linkopts=gc_linkopts(ctx),
+      x_defs=ctx.attr.x_defs,
+      instrument="race")
 
   # TODO(bazel-team): the Go tests should do a chdir to the directory
   # holding the data files, so open-source go tests continue to work
@@ -119,10 +161,13 @@ go_test = rule(
         "deps": attr.label_list(providers = [GoLibrary]),
         "importpath": attr.string(),
         "library": attr.label(providers = [GoLibrary]),
+        "embed": attr.label_list(providers = [GoLibrary]),
         "gc_goopts": attr.string_list(),
         "gc_linkopts": attr.string_list(),
         "linkstamp": attr.string(),
         "x_defs": attr.string_dict(),
+        "xml_report": attr.bool(),
+        "race": attr.bool(),
         #TODO(toolchains): Remove _toolchain attribute when real toolchains arrive
         "_go_toolchain": attr.label(default = Label("@io_bazel_rules_go_toolchain//:go_toolchain")),
         "_go_prefix": attr.label(default = Label(
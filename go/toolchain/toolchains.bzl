@@ -1,5 +1,6 @@
 load('//go/private:go_toolchain.bzl', 'go_toolchain', 'platform', 'constraint_setting', 'constraint_value')
 load('//go/private:go_tool_binary.bzl', 'go_bootstrap_toolchain')
+load('//go/private:stdlib.bzl', 'go_stdlib')
 
 def generate_toolchains():
   # Compatability declarations
@@ -182,8 +183,28 @@ def generate_toolchains():
     if toolchain["goos"] == os_linux.goos:
       toolchain["cgo_link_flags"] += ["-Wl,-whole-archive"]
 
-  # Use the final dictionaries to actually generate all the toolchains
+  # Use the final dictionaries to actually generate all the toolchains.
+  # Each toolchain compiles the standard library for its target once for
+  # each instrumentation mode, instead of using the distribution's pkg
+  # directory, which only has archives for the host. The instrumented
+  # versions are only built when something asks for them.
   for toolchain in toolchains:
+    for instrument in ["", "race", "msan"]:
+      suffix = "-stdlib-" + instrument if instrument else "-stdlib"
+      go_stdlib(
+          name = toolchain["name"] + suffix,
+          root = toolchain["root"],
+          go = toolchain["go"],
+          tools = toolchain["tools"],
+          srcs = toolchain["stdlib"],
+          goos = toolchain["goos"],
+          goarch = toolchain["goarch"],
+          instrument = instrument,
+          tags = ["manual"],
+      )
+    toolchain["stdlib_pkg"] = ":" + toolchain["name"] + "-stdlib"
+    toolchain["stdlib_pkg_race"] = ":" + toolchain["name"] + "-stdlib-race"
+    toolchain["stdlib_pkg_msan"] = ":" + toolchain["name"] + "-stdlib-msan"
     go_toolchain(**toolchain)
     if not toolchain["is_cross"]:
       go_bootstrap_toolchain(
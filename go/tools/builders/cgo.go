@@ -60,14 +60,88 @@ func testCgo(src string, data []byte) (bool, string, error) {
 	return false, parsed.Name.String(), nil
 }
 
+// cdepInfo holds the include directories, defines, and frameworks that
+// cc_library dependencies propagate to a cgo package.
+type cdepInfo struct {
+	includes, quoteIncludes, systemIncludes multiFlag
+	defines                                 multiFlag
+	frameworkDirs, frameworks               multiFlag
+}
+
+// flags returns the C compiler and linker flags for d. Relative directories
+// are made absolute with execRoot, so they're found wherever the C compiler
+// runs. Dependencies often share headers and frameworks, so each flag
+// appears only once, in the order it was first seen.
+func (d *cdepInfo) flags(execRoot string) (copts, linkopts []string) {
+	seen := map[*[]string]map[string]bool{
+		&copts:    make(map[string]bool),
+		&linkopts: make(map[string]bool),
+	}
+	add := func(opts *[]string, flag, value string) {
+		if seen[opts][flag+" "+value] {
+			return
+		}
+		seen[opts][flag+" "+value] = true
+		*opts = append(*opts, flag, value)
+	}
+	abs := func(dir string) string {
+		if filepath.IsAbs(dir) {
+			return dir
+		}
+		return filepath.Join(execRoot, dir)
+	}
+	for _, define := range d.defines {
+		add(&copts, "-D", define)
+	}
+	for _, dir := range d.includes {
+		add(&copts, "-I", abs(dir))
+	}
+	for _, dir := range d.quoteIncludes {
+		add(&copts, "-iquote", abs(dir))
+	}
+	for _, dir := range d.systemIncludes {
+		add(&copts, "-isystem", abs(dir))
+	}
+	for _, dir := range d.frameworkDirs {
+		add(&copts, "-F", abs(dir))
+		add(&linkopts, "-F", abs(dir))
+	}
+	for _, framework := range d.frameworks {
+		add(&linkopts, "-framework", framework)
+	}
+	return copts, linkopts
+}
+
+// expandSrcDir replaces ${SRCDIR} in each of opts with srcdir, the
+// directory of the package, as the go tool does in #cgo directives. This
+// lets copts and clinkopts in build files use the same flags.
+func expandSrcDir(opts []string, srcdir string) []string {
+	expanded := make([]string, len(opts))
+	for i, opt := range opts {
+		expanded[i] = strings.Replace(opt, "${SRCDIR}", srcdir, -1)
+	}
+	return expanded
+}
+
 func run(args []string) error {
 	sources := multiFlag{}
+	linkopts := multiFlag{}
+	var cdeps cdepInfo
 	cc := ""
 	objdir := ""
+	srcdir := ""
 	flags := flag.NewFlagSet("cgo", flag.ContinueOnError)
 	flags.Var(&sources, "src", "A source file to be filtered and compiled")
 	flags.StringVar(&cc, "cc", "", "Sets the c compiler to use")
 	flags.StringVar(&objdir, "objdir", "", "The output directory")
+	flags.StringVar(&srcdir, "srcdir", "", "The package directory, substituted for ${SRCDIR} in options")
+	flags.Var(&linkopts, "linkopt", "A flag to pass to the C linker")
+	flags.Var(&cdeps.includes, "cdep_include", "An include directory of a C dependency")
+	flags.Var(&cdeps.quoteIncludes, "cdep_quote_include", "A quote include directory of a C dependency")
+	flags.Var(&cdeps.systemIncludes, "cdep_system_include", "A system include directory of a C dependency")
+	flags.Var(&cdeps.defines, "cdep_define", "A preprocessor define of a C dependency")
+	flags.Var(&cdeps.frameworkDirs, "cdep_framework_dir", "A framework search directory of a C dependency")
+	flags.Var(&cdeps.frameworks, "cdep_framework", "A framework a C dependency links against")
 	// process the args
 	if len(args) < 2 {
 		flags.Usage()
@@ -148,12 +222,29 @@ func run(args []string) error {
 	if abs, err := filepath.Abs(cc); err == nil {
 		cc = abs
 	}
+	execRoot, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if srcdir, err = filepath.Abs(srcdir); err != nil {
+		return err
+	}
+	cdepCopts, cdepLinkopts := cdeps.flags(execRoot)
+	ldflags := append(expandSrcDir(linkopts, srcdir), cdepLinkopts...)
+
 	env := os.Environ()
 	env = append(env, fmt.Sprintf("CC=%s", cc))
 	env = append(env, fmt.Sprintf("CXX=%s", cc))
+	env = append(env, fmt.Sprintf("CGO_LDFLAGS=%s", strings.Join(ldflags, " ")))
 
-	goargs := []string{"tool", "cgo", "-objdir", objdir}
-	goargs = append(goargs, flags.Args()...)
+	// Arguments after "--" are options for the C compiler.
+	copts := flags.Args()
+	if len(copts) > 0 && copts[0] == "--" {
+		copts = copts[1:]
+	}
+	goargs := []string{"tool", "cgo", "-objdir", objdir, "--"}
+	goargs = append(goargs, expandSrcDir(copts, srcdir)...)
+	goargs = append(goargs, cdepCopts...)
 	goargs = append(goargs, cgoSrcs...)
 	cmd := exec.Command(gotool, goargs...)
 	cmd.Stdout = os.Stdout
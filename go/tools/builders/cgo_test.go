@@ -0,0 +1,68 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCdepFlags(t *testing.T) {
+	d := cdepInfo{
+		includes:       multiFlag{"external/zlib", "/usr/include/zlib", "external/zlib"},
+		quoteIncludes:  multiFlag{"bazel-out/genfiles"},
+		systemIncludes: multiFlag{"external/ssl/include"},
+		defines:        multiFlag{"USE_SSL", "VERSION=2", "USE_SSL"},
+		frameworkDirs:  multiFlag{"Frameworks"},
+		frameworks:     multiFlag{"CoreFoundation", "Security", "CoreFoundation"},
+	}
+	copts, linkopts := d.flags("/execroot")
+	wantCopts := []string{
+		"-D", "USE_SSL",
+		"-D", "VERSION=2",
+		"-I", "/execroot/external/zlib",
+		"-I", "/usr/include/zlib",
+		"-iquote", "/execroot/bazel-out/genfiles",
+		"-isystem", "/execroot/external/ssl/include",
+		"-F", "/execroot/Frameworks",
+	}
+	wantLinkopts := []string{
+		"-F", "/execroot/Frameworks",
+		"-framework", "CoreFoundation",
+		"-framework", "Security",
+	}
+	if !reflect.DeepEqual(copts, wantCopts) {
+		t.Errorf("copts: got %q; want %q", copts, wantCopts)
+	}
+	if !reflect.DeepEqual(linkopts, wantLinkopts) {
+		t.Errorf("linkopts: got %q; want %q", linkopts, wantLinkopts)
+	}
+}
+
+func TestExpandSrcDir(t *testing.T) {
+	for _, tc := range []struct {
+		opt, want string
+	}{
+		{opt: "-I${SRCDIR}/include", want: "-I/src/foo/include"},
+		{opt: "${SRCDIR}/libfoo.a", want: "/src/foo/libfoo.a"},
+		{opt: "-L${SRCDIR}/a:${SRCDIR}/b", want: "-L/src/foo/a:/src/foo/b"},
+		{opt: "-DSRCDIR", want: "-DSRCDIR"},
+		{opt: "$SRCDIR", want: "$SRCDIR"},
+	} {
+		if got := expandSrcDir([]string{tc.opt}, "/src/foo"); got[0] != tc.want {
+			t.Errorf("expandSrcDir(%q): got %q; want %q", tc.opt, got[0], tc.want)
+		}
+	}
+}
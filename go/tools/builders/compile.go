@@ -22,10 +22,12 @@ import (
 	"go/build"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -42,12 +44,17 @@ func run(args []string) error {
 	sources := multiFlag{}
 	deps := multiFlag{}
 	search := multiFlag{}
+	asmSources := multiFlag{}
+	asmIncludes := multiFlag{}
 	flags := flag.NewFlagSet("compile", flag.ContinueOnError)
 	flags.Var(&sources, "src", "A source file to be filtered and compiled")
 	flags.Var(&deps, "dep", "Import path of a direct dependency")
 	flags.Var(&search, "I", "Search paths of a direct dependency")
+	flags.Var(&asmSources, "asmsrc", "An assembly source file in the package, scanned for symbol ABIs")
+	flags.Var(&asmIncludes, "asm_include", "An include directory for the assembly sources")
 	trimpath := flags.String("trimpath", "", "The base of the paths to trim")
 	output := flags.String("o", "", "The output object file to write")
+	instrument := flags.String("instrument", "", "Instrument the code for race or msan")
 	// process the args
 	if len(args) < 2 {
 		flags.Usage()
@@ -80,6 +87,28 @@ func run(args []string) error {
 		goargs = append(goargs, "-I", abs(path))
 	}
 	goargs = append(goargs, "-o", *output)
+	instrumentFlags, err := instrumentArgs(*instrument)
+	if err != nil {
+		return err
+	}
+	goargs = append(goargs, instrumentFlags...)
+
+	// Packages with assembly need the ABIs of the assembly functions.
+	asmSources, err = filterFiles(bctx, asmSources)
+	if err != nil {
+		return err
+	}
+	if len(asmSources) > 0 {
+		symabis, cleanup, err := genSymabis(gotool, bctx, asmSources, asmIncludes)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		if symabis != "" {
+			goargs = append(goargs, "-symabis", symabis)
+		}
+	}
+
 	goargs = append(goargs, flags.Args()...)
 	goargs = append(goargs, sources...)
 	cmd := exec.Command(gotool, goargs...)
@@ -97,6 +126,65 @@ func main() {
 	}
 }
 
+// genSymabis runs "go tool asm -gensymabis" on a package's assembly sources
+// and returns the path of the file it writes, which tells the compiler the
+// ABI of each assembly function. Toolchains older than Go 1.12 don't have
+// ABIs, so "" is returned for them. The returned function removes the file.
+func genSymabis(gotool string, bctx build.Context, sources, includes []string) (string, func(), error) {
+	noop := func() {}
+	out, err := exec.Command(gotool, "version").Output()
+	if err != nil {
+		return "", noop, fmt.Errorf("error getting the Go version: %v", err)
+	}
+	if minor, ok := goMinorVersion(string(out)); ok && minor < 12 {
+		return "", noop, nil
+	}
+
+	dir, err := ioutil.TempDir("", "symabis")
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	// Sources may include go_asm.h, which is written by the compiler. Like
+	// "go build", use an empty one, since only the symbols are needed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "go_asm.h"), nil, 0666); err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	symabis := filepath.Join(dir, "symabis")
+	goargs := []string{"tool", "asm", "-gensymabis", "-o", symabis, "-I", dir}
+	for _, inc := range includes {
+		goargs = append(goargs, "-I", abs(inc))
+	}
+	goargs = append(goargs, "-D", "GOOS_"+bctx.GOOS, "-D", "GOARCH_"+bctx.GOARCH)
+	goargs = append(goargs, sources...)
+	cmd := exec.Command(gotool, goargs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		cleanup()
+		return "", noop, fmt.Errorf("error generating symbol ABIs: %v", err)
+	}
+	return symabis, cleanup, nil
+}
+
+var goVersionPattern = regexp.MustCompile(`\bgo1\.(\d+)`)
+
+// goMinorVersion returns the minor version in the output of "go version",
+// like 12 for "go version go1.12.5 linux/amd64". False is returned for
+// development versions, which don't have a release number.
+func goMinorVersion(version string) (int, bool) {
+	m := goVersionPattern.FindStringSubmatch(version)
+	if m == nil {
+		return 0, false
+	}
+	minor, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+	return minor, true
+}
+
 func checkDirectDeps(bctx build.Context, sources, deps []string) error {
 	depSet := make(map[string]bool)
 	for _, d := range deps {
@@ -0,0 +1,35 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestGoMinorVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		minor   int
+		ok      bool
+	}{
+		{version: "go version go1.12.5 linux/amd64", minor: 12, ok: true},
+		{version: "go version go1.9 darwin/amd64", minor: 9, ok: true},
+		{version: "go version go1.11beta2 linux/amd64", minor: 11, ok: true},
+		{version: "go version devel +8e0781e16c Thu Jan 10 00:00:00 2019 +0000 linux/amd64", ok: false},
+	} {
+		minor, ok := goMinorVersion(tc.version)
+		if minor != tc.minor || ok != tc.ok {
+			t.Errorf("goMinorVersion(%q): got %d, %v; want %d, %v", tc.version, minor, ok, tc.minor, tc.ok)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"errors"
 	"flag"
 	"fmt"
@@ -33,6 +34,9 @@ import (
 )
 
 var headerTpl = template.Must(template.New("embed").Parse(`// Generated by go_embed_data for {{.Label}}. DO NOT EDIT.
+{{- if .Compress}}
+// The embedded data is compressed with gzip.
+{{- end}}
 
 package {{.Package}}
 
@@ -56,7 +60,7 @@ func main() {
 
 type configuration struct {
 	Label, Package, Var string
-	Multi               bool
+	Multi, Compress     bool
 	Sources             []string
 	out, workspace      string
 	flatten, strData    bool
@@ -114,6 +118,7 @@ func newConfiguration(args []string) (*configuration, error) {
 	flags.StringVar(&c.workspace, "workspace", "", "Name of the workspace (required)")
 	flags.BoolVar(&c.flatten, "flatten", false, "Whether to access files by base name")
 	flags.BoolVar(&c.strData, "string", false, "Whether to store contents as strings")
+	flags.BoolVar(&c.Compress, "compress", false, "Whether to compress contents with gzip")
 	flags.Parse(args[1:])
 	if c.Label == "" {
 		return nil, errors.New("error: -label option not provided")
@@ -146,7 +151,7 @@ func embedSingleFile(c *configuration, w io.Writer) error {
 	if _, err := fmt.Fprintf(w, "var %s = %s", c.Var, dataBegin); err != nil {
 		return err
 	}
-	if err := embedFileContents(w, c.Sources[0]); err != nil {
+	if err := embedFileContents(w, c.Sources[0], c.Compress); err != nil {
 		return err
 	}
 	_, err := fmt.Fprint(w, dataEnd)
@@ -170,7 +175,7 @@ func embedMultipleFiles(c *configuration, w io.Writer) error {
 		if _, err := fmt.Fprintf(w, "\t%s_%d = %s", c.Var, i, dataBegin); err != nil {
 			return err
 		}
-		if err := embedFileContents(w, filename); err != nil {
+		if err := embedFileContents(w, filename, c.Compress); err != nil {
 			return err
 		}
 		if _, err := fmt.Fprint(w, dataEnd); err != nil {
@@ -181,15 +186,27 @@ func embedMultipleFiles(c *configuration, w io.Writer) error {
 	return err
 }
 
-func embedFileContents(w io.Writer, filename string) error {
+func embedFileContents(w io.Writer, filename string, compress bool) error {
 	f, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	_, err = io.Copy(&escapeWriter{w}, bufio.NewReader(f))
-	return err
+	if !compress {
+		_, err = io.Copy(&escapeWriter{w}, bufio.NewReader(f))
+		return err
+	}
+	// The gzip header is left empty, so the output doesn't depend on the file's
+	// name or modification time.
+	zw, err := gzip.NewWriterLevel(&escapeWriter{w}, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, bufio.NewReader(f)); err != nil {
+		return err
+	}
+	return zw.Close()
 }
 
 type escapeWriter struct {
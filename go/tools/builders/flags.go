@@ -30,3 +30,19 @@ func (m *multiFlag) Set(v string) error {
 	(*m) = append(*m, v)
 	return nil
 }
+
+// instrumentArgs returns the flags that make "go tool compile" or
+// "go tool link" instrument code for mode, which is "race" or "msan". The
+// flags also select the standard library compiled the same way,
+// in a pkg directory with the mode as its suffix, like
+// GOROOT/pkg/linux_amd64_race. No flags are returned if mode is empty.
+func instrumentArgs(mode string) ([]string, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "race", "msan":
+		return []string{"-" + mode, "-installsuffix", mode}, nil
+	default:
+		return nil, fmt.Errorf("unknown instrumentation mode %q; want race or msan", mode)
+	}
+}
@@ -22,20 +22,21 @@ import (
 	"fmt"
 	"go/ast"
 	"go/build"
+	"go/doc"
 	"go/parser"
 	"go/token"
 	"log"
 	"os"
-	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
-	coverFileRegexp = regexp.MustCompile(".+_(?P<cover_var>GoCover_\\d+)\\.cover\\.go")
-
 	testCover      bool     // -cover flag
 	testCoverMode  string   // -covermode flag
 	testCoverPaths []string // -coverpkg flag
@@ -44,12 +45,49 @@ var (
 // CoverVar holds the name of the generated coverage variables targeting
 // the named file.
 type CoverVar struct {
-	File string // local file name
+	File string // file name reported in profiles, like "example.com/foo/foo.go"
 	Var  string // name of count struct
 }
 
+// coverInfo holds the coverage variables of one instrumented package.
 type coverInfo struct {
-	Vars map[string]*CoverVar
+	ImportPath string // path the package is compiled as, which may be an importmap
+	Vars       []CoverVar
+}
+
+// parseCoverFlags groups the values of --cover flags by package. Each value
+// has the form "<importpath>=<var>=<file>". Packages are sorted by import
+// path, so the generated source is deterministic.
+func parseCoverFlags(values []string) ([]coverInfo, error) {
+	byPath := make(map[string]*coverInfo)
+	var paths []string
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid --cover value %q: want <importpath>=<var>=<file>", v)
+		}
+		ci, ok := byPath[parts[0]]
+		if !ok {
+			ci = &coverInfo{ImportPath: parts[0]}
+			byPath[parts[0]] = ci
+			paths = append(paths, parts[0])
+		}
+		ci.Vars = append(ci.Vars, CoverVar{File: parts[2], Var: parts[1]})
+	}
+	sort.Strings(paths)
+	cover := make([]coverInfo, 0, len(paths))
+	for _, p := range paths {
+		cover = append(cover, *byPath[p])
+	}
+	return cover, nil
+}
+
+// Example is an example function with an output comment. Examples without
+// output comments are compiled but not run, like with "go test".
+type Example struct {
+	Name      string // name of the function, like "ExampleFoo"
+	Output    string // expected output
+	Unordered bool   // whether the output lines may be printed in any order
 }
 
 // Cases holds template data.
@@ -58,7 +96,9 @@ type Cases struct {
 	RunDir           string
 	TestNames        []string
 	BenchmarkNames   []string
+	Examples         []Example
 	HasTestMain      bool
+	XMLReport        bool
 	Version17        bool
 	Version18OrNewer bool
 	Cover            []coverInfo
@@ -92,24 +132,25 @@ import (
 	"flag"
 	"log"
 	"os"
+{{if .CoverEnabled}}
+	"path/filepath"
+{{end}}
 {{if .Version17}}
 	"regexp"
 {{end}}
+	"strings"
 	"testing"
 {{if .Version18OrNewer}}
 	"testing/internal/testdeps"
 {{end}}
 
-{{if .TestNames}}
-	undertest "{{.Package}}"
-{{else if .BenchmarkNames}}
+{{if or .TestNames .BenchmarkNames .Examples .HasTestMain}}
 	undertest "{{.Package}}"
 {{end}}
 
 {{if .CoverEnabled}}
-	{{$pkg := .Package}}
 	{{range $i, $p := .Cover}}
-		_cover{{$i}} {{$pkg | printf "%q"}}
+		_cover{{$i}} {{$p.ImportPath | printf "%q"}}
 	{{end}}
 {{end}}
 )
@@ -126,6 +167,12 @@ var benchmarks = []testing.InternalBenchmark{
 {{end}}
 }
 
+var examples = []testing.InternalExample{
+{{range .Examples}}
+	{Name: "{{.Name}}", F: undertest.{{.Name}}, Output: {{printf "%q" .Output}}, Unordered: {{.Unordered}}},
+{{end}}
+}
+
 {{if .CoverEnabled}}
 
 // Only updated by init functions, so no need for atomicity.
@@ -136,7 +183,7 @@ var (
 
 func init() {
 	{{range $i, $p := .Cover}}
-	{{range $file, $cover := $p.Vars}}
+	{{range $cover := $p.Vars}}
 	coverRegisterFile({{printf "%q" $cover.File}}, _cover{{$i}}.{{$cover.Var}}.Count[:], _cover{{$i}}.{{$cover.Var}}.Pos[:], _cover{{$i}}.{{$cover.Var}}.NumStmt[:])
 	{{end}}
 	{{end}}
@@ -166,6 +213,10 @@ func coverRegisterFile(fileName string, counter []uint32, pos []uint32, numStmts
 {{end}}
 
 func main() {
+{{if .XMLReport}}
+	xmlReportMain({{printf "%q" .Package}})
+{{end}}
+
 	if err := os.Chdir("{{.RunDir}}"); err != nil {
 		log.Fatalf("could not change to test directory: %v", err)
 	}
@@ -176,6 +227,28 @@ func main() {
 		}
 	}
 
+	// Accept the benchmark flags of "go test" without the "test." prefix, so
+	// "bazel run //pkg:go_default_test -- -bench=." works like
+	// "-test.bench=.". Flags the test defines itself are left alone.
+	for i, arg := range os.Args[1:] {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if j := strings.Index(name, "="); j >= 0 {
+			name = name[:j]
+		}
+		switch name {
+		case "bench", "benchmem", "benchtime":
+			if flag.Lookup(name) == nil {
+				os.Args[i+1] = "-test." + strings.TrimLeft(arg, "-")
+			}
+		}
+	}
+
 {{if .CoverEnabled}}
 	testing.RegisterCover(testing.Cover{
 		Mode: {{printf "%q" .CoverMode}},
@@ -183,10 +256,18 @@ func main() {
 		Blocks: coverBlocks,
 		CoveredPackages: {{printf "%q" .Covered}},
 	})
+
+	// "bazel coverage" sets COVERAGE_DIR. Write the profile there, unless
+	// another location was requested.
+	if dir := os.Getenv("COVERAGE_DIR"); dir != "" {
+		if f := flag.Lookup("test.coverprofile"); f != nil && f.Value.String() == "" {
+			f.Value.Set(filepath.Join(dir, "coverage.dat"))
+		}
+	}
 {{end}}
 
 {{if .Version18OrNewer}}
-	m := testing.MainStart(testdeps.TestDeps{}, tests, benchmarks, nil)
+	m := testing.MainStart(testdeps.TestDeps{}, tests, benchmarks, examples)
 	{{if not .HasTestMain}}
 	os.Exit(m.Run())
 	{{else}}
@@ -194,9 +275,9 @@ func main() {
 	{{end}}
 {{else if .Version17}}
 	{{if not .HasTestMain}}
-	testing.Main(regexp.MatchString, tests, benchmarks, nil)
+	testing.Main(regexp.MatchString, tests, benchmarks, examples)
 	{{else}}
-	m := testing.MainStart(regexp.MatchString, tests, benchmarks, nil)
+	m := testing.MainStart(regexp.MatchString, tests, benchmarks, examples)
 	undertest.TestMain(m)
 	{{end}}
 {{end}}
@@ -210,6 +291,9 @@ func run(args []string) error {
 	runDir := flags.String("rundir", ".", "Path to directory where tests should run.")
 	out := flags.String("output", "", "output file to write. Defaults to stdout.")
 	tags := flags.String("tags", "", "Only pass through files that match these tags.")
+	xmlReport := flags.Bool("xml_report", false, "Write an XML report when Bazel requests one. xml_report.go must be compiled with the output.")
+	var coverFlags multiFlag
+	flags.Var(&coverFlags, "cover", "Coverage variables of an instrumented package, as <importpath>=<var>=<file>. May be repeated.")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -235,88 +319,47 @@ func run(args []string) error {
 		defer outFile.Close()
 	}
 
-	ci := coverInfo{
-		Vars: map[string]*CoverVar{},
+	cover, err := parseCoverFlags(coverFlags)
+	if err != nil {
+		return err
 	}
 	cases := Cases{
-		Package: *pkg,
-		RunDir:  *runDir,
-		Cover:   []coverInfo{ci},
+		Package:   *pkg,
+		RunDir:    *runDir,
+		XMLReport: *xmlReport,
+		Cover:     cover,
 	}
 	testFileSet := token.NewFileSet()
+	var files []*ast.File
 	for _, f := range filenames {
-		coverVar := extractCoverVar(f)
-		if coverVar != "" {
-			ci.Vars[f] = &CoverVar{
-				File: f,
-				Var:  coverVar,
-			}
-		}
-
 		parse, err := parser.ParseFile(testFileSet, f, nil, parser.ParseComments)
 		if err != nil {
 			return fmt.Errorf("ParseFile(%q): %v", f, err)
 		}
+		files = append(files, parse)
+		if err := addTestFuncs(&cases, testFileSet, parse); err != nil {
+			return err
+		}
+	}
 
-		for _, d := range parse.Decls {
-			fn, ok := d.(*ast.FuncDecl)
-			if !ok {
-				continue
-			}
-			if fn.Recv != nil {
-				continue
-			}
-			if fn.Name.Name == "TestMain" {
-				// TestMain is not, itself, a test
-				cases.HasTestMain = true
-				continue
-			}
-
-			// Here we check the signature of the Test* function. To
-			// be considered a test:
-
-			// 1. The function should have a single argument.
-			if len(fn.Type.Params.List) != 1 {
-				continue
-			}
-
-			// 2. The function should return nothing.
-			if fn.Type.Results != nil {
-				continue
-			}
-
-			// 3. The only parameter should have a type identified as
-			//    *<something>.T
-			starExpr, ok := fn.Type.Params.List[0].Type.(*ast.StarExpr)
-			if !ok {
-				continue
-			}
-			selExpr, ok := starExpr.X.(*ast.SelectorExpr)
-			if !ok {
-				continue
-			}
-
-			// We do not descriminate on the referenced type of the
-			// parameter being *testing.T. Instead we assert that it
-			// should be *<something>.T. This is because the import
-			// could have been aliased as a different identifier.
-
-			if strings.HasPrefix(fn.Name.Name, "Test") {
-				if selExpr.Sel.Name != "T" {
-					continue
-				}
-				cases.TestNames = append(cases.TestNames, fn.Name.Name)
-			}
-			if strings.HasPrefix(fn.Name.Name, "Benchmark") {
-				if selExpr.Sel.Name != "B" {
-					continue
-				}
-				cases.BenchmarkNames = append(cases.BenchmarkNames, fn.Name.Name)
-			}
+	for _, e := range doc.Examples(files...) {
+		if e.Output == "" && !e.EmptyOutput {
+			// Examples without output comments are only compiled.
+			continue
 		}
+		cases.Examples = append(cases.Examples, Example{
+			Name:      "Example" + e.Name,
+			Output:    e.Output,
+			Unordered: e.Unordered,
+		})
 	}
 
-	testCover = len(ci.Vars) > 0
+	testCover = len(cover) > 0
+	if len(cover) > 1 || len(cover) == 1 && cover[0].ImportPath != *pkg {
+		for _, ci := range cover {
+			testCoverPaths = append(testCoverPaths, ci.ImportPath)
+		}
+	}
 
 	goVersion, err := parseVersion(runtime.Version())
 	if err != nil {
@@ -337,6 +380,114 @@ func run(args []string) error {
 	return nil
 }
 
+// addTestFuncs adds the tests and benchmarks declared in f to cases, and
+// records whether f declares TestMain. f may belong to an internal or an
+// external test package; either way, its functions are called through the
+// package named by --package. An error is returned if TestMain has the
+// wrong signature or is declared more than once, since "go test" rejects
+// those packages too.
+func addTestFuncs(cases *Cases, fset *token.FileSet, f *ast.File) error {
+	for _, d := range f.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		if fn.Recv != nil {
+			continue
+		}
+		if fn.Name.Name == "TestMain" {
+			// TestMain is not, itself, a test. The generated main calls it
+			// instead of running the tests directly.
+			if !isTestMain(fn) {
+				return fmt.Errorf("%s: wrong signature for TestMain, must be: func TestMain(m *testing.M)", fset.Position(fn.Pos()))
+			}
+			if cases.HasTestMain {
+				return fmt.Errorf("%s: multiple definitions of TestMain", fset.Position(fn.Pos()))
+			}
+			cases.HasTestMain = true
+			continue
+		}
+
+		// Here we check the signature of the Test* function. To
+		// be considered a test:
+
+		// 1. The function should have a single argument.
+		if len(fn.Type.Params.List) != 1 {
+			continue
+		}
+
+		// 2. The function should return nothing.
+		if fn.Type.Results != nil {
+			continue
+		}
+
+		// 3. The only parameter should have a type identified as
+		//    *<something>.T
+		starExpr, ok := fn.Type.Params.List[0].Type.(*ast.StarExpr)
+		if !ok {
+			continue
+		}
+		selExpr, ok := starExpr.X.(*ast.SelectorExpr)
+		if !ok {
+			continue
+		}
+
+		// We do not descriminate on the referenced type of the
+		// parameter being *testing.T. Instead we assert that it
+		// should be *<something>.T. This is because the import
+		// could have been aliased as a different identifier.
+
+		if isTestFunc(fn.Name.Name, "Test") {
+			if selExpr.Sel.Name != "T" {
+				continue
+			}
+			cases.TestNames = append(cases.TestNames, fn.Name.Name)
+		}
+		if isTestFunc(fn.Name.Name, "Benchmark") {
+			if selExpr.Sel.Name != "B" {
+				continue
+			}
+			cases.BenchmarkNames = append(cases.BenchmarkNames, fn.Name.Name)
+		}
+	}
+	return nil
+}
+
+// isTestMain returns whether fn has the signature of TestMain: a single
+// parameter of type *<something>.M, and no results. Like for tests, the
+// package name isn't checked, since testing may be imported with another
+// name.
+func isTestMain(fn *ast.FuncDecl) bool {
+	if fn.Type.Results != nil && len(fn.Type.Results.List) > 0 {
+		return false
+	}
+	params := fn.Type.Params.List
+	if len(params) != 1 || len(params[0].Names) > 1 {
+		return false
+	}
+	starExpr, ok := params[0].Type.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	selExpr, ok := starExpr.X.(*ast.SelectorExpr)
+	return ok && selExpr.Sel.Name == "M"
+}
+
+// isTestFunc returns whether name is the name of a test or benchmark
+// function with the given prefix. Like "go test", the prefix must be
+// followed by the end of the name or a character that isn't a lower-case
+// letter, so "Benchmarking" is not a benchmark.
+func isTestFunc(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
 type version []int
 
 func parseVersion(s string) (version, error) {
@@ -366,14 +517,6 @@ func (x version) Less(y version) bool {
 	return len(x) < len(y)
 }
 
-func extractCoverVar(fn string) string {
-	res := coverFileRegexp.FindStringSubmatch(fn)
-	if len(res) > 1 {
-		return res[1]
-	}
-	return ""
-}
-
 func main() {
 	if err := run(os.Args[1:]); err != nil {
 		log.Fatal(err)
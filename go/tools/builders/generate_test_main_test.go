@@ -0,0 +1,115 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateTestMainTestMain(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "generate_test_main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		label, src, wantErr string
+		wantTestMain        bool
+	}{
+		{
+			label: "internal",
+			src: `package foo
+
+import "testing"
+
+func TestMain(m *testing.M) {}
+`,
+			wantTestMain: true,
+		}, {
+			label: "external with renamed import",
+			src: `package foo_test
+
+import testpkg "testing"
+
+func TestMain(m *testpkg.M) {}
+
+func TestFoo(t *testpkg.T) {}
+`,
+			wantTestMain: true,
+		}, {
+			label: "no TestMain",
+			src: `package foo
+
+import "testing"
+
+func TestFoo(t *testing.T) {}
+`,
+		}, {
+			label: "wrong signature",
+			src: `package foo
+
+import "testing"
+
+func TestMain(t *testing.T) {}
+`,
+			wantErr: "wrong signature for TestMain",
+		}, {
+			label: "multiple",
+			src: `package foo
+
+import "testing"
+
+func TestMain(m *testing.M) {}
+
+func TestMain(m *testing.M) {}
+`,
+			wantErr: "multiple definitions of TestMain",
+		},
+	} {
+		src := filepath.Join(dir, strings.Replace(tc.label, " ", "_", -1)+"_test.go")
+		if err := ioutil.WriteFile(src, []byte(tc.src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		out := src + ".main"
+		err := run([]string{"--package", "example.com/foo", "--output", out, src})
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("[%s] got error %v; want error containing %q", tc.label, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+			continue
+		}
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		main := string(data)
+		if got := strings.Contains(main, "undertest.TestMain(m)"); got != tc.wantTestMain {
+			t.Errorf("[%s] got TestMain call %v; want %v:\n%s", tc.label, got, tc.wantTestMain, main)
+		}
+		if !strings.Contains(main, `undertest "example.com/foo"`) {
+			t.Errorf("[%s] package under test not imported:\n%s", tc.label, main)
+		}
+	}
+}
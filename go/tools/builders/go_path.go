@@ -0,0 +1,173 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// go_path assembles a GOPATH-shaped tree from the sources of Go libraries, for
+// tools that expect that layout. It is invoked by go_path as an action.
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// manifest lists the files to put in the tree. It is written by go_path.
+type manifest struct {
+	Entries []manifestEntry `json:"entries"`
+}
+
+// manifestEntry is a file to put in the tree. Src is the path of the file,
+// relative to the execution root. Dst is its slash-separated path within the
+// tree, like "src/example.com/foo/foo.go".
+type manifestEntry struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+func main() {
+	log.SetPrefix("go_path: ")
+	log.SetFlags(0)
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("go_path", flag.ContinueOnError)
+	manifestPath := flags.String("manifest", "", "JSON file listing the files to put in the tree")
+	out := flags.String("out", "", "directory to create the tree in, or the zip file to write in archive mode")
+	mode := flags.String("mode", "copy", "how files are added: copy, symlink, or archive")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *manifestPath == "" || *out == "" {
+		return fmt.Errorf("-manifest and -out must be set")
+	}
+	data, err := ioutil.ReadFile(*manifestPath)
+	if err != nil {
+		return err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%s: %v", *manifestPath, err)
+	}
+
+	switch *mode {
+	case "copy":
+		return writeTree(*out, m.Entries, copyFile)
+	case "symlink":
+		return writeTree(*out, m.Entries, symlinkFile)
+	case "archive":
+		return writeArchive(*out, m.Entries)
+	default:
+		return fmt.Errorf("unknown mode %q; want copy, symlink, or archive", *mode)
+	}
+}
+
+// writeTree adds each entry to the directory out with add.
+func writeTree(out string, entries []manifestEntry, add func(src, dst string) error) error {
+	for _, e := range entries {
+		dst := filepath.Join(out, filepath.FromSlash(e.Dst))
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return err
+		}
+		if err := add(e.Src, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the contents and permissions of src to dst.
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fi, err := r.Stat()
+	if err != nil {
+		return err
+	}
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// symlinkFile creates a link at dst to the file src refers to. Links in src's
+// path are resolved first, so the link doesn't point into a sandbox that is
+// deleted after the action runs.
+func symlinkFile(src, dst string) error {
+	target, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return err
+	}
+	return os.Symlink(target, dst)
+}
+
+// writeArchive writes the entries to a zip file. Modification times are
+// omitted, so the archive only changes when the sources do.
+func writeArchive(out string, entries []manifestEntry) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		if err := addToArchive(zw, e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func addToArchive(zw *zip.Writer, e manifestEntry) error {
+	r, err := os.Open(e.Src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fi, err := r.Stat()
+	if err != nil {
+		return err
+	}
+	h := &zip.FileHeader{Name: e.Dst, Method: zip.Deflate}
+	h.SetMode(fi.Mode().Perm())
+	w, err := zw.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestGoPath(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "go_path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"foo/foo.go":      "package foo\n",
+		"foo/foo_amd64.s": "TEXT ·f(SB),0,$0\n",
+		"bar/bar.go":      "package bar\n",
+	}
+	m := manifest{Entries: []manifestEntry{
+		{Src: "foo/foo.go", Dst: "src/example.com/foo/foo.go"},
+		{Src: "foo/foo_amd64.s", Dst: "src/example.com/foo/foo_amd64.s"},
+		{Src: "bar/bar.go", Dst: "src/example.com/foo/bar/bar.go"},
+	}}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(manifestPath, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sources are relative to the execution root, which is the working
+	// directory of the action.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, mode := range []string{"copy", "symlink"} {
+		out := filepath.Join(dir, mode)
+		if err := run([]string{"-manifest", manifestPath, "-out", out, "-mode", mode}); err != nil {
+			t.Errorf("%s: %v", mode, err)
+			continue
+		}
+		for _, e := range m.Entries {
+			path := filepath.Join(out, filepath.FromSlash(e.Dst))
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Errorf("%s: %v", mode, err)
+				continue
+			}
+			if got, want := fi.Mode()&os.ModeSymlink != 0, mode == "symlink"; got != want {
+				t.Errorf("%s: %s: got symlink %v; want %v", mode, e.Dst, got, want)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Errorf("%s: %v", mode, err)
+			} else if want := files[e.Src]; string(got) != want {
+				t.Errorf("%s: %s: got %q; want %q", mode, e.Dst, got, want)
+			}
+		}
+	}
+
+	out := filepath.Join(dir, "archive.zip")
+	if err := run([]string{"-manifest", manifestPath, "-out", out, "-mode", "archive"}); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	want := []string{"src/example.com/foo/bar/bar.go", "src/example.com/foo/foo.go", "src/example.com/foo/foo_amd64.s"}
+	if len(names) != len(want) {
+		t.Fatalf("got archive files %q; want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("got archive files %q; want %q", names, want)
+			break
+		}
+	}
+
+	if err := run([]string{"-manifest", manifestPath, "-out", out, "-mode", "hardlink"}); err == nil {
+		t.Errorf("got success for an unknown mode; want error")
+	}
+}
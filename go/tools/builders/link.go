@@ -26,6 +26,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 )
 
@@ -52,34 +53,23 @@ func run(args []string) error {
 	stamps := multiFlag{}
 	linkstamps := multiFlag{}
 	flags := flag.NewFlagSet("link", flag.ExitOnError)
-	flags.Var(&xdefs, "X", "A link xdef that may need stamping.")
+	flags.Var(&xdefs, "X", "A link xdef whose value may reference stamp variables, like {STABLE_GIT_COMMIT}.")
 	flags.Var(&stamps, "stamp", "The name of a file with stamping values.")
 	flags.Var(&linkstamps, "linkstamp", "A package that requires link stamping.")
+	instrument := flags.String("instrument", "", "Link code instrumented for race or msan")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
 	goargs := []string{"tool", "link"}
+	instrumentFlags, err := instrumentArgs(*instrument)
+	if err != nil {
+		return err
+	}
+	goargs = append(goargs, instrumentFlags...)
 	// If we were given any stamp value files, read and parse them
-	stampmap := map[string]string{}
-	for _, stampfile := range stamps {
-		stampbuf, err := ioutil.ReadFile(stampfile)
-		if err != nil {
-			return fmt.Errorf("Failed reading stamp file %s: %v", stampfile, err)
-		}
-		scanner := bufio.NewScanner(bytes.NewReader(stampbuf))
-		for scanner.Scan() {
-			line := strings.SplitN(scanner.Text(), " ", 2)
-			switch len(line) {
-			case 0:
-				// Nothing to do here
-			case 1:
-				// Map to the empty string
-				stampmap[line[0]] = ""
-			case 2:
-				// Key and value
-				stampmap[line[0]] = line[1]
-			}
-		}
+	stampmap, err := readStampFiles(stamps)
+	if err != nil {
+		return err
 	}
 	// generate any additional link options we need
 	for _, xdef := range xdefs {
@@ -88,8 +78,7 @@ func run(args []string) error {
 			continue
 		}
 		name := split[0]
-		key := split[1]
-		if value, found := stampmap[key]; found {
+		if value, ok := expandStamp(split[1], stampmap); ok {
 			goargs = append(goargs, "-X", fmt.Sprintf("%s=%s", name, value))
 		}
 	}
@@ -110,6 +99,54 @@ func run(args []string) error {
 	return nil
 }
 
+// readStampFiles reads workspace status files, like stable-status.txt and
+// volatile-status.txt, which have lines of the form "KEY value". A key with
+// no value maps to the empty string.
+func readStampFiles(paths []string) (map[string]string, error) {
+	stampmap := map[string]string{}
+	for _, stampfile := range paths {
+		stampbuf, err := ioutil.ReadFile(stampfile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading stamp file %s: %v", stampfile, err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(stampbuf))
+		for scanner.Scan() {
+			line := strings.SplitN(scanner.Text(), " ", 2)
+			switch len(line) {
+			case 0:
+				// Nothing to do here
+			case 1:
+				// Map to the empty string
+				stampmap[line[0]] = ""
+			case 2:
+				// Key and value
+				stampmap[line[0]] = line[1]
+			}
+		}
+	}
+	return stampmap, nil
+}
+
+// stampRef matches a reference to a workspace status variable in an x_defs
+// value, like {STABLE_GIT_COMMIT}.
+var stampRef = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// expandStamp replaces references to workspace status variables in value
+// with their values from stampmap. It returns false if a referenced variable
+// isn't set, for example because the build isn't stamped; the variable is
+// left with its default value in that case.
+func expandStamp(value string, stampmap map[string]string) (string, bool) {
+	ok := true
+	expanded := stampRef.ReplaceAllStringFunc(value, func(ref string) string {
+		v, found := stampmap[ref[1:len(ref)-1]]
+		if !found {
+			ok = false
+		}
+		return v
+	})
+	return expanded, ok
+}
+
 func main() {
 	if err := run(os.Args[1:]); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,81 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandStamp(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stable := filepath.Join(dir, "stable-status.txt")
+	volatile := filepath.Join(dir, "volatile-status.txt")
+	if err := ioutil.WriteFile(stable, []byte("STABLE_GIT_COMMIT abc123\nSTABLE_VERSION 1.2\nBUILD_EMBED_LABEL\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(volatile, []byte("BUILD_TIMESTAMP 1500000000\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	stampmap, err := readStampFiles([]string{stable, volatile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		value, want string
+		wantOK      bool
+	}{
+		{value: "{STABLE_GIT_COMMIT}", want: "abc123", wantOK: true},
+		{value: "v{STABLE_VERSION}-{STABLE_GIT_COMMIT}", want: "v1.2-abc123", wantOK: true},
+		{value: "{BUILD_TIMESTAMP}", want: "1500000000", wantOK: true},
+		{value: "{BUILD_EMBED_LABEL}", want: "", wantOK: true},
+		{value: `{"json": true}`, want: `{"json": true}`, wantOK: true},
+		{value: "{STABLE_MISSING}", wantOK: false},
+	} {
+		got, ok := expandStamp(tc.value, stampmap)
+		if ok != tc.wantOK || ok && got != tc.want {
+			t.Errorf("expandStamp(%q): got %q, %v; want %q, %v", tc.value, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestInstrumentArgs(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want []string
+	}{
+		{mode: ""},
+		{mode: "race", want: []string{"-race", "-installsuffix", "race"}},
+		{mode: "msan", want: []string{"-msan", "-installsuffix", "msan"}},
+	} {
+		got, err := instrumentArgs(tc.mode)
+		if err != nil {
+			t.Errorf("instrumentArgs(%q): %v", tc.mode, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("instrumentArgs(%q): got %q; want %q", tc.mode, got, tc.want)
+		}
+	}
+	if _, err := instrumentArgs("tsan"); err == nil {
+		t.Errorf("instrumentArgs(%q): got success; want error", "tsan")
+	}
+}
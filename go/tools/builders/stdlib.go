@@ -0,0 +1,140 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// stdlib compiles the Go standard library for one combination of GOOS,
+// GOARCH, build tags, and instrumentation mode into a directory of package
+// archives. Compile and link actions search that directory instead of the
+// pkg directory of the installed Go distribution, which may not exist for
+// the target platform. It is invoked by go_stdlib as an action.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+func main() {
+	log.SetPrefix("stdlib: ")
+	log.SetFlags(0)
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("stdlib", flag.ContinueOnError)
+	out := flags.String("out", "", "directory to write the package archives to")
+	instrument := flags.String("instrument", "", "instrument the code for race or msan")
+	tags := flags.String("tags", "", "comma-separated list of build tags")
+	if len(args) < 1 {
+		return fmt.Errorf("the go tool must be specified")
+	}
+	gotool := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("-out must be set")
+	}
+	outDir, err := filepath.Abs(*out)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		return err
+	}
+
+	env := os.Environ()
+	if isCross(env, runtime.GOOS, runtime.GOARCH) {
+		if *instrument != "" {
+			return fmt.Errorf("-instrument %s needs cgo, which is disabled when cross-compiling", *instrument)
+		}
+		if getenv(env, "CGO_ENABLED") == "" {
+			env = append(env, "CGO_ENABLED=0")
+		}
+	}
+	// Newer versions of go build need a cache directory. Bazel doesn't set
+	// HOME, so a temporary one is used, since the result is cached anyway.
+	if getenv(env, "GOCACHE") == "" {
+		cache, err := ioutil.TempDir("", "stdlib_cache")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(cache)
+		env = append(env, "GOCACHE="+cache)
+	}
+
+	var tagList []string
+	if *tags != "" {
+		tagList = strings.Split(*tags, ",")
+	}
+	goargs, err := installArgs(outDir, *instrument, tagList)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(gotool, goargs...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error compiling the standard library: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "runtime.a")); err != nil {
+		return fmt.Errorf("runtime.a was not written to %s", outDir)
+	}
+	return nil
+}
+
+// installArgs returns the arguments to "go" that compile the standard
+// library into out. instrument is "race", "msan", or empty.
+func installArgs(out, instrument string, tags []string) ([]string, error) {
+	args := []string{"install", "-pkgdir", out}
+	switch instrument {
+	case "":
+	case "race", "msan":
+		args = append(args, "-"+instrument)
+	default:
+		return nil, fmt.Errorf("unknown instrumentation mode %q; want race or msan", instrument)
+	}
+	if len(tags) > 0 {
+		args = append(args, "-tags", strings.Join(tags, " "))
+	}
+	return append(args, "std"), nil
+}
+
+// isCross returns whether GOOS or GOARCH in env name a platform other than
+// the host, hostOS and hostArch. Unset variables mean the host platform.
+func isCross(env []string, hostOS, hostArch string) bool {
+	goos, goarch := getenv(env, "GOOS"), getenv(env, "GOARCH")
+	return goos != "" && goos != hostOS || goarch != "" && goarch != hostArch
+}
+
+// getenv returns the value of the last assignment to key in env, which is a
+// list of "key=value" strings like os.Environ returns.
+func getenv(env []string, key string) string {
+	value := ""
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			value = kv[len(key)+1:]
+		}
+	}
+	return value
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInstallArgs(t *testing.T) {
+	for _, tc := range []struct {
+		instrument string
+		tags       []string
+		want       []string
+	}{
+		{
+			want: []string{"install", "-pkgdir", "out", "std"},
+		}, {
+			instrument: "race",
+			tags:       []string{"netgo", "osusergo"},
+			want:       []string{"install", "-pkgdir", "out", "-race", "-tags", "netgo osusergo", "std"},
+		}, {
+			instrument: "msan",
+			want:       []string{"install", "-pkgdir", "out", "-msan", "std"},
+		},
+	} {
+		got, err := installArgs("out", tc.instrument, tc.tags)
+		if err != nil {
+			t.Errorf("installArgs(%q, %q): %v", tc.instrument, tc.tags, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("installArgs(%q, %q): got %q; want %q", tc.instrument, tc.tags, got, tc.want)
+		}
+	}
+	if _, err := installArgs("out", "tsan", nil); err == nil {
+		t.Errorf("installArgs(%q): got success; want error", "tsan")
+	}
+}
+
+func TestIsCross(t *testing.T) {
+	for _, tc := range []struct {
+		env  []string
+		want bool
+	}{
+		{env: nil, want: false},
+		{env: []string{"GOOS=linux", "GOARCH=amd64"}, want: false},
+		{env: []string{"GOOS=windows", "GOARCH=amd64"}, want: true},
+		{env: []string{"GOARCH=386"}, want: true},
+		{env: []string{"GOOS=windows", "GOOS=linux"}, want: false},
+	} {
+		if got := isCross(tc.env, "linux", "amd64"); got != tc.want {
+			t.Errorf("isCross(%q): got %v; want %v", tc.env, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file is not part of generate_test_main. It is compiled into generated
+// test mains for go_test rules with xml_report = True, which call
+// xmlReportMain before running any tests.
+
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// xmlReportChildEnv is set in the environment of the test process started by
+// runXMLReport, so it runs the tests instead of starting another process.
+const xmlReportChildEnv = "RULES_GO_XML_REPORT_CHILD"
+
+// xmlReportMain writes a JUnit XML report of the tests to the file Bazel
+// names in $XML_OUTPUT_FILE. The test binary is run again in verbose mode in
+// a child process, and its output is copied to stdout as it's parsed, so the
+// test log looks the same as without the report. xmlReportMain exits with
+// the child's exit status. If Bazel didn't ask for a report, or if this is
+// the child, xmlReportMain returns without doing anything.
+func xmlReportMain(pkg string) {
+	path := os.Getenv("XML_OUTPUT_FILE")
+	if path == "" || os.Getenv(xmlReportChildEnv) != "" {
+		return
+	}
+	os.Exit(runXMLReport(pkg, path, os.Args))
+}
+
+func runXMLReport(pkg, path string, args []string) int {
+	cmd := exec.Command(args[0], append([]string{"-test.v"}, args[1:]...)...)
+	cmd.Env = append(os.Environ(), xmlReportChildEnv+"=1")
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not run tests: %v\n", err)
+		return 1
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not run tests: %v\n", err)
+		return 1
+	}
+	results := parseTestOutput(io.TeeReader(stdout, os.Stdout))
+	code := exitCode(cmd.Wait())
+
+	data, err := xml.MarshalIndent(newXMLSuites(pkg, results, time.Since(start)), "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(path, append([]byte(xml.Header), data...), 0666)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write XML test report: %v\n", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	return code
+}
+
+// exitCode returns the exit status of a process that ended with err.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok && ws.Exited() {
+			return ws.ExitStatus()
+		}
+	}
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+// testResult is the outcome of a test, subtest, or example, parsed from the
+// output of a test binary run with -test.v.
+type testResult struct {
+	name    string
+	status  string // "PASS", "FAIL", "SKIP", or empty if the test didn't finish
+	elapsed string // seconds, as printed by the testing package
+	output  []string
+}
+
+var testResultRe = regexp.MustCompile(`^--- (PASS|FAIL|SKIP): (.+) \(([0-9.]+)s\)$`)
+
+// parseTestOutput reads the output of a test binary run with -test.v and
+// returns the tests it ran in the order they started. Lines that aren't
+// printed by the testing package are attributed to the test that started or
+// finished most recently, since log messages are printed after the result
+// line of the test that logged them.
+func parseTestOutput(r io.Reader) []*testResult {
+	var results []*testResult
+	byName := make(map[string]*testResult)
+	lookup := func(name string) *testResult {
+		t, ok := byName[name]
+		if !ok {
+			t = &testResult{name: name}
+			byName[name] = t
+			results = append(results, t)
+		}
+		return t
+	}
+
+	var current *testResult
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16<<20)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "=== RUN "), strings.HasPrefix(line, "=== CONT "):
+			// Test names don't contain spaces; the testing package replaces
+			// them with underscores.
+			if f := strings.Fields(line); len(f) == 3 {
+				current = lookup(f[2])
+			}
+			continue
+		case strings.HasPrefix(line, "=== PAUSE "):
+			continue
+		case line == "PASS" || line == "FAIL":
+			// The summary printed after all tests have run.
+			current = nil
+			continue
+		}
+		// Results of subtests are indented.
+		if m := testResultRe.FindStringSubmatch(strings.TrimLeft(line, " ")); m != nil {
+			current = lookup(m[2])
+			current.status = m[1]
+			current.elapsed = m[3]
+			continue
+		}
+		if current != nil {
+			current.output = append(current.output, line)
+		}
+	}
+	return results
+}
+
+type xmlTestSuites struct {
+	XMLName xml.Name       `xml:"testsuites"`
+	Suites  []xmlTestSuite `xml:"testsuite"`
+}
+
+type xmlTestSuite struct {
+	Name     string        `xml:"name,attr"`
+	Tests    int           `xml:"tests,attr"`
+	Failures int           `xml:"failures,attr"`
+	Errors   int           `xml:"errors,attr"`
+	Skipped  int           `xml:"skipped,attr"`
+	Time     string        `xml:"time,attr"`
+	Cases    []xmlTestCase `xml:"testcase"`
+}
+
+type xmlTestCase struct {
+	Name      string      `xml:"name,attr"`
+	ClassName string      `xml:"classname,attr"`
+	Time      string      `xml:"time,attr"`
+	Failure   *xmlMessage `xml:"failure"`
+	Error     *xmlMessage `xml:"error"`
+	Skipped   *xmlMessage `xml:"skipped"`
+	SystemOut string      `xml:"system-out,omitempty"`
+}
+
+type xmlMessage struct {
+	Message  string `xml:"message,attr"`
+	Contents string `xml:",chardata"`
+}
+
+// newXMLSuites returns a report with one test suite for the package pkg,
+// containing a test case for each result. Tests that didn't finish, because
+// the binary crashed or timed out, are reported as errors.
+func newXMLSuites(pkg string, results []*testResult, elapsed time.Duration) *xmlTestSuites {
+	suite := xmlTestSuite{
+		Name:  pkg,
+		Tests: len(results),
+		Time:  strconv.FormatFloat(elapsed.Seconds(), 'f', 3, 64),
+	}
+	for _, r := range results {
+		c := xmlTestCase{Name: r.name, ClassName: pkg, Time: r.elapsed}
+		output := strings.Join(r.output, "\n")
+		switch r.status {
+		case "PASS":
+			c.SystemOut = output
+		case "FAIL":
+			c.Failure = &xmlMessage{Message: "Failed", Contents: output}
+			suite.Failures++
+		case "SKIP":
+			c.Skipped = &xmlMessage{Message: "Skipped", Contents: output}
+			suite.Skipped++
+		default:
+			c.Error = &xmlMessage{Message: "No result; the test binary may have crashed or timed out", Contents: output}
+			suite.Errors++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	return &xmlTestSuites{Suites: []xmlTestSuite{suite}}
+}
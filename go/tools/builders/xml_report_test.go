@@ -0,0 +1,99 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const verboseTestOutput = `=== RUN   TestPass
+--- PASS: TestPass (0.01s)
+	pass_test.go:10: logged
+=== RUN   TestSub
+=== RUN   TestSub/a
+=== RUN   TestSub/b
+--- FAIL: TestSub (0.00s)
+    --- PASS: TestSub/a (0.00s)
+    --- FAIL: TestSub/b (0.00s)
+    	sub_test.go:20: broken
+=== RUN   TestSkip
+--- SKIP: TestSkip (0.00s)
+	skip_test.go:30: not today
+=== RUN   ExampleGreet
+--- FAIL: ExampleGreet (0.00s)
+got:
+hi
+want:
+hello
+=== RUN   TestCrash
+printed before crashing
+FAIL
+`
+
+func TestParseTestOutput(t *testing.T) {
+	got := parseTestOutput(strings.NewReader(verboseTestOutput))
+	want := []*testResult{
+		{name: "TestPass", status: "PASS", elapsed: "0.01", output: []string{"\tpass_test.go:10: logged"}},
+		{name: "TestSub", status: "FAIL", elapsed: "0.00"},
+		{name: "TestSub/a", status: "PASS", elapsed: "0.00"},
+		{name: "TestSub/b", status: "FAIL", elapsed: "0.00", output: []string{"    \tsub_test.go:20: broken"}},
+		{name: "TestSkip", status: "SKIP", elapsed: "0.00", output: []string{"\tskip_test.go:30: not today"}},
+		{name: "ExampleGreet", status: "FAIL", elapsed: "0.00", output: []string{"got:", "hi", "want:", "hello"}},
+		{name: "TestCrash", output: []string{"printed before crashing"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", formatResults(got), formatResults(want))
+	}
+}
+
+func formatResults(results []*testResult) string {
+	var lines []string
+	for _, r := range results {
+		lines = append(lines, strings.Join([]string{r.name, r.status, r.elapsed, strings.Join(r.output, "|")}, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestNewXMLSuites(t *testing.T) {
+	results := parseTestOutput(strings.NewReader(verboseTestOutput))
+	suites := newXMLSuites("example.com/foo", results, 0)
+	if len(suites.Suites) != 1 {
+		t.Fatalf("got %d suites; want 1", len(suites.Suites))
+	}
+	s := suites.Suites[0]
+	if s.Name != "example.com/foo" || s.Tests != 7 || s.Failures != 3 || s.Errors != 1 || s.Skipped != 1 {
+		t.Errorf("got suite %s with %d tests, %d failures, %d errors, %d skipped; want example.com/foo with 7, 3, 1, 1",
+			s.Name, s.Tests, s.Failures, s.Errors, s.Skipped)
+	}
+
+	data, err := xml.Marshal(suites)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<testcase name="TestPass" classname="example.com/foo" time="0.01"><system-out>&#x9;pass_test.go:10: logged</system-out></testcase>`,
+		`<testcase name="TestSub/b" classname="example.com/foo" time="0.00"><failure message="Failed">    &#x9;sub_test.go:20: broken</failure></testcase>`,
+		`<skipped message="Skipped">`,
+		`<error message="No result; the test binary may have crashed or timed out">printed before crashing</error>`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("report does not contain %s:\n%s", want, data)
+		}
+	}
+}
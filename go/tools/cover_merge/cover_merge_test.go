@@ -0,0 +1,207 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	profileA = `mode: count
+example.com/repo/lib/lib.go:3.20,5.2 1 2
+example.com/repo/lib/lib.go:7.20,9.2 1 0
+example.com/repo/lib/util.go:3.14,4.2 1 1
+`
+	profileB = `mode: count
+example.com/repo/lib/lib.go:7.20,9.2 1 3
+example.com/repo/lib/lib.go:3.20,5.2 1 1
+example.com/repo/cmd/main.go:5.13,7.2 2 0
+`
+)
+
+func readProfiles(t *testing.T, profiles ...string) *profile {
+	p := newProfile()
+	for i, data := range profiles {
+		if err := p.read(strings.NewReader(data), fmt.Sprintf("profile%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func TestMergeProfiles(t *testing.T) {
+	for _, tc := range []struct {
+		label    string
+		profiles []string
+		want     string
+	}{
+		{
+			label:    "count",
+			profiles: []string{profileA, profileB},
+			want: `mode: count
+example.com/repo/cmd/main.go:5.13,7.2 2 0
+example.com/repo/lib/lib.go:3.20,5.2 1 3
+example.com/repo/lib/lib.go:7.20,9.2 1 3
+example.com/repo/lib/util.go:3.14,4.2 1 1
+`,
+		}, {
+			label: "set",
+			profiles: []string{
+				"mode: set\nexample.com/repo/a.go:1.1,2.2 1 1\nexample.com/repo/a.go:3.1,4.2 1 0\n",
+				"mode: set\nexample.com/repo/a.go:1.1,2.2 1 1\nexample.com/repo/a.go:3.1,4.2 1 1\n",
+			},
+			want: "mode: set\nexample.com/repo/a.go:1.1,2.2 1 1\nexample.com/repo/a.go:3.1,4.2 1 1\n",
+		},
+	} {
+		p := readProfiles(t, tc.profiles...)
+		var buf bytes.Buffer
+		if err := p.write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("[%s] got:\n%s\nwant:\n%s", tc.label, got, tc.want)
+		}
+	}
+}
+
+func TestReadProfileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		label, data, want string
+	}{
+		{label: "no mode", data: "example.com/repo/a.go:1.1,2.2 1 1\n", want: "missing mode line"},
+		{label: "bad block", data: "mode: count\nexample.com/repo/a.go:1.1 1 1\n", want: "invalid block"},
+		{label: "mode mismatch", data: "mode: set\n", want: "doesn't match"},
+	} {
+		p := readProfiles(t, "mode: count\n")
+		err := p.read(strings.NewReader(tc.data), tc.label)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("[%s] got error %v; want error containing %q", tc.label, err, tc.want)
+		}
+	}
+}
+
+func TestWriteLcov(t *testing.T) {
+	p := readProfiles(t, profileA, profileB)
+	var buf bytes.Buffer
+	if err := writeLcov(&buf, p, "example.com/repo/"); err != nil {
+		t.Fatal(err)
+	}
+	want := `TN:
+SF:cmd/main.go
+DA:5,0
+DA:6,0
+DA:7,0
+LH:0
+LF:3
+end_of_record
+TN:
+SF:lib/lib.go
+DA:3,3
+DA:4,3
+DA:5,3
+DA:7,3
+DA:8,3
+DA:9,3
+LH:6
+LF:6
+end_of_record
+TN:
+SF:lib/util.go
+DA:3,1
+DA:4,1
+LH:2
+LF:2
+end_of_record
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteCobertura(t *testing.T) {
+	p := readProfiles(t, profileA, profileB)
+	var buf bytes.Buffer
+	if err := writeCobertura(&buf, p, "example.com/repo/", 1500000000); err != nil {
+		t.Fatal(err)
+	}
+	var got coberturaCoverage
+	if err := xml.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("%v\n%s", err, buf.String())
+	}
+	if got.LinesCovered != 8 || got.LinesValid != 11 || got.LineRate != "0.7273" || got.Timestamp != 1500000000 {
+		t.Errorf("got %d of %d lines covered, rate %s, timestamp %d; want 8 of 11, rate 0.7273, timestamp 1500000000", got.LinesCovered, got.LinesValid, got.LineRate, got.Timestamp)
+	}
+	var names []string
+	for _, pkg := range got.Packages {
+		for _, class := range pkg.Classes {
+			names = append(names, pkg.Name+" "+class.Filename+" "+class.LineRate)
+		}
+	}
+	want := []string{
+		"example.com/repo/cmd cmd/main.go 0",
+		"example.com/repo/lib lib/lib.go 1",
+		"example.com/repo/lib lib/util.go 1",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got classes %q; want %q", names, want)
+	}
+}
+
+func TestFindProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "cover_merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"lib/lib_test/coverage.dat", "lib/lib_test/test.log", "cmd/main_test/coverage.dat"} {
+		path := filepath.Join(dir, "testlogs", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "bazel-testlogs")
+	if err := os.Symlink(filepath.Join(dir, "testlogs"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := findProfiles(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, path := range paths {
+		rel, err := filepath.Rel(filepath.Join(dir, "testlogs"), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, filepath.ToSlash(rel))
+	}
+	want := []string{"cmd/main_test/coverage.dat", "lib/lib_test/coverage.dat"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
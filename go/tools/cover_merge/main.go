@@ -0,0 +1,134 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command cover_merge merges the Go coverage profiles written by
+// "bazel coverage" for each test into one report. The merged report can be
+// written as a Go coverage profile, which "go tool cover -html" turns into an
+// HTML page, or converted to lcov or Cobertura XML for CI dashboards.
+//
+// Profiles are named on the command line, or found under a directory of test
+// logs with -testlogs:
+//
+//	bazel coverage //...
+//	cover_merge -testlogs bazel-testlogs -format lcov -o coverage.lcov
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// profileName is the name of the coverage profile "bazel coverage" writes
+// in the test log directory of each test.
+const profileName = "coverage.dat"
+
+func main() {
+	log.SetPrefix("cover_merge: ")
+	log.SetFlags(0)
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("cover_merge", flag.ContinueOnError)
+	out := fs.String("o", "", "file to write the merged report to. Standard output is used if not set.")
+	format := fs.String("format", "profile", "profile: write a Go coverage profile\n\tlcov: write an lcov tracefile\n\tcobertura: write a Cobertura XML report")
+	testlogs := fs.String("testlogs", "", "directory to search for "+profileName+" files, usually bazel-testlogs")
+	trimPrefix := fs.String("trim_prefix", "", "prefix to remove from file names in lcov and Cobertura reports, like the go_prefix\n\tof the repository followed by a slash, so paths are relative to the repository root")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var write func(io.Writer, *profile) error
+	switch *format {
+	case "profile":
+		write = func(w io.Writer, p *profile) error { return p.write(w) }
+	case "lcov":
+		write = func(w io.Writer, p *profile) error { return writeLcov(w, p, *trimPrefix) }
+	case "cobertura":
+		write = func(w io.Writer, p *profile) error {
+			return writeCobertura(w, p, *trimPrefix, time.Now().Unix())
+		}
+	default:
+		return fmt.Errorf("unknown format %q; want profile, lcov, or cobertura", *format)
+	}
+
+	paths := fs.Args()
+	if *testlogs != "" {
+		found, err := findProfiles(*testlogs)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, found...)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no coverage profiles; name them as arguments or use -testlogs")
+	}
+
+	p := newProfile()
+	for _, path := range paths {
+		if err := readProfile(p, path); err != nil {
+			return err
+		}
+	}
+
+	if *out == "" {
+		return write(os.Stdout, p)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := write(f, p); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readProfile(p *profile, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.read(f, path)
+}
+
+// findProfiles returns the paths of coverage profiles in dir and its
+// subdirectories. dir may be a symbolic link, like bazel-testlogs.
+func findProfiles(dir string) ([]string, error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() == profileName && info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
@@ -0,0 +1,247 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// block is a range of statements in a coverage profile and the number of
+// times they were executed. In "set" mode, the count is 0 or 1.
+type block struct {
+	startLine, startCol int
+	endLine, endCol     int
+	numStmt             int
+	count               int64
+}
+
+// profile holds the blocks of each file in one or more merged coverage
+// profiles. Files are named by import path, like
+// "example.com/repo/lib/lib.go".
+type profile struct {
+	mode  string
+	files map[string]map[blockKey]*block
+}
+
+// blockKey identifies a block within a file. The same block appears in the
+// profile of each test that covers its package.
+type blockKey struct {
+	startLine, startCol, endLine, endCol int
+}
+
+func newProfile() *profile {
+	return &profile{files: make(map[string]map[blockKey]*block)}
+}
+
+// read parses a coverage profile written by "go test -coverprofile" and
+// merges its blocks into p. Counts of the same block are added, except in
+// "set" mode, where a block is covered if any profile covers it. All
+// profiles must have the same mode.
+func (p *profile) read(r io.Reader, name string) error {
+	s := bufio.NewScanner(r)
+	lineNum := 0
+	for s.Scan() {
+		lineNum++
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if lineNum == 1 {
+			if !strings.HasPrefix(line, "mode: ") {
+				return fmt.Errorf("%s: not a coverage profile: missing mode line", name)
+			}
+			mode := strings.TrimPrefix(line, "mode: ")
+			if p.mode != "" && p.mode != mode {
+				return fmt.Errorf("%s: coverage mode %q doesn't match mode %q of other profiles", name, mode, p.mode)
+			}
+			p.mode = mode
+			continue
+		}
+		file, b, err := parseBlock(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", name, lineNum, err)
+		}
+		p.add(file, b)
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+func (p *profile) add(file string, b block) {
+	blocks, ok := p.files[file]
+	if !ok {
+		blocks = make(map[blockKey]*block)
+		p.files[file] = blocks
+	}
+	key := blockKey{b.startLine, b.startCol, b.endLine, b.endCol}
+	old, ok := blocks[key]
+	if !ok {
+		blocks[key] = &b
+		return
+	}
+	if p.mode == "set" {
+		if b.count > 0 {
+			old.count = 1
+		}
+	} else {
+		old.count += b.count
+	}
+}
+
+// parseBlock parses a line of a coverage profile, like
+// "example.com/repo/lib/lib.go:10.13,12.2 1 3".
+func parseBlock(line string) (string, block, error) {
+	var b block
+	colon := strings.LastIndex(line, ":")
+	if colon < 0 {
+		return "", b, fmt.Errorf("invalid block %q", line)
+	}
+	file := line[:colon]
+	fields := strings.Fields(line[colon+1:])
+	if len(fields) != 3 {
+		return "", b, fmt.Errorf("invalid block %q", line)
+	}
+	pos := strings.Split(fields[0], ",")
+	if len(pos) != 2 {
+		return "", b, fmt.Errorf("invalid block %q", line)
+	}
+	var err error
+	if b.startLine, b.startCol, err = parsePosition(pos[0]); err != nil {
+		return "", b, err
+	}
+	if b.endLine, b.endCol, err = parsePosition(pos[1]); err != nil {
+		return "", b, err
+	}
+	if b.numStmt, err = strconv.Atoi(fields[1]); err != nil {
+		return "", b, fmt.Errorf("invalid statement count in %q", line)
+	}
+	if b.count, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return "", b, fmt.Errorf("invalid execution count in %q", line)
+	}
+	return file, b, nil
+}
+
+func parsePosition(s string) (line, col int, err error) {
+	dot := strings.Index(s, ".")
+	if dot < 0 {
+		return 0, 0, fmt.Errorf("invalid position %q", s)
+	}
+	if line, err = strconv.Atoi(s[:dot]); err != nil {
+		return 0, 0, fmt.Errorf("invalid position %q", s)
+	}
+	if col, err = strconv.Atoi(s[dot+1:]); err != nil {
+		return 0, 0, fmt.Errorf("invalid position %q", s)
+	}
+	return line, col, nil
+}
+
+// write writes p as a single coverage profile that "go tool cover" can
+// read. Files and blocks are sorted, so the output doesn't depend on the
+// order the profiles were read.
+func (p *profile) write(w io.Writer) error {
+	mode := p.mode
+	if mode == "" {
+		mode = "set"
+	}
+	if _, err := fmt.Fprintf(w, "mode: %s\n", mode); err != nil {
+		return err
+	}
+	for _, file := range p.fileNames() {
+		for _, b := range p.sortedBlocks(file) {
+			if _, err := fmt.Fprintf(w, "%s:%d.%d,%d.%d %d %d\n", file, b.startLine, b.startCol, b.endLine, b.endCol, b.numStmt, b.count); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *profile) fileNames() []string {
+	names := make([]string, 0, len(p.files))
+	for name := range p.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *profile) sortedBlocks(file string) []*block {
+	blocks := make(byPosition, 0, len(p.files[file]))
+	for _, b := range p.files[file] {
+		blocks = append(blocks, b)
+	}
+	sort.Sort(blocks)
+	return blocks
+}
+
+type byPosition []*block
+
+func (s byPosition) Len() int      { return len(s) }
+func (s byPosition) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPosition) Less(i, j int) bool {
+	if s[i].startLine != s[j].startLine {
+		return s[i].startLine < s[j].startLine
+	}
+	if s[i].startCol != s[j].startCol {
+		return s[i].startCol < s[j].startCol
+	}
+	if s[i].endLine != s[j].endLine {
+		return s[i].endLine < s[j].endLine
+	}
+	return s[i].endCol < s[j].endCol
+}
+
+// lineCounts returns the execution count of each line of file that has
+// statements, sorted by line. A line covered by several blocks gets the
+// largest count, so a line is reported as covered if any of its statements
+// ran.
+func (p *profile) lineCounts(file string) []lineCount {
+	counts := make(map[int]int64)
+	for _, b := range p.files[file] {
+		if b.numStmt == 0 {
+			continue
+		}
+		for line := b.startLine; line <= b.endLine; line++ {
+			if c, ok := counts[line]; !ok || b.count > c {
+				counts[line] = b.count
+			}
+		}
+	}
+	lines := make([]lineCount, 0, len(counts))
+	for line, count := range counts {
+		lines = append(lines, lineCount{line, count})
+	}
+	sort.Sort(byLine(lines))
+	return lines
+}
+
+type lineCount struct {
+	line  int
+	count int64
+}
+
+type byLine []lineCount
+
+func (s byLine) Len() int           { return len(s) }
+func (s byLine) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLine) Less(i, j int) bool { return s[i].line < s[j].line }
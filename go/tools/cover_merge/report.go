@@ -0,0 +1,148 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// sourcePath converts a file name in a coverage profile, which starts with
+// the import path of its package, to the path reported to dashboards.
+// trimPrefix, usually the go_prefix of the repository followed by a slash,
+// is removed so paths are relative to the repository root.
+func sourcePath(file, trimPrefix string) string {
+	return strings.TrimPrefix(file, trimPrefix)
+}
+
+// writeLcov writes p as an lcov tracefile, as read by genhtml and most
+// coverage services.
+func writeLcov(w io.Writer, p *profile, trimPrefix string) error {
+	for _, file := range p.fileNames() {
+		lines := p.lineCounts(file)
+		hit := 0
+		fmt.Fprintf(w, "TN:\nSF:%s\n", sourcePath(file, trimPrefix))
+		for _, l := range lines {
+			fmt.Fprintf(w, "DA:%d,%d\n", l.line, l.count)
+			if l.count > 0 {
+				hit++
+			}
+		}
+		if _, err := fmt.Fprintf(w, "LH:%d\nLF:%d\nend_of_record\n", hit, len(lines)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type coberturaCoverage struct {
+	XMLName      xml.Name           `xml:"coverage"`
+	LineRate     string             `xml:"line-rate,attr"`
+	BranchRate   string             `xml:"branch-rate,attr"`
+	LinesCovered int                `xml:"lines-covered,attr"`
+	LinesValid   int                `xml:"lines-valid,attr"`
+	Version      string             `xml:"version,attr"`
+	Timestamp    int64              `xml:"timestamp,attr"`
+	Packages     []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+	Name       string           `xml:"name,attr"`
+	LineRate   string           `xml:"line-rate,attr"`
+	BranchRate string           `xml:"branch-rate,attr"`
+	Classes    []coberturaClass `xml:"classes>class"`
+}
+
+type coberturaClass struct {
+	Name       string          `xml:"name,attr"`
+	Filename   string          `xml:"filename,attr"`
+	LineRate   string          `xml:"line-rate,attr"`
+	BranchRate string          `xml:"branch-rate,attr"`
+	Lines      []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+	Number int   `xml:"number,attr"`
+	Hits   int64 `xml:"hits,attr"`
+}
+
+// writeCobertura writes p as a Cobertura XML report, as read by Jenkins and
+// other CI dashboards. Each Go package is a Cobertura package, and each file
+// is a class. Go profiles don't record branches, so branch rates are 0.
+// timestamp is the time of the report in seconds since the Unix epoch.
+func writeCobertura(w io.Writer, p *profile, trimPrefix string, timestamp int64) error {
+	cov := coberturaCoverage{Version: "1", BranchRate: "0", Timestamp: timestamp}
+	pkgs := make(map[string]*coberturaPackage)
+	pkgHits := make(map[string][2]int)
+	for _, file := range p.fileNames() {
+		src := sourcePath(file, trimPrefix)
+		class := coberturaClass{Name: path.Base(src), Filename: src, BranchRate: "0"}
+		hit := 0
+		for _, l := range p.lineCounts(file) {
+			class.Lines = append(class.Lines, coberturaLine{Number: l.line, Hits: l.count})
+			if l.count > 0 {
+				hit++
+			}
+		}
+		class.LineRate = rate(hit, len(class.Lines))
+
+		dir := path.Dir(file)
+		pkg, ok := pkgs[dir]
+		if !ok {
+			pkg = &coberturaPackage{Name: dir, BranchRate: "0"}
+			pkgs[dir] = pkg
+		}
+		pkg.Classes = append(pkg.Classes, class)
+		counts := pkgHits[dir]
+		pkgHits[dir] = [2]int{counts[0] + hit, counts[1] + len(class.Lines)}
+		cov.LinesCovered += hit
+		cov.LinesValid += len(class.Lines)
+	}
+	dirs := make([]string, 0, len(pkgs))
+	for dir := range pkgs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		pkg := pkgs[dir]
+		pkg.LineRate = rate(pkgHits[dir][0], pkgHits[dir][1])
+		cov.Packages = append(cov.Packages, *pkg)
+	}
+	cov.LineRate = rate(cov.LinesCovered, cov.LinesValid)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(cov); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// rate formats the fraction of lines covered, as Cobertura reports do.
+func rate(hit, total int) string {
+	if total == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%.4g", float64(hit)/float64(total))
+}
@@ -66,6 +66,32 @@ func TestGetRepoRoot(t *testing.T) {
 	}
 }
 
+func TestRevision(t *testing.T) {
+	for _, tc := range []struct {
+		label, rev, commit, tag, want string
+		wantErr                       bool
+	}{
+		{label: "rev", rev: "v1.0.0", want: "v1.0.0"},
+		{label: "commit", commit: "1234abcd", want: "1234abcd"},
+		{label: "tag", tag: "v1.0.0", want: "v1.0.0"},
+		{label: "none", wantErr: true},
+		{label: "commit and tag", commit: "1234abcd", tag: "v1.0.0", wantErr: true},
+	} {
+		got, err := revision(tc.rev, tc.commit, tc.tag)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("[%s] expected error. Got %q", tc.label, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+		} else if got != tc.want {
+			t.Errorf("[%s] Expected %q, got %q", tc.label, tc.want, got)
+		}
+	}
+}
+
 func TestGetRepoRoot_error(t *testing.T) {
 	for _, tc := range []struct {
 		label      string
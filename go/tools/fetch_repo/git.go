@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// fetchGit checks out rev of the git repository at remote into dest. This is
+// used instead of vcs.VCS.CreateAtRev when a shallow fetch or a cache is
+// requested.
+//
+// If shallow is true, only rev is fetched, without its history. rev must be
+// a full commit hash or a branch or tag name for this to work, and the
+// server must allow fetching commits by hash, which most hosts do.
+//
+// If cacheDir is set, the repository is first fetched into a bare mirror in
+// cacheDir, which is shared by all fetches of the same remote, and dest is
+// fetched from the mirror. Revisions already in the mirror aren't fetched
+// again. The mirror is best-effort: if it can't be used, dest is fetched
+// from remote directly.
+func fetchGit(dest, remote, rev string, shallow bool, cacheDir string) error {
+	src, srcRev := remote, rev
+	if cacheDir != "" {
+		mirror, err := updateGitCache(cacheDir, remote, rev, shallow)
+		if err != nil {
+			log.Printf("%s: not using cache: %v", remote, err)
+		} else {
+			src, srcRev = mirror, fetchedRef(rev)
+		}
+	}
+
+	if err := os.MkdirAll(dest, 0777); err != nil {
+		return err
+	}
+	if err := runGit(dest, "init", "-q"); err != nil {
+		return err
+	}
+	if err := runGit(dest, "remote", "add", "origin", remote); err != nil {
+		return err
+	}
+	if err := fetchGitRev(dest, src, srcRev, fetchedRef(rev), shallow); err != nil {
+		return err
+	}
+	return runGit(dest, "checkout", "-q", fetchedRef(rev))
+}
+
+// updateGitCache makes sure rev of the repository at remote is in its mirror
+// in cacheDir, and returns the mirror's path. Mirrors are created in a
+// temporary directory and renamed into place, so concurrent fetches never
+// see a partially initialized mirror.
+func updateGitCache(cacheDir, remote, rev string, shallow bool) (string, error) {
+	mirror := filepath.Join(cacheDir, "git", gitCacheKey(remote))
+	if _, err := os.Stat(mirror); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(mirror), 0777); err != nil {
+			return "", err
+		}
+		tmp, err := ioutil.TempDir(filepath.Dir(mirror), "tmp")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(tmp)
+		if err := runGit(tmp, "init", "-q", "--bare"); err != nil {
+			return "", err
+		}
+		// Fetches from the mirror name revisions by hash.
+		if err := runGit(tmp, "config", "uploadpack.allowAnySHA1InWant", "true"); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmp, mirror); err != nil {
+			if _, statErr := os.Stat(mirror); statErr != nil {
+				return "", err
+			}
+			// Another fetch created the mirror first.
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	if runGit(mirror, "cat-file", "-e", fetchedRef(rev)+"^{commit}") == nil {
+		return mirror, nil
+	}
+	if err := fetchGitRev(mirror, remote, rev, fetchedRef(rev), shallow); err != nil {
+		return "", err
+	}
+	return mirror, nil
+}
+
+// fetchGitRev fetches rev from src into the repository in dir, and points
+// ref at it. If rev can't be fetched by name, which is the case for
+// abbreviated commit hashes, and shallow is false, all branches and tags are
+// fetched instead.
+func fetchGitRev(dir, src, rev, ref string, shallow bool) error {
+	args := []string{"fetch", "-q"}
+	if shallow {
+		args = append(args, "--depth=1")
+	}
+	err := runGit(dir, append(args, src, "+"+rev+":"+ref)...)
+	if err == nil || shallow {
+		return err
+	}
+	if err := runGit(dir, "fetch", "-q", src, "+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"); err != nil {
+		return err
+	}
+	return runGit(dir, "update-ref", ref, rev+"^{commit}")
+}
+
+// fetchedRef returns the name of the ref fetchGit uses for rev, both in
+// mirrors and in the destination repository.
+func fetchedRef(rev string) string {
+	return "refs/fetch_repo/" + rev
+}
+
+// gitCacheKey returns the name of the mirror of remote in a cache directory.
+func gitCacheKey(remote string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(remote)))
+}
+
+// runGit runs git with args in dir. Its output is included in the error if
+// it fails.
+func runGit(dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
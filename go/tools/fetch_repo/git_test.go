@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	tmp, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Create a repository with two commits, and tag the first one.
+	remote := filepath.Join(tmp, "remote")
+	if err := os.MkdirAll(remote, 0777); err != nil {
+		t.Fatal(err)
+	}
+	mustGit(t, remote, "init", "-q")
+	mustGit(t, remote, "config", "uploadpack.allowAnySHA1InWant", "true")
+	var commits []string
+	for i, content := range []string{"package a // v1\n", "package a // v2\n"} {
+		if err := ioutil.WriteFile(filepath.Join(remote, "a.go"), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		mustGit(t, remote, "add", "a.go")
+		mustGit(t, remote, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", content)
+		commits = append(commits, strings.TrimSpace(mustGit(t, remote, "rev-parse", "HEAD")))
+		if i == 0 {
+			mustGit(t, remote, "tag", "v1.0.0")
+		}
+	}
+	cacheDir := filepath.Join(tmp, "cache")
+
+	for _, tc := range []struct {
+		label, rev, cacheDir, want string
+		shallow                    bool
+	}{
+		{label: "shallow commit", rev: commits[0], shallow: true, want: "v1"},
+		{label: "shallow tag", rev: "v1.0.0", shallow: true, want: "v1"},
+		{label: "abbreviated commit", rev: commits[0][:8], want: "v1"},
+		{label: "cached shallow commit", rev: commits[1], shallow: true, cacheDir: cacheDir, want: "v2"},
+		{label: "cached tag", rev: "v1.0.0", cacheDir: cacheDir, want: "v1"},
+	} {
+		dest := filepath.Join(tmp, "dest", strings.Replace(tc.label, " ", "_", -1))
+		if err := fetchGit(dest, remote, tc.rev, tc.shallow, tc.cacheDir); err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+			continue
+		}
+		if got, err := ioutil.ReadFile(filepath.Join(dest, "a.go")); err != nil || !strings.Contains(string(got), tc.want) {
+			t.Errorf("[%s] a.go: got %q, %v; want %s", tc.label, got, err, tc.want)
+		}
+		if tc.shallow {
+			if n := strings.TrimSpace(mustGit(t, dest, "rev-list", "--count", "HEAD")); n != "1" {
+				t.Errorf("[%s] got %s commits; want 1", tc.label, n)
+			}
+		}
+		if origin := mustGit(t, dest, "remote", "-v"); !strings.Contains(origin, remote) {
+			t.Errorf("[%s] got remotes %q; want origin %s", tc.label, origin, remote)
+		}
+	}
+
+	// Cached revisions are fetched from the mirror, even if the remote is
+	// gone.
+	if err := os.RemoveAll(remote); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(tmp, "dest", "from_cache")
+	if err := fetchGit(dest, remote, commits[1], true, cacheDir); err != nil {
+		t.Errorf("[from cache] %v", err)
+	}
+}
+
+func mustGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
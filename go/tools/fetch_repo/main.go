@@ -8,6 +8,22 @@
 //
 // These differences help us to manage external Go repositories in the manner of
 // Bazel.
+//
+// The repository is found from the import path with the same discovery the go
+// command uses, including <meta name="go-import"> tags. When discovery isn't
+// possible, for example because the import path's server requires a login,
+// --vcs and --remote name the repository directly.
+//
+// When --version is given, fetch_repo downloads a Go module instead, from the
+// module proxies listed in GOPROXY. GOPRIVATE, GONOPROXY, and GONOSUMDB are
+// respected like they are by the go command. The module is verified against
+// --sum, a hash copied from go.sum, even if it's checked out from version
+// control because of a "direct" entry in GOPROXY.
+//
+// --shallow fetches only the requested revision of a git repository, without
+// its history. --cache_dir names a directory shared by fetches of different
+// repositories, where git mirrors and module zips are kept so they don't
+// need to be downloaded again.
 package main
 
 import (
@@ -22,8 +38,14 @@ var (
 	remote     = flag.String("remote", "", "The URI of the remote repository. Must be used with the --vcs flag.")
 	cmd        = flag.String("vcs", "", "Version control system to use to fetch the repository. Should be one of: git,hg,svn,bzr. Must be used with the --remote flag.")
 	rev        = flag.String("rev", "", "target revision")
+	commit     = flag.String("commit", "", "commit to check out. May be used instead of --rev.")
+	tag        = flag.String("tag", "", "tag to check out. May be used instead of --rev.")
 	dest       = flag.String("dest", "", "destination directory")
 	importpath = flag.String("importpath", "", "Go importpath to the repository fetch")
+	version    = flag.String("version", "", "module version to download from GOPROXY. If set, importpath is the module path. --remote and --vcs\nare used if the module is fetched directly.")
+	sum        = flag.String("sum", "", "hash of the module from go.sum, like h1:..., used to verify the download. Must be used with the --version flag.")
+	shallow    = flag.Bool("shallow", false, "if true, fetch only the target revision of a git repository, without its history. The revision must be\na full commit hash, a branch, or a tag.")
+	cacheDir   = flag.String("cache_dir", "", "directory where git mirrors and module zips are kept and reused across fetches")
 
 	// Used for overriding in tests to disable network calls.
 	repoRootForImportPath = vcs.RepoRootForImportPath
@@ -50,7 +72,7 @@ func getRepoRoot(remote, cmd, importpath string) (*vcs.RepoRoot, error) {
 	// Try to figure out the information from the import path.
 	r, err := repoRootForImportPath(importpath, true)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%v. If the repository can't be discovered from the import path, use --remote and --vcs.", err)
 	}
 	if importpath != r.Root {
 		return nil, fmt.Errorf("not a root of a repository: %s", importpath)
@@ -58,12 +80,48 @@ func getRepoRoot(remote, cmd, importpath string) (*vcs.RepoRoot, error) {
 	return r, nil
 }
 
+// revision returns the revision to check out, given the values of the --rev,
+// --commit, and --tag flags. Exactly one of them must be set.
+func revision(rev, commit, tag string) (string, error) {
+	var set []string
+	for _, r := range []string{rev, commit, tag} {
+		if r != "" {
+			set = append(set, r)
+		}
+	}
+	if len(set) != 1 {
+		return "", fmt.Errorf("exactly one of --rev, --commit, or --tag must be specified")
+	}
+	return set[0], nil
+}
+
 func run() error {
+	if *version != "" {
+		if *rev != "" || *commit != "" || *tag != "" {
+			return fmt.Errorf("--version may not be used with --rev, --commit, or --tag")
+		}
+		env := moduleEnvFromOS()
+		env.cacheDir = *cacheDir
+		return fetchModule(*dest, *importpath, *version, *sum, *remote, *cmd, env)
+	}
+	if *sum != "" {
+		return fmt.Errorf("--sum must be used with the --version flag")
+	}
+	target, err := revision(*rev, *commit, *tag)
+	if err != nil {
+		return err
+	}
 	r, err := getRepoRoot(*remote, *cmd, *importpath)
 	if err != nil {
 		return err
 	}
-	return r.VCS.CreateAtRev(*dest, r.Repo, *rev)
+	if r.VCS.Cmd == "git" && (*shallow || *cacheDir != "") {
+		return fetchGit(*dest, r.Repo, target, *shallow, *cacheDir)
+	}
+	if *shallow {
+		return fmt.Errorf("--shallow is only supported for git repositories")
+	}
+	return r.VCS.CreateAtRev(*dest, r.Repo, target)
 }
 
 func main() {
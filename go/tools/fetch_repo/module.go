@@ -0,0 +1,491 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pmcalpine/rules_go/go/tools/modproxy"
+	"golang.org/x/tools/go/vcs"
+)
+
+// moduleEnv holds the environment variables that control how modules are
+// downloaded. They have the same meaning as for the go command.
+type moduleEnv struct {
+	// proxy is the list of module proxies to try, from GOPROXY.
+	proxy string
+
+	// noProxy and noSumDB are comma-separated lists of glob patterns of
+	// module path prefixes. Modules matching noProxy are fetched directly
+	// from version control, and modules matching noSumDB may be fetched
+	// without a sum to verify them. Both default to GOPRIVATE.
+	noProxy, noSumDB string
+
+	// cacheDir, if set, is a directory where downloaded module zips are
+	// kept, so they're reused by later fetches. It's set from --cache_dir,
+	// not from the environment.
+	cacheDir string
+}
+
+// moduleEnvFromOS reads a moduleEnv from the process environment.
+func moduleEnvFromOS() moduleEnv {
+	env := moduleEnv{
+		proxy:   os.Getenv("GOPROXY"),
+		noProxy: os.Getenv("GONOPROXY"),
+		noSumDB: os.Getenv("GONOSUMDB"),
+	}
+	if env.proxy == "" {
+		env.proxy = modproxy.DefaultGoProxy
+	}
+	private := os.Getenv("GOPRIVATE")
+	if env.noProxy == "" {
+		env.noProxy = private
+	}
+	if env.noSumDB == "" {
+		env.noSumDB = private
+	}
+	return env
+}
+
+// matchPrefixPatterns reports whether any element of patterns, a
+// comma-separated list of glob patterns, matches a prefix of modPath. A
+// pattern matches a prefix with the same number of path elements, like the
+// go command's GOPRIVATE.
+func matchPrefixPatterns(patterns, modPath string) bool {
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSuffix(strings.TrimSpace(pattern), "/")
+		if pattern == "" {
+			continue
+		}
+		n := strings.Count(pattern, "/")
+		prefix := modPath
+		for i := 0; i < len(modPath); i++ {
+			if modPath[i] == '/' {
+				n--
+				if n < 0 {
+					prefix = modPath[:i]
+					break
+				}
+			}
+		}
+		if n > 0 {
+			continue
+		}
+		if ok, _ := path.Match(pattern, prefix); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchModule downloads version of the module modPath into dest. The module
+// is downloaded from the proxies in env, in order. A module matching
+// env.noProxy, or reaching a "direct" entry, is checked out from version
+// control instead. See fetchModuleDirect.
+//
+// Modules are verified against sum, a hash in the format of a go.sum line,
+// like "h1:...", whether they're downloaded or checked out. sum may only be
+// empty for modules matching env.noSumDB, since the checksum database isn't
+// consulted.
+func fetchModule(dest, modPath, version, sum, remote, cmd string, env moduleEnv) error {
+	if sum == "" && !matchPrefixPatterns(env.noSumDB, modPath) {
+		return fmt.Errorf("%s@%s: no sum to verify the module. Copy it from go.sum, or add the module to GONOSUMDB or GOPRIVATE if it's private", modPath, version)
+	}
+
+	if env.cacheDir != "" {
+		if data, err := readModuleCache(env.cacheDir, modPath, version); err == nil {
+			if err := verifyModuleZip(modPath, version, sum, data); err != nil {
+				log.Printf("ignoring cached module: %v", err)
+			} else {
+				return extractModuleZip(dest, modPath, version, data)
+			}
+		}
+	}
+
+	var specs []modproxy.Spec
+	if matchPrefixPatterns(env.noProxy, modPath) {
+		specs = []modproxy.Spec{{URL: "direct"}}
+	} else {
+		var err error
+		if specs, err = modproxy.ParseList(env.proxy); err != nil {
+			return err
+		}
+	}
+
+	var errs []string
+	for _, spec := range specs {
+		var data []byte
+		var err error
+		switch spec.URL {
+		case "off":
+			errs = append(errs, "module downloads disabled by GOPROXY=off")
+			return fmt.Errorf("%s@%s: could not download module: %s", modPath, version, strings.Join(errs, "; "))
+		case "direct":
+			if data, err = fetchModuleDirect(modPath, version, remote, cmd, env.cacheDir); err != nil {
+				return err
+			}
+		default:
+			data, err = downloadModuleZip(spec.URL, modPath, version)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", spec.URL, err))
+			if err == modproxy.ErrNotFound || spec.FallBackOnError {
+				continue
+			}
+			break
+		}
+		if err := verifyModuleZip(modPath, version, sum, data); err != nil {
+			return err
+		}
+		if env.cacheDir != "" {
+			if err := writeModuleCache(env.cacheDir, modPath, version, data); err != nil {
+				log.Printf("%s@%s: could not cache module: %v", modPath, version, err)
+			}
+		}
+		return extractModuleZip(dest, modPath, version, data)
+	}
+	return fmt.Errorf("%s@%s: could not download module: %s", modPath, version, strings.Join(errs, "; "))
+}
+
+// verifyModuleZip checks that the hash of a module zip file matches sum. Any
+// file matches an empty sum.
+func verifyModuleZip(modPath, version, sum string, data []byte) error {
+	if sum == "" {
+		return nil
+	}
+	if got, err := modproxy.HashZip(data); err != nil {
+		return fmt.Errorf("%s@%s: %v", modPath, version, err)
+	} else if got != sum {
+		return fmt.Errorf("%s@%s: checksum mismatch: downloaded %s, want %s", modPath, version, got, sum)
+	}
+	return nil
+}
+
+// moduleCachePath returns the path of the zip file for version of modPath in
+// cacheDir. The layout is the same as a proxy's, so a cache directory may
+// also be used as a file:// proxy.
+func moduleCachePath(cacheDir, modPath, version string) (string, error) {
+	escPath, err := modproxy.EscapePath(modPath)
+	if err != nil {
+		return "", err
+	}
+	escVersion, err := modproxy.EscapePath(version)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "mod", filepath.FromSlash(escPath), "@v", escVersion+".zip"), nil
+}
+
+// readModuleCache returns the zip file for version of modPath from cacheDir.
+func readModuleCache(cacheDir, modPath, version string) ([]byte, error) {
+	p, err := moduleCachePath(cacheDir, modPath, version)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+// writeModuleCache saves the zip file for version of modPath in cacheDir.
+// The file is written under a temporary name and renamed, so concurrent
+// fetches never read a partial file.
+func writeModuleCache(cacheDir, modPath, version string, data []byte) error {
+	p, err := moduleCachePath(cacheDir, modPath, version)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// fetchModuleDirect checks out version of the module modPath from version
+// control and returns a zip file of the module, with the files the go
+// command would put in it, so it can be verified and extracted like a zip
+// file from a proxy. Unless remote and cmd are set, the repository is
+// discovered from modPath, which may be in a subdirectory of it. Git
+// repositories are fetched through the mirror in cacheDir, if it's set.
+func fetchModuleDirect(modPath, version, remote, cmd, cacheDir string) ([]byte, error) {
+	r, subdir, err := moduleRepoRoot(remote, cmd, modPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s@%s: %v", modPath, version, err)
+	}
+	rev, codeDir, pathMajor := moduleRevision(modPath, subdir, version)
+
+	tmp, err := ioutil.TempDir("", "fetch_repo")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	checkout := filepath.Join(tmp, "repo")
+	if r.VCS.Cmd == "git" && cacheDir != "" {
+		err = fetchGit(checkout, r.Repo, rev, false, cacheDir)
+	} else {
+		err = r.VCS.CreateAtRev(checkout, r.Repo, rev)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s@%s: checking out %s from %s: %v", modPath, version, rev, r.Repo, err)
+	}
+
+	// A module with a major version suffix is either in the directory
+	// named by the suffix ("major subdirectory") or in the directory
+	// without it ("major branch"), like the go command looks for it.
+	dir := codeDir
+	if pathMajor != "" {
+		majorDir := path.Join(codeDir, pathMajor)
+		if _, err := os.Stat(filepath.Join(checkout, filepath.FromSlash(majorDir), "go.mod")); err == nil {
+			dir = majorDir
+		}
+	}
+	return zipModuleDir(checkout, dir, modPath, version)
+}
+
+// moduleRepoRoot returns the repository containing the module modPath and
+// the slash-separated path of modPath relative to the repository's root
+// import path, which is empty if they're the same. If remote and cmd are
+// set, they name the repository, and modPath is its root.
+func moduleRepoRoot(remote, cmd, modPath string) (*vcs.RepoRoot, string, error) {
+	if remote != "" || cmd != "" {
+		r, err := getRepoRoot(remote, cmd, modPath)
+		return r, "", err
+	}
+	r, err := repoRootForImportPath(modPath, true)
+	if err != nil {
+		return nil, "", fmt.Errorf("%v. If the repository can't be discovered from the module path, use --remote and --vcs.", err)
+	}
+	if modPath == r.Root {
+		return r, "", nil
+	}
+	if !strings.HasPrefix(modPath, r.Root+"/") {
+		return nil, "", fmt.Errorf("module path is not in repository %s", r.Root)
+	}
+	return r, modPath[len(r.Root)+1:], nil
+}
+
+// pseudoVersionRE matches pseudo-versions, like
+// v0.0.0-20170915032832-14c0d48ead0c, which name a commit instead of a tag.
+// It's the same expression the go command uses.
+var pseudoVersionRE = regexp.MustCompile(`^v[0-9]+\.(0\.0-|\d+\.\d+-([^+]*\.)?0\.)\d{14}-[A-Za-z0-9]+(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// majorSuffixRE matches the major version suffix of a module path, like
+// "/v2".
+var majorSuffixRE = regexp.MustCompile(`/v[0-9]+$`)
+
+// moduleRevision returns the revision to check out for version of the
+// module modPath, which is in the directory subdir of its repository. This
+// is the commit named by a pseudo-version, or the tag for version
+// otherwise. Tags of modules in subdirectories are prefixed with the
+// directory, like "sub/v1.2.0". codeDir is subdir without the major
+// version suffix of modPath, pathMajor is that suffix, like "v2", or empty
+// if modPath has none.
+func moduleRevision(modPath, subdir, version string) (rev, codeDir, pathMajor string) {
+	if m := majorSuffixRE.FindString(modPath); m != "" {
+		pathMajor = m[1:]
+	}
+	codeDir = subdir
+	if pathMajor != "" && (codeDir == pathMajor || strings.HasSuffix(codeDir, "/"+pathMajor)) {
+		codeDir = strings.TrimSuffix(strings.TrimSuffix(codeDir, pathMajor), "/")
+	}
+	if pseudoVersionRE.MatchString(version) {
+		v := version
+		if i := strings.IndexByte(v, '+'); i >= 0 {
+			v = v[:i]
+		}
+		return v[strings.LastIndex(v, "-")+1:], codeDir, pathMajor
+	}
+	rev = strings.TrimSuffix(version, "+incompatible")
+	if codeDir != "" {
+		rev = codeDir + "/" + rev
+	}
+	return rev, codeDir, pathMajor
+}
+
+// vcsDirs are version control metadata directories, which are never part of
+// a module.
+var vcsDirs = map[string]bool{".bzr": true, ".git": true, ".hg": true, ".svn": true}
+
+// zipModuleDir returns a zip file of the module modPath at version, whose
+// files are in the slash-separated directory dir of the checkout root. Like
+// the go command, it leaves out version control directories, subdirectories
+// with their own go.mod file, which are other modules, packages in vendor
+// directories, and files that aren't regular files. A module in a
+// subdirectory without a LICENSE file gets the one at the root of the
+// repository.
+//
+// Files are hashed the same way as in zip files from a proxy, so the result
+// can be checked against go.sum. The go command builds zip files from VCS
+// archives, so a repository that excludes files from them, with
+// export-ignore attributes in .gitattributes for example, fails the check
+// instead of being accepted with extra files.
+func zipModuleDir(root, dir, modPath, version string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	prefix := modPath + "@" + version + "/"
+	modDir := filepath.Join(root, filepath.FromSlash(dir))
+	haveLicense := false
+	add := func(name, p string, info os.FileInfo) error {
+		h, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		h.Name = prefix + name
+		h.Method = zip.Deflate
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+	err := filepath.Walk(modDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(modDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if p == modDir {
+				return nil
+			}
+			if vcsDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || isVendoredPackage(rel) {
+			return nil
+		}
+		if rel == "LICENSE" {
+			haveLicense = true
+		}
+		return add(rel, p, info)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s@%s: %v", modPath, version, err)
+	}
+	if dir != "" && !haveLicense {
+		p := filepath.Join(root, "LICENSE")
+		if info, err := os.Lstat(p); err == nil && info.Mode().IsRegular() {
+			if err := add("LICENSE", p, info); err != nil {
+				return nil, fmt.Errorf("%s@%s: %v", modPath, version, err)
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isVendoredPackage returns whether name, a slash-separated path in a
+// module, is a file in a package in a vendor directory. Files directly in
+// a vendor directory, like vendor/modules.txt, are not.
+func isVendoredPackage(name string) bool {
+	var i int
+	if strings.HasPrefix(name, "vendor/") {
+		i += len("vendor/")
+	} else if j := strings.Index(name, "/vendor/"); j >= 0 {
+		i += j + len("/vendor/")
+	} else {
+		return false
+	}
+	return strings.Contains(name[i:], "/")
+}
+
+// downloadModuleZip returns the zip file for version of modPath from the
+// proxy at baseURL. file:// URLs are read from the local file system, so a
+// mirror may be used offline.
+func downloadModuleZip(baseURL, modPath, version string) ([]byte, error) {
+	escPath, err := modproxy.EscapePath(modPath)
+	if err != nil {
+		return nil, err
+	}
+	escVersion, err := modproxy.EscapePath(version)
+	if err != nil {
+		return nil, err
+	}
+	return modproxy.Get(baseURL, escPath+"/@v/"+escVersion+".zip")
+}
+
+// extractModuleZip extracts a module zip file into dest. Every file in the
+// zip must be under a "<modPath>@<version>/" directory, which is stripped.
+func extractModuleZip(dest, modPath, version string, data []byte) error {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	prefix := modPath + "@" + version + "/"
+	for _, f := range z.File {
+		if !strings.HasPrefix(f.Name, prefix) {
+			return fmt.Errorf("%s@%s: file %q is outside the module directory", modPath, version, f.Name)
+		}
+		rel := f.Name[len(prefix):]
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			continue
+		}
+		if clean := path.Clean(rel); clean != rel || clean == ".." || strings.HasPrefix(clean, "../") || path.IsAbs(clean) {
+			return fmt.Errorf("%s@%s: invalid file name %q", modPath, version, f.Name)
+		}
+		if err := extractZipFile(f, filepath.Join(dest, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractZipFile(f *zip.File, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	mode := os.FileMode(0666)
+	if f.Mode()&0111 != 0 {
+		mode = 0777
+	}
+	w, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
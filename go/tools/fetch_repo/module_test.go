@@ -0,0 +1,308 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/modproxy"
+)
+
+func TestMatchPrefixPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		patterns, modPath string
+		want              bool
+	}{
+		{"", "example.com/a", false},
+		{"example.com", "example.com/a/b", true},
+		{"example.com/a", "example.com/a/b", true},
+		{"example.com/a", "example.com/ab", false},
+		{"example.com/a/b/c", "example.com/a/b", false},
+		{"*.corp.example.com", "git.corp.example.com/team/mod", true},
+		{"other.com,*.corp.example.com/team", "git.corp.example.com/team/mod", true},
+		{"*.corp.example.com", "example.com/mod", false},
+	} {
+		if got := matchPrefixPatterns(tc.patterns, tc.modPath); got != tc.want {
+			t.Errorf("matchPrefixPatterns(%q, %q) = %v; want %v", tc.patterns, tc.modPath, got, tc.want)
+		}
+	}
+}
+
+func TestFetchModule(t *testing.T) {
+	proxyDir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(proxyDir)
+	emptyDir := filepath.Join(proxyDir, "empty")
+	mirrorDir := filepath.Join(proxyDir, "mirror")
+
+	const modPath, version = "example.com/Mod", "v1.0.0"
+	data := moduleZip(t, modPath+"@"+version+"/", map[string]string{
+		"go.mod":     "module example.com/Mod\n",
+		"mod.go":     "package mod\n",
+		"sub/sub.go": "package sub\n",
+	})
+	zipDir := filepath.Join(mirrorDir, "example.com", "!mod", "@v")
+	if err := os.MkdirAll(zipDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(zipDir, version+".zip"), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := modproxy.HashZip(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror := "file://" + filepath.ToSlash(mirrorDir)
+	empty := "file://" + filepath.ToSlash(emptyDir)
+
+	for _, tc := range []struct {
+		label, sum, wantErr string
+		env                 moduleEnv
+	}{
+		{
+			label: "verified",
+			sum:   sum,
+			env:   moduleEnv{proxy: mirror},
+		},
+		{
+			label: "fallback",
+			sum:   sum,
+			env:   moduleEnv{proxy: empty + "," + mirror},
+		},
+		{
+			label: "private without sum",
+			env:   moduleEnv{proxy: mirror, noSumDB: "example.com"},
+		},
+		{
+			label:   "missing sum",
+			env:     moduleEnv{proxy: mirror},
+			wantErr: "no sum",
+		},
+		{
+			label:   "wrong sum",
+			sum:     "h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+			env:     moduleEnv{proxy: mirror},
+			wantErr: "checksum mismatch",
+		},
+		{
+			label:   "not found",
+			sum:     sum,
+			env:     moduleEnv{proxy: empty},
+			wantErr: "could not download",
+		},
+		{
+			label:   "off",
+			sum:     sum,
+			env:     moduleEnv{proxy: "off," + mirror},
+			wantErr: "GOPROXY=off",
+		},
+	} {
+		dest, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fetchModule(dest, modPath, version, tc.sum, "", "", tc.env)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("[%s] expected error containing %q, got %v", tc.label, tc.wantErr, err)
+			}
+		} else if err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+		} else if got, err := ioutil.ReadFile(filepath.Join(dest, "sub", "sub.go")); err != nil || string(got) != "package sub\n" {
+			t.Errorf("[%s] sub/sub.go was not extracted: %q, %v", tc.label, got, err)
+		}
+		os.RemoveAll(dest)
+	}
+
+	// Modules are saved in the cache directory and read from it before
+	// trying proxies.
+	cacheDir := filepath.Join(proxyDir, "cache")
+	for _, tc := range []struct {
+		label string
+		env   moduleEnv
+	}{
+		{label: "cache miss", env: moduleEnv{proxy: mirror, cacheDir: cacheDir}},
+		{label: "cache hit", env: moduleEnv{proxy: "off", cacheDir: cacheDir}},
+	} {
+		dest, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fetchModule(dest, modPath, version, sum, "", "", tc.env); err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+		}
+		os.RemoveAll(dest)
+	}
+
+	// A direct fetch uses --remote and --vcs instead of discovery.
+	err = fetchModule(proxyDir, modPath, version, sum, "https://git.example.com/mod", "nope", moduleEnv{proxy: "direct"})
+	if err == nil || !strings.Contains(err.Error(), "invalid VCS type: nope") {
+		t.Errorf("[direct with remote] expected invalid VCS error, got %v", err)
+	}
+}
+
+func TestModuleRevision(t *testing.T) {
+	for _, tc := range []struct {
+		modPath, subdir, version string
+		rev, codeDir, pathMajor  string
+	}{
+		{"example.com/mod", "", "v1.2.0", "v1.2.0", "", ""},
+		{"example.com/mod", "", "v0.0.0-20170915032832-14c0d48ead0c", "14c0d48ead0c", "", ""},
+		{"example.com/mod", "", "v1.2.1-0.20170915032832-14c0d48ead0c", "14c0d48ead0c", "", ""},
+		{"example.com/mod", "", "v1.2.0-pre.0.20170915032832-14c0d48ead0c", "14c0d48ead0c", "", ""},
+		{"example.com/mod", "", "v2.0.0+incompatible", "v2.0.0", "", ""},
+		{"example.com/mod/v2", "v2", "v2.1.0", "v2.1.0", "", "v2"},
+		{"example.com/mod/v2", "v2", "v2.0.0-20170915032832-14c0d48ead0c", "14c0d48ead0c", "", "v2"},
+		{"example.com/mod/sub", "sub", "v1.0.0", "sub/v1.0.0", "sub", ""},
+		{"example.com/mod/sub/v3", "sub/v3", "v3.0.0", "sub/v3.0.0", "sub", "v3"},
+		{"example.com/mod/v2", "", "v2.1.0", "v2.1.0", "", "v2"},
+	} {
+		rev, codeDir, pathMajor := moduleRevision(tc.modPath, tc.subdir, tc.version)
+		if rev != tc.rev || codeDir != tc.codeDir || pathMajor != tc.pathMajor {
+			t.Errorf("moduleRevision(%q, %q, %q) = %q, %q, %q; want %q, %q, %q", tc.modPath, tc.subdir, tc.version, rev, codeDir, pathMajor, tc.rev, tc.codeDir, tc.pathMajor)
+		}
+	}
+}
+
+func TestFetchModuleDirect(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	tmp, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The repository has a v1 module at its root, a v2 module in the major
+	// subdirectory v2, and a nested module, which is in neither zip file.
+	remote := filepath.Join(tmp, "remote")
+	files := map[string]string{
+		"LICENSE":                   "license\n",
+		"go.mod":                    "module example.com/mod\n",
+		"mod.go":                    "package mod\n",
+		"vendor/modules.txt":        "# vendored\n",
+		"vendor/example.com/x/x.go": "package x\n",
+		"nested/go.mod":             "module example.com/mod/nested\n",
+		"nested/nested.go":          "package nested\n",
+		"v2/go.mod":                 "module example.com/mod/v2\n",
+		"v2/mod.go":                 "package mod // v2\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(remote, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustGit(t, remote, "init", "-q")
+	mustGit(t, remote, "add", ".")
+	mustGit(t, remote, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init")
+	mustGit(t, remote, "tag", "v1.0.0")
+	mustGit(t, remote, "tag", "v2.0.0")
+	commit := strings.TrimSpace(mustGit(t, remote, "rev-parse", "HEAD"))
+	pseudo := "v0.0.0-20170915032832-" + commit[:12]
+
+	v1Sum, err := modproxy.HashZip(moduleZip(t, "example.com/mod@v1.0.0/", map[string]string{
+		"LICENSE":            "license\n",
+		"go.mod":             "module example.com/mod\n",
+		"mod.go":             "package mod\n",
+		"vendor/modules.txt": "# vendored\n",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pseudoSum, err := modproxy.HashZip(moduleZip(t, "example.com/mod@"+pseudo+"/", map[string]string{
+		"LICENSE":            "license\n",
+		"go.mod":             "module example.com/mod\n",
+		"mod.go":             "package mod\n",
+		"vendor/modules.txt": "# vendored\n",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2Sum, err := modproxy.HashZip(moduleZip(t, "example.com/mod/v2@v2.0.0/", map[string]string{
+		"LICENSE": "license\n",
+		"go.mod":  "module example.com/mod/v2\n",
+		"mod.go":  "package mod // v2\n",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		label, modPath, version, sum, wantErr, wantFile, wantContent string
+	}{
+		{label: "tag", modPath: "example.com/mod", version: "v1.0.0", sum: v1Sum, wantFile: "mod.go", wantContent: "package mod\n"},
+		{label: "pseudo-version", modPath: "example.com/mod", version: pseudo, sum: pseudoSum, wantFile: "mod.go", wantContent: "package mod\n"},
+		{label: "major subdirectory", modPath: "example.com/mod/v2", version: "v2.0.0", sum: v2Sum, wantFile: "mod.go", wantContent: "package mod // v2\n"},
+		{label: "wrong sum", modPath: "example.com/mod", version: "v1.0.0", sum: v2Sum, wantErr: "checksum mismatch"},
+	} {
+		dest := filepath.Join(tmp, "dest", strings.Replace(tc.label, " ", "_", -1))
+		err := fetchModule(dest, tc.modPath, tc.version, tc.sum, remote, "git", moduleEnv{proxy: "direct"})
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("[%s] expected error containing %q, got %v", tc.label, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+			continue
+		}
+		if got, err := ioutil.ReadFile(filepath.Join(dest, tc.wantFile)); err != nil || string(got) != tc.wantContent {
+			t.Errorf("[%s] %s: got %q, %v; want %q", tc.label, tc.wantFile, got, err, tc.wantContent)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "nested")); !os.IsNotExist(err) {
+			t.Errorf("[%s] nested module was extracted", tc.label)
+		}
+	}
+}
+
+func TestExtractModuleZip_error(t *testing.T) {
+	for _, tc := range []struct {
+		label, name string
+	}{
+		{label: "outside module", name: "example.com/other@v1.0.0/x.go"},
+		{label: "parent dir", name: "example.com/mod@v1.0.0/../x.go"},
+	} {
+		dest, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := moduleZip(t, "", map[string]string{tc.name: "package x\n"})
+		if err := extractModuleZip(dest, "example.com/mod", "v1.0.0", data); err == nil {
+			t.Errorf("[%s] expected error", tc.label)
+		}
+		os.RemoveAll(dest)
+	}
+}
+
+// moduleZip returns a zip file containing files, with prefix added to their
+// names.
+func moduleZip(t *testing.T, prefix string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(prefix + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,92 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CgoVarPolicy determines how a variable like ${PKG_CONFIG_PATH} in a cgo
+// directive is written in copts and clinkopts.
+type CgoVarPolicy int
+
+const (
+	// RejectCgoVar indicates files that refer to the variable are reported
+	// as errors. This is the policy for variables that aren't configured.
+	RejectCgoVar CgoVarPolicy = iota
+
+	// PassCgoVar indicates the variable is written unexpanded. It's escaped
+	// as $${NAME}, so Bazel passes ${NAME} to the compiler or linker.
+	PassCgoVar
+
+	// MapCgoVar indicates the variable is replaced with a configured value,
+	// usually a Bazel make variable like $(GENDIR).
+	MapCgoVar
+)
+
+// CgoVar is the configured expansion of a variable in cgo directives.
+type CgoVar struct {
+	Policy CgoVarPolicy
+
+	// Value replaces the variable if Policy is MapCgoVar.
+	Value string
+}
+
+// ParseCgoVar parses the configuration of a cgo variable written as
+// "NAME=reject", "NAME=pass", or "NAME=map:VALUE", the format of gazelle's
+// -cgo_var flag. SRCDIR can't be configured, since it's always expanded to
+// the package directory.
+func ParseCgoVar(s string) (string, CgoVar, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return "", CgoVar{}, fmt.Errorf("cgo variable %q: want NAME=reject, NAME=pass, or NAME=map:VALUE", s)
+	}
+	name, policy := s[:i], s[i+1:]
+	if !IsCgoVarName(name) {
+		return "", CgoVar{}, fmt.Errorf("cgo variable %q: invalid name %q", s, name)
+	}
+	if name == "SRCDIR" {
+		return "", CgoVar{}, fmt.Errorf("cgo variable %q: SRCDIR is always expanded", s)
+	}
+	switch {
+	case policy == "reject":
+		return name, CgoVar{Policy: RejectCgoVar}, nil
+	case policy == "pass":
+		return name, CgoVar{Policy: PassCgoVar}, nil
+	case strings.HasPrefix(policy, "map:"):
+		return name, CgoVar{Policy: MapCgoVar, Value: policy[len("map:"):]}, nil
+	default:
+		return "", CgoVar{}, fmt.Errorf("cgo variable %q: unrecognized policy %q: want reject, pass, or map:VALUE", s, policy)
+	}
+}
+
+// IsCgoVarName returns whether s could name a variable in a cgo directive,
+// written like ${NAME}.
+func IsCgoVarName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', r == '_':
+		case i > 0 && '0' <= r && r <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
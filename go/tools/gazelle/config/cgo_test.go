@@ -0,0 +1,52 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "testing"
+
+func TestParseCgoVar(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		wantName string
+		want     CgoVar
+		wantErr  bool
+	}{
+		{s: "PKG_CONFIG_PATH=reject", wantName: "PKG_CONFIG_PATH", want: CgoVar{Policy: RejectCgoVar}},
+		{s: "PKG_CONFIG_PATH=pass", wantName: "PKG_CONFIG_PATH", want: CgoVar{Policy: PassCgoVar}},
+		{s: "GEN=map:$(GENDIR)/include", wantName: "GEN", want: CgoVar{Policy: MapCgoVar, Value: "$(GENDIR)/include"}},
+		{s: "GEN=map:", wantName: "GEN", want: CgoVar{Policy: MapCgoVar}},
+		{s: "GEN", wantErr: true},
+		{s: "GEN=keep", wantErr: true},
+		{s: "1GEN=pass", wantErr: true},
+		{s: "=pass", wantErr: true},
+		{s: "SRCDIR=pass", wantErr: true},
+	} {
+		name, got, err := ParseCgoVar(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseCgoVar(%q) succeeded; want error", tc.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCgoVar(%q) failed: %v", tc.s, err)
+			continue
+		}
+		if name != tc.wantName || got != tc.want {
+			t.Errorf("ParseCgoVar(%q) = %q, %#v; want %q, %#v", tc.s, name, got, tc.wantName, tc.want)
+		}
+	}
+}
@@ -16,7 +16,13 @@ limitations under the License.
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
 )
 
 // Config holds information about how Gazelle should run. This is mostly
@@ -31,8 +37,14 @@ type Config struct {
 	// ValidBuildFileNames is a list of base names that are considered valid
 	// build files. Some repositories may have files named "BUILD" that are not
 	// used by Bazel and should be ignored. Must contain at least one string.
+	// New build files are created with the first name.
 	ValidBuildFileNames []string
 
+	// RenameBuildFiles, if true, causes existing build files that are
+	// updated to be renamed to the first name in ValidBuildFileNames, when
+	// they have another name.
+	RenameBuildFiles bool
+
 	// GenericTags is a set of build constraints that are true on all platforms.
 	// It should not be nil.
 	GenericTags BuildTags
@@ -41,6 +53,12 @@ type Config struct {
 	// should include GenericTags. It should not be nil.
 	Platforms PlatformTags
 
+	// NoCgoPlatforms is a set of labels of platforms in Platforms where cgo
+	// is unavailable. If it's not empty, "cgo" is only set in the tags of
+	// the other platforms, and files that depend on cgo are added to
+	// platform-specific srcs.
+	NoCgoPlatforms map[string]bool
+
 	// GoPrefix is the portion of the import path for the root of this repository.
 	// This is used to map imports to labels within the repository.
 	GoPrefix string
@@ -48,8 +66,144 @@ type Config struct {
 	// DepMode determines how imports outside of GoPrefix are resolved.
 	DepMode DependencyMode
 
+	// GlobMode determines how mergeable attributes written with glob in
+	// existing build files are merged with generated lists.
+	GlobMode GlobMode
+
+	// ProtoMode determines how rules are generated for .proto files and
+	// checked-in .pb.go files.
+	ProtoMode ProtoMode
+
+	// HeaderMode determines where header files included by cgo code are
+	// listed.
+	HeaderMode HeaderMode
+
+	// Newline determines the line endings of build files Gazelle writes.
+	Newline Newline
+
+	// MergeStrategies maps names of mergeable attributes to the strategies
+	// used to merge them. Attributes not in the map are merged with
+	// ReplaceStrategy. "# gazelle:merge" directives in build files override
+	// these strategies in their directories and subdirectories.
+	MergeStrategies map[string]MergeStrategy
+
 	// KnownImports is a list of imports to add to the external resolver cache
 	KnownImports []string
+
+	// CgoVars maps names of variables in cgo directives, like
+	// PKG_CONFIG_PATH in ${PKG_CONFIG_PATH}, to how they're expanded.
+	// Files referring to variables not in the map, other than ${SRCDIR},
+	// are reported as errors.
+	CgoVars map[string]CgoVar
+
+	// GoVersion is the version of the Go SDK packages are built with. If
+	// it's set, packages that require a newer version are reported. It may
+	// be zero if the version isn't known.
+	GoVersion GoVersion
+
+	// DetectGoVersion enables detecting the Go version each target requires
+	// from the language features and standard packages its files use.
+	// Versions declared with "# gazelle:go_version" directives are used
+	// either way.
+	DetectGoVersion bool
+
+	// SelectSummaryThreshold, if positive, is the number of platform-specific
+	// srcs or deps a rule needs for a comment summarizing them to be added.
+	SelectSummaryThreshold int
+
+	// CollapseOSSelects enables moving srcs and deps used on all the
+	// platforms of an OS out of the platform-specific select cases and into
+	// a select case for the OS.
+	CollapseOSSelects bool
+
+	// MaxSelectBranches, if positive, is the number of platform-specific
+	// cases a rule's srcs may have in its selects. Rules with more are written
+	// with a glob instead, and the builder filters the matched files by
+	// build constraints on each platform.
+	MaxSelectBranches int
+
+	// ManagedImports maps import paths to labels, like "//foo:lib", of
+	// libraries in build files owned by other tools. These files are marked
+	// with "# gazelle:managed_by" and aren't updated, but imports of their
+	// libraries are resolved to these labels.
+	ManagedImports map[string]string
+
+	// Repos is a list of other repositories with Go packages imported by
+	// packages in this one. Imports in these repositories are resolved to
+	// labels in them instead of to go_repository rules.
+	Repos []Repo
+
+	// ExcludedPaths is a list of slash-separated paths, relative to RepoRoot,
+	// of directories that should not be visited. Entries may be glob patterns
+	// in the syntax accepted by path.Match.
+	ExcludedPaths []string
+
+	// IgnoredPaths is a list of slash-separated paths, relative to RepoRoot,
+	// of directories listed in the workspace's .bazelignore file. These are
+	// not visited either. Unlike ExcludedPaths, entries are literal paths,
+	// as they are for Bazel, so "*" and "[" have no special meaning.
+	IgnoredPaths []string
+
+	// FollowSymlinks determines whether symbolic links to directories are
+	// followed while walking the repository. Links that would lead back into
+	// a directory that is already being visited are skipped.
+	FollowSymlinks bool
+
+	// Annotation, if not empty, is added to a trailing comment on each
+	// generated rule, after merger.AnnotationPrefix. It identifies the Gazelle
+	// version and flags used to generate the rule.
+	Annotation string
+
+	// OwnedRulesOnly restricts merging to rules Gazelle owns: rules in
+	// existing build files with a trailing merger.AnnotationPrefix comment.
+	// Generated rules are marked with that comment. Generated rules with the
+	// same name as an existing rule that isn't marked are dropped, so
+	// handwritten rules, like wrappers around go_test, are left alone.
+	OwnedRulesOnly bool
+
+	// UpdateDirs, if not nil, is the set of slash-separated paths, relative to
+	// RepoRoot, of directories where build files should be generated. Other
+	// directories are only visited if they contain one of these directories.
+	// If UpdateDirs is nil, build files are generated everywhere.
+	UpdateDirs map[string]bool
+
+	// Jobs is the maximum number of directories that are read, and build
+	// files that are generated and written, concurrently. Values less than 1
+	// are treated as 1.
+	Jobs int
+
+	// MaxDepth is the maximum number of levels below RepoRoot that are
+	// visited. Deeper directories are skipped with a warning. If MaxDepth is
+	// 0, there is no limit.
+	MaxDepth int
+
+	// EmptyPackageVisibility, if not empty, is the default visibility of
+	// packages created in directories that have neither a build file nor any
+	// generated rules. This is useful for organizations that require every
+	// directory to be a Bazel package. If it's empty, no build file is
+	// created in those directories.
+	EmptyPackageVisibility string
+
+	// ImportPolicy, if not nil, forbids packages in parts of the repository
+	// from importing certain packages. Violations are reported when imports
+	// are resolved.
+	ImportPolicy *ImportPolicy
+
+	// Hermetic, if not nil, forbids Gazelle from consulting the network, so
+	// build files don't depend on the machine they're generated on.
+	// Forbidden lookups are reported when imports are resolved.
+	Hermetic *Hermetic
+
+	// TestSizePolicy, if not nil, chooses the size and timeout of go_test
+	// rules from statistics about their sources, when they aren't set with
+	// directives.
+	TestSizePolicy *TestSizePolicy
+
+	// UpdateDepsLocks, if true, causes lock files listing the external
+	// packages imported in a directory to be rewritten with the current
+	// imports. Otherwise, imports missing from lock files are reported as
+	// errors, and build files in those directories aren't updated.
+	UpdateDepsLocks bool
 }
 
 var DefaultValidBuildFileNames = []string{"BUILD.bazel", "BUILD"}
@@ -67,6 +221,65 @@ func (c *Config) DefaultBuildFileName() string {
 	return c.ValidBuildFileNames[0]
 }
 
+// NewBuildFilePath returns the path of a new build file in dir. It has the
+// first name in ValidBuildFileNames, unless dir contains a directory with
+// that name, as it does on case-insensitive file systems when there's a
+// directory named "build". Then the next name that isn't a directory is
+// used.
+func (c *Config) NewBuildFilePath(dir string) string {
+	for _, base := range c.ValidBuildFileNames {
+		p := filepath.Join(dir, base)
+		if st, err := os.Stat(p); err != nil || !st.IsDir() {
+			return p
+		}
+	}
+	return filepath.Join(dir, c.DefaultBuildFileName())
+}
+
+// IsExcludedPath returns whether the directory with the given slash-separated
+// path, relative to RepoRoot, should be skipped, together with all of its
+// subdirectories. The repository root itself is never excluded.
+func (c *Config) IsExcludedPath(rel string) bool {
+	if rel == "" {
+		return false
+	}
+	for _, p := range c.IgnoredPaths {
+		if rel == p || strings.HasPrefix(rel, p+"/") {
+			return true
+		}
+	}
+	for _, p := range c.ExcludedPaths {
+		if p == rel {
+			return true
+		}
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldUpdateDir returns whether build files should be generated in the
+// directory with the given slash-separated path, relative to RepoRoot.
+func (c *Config) ShouldUpdateDir(rel string) bool {
+	return c.UpdateDirs == nil || c.UpdateDirs[rel]
+}
+
+// ShouldVisitDir returns whether the directory with the given slash-separated
+// path, relative to RepoRoot, should be visited. This is true if build files
+// should be generated in the directory or in any of its subdirectories.
+func (c *Config) ShouldVisitDir(rel string) bool {
+	if c.ShouldUpdateDir(rel) {
+		return true
+	}
+	for dir := range c.UpdateDirs {
+		if rel == "" || strings.HasPrefix(dir, rel+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 // BuildTags is a set of build constraints.
 type BuildTags map[string]bool
 
@@ -84,21 +297,70 @@ func init() {
 	DefaultPlatformTags = make(PlatformTags)
 	arch := "amd64"
 	for _, os := range []string{"darwin", "linux", "windows"} {
-		label := fmt.Sprintf("@io_bazel_rules_go//go/platform:%s_%s", os, arch)
+		label := Platform{OS: os, Arch: arch}.Label()
 		DefaultPlatformTags[label] = BuildTags{arch: true, os: true}
 	}
 }
 
+// PlatformLabelPrefix is the package containing config_settings for each
+// platform supported by rules_go.
+const PlatformLabelPrefix = "@io_bazel_rules_go//go/platform:"
+
+// Platform identifies a target platform by operating system and
+// architecture. Either field may be empty, in which case the platform
+// matches any operating system or any architecture, but not both.
+type Platform struct {
+	OS, Arch string
+}
+
+// String returns the name of the platform's config_setting, for example,
+// "linux_amd64", "linux", or "amd64".
+func (p Platform) String() string {
+	switch {
+	case p.OS != "" && p.Arch != "":
+		return p.OS + "_" + p.Arch
+	case p.OS != "":
+		return p.OS
+	default:
+		return p.Arch
+	}
+}
+
+// Label returns the canonical label of the platform's config_setting, for
+// example, "@io_bazel_rules_go//go/platform:linux_amd64".
+func (p Platform) Label() string {
+	return PlatformLabelPrefix + p.String()
+}
+
 // PreprocessTags performs some automatic processing on generic and
-// platform-specific tags before they are used to match files.
+// platform-specific tags before they are used to match files. Platforms is
+// replaced with a copy, so it may be shared with other configurations.
 func (c *Config) PreprocessTags() {
-	c.GenericTags["cgo"] = true
+	if len(c.NoCgoPlatforms) == 0 {
+		c.GenericTags["cgo"] = true
+	}
 	c.GenericTags["gc"] = true
-	for _, platformTags := range c.Platforms {
-		for t, _ := range c.GenericTags {
-			platformTags[t] = true
+	platforms := make(PlatformTags)
+	for label, platformTags := range c.Platforms {
+		tags := make(BuildTags)
+		for t := range platformTags {
+			tags[t] = true
 		}
+		for t := range c.GenericTags {
+			tags[t] = true
+		}
+		if !c.NoCgoPlatforms[label] {
+			tags["cgo"] = true
+		}
+		platforms[label] = tags
 	}
+	c.Platforms = platforms
+}
+
+// CgoVaries returns whether cgo is available on some platforms but not
+// others. Files that depend on cgo can't be built on all platforms then.
+func (c *Config) CgoVaries() bool {
+	return len(c.NoCgoPlatforms) > 0
 }
 
 // DependencyMode determines how imports of packages outside of the prefix
@@ -128,3 +390,187 @@ func DependencyModeFromString(s string) (DependencyMode, error) {
 		return 0, fmt.Errorf("unrecognized dependency mode: %q", s)
 	}
 }
+
+// GlobMode determines how attributes like srcs are merged when they are
+// written with glob in an existing build file.
+type GlobMode int
+
+const (
+	// ReplaceGlobMode indicates globs should be replaced with generated lists.
+	ReplaceGlobMode GlobMode = iota
+
+	// KeepGlobMode indicates attributes written with glob should be left
+	// unchanged.
+	KeepGlobMode
+
+	// CompareGlobMode indicates globs should be expanded and compared with
+	// generated lists. Globs are kept if they match exactly the same files
+	// and are replaced otherwise.
+	CompareGlobMode
+)
+
+// In KeepGlobMode, globs combined with lists or selects using + are kept, and
+// the other components are merged without the files the globs match. In
+// CompareGlobMode, they're only kept if every file they match is generated.
+
+// ProtoMode determines how rules are generated for directories containing
+// .proto files.
+type ProtoMode int
+
+const (
+	// DefaultProtoMode indicates go_proto_library rules should be generated
+	// for .proto files. Checked-in .pb.go files are excluded from srcs,
+	// since they're generated by go_proto_library instead.
+	DefaultProtoMode ProtoMode = iota
+
+	// LegacyProtoMode indicates checked-in .pb.go files should be built
+	// with go_library, and .proto files should be listed in a filegroup so
+	// go_proto_library rules in other packages can depend on them.
+	LegacyProtoMode
+
+	// DisableProtoMode indicates .proto files should be ignored. Checked-in
+	// .pb.go files are built with go_library.
+	DisableProtoMode
+)
+
+// ProtoModeFromString converts a string from the command line to a
+// ProtoMode. Valid strings are "default", "legacy", and "disable". An error
+// will be returned for an invalid string.
+func ProtoModeFromString(s string) (ProtoMode, error) {
+	switch s {
+	case "default":
+		return DefaultProtoMode, nil
+	case "legacy":
+		return LegacyProtoMode, nil
+	case "disable":
+		return DisableProtoMode, nil
+	default:
+		return 0, fmt.Errorf("unrecognized proto mode: %q", s)
+	}
+}
+
+// HeaderMode determines where header files included by cgo code are listed.
+// Headers included by Go assembly are always listed in srcs.
+type HeaderMode int
+
+const (
+	// SrcsHeaderMode indicates headers should be listed in the srcs of the
+	// rule that builds the cgo code.
+	SrcsHeaderMode HeaderMode = iota
+
+	// CcLibraryHeaderMode indicates headers should be listed in the hdrs of
+	// a cc_library in the same package, which the rule lists in cdeps.
+	CcLibraryHeaderMode
+
+	// ExportHeaderMode is like CcLibraryHeaderMode, but the cc_library is
+	// visible to other packages, so C code in them can include the headers
+	// by listing it in cdeps.
+	ExportHeaderMode
+)
+
+// HeaderModeFromString converts a string from the command line to a
+// HeaderMode. Valid strings are "srcs", "cc_library", and "export". An error
+// will be returned for an invalid string.
+func HeaderModeFromString(s string) (HeaderMode, error) {
+	switch s {
+	case "srcs":
+		return SrcsHeaderMode, nil
+	case "cc_library":
+		return CcLibraryHeaderMode, nil
+	case "export":
+		return ExportHeaderMode, nil
+	default:
+		return 0, fmt.Errorf("unrecognized header mode: %q", s)
+	}
+}
+
+// GlobModeFromString converts a string from the command line to a
+// GlobMode. Valid strings are "replace", "keep", and "compare". An error
+// will be returned for an invalid string.
+func GlobModeFromString(s string) (GlobMode, error) {
+	switch s {
+	case "replace":
+		return ReplaceGlobMode, nil
+	case "keep":
+		return KeepGlobMode, nil
+	case "compare":
+		return CompareGlobMode, nil
+	default:
+		return 0, fmt.Errorf("unrecognized glob mode: %q", s)
+	}
+}
+
+// Newline determines the line endings of files Gazelle writes.
+type Newline int
+
+const (
+	// LFNewline indicates lines end with "\n".
+	LFNewline Newline = iota
+
+	// CRLFNewline indicates lines end with "\r\n".
+	CRLFNewline
+
+	// PlatformNewline indicates lines end with "\r\n" on Windows and "\n"
+	// elsewhere.
+	PlatformNewline
+)
+
+// NewlineFromString converts a string from the command line to a Newline.
+// Valid strings are "lf", "crlf", and "platform". An error will be returned
+// for an invalid string.
+func NewlineFromString(s string) (Newline, error) {
+	switch s {
+	case "lf":
+		return LFNewline, nil
+	case "crlf":
+		return CRLFNewline, nil
+	case "platform":
+		return PlatformNewline, nil
+	default:
+		return 0, fmt.Errorf("unrecognized newline policy: %q", s)
+	}
+}
+
+// Convert returns data with its line endings changed to n. data may have
+// any mix of "\n" and "\r\n" line endings.
+func (n Newline) Convert(data []byte) []byte {
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	if n == CRLFNewline || n == PlatformNewline && runtime.GOOS == "windows" {
+		data = bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+	}
+	return data
+}
+
+// MergeStrategy determines how the generated value of a mergeable attribute
+// is combined with the value in an existing rule.
+type MergeStrategy int
+
+const (
+	// ReplaceStrategy indicates generated values should replace existing
+	// values. Elements marked with "# keep" comments are preserved.
+	ReplaceStrategy MergeStrategy = iota
+
+	// UnionStrategy indicates existing elements should be preserved, and
+	// generated elements should be added.
+	UnionStrategy
+
+	// KeepStrategy indicates existing values should be left unchanged.
+	// Generated values are only used if the attribute is not set.
+	KeepStrategy
+)
+
+// MergeStrategyFromString converts a string from the command line or a
+// directive to a MergeStrategy. Valid strings are "replace", "union", and
+// "keep". An error will be returned for an invalid string.
+func MergeStrategyFromString(s string) (MergeStrategy, error) {
+	switch s {
+	case "replace":
+		return ReplaceStrategy, nil
+	case "union":
+		return UnionStrategy, nil
+	case "keep":
+		return KeepStrategy, nil
+	default:
+		return 0, fmt.Errorf("unrecognized merge strategy: %q", s)
+	}
+}
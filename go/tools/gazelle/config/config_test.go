@@ -15,7 +15,12 @@ limitations under the License.
 
 package config
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestPreprocessTags(t *testing.T) {
 	c := &Config{
@@ -46,3 +51,128 @@ func TestPreprocessTags(t *testing.T) {
 		}
 	}
 }
+
+func TestPreprocessTagsNoCgo(t *testing.T) {
+	windows := Platform{OS: "windows", Arch: "amd64"}.Label()
+	c := &Config{
+		GenericTags:    map[string]bool{},
+		Platforms:      DefaultPlatformTags,
+		NoCgoPlatforms: map[string]bool{windows: true},
+	}
+	c.PreprocessTags()
+	if c.GenericTags["cgo"] {
+		t.Errorf("generic tag cgo unexpectedly set")
+	}
+	for name, platformTags := range c.Platforms {
+		if want := name != windows; platformTags["cgo"] != want {
+			t.Errorf("on platform %q, got cgo %v; want %v", name, platformTags["cgo"], want)
+		}
+	}
+	if DefaultPlatformTags[windows]["gc"] {
+		t.Errorf("DefaultPlatformTags was modified")
+	}
+}
+
+func TestIsExcludedPath(t *testing.T) {
+	c := &Config{
+		ExcludedPaths: []string{"node_modules", "bazel-*", "third_party/*/testdata"},
+	}
+	for _, tc := range []struct {
+		rel  string
+		want bool
+	}{
+		{"", false},
+		{"node_modules", true},
+		{"node_modules_x", false},
+		{"bazel-out", true},
+		{"bazel-out/x", false},
+		{"third_party/foo/testdata", true},
+		{"third_party/foo", false},
+		{"src/node_modules", false},
+	} {
+		if got := c.IsExcludedPath(tc.rel); got != tc.want {
+			t.Errorf("IsExcludedPath(%q): got %v; want %v", tc.rel, got, tc.want)
+		}
+	}
+}
+
+func TestIsExcludedPathBazelIgnore(t *testing.T) {
+	c := &Config{
+		IgnoredPaths: []string{"node_modules", "out[1]", "gen*"},
+	}
+	for _, tc := range []struct {
+		rel  string
+		want bool
+	}{
+		{"node_modules", true},
+		{"node_modules/x", true},
+		{"node_modules_x", false},
+		{"out[1]", true},
+		{"out1", false},
+		{"gen*", true},
+		{"generated", false},
+	} {
+		if got := c.IsExcludedPath(tc.rel); got != tc.want {
+			t.Errorf("IsExcludedPath(%q): got %v; want %v", tc.rel, got, tc.want)
+		}
+	}
+}
+
+func TestShouldVisitDir(t *testing.T) {
+	c := &Config{UpdateDirs: map[string]bool{"a/b": true}}
+	for _, tc := range []struct {
+		rel           string
+		visit, update bool
+	}{
+		{"", true, false},
+		{"a", true, false},
+		{"a/b", true, true},
+		{"a/b/c", false, false},
+		{"ab", false, false},
+		{"d", false, false},
+	} {
+		if got := c.ShouldVisitDir(tc.rel); got != tc.visit {
+			t.Errorf("ShouldVisitDir(%q) = %v; want %v", tc.rel, got, tc.visit)
+		}
+		if got := c.ShouldUpdateDir(tc.rel); got != tc.update {
+			t.Errorf("ShouldUpdateDir(%q) = %v; want %v", tc.rel, got, tc.update)
+		}
+	}
+}
+
+func TestNewBuildFilePath(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Config{ValidBuildFileNames: []string{"BUILD", "BUILD.bazel"}}
+	if got, want := c.NewBuildFilePath(dir), filepath.Join(dir, "BUILD"); got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+
+	// A directory named BUILD, or "build" on a case-insensitive file system,
+	// can't be replaced by a build file, so the next name is used.
+	if err := os.Mkdir(filepath.Join(dir, "BUILD"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.NewBuildFilePath(dir), filepath.Join(dir, "BUILD.bazel"); got != want {
+		t.Errorf("with a BUILD directory, got %s; want %s", got, want)
+	}
+}
+
+func TestPlatformLabel(t *testing.T) {
+	for _, tc := range []struct {
+		p    Platform
+		want string
+	}{
+		{Platform{OS: "linux", Arch: "amd64"}, "@io_bazel_rules_go//go/platform:linux_amd64"},
+		{Platform{OS: "linux"}, "@io_bazel_rules_go//go/platform:linux"},
+		{Platform{Arch: "arm"}, "@io_bazel_rules_go//go/platform:arm"},
+	} {
+		if got := tc.p.Label(); got != tc.want {
+			t.Errorf("%#v.Label(): got %q; want %q", tc.p, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GoVersion is a Go release, like 1.9. Patch releases aren't distinguished,
+// since they don't add language features or packages. The zero value means
+// the version is unknown.
+type GoVersion struct {
+	Major, Minor int
+}
+
+// ParseGoVersion parses a version written like "1.9" or "go1.9". A patch
+// number, as in "1.9.2", is accepted and ignored.
+func ParseGoVersion(s string) (GoVersion, error) {
+	fields := strings.Split(strings.TrimPrefix(s, "go"), ".")
+	if len(fields) < 2 || len(fields) > 3 {
+		return GoVersion{}, fmt.Errorf("invalid Go version %q: want a version like 1.9", s)
+	}
+	var nums [3]int
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return GoVersion{}, fmt.Errorf("invalid Go version %q: want a version like 1.9", s)
+		}
+		nums[i] = n
+	}
+	if nums[0] == 0 {
+		return GoVersion{}, fmt.Errorf("invalid Go version %q: want a version like 1.9", s)
+	}
+	return GoVersion{Major: nums[0], Minor: nums[1]}, nil
+}
+
+// IsZero returns whether v is unknown.
+func (v GoVersion) IsZero() bool {
+	return v == GoVersion{}
+}
+
+// Less returns whether v is an earlier release than w.
+func (v GoVersion) Less(w GoVersion) bool {
+	if v.Major != w.Major {
+		return v.Major < w.Major
+	}
+	return v.Minor < w.Minor
+}
+
+// String returns v written like "1.9", or "" if v is unknown.
+func (v GoVersion) String() string {
+	if v.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
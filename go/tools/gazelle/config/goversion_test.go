@@ -0,0 +1,68 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "testing"
+
+func TestParseGoVersion(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    GoVersion
+		wantErr bool
+	}{
+		{s: "1.9", want: GoVersion{1, 9}},
+		{s: "go1.10", want: GoVersion{1, 10}},
+		{s: "1.8.3", want: GoVersion{1, 8}},
+		{s: "1", wantErr: true},
+		{s: "1.x", wantErr: true},
+		{s: "0.9", wantErr: true},
+		{s: "1.9.1.1", wantErr: true},
+		{s: "", wantErr: true},
+	} {
+		got, err := ParseGoVersion(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseGoVersion(%q) succeeded; want error", tc.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseGoVersion(%q) failed: %v", tc.s, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseGoVersion(%q) = %#v; want %#v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestGoVersionLess(t *testing.T) {
+	for _, tc := range []struct {
+		v, w GoVersion
+		want bool
+	}{
+		{GoVersion{1, 8}, GoVersion{1, 9}, true},
+		{GoVersion{1, 9}, GoVersion{1, 10}, true},
+		{GoVersion{1, 9}, GoVersion{1, 9}, false},
+		{GoVersion{1, 10}, GoVersion{1, 9}, false},
+		{GoVersion{1, 20}, GoVersion{2, 0}, true},
+		{GoVersion{}, GoVersion{1, 0}, true},
+	} {
+		if got := tc.v.Less(tc.w); got != tc.want {
+			t.Errorf("%v.Less(%v) = %v; want %v", tc.v, tc.w, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Hermetic forbids Gazelle from consulting anything that may differ between
+// machines, so the same repository produces the same build files everywhere.
+// It is set with -hermetic.
+//
+// Gazelle never reads GOPATH, the installed Go toolchain, or pkg-config:
+// standard packages are recognized by their import paths, and #cgo
+// pkg-config directives are reported as errors. The only other source of
+// information is the network, which the external resolver uses to find the
+// repository roots of import paths it doesn't know. In hermetic mode, those
+// lookups fail instead, and they're counted, so Gazelle can exit with an
+// error after generating build files. A Hermetic may be used concurrently.
+type Hermetic struct {
+	// violations is the number of errors returned by Forbid. It's first, so
+	// it's aligned for atomic access on 32-bit platforms.
+	violations int64
+}
+
+// Forbid returns an error describing something that hermetic mode doesn't
+// allow and counts it. If h is nil, hermetic mode is off, and Forbid returns
+// nil.
+func (h *Hermetic) Forbid(format string, args ...interface{}) error {
+	if h == nil {
+		return nil
+	}
+	atomic.AddInt64(&h.violations, 1)
+	return fmt.Errorf("%s, which is not allowed with -hermetic", fmt.Sprintf(format, args...))
+}
+
+// ViolationCount returns the number of errors returned by Forbid.
+func (h *Hermetic) ViolationCount() int {
+	if h == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&h.violations))
+}
@@ -0,0 +1,38 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "testing"
+
+func TestHermeticForbid(t *testing.T) {
+	var off *Hermetic
+	if err := off.Forbid("network access"); err != nil {
+		t.Errorf("got error %v with hermetic mode off; want nil", err)
+	}
+	if n := off.ViolationCount(); n != 0 {
+		t.Errorf("got %d violations with hermetic mode off; want 0", n)
+	}
+
+	h := &Hermetic{}
+	err := h.Forbid("fetching %q needs network access", "example.com/x")
+	if want := `fetching "example.com/x" needs network access, which is not allowed with -hermetic`; err == nil || err.Error() != want {
+		t.Errorf("got error %v; want %q", err, want)
+	}
+	h.Forbid("again")
+	if n := h.ViolationCount(); n != 2 {
+		t.Errorf("got %d violations; want 2", n)
+	}
+}
@@ -0,0 +1,66 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+// RepoOverride holds settings used when generating build files for a
+// repository whose packages have sources for many platforms. Without them,
+// rules in these repositories have selects with hundreds of cases, which are
+// slow to load and hard to read.
+type RepoOverride struct {
+	// Prefix is the import path of the repository's root directory.
+	Prefix string
+
+	// CollapseOSSelects and MaxSelectBranches are used in place of the
+	// fields of Config with the same names.
+	CollapseOSSelects bool
+	MaxSelectBranches int
+}
+
+// KnownRepoOverrides is the curated list of repositories with settings that
+// produce compact rules for them. golang.org/x/sys/unix, for example, has
+// files for almost every platform, so its srcs are written with a glob, and
+// the builder filters them by build constraints.
+var KnownRepoOverrides = []RepoOverride{
+	{Prefix: "github.com/fsnotify/fsnotify", CollapseOSSelects: true},
+	{Prefix: "github.com/mattn/go-isatty", CollapseOSSelects: true},
+	{Prefix: "github.com/shirou/gopsutil", CollapseOSSelects: true, MaxSelectBranches: 8},
+	{Prefix: "golang.org/x/crypto", CollapseOSSelects: true},
+	{Prefix: "golang.org/x/net", CollapseOSSelects: true, MaxSelectBranches: 8},
+	{Prefix: "golang.org/x/sys", CollapseOSSelects: true, MaxSelectBranches: 4},
+}
+
+// RepoOverrideFor returns the entry in overrides for the repository with
+// the import path prefix, or nil if there isn't one.
+func RepoOverrideFor(overrides []RepoOverride, prefix string) *RepoOverride {
+	for i := range overrides {
+		if overrides[i].Prefix == prefix {
+			return &overrides[i]
+		}
+	}
+	return nil
+}
+
+// ApplyRepoOverride sets the fields of c that o overrides. Fields named in
+// explicit, by the name of the gazelle flag that sets them, like
+// "max_select_branches", are left alone, so flags take precedence.
+func (c *Config) ApplyRepoOverride(o *RepoOverride, explicit map[string]bool) {
+	if !explicit["collapse_os_selects"] {
+		c.CollapseOSSelects = o.CollapseOSSelects
+	}
+	if !explicit["max_select_branches"] {
+		c.MaxSelectBranches = o.MaxSelectBranches
+	}
+}
@@ -0,0 +1,51 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "testing"
+
+func TestApplyRepoOverride(t *testing.T) {
+	if o := RepoOverrideFor(KnownRepoOverrides, "golang.org/x/sys/unix"); o != nil {
+		t.Errorf("got override %+v for a package; want overrides only for repository roots", o)
+	}
+	o := RepoOverrideFor(KnownRepoOverrides, "golang.org/x/sys")
+	if o == nil {
+		t.Fatal("no override for golang.org/x/sys")
+	}
+
+	for _, tc := range []struct {
+		label        string
+		explicit     map[string]bool
+		wantCollapse bool
+		wantMax      int
+	}{
+		{
+			label:        "no flags",
+			wantCollapse: true,
+			wantMax:      o.MaxSelectBranches,
+		}, {
+			label:    "explicit flags",
+			explicit: map[string]bool{"collapse_os_selects": true, "max_select_branches": true},
+			wantMax:  100,
+		},
+	} {
+		c := &Config{GoPrefix: "golang.org/x/sys", MaxSelectBranches: 100}
+		c.ApplyRepoOverride(o, tc.explicit)
+		if c.CollapseOSSelects != tc.wantCollapse || c.MaxSelectBranches != tc.wantMax {
+			t.Errorf("[%s] got collapse %v, max %d; want collapse %v, max %d", tc.label, c.CollapseOSSelects, c.MaxSelectBranches, tc.wantCollapse, tc.wantMax)
+		}
+	}
+}
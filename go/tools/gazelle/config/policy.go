@@ -0,0 +1,201 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// ImportPolicy is a set of rules that forbid packages in parts of the
+// repository from importing certain packages. It is read from a file with
+// ReadImportPolicy. Each line of the file is a rule of the form:
+//
+//	<level> <import pattern> [in <subtree>...] [except <subtree>...]
+//
+// level is "error" or "warning". An import pattern is an import path, or an
+// import path followed by "/..." to match the path and everything under it.
+// Subtrees are labels of directories, like "//storage", which match the
+// directory and its subdirectories; "//" matches the whole repository. A
+// rule applies to packages in any "in" subtree (or anywhere, if there are
+// none), except packages in an "except" subtree. Blank lines and lines
+// starting with "#" are skipped. For example:
+//
+//	error github.com/lib/pq/... except //storage
+//	warning golang.org/x/net/context in //server //client
+//
+// An ImportPolicy may be checked concurrently.
+type ImportPolicy struct {
+	// errors is the number of imports found by Check that violate rules
+	// with ErrorPolicy. It's first, so it's aligned for atomic access on
+	// 32-bit platforms.
+	errors int64
+
+	Rules []ImportRule
+}
+
+// ImportRule is a rule in an ImportPolicy.
+type ImportRule struct {
+	Level PolicyLevel
+
+	// Pattern is the import pattern, as written in the policy file.
+	Pattern string
+
+	// In and Except are slash-separated paths, relative to the repository
+	// root, of the subtrees the rule applies and doesn't apply to. The
+	// repository root is "".
+	In, Except []string
+}
+
+// PolicyLevel determines how violations of an ImportRule are reported.
+type PolicyLevel int
+
+const (
+	// ErrorPolicy indicates violations are reported as errors, and Gazelle
+	// fails after generating build files.
+	ErrorPolicy PolicyLevel = iota
+
+	// WarningPolicy indicates violations are reported as warnings.
+	WarningPolicy
+)
+
+// ReadImportPolicy reads an import policy from the file at path. See
+// ImportPolicy for the format.
+func ReadImportPolicy(path string) (*ImportPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &ImportPolicy{}
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseImportRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		p.Rules = append(p.Rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseImportRule(line string) (ImportRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return ImportRule{}, fmt.Errorf("want <level> <import pattern> [in <subtree>...] [except <subtree>...]")
+	}
+	var r ImportRule
+	switch fields[0] {
+	case "error":
+		r.Level = ErrorPolicy
+	case "warning":
+		r.Level = WarningPolicy
+	default:
+		return ImportRule{}, fmt.Errorf("unrecognized level %q: want error or warning", fields[0])
+	}
+	r.Pattern = fields[1]
+
+	var dst *[]string
+	for _, f := range fields[2:] {
+		switch {
+		case f == "in":
+			dst = &r.In
+		case f == "except":
+			dst = &r.Except
+		case dst == nil:
+			return ImportRule{}, fmt.Errorf("unexpected %q: subtrees must follow \"in\" or \"except\"", f)
+		case !strings.HasPrefix(f, "//"):
+			return ImportRule{}, fmt.Errorf("subtree %q: must start with \"//\"", f)
+		default:
+			rel := strings.TrimSuffix(strings.TrimPrefix(f, "//"), "/...")
+			if rel = path.Clean(rel); rel == "." {
+				rel = ""
+			}
+			*dst = append(*dst, rel)
+		}
+	}
+	return r, nil
+}
+
+// Check returns the first rule that forbids packages in the directory rel,
+// a slash-separated path relative to the repository root, from importing
+// imp. nil is returned if the import is allowed. Violations of rules with
+// ErrorPolicy are counted; see ErrorCount.
+func (p *ImportPolicy) Check(rel, imp string) *ImportRule {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.matchesImport(imp) || !r.appliesTo(rel) {
+			continue
+		}
+		if r.Level == ErrorPolicy {
+			atomic.AddInt64(&p.errors, 1)
+		}
+		return r
+	}
+	return nil
+}
+
+// ErrorCount returns the number of imports found by Check that violate
+// rules with ErrorPolicy.
+func (p *ImportPolicy) ErrorCount() int {
+	if p == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&p.errors))
+}
+
+func (r *ImportRule) matchesImport(imp string) bool {
+	if strings.HasSuffix(r.Pattern, "/...") {
+		prefix := r.Pattern[:len(r.Pattern)-len("/...")]
+		return imp == prefix || strings.HasPrefix(imp, prefix+"/")
+	}
+	return imp == r.Pattern
+}
+
+func (r *ImportRule) appliesTo(rel string) bool {
+	if len(r.In) > 0 && !inSubtrees(rel, r.In) {
+		return false
+	}
+	return !inSubtrees(rel, r.Except)
+}
+
+// inSubtrees returns whether the directory rel is one of the directories in
+// subtrees or is under one of them.
+func inSubtrees(rel string, subtrees []string) bool {
+	for _, s := range subtrees {
+		if s == "" || rel == s || strings.HasPrefix(rel, s+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writePolicy(t *testing.T, content string) string {
+	f, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestReadImportPolicy(t *testing.T) {
+	path := writePolicy(t, `
+# Only storage may use database drivers.
+error github.com/lib/pq/... except //storage
+warning golang.org/x/net/context in //server/... //client
+error example.com/internal/secret in // except //vault
+`)
+	defer os.Remove(path)
+
+	p, err := ReadImportPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImportRule{
+		{Level: ErrorPolicy, Pattern: "github.com/lib/pq/...", Except: []string{"storage"}},
+		{Level: WarningPolicy, Pattern: "golang.org/x/net/context", In: []string{"server", "client"}},
+		{Level: ErrorPolicy, Pattern: "example.com/internal/secret", In: []string{""}, Except: []string{"vault"}},
+	}
+	if !reflect.DeepEqual(p.Rules, want) {
+		t.Errorf("got rules %#v; want %#v", p.Rules, want)
+	}
+}
+
+func TestReadImportPolicyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		content, wantError string
+	}{
+		{"error", "want <level>"},
+		{"fatal example.com/x", "unrecognized level"},
+		{"error example.com/x //storage", "must follow"},
+		{"error example.com/x except storage", "must start with"},
+	} {
+		path := writePolicy(t, tc.content)
+		defer os.Remove(path)
+		_, err := ReadImportPolicy(path)
+		if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+			t.Errorf("for %q, got error %v; want error containing %q", tc.content, err, tc.wantError)
+		}
+	}
+}
+
+func TestImportPolicyCheck(t *testing.T) {
+	p := &ImportPolicy{Rules: []ImportRule{
+		{Level: ErrorPolicy, Pattern: "github.com/lib/pq/...", Except: []string{"storage"}},
+		{Level: WarningPolicy, Pattern: "golang.org/x/net/context", In: []string{"server"}},
+	}}
+	for _, tc := range []struct {
+		rel, imp string
+		want     *ImportRule
+	}{
+		{"app", "github.com/lib/pq", &p.Rules[0]},
+		{"", "github.com/lib/pq/oid", &p.Rules[0]},
+		{"app", "github.com/lib/pqx", nil},
+		{"storage", "github.com/lib/pq", nil},
+		{"storage/sql", "github.com/lib/pq", nil},
+		{"storagex", "github.com/lib/pq", &p.Rules[0]},
+		{"server/http", "golang.org/x/net/context", &p.Rules[1]},
+		{"client", "golang.org/x/net/context", nil},
+		{"server", "golang.org/x/net/context/ctxhttp", nil},
+	} {
+		if got := p.Check(tc.rel, tc.imp); got != tc.want {
+			t.Errorf("Check(%q, %q) = %v; want %v", tc.rel, tc.imp, got, tc.want)
+		}
+	}
+	if got := p.ErrorCount(); got != 3 {
+		t.Errorf("ErrorCount() = %d; want 3", got)
+	}
+
+	var nilPolicy *ImportPolicy
+	if r := nilPolicy.Check("app", "github.com/lib/pq"); r != nil || nilPolicy.ErrorCount() != 0 {
+		t.Errorf("nil policy forbids imports")
+	}
+}
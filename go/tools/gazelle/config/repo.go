@@ -0,0 +1,119 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Repo is another Bazel repository with Go packages imported by packages in
+// this one, like a first-party repository declared with local_repository.
+// Imports in Prefix are resolved to labels in the repository, like
+// "@name//pkg:go_default_library", instead of to go_repository rules.
+type Repo struct {
+	// Name is the name of the repository in the WORKSPACE file.
+	Name string
+
+	// Prefix is the Go import path of the repository's root directory.
+	Prefix string
+
+	// Root is the path to the repository's root directory. If it's not
+	// absolute, it's relative to the root of this repository.
+	Root string
+}
+
+// ParseRepo parses a repository written as "name,prefix,root", the format
+// of gazelle's -repo flag.
+func ParseRepo(s string) (Repo, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 3 {
+		return Repo{}, fmt.Errorf("repository %q: want name,prefix,root", s)
+	}
+	r := Repo{Name: fields[0], Prefix: path.Clean(fields[1]), Root: fields[2]}
+	if !isRepoName(r.Name) {
+		return Repo{}, fmt.Errorf("repository %q: invalid name %q", s, r.Name)
+	}
+	if fields[1] == "" || r.Prefix == "." || path.IsAbs(r.Prefix) {
+		return Repo{}, fmt.Errorf("repository %q: invalid import path prefix %q", s, fields[1])
+	}
+	if r.Root == "" {
+		return Repo{}, fmt.Errorf("repository %q: root directory is empty", s)
+	}
+	return r, nil
+}
+
+// RootDir returns the absolute path to the root directory of r. Relative
+// roots are interpreted relative to c.RepoRoot.
+func (c *Config) RootDir(r Repo) string {
+	if filepath.IsAbs(r.Root) {
+		return filepath.Clean(r.Root)
+	}
+	return filepath.Join(c.RepoRoot, r.Root)
+}
+
+// RepoForImport returns the repository in c.Repos containing the package
+// imp. If imp is in more than one repository, the one with the longest
+// prefix is returned. nil is returned if imp isn't in any of them, or if
+// it's in c.GoPrefix and no repository has a longer prefix, since packages
+// in this repository take precedence.
+func (c *Config) RepoForImport(imp string) *Repo {
+	var best *Repo
+	for i := range c.Repos {
+		r := &c.Repos[i]
+		if hasImportPrefix(imp, r.Prefix) && (best == nil || len(r.Prefix) > len(best.Prefix)) {
+			best = r
+		}
+	}
+	if best == nil || (hasImportPrefix(imp, c.GoPrefix) && len(c.GoPrefix) >= len(best.Prefix)) {
+		return nil
+	}
+	return best
+}
+
+// RepoByName returns the repository in c.Repos named name, or nil if there
+// is none.
+func (c *Config) RepoByName(name string) *Repo {
+	for i := range c.Repos {
+		if c.Repos[i].Name == name {
+			return &c.Repos[i]
+		}
+	}
+	return nil
+}
+
+// hasImportPrefix returns whether imp is prefix or a package under it.
+func hasImportPrefix(imp, prefix string) bool {
+	return imp == prefix || strings.HasPrefix(imp, prefix+"/")
+}
+
+// isRepoName returns whether s is a valid Bazel repository name.
+func isRepoName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case i > 0 && ('0' <= r && r <= '9' || r == '_' || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "testing"
+
+func TestParseRepo(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    Repo
+		wantErr bool
+	}{
+		{s: "com_example_lib,example.com/lib,../lib", want: Repo{Name: "com_example_lib", Prefix: "example.com/lib", Root: "../lib"}},
+		{s: "lib,example.com/lib/,/src/lib", want: Repo{Name: "lib", Prefix: "example.com/lib", Root: "/src/lib"}},
+		{s: "lib,example.com/lib", wantErr: true},
+		{s: "lib,example.com/lib,../lib,x", wantErr: true},
+		{s: "@lib,example.com/lib,../lib", wantErr: true},
+		{s: "1lib,example.com/lib,../lib", wantErr: true},
+		{s: "lib,,../lib", wantErr: true},
+		{s: "lib,example.com/lib,", wantErr: true},
+	} {
+		got, err := ParseRepo(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseRepo(%q) succeeded; want error", tc.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRepo(%q) failed: %v", tc.s, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseRepo(%q) = %#v; want %#v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestRepoForImport(t *testing.T) {
+	c := &Config{
+		GoPrefix: "example.com/repo",
+		Repos: []Repo{
+			{Name: "com_example_lib", Prefix: "example.com/lib"},
+			{Name: "com_example_lib_sub", Prefix: "example.com/lib/sub"},
+			{Name: "com_example_vendored", Prefix: "example.com/repo/vendored"},
+		},
+	}
+	for _, tc := range []struct {
+		imp, want string
+	}{
+		{"example.com/lib", "com_example_lib"},
+		{"example.com/lib/a", "com_example_lib"},
+		{"example.com/libx", ""},
+		{"example.com/lib/sub/b", "com_example_lib_sub"},
+		{"example.com/repo/a", ""},
+		{"example.com/repo/vendored/a", "com_example_vendored"},
+		{"github.com/x/y", ""},
+	} {
+		var got string
+		if r := c.RepoForImport(tc.imp); r != nil {
+			got = r.Name
+		}
+		if got != tc.want {
+			t.Errorf("RepoForImport(%q) = %q; want %q", tc.imp, got, tc.want)
+		}
+	}
+}
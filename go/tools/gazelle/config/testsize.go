@@ -0,0 +1,197 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// TestSizePolicy chooses default size and timeout attributes for go_test
+// rules from statistics about their sources, so tests that are likely to be
+// slow aren't declared small. It is read from a file with
+// ReadTestSizePolicy. Each line of the file is a rule of the form:
+//
+//	<size>[/<timeout>] [if <condition>...]
+//
+// size is small, medium, large, or enormous, and timeout is short, moderate,
+// long, or eternal. A rule applies to a test if all of its conditions hold;
+// a rule without conditions applies to every test. The conditions are:
+//
+//	files>=N   the test has at least N .go files
+//	network    the test imports a networking package, like net/http
+//	sleep      the test calls time.Sleep
+//	tag=NAME   a build constraint of one of the test's files mentions NAME
+//
+// The first rule that applies is used. Blank lines and lines starting with
+// "#" are skipped. For example:
+//
+//	large/long if tag=integration
+//	medium if network
+//	medium if sleep
+//	medium if files>=20
+//
+// Sizes and timeouts set with "# gazelle:test_size" and
+// "# gazelle:test_timeout" directives take precedence, so the policy can be
+// overridden in individual directories.
+type TestSizePolicy struct {
+	Rules []TestSizeRule
+}
+
+// TestSizeRule is a rule in a TestSizePolicy.
+type TestSizeRule struct {
+	// Size and Timeout are the attributes chosen by the rule. Timeout may be
+	// empty.
+	Size, Timeout string
+
+	// MinFiles is the number of .go files a test needs for the rule to
+	// apply. It's 0 if there is no files condition.
+	MinFiles int
+
+	// Network and Sleep are true if the rule only applies to tests that use
+	// the network or call time.Sleep.
+	Network, Sleep bool
+
+	// Tags are build tags that must each be mentioned by a build constraint
+	// of one of the test's files.
+	Tags []string
+}
+
+// TestStats describes the sources of a test. It's used to choose a rule from
+// a TestSizePolicy.
+type TestStats struct {
+	// Files is the number of .go files in the test.
+	Files int
+
+	// Network is true if any file imports a networking package, and Sleep
+	// is true if any file calls time.Sleep.
+	Network, Sleep bool
+
+	// Tags is the set of build tags mentioned in the build constraints of
+	// the test's files.
+	Tags map[string]bool
+}
+
+// ValidTestSizes and ValidTestTimeouts are the values Bazel accepts for the
+// size and timeout attributes of tests.
+var (
+	ValidTestSizes    = map[string]bool{"small": true, "medium": true, "large": true, "enormous": true}
+	ValidTestTimeouts = map[string]bool{"short": true, "moderate": true, "long": true, "eternal": true}
+)
+
+// ReadTestSizePolicy reads a test size policy from the file at path. See
+// TestSizePolicy for the format.
+func ReadTestSizePolicy(path string) (*TestSizePolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &TestSizePolicy{}
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseTestSizeRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		p.Rules = append(p.Rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseTestSizeRule(line string) (TestSizeRule, error) {
+	fields := strings.Fields(line)
+	var r TestSizeRule
+	r.Size = fields[0]
+	if i := strings.IndexByte(r.Size, '/'); i >= 0 {
+		r.Size, r.Timeout = r.Size[:i], r.Size[i+1:]
+		if !ValidTestTimeouts[r.Timeout] {
+			return TestSizeRule{}, fmt.Errorf("unrecognized timeout %q: want short, moderate, long, or eternal", r.Timeout)
+		}
+	}
+	if !ValidTestSizes[r.Size] {
+		return TestSizeRule{}, fmt.Errorf("unrecognized size %q: want small, medium, large, or enormous", r.Size)
+	}
+	if len(fields) == 1 {
+		return r, nil
+	}
+	if fields[1] != "if" || len(fields) == 2 {
+		return TestSizeRule{}, fmt.Errorf("want <size>[/<timeout>] [if <condition>...]")
+	}
+
+	for _, f := range fields[2:] {
+		switch {
+		case f == "network":
+			r.Network = true
+		case f == "sleep":
+			r.Sleep = true
+		case strings.HasPrefix(f, "files>="):
+			n, err := strconv.Atoi(f[len("files>="):])
+			if err != nil || n < 0 {
+				return TestSizeRule{}, fmt.Errorf("condition %q: want a non-negative number of files", f)
+			}
+			r.MinFiles = n
+		case strings.HasPrefix(f, "tag="):
+			tag := f[len("tag="):]
+			if tag == "" {
+				return TestSizeRule{}, fmt.Errorf("condition %q: missing tag name", f)
+			}
+			r.Tags = append(r.Tags, tag)
+		default:
+			return TestSizeRule{}, fmt.Errorf("unrecognized condition %q: want files>=N, network, sleep, or tag=NAME", f)
+		}
+	}
+	return r, nil
+}
+
+// Choose returns the first rule that applies to a test with the given
+// statistics. nil is returned if no rule applies.
+func (p *TestSizePolicy) Choose(stats TestStats) *TestSizeRule {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Rules {
+		if r := &p.Rules[i]; r.appliesTo(stats) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *TestSizeRule) appliesTo(stats TestStats) bool {
+	if stats.Files < r.MinFiles || r.Network && !stats.Network || r.Sleep && !stats.Sleep {
+		return false
+	}
+	for _, tag := range r.Tags {
+		if !stats.Tags[tag] {
+			return false
+		}
+	}
+	return true
+}
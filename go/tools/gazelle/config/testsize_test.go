@@ -0,0 +1,96 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadTestSizePolicy(t *testing.T) {
+	path := writePolicy(t, `
+# Integration tests talk to real servers.
+large/long if tag=integration network
+medium if sleep
+medium/moderate if files>=20
+small
+`)
+	defer os.Remove(path)
+
+	p, err := ReadTestSizePolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TestSizeRule{
+		{Size: "large", Timeout: "long", Network: true, Tags: []string{"integration"}},
+		{Size: "medium", Sleep: true},
+		{Size: "medium", Timeout: "moderate", MinFiles: 20},
+		{Size: "small"},
+	}
+	if !reflect.DeepEqual(p.Rules, want) {
+		t.Errorf("got rules %#v; want %#v", p.Rules, want)
+	}
+}
+
+func TestReadTestSizePolicyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		content, wantError string
+	}{
+		{"tiny", "unrecognized size"},
+		{"small/forever", "unrecognized timeout"},
+		{"medium when sleep", "want <size>"},
+		{"medium if", "want <size>"},
+		{"medium if files>=many", "number of files"},
+		{"medium if tag=", "missing tag"},
+		{"medium if slow", "unrecognized condition"},
+	} {
+		path := writePolicy(t, tc.content)
+		defer os.Remove(path)
+		_, err := ReadTestSizePolicy(path)
+		if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+			t.Errorf("for %q, got error %v; want error containing %q", tc.content, err, tc.wantError)
+		}
+	}
+}
+
+func TestTestSizePolicyChoose(t *testing.T) {
+	p := &TestSizePolicy{Rules: []TestSizeRule{
+		{Size: "large", Timeout: "long", Network: true, Tags: []string{"integration"}},
+		{Size: "medium", Sleep: true},
+		{Size: "medium", MinFiles: 3},
+	}}
+	for _, tc := range []struct {
+		stats TestStats
+		want  *TestSizeRule
+	}{
+		{TestStats{Files: 1, Network: true, Tags: map[string]bool{"integration": true}}, &p.Rules[0]},
+		{TestStats{Files: 1, Network: true}, nil},
+		{TestStats{Files: 1, Sleep: true}, &p.Rules[1]},
+		{TestStats{Files: 3}, &p.Rules[2]},
+		{TestStats{Files: 2}, nil},
+	} {
+		if got := p.Choose(tc.stats); got != tc.want {
+			t.Errorf("Choose(%+v) = %v; want %v", tc.stats, got, tc.want)
+		}
+	}
+
+	var nilPolicy *TestSizePolicy
+	if got := nilPolicy.Choose(TestStats{Files: 100}); got != nil {
+		t.Errorf("nil policy: got %v; want nil", got)
+	}
+}
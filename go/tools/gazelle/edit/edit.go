@@ -0,0 +1,255 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package edit applies small scripted changes to rules in BUILD files, in
+// the style of buildozer. Edited files are formatted the same way Gazelle
+// formats the files it generates. Values added to attributes that Gazelle
+// regenerates are marked with "# keep", so later runs of Gazelle preserve
+// them.
+package edit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/rules"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/schema"
+)
+
+// keepComment is the marker recognized by merger for values that should be
+// preserved.
+const keepComment = "# keep"
+
+// listAttrs is the set of attributes that "set" always sets to a list, even
+// when a single value is given.
+var listAttrs = map[string]bool{
+	"clinkopts":  true,
+	"copts":      true,
+	"data":       true,
+	"deps":       true,
+	"srcs":       true,
+	"tags":       true,
+	"visibility": true,
+}
+
+// A Command is a single edit applied to a rule.
+type Command struct {
+	// Op is the name of the edit: "add", "remove", "set", or "rename".
+	Op string
+
+	// Args are the operands of the edit. For all operations except "rename",
+	// the first argument is the name of an attribute.
+	Args []string
+}
+
+// ParseCommand parses a command of the form "op arg...". Arguments are
+// separated by white space. The following commands are recognized:
+//
+//	add <attr> <value>...       appends values to a list attribute
+//	remove <attr> [<value>...]  removes values from a list attribute, or the
+//	                            whole attribute if no values are given
+//	set <attr> <value>...       replaces the value of an attribute
+//	rename <name>               renames the rule and references to it
+//	                            within the same file
+func ParseCommand(s string) (Command, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Command{}, errors.New("empty command")
+	}
+	cmd := Command{Op: fields[0], Args: fields[1:]}
+	if err := cmd.check(); err != nil {
+		return Command{}, err
+	}
+	return cmd, nil
+}
+
+func (cmd Command) String() string {
+	return strings.Join(append([]string{cmd.Op}, cmd.Args...), " ")
+}
+
+func (cmd Command) check() error {
+	var ok bool
+	switch cmd.Op {
+	case "add", "set":
+		ok = len(cmd.Args) >= 2
+	case "remove":
+		ok = len(cmd.Args) >= 1
+	case "rename":
+		ok = len(cmd.Args) == 1
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Op)
+	}
+	if !ok {
+		return fmt.Errorf("%q: wrong number of arguments", cmd)
+	}
+	return nil
+}
+
+// Apply applies cmds in order to the rule named name in f. It stops at the
+// first command that fails; commands before it remain applied.
+func Apply(f *bf.File, name string, cmds []Command) error {
+	r := findRule(f, name)
+	if r == nil {
+		return fmt.Errorf("%s: no rule named %q", f.Path, name)
+	}
+	for _, cmd := range cmds {
+		err := cmd.check()
+		if err == nil {
+			switch cmd.Op {
+			case "add":
+				err = add(r, cmd.Args[0], cmd.Args[1:])
+			case "remove":
+				remove(r, cmd.Args[0], cmd.Args[1:])
+			case "set":
+				err = set(r, cmd.Args[0], cmd.Args[1:])
+			case "rename":
+				err = rename(f, r, cmd.Args[0])
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", f.Path, name, err)
+		}
+	}
+	return nil
+}
+
+// Format sorts and formats f the same way Gazelle formats generated files
+// and returns the content of the file.
+func Format(f *bf.File) []byte {
+	rules.SortLabels(f)
+	bf.Rewrite(f, nil)
+	return bf.Format(f)
+}
+
+func findRule(f *bf.File, name string) *bf.Rule {
+	for _, r := range f.Rules("") {
+		if r.Name() == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func add(r *bf.Rule, attr string, values []string) error {
+	var list *bf.ListExpr
+	switch e := r.Attr(attr).(type) {
+	case nil:
+		list = &bf.ListExpr{}
+		r.SetAttr(attr, list)
+	case *bf.ListExpr:
+		list = e
+	case *bf.BinaryExpr:
+		// A list concatenated with a select expression.
+		if l, ok := e.X.(*bf.ListExpr); ok && e.Op == "+" {
+			list = l
+		}
+	}
+	if list == nil {
+		return fmt.Errorf("attribute %q is not a list", attr)
+	}
+
+	for _, v := range values {
+		if hasString(list, v) {
+			continue
+		}
+		list.List = append(list.List, newString(r.Kind(), attr, v))
+	}
+	return nil
+}
+
+func remove(r *bf.Rule, attr string, values []string) {
+	if len(values) == 0 {
+		r.DelAttr(attr)
+		return
+	}
+	e := r.Attr(attr)
+	if e == nil {
+		return
+	}
+	drop := make(map[string]bool)
+	for _, v := range values {
+		drop[v] = true
+	}
+	// Values are removed from every list in the attribute, including lists
+	// in select expressions.
+	bf.Walk(e, func(x bf.Expr, _ []bf.Expr) {
+		list, ok := x.(*bf.ListExpr)
+		if !ok {
+			return
+		}
+		kept := list.List[:0]
+		for _, elem := range list.List {
+			if s, ok := elem.(*bf.StringExpr); ok && drop[s.Value] {
+				continue
+			}
+			kept = append(kept, elem)
+		}
+		list.List = kept
+	})
+}
+
+func set(r *bf.Rule, attr string, values []string) error {
+	if attr == "name" {
+		return errors.New(`use "rename" to change the name of a rule`)
+	}
+	_, isList := r.Attr(attr).(*bf.ListExpr)
+	if len(values) == 1 && !isList && !listAttrs[attr] {
+		r.SetAttr(attr, newString(r.Kind(), attr, values[0]))
+		return nil
+	}
+	list := &bf.ListExpr{}
+	for _, v := range values {
+		list.List = append(list.List, newString(r.Kind(), attr, v))
+	}
+	r.SetAttr(attr, list)
+	return nil
+}
+
+func rename(f *bf.File, r *bf.Rule, newName string) error {
+	if findRule(f, newName) != nil {
+		return fmt.Errorf("a rule named %q already exists", newName)
+	}
+	oldRef, newRef := ":"+r.Name(), ":"+newName
+	r.SetAttr("name", &bf.StringExpr{Value: newName})
+	for _, s := range f.Stmt {
+		bf.Walk(s, func(x bf.Expr, _ []bf.Expr) {
+			if str, ok := x.(*bf.StringExpr); ok && str.Value == oldRef {
+				str.Value = newRef
+			}
+		})
+	}
+	return nil
+}
+
+// newString returns a string expression for a value of attr. The value is
+// marked with a "# keep" comment if Gazelle would otherwise discard it.
+func newString(kind, attr, value string) *bf.StringExpr {
+	s := &bf.StringExpr{Value: value}
+	if schema.IsMergeable(kind, attr) {
+		s.Comment().Suffix = []bf.Comment{{Token: keepComment, Suffix: true}}
+	}
+	return s
+}
+
+func hasString(list *bf.ListExpr, value string) bool {
+	for _, elem := range list.List {
+		if s, ok := elem.(*bf.StringExpr); ok && s.Value == value {
+			return true
+		}
+	}
+	return false
+}
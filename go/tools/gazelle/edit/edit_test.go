@@ -0,0 +1,173 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edit
+
+import (
+	"strings"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+const original = `go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    deps = ["//foo:go_default_library"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    library = ":go_default_library",
+)
+`
+
+func TestApply(t *testing.T) {
+	for _, tc := range []struct {
+		desc, name string
+		cmds       []string
+		want       string
+	}{
+		{
+			desc: "add dep",
+			name: "go_default_library",
+			cmds: []string{"add deps //bar:go_default_library //foo:go_default_library"},
+			want: `go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    deps = [
+        "//bar:go_default_library",  # keep
+        "//foo:go_default_library",
+    ],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    library = ":go_default_library",
+)
+`,
+		}, {
+			desc: "remove and set",
+			name: "go_default_library",
+			cmds: []string{
+				"remove deps //foo:go_default_library",
+				"set visibility //visibility:public",
+			},
+			want: `go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    visibility = ["//visibility:public"],
+    deps = [],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    library = ":go_default_library",
+)
+`,
+		}, {
+			desc: "rename",
+			name: "go_default_library",
+			cmds: []string{"rename lib"},
+			want: `go_library(
+    name = "lib",
+    srcs = ["lib.go"],
+    deps = ["//foo:go_default_library"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    library = ":lib",
+)
+`,
+		},
+	} {
+		f, err := bf.Parse("BUILD", []byte(original))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cmds []Command
+		for _, s := range tc.cmds {
+			cmd, err := ParseCommand(s)
+			if err != nil {
+				t.Fatalf("%s: ParseCommand(%q) failed: %v", tc.desc, s, err)
+			}
+			cmds = append(cmds, cmd)
+		}
+		if err := Apply(f, tc.name, cmds); err != nil {
+			t.Errorf("%s: Apply failed: %v", tc.desc, err)
+			continue
+		}
+		if got := string(Format(f)); got != tc.want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		desc, name string
+		cmd        Command
+		want       string
+	}{
+		{
+			desc: "missing rule",
+			name: "missing",
+			cmd:  Command{Op: "add", Args: []string{"deps", "//bar"}},
+			want: "no rule named",
+		}, {
+			desc: "not a list",
+			name: "go_default_test",
+			cmd:  Command{Op: "add", Args: []string{"library", ":other"}},
+			want: "is not a list",
+		}, {
+			desc: "rename to existing",
+			name: "go_default_library",
+			cmd:  Command{Op: "rename", Args: []string{"go_default_test"}},
+			want: "already exists",
+		}, {
+			desc: "set name",
+			name: "go_default_library",
+			cmd:  Command{Op: "set", Args: []string{"name", "lib"}},
+			want: "rename",
+		}, {
+			desc: "unknown command",
+			name: "go_default_library",
+			cmd:  Command{Op: "frob"},
+			want: "unknown command",
+		},
+	} {
+		f, err := bf.Parse("BUILD", []byte(original))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Apply(f, tc.name, []Command{tc.cmd})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v; want error containing %q", tc.desc, err, tc.want)
+		}
+	}
+}
+
+func TestParseCommandErrors(t *testing.T) {
+	for _, s := range []string{"", "add deps", "rename", "rename a b", "remove"} {
+		if _, err := ParseCommand(s); err == nil {
+			t.Errorf("ParseCommand(%q) succeeded; want error", s)
+		}
+	}
+}
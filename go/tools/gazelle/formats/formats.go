@@ -0,0 +1,152 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package formats defines the JSON documents written by Gazelle and related
+// tools, so other programs can read them with these types instead of
+// reverse-engineering the output. The documents are:
+//
+//   - Diagnostic: a message written with "gazelle -log_format=json", one
+//     JSON object per line.
+//   - PackageDump: the packages found by "gazelle -mode=metadata".
+//   - Provenance: the VENDORED.json file vendor_repo writes into vendored
+//     repositories.
+//
+// Each document has a "version" field. Within a version, fields may be
+// added, and readers must ignore fields they don't recognize. Removing or
+// renaming a field, or changing its type or meaning, increments the version.
+// Writers always write the current version. Documents written before
+// versioning have no version field, so they're read as version 0, which has
+// the same fields as version 1, except that a PackageDump was a bare array
+// of packages. ReadPackageDump accepts both.
+package formats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Current versions of the documents in this package.
+const (
+	DiagnosticVersion  = 1
+	PackageDumpVersion = 1
+	ProvenanceVersion  = 1
+)
+
+// Diagnostic is a message about a problem Gazelle found, or about its
+// progress.
+type Diagnostic struct {
+	Version int `json:"version"`
+
+	// Level is "error", "warning", or "info".
+	Level string `json:"level"`
+
+	// Kind identifies the type of problem, like "parse_error". It is empty
+	// for informational messages and problems that aren't classified.
+	Kind string `json:"kind,omitempty"`
+
+	// Path is the file or directory the message is about, if any.
+	Path string `json:"path,omitempty"`
+
+	Message string `json:"message"`
+}
+
+// PackageDump lists the Go packages found in a repository.
+type PackageDump struct {
+	Version  int       `json:"version"`
+	Packages []Package `json:"packages"`
+}
+
+// Package describes a Go package and the targets Gazelle generates rules
+// for. Empty targets are omitted.
+type Package struct {
+	Name        string              `json:"name"`
+	Dir         string              `json:"dir"`
+	Rel         string              `json:"rel"`
+	ImportPath  string              `json:"importpath"`
+	Library     *Target             `json:"library,omitempty"`
+	CgoLibrary  *Target             `json:"cgo_library,omitempty"`
+	CLibrary    *Target             `json:"c_library,omitempty"`
+	Binary      *Target             `json:"binary,omitempty"`
+	Test        *Target             `json:"test,omitempty"`
+	XTest       *Target             `json:"xtest,omitempty"`
+	Protos      []string            `json:"protos,omitempty"`
+	HasPbGo     bool                `json:"has_pb_go,omitempty"`
+	HasTestdata bool                `json:"has_testdata,omitempty"`
+	Generate    []GenerateDirective `json:"generate,omitempty"`
+}
+
+// GenerateDirective is a //go:generate comment in a package's sources.
+type GenerateDirective struct {
+	File    string `json:"file"`
+	Command string `json:"command"`
+}
+
+// Target describes the sources and options of a rule.
+type Target struct {
+	Sources   *PlatformStrings `json:"srcs,omitempty"`
+	Imports   *PlatformStrings `json:"imports,omitempty"`
+	COpts     *PlatformStrings `json:"copts,omitempty"`
+	CLinkOpts *PlatformStrings `json:"clinkopts,omitempty"`
+
+	// Hdrs lists the header files in Sources.
+	Hdrs *PlatformStrings `json:"hdrs,omitempty"`
+}
+
+// PlatformStrings is a list of strings used on all platforms, and lists
+// used on specific platforms, keyed by config_setting label.
+type PlatformStrings struct {
+	Generic  []string            `json:"generic,omitempty"`
+	Platform map[string][]string `json:"platform,omitempty"`
+}
+
+// Provenance records where a vendored repository came from.
+type Provenance struct {
+	Version     int    `json:"version"`
+	ImportPath  string `json:"importpath"`
+	VCS         string `json:"vcs,omitempty"`
+	Remote      string `json:"remote,omitempty"`
+	Revision    string `json:"revision,omitempty"`
+	Source      string `json:"source,omitempty"`
+	RewrittenTo string `json:"rewritten_to,omitempty"`
+}
+
+// CheckVersion returns an error if a document of the named kind has a
+// version newer than current, which this package can't read reliably.
+func CheckVersion(kind string, version, current int) error {
+	if version > current {
+		return fmt.Errorf("%s version %d is newer than the supported version %d", kind, version, current)
+	}
+	return nil
+}
+
+// ReadPackageDump parses a PackageDump. Unversioned dumps, which are bare
+// arrays of packages, are accepted and read as version 0.
+func ReadPackageDump(data []byte) (*PackageDump, error) {
+	var dump PackageDump
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &dump.Packages); err != nil {
+			return nil, err
+		}
+		return &dump, nil
+	}
+	if err := json.Unmarshal(data, &dump); err != nil {
+		return nil, err
+	}
+	if err := CheckVersion("package dump", dump.Version, PackageDumpVersion); err != nil {
+		return nil, err
+	}
+	return &dump, nil
+}
@@ -0,0 +1,52 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package formats
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadPackageDump(t *testing.T) {
+	want := []Package{{Name: "lib", Rel: "lib", ImportPath: "example.com/repo/lib"}}
+	for _, tc := range []struct {
+		label, data string
+		version     int
+	}{
+		{
+			label: "unversioned",
+			data:  `[{"name": "lib", "rel": "lib", "importpath": "example.com/repo/lib"}]`,
+		}, {
+			label:   "version 1",
+			data:    `{"version": 1, "packages": [{"name": "lib", "rel": "lib", "importpath": "example.com/repo/lib", "new_field": true}]}`,
+			version: 1,
+		},
+	} {
+		dump, err := ReadPackageDump([]byte(tc.data))
+		if err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+			continue
+		}
+		if dump.Version != tc.version || !reflect.DeepEqual(dump.Packages, want) {
+			t.Errorf("[%s] got %+v; want version %d and packages %+v", tc.label, dump, tc.version, want)
+		}
+	}
+
+	if _, err := ReadPackageDump([]byte(`{"version": 2, "packages": []}`)); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("got error %v for a newer version; want a version error", err)
+	}
+}
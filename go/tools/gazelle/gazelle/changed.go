@@ -0,0 +1,174 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// changedDirs returns the set of directories, relative to repoRoot, that
+// contain files that differ from the git revision rev. Uncommitted and
+// untracked files are included; ignored files are not. Directories of
+// packages that import packages in these directories are not included.
+func changedDirs(repoRoot, rev string) (map[string]bool, error) {
+	// --no-renames reports both the old and new paths of renamed files.
+	diff, err := gitOutput(repoRoot, "diff", "--name-only", "--no-renames", "--relative", rev, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := gitOutput(repoRoot, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	return dirsOfFiles(append(diff, untracked...)), nil
+}
+
+// changedFilesDirs returns the set of directories, relative to repoRoot,
+// that contain the files listed in the file named name, or in stdin if name
+// is "-". This supports version control systems other than git, and CI
+// systems that already know which files changed.
+func changedFilesDirs(repoRoot, name string) (map[string]bool, error) {
+	r := io.Reader(os.Stdin)
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	files, err := readChangedFiles(r, repoRoot)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return dirsOfFiles(files), nil
+}
+
+// readChangedFiles reads a list of files, one per line, and returns their
+// slash-separated paths relative to repoRoot. Paths may be relative to
+// repoRoot or absolute. Blank lines are skipped.
+func readChangedFiles(r io.Reader, repoRoot string) ([]string, error) {
+	var files []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.TrimSpace(s.Text())
+		if f == "" {
+			continue
+		}
+		if filepath.IsAbs(f) {
+			rel, err := filepath.Rel(repoRoot, f)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return nil, fmt.Errorf("%s is not in the repository root %s", f, repoRoot)
+			}
+			f = rel
+		}
+		f = path.Clean(filepath.ToSlash(f))
+		if f == ".." || strings.HasPrefix(f, "../") {
+			return nil, fmt.Errorf("%s is not in the repository", f)
+		}
+		files = append(files, f)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// readDirs reads a list of directories, one per line, and returns the set
+// of their slash-separated paths relative to repoRoot. Like directories
+// named on the command line, paths may be absolute or relative to the
+// current directory. Blank lines are skipped.
+func readDirs(r io.Reader, repoRoot string) (map[string]bool, error) {
+	dirs := make(map[string]bool)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		d := strings.TrimSpace(s.Text())
+		if d == "" {
+			continue
+		}
+		abs, err := filepath.Abs(d)
+		if err != nil {
+			return nil, err
+		}
+		if !isDescendingDir(abs, repoRoot) {
+			return nil, fmt.Errorf("%s is not in the repository root %s", d, repoRoot)
+		}
+		rel, err := filepath.Rel(repoRoot, abs)
+		if err != nil {
+			return nil, err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		dirs[filepath.ToSlash(rel)] = true
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// dirsOfFiles returns the set of directories whose build files may be
+// affected by changes to the given slash-separated files. This includes
+// the directory containing each file and, for files in testdata, the
+// directory containing testdata.
+func dirsOfFiles(files []string) map[string]bool {
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		dir := path.Dir(f)
+		if dir == "." {
+			dir = ""
+		}
+		dirs[dir] = true
+		for rel := dir; rel != ""; {
+			parent := path.Dir(rel)
+			if parent == "." {
+				parent = ""
+			}
+			if path.Base(rel) == "testdata" {
+				dirs[parent] = true
+			}
+			rel = parent
+		}
+	}
+	return dirs
+}
+
+func gitOutput(dir string, args ...string) ([]string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,95 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDirsOfFiles(t *testing.T) {
+	got := dirsOfFiles([]string{
+		"main.go",
+		"a/b/lib.go",
+		"a/b/BUILD",
+		"c/testdata/x/in.txt",
+	})
+	want := map[string]bool{
+		"":             true,
+		"a/b":          true,
+		"c":            true,
+		"c/testdata/x": true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestReadChangedFiles(t *testing.T) {
+	root := filepath.FromSlash("/repo")
+	input := strings.Join([]string{
+		"a/b/lib.go",
+		"",
+		"  c/d.go\r",
+		filepath.Join(root, "e", "f.go"),
+		"./g//h.go",
+	}, "\n")
+	got, err := readChangedFiles(strings.NewReader(input), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a/b/lib.go", "c/d.go", "e/f.go", "g/h.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	for _, bad := range []string{"../other/x.go", filepath.Join(filepath.FromSlash("/other"), "x.go")} {
+		if _, err := readChangedFiles(strings.NewReader(bad), root); err == nil {
+			t.Errorf("%s: got success; want error for a file outside the repository", bad)
+		}
+	}
+}
+
+func TestReadDirs(t *testing.T) {
+	root, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Join([]string{
+		"a/b",
+		"",
+		"  c\r",
+		filepath.Join(root, "e", "f"),
+		"./g//h/",
+		".",
+	}, "\n")
+	got, err := readDirs(strings.NewReader(input), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"a/b": true, "c": true, "e/f": true, "g/h": true, "": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	for _, bad := range []string{"..", filepath.Join(filepath.Dir(root), "other")} {
+		if _, err := readDirs(strings.NewReader(bad), root); err == nil {
+			t.Errorf("%s: got success; want error for a directory outside the repository", bad)
+		}
+	}
+}
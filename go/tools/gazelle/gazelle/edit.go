@@ -0,0 +1,152 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/edit"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/wspace"
+)
+
+func editUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle edit [flags...] command... label...
+
+Edit applies commands to the rules named by labels, then formats the edited
+BUILD files the same way gazelle formats generated files. Labels must be
+absolute (//pkg:name) and refer to rules in the current repository.
+
+Commands are passed as single arguments, for example 'add deps //foo'.
+The following commands are supported:
+
+  add <attr> <value>...       appends values to a list attribute
+  remove <attr> [<value>...]  removes values from a list attribute, or the
+                              whole attribute if no values are given
+  set <attr> <value>...       replaces the value of an attribute
+  rename <name>               renames the rule and references to it within
+                              the same file
+
+Values added to attributes that gazelle regenerates (such as srcs and deps)
+are marked with a "# keep" comment so that gazelle preserves them.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
+
+func runEdit(args []string) error {
+	fs := flag.NewFlagSet("gazelle edit", flag.ContinueOnError)
+	fs.Usage = func() {}
+	buildFileName := fs.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names")
+	repoRoot := fs.String("repo_root", "", "path to the repository root, otherwise gazelle searches for it.")
+	mode := fs.String("mode", "fix", "print: prints the edited BUILD files\n\tfix: rewrites the BUILD files in place\n\tdiff: shows the changes that would be made")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			editUsage(fs)
+			os.Exit(0)
+		}
+		return errors.New("Try -help for more information.")
+	}
+
+	var cmds []edit.Command
+	var labels []resolve.Label
+	for _, arg := range fs.Args() {
+		if strings.HasPrefix(arg, "//") || strings.HasPrefix(arg, "@") || strings.HasPrefix(arg, ":") {
+			l, err := resolve.ParseLabel(arg)
+			if err != nil {
+				return err
+			}
+			if l.Repo != "" || l.Relative {
+				return fmt.Errorf("label %q: must be an absolute label in the current repository", arg)
+			}
+			labels = append(labels, l)
+			continue
+		}
+		cmd, err := edit.ParseCommand(arg)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, cmd)
+	}
+	if len(cmds) == 0 || len(labels) == 0 {
+		return errors.New("at least one command and one label must be given")
+	}
+
+	emit, ok := modeFromName[*mode]
+	if !ok {
+		return fmt.Errorf("unrecognized emit mode: %q", *mode)
+	}
+
+	c := &config.Config{
+		RepoRoot:            *repoRoot,
+		ValidBuildFileNames: strings.Split(*buildFileName, ","),
+	}
+	if c.RepoRoot == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if c.RepoRoot, err = wspace.Find(cwd); err != nil {
+			return fmt.Errorf("-repo_root not specified, and WORKSPACE cannot be found: %v", err)
+		}
+	}
+
+	// Labels in the same package are applied to the same file, which is
+	// emitted once after all edits.
+	var files []*bf.File
+	filesByPkg := make(map[string]*bf.File)
+	for _, l := range labels {
+		f, ok := filesByPkg[l.Pkg]
+		if !ok {
+			dir := filepath.Join(c.RepoRoot, filepath.FromSlash(l.Pkg))
+			p, err := findBuildFile(c, dir)
+			if err != nil {
+				return fmt.Errorf("%s: could not find build file: %v", l, err)
+			}
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			if f, err = bf.Parse(p, data); err != nil {
+				return err
+			}
+			filesByPkg[l.Pkg] = f
+			files = append(files, f)
+		}
+		if err := edit.Apply(f, l.Name, cmds); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		// edit.Format sorts and rewrites f in place. emit prints the result.
+		edit.Format(f)
+		if err := emit(c, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
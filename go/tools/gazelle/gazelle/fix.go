@@ -16,15 +16,109 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
 )
 
 func fixFile(c *config.Config, file *bf.File) error {
-	if err := ioutil.WriteFile(file.Path, bf.Format(file), 0644); err != nil {
+	if err := writeFile(c, file.Path, bf.Format(file)); err != nil {
 		return err
 	}
+	renamedBuildFiles.Lock()
+	oldPath, ok := renamedBuildFiles.m[file.Path]
+	delete(renamedBuildFiles.m, file.Path)
+	renamedBuildFiles.Unlock()
+	if ok {
+		return os.Remove(oldPath)
+	}
 	return nil
 }
+
+// renamedBuildFiles maps the paths of build files that are renamed with
+// -rename_build_files to the paths of the files they replace. fixFile
+// removes the old file once the new one is written.
+var renamedBuildFiles = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// renameBuildFile changes the path of f, an existing build file, to a
+// path with the first name in c.ValidBuildFileNames. The file is left alone
+// if it already has that name, or if a file with that name exists, which
+// is an error reported when the directory is read.
+func renameBuildFile(c *config.Config, f *bf.File) {
+	dir := filepath.Dir(f.Path)
+	newPath := c.NewBuildFilePath(dir)
+	if newPath == f.Path {
+		return
+	}
+	if _, err := os.Lstat(newPath); !os.IsNotExist(err) {
+		return
+	}
+	renamedBuildFiles.Lock()
+	renamedBuildFiles.m[newPath] = f.Path
+	renamedBuildFiles.Unlock()
+	f.Path = newPath
+}
+
+// writeFile writes data to path with the line endings chosen by c.Newline.
+// An existing file that differs from data only in line endings is left
+// unchanged, so contributors whose checkouts use other line endings don't
+// see spurious changes. Otherwise, the file is replaced by renaming a new
+// file over it, so readers never see a partly written file. The new file
+// gets the permissions of the old one; files that didn't exist are created
+// with mode 0644. If path is a symbolic link, the file it points to is
+// replaced, and the link is kept.
+func writeFile(c *config.Config, path string, data []byte) error {
+	data = c.Newline.Convert(data)
+	perm := os.FileMode(0644)
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+		old, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if equalIgnoringNewlines(old, data) {
+			return nil
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		perm = st.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// equalIgnoringNewlines returns whether a and b are the same after "\r\n"
+// line endings are changed to "\n".
+func equalIgnoringNewlines(a, b []byte) bool {
+	return bytes.Equal(config.LFNewline.Convert(a), config.LFNewline.Convert(b))
+}
@@ -20,6 +20,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	bf "github.com/bazelbuild/buildtools/build"
@@ -100,7 +101,7 @@ func TestCreateFile(t *testing.T) {
 
 	// Check that Gazelle creates a new file named "BUILD.bazel".
 	c := defaultConfig(dir)
-	run(c, fixFile)
+	run(c, fixFile, nil)
 
 	buildFile := filepath.Join(dir, "BUILD.bazel")
 	if _, err = os.Stat(buildFile); err != nil {
@@ -129,7 +130,7 @@ func TestUpdateFile(t *testing.T) {
 
 	// Check that Gazelle updates the BUILD file in place.
 	c := defaultConfig(dir)
-	run(c, fixFile)
+	run(c, fixFile, nil)
 	if st, err := os.Stat(buildFile); err != nil {
 		t.Errorf("could not stat BUILD: %v", err)
 	} else if st.Size() == 0 {
@@ -140,3 +141,116 @@ func TestUpdateFile(t *testing.T) {
 		t.Errorf("BUILD.bazel should not exist")
 	}
 }
+
+func TestRenameFile(t *testing.T) {
+	// Create a directory with a simple .go file and an empty BUILD file.
+	tmpdir := os.Getenv("TEST_TMPDIR")
+	dir, err := ioutil.TempDir(tmpdir, "")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", tmpdir, "", err)
+	}
+	defer os.RemoveAll(dir)
+
+	goFile := filepath.Join(dir, "main.go")
+	if err = ioutil.WriteFile(goFile, []byte("package main"), 0600); err != nil {
+		t.Fatalf("error writing file %q: %v", goFile, err)
+	}
+
+	buildFile := filepath.Join(dir, "BUILD")
+	if err = ioutil.WriteFile(buildFile, nil, 0600); err != nil {
+		t.Fatalf("error writing file %q: %v", buildFile, err)
+	}
+
+	// Check that Gazelle moves the BUILD file to BUILD.bazel.
+	c := defaultConfig(dir)
+	c.RenameBuildFiles = true
+	run(c, fixFile, nil)
+	if _, err := os.Stat(filepath.Join(dir, "BUILD.bazel")); err != nil {
+		t.Errorf("could not stat BUILD.bazel: %v", err)
+	}
+	if _, err = os.Stat(buildFile); err == nil {
+		t.Errorf("BUILD should not exist")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	tmpdir := os.Getenv("TEST_TMPDIR")
+	dir, err := ioutil.TempDir(tmpdir, "")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", tmpdir, "", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		desc, old, data, want string
+		exists                bool
+		oldMode, wantMode     os.FileMode
+		newline               config.Newline
+	}{
+		{
+			desc:     "new file",
+			data:     "a\nb\n",
+			want:     "a\nb\n",
+			wantMode: 0644,
+		}, {
+			desc:     "new file with crlf",
+			data:     "a\nb\n",
+			want:     "a\r\nb\r\n",
+			wantMode: 0644,
+			newline:  config.CRLFNewline,
+		}, {
+			desc:     "executable file keeps mode",
+			old:      "a\n",
+			exists:   true,
+			oldMode:  0755,
+			data:     "a\nb\n",
+			want:     "a\nb\n",
+			wantMode: 0755,
+		}, {
+			desc:     "only line endings differ",
+			old:      "a\r\nb\r\n",
+			exists:   true,
+			oldMode:  0600,
+			data:     "a\nb\n",
+			want:     "a\r\nb\r\n",
+			wantMode: 0600,
+		}, {
+			desc:     "crlf file converted to lf",
+			old:      "a\r\n",
+			exists:   true,
+			oldMode:  0644,
+			data:     "a\nb\n",
+			want:     "a\nb\n",
+			wantMode: 0644,
+		},
+	} {
+		path := filepath.Join(dir, strings.Replace(tc.desc, " ", "_", -1))
+		if tc.exists {
+			if err := ioutil.WriteFile(path, []byte(tc.old), 0666); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, tc.oldMode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c := &config.Config{Newline: tc.newline}
+		if err := writeFile(c, path, []byte(tc.data)); err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got %q; want %q", tc.desc, got, tc.want)
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := st.Mode().Perm(); mode != tc.wantMode {
+			t.Errorf("%s: got mode %v; want %v", tc.desc, mode, tc.wantMode)
+		}
+	}
+}
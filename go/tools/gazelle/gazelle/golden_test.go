@@ -0,0 +1,173 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/testdata"
+)
+
+var updateGolden = flag.Bool("update_golden", false, "if true, TestGolden overwrites the expected files in testdata/golden with gazelle's output")
+
+// TestGolden runs gazelle on each fixture tree in testdata/golden and checks
+// the build files it writes. Each subdirectory of testdata/golden is a tree
+// of source files, laid out as follows:
+//
+//   - args, if present, lists flags passed to gazelle, one per line.
+//     -repo_root is set to a copy of the tree.
+//   - Files named name.want hold the expected content of name after gazelle
+//     runs. Every build file in the output must have one.
+//   - Files named name.in are copied as name. This is used for existing
+//     build files, which would otherwise be packages in this repository.
+//   - Other files are copied as is.
+//
+// Run with -update_golden, outside of Bazel and with TEST_SRCDIR set to the
+// repository root, to rewrite the .want files with gazelle's output.
+func TestGolden(t *testing.T) {
+	goldenDir := filepath.Join(testdata.Dir(), "golden")
+	fis, err := ioutil.ReadDir(goldenDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			checkGoldenTree(t, filepath.Join(goldenDir, fi.Name()))
+		}
+	}
+}
+
+// checkGoldenTree runs gazelle on a copy of the fixture tree in src and
+// reports differences between the build files it writes and the .want files
+// in src.
+func checkGoldenTree(t *testing.T, src string) {
+	name := filepath.Base(src)
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "golden_"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args, want, err := copyGoldenTree(src, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args = append([]string{"-repo_root", dir}, args...)
+	if err := runGazelle(dir, args); err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+
+	got := make(map[string]string)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if base := filepath.Base(path); !info.IsDir() && (base == "BUILD" || base == "BUILD.bazel") {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			got[filepath.ToSlash(rel)] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *updateGolden {
+		for rel, content := range got {
+			wantPath := filepath.Join(src, filepath.FromSlash(rel)) + ".want"
+			if err := ioutil.WriteFile(wantPath, []byte(content), 0666); err != nil {
+				t.Error(err)
+			}
+		}
+		return
+	}
+
+	var rels []string
+	for rel := range got {
+		rels = append(rels, rel)
+	}
+	for rel := range want {
+		if _, ok := got[rel]; !ok {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+	for _, rel := range rels {
+		g, gotOk := got[rel]
+		w, wantOk := want[rel]
+		switch {
+		case !wantOk:
+			t.Errorf("%s: %s: unexpected build file:\n%s", name, rel, g)
+		case !gotOk:
+			t.Errorf("%s: %s: not written; want:\n%s", name, rel, w)
+		case g != w:
+			t.Errorf("%s: %s: got:\n%s\nwant:\n%s", name, rel, g, w)
+		}
+	}
+}
+
+// copyGoldenTree copies the fixture tree in src to dir. It returns the flags
+// listed in src/args and the expected content of files, keyed by
+// slash-separated paths relative to dir.
+func copyGoldenTree(src, dir string) (args []string, want map[string]string, err error) {
+	want = make(map[string]string)
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0777)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case rel == "args":
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					args = append(args, line)
+				}
+			}
+			return nil
+		case strings.HasSuffix(rel, ".want"):
+			want[filepath.ToSlash(strings.TrimSuffix(rel, ".want"))] = string(data)
+			return nil
+		case strings.HasSuffix(rel, ".in"):
+			rel = strings.TrimSuffix(rel, ".in")
+		}
+		return ioutil.WriteFile(filepath.Join(dir, rel), data, 0666)
+	})
+	return args, want, err
+}
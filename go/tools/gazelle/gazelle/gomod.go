@@ -0,0 +1,74 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/wspace"
+)
+
+// addGoModRepos adds a repository to c.Repos for each replace directive in
+// the go.mod file in c.RepoRoot that replaces a module with a directory.
+// Imports in those modules are then resolved to labels in a
+// local_repository instead of a go_repository, which would be fetched at
+// a version the code isn't built with. If a repository in c.Repos already
+// has the module's prefix, the directive is skipped. If one has the same
+// root directory, its name is used. Otherwise, the repository is named
+// after the module path, the same way go_repository rules are.
+func addGoModRepos(c *config.Config) error {
+	reps, err := wspace.ReadGoModReplacements(c.RepoRoot)
+	if err != nil {
+		return err
+	}
+	for _, rep := range reps {
+		if !rep.IsLocal() || rep.Old == c.GoPrefix || hasRepoPrefix(c, rep.Old) {
+			continue
+		}
+		r := config.Repo{
+			Name:   resolve.ImportPathToBazelRepoName(rep.Old),
+			Prefix: rep.Old,
+			Root:   filepath.FromSlash(rep.New),
+		}
+		for _, other := range c.Repos {
+			if c.RootDir(other) == c.RootDir(r) {
+				r.Name = other.Name
+				break
+			}
+		}
+		if st, err := os.Stat(c.RootDir(r)); err != nil || !st.IsDir() {
+			path := filepath.Join(c.RepoRoot, "go.mod")
+			logging.Warningf(logging.UnresolvedImport, path, "%s: %s is replaced with %s, which is not a directory", path, rep.Old, rep.New)
+		}
+		c.Repos = append(c.Repos, r)
+	}
+	return nil
+}
+
+// hasRepoPrefix returns whether a repository in c.Repos has the import
+// path prefix prefix.
+func hasRepoPrefix(c *config.Config, prefix string) bool {
+	for _, r := range c.Repos {
+		if r.Prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
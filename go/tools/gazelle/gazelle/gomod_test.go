@@ -0,0 +1,74 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+func TestAddGoModRepos(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "gomod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "repo")
+	for _, d := range []string{root, filepath.Join(dir, "foo"), filepath.Join(dir, "bar"), filepath.Join(dir, "baz")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := `module example.com/repo
+
+replace (
+	example.com/foo => ../foo
+	example.com/bar => ../bar
+	example.com/baz => ../baz
+	example.com/fork => example.com/other v1.0.0
+	example.com/repo => ./
+)
+`
+	if err := ioutil.WriteFile(filepath.Join(root, "go.mod"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &config.Config{
+		RepoRoot: root,
+		GoPrefix: "example.com/repo",
+		Repos: []config.Repo{
+			{Name: "foo_repo", Prefix: "example.com/foo", Root: "../foo"},
+			{Name: "bar_repo", Prefix: "example.com/bar/v2", Root: "../bar"},
+		},
+	}
+	if err := addGoModRepos(c); err != nil {
+		t.Fatal(err)
+	}
+	want := []config.Repo{
+		{Name: "foo_repo", Prefix: "example.com/foo", Root: "../foo"},
+		{Name: "bar_repo", Prefix: "example.com/bar/v2", Root: "../bar"},
+		{Name: "bar_repo", Prefix: "example.com/bar", Root: filepath.FromSlash("../bar")},
+		{Name: "com_example_baz", Prefix: "example.com/baz", Root: filepath.FromSlash("../baz")},
+	}
+	if !reflect.DeepEqual(c.Repos, want) {
+		t.Errorf("got repos %#v; want %#v", c.Repos, want)
+	}
+}
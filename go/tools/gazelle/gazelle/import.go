@@ -0,0 +1,176 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/migrate"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/wspace"
+)
+
+func importUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle import -from=buck|pants|please [flags...] [dirs...]
+
+Import converts Go targets defined for another build system into rules_go
+rules. It searches the given directories (default: the current directory)
+for build files of that system and writes a Bazel build file next to each
+one that defines Go targets. Names, visibility, and dependencies of targets
+are preserved. Files with targets named differently than gazelle would name
+them are marked with "# gazelle:ignore", so later runs of gazelle don't add
+rules next to them.
+
+Existing Bazel build files are not replaced, and files with load statements
+are treated as Bazel build files, not converted, since Pants and Please also
+name their build files BUILD. Targets and attributes that can't be converted
+are reported.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("gazelle import", flag.ContinueOnError)
+	fs.Usage = func() {}
+	from := fs.String("from", "", "build system to import from: buck, pants, or please")
+	buildFileName := fs.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names.\n\tThe first element of the list is the name of output build files to generate.")
+	repoRoot := fs.String("repo_root", "", "path to the repository root, otherwise gazelle searches for it.")
+	mode := fs.String("mode", "fix", "print: prints the converted BUILD files\n\tfix: writes the converted BUILD files\n\tdiff: shows the files that would be written")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			importUsage(fs)
+			os.Exit(0)
+		}
+		return errors.New("Try -help for more information.")
+	}
+	if *from == "" {
+		return errors.New("-from must be set")
+	}
+	sys, err := migrate.FindBuildSystem(*from)
+	if err != nil {
+		return err
+	}
+	emit, ok := modeFromName[*mode]
+	if !ok {
+		return fmt.Errorf("unrecognized emit mode: %q", *mode)
+	}
+
+	c := &config.Config{
+		RepoRoot:            *repoRoot,
+		ValidBuildFileNames: strings.Split(*buildFileName, ","),
+	}
+	if c.RepoRoot == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if c.RepoRoot, err = wspace.Find(cwd); err != nil {
+			return fmt.Errorf("-repo_root not specified, and WORKSPACE cannot be found: %v", err)
+		}
+	}
+	if c.RepoRoot, err = filepath.Abs(c.RepoRoot); err != nil {
+		return err
+	}
+
+	dirs := fs.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	for _, dir := range dirs {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if !isDescendingDir(dir, c.RepoRoot) {
+			return fmt.Errorf("dir %q is not a subdirectory of repo root %q", dir, c.RepoRoot)
+		}
+		err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if base := info.Name(); p != dir && (strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !sys.IsBuildFile(info.Name()) {
+				return nil
+			}
+			return importFile(c, sys, emit, p)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importFile converts the build file at p and emits the result. Parse
+// errors and conflicts with existing files are logged, not returned, so
+// that one bad file doesn't stop the import.
+func importFile(c *config.Config, sys *migrate.BuildSystem, emit emitFunc, p string) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	old, err := bf.Parse(p, data)
+	if err != nil {
+		logging.Errorf(logging.ParseError, p, "%v", err)
+		return nil
+	}
+	if !sys.IsForeignFile(old) {
+		// A Bazel build file with a name the other build system also uses.
+		return nil
+	}
+	dir := filepath.Dir(p)
+	rel, err := filepath.Rel(c.RepoRoot, dir)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		rel = ""
+	}
+
+	newPath := c.NewBuildFilePath(dir)
+	f, warnings := sys.ConvertFile(old, newPath, rel)
+	for _, w := range warnings {
+		logging.Warningf("", p, "%s", w)
+	}
+	if f == nil {
+		return nil
+	}
+	if newPath != p {
+		if _, err := os.Stat(newPath); err == nil {
+			logging.Warningf("", p, "%s: not converting, since %s already exists", p, newPath)
+			return nil
+		}
+	}
+	bf.Rewrite(f, nil)
+	return emit(c, f)
+}
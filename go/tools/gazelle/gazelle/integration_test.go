@@ -20,11 +20,23 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"flag"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/formats"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/rules"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/schema"
 )
 
 type fileSpec struct {
@@ -73,7 +85,7 @@ func runGazelle(wd string, args []string) error {
 		return err
 	}
 
-	run(c, emit)
+	run(c, emit, nil)
 	return nil
 }
 
@@ -208,3 +220,303 @@ go_library(
 //   -external vendor works
 //   run in fix mode in testdata directories to create new files
 //   run in diff mode in testdata directories to update existing files (no change)
+
+func TestMetadataMode(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "WORKSPACE"},
+		{path: "lib/lib.go", content: `package lib
+
+import "example.com/repo/dep"
+
+//go:generate stringer -type=Kind
+`},
+		{path: "lib/lib_linux.go", content: "package lib"},
+		{path: "lib/lib_test.go", content: "package lib"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, emit, err := newConfiguration([]string{"-go_prefix", "example.com/repo", "-mode", "metadata", "-repo_root", dir, dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emit != nil {
+		t.Fatal("got non-nil emitFunc in metadata mode")
+	}
+	var buf bytes.Buffer
+	if err := writeMetadata(&buf, c); err != nil {
+		t.Fatal(err)
+	}
+
+	dump, err := formats.ReadPackageDump(buf.Bytes())
+	if err != nil {
+		t.Fatalf("could not parse output: %v\n%s", err, buf.Bytes())
+	}
+	if dump.Version != formats.PackageDumpVersion {
+		t.Errorf("got version %d; want %d", dump.Version, formats.PackageDumpVersion)
+	}
+	got := dump.Packages
+	if len(got) != 1 {
+		t.Fatalf("got %d packages; want 1:\n%s", len(got), buf.Bytes())
+	}
+	pkg := got[0]
+	if pkg.Name != "lib" || pkg.Rel != "lib" || pkg.ImportPath != "example.com/repo/lib" {
+		t.Errorf("got name %q, rel %q, importpath %q; want lib, lib, example.com/repo/lib", pkg.Name, pkg.Rel, pkg.ImportPath)
+	}
+	if pkg.Library == nil || pkg.Test == nil || pkg.Binary != nil {
+		t.Fatalf("got targets library=%v, test=%v, binary=%v; want library and test only", pkg.Library, pkg.Test, pkg.Binary)
+	}
+	if got, want := pkg.Library.Sources.Generic, []string{"lib.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got library srcs %q; want %q", got, want)
+	}
+	linux := "@io_bazel_rules_go//go/platform:linux_amd64"
+	if got, want := pkg.Library.Sources.Platform[linux], []string{"lib_linux.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got linux library srcs %q; want %q", got, want)
+	}
+	if got, want := pkg.Library.Imports.Generic, []string{"example.com/repo/dep"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got library imports %q; want %q", got, want)
+	}
+	if got, want := pkg.Generate, []formats.GenerateDirective{{File: "lib.go", Command: "stringer -type=Kind"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got generate directives %v; want %v", got, want)
+	}
+}
+
+func TestAnnotationFlagsHash(t *testing.T) {
+	dir, err := createFiles([]fileSpec{{path: "WORKSPACE"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	annotation := func(args ...string) string {
+		args = append([]string{"-annotate", "-repo_root", dir}, args...)
+		c, _, err := newConfiguration(append(args, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Annotation
+	}
+	a := annotation("-go_prefix", "example.com/a", "-mode", "print")
+	if !strings.HasPrefix(a, "version=") || !strings.Contains(a, " flags=") {
+		t.Errorf("got annotation %q; want version and flags", a)
+	}
+	if b := annotation("-go_prefix", "example.com/a"); b != a {
+		t.Errorf("annotation changed with -mode: got %q; want %q", b, a)
+	}
+	if b := annotation("-go_prefix", "example.com/a", "-mode", "print", "-v"); b != a {
+		t.Errorf("annotation changed with -v: got %q; want %q", b, a)
+	}
+	if b := annotation("-go_prefix", "example.com/b"); b == a {
+		t.Errorf("annotation did not change with -go_prefix: %q", b)
+	}
+}
+
+func TestLogFlags(t *testing.T) {
+	dir, err := createFiles([]fileSpec{{path: "WORKSPACE"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer logging.SetVerbosity(logging.WarningLevel)
+	defer logging.SetFormat(logging.TextFormat)
+
+	for _, tc := range []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"-v", "-q"}, "can't be used together"},
+		{[]string{"-log_format", "xml"}, "unrecognized log format"},
+		{[]string{"-log_format", "json", "-q"}, ""},
+	} {
+		args := append([]string{"-go_prefix", "example.com/repo", "-repo_root", dir}, tc.args...)
+		_, _, err := newConfiguration(append(args, dir))
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%v: got error %v; want %q", tc.args, err, tc.wantErr)
+		}
+	}
+	if logging.Enabled(logging.WarningLevel) {
+		t.Error("warnings enabled after -q")
+	}
+}
+
+func init() {
+	rules.RegisterLanguage(fakeLanguage{})
+}
+
+// fakeLanguage generates a fake_library rule for each directory containing
+// .fake files. It's registered for all tests in this package, but it has no
+// effect in tests without .fake files.
+type fakeLanguage struct{}
+
+func (fakeLanguage) Name() string { return "fake" }
+
+func (fakeLanguage) Kinds() []schema.Kind {
+	return []schema.Kind{{
+		Name:           "fake_library",
+		Load:           "@fake//:def.bzl",
+		MergeableAttrs: map[string]bool{"srcs": true},
+	}}
+}
+
+func (fakeLanguage) RegisterFlags(fs *flag.FlagSet) {}
+
+func (fakeLanguage) Configure(c *config.Config) error { return nil }
+
+func (fakeLanguage) Resolve(imp, rel string) (resolve.Label, error) {
+	return resolve.Label{Pkg: rel, Name: imp}, nil
+}
+
+func (fakeLanguage) GenerateRules(c *config.Config, r resolve.LabelResolver, dir *packages.Dir) []*bf.Rule {
+	var srcs []string
+	for _, f := range dir.Files {
+		if strings.HasSuffix(f, ".fake") {
+			srcs = append(srcs, f)
+		}
+	}
+	if len(srcs) == 0 {
+		return nil
+	}
+	return []*bf.Rule{rules.NewRule("fake_library", nil, []rules.KeyValue{
+		{Key: "name", Value: "fake"},
+		{Key: "srcs", Value: srcs},
+	})}
+}
+
+func TestRegisteredLanguage(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "WORKSPACE"},
+		{path: "fake/a.fake"},
+		{path: "mixed/a.fake"},
+		{path: "mixed/mixed.go", content: "package mixed"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, []string{"-go_prefix", "example.com/repo"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{
+			path: "fake/BUILD.bazel",
+			want: `load("@fake//:def.bzl", "fake_library")
+
+fake_library(
+    name = "fake",
+    srcs = ["a.fake"],
+)
+`,
+		}, {
+			path: "mixed/BUILD.bazel",
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@fake//:def.bzl", "fake_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["mixed.go"],
+    visibility = ["//visibility:public"],
+)
+
+fake_library(
+    name = "fake",
+    srcs = ["a.fake"],
+)
+`,
+		},
+	} {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, tc.path)); err != nil {
+			t.Error(err)
+		} else if string(got) != tc.want {
+			t.Errorf("%s: got %s ; want %s", tc.path, got, tc.want)
+		}
+	}
+}
+
+// TestDirsFromStdin checks that "gazelle -" generates build files in exactly
+// the directories listed in stdin.
+func TestDirsFromStdin(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "WORKSPACE"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/sub/sub.go", content: "package sub"},
+		{path: "b/b.go", content: "package b"},
+		{path: "c/c.go", content: "package c"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stdin, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdin.Name())
+	defer stdin.Close()
+	if _, err := stdin.WriteString("a\n" + filepath.Join(dir, "c") + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = oldStdin }()
+
+	if err := runGazelle(dir, []string{"-go_prefix", "example.com/repo", "-"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{"a/BUILD.bazel", true},
+		{"c/BUILD.bazel", true},
+		{"BUILD.bazel", false},
+		{"a/sub/BUILD.bazel", false},
+		{"b/BUILD.bazel", false},
+	} {
+		_, err := os.Stat(filepath.Join(dir, tc.path))
+		if got := err == nil; got != tc.want {
+			t.Errorf("%s: got exists %v; want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestEmptyPackageVisibility(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "WORKSPACE"},
+		{path: "a/b/b.go", content: "package b"},
+		{path: "a/b/testdata/x.txt"},
+		{path: "docs/README.md"},
+		{path: "existing/BUILD", content: "# nothing here\n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", "example.com/repo", "-empty_package_visibility", "//visibility:public"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	const want = `package(default_visibility = ["//visibility:public"])
+`
+	for _, path := range []string{"a/BUILD.bazel", "docs/BUILD.bazel"} {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, path)); err != nil {
+			t.Error(err)
+		} else if string(got) != want {
+			t.Errorf("%s: got %s ; want %s", path, got, want)
+		}
+	}
+	for _, path := range []string{"a/b/testdata/BUILD.bazel", "existing/BUILD.bazel"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err == nil {
+			t.Errorf("%s: unexpectedly created", path)
+		}
+	}
+}
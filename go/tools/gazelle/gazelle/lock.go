@@ -0,0 +1,153 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+)
+
+// depsLockName is the name of a file listing the external packages that the
+// Go package in the same directory may import, one import path per line.
+// Directories without this file aren't checked. An empty file allows no
+// external imports.
+const depsLockName = "deps.lock"
+
+const depsLockHeader = `# External packages imported by Go code in this directory. Gazelle fails if
+# other external packages are imported. Update with gazelle -update_deps_locks.
+`
+
+// depsLockErrors is the number of directories whose packages import
+// external packages missing from their lock files during the current run.
+var depsLockErrors int64
+
+// checkDepsLock checks the external imports of the package in d against
+// the lock file in d, if there is one. If c.UpdateDepsLocks is set, the
+// lock file is rewritten to list the current imports instead. checkDepsLock
+// returns false if the package imports packages that aren't in the lock;
+// the build file in d should not be updated in that case, so the new
+// dependencies aren't added without review.
+func checkDepsLock(c *config.Config, d *packages.Dir) bool {
+	if d.Package == nil || !hasFile(d.Files, depsLockName) {
+		return true
+	}
+	path := filepath.Join(d.Path, depsLockName)
+	imports := externalImports(c, d.Package)
+	if c.UpdateDepsLocks {
+		if err := writeDepsLock(path, imports); err != nil {
+			logging.Error(err)
+		}
+		return true
+	}
+
+	locked, err := readDepsLock(path)
+	if err != nil {
+		logging.Error(err)
+		return true
+	}
+	var unlocked []string
+	for _, imp := range imports {
+		if !locked[imp] {
+			unlocked = append(unlocked, imp)
+		}
+	}
+	if len(unlocked) == 0 {
+		return true
+	}
+	atomic.AddInt64(&depsLockErrors, 1)
+	logging.Errorf(logging.UnlockedImport, path, "%s: imports not in %s: %s. Review them, then run gazelle with -update_deps_locks to add them", d.Path, depsLockName, strings.Join(unlocked, ", "))
+	return false
+}
+
+// externalImports returns the sorted, de-duplicated import paths of
+// packages outside c.GoPrefix imported by any target in pkg. Packages in
+// c.Repos aren't included, since they're first-party code.
+func externalImports(c *config.Config, pkg *packages.Package) []string {
+	seen := make(map[string]bool)
+	var imports []string
+	add := func(imp string) {
+		if seen[imp] || imp == c.GoPrefix || strings.HasPrefix(imp, c.GoPrefix+"/") ||
+			strings.HasPrefix(imp, "./") || strings.HasPrefix(imp, "../") || c.RepoForImport(imp) != nil {
+			return
+		}
+		seen[imp] = true
+		imports = append(imports, imp)
+	}
+	for _, t := range []packages.Target{pkg.Library, pkg.CgoLibrary, pkg.Binary, pkg.Test, pkg.XTest} {
+		for _, imp := range t.Imports.Generic {
+			add(imp)
+		}
+		for _, platformImports := range t.Imports.Platform {
+			for _, imp := range platformImports {
+				add(imp)
+			}
+		}
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+// readDepsLock returns the set of import paths listed in the lock file at
+// path. Blank lines and lines starting with "#" are skipped.
+func readDepsLock(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	locked := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		locked[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return locked, nil
+}
+
+// writeDepsLock writes imports to the lock file at path.
+func writeDepsLock(path string, imports []string) error {
+	var buf bytes.Buffer
+	buf.WriteString(depsLockHeader)
+	for _, imp := range imports {
+		buf.WriteString(imp)
+		buf.WriteByte('\n')
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// hasFile returns whether the sorted list of file names files contains
+// name.
+func hasFile(files []string, name string) bool {
+	i := sort.SearchStrings(files, name)
+	return i < len(files) && files[i] == name
+}
@@ -0,0 +1,87 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+)
+
+func TestDepsLock(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "deps_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, depsLockName)
+	if err := ioutil.WriteFile(lockPath, []byte("# comment\ngithub.com/locked/dep\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &config.Config{GoPrefix: "example.com/repo"}
+	d := &packages.Dir{
+		Path:  dir,
+		Files: []string{depsLockName, "lib.go"},
+		Package: &packages.Package{
+			Library: packages.Target{Imports: packages.PlatformStrings{
+				Generic:  []string{"example.com/repo/other", "github.com/locked/dep"},
+				Platform: map[string][]string{"linux_amd64": {"golang.org/x/sys/unix"}},
+			}},
+			Test: packages.Target{Imports: packages.PlatformStrings{
+				Generic: []string{"github.com/locked/dep", "github.com/new/dep"},
+			}},
+		},
+	}
+	if got, want := externalImports(c, d.Package), []string{"github.com/locked/dep", "github.com/new/dep", "golang.org/x/sys/unix"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got external imports %v; want %v", got, want)
+	}
+
+	atomic.StoreInt64(&depsLockErrors, 0)
+	if checkDepsLock(c, d) {
+		t.Errorf("checkDepsLock succeeded with unlocked imports; want failure")
+	}
+	if n := atomic.LoadInt64(&depsLockErrors); n != 1 {
+		t.Errorf("got %d lock errors; want 1", n)
+	}
+
+	c.UpdateDepsLocks = true
+	if !checkDepsLock(c, d) {
+		t.Errorf("checkDepsLock failed while updating locks")
+	}
+	c.UpdateDepsLocks = false
+	if !checkDepsLock(c, d) {
+		t.Errorf("checkDepsLock failed after updating locks")
+	}
+	locked, err := readDepsLock(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"github.com/locked/dep": true, "github.com/new/dep": true, "golang.org/x/sys/unix": true}
+	if !reflect.DeepEqual(locked, want) {
+		t.Errorf("got locked imports %v; want %v", locked, want)
+	}
+
+	if !checkDepsLock(c, &packages.Dir{Path: dir, Files: []string{"lib.go"}, Package: &packages.Package{}}) {
+		t.Errorf("checkDepsLock failed in a directory without a lock file")
+	}
+}
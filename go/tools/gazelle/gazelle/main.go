@@ -18,21 +18,28 @@ limitations under the License.
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/merger"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
-	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/rules"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/telemetry"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/wspace"
 )
 
@@ -44,80 +51,168 @@ var modeFromName = map[string]emitFunc{
 	"diff":  diffFile,
 }
 
-func run(c *config.Config, emit emitFunc) {
-	r := resolve.NewLabelResolver(c)
-	shouldProcessRoot := false
-	didProcessRoot := false
-	for _, dir := range c.Dirs {
-		if c.RepoRoot == dir {
-			shouldProcessRoot = true
+// subcommands maps names of subcommands to functions that run them with
+// the remaining command line arguments.
+var subcommands map[string]func([]string) error
+
+func init() {
+	// subcommands is set in init, since -version lists it, and some
+	// subcommands parse the same flags.
+	subcommands = map[string]func([]string) error{
+		"edit":         runEdit,
+		"import":       runImport,
+		"migrate":      runMigrate,
+		"serve":        runServe,
+		"update-repos": runUpdateRepos,
+		"visibility":   runVisibility,
+		"why":          runWhy,
+	}
+}
+
+// run generates BUILD files for directories in c.Dirs and emits them. Rules
+// are generated by each registered language. run returns an error describing
+// any files that couldn't be emitted, or an error if any imports violate
+// the import policy or aren't in a deps lock file, or if libraries in build
+// files owned by other tools claim conflicting import paths. Other errors
+// are logged.
+func run(c *config.Config, emit emitFunc, t *phaseTimer) error {
+	atomic.StoreInt64(&depsLockErrors, 0)
+	conflicts := indexManagedDirs(c)
+	langs := rules.Languages()
+	for _, l := range langs {
+		if err := l.Configure(c); err != nil {
+			return fmt.Errorf("%s: %v", l.Name(), err)
 		}
-		packages.Walk(c, dir, func(pkg *packages.Package, oldFile *bf.File) {
-			if pkg.Rel == "" {
-				didProcessRoot = true
-			}
-			processPackage(c, r, emit, pkg, oldFile)
+	}
+	w := newOutputWriter(c, emit)
+	w.timer = t
+	q := newGenerateQueue(c, w)
+	for _, dir := range c.Dirs {
+		// Time spent in the callback, which may wait for rules to be
+		// generated, is not counted as part of the walk.
+		walkStart := time.Now()
+		var callbackTime time.Duration
+		packages.WalkDirs(c, dir, func(d *packages.Dir) {
+			callbackStart := time.Now()
+			defer func() { callbackTime += time.Since(callbackStart) }()
+			t.countDir()
+			q.add(func() *bf.File {
+				return processDir(c, langs, t, d)
+			})
 		})
+		t.add(walkPhase, time.Since(walkStart)-callbackTime)
 	}
-	if shouldProcessRoot && !didProcessRoot {
-		// We did not process a package at the repository root. We need to put
-		// a go_prefix rule there, even if there are no .go files in that directory.
-		pkg := &packages.Package{Dir: c.RepoRoot}
-		var oldFile *bf.File
-		var oldData []byte
-		oldPath, err := findBuildFile(c, c.RepoRoot)
-		if os.IsNotExist(err) {
-			goto processRoot
-		}
-		if err != nil {
-			log.Print(err)
-			return
-		}
-		oldData, err = ioutil.ReadFile(oldPath)
-		if err != nil {
-			log.Print(err)
-			return
-		}
-		oldFile, err = bf.Parse(oldPath, oldData)
-		if err != nil {
-			log.Print(err)
-			return
-		}
-
-	processRoot:
-		processPackage(c, r, emit, pkg, oldFile)
+	q.wait()
+	if err := w.wait(); err != nil {
+		return err
 	}
+	if n := c.ImportPolicy.ErrorCount(); n > 0 {
+		return fmt.Errorf("%d imports are forbidden by the import policy", n)
+	}
+	if n := c.Hermetic.ViolationCount(); n > 0 {
+		return fmt.Errorf("%d import paths could not be resolved without network access, which -hermetic forbids; list their repositories with -known_import", n)
+	}
+	if n := atomic.LoadInt64(&depsLockErrors); n > 0 {
+		return fmt.Errorf("build files in %d directories were not updated, since they import packages missing from %s", n, depsLockName)
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("%d import paths claimed by libraries in build files owned by other tools conflict with other libraries", conflicts)
+	}
+	return nil
 }
 
-func processPackage(c *config.Config, r resolve.LabelResolver, emit emitFunc, pkg *packages.Package, oldFile *bf.File) {
-	g := rules.NewGenerator(c, r, oldFile)
-	genFile := g.Generate(pkg)
+// processDir generates rules for d with each language in langs and merges
+// them with the existing build file. It returns the file to emit, or nil if
+// no rules were generated or the existing file should not be changed.
+// processDir may be called concurrently for different directories. Time
+// spent in each phase is recorded in t, which may be nil.
+func processDir(c *config.Config, langs []rules.Language, t *phaseTimer, d *packages.Dir) *bf.File {
+	if d.ManagedBy != "" {
+		logging.Infof("%s: build file is managed by %s; not updating it", d.Path, d.ManagedBy)
+		return nil
+	}
+	if !checkDepsLock(c, d) {
+		return nil
+	}
+	start := time.Now()
+	var rs []*bf.Rule
+	var resolveTime time.Duration
+	for _, l := range langs {
+		tr := &timedResolver{r: l}
+		rs = append(rs, l.GenerateRules(c, tr, d)...)
+		resolveTime += tr.d
+	}
+	rules.MapKinds(rs, d.MapKinds)
+	t.add(generatePhase, time.Since(start)-resolveTime)
+	t.add(resolvePhase, resolveTime)
+	if len(rs) == 0 {
+		return emptyPackageFile(c, d)
+	}
+	if d.File == nil && len(d.DefaultVisibility) > 0 {
+		// Rules with this visibility were generated without visibility
+		// attributes, so a new file must set the default.
+		rs = append([]*bf.Rule{rules.NewRule("package", nil, []rules.KeyValue{
+			{Key: "default_visibility", Value: d.DefaultVisibility},
+		})}, rs...)
+	}
 
-	if oldFile == nil {
+	defer t.since(mergePhase, time.Now())
+	genFile := rules.NewFile(c, d.Path, langs, rs)
+	rules.SortLabels(genFile)
+	bf.Rewrite(genFile, nil) // have buildifier 'format' our rules.
+	if d.File == nil {
 		// No existing file, so no merge required.
-		rules.SortLabels(genFile)
-		bf.Rewrite(genFile, nil) // have buildifier 'format' our rules.
-		if err := emit(c, genFile); err != nil {
-			log.Print(err)
-		}
-		return
+		return genFile
 	}
 
-	// Existing file, so merge and replace the old one.
-	mergedFile := merger.MergeWithExisting(genFile, oldFile)
+	// Existing file, so merge and replace the old one. The merged file is
+	// not rewritten, since buildifier would reorder attributes the user
+	// wrote. Only labels in merged attributes are sorted. Directives in
+	// this directory and the ones above it may change merge strategies.
+	mc := *c
+	mc.MergeStrategies = d.MergeStrategies
+	mergedFile := merger.MergeWithExisting(&mc, genFile, d.File)
 	if mergedFile == nil {
 		// Ignored file. Don't emit.
-		return
+		return nil
 	}
 
 	rules.SortLabels(mergedFile)
-	bf.Rewrite(mergedFile, nil) // have buildifier 'format' our rules.
-	if err := emit(c, mergedFile); err != nil {
-		log.Print(err)
-		return
+	if c.RenameBuildFiles {
+		renameBuildFile(c, mergedFile)
+	}
+	return mergedFile
+}
+
+// emptyPackageFile returns a build file for d containing only a package rule
+// that sets c.EmptyPackageVisibility. nil is returned if
+// c.EmptyPackageVisibility is not set, if d already has a build file, or if
+// d is a testdata directory or is inside one, since those are normally data
+// for tests in a parent package.
+func emptyPackageFile(c *config.Config, d *packages.Dir) *bf.File {
+	if c.EmptyPackageVisibility == "" || d.File != nil || isTestdata(d.Rel) {
+		return nil
+	}
+	r := rules.NewRule("package", nil, []rules.KeyValue{
+		{Key: "default_visibility", Value: []string{c.EmptyPackageVisibility}},
+	})
+	return &bf.File{
+		Path: c.NewBuildFilePath(d.Path),
+		Stmt: []bf.Expr{r.Call},
 	}
 }
 
+// isTestdata returns whether the slash-separated path rel has a component
+// named "testdata".
+func isTestdata(rel string) bool {
+	for _, name := range strings.Split(rel, "/") {
+		if name == "testdata" {
+			return true
+		}
+	}
+	return false
+}
+
 func usage(fs *flag.FlagSet) {
 	fmt.Fprintln(os.Stderr, `usage: gazelle [flags...] [package-dirs...]
 
@@ -132,11 +227,25 @@ It takes a list of paths to Go package directories [defaults to . if none given]
 It recursively traverses its subpackages.
 All the directories must be under the directory specified in -repo_root.
 [if -repo_root is not given, gazelle searches $pwd and up for the WORKSPACE file]
+If the only argument is "-", directories are read from stdin, one per line,
+and build files are generated in exactly those directories, without traversing
+their subdirectories.
 
 There are several modes of gazelle.
 In print mode, gazelle prints reconciled BUILD files to stdout.
 In fix mode, gazelle creates BUILD files or updates existing ones.
 In diff mode, gazelle shows diff.
+In metadata mode, gazelle prints information about Go packages as JSON.
+
+Run "gazelle edit -help" for information on editing rules in existing
+BUILD files. Run "gazelle migrate -help" for information on importing flags
+from Makefiles and shell scripts. Run "gazelle import -help" for information
+on converting Buck, Pants, and Please targets. Run "gazelle visibility -help"
+for information on narrowing the visibility of libraries to their users. Run
+"gazelle why -help" for information on finding the imports that cause a
+dependency. Run "gazelle update-repos -help" for information on pinning
+go_repository rules to the modules in go.mod. Run "gazelle serve -help" for
+information on running gazelle as a server for editors and pre-commit hooks.
 
 FLAGS:
 `)
@@ -147,14 +256,47 @@ func main() {
 	log.SetPrefix("gazelle: ")
 	log.SetFlags(0) // don't print timestamps
 
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				logging.Fatal(err)
+			}
+			return
+		}
+	}
+
 	c, emit, err := newConfiguration(os.Args[1:])
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(err)
 	}
 
-	run(c, emit)
+	if emit == nil {
+		if err := printMetadata(c); err != nil {
+			logging.Fatal(err)
+		}
+		return
+	}
+	stopProfile, err := profileOpts.start()
+	if err == nil {
+		var t *phaseTimer
+		if logging.Enabled(logging.InfoLevel) || telemetry.Enabled() {
+			t = newPhaseTimer()
+		}
+		err = run(c, emit, t)
+		t.report()
+		t.record(err)
+	}
+	if stopErr := stopProfile(); err == nil {
+		err = stopErr
+	}
+	if err != nil {
+		logging.Fatal(err)
+	}
 }
 
+// newConfiguration parses command line arguments and returns the resulting
+// configuration and the function used to emit BUILD files. In metadata mode,
+// no BUILD files are emitted, and the returned emitFunc is nil.
 func newConfiguration(args []string) (*config.Config, emitFunc, error) {
 	fs := flag.NewFlagSet("gazelle", flag.ContinueOnError)
 	// Flag will call this on any parse error. Don't print usage unless
@@ -162,13 +304,53 @@ func newConfiguration(args []string) (*config.Config, emitFunc, error) {
 	fs.Usage = func() {}
 
 	knownImports := multiFlag{}
+	excludes := multiFlag{}
+	mergeStrategies := multiFlag{}
+	repos := multiFlag{}
+	cgoVars := multiFlag{}
 	buildFileName := fs.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names.\nThe first element of the list is the name of output build files to generate.")
+	renameBuildFiles := fs.Bool("rename_build_files", false, "if true, in fix mode, existing build files that are updated are renamed to the first name\n\tin -build_file_name, if they have another name")
 	buildTags := fs.String("build_tags", "", "comma-separated list of build tags. If not specified, Gazelle will not\n\tfilter sources with build constraints.")
+	noCgoPlatforms := fs.String("no_cgo_platforms", "", "comma-separated list of platforms, like windows_amd64, where cgo is unavailable. Files that\n\timport \"C\" are only built on other platforms, and pure Go fallbacks are built instead")
+	globMode := fs.String("glob_mode", "replace", "replace: replace srcs and other mergeable attributes written with glob with generated lists\n\tkeep: leave attributes written with glob unchanged\n\tcompare: keep globs that match exactly the generated sources, and replace others")
+	newline := fs.String("newline", "lf", "lf: end lines in written build files with LF\n\tcrlf: end lines with CRLF\n\tplatform: end lines with CRLF on Windows and LF elsewhere\n\tFiles that differ from the generated content only in line endings are not rewritten")
+	protoMode := fs.String("proto", "default", "default: generate go_proto_library rules for .proto files, excluding checked-in .pb.go files from srcs\n\tlegacy: build checked-in .pb.go files, and list .proto files in a filegroup\n\tdisable: ignore .proto files, and build checked-in .pb.go files")
+	cgoHeaders := fs.String("cgo_headers", "srcs", "srcs: list header files included by cgo code in the srcs of the rule that builds it\n\tcc_library: list them in the hdrs of a cc_library in the same package, added to the rule's cdeps\n\texport: like cc_library, but the cc_library is visible to other packages")
 	external := fs.String("external", "external", "external: resolve external packages with go_repository\n\tvendored: resolve external packages as packages in vendor/")
 	goPrefix := fs.String("go_prefix", "", "go_prefix of the target workspace")
 	repoRoot := fs.String("repo_root", "", "path to a directory which corresponds to go_prefix, otherwise gazelle searches for it.")
 	fs.Var(&knownImports, "known_import", "import path for which external resolution is skipped (can specify multiple times)")
-	mode := fs.String("mode", "fix", "print: prints all of the updated BUILD files\n\tfix: rewrites all of the BUILD files in place\n\tdiff: computes the rewrite but then just does a diff")
+	fs.Var(&repos, "repo", "name,prefix,root: another repository with Go packages imported by this one, like a\n\tlocal_repository. Imports under prefix are resolved to labels like @name//pkg instead of\n\tgo_repository rules. root may be relative to -repo_root (can specify multiple times)")
+	fs.Var(&cgoVars, "cgo_var", "NAME=reject|pass|map:VALUE: how ${NAME} in #cgo directives is written in copts and clinkopts.\n\tpass writes it unexpanded; map replaces it with VALUE, like $(GENDIR). Files using\n\tother variables besides ${SRCDIR} are reported as errors (can specify multiple times)")
+	fs.Var(&mergeStrategies, "merge_strategy", "attr=strategy: how to merge a generated attribute with an existing one. Strategies are\n\treplace (default), union, and keep. May be overridden by \"# gazelle:merge attr strategy\" comments\n\tin build files (can specify multiple times)")
+	fs.Var(&excludes, "exclude", "path of a directory, relative to the repository root, that gazelle should not visit.\n\tMay be a glob pattern. Entries in .bazelignore are also excluded (can specify multiple times)")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "maximum number of directories to process concurrently in fix mode")
+	changedSince := fs.String("changed_since", "", "git revision. If set, only directories containing files that changed since this\n\trevision (including uncommitted and untracked files) are updated. Build files of packages that\n\timport the changed packages are not updated")
+	changedFiles := fs.String("changed_files", "", "path of a file listing changed files, one per line, relative to the repository root, or \"-\"\n\tto read them from stdin. If set, only directories containing those files are updated. This is an\n\talternative to -changed_since for other version control systems")
+	annotate := fs.Bool("annotate", false, "if true, add a comment to each generated rule identifying the gazelle version and a hash of the flags used")
+	ownedRulesOnly := fs.Bool("owned_rules_only", false, "if true, only merge generated rules into existing rules marked with a \"# gazelle:generated\" comment,\n\tand mark generated rules with it. Unmarked rules with the same name as a generated rule are left alone")
+	maxDepth := fs.Int("max_depth", 0, "maximum number of directory levels below the repository root to visit.\n\tDeeper directories are skipped with a warning. 0 means no limit.")
+	goVersion := fs.String("go_version", "", "version of the Go SDK packages are built with, like 1.9. If set, targets that require a newer\n\tversion, detected with -detect_go_version or declared with \"# gazelle:go_version\", are reported")
+	detectGoVersion := fs.Bool("detect_go_version", false, "if true, detect the Go version each target requires from the language features and standard\n\tpackages it uses, and note it in a comment on the generated rule")
+	selectSummaryThreshold := fs.Int("select_summary_threshold", 0, "if positive, add a comment summarizing the platform-specific srcs and deps of rules that\n\thave at least this many, like \"# gazelle:platforms srcs 3 platforms x 12 files\"")
+	maxSelectBranches := fs.Int("max_select_branches", 0, "if positive, write srcs with a glob filtered by build constraints at build time when a\n\tselect would have more than this many platform-specific cases")
+	collapseOSSelects := fs.Bool("collapse_os_selects", false, "if true, select on OS-level config_settings, like @io_bazel_rules_go//go/platform:linux, for\n\tsrcs and deps used on all of an OS's platforms")
+	knownRepoOverrides := fs.Bool("known_repo_overrides", true, "if true, generate compact rules for repositories known to have sources for many platforms, like\n\tgolang.org/x/sys, by collapsing selects and writing large srcs with a glob. Flags set explicitly take precedence")
+	followSymlinks := fs.Bool("follow_symlinks", false, "if true, follow symbolic links to directories while walking the repository")
+	updateDepsLocks := fs.Bool("update_deps_locks", false, "if true, rewrite "+depsLockName+" files with the external packages currently imported in their\n\tdirectories. Otherwise, gazelle fails if packages import external packages missing from those files")
+	importPolicy := fs.String("import_policy", "", "path to a file listing imports forbidden in parts of the repository. Forbidden imports are\n\treported when build files are generated; see config.ImportPolicy for the format")
+	testSizePolicy := fs.String("test_size_policy", "", "path to a file with rules choosing the size and timeout of go_test rules from their file\n\tcount, imports, and build tags; see config.TestSizePolicy for the format")
+	hermetic := fs.Bool("hermetic", false, "if true, fail instead of consulting anything that could differ between machines, like the network,\n\tso the same repository produces the same build files everywhere")
+	emptyPackageVisibility := fs.String("empty_package_visibility", "", "visibility label, like //visibility:public. If set, directories without a build file or\n\tgenerated rules get a build file with only a package rule setting default_visibility")
+	profileOpts.registerFlags(fs)
+	for _, l := range rules.Languages() {
+		l.RegisterFlags(fs)
+	}
+	verbose := fs.Bool("v", false, "if true, print progress and the time spent in each phase")
+	quiet := fs.Bool("q", false, "if true, only print errors, not warnings about individual files")
+	logFormat := fs.String("log_format", "text", "text: print messages as text\n\tjson: print each message as a JSON object on its own line, with level, kind, path, and message fields")
+	showVersion := fs.Bool("version", false, "if true, print the gazelle version, the rules_go version it targets, and the\n\tsupported languages, subcommands, and flags, then exit")
+	mode := fs.String("mode", "fix", "print: prints all of the updated BUILD files\n\tfix: rewrites all of the BUILD files in place\n\tdiff: computes the rewrite but then just does a diff\n\tmetadata: prints information about Go packages as JSON instead of updating BUILD files")
 	if err := fs.Parse(args); err != nil {
 		if err == flag.ErrHelp {
 			usage(fs)
@@ -177,12 +359,36 @@ func newConfiguration(args []string) (*config.Config, emitFunc, error) {
 		// flag already prints the error; don't print it again.
 		log.Fatal("Try -help for more information.")
 	}
+	if *showVersion {
+		printVersion(os.Stdout, fs)
+		os.Exit(0)
+	}
 
 	var c config.Config
 	var err error
 
+	if *verbose && *quiet {
+		return nil, nil, errors.New("-v and -q can't be used together")
+	}
+	format, err := logging.FormatFromString(*logFormat)
+	if err != nil {
+		return nil, nil, err
+	}
+	logging.SetFormat(format)
+	switch {
+	case *verbose:
+		logging.SetVerbosity(logging.InfoLevel)
+	case *quiet:
+		logging.SetVerbosity(logging.ErrorLevel)
+	default:
+		logging.SetVerbosity(logging.WarningLevel)
+	}
+
+	// "gazelle -" reads the directories to update from stdin. They're
+	// read once the repository root is known.
+	dirsFromStdin := fs.NArg() == 1 && fs.Arg(0) == "-"
 	c.Dirs = fs.Args()
-	if len(c.Dirs) == 0 {
+	if len(c.Dirs) == 0 || dirsFromStdin {
 		c.Dirs = []string{"."}
 	}
 	for i := range c.Dirs {
@@ -216,6 +422,16 @@ func newConfiguration(args []string) (*config.Config, emitFunc, error) {
 		}
 	}
 
+	if c.IgnoredPaths, err = wspace.ReadBazelIgnore(c.RepoRoot); err != nil {
+		return nil, nil, err
+	}
+	c.ExcludedPaths = excludes
+	for _, p := range c.ExcludedPaths {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, nil, fmt.Errorf("invalid exclude pattern %q: %v", p, err)
+		}
+	}
+
 	c.ValidBuildFileNames = strings.Split(*buildFileName, ",")
 	if len(c.ValidBuildFileNames) == 0 {
 		return nil, nil, fmt.Errorf("no valid build file names specified")
@@ -229,6 +445,16 @@ func newConfiguration(args []string) (*config.Config, emitFunc, error) {
 		c.GenericTags[t] = true
 	}
 	c.Platforms = config.DefaultPlatformTags
+	if *noCgoPlatforms != "" {
+		c.NoCgoPlatforms = make(map[string]bool)
+		for _, name := range strings.Split(*noCgoPlatforms, ",") {
+			label := config.PlatformLabelPrefix + name
+			if _, ok := c.Platforms[label]; !ok {
+				return nil, nil, fmt.Errorf("-no_cgo_platforms: unknown platform %q", name)
+			}
+			c.NoCgoPlatforms[label] = true
+		}
+	}
 	c.PreprocessTags()
 
 	c.GoPrefix = *goPrefix
@@ -244,16 +470,169 @@ func newConfiguration(args []string) (*config.Config, emitFunc, error) {
 		return nil, nil, err
 	}
 
-	emit, ok := modeFromName[*mode]
-	if !ok {
-		return nil, nil, fmt.Errorf("unrecognized emit mode: %q", *mode)
+	c.GlobMode, err = config.GlobModeFromString(*globMode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.ProtoMode, err = config.ProtoModeFromString(*protoMode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.HeaderMode, err = config.HeaderModeFromString(*cgoHeaders)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.Newline, err = config.NewlineFromString(*newline)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, m := range mergeStrategies {
+		i := strings.IndexByte(m, '=')
+		if i < 0 {
+			return nil, nil, fmt.Errorf("invalid -merge_strategy %q: want attr=strategy", m)
+		}
+		strategy, err := config.MergeStrategyFromString(m[i+1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.MergeStrategies == nil {
+			c.MergeStrategies = make(map[string]config.MergeStrategy)
+		}
+		c.MergeStrategies[m[:i]] = strategy
+	}
+
+	for _, s := range cgoVars {
+		name, v, err := config.ParseCgoVar(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.CgoVars == nil {
+			c.CgoVars = make(map[string]config.CgoVar)
+		}
+		c.CgoVars[name] = v
+	}
+
+	var emit emitFunc
+	if *mode != metadataMode {
+		var ok bool
+		emit, ok = modeFromName[*mode]
+		if !ok {
+			return nil, nil, fmt.Errorf("unrecognized emit mode: %q", *mode)
+		}
 	}
 
 	c.KnownImports = append(c.KnownImports, knownImports...)
+	for _, s := range repos {
+		r, err := config.ParseRepo(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r.Prefix == c.GoPrefix {
+			return nil, nil, fmt.Errorf("repository %q: prefix is the same as -go_prefix", s)
+		}
+		if st, err := os.Stat(c.RootDir(r)); err != nil || !st.IsDir() {
+			return nil, nil, fmt.Errorf("repository %q: root %s is not a directory", s, c.RootDir(r))
+		}
+		c.Repos = append(c.Repos, r)
+	}
+	if err := addGoModRepos(&c); err != nil {
+		return nil, nil, err
+	}
+	if *goVersion != "" {
+		if c.GoVersion, err = config.ParseGoVersion(*goVersion); err != nil {
+			return nil, nil, err
+		}
+	}
+	c.DetectGoVersion = *detectGoVersion
+	c.SelectSummaryThreshold = *selectSummaryThreshold
+	c.CollapseOSSelects = *collapseOSSelects
+	c.MaxSelectBranches = *maxSelectBranches
+	if *knownRepoOverrides {
+		if o := config.RepoOverrideFor(config.KnownRepoOverrides, c.GoPrefix); o != nil {
+			explicit := make(map[string]bool)
+			fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+			c.ApplyRepoOverride(o, explicit)
+		}
+	}
+	c.FollowSymlinks = *followSymlinks
+	c.MaxDepth = *maxDepth
+	c.EmptyPackageVisibility = *emptyPackageVisibility
+	c.UpdateDepsLocks = *updateDepsLocks
+	if *hermetic {
+		c.Hermetic = &config.Hermetic{}
+	}
+	if *importPolicy != "" {
+		if c.ImportPolicy, err = config.ReadImportPolicy(*importPolicy); err != nil {
+			return nil, nil, err
+		}
+	}
+	if *testSizePolicy != "" {
+		if c.TestSizePolicy, err = config.ReadTestSizePolicy(*testSizePolicy); err != nil {
+			return nil, nil, err
+		}
+	}
+	if *mode == "fix" {
+		c.Jobs = *jobs
+		c.RenameBuildFiles = *renameBuildFiles
+	} else {
+		// Other modes write to stdout. Emit one file at a time so output
+		// isn't interleaved.
+		c.Jobs = 1
+	}
+	if *changedSince != "" && *changedFiles != "" {
+		return nil, nil, errors.New("-changed_since and -changed_files may not be used together")
+	}
+	if dirsFromStdin {
+		if *changedSince != "" || *changedFiles != "" {
+			return nil, nil, errors.New("-changed_since and -changed_files may not be used when reading directories from stdin")
+		}
+		if c.UpdateDirs, err = readDirs(os.Stdin, c.RepoRoot); err != nil {
+			return nil, nil, fmt.Errorf("reading directories from stdin: %v", err)
+		}
+		c.Dirs = []string{c.RepoRoot}
+	}
+	if *changedSince != "" {
+		if c.UpdateDirs, err = changedDirs(c.RepoRoot, *changedSince); err != nil {
+			return nil, nil, err
+		}
+	}
+	if *changedFiles != "" {
+		if c.UpdateDirs, err = changedFilesDirs(c.RepoRoot, *changedFiles); err != nil {
+			return nil, nil, err
+		}
+	}
+	if *annotate {
+		c.Annotation = fmt.Sprintf("version=%s flags=%s", version, flagsHash(fs))
+	}
+	c.OwnedRulesOnly = *ownedRulesOnly
 
 	return &c, emit, err
 }
 
+// flagsHash returns a short hash of the flags explicitly set in fs. Flags
+// that don't affect generated rules, like -repo_root and -mode, are not
+// included, so the same hash is produced on different machines.
+func flagsHash(fs *flag.FlagSet) string {
+	h := sha256.New()
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "annotate", "changed_files", "changed_since", "go_version", "hermetic", "import_policy", "jobs", "log_format", "max_depth", "mode", "q", "repo_root", "update_deps_locks", "v":
+			return
+		}
+		for _, name := range profileFlagNames {
+			if f.Name == name {
+				return
+			}
+		}
+		fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value)
+	})
+	return hex.EncodeToString(h.Sum(nil))[:8]
+}
+
 func findBuildFile(c *config.Config, dir string) (string, error) {
 	for _, base := range c.ValidBuildFileNames {
 		p := filepath.Join(dir, base)
@@ -0,0 +1,205 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+)
+
+// managedClaim is an import path claimed by a library in a build file owned
+// by another tool.
+type managedClaim struct {
+	// importpath is the import path of the library. It's the importpath
+	// attribute, or the path go_library infers from the go_prefix and label.
+	importpath string
+
+	// label is the label of the library, and rel is the slash-separated
+	// path of its directory, relative to the repository root.
+	label, rel string
+
+	// file is the path to the build file.
+	file string
+}
+
+// indexManagedDirs finds build files in the repository marked with
+// "# gazelle:managed_by" and adds the import paths claimed by libraries in
+// them to c.ManagedImports, so imports of those libraries are resolved to
+// the right labels. The whole repository is searched, since libraries may
+// be imported from anywhere. Claims that conflict with each other or with
+// libraries Gazelle generates are reported and left out. indexManagedDirs
+// returns the number of conflicts.
+func indexManagedDirs(c *config.Config) int {
+	var claims []managedClaim
+	managedDirs := make(map[string]bool)
+	filepath.Walk(c.RepoRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			// Errors are reported when the repository is walked to
+			// generate build files.
+			return nil
+		}
+		rel, err := filepath.Rel(c.RepoRoot, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+		if base := info.Name(); rel != "" && (base[0] == '.' || base[0] == '_' || c.IsExcludedPath(rel)) {
+			return filepath.SkipDir
+		}
+		if f := readManagedBuildFile(c, p); f != nil {
+			managedDirs[rel] = true
+			claims = append(claims, libraryClaims(c, rel, f)...)
+		}
+		return nil
+	})
+	return addManagedClaims(c, claims, managedDirs)
+}
+
+// readManagedBuildFile returns the build file in dir if it's marked with
+// "# gazelle:managed_by", or nil otherwise. Files without the marker aren't
+// parsed.
+func readManagedBuildFile(c *config.Config, dir string) *bf.File {
+	for _, base := range c.ValidBuildFileNames {
+		p := filepath.Join(dir, base)
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		if !bytes.Contains(data, []byte(packages.ManagedByPrefix)) {
+			return nil
+		}
+		f, err := bf.Parse(p, data)
+		if err != nil || f == nil || packages.ManagedBy(f) == "" {
+			return nil
+		}
+		return f
+	}
+	return nil
+}
+
+// libraryClaims returns the import paths claimed by go_library and
+// go_proto_library rules in f, the build file in the directory rel.
+func libraryClaims(c *config.Config, rel string, f *bf.File) []managedClaim {
+	var claims []managedClaim
+	for _, s := range f.Stmt {
+		call, ok := s.(*bf.CallExpr)
+		if !ok {
+			continue
+		}
+		r := bf.Rule{Call: call}
+		if kind := r.Kind(); kind != "go_library" && kind != "go_proto_library" {
+			continue
+		}
+		name := r.Name()
+		if name == "" {
+			continue
+		}
+		claims = append(claims, managedClaim{
+			importpath: ruleImportPath(c, rel, name, r.AttrString("importpath")),
+			label:      resolve.Label{Pkg: rel, Name: name}.String(),
+			rel:        rel,
+			file:       f.Path,
+		})
+	}
+	return claims
+}
+
+// ruleImportPath returns the import path of a library named name in the
+// directory rel. If importpath, the rule's attribute, is empty, the path is
+// inferred from c.GoPrefix the same way go_library infers it.
+func ruleImportPath(c *config.Config, rel, name, importpath string) string {
+	if importpath != "" {
+		return importpath
+	}
+	importpath = path.Join(c.GoPrefix, rel)
+	if name != resolve.DefaultLibName {
+		importpath = path.Join(importpath, name)
+	}
+	if i := strings.LastIndex(importpath, "/vendor/"); i >= 0 {
+		importpath = importpath[i+len("/vendor/"):]
+	}
+	return importpath
+}
+
+// addManagedClaims adds claims to c.ManagedImports. A claim conflicts if an
+// earlier claim has the same import path, or if Gazelle generates a library
+// for the path in another directory, one with .go files that isn't in
+// managedDirs. Conflicts are reported as errors, and their count is
+// returned.
+func addManagedClaims(c *config.Config, claims []managedClaim, managedDirs map[string]bool) int {
+	conflicts := 0
+	owners := make(map[string]managedClaim)
+	for _, cl := range claims {
+		if prev, ok := owners[cl.importpath]; ok {
+			logging.Errorf(logging.ConflictingImportPath, cl.file, "%s: import path %q of %s is also claimed by %s", cl.file, cl.importpath, cl.label, prev.label)
+			conflicts++
+			continue
+		}
+		if rel, ok := generatedLibraryDir(c, cl.importpath); ok && rel != cl.rel && !managedDirs[rel] {
+			label := resolve.Label{Pkg: rel, Name: resolve.DefaultLibName}
+			logging.Errorf(logging.ConflictingImportPath, cl.file, "%s: import path %q of %s is also claimed by %s, which gazelle generates", cl.file, cl.importpath, cl.label, label)
+			conflicts++
+			continue
+		}
+		owners[cl.importpath] = cl
+		if c.ManagedImports == nil {
+			c.ManagedImports = make(map[string]string)
+		}
+		c.ManagedImports[cl.importpath] = cl.label
+	}
+	return conflicts
+}
+
+// generatedLibraryDir returns the directory, relative to the repository
+// root, where Gazelle would generate a library for importpath, and whether
+// it would. That's the case if the directory has .go files other than
+// tests.
+func generatedLibraryDir(c *config.Config, importpath string) (string, bool) {
+	var rel string
+	switch {
+	case importpath == c.GoPrefix:
+	case strings.HasPrefix(importpath, c.GoPrefix+"/"):
+		rel = importpath[len(c.GoPrefix)+1:]
+	default:
+		return "", false
+	}
+	if c.IsExcludedPath(rel) {
+		return "", false
+	}
+	files, err := ioutil.ReadDir(filepath.Join(c.RepoRoot, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", false
+	}
+	for _, f := range files {
+		if name := f.Name(); !f.IsDir() && strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go") {
+			return rel, true
+		}
+	}
+	return "", false
+}
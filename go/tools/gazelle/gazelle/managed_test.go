@@ -0,0 +1,83 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+func TestRuleImportPath(t *testing.T) {
+	c := &config.Config{GoPrefix: "example.com/repo"}
+	for _, tc := range []struct {
+		rel, name, importpath, want string
+	}{
+		{"gen/api", "go_default_library", "", "example.com/repo/gen/api"},
+		{"gen/api", "api_go", "", "example.com/repo/gen/api/api_go"},
+		{"", "go_default_library", "", "example.com/repo"},
+		{"vendor/example.com/lib", "go_default_library", "", "example.com/lib"},
+		{"gen/api", "api_go", "example.com/api", "example.com/api"},
+	} {
+		if got := ruleImportPath(c, tc.rel, tc.name, tc.importpath); got != tc.want {
+			t.Errorf("ruleImportPath(%q, %q, %q) = %q; want %q", tc.rel, tc.name, tc.importpath, got, tc.want)
+		}
+	}
+}
+
+func TestAddManagedClaims(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "managed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"lib/lib.go", "gen/api/api.pb.go", "gen/other/other.pb.go", "tests/a_test.go"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("package x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &config.Config{RepoRoot: dir, GoPrefix: "example.com/repo"}
+	claims := []managedClaim{
+		{importpath: "example.com/repo/gen/api", label: "//gen/api:go_default_library", rel: "gen/api"},
+		{importpath: "example.com/repo/gen/api", label: "//gen/other:api", rel: "gen/other"},
+		{importpath: "example.com/repo/lib", label: "//gen/other:lib", rel: "gen/other"},
+		{importpath: "example.com/repo/tests", label: "//gen/other:tests", rel: "gen/other"},
+		{importpath: "example.com/repo/gen/api/v2", label: "//gen/api:v2", rel: "gen/api"},
+		{importpath: "example.com/external", label: "//gen/api:external", rel: "gen/api"},
+	}
+	managedDirs := map[string]bool{"gen/api": true, "gen/other": true}
+	if got, want := addManagedClaims(c, claims, managedDirs), 2; got != want {
+		t.Errorf("got %d conflicts; want %d", got, want)
+	}
+	want := map[string]string{
+		"example.com/repo/gen/api":    "//gen/api:go_default_library",
+		"example.com/repo/tests":      "//gen/other:tests",
+		"example.com/repo/gen/api/v2": "//gen/api:v2",
+		"example.com/external":        "//gen/api:external",
+	}
+	if !reflect.DeepEqual(c.ManagedImports, want) {
+		t.Errorf("got managed imports %v; want %v", c.ManagedImports, want)
+	}
+}
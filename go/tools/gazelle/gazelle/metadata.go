@@ -0,0 +1,109 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/formats"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+)
+
+// metadataMode is the name of the mode that prints package metadata as JSON
+// instead of emitting BUILD files.
+const metadataMode = "metadata"
+
+// printMetadata walks the directories in c.Dirs and prints a
+// formats.PackageDump describing each Go package found to stdout.
+func printMetadata(c *config.Config) error {
+	return writeMetadata(os.Stdout, c)
+}
+
+func writeMetadata(w io.Writer, c *config.Config) error {
+	dump := formats.PackageDump{
+		Version:  formats.PackageDumpVersion,
+		Packages: []formats.Package{},
+	}
+	for _, dir := range c.Dirs {
+		packages.Scan(c, dir, func(pkg *packages.Package) {
+			dump.Packages = append(dump.Packages, newPackageMetadata(c, pkg))
+		})
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = w.Write(data)
+	return err
+}
+
+func newPackageMetadata(c *config.Config, pkg *packages.Package) formats.Package {
+	var generate []formats.GenerateDirective
+	for _, g := range pkg.Generate {
+		generate = append(generate, formats.GenerateDirective{File: g.File, Command: g.Command})
+	}
+	return formats.Package{
+		Name:        pkg.Name,
+		Dir:         pkg.Dir,
+		Rel:         pkg.Rel,
+		ImportPath:  path.Join(c.GoPrefix, pkg.Rel),
+		Library:     newTargetMetadata(pkg.Library),
+		CgoLibrary:  newTargetMetadata(pkg.CgoLibrary),
+		CLibrary:    newTargetMetadata(pkg.CLibrary),
+		Binary:      newTargetMetadata(pkg.Binary),
+		Test:        newTargetMetadata(pkg.Test),
+		XTest:       newTargetMetadata(pkg.XTest),
+		Protos:      pkg.Protos,
+		HasPbGo:     pkg.HasPbGo,
+		HasTestdata: pkg.HasTestdata,
+		Generate:    generate,
+	}
+}
+
+func newTargetMetadata(t packages.Target) *formats.Target {
+	if t.Sources.IsEmpty() {
+		return nil
+	}
+	return &formats.Target{
+		Sources:   newPlatformStringsMetadata(t.SourcesAndHdrs()),
+		Imports:   newPlatformStringsMetadata(t.Imports),
+		COpts:     newPlatformStringsMetadata(t.COpts),
+		CLinkOpts: newPlatformStringsMetadata(t.CLinkOpts),
+		Hdrs:      newPlatformStringsMetadata(t.Hdrs),
+	}
+}
+
+func newPlatformStringsMetadata(ps packages.PlatformStrings) *formats.PlatformStrings {
+	if ps.IsEmpty() {
+		return nil
+	}
+	m := &formats.PlatformStrings{Generic: ps.Generic}
+	for platform, strs := range ps.Platform {
+		if len(strs) == 0 {
+			continue
+		}
+		if m.Platform == nil {
+			m.Platform = make(map[string][]string)
+		}
+		m.Platform[platform] = strs
+	}
+	return m
+}
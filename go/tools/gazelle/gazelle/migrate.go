@@ -0,0 +1,173 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/edit"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/migrate"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/wspace"
+)
+
+func migrateUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle migrate [flags...] script...
+
+Migrate looks for "go build", "go install", and "go test" commands in
+Makefiles and shell scripts and copies their flags into the rules that
+gazelle generated for the packages they build. -X flags in -ldflags become
+x_defs, other -ldflags become gc_linkopts, and -gcflags become gc_goopts.
+Build tags are reported, since they are passed to gazelle with -build_tags.
+
+Run gazelle to generate BUILD files before running migrate. Scripts are not
+executed, so commands that can't be converted are reported as warnings.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("gazelle migrate", flag.ContinueOnError)
+	fs.Usage = func() {}
+	buildFileName := fs.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names")
+	goPrefix := fs.String("go_prefix", "", "go_prefix of the target workspace")
+	repoRoot := fs.String("repo_root", "", "path to the repository root, otherwise gazelle searches for it.")
+	mode := fs.String("mode", "fix", "print: prints the updated BUILD files\n\tfix: rewrites the BUILD files in place\n\tdiff: shows the changes that would be made")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			migrateUsage(fs)
+			os.Exit(0)
+		}
+		return errors.New("Try -help for more information.")
+	}
+	if fs.NArg() == 0 {
+		return errors.New("no scripts given")
+	}
+
+	emit, ok := modeFromName[*mode]
+	if !ok {
+		return fmt.Errorf("unrecognized emit mode: %q", *mode)
+	}
+
+	c := &config.Config{
+		RepoRoot:            *repoRoot,
+		ValidBuildFileNames: strings.Split(*buildFileName, ","),
+		GoPrefix:            *goPrefix,
+	}
+	if c.RepoRoot == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if c.RepoRoot, err = wspace.Find(cwd); err != nil {
+			return fmt.Errorf("-repo_root not specified, and WORKSPACE cannot be found: %v", err)
+		}
+	}
+	var err error
+	if c.RepoRoot, err = filepath.Abs(c.RepoRoot); err != nil {
+		return err
+	}
+	if c.GoPrefix == "" {
+		if c.GoPrefix, err = loadGoPrefix(c); err != nil {
+			return err
+		}
+	}
+
+	var changes []migrate.Change
+	tags := make(map[string]bool)
+	for _, script := range fs.Args() {
+		abs, err := filepath.Abs(script)
+		if err != nil {
+			return err
+		}
+		if !isDescendingDir(filepath.Dir(abs), c.RepoRoot) {
+			return fmt.Errorf("script %q is not in repo root %q", script, c.RepoRoot)
+		}
+		data, err := ioutil.ReadFile(abs)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.RepoRoot, filepath.Dir(abs))
+		if err != nil {
+			return err
+		}
+		invs := migrate.ParseScript(script, data)
+		plan := migrate.Convert(invs, filepath.ToSlash(rel), c.GoPrefix)
+		changes = append(changes, plan.Changes...)
+		for _, t := range plan.BuildTags {
+			tags[t] = true
+		}
+		for _, w := range plan.Warnings {
+			logging.Warningf("", abs, "%s", w)
+		}
+	}
+
+	// Changes to the same package are applied to the same file, which is
+	// emitted once.
+	var files []*bf.File
+	filesByRel := make(map[string]*bf.File)
+	for _, ch := range changes {
+		f, ok := filesByRel[ch.Rel]
+		if !ok {
+			dir := filepath.Join(c.RepoRoot, filepath.FromSlash(ch.Rel))
+			p, err := findBuildFile(c, dir)
+			if err != nil {
+				logging.Warningf(logging.IOError, dir, "%s: could not find build file in %s; run gazelle first", ch.Pos, dir)
+				continue
+			}
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			if f, err = bf.Parse(p, data); err != nil {
+				return err
+			}
+			filesByRel[ch.Rel] = f
+			files = append(files, f)
+		}
+		if err := migrate.Apply(f, ch); err != nil {
+			logging.Warning(err)
+		}
+	}
+	for _, f := range files {
+		edit.Format(f)
+		if err := emit(c, f); err != nil {
+			return err
+		}
+	}
+
+	if len(tags) > 0 {
+		var tagList []string
+		for t := range tags {
+			tagList = append(tagList, t)
+		}
+		sort.Strings(tagList)
+		logging.Warningf("", "", "scripts use build tags; run gazelle with -build_tags=%s", strings.Join(tagList, ","))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+// outputWriter emits files using up to c.Jobs goroutines. Errors are
+// collected for each file and reported together by wait, so one file that
+// can't be written doesn't stop the others.
+type outputWriter struct {
+	c    *config.Config
+	emit emitFunc
+	sem  chan struct{}
+	wg   sync.WaitGroup
+
+	// timer records the time spent writing files. It may be nil.
+	timer *phaseTimer
+
+	mu    sync.Mutex
+	count int
+	errs  []error
+}
+
+func newOutputWriter(c *config.Config, emit emitFunc) *outputWriter {
+	jobs := c.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	return &outputWriter{c: c, emit: emit, sem: make(chan struct{}, jobs)}
+}
+
+// write emits f in the background. It blocks while c.Jobs files are being
+// emitted. f must not be modified after write is called.
+func (w *outputWriter) write(f *bf.File) {
+	w.sem <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.sem
+			w.wg.Done()
+		}()
+		start := time.Now()
+		err := w.emit(w.c, f)
+		w.timer.since(writePhase, start)
+		w.timer.countFile()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.count++
+		if err != nil {
+			w.errs = append(w.errs, err)
+		}
+	}()
+}
+
+// wait waits for all files to be emitted. It returns an outputError if any
+// files could not be emitted.
+func (w *outputWriter) wait() error {
+	w.wg.Wait()
+	if len(w.errs) == 0 {
+		return nil
+	}
+	return &outputError{total: w.count, errs: w.errs}
+}
+
+// outputError reports all the files that could not be emitted.
+type outputError struct {
+	total int
+	errs  []error
+}
+
+func (e *outputError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d of %d files could not be written:", len(e.errs), e.total)
+	for _, err := range e.errs {
+		fmt.Fprintf(&buf, "\n\t%v", err)
+	}
+	return buf.String()
+}
+
+// generateQueue generates files using up to c.Jobs goroutines and passes
+// them to an outputWriter in the order they were added, so the output
+// doesn't depend on which files are generated first.
+type generateQueue struct {
+	w     *outputWriter
+	sem   chan struct{}
+	files chan chan *bf.File
+	done  chan struct{}
+}
+
+func newGenerateQueue(c *config.Config, w *outputWriter) *generateQueue {
+	jobs := c.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	q := &generateQueue{
+		w:     w,
+		sem:   make(chan struct{}, jobs),
+		files: make(chan chan *bf.File, jobs),
+		done:  make(chan struct{}),
+	}
+	go q.writeFiles()
+	return q
+}
+
+// add calls gen in the background and writes the file it returns, unless
+// the file is nil. add must not be called concurrently with itself or wait.
+func (q *generateQueue) add(gen func() *bf.File) {
+	q.sem <- struct{}{}
+	file := make(chan *bf.File, 1)
+	q.files <- file
+	go func() {
+		defer func() { <-q.sem }()
+		file <- gen()
+	}()
+}
+
+// wait waits for all files to be generated and passed to the outputWriter.
+func (q *generateQueue) wait() {
+	close(q.files)
+	<-q.done
+}
+
+func (q *generateQueue) writeFiles() {
+	for file := range q.files {
+		if f := <-file; f != nil {
+			q.w.write(f)
+		}
+	}
+	close(q.done)
+}
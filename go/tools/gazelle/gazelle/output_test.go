@@ -0,0 +1,114 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+func TestOutputWriter(t *testing.T) {
+	const jobs = 3
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	written := make(map[string]bool)
+	emit := func(c *config.Config, f *bf.File) error {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+
+		if strings.HasPrefix(f.Path, "bad") {
+			return fmt.Errorf("%s: cannot write", f.Path)
+		}
+		mu.Lock()
+		written[f.Path] = true
+		mu.Unlock()
+		return nil
+	}
+
+	w := newOutputWriter(&config.Config{Jobs: jobs}, emit)
+	for i := 0; i < 20; i++ {
+		w.write(&bf.File{Path: fmt.Sprintf("good%d", i)})
+	}
+	w.write(&bf.File{Path: "bad1"})
+	w.write(&bf.File{Path: "bad2"})
+	err := w.wait()
+
+	if len(written) != 20 {
+		t.Errorf("got %d files written; want 20", len(written))
+	}
+	if maxActive > jobs {
+		t.Errorf("got %d concurrent writes; want at most %d", maxActive, jobs)
+	}
+	if err == nil {
+		t.Fatal("got success; want error")
+	}
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "2 of 22 files could not be written") ||
+		!strings.Contains(msg, "bad1: cannot write") ||
+		!strings.Contains(msg, "bad2: cannot write") {
+		t.Errorf("got error %q; want error reporting bad1 and bad2", msg)
+	}
+}
+
+func TestGenerateQueueOrder(t *testing.T) {
+	// With one emitting goroutine, files must be emitted in the order they
+	// were added, even though later files are generated first.
+	var got []string
+	emit := func(c *config.Config, f *bf.File) error {
+		got = append(got, f.Path)
+		return nil
+	}
+	w := newOutputWriter(&config.Config{Jobs: 1}, emit)
+	q := newGenerateQueue(&config.Config{Jobs: 4}, w)
+	var want []string
+	for i := 0; i < 8; i++ {
+		path := fmt.Sprintf("f%d", i)
+		delay := time.Duration(8-i) * time.Millisecond
+		if i == 5 {
+			// Ignored files are not emitted.
+			q.add(func() *bf.File { return nil })
+			continue
+		}
+		want = append(want, path)
+		q.add(func() *bf.File {
+			time.Sleep(delay)
+			return &bf.File{Path: path}
+		})
+	}
+	q.wait()
+	if err := w.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
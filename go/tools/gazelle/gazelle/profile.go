@@ -0,0 +1,205 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"time"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+)
+
+// profileOptions holds flags used to diagnose slow runs. They are set by
+// newConfiguration.
+var profileOpts profileOptions
+
+type profileOptions struct {
+	cpuProfile, memProfile, trace string
+}
+
+// profileFlagNames lists flags registered by registerFlags. They don't
+// affect generated rules.
+var profileFlagNames = []string{"cpuprofile", "memprofile", "trace"}
+
+func (p *profileOptions) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&p.cpuProfile, "cpuprofile", "", "write a CPU profile to this file")
+	fs.StringVar(&p.memProfile, "memprofile", "", "write a memory profile to this file when gazelle finishes")
+	fs.StringVar(&p.trace, "trace", "", "write an execution trace to this file")
+}
+
+// start starts CPU profiling and tracing, if they were requested. The
+// returned function stops them and writes the memory profile. It must be
+// called before gazelle exits, even if start returns an error.
+func (p *profileOptions) start() (stop func() error, err error) {
+	var stops []func() error
+	stop = func() error {
+		var firstErr error
+		for i := len(stops) - 1; i >= 0; i-- {
+			if err := stops[i](); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	if p.cpuProfile != "" {
+		f, err := os.Create(p.cpuProfile)
+		if err != nil {
+			return stop, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return stop, err
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return f.Close()
+		})
+	}
+
+	if p.trace != "" {
+		f, err := os.Create(p.trace)
+		if err != nil {
+			return stop, err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return stop, err
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return f.Close()
+		})
+	}
+
+	if p.memProfile != "" {
+		path := p.memProfile
+		stops = append(stops, func() error {
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			runtime.GC() // get up-to-date statistics
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		})
+	}
+
+	return stop, nil
+}
+
+// Phases of a run, in the order they are reported.
+const (
+	walkPhase     = "walk"
+	resolvePhase  = "resolve"
+	generatePhase = "generate"
+	mergePhase    = "merge"
+	writePhase    = "write"
+)
+
+var phases = []string{walkPhase, resolvePhase, generatePhase, mergePhase, writePhase}
+
+// phaseTimer measures the time spent in each phase of a run, and counts the
+// directories visited and files emitted. Since most phases run concurrently,
+// the time reported for them is the sum of the time spent by each
+// goroutine. All methods may be called on a nil *phaseTimer, in which case
+// nothing is measured.
+type phaseTimer struct {
+	start time.Time
+
+	mu          sync.Mutex
+	times       map[string]time.Duration
+	dirs, files int
+}
+
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{start: time.Now(), times: make(map[string]time.Duration)}
+}
+
+// add records that d was spent in phase.
+func (t *phaseTimer) add(phase string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.times[phase] += d
+}
+
+// since records the time since start as spent in phase.
+func (t *phaseTimer) since(phase string, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.add(phase, time.Since(start))
+}
+
+// countDir records that a directory was visited.
+func (t *phaseTimer) countDir() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dirs++
+}
+
+// countFile records that a build file was emitted.
+func (t *phaseTimer) countFile() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files++
+}
+
+// report logs the time spent in each phase.
+func (t *phaseTimer) report() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	logging.Infof("time: %-10s %v", "total", time.Since(t.start))
+	for _, phase := range phases {
+		logging.Infof("time: %-10s %v", phase, t.times[phase])
+	}
+}
+
+// timedResolver measures the time spent resolving imports for one package,
+// so it can be subtracted from the time spent generating rules. It must not
+// be used concurrently.
+type timedResolver struct {
+	r resolve.LabelResolver
+	d time.Duration
+}
+
+func (r *timedResolver) Resolve(importpath, dir string) (resolve.Label, error) {
+	start := time.Now()
+	l, err := r.r.Resolve(importpath, dir)
+	r.d += time.Since(start)
+	return l, err
+}
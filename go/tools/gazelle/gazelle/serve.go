@@ -0,0 +1,360 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/rules"
+)
+
+func serveUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle serve -listen unix:path [flags...] [-- gazelle-flags...]
+
+Serve runs gazelle as a long-lived server, so editor plugins and pre-commit
+hooks don't pay for walking the whole repository on each run. Go packages in
+the repository are indexed once when the server starts. Requests are JSON-RPC
+1.0 calls, as implemented by the Go net/rpc/jsonrpc package, to these
+methods:
+
+  Gazelle.Generate {"Dir": "foo"}
+      Regenerates the build file in one directory. The reply has the
+      file's "Path", its new "Content", and whether it "Changed". Content
+      is empty if gazelle wouldn't write a file there.
+  Gazelle.Check {"Dirs": ["foo", "bar"]}
+      Lists in "Stale" the directories whose build files gazelle would
+      change. The whole repository is checked if Dirs is empty.
+  Gazelle.Resolve {"ImportPath": "example.com/repo/foo", "From": "bar"}
+      Resolves an import in a directory to the "Label" gazelle would add to
+      deps. "Dir" is the directory of the package, if it's indexed.
+  Gazelle.Reindex {}
+      Walks the whole repository again. The reply has the number of
+      indexed "Packages".
+
+Directories are slash-separated paths relative to the repository root. The
+directories named in Generate and Check requests are read again from disk,
+so the index stays current as files are edited. Flags after "--" are the
+same as gazelle's and configure how build files are generated.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("gazelle serve", flag.ContinueOnError)
+	fs.Usage = func() {}
+	listen := fs.String("listen", "", "address to listen on: unix:path for a Unix domain socket, or tcp:host:port")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			serveUsage(fs)
+			os.Exit(0)
+		}
+		return errors.New("Try -help for more information.")
+	}
+	if *listen == "" {
+		return errors.New("gazelle serve: -listen must be set")
+	}
+	network, address, err := parseListenAddr(*listen)
+	if err != nil {
+		return err
+	}
+	c, _, err := newConfiguration(fs.Args())
+	if err != nil {
+		return err
+	}
+	s, err := newGazelleServer(c)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	// Closing a Unix listener removes its socket, so the server is stopped
+	// by closing the listener on interrupt rather than by exiting.
+	var stopped bool
+	var stopMu sync.Mutex
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		stopMu.Lock()
+		stopped = true
+		stopMu.Unlock()
+		ln.Close()
+	}()
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Gazelle", s); err != nil {
+		return err
+	}
+	logging.Infof("serving %s on %s", c.RepoRoot, *listen)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			stopMu.Lock()
+			defer stopMu.Unlock()
+			if stopped {
+				return nil
+			}
+			return err
+		}
+		go srv.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// parseListenAddr splits an address given with -listen, like
+// "unix:/tmp/gazelle.sock" or "tcp:localhost:5000", into a network and an
+// address for net.Listen.
+func parseListenAddr(s string) (network, address string, err error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return "", "", fmt.Errorf("-listen %q: want unix:path or tcp:host:port", s)
+	}
+	network, address = s[:i], s[i+1:]
+	if network != "unix" && network != "tcp" || address == "" {
+		return "", "", fmt.Errorf("-listen %q: want unix:path or tcp:host:port", s)
+	}
+	return network, address, nil
+}
+
+// GenerateArgs are the arguments of Gazelle.Generate.
+type GenerateArgs struct {
+	Dir string
+}
+
+// GenerateReply is the result of Gazelle.Generate.
+type GenerateReply struct {
+	Path, Content string
+	Changed       bool
+}
+
+// CheckArgs are the arguments of Gazelle.Check.
+type CheckArgs struct {
+	Dirs []string
+}
+
+// CheckReply is the result of Gazelle.Check.
+type CheckReply struct {
+	Stale []string
+}
+
+// ResolveArgs are the arguments of Gazelle.Resolve.
+type ResolveArgs struct {
+	ImportPath, From string
+}
+
+// ResolveReply is the result of Gazelle.Resolve.
+type ResolveReply struct {
+	Label, Dir string
+}
+
+// ReindexArgs are the arguments of Gazelle.Reindex.
+type ReindexArgs struct{}
+
+// ReindexReply is the result of Gazelle.Reindex.
+type ReindexReply struct {
+	Packages int
+}
+
+// gazelleServer answers requests made to "gazelle serve". Requests are
+// handled one at a time, since they may update the index.
+type gazelleServer struct {
+	mu    sync.Mutex
+	c     *config.Config
+	langs []rules.Language
+	r     resolve.LabelResolver
+
+	// pkgs maps directories, relative to the repository root, to the Go
+	// packages in them. importPaths maps import paths of those packages to
+	// their directories.
+	pkgs        map[string]*packages.Package
+	importPaths map[string]string
+}
+
+// dirResult is the build file generated for a directory. path and content
+// are empty if gazelle wouldn't write a file there.
+type dirResult struct {
+	rel, path string
+	content   []byte
+	changed   bool
+}
+
+// newGazelleServer configures languages with c and indexes the packages in
+// the repository.
+func newGazelleServer(c *config.Config) (*gazelleServer, error) {
+	s := &gazelleServer{
+		c:     c,
+		langs: rules.Languages(),
+		r:     resolve.NewLabelResolver(c),
+	}
+	for _, l := range s.langs {
+		if err := l.Configure(c); err != nil {
+			return nil, fmt.Errorf("%s: %v", l.Name(), err)
+		}
+	}
+	s.update(nil)
+	return s, nil
+}
+
+// update reads the directories rels from disk, updates the index, and
+// generates their build files. If rels is nil, the whole repository is read
+// and the index is rebuilt.
+func (s *gazelleServer) update(rels []string) []dirResult {
+	c := *s.c
+	if rels == nil {
+		c.UpdateDirs = nil
+		s.pkgs = make(map[string]*packages.Package)
+		s.importPaths = make(map[string]string)
+	} else {
+		c.UpdateDirs = make(map[string]bool)
+		for _, rel := range rels {
+			c.UpdateDirs[rel] = true
+		}
+	}
+	var results []dirResult
+	packages.WalkDirs(&c, c.RepoRoot, func(d *packages.Dir) {
+		s.indexDir(d.Rel, d.Package)
+		res := dirResult{rel: d.Rel}
+		if f := processDir(&c, s.langs, nil, d); f != nil {
+			res.path = f.Path
+			res.content = bf.Format(f)
+			old, err := ioutil.ReadFile(f.Path)
+			res.changed = err != nil || !equalIgnoringNewlines(old, res.content)
+		}
+		results = append(results, res)
+	})
+	return results
+}
+
+// indexDir records pkg as the package in the directory rel, replacing any
+// package recorded before. pkg is nil if the directory has no Go package.
+func (s *gazelleServer) indexDir(rel string, pkg *packages.Package) {
+	importPath := path.Join(s.c.GoPrefix, rel)
+	if pkg == nil {
+		delete(s.pkgs, rel)
+		delete(s.importPaths, importPath)
+		return
+	}
+	s.pkgs[rel] = pkg
+	s.importPaths[importPath] = rel
+}
+
+// relDir converts a directory given in a request to a slash-separated path
+// relative to the repository root. Absolute paths must be inside the
+// repository.
+func (s *gazelleServer) relDir(dir string) (string, error) {
+	if filepath.IsAbs(dir) {
+		rel, err := filepath.Rel(s.c.RepoRoot, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("%s: not in repository %s", dir, s.c.RepoRoot)
+		}
+		dir = filepath.ToSlash(rel)
+	}
+	if dir = path.Clean(dir); dir == "." {
+		dir = ""
+	}
+	if dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", fmt.Errorf("%s: not in repository %s", dir, s.c.RepoRoot)
+	}
+	return dir, nil
+}
+
+// Generate regenerates the build file in one directory.
+func (s *gazelleServer) Generate(args *GenerateArgs, reply *GenerateReply) error {
+	rel, err := s.relDir(args.Dir)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, res := range s.update([]string{rel}) {
+		if res.rel == rel {
+			*reply = GenerateReply{Path: res.path, Content: string(res.content), Changed: res.changed}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: directory not found or excluded", args.Dir)
+}
+
+// Check lists the directories whose build files would change.
+func (s *gazelleServer) Check(args *CheckArgs, reply *CheckReply) error {
+	var rels []string
+	for _, dir := range args.Dirs {
+		rel, err := s.relDir(dir)
+		if err != nil {
+			return err
+		}
+		rels = append(rels, rel)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply.Stale = nil
+	for _, res := range s.update(rels) {
+		if res.changed {
+			reply.Stale = append(reply.Stale, res.rel)
+		}
+	}
+	sort.Strings(reply.Stale)
+	return nil
+}
+
+// Resolve resolves an import in a directory to a label.
+func (s *gazelleServer) Resolve(args *ResolveArgs, reply *ResolveReply) error {
+	from, err := s.relDir(args.From)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.r.Resolve(args.ImportPath, from)
+	if err != nil {
+		return err
+	}
+	*reply = ResolveReply{Label: l.String(), Dir: s.importPaths[args.ImportPath]}
+	return nil
+}
+
+// Reindex walks the whole repository again.
+func (s *gazelleServer) Reindex(args *ReindexArgs, reply *ReindexReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(nil)
+	reply.Packages = len(s.pkgs)
+	return nil
+}
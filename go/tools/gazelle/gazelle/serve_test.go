@@ -0,0 +1,138 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		s, network, address string
+		wantErr             bool
+	}{
+		{s: "unix:/tmp/gazelle.sock", network: "unix", address: "/tmp/gazelle.sock"},
+		{s: "tcp:localhost:5000", network: "tcp", address: "localhost:5000"},
+		{s: "/tmp/gazelle.sock", wantErr: true},
+		{s: "udp:localhost:5000", wantErr: true},
+		{s: "unix:", wantErr: true},
+	} {
+		network, address, err := parseListenAddr(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseListenAddr(%q): got success; want error", tc.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseListenAddr(%q): %v", tc.s, err)
+		} else if network != tc.network || address != tc.address {
+			t.Errorf("parseListenAddr(%q) = %q, %q; want %q, %q", tc.s, network, address, tc.network, tc.address)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "WORKSPACE"},
+		{path: "lib/lib.go", content: "package lib\n"},
+		{path: "cmd/main.go", content: `package main
+
+import _ "example.com/repo/lib"
+
+func main() {}
+`},
+		{path: "data/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, _, err := newConfiguration([]string{"-repo_root", dir, "-go_prefix", "example.com/repo", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newGazelleServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Gazelle", s); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go srv.ServeCodec(jsonrpc.NewServerCodec(serverConn))
+	client := jsonrpc.NewClient(clientConn)
+	defer client.Close()
+
+	var reindex ReindexReply
+	if err := client.Call("Gazelle.Reindex", &ReindexArgs{}, &reindex); err != nil {
+		t.Fatal(err)
+	}
+	if reindex.Packages != 2 {
+		t.Errorf("Reindex: got %d packages; want 2", reindex.Packages)
+	}
+
+	var resolved ResolveReply
+	if err := client.Call("Gazelle.Resolve", &ResolveArgs{ImportPath: "example.com/repo/lib", From: "cmd"}, &resolved); err != nil {
+		t.Fatal(err)
+	}
+	if want := (ResolveReply{Label: "//lib:go_default_library", Dir: "lib"}); resolved != want {
+		t.Errorf("Resolve: got %+v; want %+v", resolved, want)
+	}
+
+	var check CheckReply
+	if err := client.Call("Gazelle.Check", &CheckArgs{}, &check); err != nil {
+		t.Fatal(err)
+	}
+	// The root directory gets a build file with the go_prefix rule.
+	if want := []string{"", "cmd", "lib"}; !reflect.DeepEqual(check.Stale, want) {
+		t.Errorf("Check: got stale %q; want %q", check.Stale, want)
+	}
+
+	var gen GenerateReply
+	if err := client.Call("Gazelle.Generate", &GenerateArgs{Dir: filepath.Join(dir, "lib")}, &gen); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "lib", "BUILD.bazel"); gen.Path != want || !gen.Changed {
+		t.Errorf("Generate: got path %q, changed %v; want %q, true", gen.Path, gen.Changed, want)
+	}
+	if err := client.Call("Gazelle.Generate", &GenerateArgs{Dir: "../elsewhere"}, &gen); err == nil {
+		t.Errorf("Generate outside the repository: got success; want error")
+	}
+
+	// Removing a package's sources removes it from the index once its
+	// directory is read again.
+	if err := os.Remove(filepath.Join(dir, "lib", "lib.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("Gazelle.Check", &CheckArgs{Dirs: []string{"lib"}}, &check); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("Gazelle.Resolve", &ResolveArgs{ImportPath: "example.com/repo/lib", From: "cmd"}, &resolved); err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Dir != "" {
+		t.Errorf("Resolve after removing lib: got dir %q; want none", resolved.Dir)
+	}
+}
@@ -0,0 +1,63 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/telemetry"
+)
+
+// record passes statistics about the run measured by t to the telemetry
+// recorder, if one is set. err is the error the run ended with, if any.
+func (t *phaseTimer) record(err error) {
+	if t == nil || !telemetry.Enabled() {
+		return
+	}
+	telemetry.Record(t.stats(err))
+}
+
+// stats returns anonymized statistics about the run measured by t.
+func (t *phaseTimer) stats(err error) *telemetry.Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &telemetry.Stats{
+		Version:  version,
+		GOOS:     runtime.GOOS,
+		GOARCH:   runtime.GOARCH,
+		Duration: time.Since(t.start),
+		Phases:   make(map[string]time.Duration),
+		Dirs:     t.dirs,
+		Files:    t.files,
+		Errors:   kindCounts(logging.ErrorLevel),
+		Warnings: kindCounts(logging.WarningLevel),
+		Failed:   err != nil,
+	}
+	for _, phase := range phases {
+		s.Phases[phase] = t.times[phase]
+	}
+	return s
+}
+
+func kindCounts(l logging.Level) map[string]int {
+	counts := make(map[string]int)
+	for kind, n := range logging.Counts(l) {
+		counts[string(kind)] = n
+	}
+	return counts
+}
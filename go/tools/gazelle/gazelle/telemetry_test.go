@@ -0,0 +1,69 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+)
+
+func TestRunStats(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "WORKSPACE"},
+		{path: "a/a.go", content: "package a"},
+		{path: "b/b.go", content: "package b"},
+		{path: "b/bad.go", content: "not go"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, _, err := newConfiguration([]string{"-repo_root", dir, "-go_prefix", "example.com/repo", "-q", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.ResetCounts()
+	defer logging.ResetCounts()
+
+	timer := newPhaseTimer()
+	emit := func(*config.Config, *bf.File) error { return nil }
+	err = run(c, emit, timer)
+	s := timer.stats(err)
+
+	if s.Version != version || s.Failed {
+		t.Errorf("got version %q, failed %v; want %q, false", s.Version, s.Failed, version)
+	}
+	// The root directory has a build file for the go_prefix rule.
+	if s.Dirs != 3 || s.Files != 3 {
+		t.Errorf("got %d dirs, %d files; want 3 dirs, 3 files", s.Dirs, s.Files)
+	}
+	if want := map[string]int{"parse_error": 1}; !reflect.DeepEqual(s.Warnings, want) {
+		t.Errorf("got warnings %v; want %v", s.Warnings, want)
+	}
+	if len(s.Errors) != 0 {
+		t.Errorf("got errors %v; want none", s.Errors)
+	}
+	for _, phase := range phases {
+		if _, ok := s.Phases[phase]; !ok {
+			t.Errorf("no time recorded for phase %q", phase)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/merger"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/wspace"
+)
+
+func updateReposUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle update-repos [flags...]
+
+Update-repos pins a go_repository rule in WORKSPACE to each module required
+by the go.mod file in the repository root. Each rule gets the module's
+version and the hash of its zip file from go.sum as sum, so go_repository
+downloads the module and checks it against go.sum. Existing rules with the
+same importpath are updated; their commit, tag, urls, and sha256 attributes
+are removed, since they can't be set together with version. Other rules are
+added after them.
+
+Every required module must be listed in go.sum; run "go mod download" to
+add missing ones. Modules replaced with a directory are skipped, since
+gazelle resolves their imports to the directory. Modules replaced with
+other modules aren't supported. Rules with a trailing "# keep" comment are
+left alone.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
+
+func runUpdateRepos(args []string) error {
+	fs := flag.NewFlagSet("gazelle update-repos", flag.ContinueOnError)
+	fs.Usage = func() {}
+	repoRoot := fs.String("repo_root", "", "path to the repository root, otherwise gazelle searches for it.")
+	mode := fs.String("mode", "fix", "print: prints the updated WORKSPACE file\n\tfix: rewrites the WORKSPACE file in place\n\tdiff: shows the changes that would be made")
+	prune := fs.Bool("prune", false, "if true, go_repository rules with a version for modules no longer required by go.mod are deleted")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			updateReposUsage(fs)
+			os.Exit(0)
+		}
+		return errors.New("Try -help for more information.")
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	emit, ok := modeFromName[*mode]
+	if !ok {
+		return fmt.Errorf("unrecognized emit mode: %q", *mode)
+	}
+
+	c := &config.Config{RepoRoot: *repoRoot}
+	if c.RepoRoot == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if c.RepoRoot, err = wspace.Find(cwd); err != nil {
+			return fmt.Errorf("-repo_root not specified, and WORKSPACE cannot be found: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(c.RepoRoot, "go.mod")); err != nil {
+		return err
+	}
+	reqs, err := wspace.ReadGoModRequirements(c.RepoRoot)
+	if err != nil {
+		return err
+	}
+	reps, err := wspace.ReadGoModReplacements(c.RepoRoot)
+	if err != nil {
+		return err
+	}
+	sums, err := wspace.ReadGoSum(c.RepoRoot)
+	if err != nil {
+		return err
+	}
+	mods, err := pinnedModules(reqs, reps, sums)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.RepoRoot, "WORKSPACE")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	f, err := bf.Parse(path, data)
+	if err != nil {
+		return err
+	}
+	updateRepos(f, mods, *prune)
+	return emit(c, f)
+}
+
+// pinnedModule is a module required by go.mod, with the hash of its zip
+// file from go.sum.
+type pinnedModule struct {
+	path, version, sum string
+}
+
+// pinnedModules returns the modules in reqs, except those replaced with
+// directories in reps, with their sums from sums, a map returned by
+// wspace.ReadGoSum. An error is returned if a module is replaced with
+// another module, or if its sum is missing.
+func pinnedModules(reqs []wspace.Requirement, reps []wspace.Replacement, sums map[string]string) ([]pinnedModule, error) {
+	var mods []pinnedModule
+	var missing []string
+	for _, req := range reqs {
+		if rep, ok := findReplacement(reps, req); ok {
+			if rep.IsLocal() {
+				continue
+			}
+			return nil, fmt.Errorf("%s %s is replaced with %s %s; replacements with other modules aren't supported", req.Path, req.Version, rep.New, rep.NewVersion)
+		}
+		sum, ok := sums[req.Path+" "+req.Version]
+		if !ok {
+			missing = append(missing, req.Path+"@"+req.Version)
+			continue
+		}
+		mods = append(mods, pinnedModule{path: req.Path, version: req.Version, sum: sum})
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("go.sum has no hashes for %s; run \"go mod download\" to add them", strings.Join(missing, ", "))
+	}
+	return mods, nil
+}
+
+// findReplacement returns the replace directive in reps that applies to
+// req, if there is one. Like the go command, a directive for req's
+// version takes precedence over one for all versions.
+func findReplacement(reps []wspace.Replacement, req wspace.Requirement) (wspace.Replacement, bool) {
+	var found wspace.Replacement
+	ok := false
+	for _, rep := range reps {
+		if rep.Old != req.Path {
+			continue
+		}
+		if rep.OldVersion == req.Version {
+			return rep, true
+		}
+		if rep.OldVersion == "" {
+			found, ok = rep, true
+		}
+	}
+	return found, ok
+}
+
+// conflictingRepoAttrs are attributes of go_repository that can't be set
+// together with version.
+var conflictingRepoAttrs = []string{"commit", "tag", "urls", "strip_prefix", "type", "sha256"}
+
+// updateRepos updates go_repository rules in f, a WORKSPACE file, to the
+// versions and sums of mods. Rules are matched by importpath. Rules for
+// modules without one are added at the end of f, sorted by name, and
+// go_repository is added to the load of @io_bazel_rules_go//go:def.bzl if
+// needed. If prune is set, go_repository rules with a version for modules
+// not in mods are deleted. Rules with a trailing "# keep" comment are left
+// alone.
+func updateRepos(f *bf.File, mods []pinnedModule, prune bool) {
+	byPath := make(map[string]pinnedModule)
+	for _, m := range mods {
+		byPath[m.path] = m
+	}
+	updated := make(map[string]bool)
+	deleted := make(map[bf.Expr]bool)
+	for _, r := range f.Rules("go_repository") {
+		if merger.ShouldKeepRule(r.Call) {
+			continue
+		}
+		importpath := r.AttrString("importpath")
+		m, ok := byPath[importpath]
+		if !ok {
+			if prune && r.Attr("version") != nil {
+				deleted[r.Call] = true
+			}
+			continue
+		}
+		for _, key := range conflictingRepoAttrs {
+			r.DelAttr(key)
+		}
+		r.SetAttr("sum", &bf.StringExpr{Value: m.sum})
+		r.SetAttr("version", &bf.StringExpr{Value: m.version})
+		updated[importpath] = true
+	}
+	if len(deleted) > 0 {
+		var stmt []bf.Expr
+		for _, s := range f.Stmt {
+			if !deleted[s] {
+				stmt = append(stmt, s)
+			}
+		}
+		f.Stmt = stmt
+	}
+
+	var added []*bf.CallExpr
+	for _, m := range mods {
+		if updated[m.path] {
+			continue
+		}
+		added = append(added, &bf.CallExpr{
+			X: &bf.LiteralExpr{Token: "go_repository"},
+			List: []bf.Expr{
+				repoAttr("name", resolve.ImportPathToBazelRepoName(m.path)),
+				repoAttr("importpath", m.path),
+				repoAttr("sum", m.sum),
+				repoAttr("version", m.version),
+			},
+		})
+	}
+	if len(added) == 0 {
+		return
+	}
+	sort.Stable(callsByName(added))
+	if !loadsGoRepository(f) {
+		f.Stmt = append(f.Stmt, &bf.CallExpr{
+			X: &bf.LiteralExpr{Token: "load"},
+			List: []bf.Expr{
+				&bf.StringExpr{Value: "@io_bazel_rules_go//go:def.bzl"},
+				&bf.StringExpr{Value: "go_repository"},
+			},
+		})
+	}
+	for _, call := range added {
+		f.Stmt = append(f.Stmt, call)
+	}
+}
+
+// loadsGoRepository returns whether f loads go_repository from
+// @io_bazel_rules_go//go:def.bzl. If another symbol is loaded from that
+// file, go_repository is added to its load, and true is returned.
+func loadsGoRepository(f *bf.File) bool {
+	for _, s := range f.Stmt {
+		call, ok := s.(*bf.CallExpr)
+		if !ok || len(call.List) == 0 {
+			continue
+		}
+		if x, ok := call.X.(*bf.LiteralExpr); !ok || x.Token != "load" {
+			continue
+		}
+		if label, ok := call.List[0].(*bf.StringExpr); !ok || label.Value != "@io_bazel_rules_go//go:def.bzl" {
+			continue
+		}
+		for _, arg := range call.List[1:] {
+			if sym, ok := arg.(*bf.StringExpr); ok && sym.Value == "go_repository" {
+				return true
+			}
+		}
+		call.List = append(call.List, &bf.StringExpr{Value: "go_repository"})
+		return true
+	}
+	return false
+}
+
+func repoAttr(key, value string) *bf.BinaryExpr {
+	return &bf.BinaryExpr{
+		X:  &bf.LiteralExpr{Token: key},
+		Op: "=",
+		Y:  &bf.StringExpr{Value: value},
+	}
+}
+
+// callsByName sorts rules created by updateRepos by name, which is always
+// their first argument.
+type callsByName []*bf.CallExpr
+
+func (s callsByName) Len() int      { return len(s) }
+func (s callsByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s callsByName) Less(i, j int) bool {
+	return s[i].List[0].(*bf.BinaryExpr).Y.(*bf.StringExpr).Value < s[j].List[0].(*bf.BinaryExpr).Y.(*bf.StringExpr).Value
+}
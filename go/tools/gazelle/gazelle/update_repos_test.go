@@ -0,0 +1,131 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/wspace"
+)
+
+func TestPinnedModules(t *testing.T) {
+	reqs := []wspace.Requirement{
+		{Path: "example.com/a", Version: "v1.0.0"},
+		{Path: "example.com/local", Version: "v1.0.0"},
+		{Path: "example.com/b/v2", Version: "v2.1.0"},
+	}
+	reps := []wspace.Replacement{{Old: "example.com/local", New: "../local"}}
+	sums := map[string]string{
+		"example.com/a v1.0.0":    "h1:a=",
+		"example.com/b/v2 v2.1.0": "h1:b=",
+	}
+	got, err := pinnedModules(reqs, reps, sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pinnedModule{
+		{path: "example.com/a", version: "v1.0.0", sum: "h1:a="},
+		{path: "example.com/b/v2", version: "v2.1.0", sum: "h1:b="},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	delete(sums, "example.com/a v1.0.0")
+	if _, err := pinnedModules(reqs, reps, sums); err == nil || !strings.Contains(err.Error(), "example.com/a@v1.0.0") {
+		t.Errorf("missing sum: got error %v; want error naming example.com/a@v1.0.0", err)
+	}
+
+	reps = []wspace.Replacement{{Old: "example.com/b/v2", New: "example.com/fork/v2", NewVersion: "v2.1.1"}}
+	if _, err := pinnedModules(reqs[2:], reps, sums); err == nil {
+		t.Errorf("module replacement: got success; want error")
+	}
+}
+
+func TestUpdateRepos(t *testing.T) {
+	old := `load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies")
+
+go_repository(
+    name = "com_example_a",
+    commit = "0123456789abcdef0123456789abcdef01234567",
+    importpath = "example.com/a",
+)
+
+go_repository(
+    name = "com_example_old",
+    importpath = "example.com/old",
+    sum = "h1:old=",
+    version = "v1.0.0",
+)
+
+go_repository(
+    name = "com_example_tool",
+    commit = "0123456789abcdef0123456789abcdef01234567",
+    importpath = "example.com/tool",
+)
+
+go_repository(
+    name = "com_example_kept",
+    importpath = "example.com/kept",
+    version = "v0.1.0",
+)  # keep
+`
+	// The parser attaches the comment after com_example_kept to its last
+	// attribute, so that's where it's printed.
+	want := `load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies", "go_repository")
+
+go_repository(
+    name = "com_example_a",
+    importpath = "example.com/a",
+    sum = "h1:a=",
+    version = "v1.1.0",
+)
+
+go_repository(
+    name = "com_example_tool",
+    commit = "0123456789abcdef0123456789abcdef01234567",
+    importpath = "example.com/tool",
+)
+
+go_repository(
+    name = "com_example_kept",
+    importpath = "example.com/kept",
+    version = "v0.1.0",  # keep
+)
+
+go_repository(
+    name = "com_example_b_v2",
+    importpath = "example.com/b/v2",
+    sum = "h1:b=",
+    version = "v2.0.0",
+)
+`
+	f, err := bf.Parse("WORKSPACE", []byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mods := []pinnedModule{
+		{path: "example.com/a", version: "v1.1.0", sum: "h1:a="},
+		{path: "example.com/b/v2", version: "v2.0.0", sum: "h1:b="},
+	}
+	updateRepos(f, mods, true)
+	if got := string(bf.Format(f)); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,61 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/rules"
+)
+
+// version identifies this build of Gazelle in rule annotations and in the
+// output of -version. The gazelle binary sets it from the
+// STABLE_GAZELLE_VERSION workspace status variable when built with
+// --workspace_status_command; otherwise it's "devel".
+var version = "devel"
+
+// rulesGoVersion is the release of rules_go whose rules and attributes
+// Gazelle generates.
+const rulesGoVersion = "0.5.2"
+
+// printVersion writes the Gazelle version, the rules_go version it targets,
+// and the languages, subcommands, and flags this build supports, so scripts
+// can check for a feature without comparing versions.
+func printVersion(w io.Writer, fs *flag.FlagSet) {
+	var langs []string
+	for _, l := range rules.Languages() {
+		langs = append(langs, l.Name())
+	}
+	var cmds []string
+	for name := range subcommands {
+		cmds = append(cmds, name)
+	}
+	sort.Strings(cmds)
+	var flags []string
+	fs.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, f.Name)
+	})
+
+	fmt.Fprintf(w, "gazelle version %s\n", version)
+	fmt.Fprintf(w, "rules_go version %s\n", rulesGoVersion)
+	fmt.Fprintf(w, "languages: %s\n", strings.Join(langs, " "))
+	fmt.Fprintf(w, "subcommands: %s\n", strings.Join(cmds, " "))
+	fmt.Fprintf(w, "flags: %s\n", strings.Join(flags, " "))
+}
@@ -0,0 +1,46 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestPrintVersion(t *testing.T) {
+	fs := flag.NewFlagSet("gazelle", flag.ContinueOnError)
+	fs.Bool("version", false, "")
+	fs.String("mode", "fix", "")
+
+	var buf bytes.Buffer
+	printVersion(&buf, fs)
+	got := buf.String()
+	for _, want := range []string{
+		"gazelle version " + version + "\n",
+		"rules_go version " + rulesGoVersion + "\n",
+		"subcommands: edit import migrate serve update-repos visibility why\n",
+		"flags: mode version\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got:\n%s\nwant line %q", got, want)
+		}
+	}
+	if !strings.Contains(got, "languages: go") {
+		t.Errorf("got:\n%s\nwant the go language", got)
+	}
+}
@@ -0,0 +1,341 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/edit"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/merger"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/wspace"
+)
+
+func visibilityUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle visibility [flags...]
+
+Visibility finds go_library rules with public visibility and suggests the
+narrowest visibility that still allows every package in the repository that
+depends on them. Dependencies are read from the deps, embed, and library
+attributes of every rule in every build file in the repository, including
+rules gazelle didn't generate. If any of those attributes can't be read,
+for example, because it's a variable, no visibility is suggested, since
+dependents can't be known. Dependencies added inside macros aren't seen.
+
+In report mode, which is the default, one line is printed for each library
+whose visibility could be narrowed. In the other modes, the visibility
+attributes are rewritten. Since public libraries may be used by other
+repositories, which can't be seen here, visibility is only rewritten when
+-no_external_users is set. Libraries with no dependents in the repository
+are reported but not changed. Visibility attributes marked with a "# keep"
+comment are left alone.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
+
+const publicVisibility = "//visibility:public"
+
+func runVisibility(args []string) error {
+	fs := flag.NewFlagSet("gazelle visibility", flag.ContinueOnError)
+	fs.Usage = func() {}
+	buildFileName := fs.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names")
+	repoRoot := fs.String("repo_root", "", "path to the repository root, otherwise gazelle searches for it.")
+	goPrefix := fs.String("go_prefix", "", "go_prefix of the target workspace")
+	noExternalUsers := fs.Bool("no_external_users", false, "if true, no other repository depends on libraries in this one, so their visibility may be rewritten")
+	mode := fs.String("mode", "report", "report: prints suggested visibility for each library\n\tprint: prints the updated BUILD files\n\tfix: rewrites the BUILD files in place\n\tdiff: shows the changes that would be made")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			visibilityUsage(fs)
+			os.Exit(0)
+		}
+		return errors.New("Try -help for more information.")
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	var emit emitFunc
+	if *mode != "report" {
+		var ok bool
+		if emit, ok = modeFromName[*mode]; !ok {
+			return fmt.Errorf("unrecognized emit mode: %q", *mode)
+		}
+		if !*noExternalUsers {
+			return fmt.Errorf("-mode=%s rewrites visibility, but libraries may be used by other repositories; set -no_external_users if none are", *mode)
+		}
+	}
+
+	c, err := newRepoConfig(*repoRoot, *goPrefix, "external", *buildFileName)
+	if err != nil {
+		return err
+	}
+
+	// The whole repository is indexed before any suggestions are made,
+	// since a library may be used by packages visited after it.
+	type buildFile struct {
+		f   *bf.File
+		rel string
+	}
+	var files []buildFile
+	idx := make(usageIndex)
+	var unknown []string
+	packages.WalkDirs(c, c.RepoRoot, func(d *packages.Dir) {
+		if d.File != nil {
+			unknown = append(unknown, idx.addFile(d.File, d.Rel)...)
+			files = append(files, buildFile{d.File, d.Rel})
+		}
+	})
+	if len(unknown) > 0 {
+		return fmt.Errorf("dependents of libraries can't be known, since these attributes couldn't be read:\n\t%s", strings.Join(unknown, "\n\t"))
+	}
+
+	for _, file := range files {
+		f := file.f
+		changed := false
+		for _, s := range suggestVisibility(f, file.rel, idx) {
+			if emit == nil {
+				printSuggestion(os.Stdout, s)
+				continue
+			}
+			if len(s.visibility) == 0 {
+				continue
+			}
+			cmd := edit.Command{Op: "set", Args: append([]string{"visibility"}, s.visibility...)}
+			if err := edit.Apply(f, s.label.Name, []edit.Command{cmd}); err != nil {
+				return err
+			}
+			changed = true
+		}
+		if changed {
+			edit.Format(f)
+			if err := emit(c, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newRepoConfig returns a configuration for subcommands that analyze the
+// whole repository, like visibility and why, from the values of their
+// flags. The repository root and prefix are found the same way as when
+// generating build files.
+func newRepoConfig(repoRoot, goPrefix, external, buildFileName string) (*config.Config, error) {
+	c := &config.Config{
+		RepoRoot:            repoRoot,
+		GoPrefix:            goPrefix,
+		ValidBuildFileNames: strings.Split(buildFileName, ","),
+		GenericTags:         make(config.BuildTags),
+		Platforms:           config.DefaultPlatformTags,
+	}
+	c.PreprocessTags()
+	if c.RepoRoot == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		if c.RepoRoot, err = wspace.Find(cwd); err != nil {
+			return nil, fmt.Errorf("-repo_root not specified, and WORKSPACE cannot be found: %v", err)
+		}
+	}
+	var err error
+	if c.IgnoredPaths, err = wspace.ReadBazelIgnore(c.RepoRoot); err != nil {
+		return nil, err
+	}
+	if c.GoPrefix == "" {
+		if c.GoPrefix, err = loadGoPrefix(c); err != nil {
+			return nil, fmt.Errorf("-go_prefix not set and not root BUILD file found")
+		}
+	}
+	if c.DepMode, err = config.DependencyModeFromString(external); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// usageIndex maps labels of targets in the repository, like
+// "//foo:go_default_library", to the set of packages that depend on them.
+// Packages are slash-separated paths relative to the repository root.
+type usageIndex map[string]map[string]bool
+
+// usageAttrs are the attributes of rules that name their dependencies.
+// "library" is the attribute older go_test rules used instead of "embed".
+var usageAttrs = []string{"deps", "embed", "library"}
+
+// addFile records the dependencies of all rules in f, the build file in
+// the package rel, whatever their kind. Labels in other repositories are
+// skipped. The attributes that couldn't be read are returned, like
+// "//foo:bar deps".
+func (idx usageIndex) addFile(f *bf.File, rel string) []string {
+	var unknown []string
+	for _, r := range f.Rules("") {
+		for _, attr := range usageAttrs {
+			e := r.Attr(attr)
+			if e == nil {
+				continue
+			}
+			labels, ok := attrLabels(e)
+			if !ok {
+				l := resolve.Label{Pkg: rel, Name: r.Name()}
+				unknown = append(unknown, fmt.Sprintf("%s %s", absoluteLabel(l), attr))
+				continue
+			}
+			for _, s := range labels {
+				l, err := resolve.ParseLabel(s)
+				if err != nil || l.Repo != "" {
+					continue
+				}
+				if l.Relative {
+					l.Pkg, l.Relative = rel, false
+				}
+				if l.Pkg == rel {
+					continue
+				}
+				key := absoluteLabel(l)
+				if idx[key] == nil {
+					idx[key] = make(map[string]bool)
+				}
+				idx[key][rel] = true
+			}
+		}
+	}
+	return unknown
+}
+
+// attrLabels returns the strings in e, the value of an attribute. e may be
+// a string, a list, a select, or a concatenation of them. false is returned
+// if e contains any other expression, since its value isn't known.
+func attrLabels(e bf.Expr) ([]string, bool) {
+	switch e := e.(type) {
+	case *bf.StringExpr:
+		return []string{e.Value}, true
+	case *bf.ListExpr:
+		var labels []string
+		for _, elem := range e.List {
+			ls, ok := attrLabels(elem)
+			if !ok {
+				return nil, false
+			}
+			labels = append(labels, ls...)
+		}
+		return labels, true
+	case *bf.BinaryExpr:
+		if e.Op != "+" {
+			return nil, false
+		}
+		x, ok := attrLabels(e.X)
+		if !ok {
+			return nil, false
+		}
+		y, ok := attrLabels(e.Y)
+		if !ok {
+			return nil, false
+		}
+		return append(x, y...), true
+	case *bf.CallExpr:
+		fn, ok := e.X.(*bf.LiteralExpr)
+		if !ok || fn.Token != "select" || len(e.List) != 1 {
+			return nil, false
+		}
+		dict, ok := e.List[0].(*bf.DictExpr)
+		if !ok {
+			return nil, false
+		}
+		var labels []string
+		for _, c := range dict.List {
+			kv, ok := c.(*bf.KeyValueExpr)
+			if !ok {
+				return nil, false
+			}
+			ls, ok := attrLabels(kv.Value)
+			if !ok {
+				return nil, false
+			}
+			labels = append(labels, ls...)
+		}
+		return labels, true
+	default:
+		return nil, false
+	}
+}
+
+// absoluteLabel formats l with an explicit package and name, like
+// "//foo:go_default_library", so equal labels have equal strings.
+func absoluteLabel(l resolve.Label) string {
+	return fmt.Sprintf("//%s:%s", l.Pkg, l.Name)
+}
+
+// visibilitySuggestion is a go_library rule whose visibility could be
+// narrowed.
+type visibilitySuggestion struct {
+	label resolve.Label
+
+	// visibility is the narrowest visibility that allows all dependents. It
+	// is empty if nothing in the repository depends on the library.
+	visibility []string
+}
+
+// suggestVisibility returns suggestions for go_library rules with public
+// visibility in f, the build file in the package rel.
+func suggestVisibility(f *bf.File, rel string, idx usageIndex) []visibilitySuggestion {
+	var suggestions []visibilitySuggestion
+	for _, r := range f.Rules("go_library") {
+		vis, ok := r.Attr("visibility").(*bf.ListExpr)
+		if !ok || len(vis.List) != 1 || merger.ShouldKeep(vis) || merger.ShouldKeep(vis.List[0]) {
+			continue
+		}
+		if s, ok := vis.List[0].(*bf.StringExpr); !ok || s.Value != publicVisibility {
+			continue
+		}
+		l := resolve.Label{Pkg: rel, Name: r.Name()}
+		suggestions = append(suggestions, visibilitySuggestion{
+			label:      l,
+			visibility: narrowVisibility(idx[absoluteLabel(l)]),
+		})
+	}
+	return suggestions
+}
+
+// narrowVisibility returns a visibility list allowing each package in
+// users, in sorted order.
+func narrowVisibility(users map[string]bool) []string {
+	var vis []string
+	for rel := range users {
+		vis = append(vis, fmt.Sprintf("//%s:__pkg__", rel))
+	}
+	sort.Strings(vis)
+	return vis
+}
+
+func printSuggestion(w io.Writer, s visibilitySuggestion) {
+	if len(s.visibility) == 0 {
+		fmt.Fprintf(w, "%s: no dependents in this repository\n", absoluteLabel(s.label))
+		return
+	}
+	fmt.Fprintf(w, "%s: %s -> %s\n", absoluteLabel(s.label), publicVisibility, strings.Join(s.visibility, " "))
+}
@@ -0,0 +1,130 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+)
+
+func TestUsageIndex(t *testing.T) {
+	idx := make(usageIndex)
+	for _, file := range []struct{ rel, content string }{
+		{
+			rel: "app",
+			content: `
+go_library(
+    name = "go_default_library",
+    deps = [
+        ":util",
+        "//lib:go_default_library",
+        "@com_github_external_dep//:go_default_library",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": ["//lib/linux:go_default_library"],
+        "//conditions:default": [],
+    }),
+)
+
+go_test(
+    name = "go_default_test",
+    embed = [":go_default_library"],
+    deps = ["//testutil:go_default_library"],
+)
+`,
+		}, {
+			rel: "tool",
+			content: `
+my_go_binary(
+    name = "tool",
+    deps = ["//lib"],
+)
+`,
+		},
+	} {
+		f, err := bf.Parse(file.rel+"/BUILD", []byte(file.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unknown := idx.addFile(f, file.rel); len(unknown) > 0 {
+			t.Errorf("%s: got unknown attributes %v; want none", file.rel, unknown)
+		}
+	}
+
+	want := usageIndex{
+		"//lib:lib":                      {"tool": true},
+		"//lib:go_default_library":       {"app": true},
+		"//lib/linux:go_default_library": {"app": true},
+		"//testutil:go_default_library":  {"app": true},
+	}
+	if !reflect.DeepEqual(idx, want) {
+		t.Errorf("got index %v; want %v", idx, want)
+	}
+}
+
+func TestUsageIndexHandwrittenRule(t *testing.T) {
+	f, err := bf.Parse("tool/BUILD", []byte(`
+sh_binary(
+    name = "tool",
+    srcs = ["tool.sh"],
+    deps = ["//lib:go_default_library"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := make(usageIndex)
+	idx.addFile(f, "tool")
+	if got, want := narrowVisibility(idx["//lib:go_default_library"]), []string{"//tool:__pkg__"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got visibility %v; want %v", got, want)
+	}
+}
+
+func TestUsageIndexUnknownDeps(t *testing.T) {
+	f, err := bf.Parse("app/BUILD", []byte(`
+go_binary(
+    name = "app",
+    deps = COMMON_DEPS + ["//lib:go_default_library"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := make(usageIndex)
+	if got, want := idx.addFile(f, "app"), []string{"//app:app deps"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got unknown attributes %v; want %v", got, want)
+	}
+}
+
+func TestPrintSuggestion(t *testing.T) {
+	var buf bytes.Buffer
+	printSuggestion(&buf, visibilitySuggestion{
+		label:      resolve.Label{Pkg: "lib", Name: "go_default_library"},
+		visibility: []string{"//app:__pkg__", "//tool:__pkg__"},
+	})
+	printSuggestion(&buf, visibilitySuggestion{
+		label: resolve.Label{Pkg: "unused", Name: "go_default_library"},
+	})
+	want := `//lib:go_default_library: //visibility:public -> //app:__pkg__ //tool:__pkg__
+//unused:go_default_library: no dependents in this repository
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,255 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+)
+
+func whyUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle why [flags...] from-label dep-label
+
+Why explains why a Go rule in this repository depends on another rule. It
+prints the source files and import statements of from-label whose imports
+resolve to dep-label, the same way gazelle resolves deps. For example:
+
+  gazelle why //foo:go_default_library @org_x//y
+
+If dep-label has no explicit target name, like @org_x//y, imports of any
+rule in that package are reported. Imports in files that are only built
+on some platforms are followed by those platforms.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
+
+func runWhy(args []string) error {
+	fs := flag.NewFlagSet("gazelle why", flag.ContinueOnError)
+	fs.Usage = func() {}
+	buildFileName := fs.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names")
+	repoRoot := fs.String("repo_root", "", "path to the repository root, otherwise gazelle searches for it.")
+	goPrefix := fs.String("go_prefix", "", "go_prefix of the target workspace")
+	external := fs.String("external", "external", "external: resolve external packages with go_repository\n\tvendored: resolve external packages as packages in vendor/")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			whyUsage(fs)
+			os.Exit(0)
+		}
+		return errors.New("Try -help for more information.")
+	}
+	if fs.NArg() != 2 {
+		return errors.New("gazelle why: expected a rule label and a dependency label")
+	}
+	from, err := resolve.ParseLabel(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if from.Repo != "" || from.Relative {
+		return fmt.Errorf("%s: must be a label of a rule in this repository, like //foo:go_default_library", fs.Arg(0))
+	}
+	dep, err := parseDepLabel(fs.Arg(1), from.Pkg)
+	if err != nil {
+		return err
+	}
+
+	c, err := newRepoConfig(*repoRoot, *goPrefix, *external, *buildFileName)
+	if err != nil {
+		return err
+	}
+	c.UpdateDirs = map[string]bool{from.Pkg: true}
+	var pkg *packages.Package
+	packages.Walk(c, c.RepoRoot, func(p *packages.Package, _ *bf.File) {
+		if p.Rel == from.Pkg {
+			pkg = p
+		}
+	})
+	if pkg == nil {
+		return fmt.Errorf("%s: no Go package found in //%s", absoluteLabel(from), from.Pkg)
+	}
+	targets, err := ruleTargets(pkg, from.Name)
+	if err != nil {
+		return err
+	}
+
+	r := resolve.NewLabelResolver(c)
+	edges, err := findImportEdges(r, pkg, targets, dep)
+	if err != nil {
+		return err
+	}
+	if len(edges) == 0 {
+		return fmt.Errorf("%s does not import anything resolved to %s", absoluteLabel(from), fs.Arg(1))
+	}
+	printImportEdges(os.Stdout, absoluteLabel(from), fs.Arg(1), edges)
+	return nil
+}
+
+// depLabel is a dependency label given to "gazelle why".
+type depLabel struct {
+	resolve.Label
+
+	// anyName is true if the label had no explicit target name, like
+	// "@org_x//y". Labels of any rule in the package match it.
+	anyName bool
+}
+
+// parseDepLabel parses a dependency label. Relative labels are made
+// absolute in the package rel.
+func parseDepLabel(s, rel string) (depLabel, error) {
+	l, err := resolve.ParseLabel(s)
+	if err != nil {
+		return depLabel{}, err
+	}
+	if l.Relative {
+		l.Pkg, l.Relative = rel, false
+	}
+	return depLabel{Label: l, anyName: !strings.Contains(s, ":")}, nil
+}
+
+// matches returns whether l, resolved from an import in the package rel,
+// refers to a rule matched by d.
+func (d depLabel) matches(l resolve.Label, rel string) bool {
+	if l.Relative {
+		l.Pkg, l.Relative = rel, false
+	}
+	return l.Repo == d.Repo && l.Pkg == d.Pkg && (d.anyName || l.Name == d.Name)
+}
+
+// ruleTargets returns the targets in pkg that gazelle generates the rule
+// named name from.
+func ruleTargets(pkg *packages.Package, name string) ([]packages.Target, error) {
+	switch {
+	case name == resolve.DefaultLibName:
+		return []packages.Target{pkg.Library, pkg.CgoLibrary}, nil
+	case name == resolve.DefaultCgoLibName:
+		return []packages.Target{pkg.CgoLibrary}, nil
+	case name == resolve.DefaultTestName:
+		return []packages.Target{pkg.Test}, nil
+	case name == resolve.DefaultXTestName:
+		return []packages.Target{pkg.XTest}, nil
+	case pkg.IsCommand() && name == filepath.Base(pkg.Dir):
+		return []packages.Target{pkg.Binary}, nil
+	default:
+		return nil, fmt.Errorf("//%s:%s: not a Go rule generated by gazelle", pkg.Rel, name)
+	}
+}
+
+// importEdge is an import statement that causes a dependency.
+type importEdge struct {
+	file string // path of the file relative to the repository root
+	line int
+	imp  string
+
+	// platforms lists the names of the platforms the file is built on, like
+	// "linux_amd64", if it isn't built on all of them.
+	platforms []string
+}
+
+// findImportEdges returns the import statements in the .go sources of
+// targets whose imports resolve to a label matching dep. Edges are sorted
+// by file and line.
+func findImportEdges(r resolve.LabelResolver, pkg *packages.Package, targets []packages.Target, dep depLabel) ([]importEdge, error) {
+	filePlatforms := make(map[string][]string)
+	for _, t := range targets {
+		for _, src := range t.Sources.Generic {
+			filePlatforms[src] = nil
+		}
+		for label, srcs := range t.Sources.Platform {
+			name := strings.TrimPrefix(label, config.PlatformLabelPrefix)
+			for _, src := range srcs {
+				if ps, ok := filePlatforms[src]; !ok || ps != nil {
+					filePlatforms[src] = append(ps, name)
+				}
+			}
+		}
+	}
+
+	var edges []importEdge
+	fset := token.NewFileSet()
+	for src, platforms := range filePlatforms {
+		if !strings.HasSuffix(src, ".go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, src), nil, parser.ImportsOnly)
+		if os.IsNotExist(err) {
+			// Generated files don't exist until they're built.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(platforms)
+		for _, spec := range f.Imports {
+			imp, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			l, err := r.Resolve(imp, pkg.Rel)
+			if err != nil || !dep.matches(l, pkg.Rel) {
+				continue
+			}
+			edges = append(edges, importEdge{
+				file:      path.Join(pkg.Rel, src),
+				line:      fset.Position(spec.Pos()).Line,
+				imp:       imp,
+				platforms: platforms,
+			})
+		}
+	}
+	sort.Sort(byFileAndLine(edges))
+	return edges, nil
+}
+
+type byFileAndLine []importEdge
+
+func (es byFileAndLine) Len() int      { return len(es) }
+func (es byFileAndLine) Swap(i, j int) { es[i], es[j] = es[j], es[i] }
+func (es byFileAndLine) Less(i, j int) bool {
+	if es[i].file != es[j].file {
+		return es[i].file < es[j].file
+	}
+	return es[i].line < es[j].line
+}
+
+// printImportEdges prints the import statements that cause from to depend
+// on dep, one per line.
+func printImportEdges(w io.Writer, from, dep string, edges []importEdge) {
+	fmt.Fprintf(w, "%s depends on %s because of:\n", from, dep)
+	for _, e := range edges {
+		fmt.Fprintf(w, "  %s:%d: import %q", e.file, e.line, e.imp)
+		if len(e.platforms) > 0 {
+			fmt.Fprintf(w, " (%s)", strings.Join(e.platforms, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,108 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+)
+
+func TestFindImportEdges(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "why_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"foo.go": `package foo
+
+import (
+	"fmt"
+
+	"github.com/x/y"
+)
+`,
+		"foo_linux.go": `package foo
+
+import "github.com/x/y/z"
+`,
+		"bar.go": `package foo
+
+import "example.com/repo/lib"
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	linux := config.Platform{OS: "linux", Arch: "amd64"}.Label()
+	pkg := &packages.Package{
+		Name: "foo",
+		Dir:  dir,
+		Rel:  "foo",
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{
+				Generic:  []string{"bar.go", "foo.go", "gen.go"},
+				Platform: map[string][]string{linux: {"foo_linux.go"}},
+			},
+		},
+	}
+	c := &config.Config{GoPrefix: "example.com/repo", DepMode: config.ExternalMode}
+	r := resolve.NewLabelResolver(c)
+
+	for _, tc := range []struct {
+		dep, want string
+	}{
+		{
+			dep: "@com_github_x_y//:go_default_library",
+			want: `//foo:go_default_library depends on @com_github_x_y//:go_default_library because of:
+  foo/foo.go:6: import "github.com/x/y"
+`,
+		}, {
+			dep: "@com_github_x_y//z",
+			want: `//foo:go_default_library depends on @com_github_x_y//z because of:
+  foo/foo_linux.go:3: import "github.com/x/y/z" (linux_amd64)
+`,
+		}, {
+			dep: "//lib:go_default_library",
+			want: `//foo:go_default_library depends on //lib:go_default_library because of:
+  foo/bar.go:3: import "example.com/repo/lib"
+`,
+		},
+	} {
+		dep, err := parseDepLabel(tc.dep, pkg.Rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edges, err := findImportEdges(r, pkg, []packages.Target{pkg.Library}, dep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		printImportEdges(&buf, "//foo:go_default_library", tc.dep, edges)
+		if got := buf.String(); got != tc.want {
+			t.Errorf("for %s, got:\n%s\nwant:\n%s", tc.dep, got, tc.want)
+		}
+	}
+}
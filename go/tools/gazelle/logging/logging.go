@@ -0,0 +1,341 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging reports errors, warnings, and other messages from Gazelle.
+//
+// Messages are written either as text, through the standard log package, or
+// as JSON objects, one per line, which CI systems can collect. Each message
+// has a level, and messages with levels above the current verbosity are
+// discarded. Messages about specific files also have a kind and a path, so
+// that they can be grouped and attributed.
+//
+// Logging functions may be called concurrently.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"go/scanner"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/formats"
+)
+
+// Level indicates the severity of a message.
+type Level int
+
+const (
+	// ErrorLevel is used for problems that prevent a build file from being
+	// generated or written.
+	ErrorLevel Level = iota
+
+	// WarningLevel is used for problems with individual files that are
+	// skipped. This is the default verbosity.
+	WarningLevel
+
+	// InfoLevel is used for progress and timing information.
+	InfoLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case ErrorLevel:
+		return "error"
+	case WarningLevel:
+		return "warning"
+	case InfoLevel:
+		return "info"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// MarshalText encodes the level as its name in JSON output.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Kind identifies the type of problem a message is about. It is empty for
+// messages that don't fit a more specific kind.
+type Kind string
+
+const (
+	// IOError is used when a file or directory can't be read.
+	IOError Kind = "io_error"
+
+	// PathTooLong is used when a path is too long for the operating system.
+	PathTooLong Kind = "path_too_long"
+
+	// DepthLimit is used when a directory is skipped because it is nested
+	// too deeply.
+	DepthLimit Kind = "depth_limit"
+
+	// RepeatedDirectory is used when a directory is skipped because it
+	// appears to be part of a pathological tree, with the same directory
+	// name nested many times.
+	RepeatedDirectory Kind = "repeated_directory"
+
+	// ParseError is used when a Go file or build file can't be parsed.
+	ParseError Kind = "parse_error"
+
+	// MultipleBuildFiles is used when a directory has more than one build file.
+	MultipleBuildFiles Kind = "multiple_build_files"
+
+	// MultiplePackages is used when a directory has Go files from more than
+	// one package, and none of them matches the directory name.
+	MultiplePackages Kind = "multiple_packages"
+
+	// UnsupportedExtension is used for files that "go build" would use, but
+	// which can't be built with Bazel yet.
+	UnsupportedExtension Kind = "unsupported_extension"
+
+	// UnresolvedImport is used when an import path can't be resolved to a
+	// label.
+	UnresolvedImport Kind = "unresolved_import"
+
+	// InvalidDirective is used when a "# gazelle:" directive in a build file
+	// can't be parsed.
+	InvalidDirective Kind = "invalid_directive"
+
+	// InvalidEmbed is used when a "//go:embed" pattern can't be matched
+	// against files.
+	InvalidEmbed Kind = "invalid_embed"
+
+	// ForbiddenImport is used when a package imports a package that the
+	// import policy forbids it from importing.
+	ForbiddenImport Kind = "forbidden_import"
+
+	// UnlockedImport is used when a package imports an external package
+	// that isn't listed in the lock file in its directory.
+	UnlockedImport Kind = "unlocked_import"
+
+	// MixedProtoPackage is used when a directory has .proto files and Go
+	// sources other than .pb.go files, so a go_proto_library can't be
+	// generated for it.
+	MixedProtoPackage Kind = "mixed_proto_package"
+
+	// UnsupportedGoVersion is used when a target needs a newer version of Go
+	// than the configured SDK version.
+	UnsupportedGoVersion Kind = "unsupported_go_version"
+
+	// ConflictingImportPath is used when a library in a build file owned by
+	// another tool claims an import path that another library also claims.
+	ConflictingImportPath Kind = "conflicting_import_path"
+)
+
+// Format is the way messages are written.
+type Format int
+
+const (
+	// TextFormat writes each message as a line of text using the standard
+	// log package, so the log prefix and flags apply.
+	TextFormat Format = iota
+
+	// JSONFormat writes each message as a JSON-encoded formats.Diagnostic on
+	// its own line.
+	JSONFormat
+)
+
+// FormatFromString converts a string into a Format.
+func FormatFromString(s string) (Format, error) {
+	switch s {
+	case "text":
+		return TextFormat, nil
+	case "json":
+		return JSONFormat, nil
+	default:
+		return 0, fmt.Errorf("unrecognized log format: %q", s)
+	}
+}
+
+// Entry is a message to be written. In JSON format, it is written as a
+// formats.Diagnostic.
+type Entry struct {
+	Level   Level
+	Kind    Kind
+	Path    string
+	Message string
+}
+
+// A FileError is an error about a specific file. When it is logged, its kind
+// and path are recorded.
+type FileError struct {
+	Kind Kind
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+var (
+	mu        sync.Mutex
+	verbosity = WarningLevel
+	logFormat = TextFormat
+	out       io.Writer
+
+	// counts is the number of errors and warnings reported, by level and
+	// kind, including those that weren't written.
+	counts = make(map[Level]map[Kind]int)
+)
+
+// SetVerbosity sets the highest level of messages that are written.
+func SetVerbosity(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	verbosity = l
+}
+
+// Enabled returns whether messages at level l are written.
+func Enabled(l Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return l <= verbosity
+}
+
+// SetFormat sets the format messages are written in.
+func SetFormat(f Format) {
+	mu.Lock()
+	defer mu.Unlock()
+	logFormat = f
+}
+
+// SetOutput sets the destination for JSON messages. If w is nil, messages
+// are written to os.Stderr. Text messages are written to the output of the
+// standard log package.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// Counts returns the number of messages at level l reported so far, keyed
+// by kind. Messages are counted even if they weren't written because of the
+// verbosity. Only errors and warnings are counted.
+func Counts(l Level) map[Kind]int {
+	mu.Lock()
+	defer mu.Unlock()
+	c := make(map[Kind]int)
+	for kind, n := range counts[l] {
+		c[kind] = n
+	}
+	return c
+}
+
+// ResetCounts discards the counts returned by Counts.
+func ResetCounts() {
+	mu.Lock()
+	defer mu.Unlock()
+	counts = make(map[Level]map[Kind]int)
+}
+
+// Errorf logs an error about the file at path.
+func Errorf(kind Kind, path, format string, args ...interface{}) {
+	write(Entry{ErrorLevel, kind, path, fmt.Sprintf(format, args...)})
+}
+
+// Warningf logs a warning about the file at path.
+func Warningf(kind Kind, path, format string, args ...interface{}) {
+	write(Entry{WarningLevel, kind, path, fmt.Sprintf(format, args...)})
+}
+
+// Infof logs an informational message.
+func Infof(format string, args ...interface{}) {
+	write(Entry{Level: InfoLevel, Message: fmt.Sprintf(format, args...)})
+}
+
+// Error logs err as an error. The kind and path of the message are derived
+// from the type of err.
+func Error(err error) {
+	kind, path := classify(err)
+	write(Entry{ErrorLevel, kind, path, err.Error()})
+}
+
+// Warning logs err as a warning. The kind and path of the message are derived
+// from the type of err.
+func Warning(err error) {
+	kind, path := classify(err)
+	write(Entry{WarningLevel, kind, path, err.Error()})
+}
+
+// Fatal logs err as an error, then exits.
+func Fatal(err error) {
+	Error(err)
+	os.Exit(1)
+}
+
+func classify(err error) (Kind, string) {
+	switch err := err.(type) {
+	case *FileError:
+		return err.Kind, err.Path
+	case *os.PathError:
+		if err.Err == syscall.ENAMETOOLONG {
+			return PathTooLong, err.Path
+		}
+		return IOError, err.Path
+	case scanner.ErrorList:
+		if len(err) > 0 {
+			return ParseError, err[0].Pos.Filename
+		}
+		return ParseError, ""
+	case *scanner.Error:
+		return ParseError, err.Pos.Filename
+	case *build.MultiplePackageError:
+		return MultiplePackages, err.Dir
+	default:
+		return "", ""
+	}
+}
+
+func write(e Entry) {
+	mu.Lock()
+	defer mu.Unlock()
+	if e.Level <= WarningLevel {
+		if counts[e.Level] == nil {
+			counts[e.Level] = make(map[Kind]int)
+		}
+		counts[e.Level][e.Kind]++
+	}
+	if e.Level > verbosity {
+		return
+	}
+	if logFormat == TextFormat {
+		log.Print(e.Message)
+		return
+	}
+	data, err := json.Marshal(formats.Diagnostic{
+		Version: formats.DiagnosticVersion,
+		Level:   e.Level.String(),
+		Kind:    string(e.Kind),
+		Path:    e.Path,
+		Message: e.Message,
+	})
+	if err != nil {
+		// Entries only contain strings, so this shouldn't happen.
+		log.Print(e.Message)
+		return
+	}
+	w := out
+	if w == nil {
+		w = os.Stderr
+	}
+	w.Write(append(data, '\n'))
+}
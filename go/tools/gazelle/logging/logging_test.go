@@ -0,0 +1,132 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"go/build"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/formats"
+)
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	SetFormat(JSONFormat)
+	SetOutput(&buf)
+	defer func() {
+		SetFormat(TextFormat)
+		SetOutput(nil)
+		SetVerbosity(WarningLevel)
+	}()
+	SetVerbosity(WarningLevel)
+
+	Errorf(MultipleBuildFiles, "a", "in directory a, multiple Bazel files are present")
+	Warning(&FileError{Kind: UnsupportedExtension, Path: "a/foo.m", Err: errors.New("file extension not yet supported")})
+	Warning(&os.PathError{Op: "open", Path: "a/b", Err: os.ErrNotExist})
+	Error(&os.PathError{Op: "open", Path: "a/long", Err: syscall.ENAMETOOLONG})
+	Error(&build.MultiplePackageError{Dir: "c", Packages: []string{"x", "y"}, Files: []string{"x.go", "y.go"}})
+	Warning(errors.New("other"))
+	Infof("not written")
+
+	var got []Entry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e formats.Diagnostic
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("could not parse %q: %v", line, err)
+		}
+		if e.Version != formats.DiagnosticVersion {
+			t.Errorf("%q: got version %d; want %d", line, e.Version, formats.DiagnosticVersion)
+		}
+		got = append(got, Entry{Kind: Kind(e.Kind), Path: e.Path, Message: e.Level})
+	}
+	want := []Entry{
+		{Kind: MultipleBuildFiles, Path: "a", Message: "error"},
+		{Kind: UnsupportedExtension, Path: "a/foo.m", Message: "warning"},
+		{Kind: IOError, Path: "a/b", Message: "warning"},
+		{Kind: PathTooLong, Path: "a/long", Message: "error"},
+		{Kind: MultiplePackages, Path: "c", Message: "error"},
+		{Message: "warning"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestTextVerbosity(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+		SetVerbosity(WarningLevel)
+	}()
+
+	for _, tc := range []struct {
+		level Level
+		want  string
+	}{
+		{ErrorLevel, "e\n"},
+		{WarningLevel, "e\nw\n"},
+		{InfoLevel, "e\nw\ni\n"},
+	} {
+		buf.Reset()
+		SetVerbosity(tc.level)
+		Errorf("", "", "e")
+		Warningf("", "", "w")
+		Infof("i")
+		if got := buf.String(); got != tc.want {
+			t.Errorf("at level %v: got %q; want %q", tc.level, got, tc.want)
+		}
+	}
+}
+
+func TestCounts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		SetVerbosity(WarningLevel)
+		ResetCounts()
+	}()
+	ResetCounts()
+	SetVerbosity(ErrorLevel)
+
+	Errorf(ParseError, "a.go", "e")
+	Error(&FileError{Kind: ParseError, Path: "b.go", Err: errors.New("e")})
+	Warningf(IOError, "c", "w")
+	Warning(errors.New("w"))
+	Infof("i")
+
+	if got, want := Counts(ErrorLevel), map[Kind]int{ParseError: 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors %v; want %v", got, want)
+	}
+	if got, want := Counts(WarningLevel), map[Kind]int{IOError: 1, "": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got warnings %v; want %v", got, want)
+	}
+	if got := Counts(InfoLevel); len(got) != 0 {
+		t.Errorf("got info counts %v; want none", got)
+	}
+}
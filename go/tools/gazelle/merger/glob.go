@@ -0,0 +1,225 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+// keepGlob returns whether the old value of a mergeable attribute, written
+// with glob, should be kept instead of being merged with the generated
+// value. This depends on c.GlobMode. In CompareGlobMode, the glob is
+// expanded in dir, and it's kept if it matches exactly the files in gen.
+func keepGlob(c *config.Config, dir string, gen, old bf.Expr) bool {
+	g, ok := parseGlob(old)
+	if !ok {
+		return false
+	}
+	switch c.GlobMode {
+	case config.KeepGlobMode:
+		return true
+	case config.CompareGlobMode:
+		want, ok := stringList(gen)
+		if !ok {
+			// Generated lists with select expressions can't be compared.
+			return false
+		}
+		got, err := g.expand(c, dir)
+		if err != nil {
+			return false
+		}
+		return sameStrings(got, want)
+	default:
+		return false
+	}
+}
+
+// expandGlobs returns the set of files matched by the calls to glob in
+// globs. It returns false if any glob can't be parsed or expanded.
+func expandGlobs(c *config.Config, dir string, globs []bf.Expr) (map[string]bool, bool) {
+	matched := make(map[string]bool)
+	for _, e := range globs {
+		g, ok := parseGlob(e)
+		if !ok {
+			return nil, false
+		}
+		files, err := g.expand(c, dir)
+		if err != nil {
+			return nil, false
+		}
+		for _, f := range files {
+			matched[f] = true
+		}
+	}
+	return matched, true
+}
+
+// glob holds the arguments of a call to glob.
+type glob struct {
+	patterns, excludes []string
+}
+
+// parseGlob returns the arguments of e if it's a call to glob with literal
+// string lists as arguments.
+func parseGlob(e bf.Expr) (glob, bool) {
+	call, ok := e.(*bf.CallExpr)
+	if !ok || kind(call) != "glob" || len(call.List) == 0 {
+		return glob{}, false
+	}
+	var g glob
+	for i, arg := range call.List {
+		key := ""
+		if b, ok := arg.(*bf.BinaryExpr); ok && b.Op == "=" {
+			l, ok := b.X.(*bf.LiteralExpr)
+			if !ok {
+				return glob{}, false
+			}
+			key = l.Token
+			arg = b.Y
+		} else if i == 0 {
+			key = "include"
+		} else if i == 1 {
+			key = "exclude"
+		}
+		switch key {
+		case "include", "exclude":
+			strs, ok := stringList(arg)
+			if !ok {
+				return glob{}, false
+			}
+			if key == "include" {
+				g.patterns = strs
+			} else {
+				g.excludes = strs
+			}
+		case "exclude_directories":
+			// Directories are never matched anyway, since only files can be
+			// sources.
+		default:
+			return glob{}, false
+		}
+	}
+	return g, true
+}
+
+// expand returns the slash-separated paths, relative to dir, of files
+// matched by g. Like Bazel, it doesn't descend into subdirectories that
+// contain build files, since they are separate packages.
+func (g glob) expand(c *config.Config, dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if rel != "." && hasBuildFile(c, p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if matchAny(g.patterns, rel) && !matchAny(g.excludes, rel) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func hasBuildFile(c *config.Config, dir string) bool {
+	for _, base := range c.ValidBuildFileNames {
+		if st, err := os.Stat(filepath.Join(dir, base)); err == nil && !st.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if matchGlob(strings.Split(p, "/"), strings.Split(name, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob returns whether the path segments in name are matched by the
+// pattern segments in pat. A "**" segment matches any number of segments.
+// Other segments are matched with path.Match.
+func matchGlob(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlob(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// stringList returns the values of e if it's a list of string literals.
+func stringList(e bf.Expr) ([]string, bool) {
+	l, ok := e.(*bf.ListExpr)
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, 0, len(l.List))
+	for _, elem := range l.List {
+		s, ok := elem.(*bf.StringExpr)
+		if !ok {
+			return nil, false
+		}
+		strs = append(strs, s.Value)
+	}
+	return strs, true
+}
+
+// sameStrings returns whether a and b contain the same set of strings.
+func sameStrings(a, b []string) bool {
+	aset := make(map[string]bool)
+	for _, s := range a {
+		aset[s] = true
+	}
+	bset := make(map[string]bool)
+	for _, s := range b {
+		if !aset[s] {
+			return false
+		}
+		bset[s] = true
+	}
+	return len(aset) == len(bset)
+}
@@ -0,0 +1,227 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.go", "a.go", true},
+		{"*.go", "sub/a.go", false},
+		{"**/*.go", "a.go", true},
+		{"**/*.go", "sub/deep/a.go", true},
+		{"sub/**", "sub/deep/a.go", true},
+		{"sub/**", "other/a.go", false},
+		{"a?.go", "ab.go", true},
+		{"*_test.go", "a.go", false},
+	} {
+		got := matchGlob(strings.Split(tc.pattern, "/"), strings.Split(tc.name, "/"))
+		if got != tc.want {
+			t.Errorf("matchGlob(%q, %q) = %v; want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMergeGlobMode(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "glob_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.go", "b.go", "a_test.go", "sub/BUILD", "sub/c.go"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const old = `
+go_library(
+    name = "go_default_library",
+    srcs = glob(
+        ["**/*.go"],
+        exclude = ["*_test.go"],
+    ),
+)
+`
+	const kept = `go_library(
+    name = "go_default_library",
+    srcs = glob(
+        ["**/*.go"],
+        exclude = ["*_test.go"],
+    ),
+)
+`
+	for _, tc := range []struct {
+		desc string
+		mode config.GlobMode
+		srcs string
+		want string
+	}{
+		{
+			desc: "replace",
+			mode: config.ReplaceGlobMode,
+			srcs: `["a.go", "b.go"]`,
+			want: `go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+    ],
+)
+`,
+		}, {
+			desc: "keep",
+			mode: config.KeepGlobMode,
+			srcs: `["a.go"]`,
+			want: kept,
+		}, {
+			desc: "compare same",
+			mode: config.CompareGlobMode,
+			srcs: `["b.go", "a.go"]`,
+			want: kept,
+		}, {
+			desc: "compare different",
+			mode: config.CompareGlobMode,
+			srcs: `["a.go"]`,
+			want: `go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+)
+`,
+		},
+	} {
+		oldFile, err := bf.Parse(filepath.Join(dir, "BUILD"), []byte(old))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gen := "go_library(\n    name = \"go_default_library\",\n    srcs = " + tc.srcs + ",\n)\n"
+		genFile, err := bf.Parse(filepath.Join(dir, "BUILD.bazel"), []byte(gen))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &config.Config{
+			ValidBuildFileNames: config.DefaultValidBuildFileNames,
+			GlobMode:            tc.mode,
+		}
+		mergedFile := MergeWithExisting(c, genFile, oldFile)
+		if got := string(bf.Format(mergedFile)); got != tc.want {
+			t.Errorf("%s: got %s; want %s", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestMergeExprComposite(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "glob_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.go", "b.go", "gen.go"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listOf := func(values ...string) *bf.ListExpr {
+		l := &bf.ListExpr{}
+		for _, v := range values {
+			l.List = append(l.List, &bf.StringExpr{Value: v})
+		}
+		return l
+	}
+	globCall := &bf.CallExpr{
+		X:    &bf.LiteralExpr{Token: "glob"},
+		List: []bf.Expr{listOf("[ab].go")},
+	}
+	old := &bf.BinaryExpr{X: listOf("gen.go"), Op: "+", Y: globCall}
+	gen := listOf("a.go", "b.go", "gen.go", "new.go")
+
+	for _, tc := range []struct {
+		desc      string
+		mode      config.GlobMode
+		gen       *bf.ListExpr
+		wantList  []string
+		wantGlobs int
+	}{
+		{
+			desc:      "keep",
+			mode:      config.KeepGlobMode,
+			wantList:  []string{"gen.go", "new.go"},
+			wantGlobs: 1,
+		}, {
+			desc:      "compare same",
+			mode:      config.CompareGlobMode,
+			wantList:  []string{"gen.go", "new.go"},
+			wantGlobs: 1,
+		}, {
+			desc:     "compare different",
+			mode:     config.CompareGlobMode,
+			gen:      listOf("a.go", "gen.go"),
+			wantList: []string{"a.go", "gen.go"},
+		}, {
+			desc:     "replace",
+			mode:     config.ReplaceGlobMode,
+			wantList: []string{"a.go", "b.go", "gen.go", "new.go"},
+		},
+	} {
+		c := &config.Config{
+			ValidBuildFileNames: config.DefaultValidBuildFileNames,
+			GlobMode:            tc.mode,
+		}
+		genExpr := gen
+		if tc.gen != nil {
+			genExpr = tc.gen
+		}
+		merged, err := mergeExpr(c, dir, genExpr, old, false, false)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		parts, err := parseExprParts(merged)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		var gotList []string
+		if parts.list != nil {
+			for _, e := range parts.list.List {
+				gotList = append(gotList, stringValue(e))
+			}
+		}
+		if !sameStrings(gotList, tc.wantList) {
+			t.Errorf("%s: got list %q; want %q", tc.desc, gotList, tc.wantList)
+		}
+		if len(parts.globs) != tc.wantGlobs {
+			t.Errorf("%s: got %d globs; want %d", tc.desc, len(parts.globs), tc.wantGlobs)
+		}
+	}
+}
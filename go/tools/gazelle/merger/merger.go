@@ -19,25 +19,35 @@ package merger
 import (
 	"fmt"
 	"log"
+	"path/filepath"
 	"sort"
 	"strings"
 
 	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/schema"
 )
 
 const (
 	gazelleIgnore = "# gazelle:ignore" // marker in a BUILD file to ignore it.
 	keep          = "# keep"           // marker in srcs or deps to tell gazelle to preserve.
-)
 
-var (
-	mergeableFields = map[string]bool{
-		"srcs":      true,
-		"deps":      true,
-		"library":   true,
-		"copts":     true,
-		"clinkopts": true,
-	}
+	// AnnotationPrefix starts a trailing comment on a generated rule that
+	// identifies the version and flags of the Gazelle run that generated it.
+	// When rules are merged, annotations on the existing rule are replaced by
+	// those on the generated rule.
+	AnnotationPrefix = "# gazelle:generated"
+
+	// GoVersionPrefix starts a trailing comment on a generated rule that
+	// notes the Go version its sources require, like
+	// "# gazelle:requires go1.9". It's merged the same way as annotations.
+	GoVersionPrefix = "# gazelle:requires"
+
+	// PlatformSummaryPrefix starts a trailing comment on a generated rule
+	// that summarizes its platform-specific srcs and deps, like
+	// "# gazelle:platforms srcs 3 platforms x 12 files". It's merged the
+	// same way as annotations.
+	PlatformSummaryPrefix = "# gazelle:platforms"
 )
 
 // MergeWithExisting merges "genFile" with "oldFile" and returns the
@@ -45,17 +55,26 @@ var (
 //
 // "genFile" is a file generated by Gazelle. It must not be nil.
 // "oldFile" is the existing file. It may be nil if no file was found.
+// Mergeable attributes written with glob in "oldFile" are merged according
+// to c.GlobMode. Other mergeable attributes are merged according to
+// c.MergeStrategies.
+//
+// If c.OwnedRulesOnly is set, generated rules are only merged with existing
+// rules Gazelle owns. See dropUnowned.
 //
 // If "oldFile" is nil, "genFile" will be returned. If "oldFile" contains
 // a "# gazelle:ignore" comment, nil will be returned. If an error occurs,
 // it will be logged, and nil will be returned.
-func MergeWithExisting(genFile, oldFile *bf.File) *bf.File {
+func MergeWithExisting(c *config.Config, genFile, oldFile *bf.File) *bf.File {
 	if oldFile == nil {
 		return genFile
 	}
 	if shouldIgnore(oldFile) {
 		return nil
 	}
+	if c.OwnedRulesOnly {
+		genFile = dropUnowned(genFile, oldFile)
+	}
 
 	mergedFile := *oldFile
 	mergedFile.Stmt = make([]bf.Expr, len(oldFile.Stmt))
@@ -79,7 +98,7 @@ func MergeWithExisting(genFile, oldFile *bf.File) *bf.File {
 		if kind(oldRule) == "load" {
 			mergedRule = mergeLoad(genRule, oldRule, oldFile)
 		} else {
-			mergedRule = mergeRule(genRule, oldRule)
+			mergedRule = mergeRule(c, filepath.Dir(oldFile.Path), genRule, oldRule)
 		}
 		mergedFile.Stmt[i] = mergedRule
 	}
@@ -90,36 +109,51 @@ func MergeWithExisting(genFile, oldFile *bf.File) *bf.File {
 
 // merge combines information from gen and old and returns an updated rule.
 // Both rules must be non-nil and must have the same kind and same name.
-func mergeRule(gen, old *bf.CallExpr) *bf.CallExpr {
+// dir is the directory containing the old rule. It's used to expand globs.
+//
+// Only mergeable and replaceable attributes are changed. Everything else in the old rule,
+// including unnamed arguments, other attributes, and their comments, is
+// kept in its original position. Attributes that are only present in the
+// generated rule are inserted before the next attribute that follows them
+// in the generated rule, so new attributes appear in a sensible place
+// without reordering existing ones. A deprecated library attribute in the
+// old rule is migrated to embed first. See migrateLibrary.
+func mergeRule(c *config.Config, dir string, gen, old *bf.CallExpr) *bf.CallExpr {
+	old = migrateLibrary(gen, old)
 	genRule := bf.Rule{Call: gen}
-	oldRule := bf.Rule{Call: old}
 	merged := *old
 	merged.List = nil
-	mergedRule := bf.Rule{Call: &merged}
+	merged.Comments = mergeAnnotations(gen, old)
 
-	// Copy unnamed arguments from the old rule without merging. The only rule
-	// generated with unnamed arguments is go_prefix, which we currently
-	// leave in place.
-	// TODO: maybe gazelle should allow the prefix to be changed.
+	oldKeys := make(map[string]bool)
 	for _, a := range old.List {
-		if b, ok := a.(*bf.BinaryExpr); ok && b.Op == "=" {
-			break
+		k := attrKey(a)
+		if k == "" {
+			merged.List = append(merged.List, a)
+			continue
 		}
-		merged.List = append(merged.List, a)
-	}
-
-	// Merge attributes from the old rule. Preserve comments on old attributes.
-	// Assume generated attributes have no comments.
-	for _, k := range oldRule.AttrKeys() {
-		oldAttr := oldRule.AttrDefn(k)
-		if !mergeableFields[k] {
-			merged.List = append(merged.List, oldAttr)
+		oldKeys[k] = true
+		oldAttr := a.(*bf.BinaryExpr)
+		if !schema.IsMergeable(kind(old), k) {
+			if genAttr := genRule.AttrDefn(k); genAttr != nil && schema.IsReplaceable(kind(old), k) &&
+				!ShouldKeep(oldAttr) && !ShouldKeep(oldAttr.Y) {
+				mergedAttr := *oldAttr
+				mergedAttr.Y = genAttr.Y
+				merged.List = append(merged.List, &mergedAttr)
+			} else {
+				merged.List = append(merged.List, oldAttr)
+			}
 			continue
 		}
 
 		oldExpr := oldAttr.Y
 		genExpr := genRule.Attr(k)
-		mergedExpr, err := mergeExpr(genExpr, oldExpr)
+		strategy := c.MergeStrategies[k]
+		if strategy == config.KeepStrategy || keepGlob(c, dir, genExpr, oldExpr) {
+			merged.List = append(merged.List, oldAttr)
+			continue
+		}
+		mergedExpr, err := mergeExpr(c, dir, genExpr, oldExpr, strategy == config.UnionStrategy, schema.IsOrdered(kind(old), k))
 		if err != nil {
 			// TODO: add a verbose mode and log errors like this.
 			mergedExpr = genExpr
@@ -131,126 +165,489 @@ func mergeRule(gen, old *bf.CallExpr) *bf.CallExpr {
 		}
 	}
 
-	// Merge attributes from genRule that we haven't processed already.
-	for _, k := range genRule.AttrKeys() {
-		if mergedRule.Attr(k) == nil {
-			mergedRule.SetAttr(k, genRule.Attr(k))
+	// Insert attributes from gen that we haven't processed already. Walk
+	// backward, so each new attribute can be placed before the attribute
+	// that follows it in gen.
+	next := ""
+	for i := len(gen.List) - 1; i >= 0; i-- {
+		k := attrKey(gen.List[i])
+		if k == "" {
+			continue
+		}
+		if oldKeys[k] {
+			next = k
+			continue
+		}
+		pos := len(merged.List)
+		if next != "" {
+			for j, a := range merged.List {
+				if attrKey(a) == next {
+					pos = j
+					break
+				}
+			}
 		}
+		merged.List = append(merged.List, nil)
+		copy(merged.List[pos+1:], merged.List[pos:])
+		merged.List[pos] = gen.List[i]
+		oldKeys[k] = true
+		next = k
 	}
 
 	return &merged
 }
 
+// attrKey returns the name of the attribute set by the rule argument e, or
+// "" if e is an unnamed argument.
+func attrKey(e bf.Expr) string {
+	b, ok := e.(*bf.BinaryExpr)
+	if !ok || b.Op != "=" {
+		return ""
+	}
+	l, ok := b.X.(*bf.LiteralExpr)
+	if !ok {
+		return ""
+	}
+	return l.Token
+}
+
+// migrateLibrary returns a copy of old with its library attribute replaced
+// by an equivalent embed attribute, if gen has an embed attribute and old
+// doesn't. The attribute keeps its position and comments. old is returned
+// unchanged if there's nothing to migrate or the library attribute isn't a
+// label or a select of labels.
+func migrateLibrary(gen, old *bf.CallExpr) *bf.CallExpr {
+	if attrIndex(gen, "embed") < 0 || attrIndex(old, "embed") >= 0 {
+		return old
+	}
+	i := attrIndex(old, "library")
+	if i < 0 {
+		return old
+	}
+	library := old.List[i].(*bf.BinaryExpr)
+	embed, ok := libraryToEmbed(library.Y)
+	if !ok {
+		return old
+	}
+	attr := *library
+	attr.X = &bf.LiteralExpr{Token: "embed"}
+	attr.Y = embed
+	migrated := *old
+	migrated.List = append([]bf.Expr(nil), old.List...)
+	migrated.List[i] = &attr
+	return &migrated
+}
+
+// libraryToEmbed converts the value of a library attribute to the value of an
+// embed attribute. A label becomes a list containing it, and in a select,
+// None becomes an empty list. false is returned for other expressions.
+func libraryToEmbed(e bf.Expr) (bf.Expr, bool) {
+	switch e := e.(type) {
+	case *bf.StringExpr:
+		return &bf.ListExpr{List: []bf.Expr{e}}, true
+	case *bf.LiteralExpr:
+		if e.Token == "None" {
+			return &bf.ListExpr{}, true
+		}
+	case *bf.CallExpr:
+		if kind(e) != "select" || len(e.List) != 1 {
+			return nil, false
+		}
+		dict, ok := e.List[0].(*bf.DictExpr)
+		if !ok {
+			return nil, false
+		}
+		embedDict := *dict
+		embedDict.List = make([]bf.Expr, len(dict.List))
+		for i, c := range dict.List {
+			kv, ok := c.(*bf.KeyValueExpr)
+			if !ok {
+				return nil, false
+			}
+			value, ok := libraryToEmbed(kv.Value)
+			if !ok {
+				return nil, false
+			}
+			if _, isSelect := value.(*bf.CallExpr); isSelect {
+				return nil, false
+			}
+			embedKV := *kv
+			embedKV.Value = value
+			embedDict.List[i] = &embedKV
+		}
+		call := *e
+		call.List = []bf.Expr{&embedDict}
+		return &call, true
+	}
+	return nil, false
+}
+
+// attrIndex returns the index of the argument of c that sets the attribute
+// key, or -1 if there is none.
+func attrIndex(c *bf.CallExpr, key string) int {
+	for i, a := range c.List {
+		if attrKey(a) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// mergeAnnotations returns a copy of the comments on an old rule with
+// provenance annotations, Go version notes, and platform summaries replaced
+// by those on the generated rule. Other comments are preserved. Annotations
+// written after a rule's closing parenthesis are attached by the parser to
+// its last argument (see trailingComments), so they're removed from there in
+// both rules, and the generated ones are returned with the rule's comments.
+func mergeAnnotations(gen, old *bf.CallExpr) bf.Comments {
+	var annotations []bf.Comment
+	for _, cs := range trailingComments(gen) {
+		for _, c := range cs.Suffix {
+			if isAnnotation(c) {
+				annotations = append(annotations, c)
+			}
+		}
+	}
+	for _, cs := range append(trailingComments(gen)[1:], trailingComments(old)[1:]...) {
+		cs.Suffix = withoutAnnotations(cs.Suffix)
+	}
+	merged := old.Comments
+	merged.Suffix = append(withoutAnnotations(old.Comments.Suffix), annotations...)
+	return merged
+}
+
+// withoutAnnotations returns the comments in cs that aren't annotations.
+func withoutAnnotations(cs []bf.Comment) []bf.Comment {
+	var kept []bf.Comment
+	for _, c := range cs {
+		if !isAnnotation(c) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// dropUnowned returns a copy of genFile without rules that have the same
+// name as a rule in oldFile that Gazelle doesn't own, so handwritten rules
+// aren't merged or duplicated. Symbols that were only loaded for the
+// dropped rules are removed from load statements.
+func dropUnowned(genFile, oldFile *bf.File) *bf.File {
+	unowned := make(map[string]bool)
+	for _, s := range oldFile.Stmt {
+		if c, ok := s.(*bf.CallExpr); ok && kind(c) != "load" && name(c) != "" && !isOwned(c) {
+			unowned[name(c)] = true
+		}
+	}
+	if len(unowned) == 0 {
+		return genFile
+	}
+
+	var kept []bf.Expr
+	usedKinds := make(map[string]bool)
+	for _, s := range genFile.Stmt {
+		if c, ok := s.(*bf.CallExpr); ok && kind(c) != "load" {
+			if unowned[name(c)] {
+				continue
+			}
+			usedKinds[kind(c)] = true
+		}
+		kept = append(kept, s)
+	}
+
+	dropped := *genFile
+	dropped.Stmt = nil
+	for _, s := range kept {
+		if c, ok := s.(*bf.CallExpr); ok && kind(c) == "load" && len(c.List) > 0 {
+			load := *c
+			load.List = c.List[:1:1]
+			for _, v := range c.List[1:] {
+				if usedKinds[stringValue(v)] {
+					load.List = append(load.List, v)
+				}
+			}
+			if len(load.List) == 1 {
+				continue
+			}
+			s = &load
+		}
+		dropped.Stmt = append(dropped.Stmt, s)
+	}
+	return &dropped
+}
+
+// isOwned returns whether rule was generated by Gazelle, which is recorded
+// in a trailing comment starting with AnnotationPrefix.
+func isOwned(rule *bf.CallExpr) bool {
+	for _, cs := range trailingComments(rule) {
+		for _, c := range cs.Suffix {
+			if strings.HasPrefix(c.Token, AnnotationPrefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trailingComments returns the comments that may hold a comment written
+// after the closing parenthesis of rule. The parser doesn't attach such a
+// comment to the rule itself. It becomes a suffix comment of the last
+// argument, or of the last element of a list in that argument. The rule's
+// own comments come first, so rules built by Gazelle are handled too.
+func trailingComments(rule *bf.CallExpr) []*bf.Comments {
+	cs := []*bf.Comments{rule.Comment()}
+	if len(rule.List) == 0 {
+		return cs
+	}
+	last := rule.List[len(rule.List)-1]
+	cs = append(cs, last.Comment())
+	if b, ok := last.(*bf.BinaryExpr); ok && b.Op == "=" {
+		last = b.Y
+	}
+	if l, ok := last.(*bf.ListExpr); ok && len(l.List) > 0 {
+		cs = append(cs, l.List[len(l.List)-1].Comment())
+	}
+	return cs
+}
+
+func isAnnotation(c bf.Comment) bool {
+	return strings.HasPrefix(c.Token, AnnotationPrefix) || strings.HasPrefix(c.Token, GoVersionPrefix) || strings.HasPrefix(c.Token, PlatformSummaryPrefix)
+}
+
 // mergeExpr combines information from gen and old and returns an updated
 // expression. The following kinds of expressions are recognized:
 //
-//   * nil
-//   * strings (can only be merged with strings)
-//   * lists of strings
-//   * a call to select with a dict argument. The dict keys must be strings,
+//   - nil
+//   - strings (can only be merged with strings)
+//   - lists of strings
+//   - a call to select with a dict argument. The dict keys must be strings,
 //     and the values must be lists of strings.
-//   * a list of strings combined with a select call using +. The list must
-//     be the left operand.
+//   - any of the above combined with calls to glob using +. There may be at
+//     most one list and one select.
+//
+// Lists and selects are merged separately. Globs in old are kept in
+// KeepGlobMode, and in CompareGlobMode if every file they match in dir is in
+// the generated list, so the merged expression still expands to the
+// generated files. Otherwise, they're replaced by the globs in gen, if any.
+// When globs are kept, files they match are removed from generated lists, so
+// they aren't listed twice. An old expression that is only a glob is handled
+// by keepGlob before mergeExpr is called.
+//
+// If union is true, all elements of old lists are kept. Otherwise, only
+// elements that are also in gen lists or that are marked with "# keep"
+// comments are kept.
 //
 // An error is returned if the expressions can't be merged, for example
 // because they are not in one of the above formats.
-func mergeExpr(gen, old bf.Expr) (bf.Expr, error) {
+func mergeExpr(c *config.Config, dir string, gen, old bf.Expr, union, ordered bool) (bf.Expr, error) {
 	if _, ok := gen.(*bf.StringExpr); ok {
-		if shouldKeep(old) {
+		if ShouldKeep(old) {
 			return old, nil
 		}
 		return gen, nil
 	}
 
-	genList, genDict, err := exprListAndDict(gen)
+	genParts, err := parseExprParts(gen)
 	if err != nil {
 		return nil, err
 	}
-	oldList, oldDict, err := exprListAndDict(old)
+	oldParts, err := parseExprParts(old)
 	if err != nil {
 		return nil, err
 	}
 
-	mergedList := mergeList(genList, oldList)
-	mergedDict, err := mergeDict(genDict, oldDict)
+	globs := genParts.globs
+	if len(oldParts.globs) > 0 && c.GlobMode != config.ReplaceGlobMode {
+		matched, ok := expandGlobs(c, dir, oldParts.globs)
+		if c.GlobMode == config.KeepGlobMode || ok && containsStrings(genParts.list, matched) {
+			globs = oldParts.globs
+			if ok {
+				genParts.list = removeStrings(genParts.list, matched)
+				for i, d := range genParts.dicts {
+					genParts.dicts[i] = removeDictStrings(d, matched)
+				}
+			}
+		}
+	}
+
+	mergedList := mergeList(genParts.list, oldParts.list, union, ordered)
+	mergedDicts, err := mergeDicts(genParts.dicts, oldParts.dicts, union, ordered)
 	if err != nil {
 		return nil, err
 	}
 
-	var mergedSelect bf.Expr
-	if mergedDict != nil {
-		mergedSelect = &bf.CallExpr{
+	var operands []bf.Expr
+	if mergedList != nil {
+		operands = append(operands, mergedList)
+	}
+	operands = append(operands, globs...)
+	for _, d := range mergedDicts {
+		operands = append(operands, &bf.CallExpr{
 			X:    &bf.LiteralExpr{Token: "select"},
-			List: []bf.Expr{mergedDict},
-		}
+			List: []bf.Expr{d},
+		})
 	}
-
-	if mergedList == nil {
-		return mergedSelect, nil
+	if len(operands) == 0 {
+		return nil, nil
 	}
-	if mergedSelect == nil {
-		return mergedList, nil
+	if len(operands) > 1 && mergedList != nil {
+		mergedList.ForceMultiLine = true
 	}
-	mergedList.ForceMultiLine = true
-	return &bf.BinaryExpr{
-		X:  mergedList,
-		Op: "+",
-		Y:  mergedSelect,
-	}, nil
+	merged := operands[0]
+	for _, e := range operands[1:] {
+		merged = &bf.BinaryExpr{X: merged, Op: "+", Y: e}
+	}
+	return merged, nil
 }
 
-// exprListAndDict matches an expression and attempts to extract either a list
-// of expressions, a call to select with a dictionary, or both.
-// An error is returned if the expression could not be matched.
-func exprListAndDict(expr bf.Expr) (*bf.ListExpr, *bf.DictExpr, error) {
+// exprParts holds the components of an attribute value, which may be a list,
+// calls to glob, and calls to select, combined with +. Gazelle generates a
+// select for each tier of platform-specific values, like OS and platform.
+type exprParts struct {
+	list  *bf.ListExpr
+	globs []bf.Expr
+	dicts []*bf.DictExpr
+}
+
+// parseExprParts splits expr into a list, globs, and the dict arguments of
+// select calls. Components may appear in any order. An error is returned if
+// expr contains anything else, or if it contains more than one list.
+func parseExprParts(expr bf.Expr) (exprParts, error) {
+	var parts exprParts
 	if expr == nil {
-		return nil, nil, nil
+		return parts, nil
 	}
-	switch expr := expr.(type) {
-	case *bf.ListExpr:
-		return expr, nil, nil
-	case *bf.CallExpr:
-		if x, ok := expr.X.(*bf.LiteralExpr); ok && x.Token == "select" && len(expr.List) == 1 {
-			if d, ok := expr.List[0].(*bf.DictExpr); ok {
-				return nil, d, nil
+	var operands []bf.Expr
+	var flatten func(bf.Expr) error
+	flatten = func(e bf.Expr) error {
+		if b, ok := e.(*bf.BinaryExpr); ok {
+			if b.Op != "+" {
+				return fmt.Errorf("expression could not be matched: unknown operator: %s", b.Op)
 			}
+			if err := flatten(b.X); err != nil {
+				return err
+			}
+			return flatten(b.Y)
 		}
-	case *bf.BinaryExpr:
-		if expr.Op != "+" {
-			return nil, nil, fmt.Errorf("expression could not be matched: unknown operator: %s", expr.Op)
+		operands = append(operands, e)
+		return nil
+	}
+	if err := flatten(expr); err != nil {
+		return exprParts{}, err
+	}
+
+	for _, e := range operands {
+		switch e := e.(type) {
+		case *bf.ListExpr:
+			if parts.list != nil {
+				return exprParts{}, fmt.Errorf("expression could not be matched: more than one list")
+			}
+			parts.list = e
+		case *bf.CallExpr:
+			switch kind(e) {
+			case "glob":
+				parts.globs = append(parts.globs, e)
+			case "select":
+				if len(e.List) != 1 {
+					return exprParts{}, fmt.Errorf("expression could not be matched: select call with %d arguments", len(e.List))
+				}
+				d, ok := e.List[0].(*bf.DictExpr)
+				if !ok {
+					return exprParts{}, fmt.Errorf("expression could not be matched: argument to select not a dict")
+				}
+				parts.dicts = append(parts.dicts, d)
+			default:
+				return exprParts{}, fmt.Errorf("expression could not be matched: unknown call to %s", kind(e))
+			}
+		default:
+			return exprParts{}, fmt.Errorf("expression could not be matched")
 		}
-		l, ok := expr.X.(*bf.ListExpr)
-		if !ok {
-			return nil, nil, fmt.Errorf("expression could not be matched: left operand not a list")
+	}
+	return parts, nil
+}
+
+// removeStrings returns a copy of list without string elements in remove.
+// nil is returned if no elements remain.
+func removeStrings(list *bf.ListExpr, remove map[string]bool) *bf.ListExpr {
+	if list == nil {
+		return nil
+	}
+	var kept []bf.Expr
+	for _, e := range list.List {
+		if !remove[stringValue(e)] {
+			kept = append(kept, e)
 		}
-		call, ok := expr.Y.(*bf.CallExpr)
-		if !ok || len(call.List) != 1 {
-			return nil, nil, fmt.Errorf("expression could not be matched: right operand not a call with one argument")
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	removed := *list
+	removed.List = kept
+	return &removed
+}
+
+// containsStrings returns whether every string in want is an element of list.
+func containsStrings(list *bf.ListExpr, want map[string]bool) bool {
+	have := make(map[string]bool)
+	if list != nil {
+		for _, e := range list.List {
+			have[stringValue(e)] = true
 		}
-		x, ok := call.X.(*bf.LiteralExpr)
-		if !ok || x.Token != "select" {
-			return nil, nil, fmt.Errorf("expression could not be matched: right operand not a call to select")
+	}
+	for s := range want {
+		if !have[s] {
+			return false
 		}
-		d, ok := call.List[0].(*bf.DictExpr)
+	}
+	return true
+}
+
+// removeDictStrings returns a copy of dict with string elements in remove
+// removed from its list values.
+func removeDictStrings(dict *bf.DictExpr, remove map[string]bool) *bf.DictExpr {
+	if dict == nil {
+		return nil
+	}
+	removed := *dict
+	removed.List = make([]bf.Expr, len(dict.List))
+	for i, e := range dict.List {
+		kv, ok := e.(*bf.KeyValueExpr)
 		if !ok {
-			return nil, nil, fmt.Errorf("expression could not be matched: argument to right operand not a dict")
+			removed.List[i] = e
+			continue
+		}
+		l, ok := kv.Value.(*bf.ListExpr)
+		if !ok {
+			removed.List[i] = e
+			continue
 		}
-		return l, d, nil
+		newKV := *kv
+		if newList := removeStrings(l, remove); newList != nil {
+			newKV.Value = newList
+		} else {
+			newKV.Value = &bf.ListExpr{}
+		}
+		removed.List[i] = &newKV
 	}
-	return nil, nil, fmt.Errorf("expression could not be matched")
+	return &removed
 }
 
-func mergeList(gen, old *bf.ListExpr) *bf.ListExpr {
+// mergeList merges a generated list of strings with a list from an existing
+// rule. If ordered is set, see mergeOrderedList.
+func mergeList(gen, old *bf.ListExpr, union, ordered bool) *bf.ListExpr {
 	if old == nil {
 		return gen
 	}
 	if gen == nil {
 		gen = &bf.ListExpr{List: []bf.Expr{}}
 	}
+	if ordered {
+		return mergeOrderedList(gen, old, union)
+	}
 
 	// Build a list of strings from the gen list and keep matching strings
-	// in the old list. This preserves comments. Also keep anything with
-	// a "# keep" comment, whether or not it's in the gen list.
+	// in the old list. This preserves their comments. Also keep anything with
+	// a "# keep" comment, whether or not it's in the gen list, and
+	// everything if union is set.
 	genSet := make(map[string]bool)
 	for _, v := range gen.List {
 		if s := stringValue(v); s != "" {
@@ -262,7 +659,7 @@ func mergeList(gen, old *bf.ListExpr) *bf.ListExpr {
 	kept := make(map[string]bool)
 	for _, v := range old.List {
 		s := stringValue(v)
-		if shouldKeep(v) || genSet[s] {
+		if union || ShouldKeep(v) || genSet[s] {
 			merged = append(merged, v)
 			if s != "" {
 				kept[s] = true
@@ -281,10 +678,138 @@ func mergeList(gen, old *bf.ListExpr) *bf.ListExpr {
 	if len(merged) == 0 {
 		return nil
 	}
-	return &bf.ListExpr{List: merged}
+	return newMergedList(merged, old)
+}
+
+// mergeOrderedList is like mergeList, but the merged list follows the order
+// of gen, since the order of flags like clinkopts is significant. Matching
+// strings from old are still used, so their comments are preserved. Strings
+// kept from old that aren't in gen are placed after the string that
+// preceded them in old, or at the beginning if nothing did.
+func mergeOrderedList(gen, old *bf.ListExpr, union bool) *bf.ListExpr {
+	genSet := make(map[string]bool)
+	for _, v := range gen.List {
+		if s := stringValue(v); s != "" {
+			genSet[s] = true
+		}
+	}
+
+	oldByString := make(map[string]bf.Expr)
+	keptAfter := make(map[string][]bf.Expr)
+	var merged []bf.Expr
+	prev := ""
+	for _, v := range old.List {
+		s := stringValue(v)
+		if genSet[s] {
+			if _, ok := oldByString[s]; !ok {
+				oldByString[s] = v
+			}
+			prev = s
+			continue
+		}
+		if union || ShouldKeep(v) {
+			if prev == "" {
+				merged = append(merged, v)
+			} else {
+				keptAfter[prev] = append(keptAfter[prev], v)
+			}
+		}
+	}
+
+	for _, v := range gen.List {
+		s := stringValue(v)
+		if o, ok := oldByString[s]; ok {
+			// Repeated strings only take the old entry and its comments once.
+			v = o
+			delete(oldByString, s)
+		}
+		merged = append(merged, v)
+		merged = append(merged, keptAfter[s]...)
+		delete(keptAfter, s)
+	}
+
+	if len(merged) == 0 {
+		return nil
+	}
+	return newMergedList(merged, old)
+}
+
+// newMergedList returns a list of merged elements with the comments attached
+// to the old list, including comments before its closing bracket.
+func newMergedList(merged []bf.Expr, old *bf.ListExpr) *bf.ListExpr {
+	return &bf.ListExpr{
+		Comments: old.Comments,
+		List:     merged,
+		End:      bf.End{Comments: old.End.Comments},
+	}
 }
 
-func mergeDict(gen, old *bf.DictExpr) (*bf.DictExpr, error) {
+// mergeDict merges the dict arguments of generated and existing select
+// calls. Cases are merged with mergeList. Comments on the old dict and on
+// its cases, including their keys, are preserved.
+// mergeDicts merges the dicts of generated selects with the dicts of selects
+// in an existing rule. Each generated dict is merged with the first unused
+// old dict that has a case with the same condition, other than the default
+// case. Old dicts that don't match a generated dict are merged with nothing,
+// which keeps only cases with "# keep" comments, and follow the generated
+// ones. Dicts that are empty after merging are dropped.
+func mergeDicts(gen, old []*bf.DictExpr, union, ordered bool) ([]*bf.DictExpr, error) {
+	matched := make([]*bf.DictExpr, len(gen))
+	used := make(map[*bf.DictExpr]bool)
+	for i, g := range gen {
+		for _, o := range old {
+			if !used[o] && dictsShareCase(g, o) {
+				matched[i] = o
+				used[o] = true
+				break
+			}
+		}
+	}
+
+	var merged []*bf.DictExpr
+	add := func(g, o *bf.DictExpr) error {
+		d, err := mergeDict(g, o, union, ordered)
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			merged = append(merged, d)
+		}
+		return nil
+	}
+	for i, g := range gen {
+		if err := add(g, matched[i]); err != nil {
+			return nil, err
+		}
+	}
+	for _, o := range old {
+		if !used[o] {
+			if err := add(nil, o); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return merged, nil
+}
+
+// dictsShareCase returns whether a and b have a case with the same condition,
+// other than "//conditions:default".
+func dictsShareCase(a, b *bf.DictExpr) bool {
+	keys := make(map[string]bool)
+	for _, kv := range a.List {
+		if k, _, err := dictEntryKeyValue(kv); err == nil && k != "//conditions:default" {
+			keys[k] = true
+		}
+	}
+	for _, kv := range b.List {
+		if k, _, err := dictEntryKeyValue(kv); err == nil && keys[k] {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeDict(gen, old *bf.DictExpr, union, ordered bool) (*bf.DictExpr, error) {
 	if old == nil {
 		return gen, nil
 	}
@@ -303,7 +828,7 @@ func mergeDict(gen, old *bf.DictExpr) (*bf.DictExpr, error) {
 		if _, ok := entryMap[k]; ok {
 			return nil, fmt.Errorf("old dict contains more than one case named %q", k)
 		}
-		e := &dictEntry{key: k, oldValue: v}
+		e := &dictEntry{key: k, oldValue: v, old: kv.(*bf.KeyValueExpr)}
 		entries = append(entries, e)
 		entryMap[k] = e
 	}
@@ -325,7 +850,11 @@ func mergeDict(gen, old *bf.DictExpr) (*bf.DictExpr, error) {
 	keys := make([]string, 0, len(entries))
 	haveDefault := false
 	for _, e := range entries {
-		e.mergedValue = mergeList(e.genValue, e.oldValue)
+		// A "# keep" comment on a case keeps everything in it. The formatter
+		// prints one-element lists on one line, so a comment on the element
+		// ends up on the case when the file is parsed again.
+		keepCase := e.old != nil && ShouldKeep(e.old)
+		e.mergedValue = mergeList(e.genValue, e.oldValue, union || keepCase, ordered)
 		if e.key == "//conditions:default" {
 			// Keep the default case, even if it's empty.
 			haveDefault = true
@@ -348,18 +877,32 @@ func mergeDict(gen, old *bf.DictExpr) (*bf.DictExpr, error) {
 	mergedEntries := make([]bf.Expr, len(keys))
 	for i, k := range keys {
 		e := entryMap[k]
+		if e.old != nil {
+			kv := *e.old
+			kv.Value = e.mergedValue
+			mergedEntries[i] = &kv
+			continue
+		}
 		mergedEntries[i] = &bf.KeyValueExpr{
 			Key:   &bf.StringExpr{Value: e.key},
 			Value: e.mergedValue,
 		}
 	}
 
-	return &bf.DictExpr{List: mergedEntries, ForceMultiLine: true}, nil
+	return &bf.DictExpr{
+		Comments:       old.Comments,
+		List:           mergedEntries,
+		End:            bf.End{Comments: old.End.Comments},
+		ForceMultiLine: true,
+	}, nil
 }
 
 type dictEntry struct {
 	key                             string
 	oldValue, genValue, mergedValue *bf.ListExpr
+
+	// old is the case in the old dict, or nil if the case is new.
+	old *bf.KeyValueExpr
 }
 
 func dictEntryKeyValue(e bf.Expr) (string, *bf.ListExpr, error) {
@@ -378,6 +921,9 @@ func dictEntryKeyValue(e bf.Expr) (string, *bf.ListExpr, error) {
 	return k.Value, v, nil
 }
 
+// mergeLoad returns a load statement with the symbols loaded by gen and the
+// symbols loaded by old that are still used in oldfile. Symbols that were
+// already loaded keep their comments.
 func mergeLoad(gen, old *bf.CallExpr, oldfile *bf.File) *bf.CallExpr {
 	vals := make(map[string]bf.Expr)
 	for _, v := range gen.List[1:] {
@@ -385,7 +931,7 @@ func mergeLoad(gen, old *bf.CallExpr, oldfile *bf.File) *bf.CallExpr {
 	}
 	for _, v := range old.List[1:] {
 		rule := stringValue(v)
-		if _, ok := vals[rule]; !ok && ruleUsed(rule, oldfile) {
+		if _, ok := vals[rule]; ok || ruleUsed(rule, oldfile) {
 			vals[rule] = v
 		}
 	}
@@ -421,11 +967,31 @@ func shouldIgnore(oldFile *bf.File) bool {
 	return false
 }
 
-// shouldKeep returns whether an expression from the original file should be
+// ShouldKeep returns whether an expression from the original file should be
 // preserved. This is true if it has a trailing comment that starts with "keep".
-func shouldKeep(e bf.Expr) bool {
-	c := e.Comment()
-	return len(c.Suffix) > 0 && strings.HasPrefix(c.Suffix[0].Token, keep)
+func ShouldKeep(e bf.Expr) bool {
+	return hasKeep(e.Comment())
+}
+
+// ShouldKeepRule returns whether a rule from the original file should be
+// preserved. This is true if a comment starting with "keep" follows it. See
+// trailingComments for where the parser attaches that comment.
+func ShouldKeepRule(rule *bf.CallExpr) bool {
+	for _, cs := range trailingComments(rule) {
+		if hasKeep(cs) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasKeep(cs *bf.Comments) bool {
+	for _, c := range cs.Suffix {
+		if strings.HasPrefix(c.Token, keep) {
+			return true
+		}
+	}
+	return false
 }
 
 func ruleUsed(rule string, oldfile *bf.File) bool {
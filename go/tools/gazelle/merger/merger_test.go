@@ -1,9 +1,12 @@
 package merger
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 
 	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
 )
 
 // should fix
@@ -13,7 +16,8 @@ import (
 
 type testCase struct {
 	desc, previous, current, expected string
-	ignore                            bool
+	ignore, ownedRulesOnly            bool
+	strategies                        map[string]config.MergeStrategy
 }
 
 var testCases = []testCase{
@@ -59,7 +63,7 @@ go_test(
         "parse_test.go",
         "print_test.go",
     ],
-    library = ":go_default_library",
+    embed = [":go_default_library"],
 )
 `,
 		expected: `
@@ -84,7 +88,7 @@ go_test(
         "print_test.go",
     ],
     data = glob(["testdata/*"]),
-    library = ":go_default_library",
+    embed = [":go_default_library"],
 )
 `},
 	{
@@ -302,6 +306,109 @@ go_library(
         "//conditions:default": [],
     }),
 )
+`,
+	}, {
+		desc: "merge OS and platform selects",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"] + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": [
+            "foo_linux.go",
+            "foo_linux_amd64.go",  # keep
+        ],
+        "@io_bazel_rules_go//go/platform:linux_arm64": [
+            "foo_linux.go",
+            "foo_linux_arm64.go",
+        ],
+        "//conditions:default": [],
+    }),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"] + select({
+        "@io_bazel_rules_go//go/platform:linux": ["foo_linux.go"],
+        "//conditions:default": [],
+    }) + select({
+        "@io_bazel_rules_go//go/platform:linux_arm64": ["foo_linux_arm64.go"],
+        "//conditions:default": [],
+    }),
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "foo.go",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux": ["foo_linux.go"],
+        "//conditions:default": [],
+    }) + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": ["foo_linux_amd64.go"],  # keep
+        "@io_bazel_rules_go//go/platform:linux_arm64": ["foo_linux_arm64.go"],
+        "//conditions:default": [],
+    }),
+)
+`,
+	}, {
+		desc: "keep select cases",
+		// A "# keep" comment after a one-element list in a select is attached
+		// to the case, since the list is printed on one line.
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "foo.go",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux": ["foo_linux.go"],
+        "//conditions:default": [],
+    }) + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": ["foo_linux_amd64.go"],  # keep
+        "@io_bazel_rules_go//go/platform:linux_arm64": ["foo_linux_arm64.go"],
+        "//conditions:default": [],
+    }),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"] + select({
+        "@io_bazel_rules_go//go/platform:linux": ["foo_linux.go"],
+        "//conditions:default": [],
+    }) + select({
+        "@io_bazel_rules_go//go/platform:linux_arm64": ["foo_linux_arm64.go"],
+        "//conditions:default": [],
+    }),
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "foo.go",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux": ["foo_linux.go"],
+        "//conditions:default": [],
+    }) + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": ["foo_linux_amd64.go"],  # keep
+        "@io_bazel_rules_go//go/platform:linux_arm64": ["foo_linux_arm64.go"],
+        "//conditions:default": [],
+    }),
+)
 `,
 	}, {
 		desc: "delete empty list",
@@ -448,6 +555,238 @@ go_library(
         "b.go",  # comments
     ],
 )
+`,
+	}, {
+		desc: "preserve comments on rewritten attributes",
+		// The parser attaches the comment after the rule to the last element
+		// of deps, and it stays there.
+		previous: `
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    deps = [
+        # Registers the plugin.
+        "//a:go_default_library",
+        "//b:go_default_library",  # pinned for ABI
+        "//old:go_default_library",
+        # TODO: remove after the migration.
+    ] + select({
+        # Only on Linux.
+        "linux_amd64": [
+            "//c:go_default_library",  # syscall wrappers
+            "//d:go_default_library",
+        ],
+    }),
+)  # owned by the storage team
+`,
+		current: `
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    deps = [
+        "//a:go_default_library",
+        "//b:go_default_library",
+        "//new:go_default_library",
+    ] + select({
+        "linux_amd64": [
+            "//c:go_default_library",
+            "//d:go_default_library",
+        ],
+    }),
+)
+`,
+		expected: `
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    deps = [
+        # Registers the plugin.
+        "//a:go_default_library",
+        "//b:go_default_library",  # pinned for ABI
+        "//new:go_default_library",
+        # TODO: remove after the migration.
+    ] + select({
+        # Only on Linux.
+        "linux_amd64": [
+            "//c:go_default_library",  # syscall wrappers
+            "//d:go_default_library",  # owned by the storage team
+        ],
+    }),
+)
+`,
+	}, {
+		desc: "owned rules only",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("//tools:test.bzl", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["old.go"],
+)  # gazelle:generated
+
+go_test(
+    name = "go_default_test",
+    srcs = ["wrapper_test.go"],
+    race = True,
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)  # gazelle:generated
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    embed = [":go_default_library"],
+)  # gazelle:generated
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("//tools:test.bzl", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)  # gazelle:generated
+
+go_test(
+    name = "go_default_test",
+    srcs = ["wrapper_test.go"],
+    race = True,
+)
+`,
+		ownedRulesOnly: true,
+	}, {
+		desc: "migrate library to embed",
+		previous: `
+go_library(
+    name = "go_default_library",
+    srcs = ["pure.go"],
+    library = select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": ":cgo_default_library",  # cgo only
+        "//conditions:default": None,
+    }),
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    library = ":go_default_library",
+    deps = ["//foo:go_default_library"],
+)
+`,
+		current: `
+go_library(
+    name = "go_default_library",
+    srcs = ["pure.go"],
+    embed = select({
+        "@io_bazel_rules_go//go/platform:darwin_amd64": [":cgo_default_library"],
+        "@io_bazel_rules_go//go/platform:linux_amd64": [":cgo_default_library"],
+        "//conditions:default": [],
+    }),
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    embed = [":go_default_library"],
+)
+`,
+		expected: `
+go_library(
+    name = "go_default_library",
+    srcs = ["pure.go"],
+    embed = select({
+        "@io_bazel_rules_go//go/platform:darwin_amd64": [":cgo_default_library"],
+        "@io_bazel_rules_go//go/platform:linux_amd64": [":cgo_default_library"],  # cgo only
+        "//conditions:default": [],
+    }),
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    embed = [":go_default_library"],
+)
+`,
+	}, {
+		desc: "replace annotations",
+		previous: `
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)  # gazelle:generated version=0.5.0 flags=0123abcd
+`,
+		current: `
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)  # gazelle:generated version=0.5.1 flags=4567cdef
+`,
+		expected: `
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)  # gazelle:generated version=0.5.1 flags=4567cdef
+`,
+	}, {
+		desc: "replace go version notes",
+		previous: `
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)  # gazelle:requires go1.8
+`,
+		current: `
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)  # gazelle:requires go1.9
+`,
+		expected: `
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)  # gazelle:requires go1.9
+`,
+	}, {
+		desc: "replace go version notes after lists",
+		previous: `
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+    ],
+)  # gazelle:requires go1.8
+`,
+		current: `
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+        "c.go",
+    ],
+)  # gazelle:requires go1.9
+`,
+		expected: `
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+        "c.go",
+    ],
+)  # gazelle:requires go1.9
 `,
 	}, {
 		desc: "merge copts and clinkopts",
@@ -489,6 +828,142 @@ cgo_library(
     ],
     clinkopts = ["-lpng"],
 )
+`,
+	}, {
+		desc: "unmanaged attributes preserved",
+		previous: `
+go_test(
+    name = "go_default_test",
+    # Integration tests need more time.
+    timeout = "long",
+    srcs = ["a_test.go"],
+    tags = ["manual"],  # flaky on CI
+    args = ["-v"],
+    custom_attr = True,
+    shard_count = 4,
+)
+`,
+		current: `
+go_test(
+    name = "go_default_test",
+    srcs = [
+        "a_test.go",
+        "b_test.go",
+    ],
+    embed = [":go_default_library"],
+    deps = ["//foo:go_default_library"],
+)
+`,
+		expected: `
+go_test(
+    name = "go_default_test",
+    # Integration tests need more time.
+    timeout = "long",
+    srcs = [
+        "a_test.go",
+        "b_test.go",
+    ],
+    tags = ["manual"],  # flaky on CI
+    args = ["-v"],
+    custom_attr = True,
+    shard_count = 4,
+    embed = [":go_default_library"],
+    deps = ["//foo:go_default_library"],
+)
+`,
+	}, {
+		desc: "new attributes placed before following attributes",
+		previous: `
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    tags = ["manual"],
+    deps = ["//foo:go_default_library"],
+)
+`,
+		current: `
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    visibility = ["//visibility:public"],
+    deps = ["//foo:go_default_library"],
+)
+`,
+		expected: `
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    tags = ["manual"],
+    visibility = ["//visibility:public"],
+    deps = ["//foo:go_default_library"],
+)
+`,
+	}, {
+		desc: "merge strategies",
+		strategies: map[string]config.MergeStrategy{
+			"deps": config.UnionStrategy,
+			"srcs": config.KeepStrategy,
+		},
+		previous: `
+go_library(
+    name = "go_default_library",
+    srcs = ["old.go"],
+    deps = [
+        "//old:go_default_library",
+        "//both:go_default_library",
+    ],
+)
+`,
+		current: `
+go_library(
+    name = "go_default_library",
+    srcs = ["new.go"],
+    copts = ["-O2"],
+    deps = [
+        "//both:go_default_library",
+        "//new:go_default_library",
+    ],
+)
+`,
+		expected: `
+go_library(
+    name = "go_default_library",
+    srcs = ["old.go"],
+    copts = ["-O2"],
+    deps = [
+        "//old:go_default_library",
+        "//both:go_default_library",
+        "//new:go_default_library",
+    ],
+)
+`,
+	}, {
+		desc: "replaceable attributes",
+		previous: `
+go_test(
+    name = "go_default_test",
+    size = "small",
+    timeout = "long",  # keep
+    srcs = ["foo_test.go"],
+    shard_count = 2,
+)
+`,
+		current: `
+go_test(
+    name = "go_default_test",
+    size = "large",
+    timeout = "short",
+    srcs = ["foo_test.go"],
+)
+`,
+		expected: `
+go_test(
+    name = "go_default_test",
+    size = "large",
+    timeout = "long",  # keep
+    srcs = ["foo_test.go"],
+    shard_count = 2,
+)
 `,
 	},
 }
@@ -505,7 +980,8 @@ func TestMergeWithExisting(t *testing.T) {
 			t.Errorf("%s: %v", tc.desc, err)
 			continue
 		}
-		mergedFile := MergeWithExisting(genFile, oldFile)
+		c := &config.Config{MergeStrategies: tc.strategies, OwnedRulesOnly: tc.ownedRulesOnly}
+		mergedFile := MergeWithExisting(c, genFile, oldFile)
 		if mergedFile == nil {
 			if !tc.ignore {
 				t.Errorf("%s: got nil; want file", tc.desc)
@@ -531,8 +1007,67 @@ func TestMergeWithExisting(t *testing.T) {
 func TestMergeWithExistingDifferentName(t *testing.T) {
 	oldFile := &bf.File{Path: "BUILD"}
 	genFile := &bf.File{Path: "BUILD.bazel"}
-	mergedFile := MergeWithExisting(genFile, oldFile)
+	mergedFile := MergeWithExisting(&config.Config{}, genFile, oldFile)
 	if got, want := mergedFile.Path, oldFile.Path; got != want {
 		t.Errorf("got %q; want %q", got, want)
 	}
 }
+
+func TestMergeOrderedList(t *testing.T) {
+	listOf := func(values ...string) *bf.ListExpr {
+		l := &bf.ListExpr{}
+		for _, v := range values {
+			e := &bf.StringExpr{Value: v}
+			if strings.HasSuffix(v, "#keep") {
+				e.Value = strings.TrimSuffix(v, "#keep")
+				e.Comment().Suffix = []bf.Comment{{Token: "# keep"}}
+			}
+			l.List = append(l.List, e)
+		}
+		return l
+	}
+	for _, tc := range []struct {
+		desc             string
+		gen, old         *bf.ListExpr
+		union, unordered bool
+		want             []string
+	}{
+		{
+			desc: "generated order",
+			gen:  listOf("-lSDL2main", "-lSDL2", "-lm"),
+			old:  listOf("-lm", "-lSDL2"),
+			want: []string{"-lSDL2main", "-lSDL2", "-lm"},
+		}, {
+			desc:      "unordered",
+			gen:       listOf("-lSDL2main", "-lSDL2", "-lm"),
+			old:       listOf("-lm", "-lSDL2"),
+			unordered: true,
+			want:      []string{"-lm", "-lSDL2", "-lSDL2main"},
+		}, {
+			desc: "keep after predecessor",
+			gen:  listOf("-lsqlite3", "-lm"),
+			old:  listOf("-lpthread#keep", "-lsqlite3", "-ldl#keep", "-lold", "-lm"),
+			want: []string{"-lpthread", "-lsqlite3", "-ldl", "-lm"},
+		}, {
+			desc:  "union",
+			gen:   listOf("-lsqlite3"),
+			old:   listOf("-lsqlite3", "-ldl"),
+			union: true,
+			want:  []string{"-lsqlite3", "-ldl"},
+		}, {
+			desc: "repeats",
+			gen:  listOf("-lfoo", "-lbar", "-lfoo"),
+			old:  listOf("-lfoo"),
+			want: []string{"-lfoo", "-lbar", "-lfoo"},
+		},
+	} {
+		merged := mergeList(tc.gen, tc.old, tc.union, !tc.unordered)
+		var got []string
+		for _, e := range merged.List {
+			got = append(got, stringValue(e))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q; want %q", tc.desc, got, tc.want)
+		}
+	}
+}
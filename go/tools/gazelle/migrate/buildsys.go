@@ -0,0 +1,307 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrate
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+)
+
+// goRulesBzl is the label of the file that defines rules_go rules.
+const goRulesBzl = "@io_bazel_rules_go//go:def.bzl"
+
+// A BuildSystem describes how Go targets of another build system are
+// converted to rules_go rules.
+type BuildSystem struct {
+	// Name is the name of the build system, as accepted by FindBuildSystem.
+	Name string
+
+	// FileNames is the list of base names of build files.
+	FileNames []string
+
+	// Kinds maps kinds of Go targets to kinds of rules_go rules. Kinds mapped
+	// to "" are recognized as Go targets but can't be converted.
+	Kinds map[string]string
+
+	// Attrs maps names of attributes to names of rules_go attributes.
+	// Attributes not in this map are dropped.
+	Attrs map[string]string
+
+	// convertLabel converts a label or address to a Bazel label.
+	convertLabel func(string) string
+}
+
+var buildSystems = []*BuildSystem{
+	{
+		Name:      "buck",
+		FileNames: []string{"BUCK"},
+		Kinds: map[string]string{
+			"go_binary":           "go_binary",
+			"go_library":          "go_library",
+			"go_test":             "go_test",
+			"cgo_library":         "",
+			"prebuilt_go_library": "",
+		},
+		Attrs: map[string]string{
+			"name":           "name",
+			"srcs":           "srcs",
+			"deps":           "deps",
+			"library":        "embed",
+			"visibility":     "visibility",
+			"package_name":   "importpath",
+			"compiler_flags": "gc_goopts",
+			"linker_flags":   "gc_linkopts",
+		},
+		convertLabel: convertBuckLabel,
+	}, {
+		Name:      "pants",
+		FileNames: []string{"BUILD"},
+		Kinds: map[string]string{
+			"go_binary":           "go_binary",
+			"go_library":          "go_library",
+			"go_remote_library":   "",
+			"go_remote_libraries": "",
+			"go_thrift_library":   "",
+			"go_protobuf_library": "",
+		},
+		Attrs: map[string]string{
+			"name":         "name",
+			"sources":      "srcs",
+			"dependencies": "deps",
+		},
+		convertLabel: convertPantsAddress,
+	}, {
+		Name:      "please",
+		FileNames: []string{"BUILD", "BUILD.plz"},
+		Kinds: map[string]string{
+			"go_binary":   "go_binary",
+			"go_library":  "go_library",
+			"go_test":     "go_test",
+			"cgo_library": "",
+			"go_get":      "",
+		},
+		Attrs: map[string]string{
+			"name":       "name",
+			"srcs":       "srcs",
+			"deps":       "deps",
+			"data":       "data",
+			"visibility": "visibility",
+		},
+		convertLabel: convertBuckLabel,
+	},
+}
+
+// FindBuildSystem returns the build system with the given name ("buck",
+// "pants", or "please").
+func FindBuildSystem(name string) (*BuildSystem, error) {
+	for _, sys := range buildSystems {
+		if sys.Name == name {
+			return sys, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown build system %q", name)
+}
+
+// IsBuildFile returns whether base is the name of a build file for sys.
+func (sys *BuildSystem) IsBuildFile(base string) bool {
+	for _, name := range sys.FileNames {
+		if base == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsForeignFile returns whether f, a file named like a build file of sys, is
+// written for sys rather than for Bazel. Pants and Please use "BUILD" too, so
+// a file with that name may be either. Bazel files must load the rules they
+// use with load statements, which Buck, Pants, and Please don't have, so
+// files with load statements are treated as Bazel files.
+func (sys *BuildSystem) IsForeignFile(f *bf.File) bool {
+	for _, stmt := range f.Stmt {
+		if c, ok := stmt.(*bf.CallExpr); ok {
+			if x, ok := c.X.(*bf.LiteralExpr); ok && x.Token == "load" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ConvertFile converts the Go targets in a build file of sys to rules_go
+// rules and returns a new file at path with the converted rules. rel is the
+// slash-separated path from the repository root to the directory containing
+// the file. newPath is the path of the returned file. nil is returned if the
+// file has no Go targets that can be converted. Targets that can't be
+// converted are reported as warnings. Callers should check IsForeignFile
+// first, since Bazel files may have the same names.
+//
+// Rule names and visibility are preserved. If any rule isn't named the way
+// Gazelle would name it, the file is marked with "# gazelle:ignore", since
+// Gazelle would otherwise add rules with its own names next to them.
+func (sys *BuildSystem) ConvertFile(old *bf.File, newPath, rel string) (*bf.File, []string) {
+	var warnings []string
+	f := &bf.File{Path: newPath}
+	kinds := make(map[string]bool)
+	customNames := false
+	for _, r := range old.Rules("") {
+		kind, ok := sys.Kinds[r.Kind()]
+		if !ok {
+			continue
+		}
+		if kind == "" {
+			warnings = append(warnings, fmt.Sprintf("%s: %s %q can't be converted", old.Path, r.Kind(), r.Name()))
+			continue
+		}
+		call := &bf.CallExpr{X: &bf.LiteralExpr{Token: kind}}
+		nr := &bf.Rule{Call: call}
+		for _, key := range r.AttrKeys() {
+			newKey, ok := sys.Attrs[key]
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("%s: %s: attribute %q was dropped", old.Path, r.Name(), key))
+				continue
+			}
+			nr.SetAttr(newKey, sys.convertExpr(newKey, r.Attr(key)))
+		}
+		if nr.Name() == "" {
+			// Pants names targets after their directories by default.
+			if rel == "" {
+				warnings = append(warnings, fmt.Sprintf("%s: unnamed %s in the repository root can't be converted", old.Path, r.Kind()))
+				continue
+			}
+			nr.SetAttr("name", &bf.StringExpr{Value: path.Base(rel)})
+		}
+		if nr.Name() != defaultName(kind, rel) {
+			customNames = true
+		}
+		kinds[kind] = true
+		f.Stmt = append(f.Stmt, call)
+	}
+	if len(f.Stmt) == 0 {
+		return nil, warnings
+	}
+
+	var kindList []string
+	for k := range kinds {
+		kindList = append(kindList, k)
+	}
+	sort.Strings(kindList)
+	load := &bf.CallExpr{X: &bf.LiteralExpr{Token: "load"}}
+	load.List = append(load.List, &bf.StringExpr{Value: goRulesBzl})
+	for _, k := range kindList {
+		load.List = append(load.List, &bf.StringExpr{Value: k})
+	}
+	load.Comments.Before = []bf.Comment{{Token: fmt.Sprintf("# Converted from %s.", old.Path)}}
+	if customNames {
+		load.Comments.Before = append(load.Comments.Before, bf.Comment{Token: "# gazelle:ignore"})
+	}
+	f.Stmt = append([]bf.Expr{load}, f.Stmt...)
+	return f, warnings
+}
+
+// convertExpr converts the value of an attribute. Labels in deps, embed,
+// and visibility are converted to Bazel labels, and calls to Pants' globs
+// are converted to glob. A single label in embed, converted from a library
+// attribute, is put in a list. Other values are copied as they are.
+func (sys *BuildSystem) convertExpr(key string, e bf.Expr) bf.Expr {
+	switch key {
+	case "deps", "embed":
+		e = bf.Edit(e, func(x bf.Expr, _ []bf.Expr) bf.Expr {
+			if s, ok := x.(*bf.StringExpr); ok {
+				return &bf.StringExpr{Value: sys.convertLabel(s.Value)}
+			}
+			return nil
+		})
+		if s, ok := e.(*bf.StringExpr); ok && key == "embed" {
+			return &bf.ListExpr{List: []bf.Expr{s}}
+		}
+		return e
+	case "visibility":
+		return bf.Edit(e, func(x bf.Expr, _ []bf.Expr) bf.Expr {
+			if s, ok := x.(*bf.StringExpr); ok {
+				return &bf.StringExpr{Value: convertVisibility(s.Value)}
+			}
+			return nil
+		})
+	case "srcs":
+		if c, ok := e.(*bf.CallExpr); ok {
+			if x, ok := c.X.(*bf.LiteralExpr); ok && x.Token == "globs" {
+				return &bf.CallExpr{
+					X:    &bf.LiteralExpr{Token: "glob"},
+					List: []bf.Expr{&bf.ListExpr{List: c.List}},
+				}
+			}
+		}
+	}
+	return e
+}
+
+// defaultName returns the name Gazelle gives a rule of the given kind in the
+// package at rel.
+func defaultName(kind, rel string) string {
+	switch kind {
+	case "go_library":
+		return resolve.DefaultLibName
+	case "go_test":
+		return resolve.DefaultTestName
+	default:
+		return path.Base(rel)
+	}
+}
+
+// convertBuckLabel converts a Buck or Please label to a Bazel label. Cell
+// and subrepo prefixes ("cell//pkg:name") are converted to repository names.
+func convertBuckLabel(l string) string {
+	if i := strings.Index(l, "//"); i > 0 && !strings.HasPrefix(l, "@") {
+		return "@" + l
+	}
+	return l
+}
+
+// convertPantsAddress converts a Pants address ("src/go/foo:name") to a
+// Bazel label.
+func convertPantsAddress(a string) string {
+	if strings.HasPrefix(a, ":") || strings.HasPrefix(a, "//") {
+		return a
+	}
+	return "//" + a
+}
+
+// convertVisibility converts a Buck or Please visibility pattern to a Bazel
+// visibility label.
+func convertVisibility(v string) string {
+	switch {
+	case v == "PUBLIC":
+		return "//visibility:public"
+	case v == "//...":
+		return "//visibility:public"
+	case strings.HasSuffix(v, "/..."):
+		return strings.TrimSuffix(v, "/...") + ":__subpackages__"
+	case strings.HasPrefix(v, "//"):
+		// Bazel can't grant visibility to individual targets, only to
+		// packages.
+		if i := strings.IndexByte(v, ':'); i >= 0 {
+			v = v[:i]
+		}
+		return v + ":__pkg__"
+	}
+	return v
+}
@@ -0,0 +1,186 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrate
+
+import (
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+)
+
+func TestConvertFile(t *testing.T) {
+	for _, tc := range []struct {
+		sys, old, want string
+	}{
+		{
+			sys: "buck",
+			old: `go_library(
+    name = "foo",
+    srcs = glob(["*.go"]),
+    package_name = "example.com/repo/foo",
+    deps = ["//bar:bar", "third_party//baz:baz"],
+    visibility = ["PUBLIC"],
+    tests = [":foo_test"],
+)
+
+go_test(
+    name = "foo_test",
+    srcs = ["foo_test.go"],
+    library = ":foo",
+    visibility = ["//qux/..."],
+)
+
+genrule(name = "gen")
+`,
+			want: `# Converted from BUCK.
+# gazelle:ignore
+load(
+    "@io_bazel_rules_go//go:def.bzl",
+    "go_library",
+    "go_test",
+)
+
+go_library(
+    name = "foo",
+    srcs = glob(["*.go"]),
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//bar",
+        "@third_party//baz:baz",
+    ],
+)
+
+go_test(
+    name = "foo_test",
+    srcs = ["foo_test.go"],
+    embed = [":foo"],
+    visibility = ["//qux:__subpackages__"],
+)
+`,
+		}, {
+			sys: "pants",
+			old: `go_binary(
+    sources = globs("*.go"),
+    dependencies = ["src/go/lib"],
+)
+`,
+			want: `# Converted from BUILD.
+load(
+    "@io_bazel_rules_go//go:def.bzl",
+    "go_binary",
+)
+
+go_binary(
+    name = "cmd",
+    srcs = glob(["*.go"]),
+    deps = ["//src/go/lib"],
+)
+`,
+		},
+	} {
+		sys, err := FindBuildSystem(tc.sys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old, err := bf.Parse(sys.FileNames[0], []byte(tc.old))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, _ := sys.ConvertFile(old, "BUILD.bazel", "src/go/cmd")
+		if f == nil {
+			t.Errorf("%s: got nil file", tc.sys)
+			continue
+		}
+		// import rewrites converted files like this before writing them.
+		bf.Rewrite(f, nil)
+		if got := string(bf.Format(f)); got != tc.want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", tc.sys, got, tc.want)
+		}
+	}
+}
+
+func TestIsForeignFile(t *testing.T) {
+	sys, err := FindBuildSystem("pants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc, data string
+		want       bool
+	}{
+		{
+			desc: "pants",
+			data: `go_library(
+    sources = globs("*.go"),
+)
+`,
+			want: true,
+		}, {
+			desc: "bazel",
+			data: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+		},
+	} {
+		f, err := bf.Parse("BUILD", []byte(tc.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sys.IsForeignFile(f); got != tc.want {
+			t.Errorf("%s: got %v; want %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestConvertVisibility(t *testing.T) {
+	for _, tc := range []struct{ v, want string }{
+		{"PUBLIC", "//visibility:public"},
+		{"//...", "//visibility:public"},
+		{"//foo/...", "//foo:__subpackages__"},
+		{"//foo:bar", "//foo:__pkg__"},
+		{"//foo", "//foo:__pkg__"},
+	} {
+		if got := convertVisibility(tc.v); got != tc.want {
+			t.Errorf("convertVisibility(%q) = %q; want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestConvertLabels(t *testing.T) {
+	for _, tc := range []struct{ l, want string }{
+		{"//foo:bar", "//foo:bar"},
+		{":bar", ":bar"},
+		{"cell//foo:bar", "@cell//foo:bar"},
+	} {
+		if got := convertBuckLabel(tc.l); got != tc.want {
+			t.Errorf("convertBuckLabel(%q) = %q; want %q", tc.l, got, tc.want)
+		}
+	}
+	for _, tc := range []struct{ a, want string }{
+		{"src/go/foo", "//src/go/foo"},
+		{"src/go/foo:bar", "//src/go/foo:bar"},
+		{":bar", ":bar"},
+	} {
+		if got := convertPantsAddress(tc.a); got != tc.want {
+			t.Errorf("convertPantsAddress(%q) = %q; want %q", tc.a, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrate
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+)
+
+// A Change describes attributes to add to a rule generated by Gazelle.
+type Change struct {
+	// Pos is the position of the invocation the change was derived from.
+	Pos string
+
+	// Rel is the slash-separated path from the repository root to the
+	// directory containing the rule.
+	Rel string
+
+	// Kind is the kind of rule to change, "go_binary" or "go_test".
+	Kind string
+
+	// XDefs, GcGoopts, and GcLinkopts are added to the rule's x_defs,
+	// gc_goopts, and gc_linkopts attributes.
+	XDefs                map[string]string
+	GcGoopts, GcLinkopts []string
+}
+
+// A Plan is the result of converting invocations.
+type Plan struct {
+	Changes []Change
+
+	// BuildTags is the sorted set of build tags used by any invocation.
+	// Gazelle should be run with these tags in -build_tags.
+	BuildTags []string
+
+	// Warnings describe things that could not be converted automatically.
+	Warnings []string
+}
+
+// varRefRe matches a value that is a single reference to a make or shell
+// variable, like $(VERSION), ${VERSION}, or $VERSION.
+var varRefRe = regexp.MustCompile(`^\$(?:\(([A-Za-z_][A-Za-z0-9_]*)\)|\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))$`)
+
+// Convert derives changes to generated rules from invocations found in a
+// script. scriptRel is the slash-separated path from the repository root to
+// the directory containing the script; relative package paths are resolved
+// against it. goPrefix is used to recognize import paths within the
+// repository.
+//
+// Values of -X flags that are a single variable reference are converted to
+// workspace status references ({NAME}), which are stamped by go_binary.
+// Other values that refer to variables can't be converted and are reported
+// as warnings.
+func Convert(invs []Invocation, scriptRel, goPrefix string) Plan {
+	var p Plan
+	tags := make(map[string]bool)
+	for _, inv := range invs {
+		for _, t := range inv.Tags {
+			tags[t] = true
+		}
+
+		kind := "go_binary"
+		if inv.Command == "test" {
+			kind = "go_test"
+		}
+		pkgs := inv.Packages
+		if len(pkgs) == 0 {
+			pkgs = []string{"."}
+		}
+		for _, pkg := range pkgs {
+			rel, ok := packageRel(pkg, scriptRel, goPrefix)
+			if !ok {
+				if len(inv.XDefs) > 0 || len(inv.LinkOpts) > 0 || len(inv.GoOpts) > 0 {
+					p.Warnings = append(p.Warnings, fmt.Sprintf("%s: package %q is not a single package in this repository; flags for it must be converted by hand", inv.Pos, pkg))
+				}
+				continue
+			}
+
+			if kind == "go_binary" && inv.Output != "" && !strings.HasSuffix(inv.Output, "/") && len(pkgs) == 1 {
+				if name := path.Base(inv.Output); name != defaultBinaryName(rel, goPrefix) {
+					p.Warnings = append(p.Warnings, fmt.Sprintf("%s: go %s writes %q, but the go_binary in //%s is named %q", inv.Pos, inv.Command, name, rel, defaultBinaryName(rel, goPrefix)))
+				}
+			}
+
+			ch := Change{
+				Pos:        inv.Pos,
+				Rel:        rel,
+				Kind:       kind,
+				GcGoopts:   inv.GoOpts,
+				GcLinkopts: inv.LinkOpts,
+			}
+			var names []string
+			for name := range inv.XDefs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				value := inv.XDefs[name]
+				if m := varRefRe.FindStringSubmatch(value); m != nil {
+					value = "{" + m[1] + m[2] + m[3] + "}"
+				} else if strings.Contains(value, "$") {
+					p.Warnings = append(p.Warnings, fmt.Sprintf("%s: -X %s=%s can't be converted; provide the value with workspace status", inv.Pos, name, value))
+					continue
+				}
+				if ch.XDefs == nil {
+					ch.XDefs = make(map[string]string)
+				}
+				ch.XDefs[name] = value
+			}
+			if ch.XDefs != nil || len(ch.GcGoopts) > 0 || len(ch.GcLinkopts) > 0 {
+				p.Changes = append(p.Changes, ch)
+			}
+		}
+	}
+
+	for t := range tags {
+		p.BuildTags = append(p.BuildTags, t)
+	}
+	sort.Strings(p.BuildTags)
+	return p
+}
+
+// packageRel returns the slash-separated path from the repository root to
+// the package named by pkg. Patterns with "..." and packages outside the
+// repository are not recognized.
+func packageRel(pkg, scriptRel, goPrefix string) (string, bool) {
+	if strings.Contains(pkg, "...") || strings.Contains(pkg, "$") || strings.HasSuffix(pkg, ".go") {
+		return "", false
+	}
+	if pkg == "." || strings.HasPrefix(pkg, "./") || strings.HasPrefix(pkg, "../") {
+		rel := path.Join(scriptRel, pkg)
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", false
+		}
+		if rel == "." {
+			rel = ""
+		}
+		return rel, true
+	}
+	if goPrefix != "" && pkg == goPrefix {
+		return "", true
+	}
+	if goPrefix != "" && strings.HasPrefix(pkg, goPrefix+"/") {
+		return pkg[len(goPrefix)+1:], true
+	}
+	return "", false
+}
+
+// defaultBinaryName returns the name Gazelle gives to the go_binary rule in
+// the package at rel.
+func defaultBinaryName(rel, goPrefix string) string {
+	if rel == "" {
+		return path.Base(goPrefix)
+	}
+	return path.Base(rel)
+}
+
+// Apply applies ch to the rule of kind ch.Kind in f. Values are added to
+// the existing attributes; entries in x_defs with the same key are replaced.
+// None of these attributes are regenerated by Gazelle, so the changes are
+// preserved by later runs.
+func Apply(f *bf.File, ch Change) error {
+	r := findRule(f, ch.Kind)
+	if r == nil {
+		return fmt.Errorf("%s: no %s rule in %s; run gazelle first", ch.Pos, ch.Kind, f.Path)
+	}
+	if len(ch.XDefs) > 0 {
+		dict, ok := r.Attr("x_defs").(*bf.DictExpr)
+		if !ok {
+			if r.Attr("x_defs") != nil {
+				return fmt.Errorf("%s: x_defs in %s is not a dict", ch.Pos, f.Path)
+			}
+			dict = &bf.DictExpr{ForceMultiLine: true}
+			r.SetAttr("x_defs", dict)
+		}
+		var names []string
+		for name := range ch.XDefs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			setDictValue(dict, name, ch.XDefs[name])
+		}
+	}
+	if err := addStrings(r, "gc_goopts", ch.GcGoopts); err != nil {
+		return fmt.Errorf("%s: %s: %v", ch.Pos, f.Path, err)
+	}
+	if err := addStrings(r, "gc_linkopts", ch.GcLinkopts); err != nil {
+		return fmt.Errorf("%s: %s: %v", ch.Pos, f.Path, err)
+	}
+	return nil
+}
+
+// findRule returns the rule of the given kind in f. Gazelle generates at
+// most one go_binary and one internal go_test per package; for tests, the
+// internal test is preferred.
+func findRule(f *bf.File, kind string) *bf.Rule {
+	rs := f.Rules(kind)
+	for _, r := range rs {
+		if kind != "go_test" || r.Name() == resolve.DefaultTestName {
+			return r
+		}
+	}
+	if len(rs) > 0 {
+		return rs[0]
+	}
+	return nil
+}
+
+func setDictValue(dict *bf.DictExpr, key, value string) {
+	for _, e := range dict.List {
+		kv, ok := e.(*bf.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		if k, ok := kv.Key.(*bf.StringExpr); ok && k.Value == key {
+			kv.Value = &bf.StringExpr{Value: value}
+			return
+		}
+	}
+	dict.List = append(dict.List, &bf.KeyValueExpr{
+		Key:   &bf.StringExpr{Value: key},
+		Value: &bf.StringExpr{Value: value},
+	})
+}
+
+func addStrings(r *bf.Rule, attr string, values []string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	list, ok := r.Attr(attr).(*bf.ListExpr)
+	if !ok {
+		if r.Attr(attr) != nil {
+			return fmt.Errorf("%s is not a list", attr)
+		}
+		list = &bf.ListExpr{}
+		r.SetAttr(attr, list)
+	}
+	have := make(map[string]bool)
+	for _, e := range list.List {
+		if s, ok := e.(*bf.StringExpr); ok {
+			have[s.Value] = true
+		}
+	}
+	for _, v := range values {
+		if !have[v] {
+			list.List = append(list.List, &bf.StringExpr{Value: v})
+			have[v] = true
+		}
+	}
+	return nil
+}
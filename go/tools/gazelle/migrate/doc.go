@@ -0,0 +1,24 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package migrate helps convert builds driven by Makefiles and shell scripts
+// to Bazel. It finds "go build", "go install", and "go test" commands in
+// scripts and converts their flags into attributes of the rules Gazelle
+// generates (x_defs, gc_goopts, gc_linkopts) and into Gazelle flags
+// (-build_tags).
+//
+// This is a heuristic: scripts are not executed, and variables are not
+// expanded. Anything that can't be converted is reported as a warning.
+package migrate
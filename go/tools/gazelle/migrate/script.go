@@ -0,0 +1,346 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// An Invocation is a "go build", "go install", or "go test" command found in
+// a Makefile or shell script.
+type Invocation struct {
+	// Pos is the name of the script and the line where the command starts,
+	// for example, "Makefile:12".
+	Pos string
+
+	// Command is "build", "install", or "test".
+	Command string
+
+	// Packages is the list of package arguments, as written.
+	Packages []string
+
+	// Output is the argument of -o, or "" if none was given.
+	Output string
+
+	// Tags is the list of build tags passed with -tags.
+	Tags []string
+
+	// XDefs maps variable names to values passed with -X in -ldflags.
+	XDefs map[string]string
+
+	// LinkOpts contains other flags passed with -ldflags.
+	LinkOpts []string
+
+	// GoOpts contains flags passed with -gcflags.
+	GoOpts []string
+}
+
+// valueFlags is the set of go command flags that take a value.
+var valueFlags = map[string]bool{
+	"asmflags":      true,
+	"bench":         true,
+	"buildmode":     true,
+	"compiler":      true,
+	"count":         true,
+	"covermode":     true,
+	"coverpkg":      true,
+	"coverprofile":  true,
+	"cpu":           true,
+	"exec":          true,
+	"gccgoflags":    true,
+	"gcflags":       true,
+	"installsuffix": true,
+	"ldflags":       true,
+	"mod":           true,
+	"o":             true,
+	"p":             true,
+	"parallel":      true,
+	"pkgdir":        true,
+	"run":           true,
+	"tags":          true,
+	"timeout":       true,
+	"toolexec":      true,
+}
+
+// goVarRe matches make and shell variables commonly used to name the go
+// command, like $(GO) or ${GOCMD}.
+var goVarRe = regexp.MustCompile(`^\$[({]?GO[A-Z_]*[)}]?$`)
+
+// ParseScript finds invocations of the go command in a Makefile or shell
+// script. name is used to report positions. Variables are not expanded;
+// values that contain references to them are returned as written.
+func ParseScript(name string, data []byte) []Invocation {
+	var invs []Invocation
+	for _, cmd := range splitCommands(string(data)) {
+		// Make recipes may start with "@", "-", or "+".
+		words := cmd.words
+		words[0] = strings.TrimLeft(words[0], "@-+")
+		if words[0] == "" {
+			words = words[1:]
+		}
+		inv, ok := parseInvocation(words)
+		if !ok {
+			continue
+		}
+		inv.Pos = fmt.Sprintf("%s:%d", name, cmd.line)
+		invs = append(invs, inv)
+	}
+	return invs
+}
+
+func parseInvocation(words []string) (Invocation, bool) {
+	// Skip environment assignments and "env" before the go command.
+	for len(words) > 0 && (words[0] == "env" || isAssignment(words[0])) {
+		words = words[1:]
+	}
+	if len(words) < 2 || !isGoCommand(words[0]) {
+		return Invocation{}, false
+	}
+	inv := Invocation{Command: words[1]}
+	switch inv.Command {
+	case "build", "install", "test":
+	default:
+		return Invocation{}, false
+	}
+
+	args := words[2:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-args" || arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			inv.Packages = append(inv.Packages, arg)
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		var value string
+		if j := strings.IndexByte(name, '='); j >= 0 {
+			name, value = name[:j], name[j+1:]
+		} else if valueFlags[name] && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		switch name {
+		case "o":
+			inv.Output = value
+		case "tags":
+			inv.Tags = append(inv.Tags, strings.FieldsFunc(value, func(r rune) bool {
+				return r == ',' || r == ' '
+			})...)
+		case "ldflags":
+			parseLinkFlags(&inv, splitWords(trimPattern(value)))
+		case "gcflags":
+			inv.GoOpts = append(inv.GoOpts, splitWords(trimPattern(value))...)
+		}
+	}
+	return inv, true
+}
+
+func parseLinkFlags(inv *Invocation, flags []string) {
+	for i := 0; i < len(flags); i++ {
+		flag := flags[i]
+		if flag != "-X" && flag != "--X" {
+			inv.LinkOpts = append(inv.LinkOpts, flag)
+			continue
+		}
+		if i+1 >= len(flags) {
+			break
+		}
+		i++
+		def := flags[i]
+		var name, value string
+		if j := strings.IndexByte(def, '='); j >= 0 {
+			name, value = def[:j], def[j+1:]
+		} else if i+1 < len(flags) {
+			// Old form: -X name value.
+			i++
+			name, value = def, flags[i]
+		} else {
+			continue
+		}
+		if inv.XDefs == nil {
+			inv.XDefs = make(map[string]string)
+		}
+		inv.XDefs[name] = value
+	}
+}
+
+// trimPattern removes a package pattern prefix, like "all=", from the value
+// of -gcflags or -ldflags.
+func trimPattern(value string) string {
+	if i := strings.IndexByte(value, '='); i > 0 && !strings.ContainsAny(value[:i], " -$") {
+		return value[i+1:]
+	}
+	return value
+}
+
+func isGoCommand(word string) bool {
+	return path.Base(word) == "go" || goVarRe.MatchString(word)
+}
+
+func isAssignment(word string) bool {
+	i := strings.IndexByte(word, '=')
+	if i <= 0 {
+		return false
+	}
+	for _, r := range word[:i] {
+		if !(r == '_' || 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// command is a simple command in a script, split into words.
+type command struct {
+	line  int
+	words []string
+}
+
+// splitCommands splits a script into simple commands. Line continuations
+// are joined, comments are removed, and commands are separated at newlines,
+// ";", "&&", "||", and "|". Words are split using shell quoting rules. Make's
+// "$$" escape is also recognized, so the same function works for recipes in
+// Makefiles.
+func splitCommands(s string) []command {
+	var cmds []command
+	var cur command
+	var word bytes.Buffer
+	inWord := false
+	line := 1
+	var quote byte
+	depth := 0 // nesting of $( and ${
+
+	endWord := func() {
+		if inWord {
+			if cur.words == nil {
+				cur.line = line
+			}
+			cur.words = append(cur.words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		if len(cur.words) > 0 {
+			cmds = append(cmds, cur)
+		}
+		cur = command{}
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			// Line continuation.
+			i++
+			line++
+			endWord()
+			continue
+
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+			continue
+
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' && i+1 < len(s) && strings.IndexByte(`"\$`, s[i+1]) >= 0 {
+				i++
+				word.WriteByte(s[i])
+			} else {
+				word.WriteByte(c)
+			}
+			continue
+
+		case c == '$' && i+1 < len(s) && (s[i+1] == '(' || s[i+1] == '{'):
+			depth++
+			inWord = true
+			word.WriteString(s[i : i+2])
+			i++
+			continue
+
+		case depth > 0 && (c == ')' || c == '}'):
+			depth--
+			word.WriteByte(c)
+			continue
+
+		case depth > 0 && c != '\n':
+			word.WriteByte(c)
+			continue
+		}
+
+		switch c {
+		case '\n':
+			depth = 0
+			endCommand()
+			line++
+		case ' ', '\t':
+			endWord()
+		case ';', '|', '&':
+			endCommand()
+		case '\'', '"':
+			quote = c
+			inWord = true
+		case '#':
+			if inWord {
+				word.WriteByte(c)
+				break
+			}
+			for i+1 < len(s) && s[i+1] != '\n' {
+				i++
+			}
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+				inWord = true
+			}
+		case '$':
+			// Make escapes "$" as "$$".
+			if i+1 < len(s) && s[i+1] == '$' {
+				i++
+			}
+			word.WriteByte(c)
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	endCommand()
+	return cmds
+}
+
+// splitWords splits the value of a flag like -ldflags into words, using the
+// same quoting rules as scripts.
+func splitWords(s string) []string {
+	var words []string
+	for _, cmd := range splitCommands(s) {
+		words = append(words, cmd.words...)
+	}
+	return words
+}
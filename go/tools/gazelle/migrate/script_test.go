@@ -0,0 +1,144 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseScript(t *testing.T) {
+	for _, tc := range []struct {
+		desc, script string
+		want         []Invocation
+	}{
+		{
+			desc: "makefile",
+			script: `
+VERSION := $(shell git describe)
+
+build:
+	@echo building
+	CGO_ENABLED=0 $(GO) build -o bin/server \
+		-ldflags "-s -w -X main.version=$(VERSION) -X 'main.name=my server'" \
+		./cmd/server
+
+test: build
+	go test -tags "integration etcd" ./... -run TestFoo # slow
+`,
+			want: []Invocation{
+				{
+					Pos:      "Makefile:6",
+					Command:  "build",
+					Packages: []string{"./cmd/server"},
+					Output:   "bin/server",
+					XDefs: map[string]string{
+						"main.version": "$(VERSION)",
+						"main.name":    "my server",
+					},
+					LinkOpts: []string{"-s", "-w"},
+				}, {
+					Pos:      "Makefile:11",
+					Command:  "test",
+					Packages: []string{"./..."},
+					Tags:     []string{"integration", "etcd"},
+				},
+			},
+		}, {
+			desc: "shell",
+			script: `#!/bin/sh
+set -e
+cd "$(dirname "$0")" && go install -gcflags=all=-N\ -l -tags=netgo example.com/repo/cmd/tool
+gofmt -l . | grep . && exit 1
+go vet ./...
+`,
+			want: []Invocation{
+				{
+					Pos:      "build.sh:3",
+					Command:  "install",
+					Packages: []string{"example.com/repo/cmd/tool"},
+					Tags:     []string{"netgo"},
+					GoOpts:   []string{"-N", "-l"},
+				},
+			},
+		},
+	} {
+		name := "Makefile"
+		if tc.desc == "shell" {
+			name = "build.sh"
+		}
+		got := ParseScript(name, []byte(tc.script))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v; want %#v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	invs := []Invocation{
+		{
+			Pos:      "Makefile:6",
+			Command:  "build",
+			Packages: []string{"./cmd/server"},
+			Output:   "bin/srv",
+			XDefs: map[string]string{
+				"main.version": "$(VERSION)",
+				"main.commit":  "$(shell git rev-parse HEAD)",
+				"main.name":    "server",
+			},
+			LinkOpts: []string{"-s"},
+		}, {
+			Pos:      "Makefile:11",
+			Command:  "test",
+			Packages: []string{"./..."},
+			Tags:     []string{"integration", "etcd"},
+		}, {
+			Pos:      "Makefile:12",
+			Command:  "test",
+			Packages: []string{"example.com/repo/tools/lib"},
+			Tags:     []string{"etcd"},
+			GoOpts:   []string{"-N"},
+		},
+	}
+	got := Convert(invs, "tools", "example.com/repo")
+	want := Plan{
+		Changes: []Change{
+			{
+				Pos:  "Makefile:6",
+				Rel:  "tools/cmd/server",
+				Kind: "go_binary",
+				XDefs: map[string]string{
+					"main.version": "{VERSION}",
+					"main.name":    "server",
+				},
+				GcLinkopts: []string{"-s"},
+			}, {
+				Pos:      "Makefile:12",
+				Rel:      "tools/lib",
+				Kind:     "go_test",
+				GcGoopts: []string{"-N"},
+			},
+		},
+		BuildTags: []string{"etcd", "integration"},
+		Warnings: []string{
+			`Makefile:6: go build writes "srv", but the go_binary in //tools/cmd/server is named "server"`,
+			"Makefile:6: -X main.commit=$(shell git rev-parse HEAD) can't be converted; provide the value with workspace status",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
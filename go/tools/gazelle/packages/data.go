@@ -0,0 +1,385 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+)
+
+// embedFiles returns the files in dir matched by "//go:embed" patterns, as
+// slash-separated paths relative to dir. Like the go command, directories
+// are matched recursively, skipping files whose names begin with "." or "_"
+// unless the pattern has the "all:" prefix. Files in subdirectories with
+// their own build files are skipped, since they belong to other packages.
+func embedFiles(c *config.Config, dir string, patterns []string) []string {
+	var files []string
+	for _, pattern := range patterns {
+		all := strings.HasPrefix(pattern, "all:")
+		if all {
+			pattern = pattern[len("all:"):]
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+		if err != nil {
+			logging.Warningf(logging.InvalidEmbed, dir, "%s: invalid //go:embed pattern %q: %v", dir, pattern, err)
+			continue
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(dir, match)
+			if err != nil || strings.HasPrefix(rel, "..") || inSubpackage(c, dir, filepath.Dir(rel)) {
+				continue
+			}
+			st, err := os.Stat(match)
+			if err != nil {
+				continue
+			}
+			if !st.IsDir() {
+				files = append(files, filepath.ToSlash(rel))
+				continue
+			}
+			filepath.Walk(match, func(p string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				base := fi.Name()
+				if p != match && !all && (base[0] == '.' || base[0] == '_') {
+					if fi.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if fi.IsDir() {
+					if p != match && hasBuildFile(c, p) {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if fi.Mode().IsRegular() {
+					rel, _ := filepath.Rel(dir, p)
+					files = append(files, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+		}
+	}
+	return files
+}
+
+// literalFiles returns the files in dir named by string literals in the
+// .go file described by info, as slash-separated paths relative to dir.
+// Only relative paths of existing regular files that aren't .go files are
+// returned. This is enabled with "# gazelle:data_literals true", since a
+// string that happens to name a file isn't necessarily a reference to it.
+func literalFiles(c *config.Config, dir string, info fileInfo) []string {
+	fset := token.NewFileSet()
+	pf, err := parser.ParseFile(fset, info.path, nil, 0)
+	if err != nil {
+		// Errors were already reported by goFileInfo.
+		return nil
+	}
+	var files []string
+	seen := make(map[string]bool)
+	ast.Inspect(pf, func(n ast.Node) bool {
+		lit, ok := n.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		s, err := strconv.Unquote(lit.Value)
+		if err != nil || s == "" || seen[s] {
+			return true
+		}
+		seen[s] = true
+		rel := path.Clean(filepath.ToSlash(s))
+		if path.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") ||
+			strings.HasSuffix(rel, ".go") || strings.ContainsAny(rel, "*?[\n") {
+			return true
+		}
+		if inSubpackage(c, dir, path.Dir(rel)) {
+			return true
+		}
+		if st, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err == nil && st.Mode().IsRegular() {
+			files = append(files, rel)
+		}
+		return true
+	})
+	return files
+}
+
+// inSubpackage returns whether the directory rel, relative to dir, is in a
+// different Bazel package than dir, because it or a directory between them
+// has a build file.
+func inSubpackage(c *config.Config, dir, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == "" {
+		return false
+	}
+	p := dir
+	for _, name := range strings.Split(rel, "/") {
+		p = filepath.Join(p, name)
+		if hasBuildFile(c, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBuildFile returns whether dir contains a build file.
+func hasBuildFile(c *config.Config, dir string) bool {
+	for _, base := range c.ValidBuildFileNames {
+		if st, err := os.Stat(filepath.Join(dir, base)); err == nil && !st.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// AssetDir is a directory of static files embedded in a Go package with a
+// go_embed_data rule. It's declared with a directive like
+// "# gazelle:embed_data web/static" in the package's build file.
+type AssetDir struct {
+	// Dir is the slash-separated path to the directory, relative to the
+	// package directory.
+	Dir string
+
+	// Var is the name of the Go variable holding the files. If it's empty,
+	// go_embed_data's default is used.
+	Var string
+}
+
+// RuleName returns the name of the go_embed_data rule for the directory.
+func (a AssetDir) RuleName() string {
+	return strings.Replace(a.Dir, "/", "_", -1) + "_data"
+}
+
+// Out returns the name of the .go file generated by the go_embed_data rule.
+func (a AssetDir) Out() string {
+	return a.RuleName() + ".go"
+}
+
+// gazelleEmbedData is a marker in a build file that declares a directory of
+// static files to embed in the package, for example,
+// "# gazelle:embed_data web/static Static". The variable name is optional.
+// It only applies to the directory containing the build file.
+const gazelleEmbedData = "# gazelle:embed_data "
+
+// findAssetDirs returns the directories declared with "# gazelle:embed_data"
+// directives in f, the build file in dir. Directories that don't exist,
+// aren't under dir, or are in other Bazel packages are skipped with a
+// warning.
+func findAssetDirs(c *config.Config, dir string, f *bf.File) []AssetDir {
+	var assets []AssetDir
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, cm := range comments {
+			if !strings.HasPrefix(cm.Token, gazelleEmbedData) {
+				continue
+			}
+			fields := strings.Fields(cm.Token[len(gazelleEmbedData):])
+			if len(fields) < 1 || len(fields) > 2 {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: want directory and optional variable name", f.Path, cm.Token)
+				continue
+			}
+			rel := path.Clean(fields[0])
+			if path.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: directory must be below the package directory", f.Path, cm.Token)
+				continue
+			}
+			if st, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err != nil || !st.IsDir() {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: %s is not a directory", f.Path, cm.Token, rel)
+				continue
+			}
+			if inSubpackage(c, dir, rel) {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: %s is in another package", f.Path, cm.Token, rel)
+				continue
+			}
+			a := AssetDir{Dir: rel}
+			if len(fields) == 2 {
+				if !isIdentifier(fields[1]) {
+					logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: %q is not a valid variable name", f.Path, cm.Token, fields[1])
+					continue
+				}
+				a.Var = fields[1]
+			}
+			assets = append(assets, a)
+		}
+	}
+	return assets
+}
+
+// isIdentifier returns whether s is a valid Go identifier.
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != "" && !token.Lookup(s).IsKeyword()
+}
+
+// addIncludedHeaders adds headers included with #include "..." by the files
+// of t, directly or through other headers, to t.Hdrs. A header included by
+// a file listed on all platforms is listed on all platforms. Otherwise, it's
+// listed on the platforms of the files that include it.
+//
+// includes maps the names of files in dir to the paths they include. Files
+// in dir that aren't in the map were excluded, so they aren't added. Headers
+// in subdirectories are read when they're found. Included paths are resolved
+// relative to the including file, then relative to dir, the same as the
+// -iquote and -I flags cgo is run with. Headers outside dir, in
+// subpackages, or with extensions the target's rule doesn't accept are
+// skipped.
+func addIncludedHeaders(c *config.Config, dir string, t *Target, includes map[string][]string) {
+	// generic and platforms record where each file is listed, updated as
+	// headers are found.
+	generic := make(map[string]bool)
+	platforms := make(map[string]map[string]bool)
+	var queue []string
+	list := func(name, platform string) bool {
+		if generic[name] {
+			return false
+		}
+		if platform == "" {
+			generic[name] = true
+			return true
+		}
+		if platforms[name] == nil {
+			platforms[name] = make(map[string]bool)
+		}
+		if platforms[name][platform] {
+			return false
+		}
+		platforms[name][platform] = true
+		return true
+	}
+	for _, ps := range []PlatformStrings{t.Sources, t.Hdrs} {
+		for _, name := range ps.Generic {
+			list(name, "")
+			queue = append(queue, name)
+		}
+		for platform, names := range ps.Platform {
+			for _, name := range names {
+				list(name, platform)
+				queue = append(queue, name)
+			}
+		}
+	}
+	found := make(map[string]bool)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		incs, ok := includes[name]
+		if !ok && strings.Contains(name, "/") {
+			incs, _ = readIncludes(filepath.Join(dir, filepath.FromSlash(name)))
+			includes[name] = incs
+		}
+		for _, inc := range incs {
+			hdr := resolveInclude(c, dir, name, inc, t.Cgo, includes)
+			if hdr == "" {
+				continue
+			}
+			changed := false
+			if generic[name] {
+				changed = list(hdr, "")
+			} else {
+				for platform := range platforms[name] {
+					changed = list(hdr, platform) || changed
+				}
+			}
+			if changed {
+				found[hdr] = true
+				queue = append(queue, hdr)
+			}
+		}
+	}
+
+	// Headers that were already listed on all platforms aren't found, since
+	// their listing can't change.
+	var hdrs []string
+	for hdr := range found {
+		hdrs = append(hdrs, hdr)
+	}
+	sort.Strings(hdrs)
+	for _, hdr := range hdrs {
+		if !generic[hdr] {
+			for platform := range platforms[hdr] {
+				if !containsString(t.Hdrs.Platform[platform], hdr) {
+					t.Hdrs.addPlatformStrings(platform, hdr)
+				}
+			}
+			continue
+		}
+		for platform, names := range t.Hdrs.Platform {
+			if names = remove(names, map[string]bool{hdr: true}); len(names) > 0 {
+				t.Hdrs.Platform[platform] = names
+			} else {
+				delete(t.Hdrs.Platform, platform)
+			}
+		}
+		t.Hdrs.addGenericStrings(hdr)
+	}
+}
+
+// resolveInclude returns the slash-separated path, relative to dir, of the
+// header included as inc by the file from, or "" if it can't be listed.
+// See addIncludedHeaders.
+func resolveInclude(c *config.Config, dir, from, inc string, cgo bool, includes map[string][]string) string {
+	if path.IsAbs(inc) || !isIncludableHeader(inc, cgo) {
+		return ""
+	}
+	for _, rel := range []string{path.Join(path.Dir(from), inc), path.Clean(inc)} {
+		if rel == ".." || strings.HasPrefix(rel, "../") || toolchainHeaders[rel] {
+			continue
+		}
+		if !strings.Contains(rel, "/") {
+			if _, ok := includes[rel]; ok {
+				return rel
+			}
+			continue
+		}
+		if inSubpackage(c, dir, path.Dir(rel)) {
+			continue
+		}
+		if st, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err == nil && st.Mode().IsRegular() {
+			return rel
+		}
+	}
+	return ""
+}
+
+// isIncludableHeader returns whether name has an extension of a header that
+// can be listed in a target's srcs. go_library accepts .h files for
+// assembly. Rules that build cgo code accept the header extensions
+// cc_library does.
+func isIncludableHeader(name string, cgo bool) bool {
+	ext := path.Ext(name)
+	if !cgo {
+		return ext == ".h"
+	}
+	_, category, ok := extTrie.lookup(name)
+	return (ok && category == hExt) || ext == ".inc"
+}
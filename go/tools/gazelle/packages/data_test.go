@@ -0,0 +1,72 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+func TestFindAssetDirs(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "data_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"web/static", "templates", "sub"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "BUILD"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var comments []bf.Comment
+	for _, directive := range []string{
+		"# gazelle:embed_data web/static",
+		"# gazelle:embed_data templates/ Templates",
+		"# gazelle:embed_data missing",
+		"# gazelle:embed_data ../outside",
+		"# gazelle:embed_data sub",
+		"# gazelle:embed_data templates 1bad",
+	} {
+		comments = append(comments, bf.Comment{Token: directive})
+	}
+	f := &bf.File{
+		Path: filepath.Join(dir, "BUILD"),
+		Stmt: []bf.Expr{&bf.CommentBlock{Comments: bf.Comments{Before: comments}}},
+	}
+	c := &config.Config{ValidBuildFileNames: config.DefaultValidBuildFileNames}
+
+	got := findAssetDirs(c, dir, f)
+	want := []AssetDir{
+		{Dir: "web/static"},
+		{Dir: "templates", Var: "Templates"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+	if name, out := want[0].RuleName(), want[0].Out(); name != "web_static_data" || out != "web_static_data.go" {
+		t.Errorf("got rule name %q and out %q; want %q and %q", name, out, "web_static_data", "web_static_data.go")
+	}
+}
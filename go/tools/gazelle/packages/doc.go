@@ -14,4 +14,29 @@ limitations under the License.
 */
 
 // Package packages provides Go package traversal in a Bazel repository.
+//
+// Walk and Scan are supported entry points for tools other than Gazelle that
+// need to know which files make up each Go package and how they are split
+// across platforms. Files are classified the same way Gazelle classifies
+// them: build constraints, cgo, tests, and generated files are all taken into
+// account. For example:
+//
+//	c := &config.Config{
+//		RepoRoot:            root,
+//		GoPrefix:            "example.com/repo",
+//		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+//		GenericTags:         make(config.BuildTags),
+//		Platforms:           config.DefaultPlatformTags,
+//	}
+//	c.PreprocessTags()
+//	packages.Scan(c, root, func(pkg *packages.Package) {
+//		fmt.Println(pkg.Rel, pkg.Library.Sources.Generic)
+//	})
+//
+// WalkDirs visits the same directories, but it reports every directory, not
+// only those containing Go packages, so rules for other languages can be
+// generated in the same walk.
+//
+// Packages passed to callbacks are not used by the walker after the callback
+// returns, so callers may keep and modify them.
 package packages
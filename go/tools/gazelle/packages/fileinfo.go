@@ -28,10 +28,12 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
 )
 
 // fileInfo holds information used to decide how to build a file. This
@@ -73,6 +75,39 @@ type fileInfo struct {
 	// copts and clinkopts contain flags that are part of CFLAGS, CPPFLAGS,
 	// CXXFLAGS, and LDFLAGS directives in cgo comments.
 	copts, clinkopts []taggedOpts
+
+	// includes lists the paths in #include "..." directives in C, C++, and
+	// assembly files, and in the cgo comments of .go files. Paths in angle
+	// brackets name system headers, so they aren't listed.
+	includes []string
+
+	// testFuncs records the kinds of test functions declared in a test file.
+	testFuncs TestFuncs
+
+	// usesNetwork is true for test files that import a networking package,
+	// and sleeps is true for test files that call time.Sleep. These are
+	// used to choose test sizes; see config.TestSizePolicy.
+	usesNetwork, sleeps bool
+
+	// embeds is a list of patterns from "//go:embed" comments in a .go file
+	// that imports "embed".
+	embeds []string
+
+	// generate is a list of commands from "//go:generate" comments in a .go
+	// file.
+	generate []string
+
+	// goVersion is the minimum Go version needed to compile a .go file,
+	// and goVersionReason describes the feature that needs it. These are
+	// only set if the Scanner's GoVersion option is set, and they're zero if
+	// the file's build constraints already require that version.
+	goVersion       config.GoVersion
+	goVersionReason string
+
+	// data is a list of slash-separated paths, relative to the package
+	// directory, of files the file needs at run time. These are set by
+	// buildPackage from embeds and, if enabled, from string literals.
+	data []string
 }
 
 // taggedOpts a list of compile or link options which should only be applied
@@ -115,49 +150,127 @@ const (
 	protoExt
 )
 
+// extCategories maps file extensions to categories. Files with other
+// extensions are ignored. Based on go/build.Context.Import.
+var extCategories = map[string]extCategory{
+	".go":      goExt,
+	".c":       cExt,
+	".cc":      cExt,
+	".cpp":     cExt,
+	".cxx":     cExt,
+	".h":       hExt,
+	".hh":      hExt,
+	".hpp":     hExt,
+	".hxx":     hExt,
+	".s":       sExt,
+	".S":       csExt,
+	".proto":   protoExt,
+	".m":       unsupportedExt,
+	".f":       unsupportedExt,
+	".F":       unsupportedExt,
+	".for":     unsupportedExt,
+	".f90":     unsupportedExt,
+	".swig":    unsupportedExt,
+	".swigcxx": unsupportedExt,
+	".syso":    unsupportedExt,
+}
+
+// extTrie is used to categorize file names without allocating memory.
+var extTrie = newSuffixTrie(extCategories)
+
+// suffixTrie is a trie of extensions, with characters in reverse order.
+// Each extension starts with '.' and contains no other '.', so the last
+// character matched is always a '.'.
+type suffixTrie struct {
+	edges    []suffixEdge
+	isExt    bool
+	category extCategory
+}
+
+type suffixEdge struct {
+	c    byte
+	next *suffixTrie
+}
+
+func newSuffixTrie(exts map[string]extCategory) *suffixTrie {
+	root := &suffixTrie{}
+	for ext, category := range exts {
+		n := root
+		for i := len(ext) - 1; i >= 0; i-- {
+			n = n.add(ext[i])
+		}
+		n.isExt = true
+		n.category = category
+	}
+	return root
+}
+
+func (n *suffixTrie) add(c byte) *suffixTrie {
+	if next := n.child(c); next != nil {
+		return next
+	}
+	next := &suffixTrie{}
+	n.edges = append(n.edges, suffixEdge{c, next})
+	return next
+}
+
+func (n *suffixTrie) child(c byte) *suffixTrie {
+	for _, e := range n.edges {
+		if e.c == c {
+			return e.next
+		}
+	}
+	return nil
+}
+
+// lookup returns the extension of name and its category. ok is false if
+// the extension is not in the trie.
+func (n *suffixTrie) lookup(name string) (ext string, category extCategory, ok bool) {
+	for i := len(name) - 1; i >= 0; i-- {
+		if n = n.child(name[i]); n == nil {
+			return "", ignoredExt, false
+		}
+		if name[i] == '.' {
+			return name[i:], n.category, n.isExt
+		}
+	}
+	return "", ignoredExt, false
+}
+
 // fileNameInfo returns information that can be inferred from the name of
-// a file. It does not read data from the file.
+// a file. It does not read data from the file. Since this is called for
+// every file in the tree, it avoids allocating memory, other than for the
+// file's path.
 func fileNameInfo(dir, name string) fileInfo {
-	ext := path.Ext(name)
-
-	// Categorize the file based on extension. Based on go/build.Context.Import.
-	var category extCategory
-	switch ext {
-	case ".go":
-		category = goExt
-	case ".c", ".cc", ".cpp", ".cxx":
-		category = cExt
-	case ".h", ".hh", ".hpp", ".hxx":
-		category = hExt
-	case ".s":
-		category = sExt
-	case ".S":
-		category = csExt
-	case ".proto":
-		category = protoExt
-	case ".m", ".f", ".F", ".for", ".f90", ".swig", ".swigcxx", ".syso":
-		category = unsupportedExt
-	default:
+	// Categorize the file based on extension.
+	ext, category, ok := extTrie.lookup(name)
+	if !ok {
+		ext = path.Ext(name)
 		category = ignoredExt
 	}
 
 	// Determine test, goos, and goarch. This is intended to match the logic
-	// in goodOSArchFile in go/build.
+	// in goodOSArchFile in go/build, which splits the stem on "_" and checks
+	// the last few elements.
 	var isTest bool
 	var goos, goarch string
-	l := strings.Split(name[:len(name)-len(ext)], "_")
-	if len(l) >= 2 && l[len(l)-1] == "test" {
+	stem := name[:len(name)-len(ext)]
+	if i := strings.LastIndexByte(stem, '_'); i >= 0 && stem[i+1:] == "test" {
 		isTest = category == goExt
-		l = l[:len(l)-1]
+		stem = stem[:i]
 	}
-	switch {
-	case len(l) >= 3 && knownOS[l[len(l)-2]] && knownArch[l[len(l)-1]]:
-		goos = l[len(l)-2]
-		goarch = l[len(l)-1]
-	case len(l) >= 2 && knownOS[l[len(l)-1]]:
-		goos = l[len(l)-1]
-	case len(l) >= 2 && knownArch[l[len(l)-1]]:
-		goarch = l[len(l)-1]
+	if i := strings.LastIndexByte(stem, '_'); i >= 0 {
+		last := stem[i+1:]
+		j := strings.LastIndexByte(stem[:i], '_')
+		switch {
+		case j >= 0 && knownOS[stem[j+1:i]] && knownArch[last]:
+			goos = stem[j+1 : i]
+			goarch = last
+		case knownOS[last]:
+			goos = last
+		case knownArch[last]:
+			goarch = last
+		}
 	}
 
 	return fileInfo{
@@ -172,13 +285,24 @@ func fileNameInfo(dir, name string) fileInfo {
 	}
 }
 
-// goFileInfo returns information about a .go file. It will parse part of the
-// file to determine the package name and imports.
+// goFileInfo returns information about a .go file. It will parse as much of
+// the file as s.opts needs: the package clause, the imports, or the whole
+// file. Test files are parsed completely, so test functions can be found.
 // This function is intended to match go/build.Context.Import.
-func goFileInfo(c *config.Config, dir, name string) (fileInfo, error) {
+func (s *Scanner) goFileInfo(dir, name string) (fileInfo, error) {
+	c := s.c
 	info := fileNameInfo(dir, name)
 	fset := token.NewFileSet()
-	pf, err := parser.ParseFile(fset, info.path, nil, parser.ImportsOnly|parser.ParseComments)
+	var mode parser.Mode
+	switch {
+	case info.isTest || s.opts.Generate || s.opts.GoVersion:
+		mode = parser.ParseComments
+	case s.opts.Imports || s.opts.Cgo || s.opts.Embeds:
+		mode = parser.ImportsOnly | parser.ParseComments
+	default:
+		mode = parser.PackageClauseOnly
+	}
+	pf, err := parser.ParseFile(fset, info.path, nil, mode)
 	if err != nil {
 		return fileInfo{}, err
 	}
@@ -189,6 +313,8 @@ func goFileInfo(c *config.Config, dir, name string) (fileInfo, error) {
 		info.packageName = info.packageName[:len(info.packageName)-len("_test")]
 	}
 
+	importsEmbed := false
+	timeName := ""
 	for _, decl := range pf.Decls {
 		d, ok := decl.(*ast.GenDecl)
 		if !ok {
@@ -205,42 +331,246 @@ func goFileInfo(c *config.Config, dir, name string) (fileInfo, error) {
 				return fileInfo{}, err
 			}
 
-			if path == "C" {
-				if info.isTest {
-					return fileInfo{}, fmt.Errorf("%s: use of cgo in test not supported", info.path)
+			if path == "embed" {
+				importsEmbed = true
+			}
+			if info.isTest {
+				if networkPackages[path] {
+					info.usesNetwork = true
 				}
+				if path == "time" {
+					timeName = "time"
+					if spec.Name != nil {
+						timeName = spec.Name.Name
+					}
+				}
+			}
+			if path == "C" {
 				info.isCgo = true
 				cg := spec.Doc
 				if cg == nil && len(d.Specs) == 1 {
 					cg = d.Doc
 				}
-				if cg != nil {
-					if err := saveCgo(&info, cg); err != nil {
+				if cg != nil && s.opts.Cgo {
+					if err := saveCgo(c, &info, cg); err != nil {
 						return fileInfo{}, err
 					}
 				}
-			} else if !isStandard(c.GoPrefix, path) {
-				info.imports = append(info.imports, path)
+			} else if s.opts.Imports && !isStandard(c.GoPrefix, path) {
+				info.imports = append(info.imports, s.strings.intern(path))
+			}
+		}
+	}
+
+	if info.isTest {
+		info.testFuncs = findTestFuncs(pf)
+		info.sleeps = callsSleep(pf, timeName)
+	}
+
+	if importsEmbed && s.opts.Embeds {
+		if mode&parser.ImportsOnly != 0 {
+			// "//go:embed" comments come after the imports, so they weren't
+			// parsed the first time.
+			pf, err = parser.ParseFile(fset, info.path, nil, parser.ParseComments)
+			if err != nil {
+				return fileInfo{}, err
 			}
 		}
+		info.embeds, err = findEmbedPatterns(pf)
+		if err != nil {
+			return fileInfo{}, fmt.Errorf("%s: %v", info.path, err)
+		}
+	}
+
+	if s.opts.Generate {
+		info.generate = findGenerateDirectives(pf)
 	}
 
 	tags, err := readTags(info.path)
 	if err != nil {
 		return fileInfo{}, err
 	}
+	s.strings.internAll(tags)
 	info.tags = tags
+	for _, opts := range [][]taggedOpts{info.copts, info.clinkopts} {
+		for i := range opts {
+			opts[i].opts = s.strings.intern(opts[i].opts)
+		}
+	}
+
+	if s.opts.GoVersion {
+		v, reason := detectGoVersion(pf)
+		if releaseTagVersion(info.tags).Less(v) {
+			info.goVersion, info.goVersionReason = v, reason
+		}
+	}
 
 	return info, nil
 }
 
+// findEmbedPatterns returns the patterns in "//go:embed" comments in f.
+// Patterns are separated by spaces and may be quoted with double quotes or
+// back quotes, like arguments to the go command.
+func findEmbedPatterns(f *ast.File) ([]string, error) {
+	var patterns []string
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if !strings.HasPrefix(c.Text, "//go:embed") {
+				continue
+			}
+			args := c.Text[len("//go:embed"):]
+			if args != "" && args[0] != ' ' && args[0] != '\t' {
+				continue
+			}
+			ps, err := splitEmbedArgs(args)
+			if err != nil {
+				return nil, err
+			}
+			patterns = append(patterns, ps...)
+		}
+	}
+	return patterns, nil
+}
+
+// splitEmbedArgs splits the arguments of a "//go:embed" comment.
+func splitEmbedArgs(args string) ([]string, error) {
+	var patterns []string
+	for {
+		args = strings.TrimLeft(args, " \t")
+		if args == "" {
+			return patterns, nil
+		}
+		n := quotedLen(args)
+		if n == 0 {
+			n = strings.IndexAny(args, " \t")
+			if n < 0 {
+				n = len(args)
+			}
+			patterns = append(patterns, args[:n])
+			args = args[n:]
+			continue
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("unterminated quoted string in //go:embed: %s", args)
+		}
+		arg, err := strconv.Unquote(args[:n])
+		if err != nil || n < len(args) && args[n] != ' ' && args[n] != '\t' {
+			return nil, fmt.Errorf("invalid quoted string in //go:embed: %s", args)
+		}
+		patterns = append(patterns, arg)
+		args = args[n:]
+	}
+}
+
+// quotedLen returns the length of the quoted string at the beginning of s,
+// including the quotes. It returns 0 if s doesn't begin with a quote and -1
+// if the quote isn't closed.
+func quotedLen(s string) int {
+	switch s[0] {
+	case '`':
+		if i := strings.IndexByte(s[1:], '`'); i >= 0 {
+			return i + 2
+		}
+		return -1
+	case '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1
+			}
+		}
+		return -1
+	default:
+		return 0
+	}
+}
+
+// findTestFuncs returns the kinds of test functions declared in f. Functions
+// are recognized by name, the same way "go test" recognizes them.
+func findTestFuncs(f *ast.File) TestFuncs {
+	var funcs TestFuncs
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil {
+			continue
+		}
+		name := fn.Name.Name
+		switch {
+		case name == "TestMain":
+			funcs.TestMain = true
+		case isTestFunc(name, "Test"):
+			funcs.Tests = true
+		case isTestFunc(name, "Benchmark"):
+			funcs.Benchmarks = true
+		case isTestFunc(name, "Example"):
+			funcs.Examples = true
+		case isTestFunc(name, "Fuzz"):
+			funcs.Fuzz = true
+		}
+	}
+	return funcs
+}
+
+// networkPackages are standard packages whose import suggests a test uses the
+// network, even if only on the loopback interface.
+var networkPackages = map[string]bool{
+	"net":               true,
+	"net/http":          true,
+	"net/http/httptest": true,
+	"net/rpc":           true,
+	"net/smtp":          true,
+	"crypto/tls":        true,
+}
+
+// callsSleep returns whether f calls Sleep from the "time" package, imported
+// with the name timeName. It returns false if timeName is empty or "_".
+func callsSleep(f *ast.File, timeName string) bool {
+	if timeName == "" || timeName == "_" {
+		return false
+	}
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		if sel, ok := n.(*ast.SelectorExpr); ok && sel.Sel.Name == "Sleep" {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == timeName {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// isTestFunc returns whether name is prefix followed by nothing or by a
+// character that is not a lower case letter, like "TestFoo" or "Test_foo"
+// but not "Testing".
+func isTestFunc(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
 // saveCgo extracts CFLAGS, CPPFLAGS, CXXFLAGS, and LDFLAGS directives
 // from a comment above a "C" import. This is intended to match logic in
-// go/build.Context.saveCgo.
-func saveCgo(info *fileInfo, cg *ast.CommentGroup) error {
+// go/build.Context.saveCgo. Variables other than ${SRCDIR} are expanded
+// according to c.CgoVars.
+func saveCgo(c *config.Config, info *fileInfo, cg *ast.CommentGroup) error {
 	text := cg.Text()
 	for _, line := range strings.Split(text, "\n") {
 		orig := line
+		if inc, ok := parseInclude(line); ok {
+			info.includes = append(info.includes, inc)
+			continue
+		}
 
 		// Line is
 		//	#cgo [GOOS/GOARCH...] LDFLAGS: stuff
@@ -271,12 +601,13 @@ func saveCgo(info *fileInfo, cg *ast.CommentGroup) error {
 		if err != nil {
 			return fmt.Errorf("%s: invalid #cgo line: %s", info.path, orig)
 		}
-		var ok bool
 		for i, opt := range opts {
-			if opt, ok = expandSrcDir(opt, info.dir); !ok {
-				return fmt.Errorf("%s: malformed #cgo argument: %s", info.path, orig)
+			if opt, err = expandCgoVars(c, opt, info.dir); err != nil {
+				return fmt.Errorf("%s: %v: %s", info.path, err, orig)
 			}
-			opts[i] = opt
+			// Arguments are quoted, so Bazel splits the joined string back
+			// into the same arguments.
+			opts[i] = quoteOpt(opt)
 		}
 
 		// Add tags to appropriate list.
@@ -356,6 +687,100 @@ func splitQuoted(s string) (r []string, err error) {
 	return args, err
 }
 
+// quoteOpt quotes a compiler or linker argument for Bourne shell
+// tokenization, which Bazel applies to copts and clinkopts. Arguments
+// without white space, quotes, or backslashes are returned unchanged.
+// Others are wrapped in single quotes, so an argument like
+// -DNAME="some value" in a cgo comment is written as '-DNAME=some value'.
+func quoteOpt(opt string) string {
+	if opt != "" && !strings.ContainsAny(opt, " \t\n\r'\"\\") {
+		return opt
+	}
+	return "'" + strings.Replace(opt, "'", `'\''`, -1) + "'"
+}
+
+// expandCgoVars expands variables written like ${NAME} in the cgo argument
+// opt. ${SRCDIR} is expanded to srcdir with expandQuotedSrcDir, which also
+// checks that the rest of opt is safe. Other variables are expanded
+// according to their policies in c.CgoVars; values aren't checked, since
+// they're configured by the user.
+func expandCgoVars(c *config.Config, opt, srcdir string) (string, error) {
+	var buf bytes.Buffer
+	flag := strings.HasPrefix(opt, "-")
+	literal := func(s string) error {
+		if s == "" {
+			return nil
+		}
+		s, ok := expandQuotedSrcDir(s, srcdir, flag)
+		if !ok {
+			return errors.New("malformed #cgo argument")
+		}
+		buf.WriteString(s)
+		return nil
+	}
+	rest := opt
+	start := 0
+	for {
+		i := strings.Index(rest[start:], "${")
+		if i < 0 {
+			break
+		}
+		i += start
+		j := strings.IndexByte(rest[i:], '}')
+		if j < 0 {
+			break
+		}
+		name := rest[i+len("${") : i+j]
+		if name == "SRCDIR" || !config.IsCgoVarName(name) {
+			start = i + j + 1
+			continue
+		}
+		if err := literal(rest[:i]); err != nil {
+			return "", err
+		}
+		v, ok := c.CgoVars[name]
+		switch {
+		case !ok || v.Policy == config.RejectCgoVar:
+			return "", fmt.Errorf("#cgo variable ${%s} is not allowed; configure it with -cgo_var", name)
+		case v.Policy == config.PassCgoVar:
+			buf.WriteString("$${" + name + "}")
+		default:
+			buf.WriteString(v.Value)
+		}
+		rest, start = rest[i+j+1:], 0
+	}
+	if err := literal(rest); err != nil {
+		return "", err
+	}
+	if buf.Len() == 0 {
+		return "", errors.New("malformed #cgo argument")
+	}
+	return buf.String(), nil
+}
+
+// expandQuotedSrcDir is like expandSrcDir, but if flag is true, str may also
+// contain spaces, as in -DNAME="some value". Since splitQuoted splits
+// arguments at unquoted spaces, these can only come from quoted flags.
+// go/build rejects them, but they're safe here, since quoteOpt quotes the
+// flag again when it's written. The parts between spaces are checked with
+// expandSrcDir. Spaces in other arguments are rejected, as in go/build.
+func expandQuotedSrcDir(str, srcdir string, flag bool) (string, bool) {
+	if !flag || !strings.Contains(str, " ") {
+		return expandSrcDir(str, srcdir)
+	}
+	parts := strings.Split(str, " ")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		var ok bool
+		if parts[i], ok = expandSrcDir(part, srcdir); !ok {
+			return "", false
+		}
+	}
+	return strings.Join(parts, " "), true
+}
+
 // expandSrcDir expands any occurrence of ${SRCDIR}, making sure
 // the result is safe for the shell.
 //
@@ -421,7 +846,11 @@ func otherFileInfo(dir, name string) (fileInfo, error) {
 		return info, nil
 	}
 	if info.category == unsupportedExt {
-		return fileInfo{}, fmt.Errorf("%s: file extension not yet supported", name)
+		return fileInfo{}, &logging.FileError{
+			Kind: logging.UnsupportedExtension,
+			Path: info.path,
+			Err:  errors.New("file extension not yet supported"),
+		}
 	}
 
 	if tags, err := readTags(info.path); err != nil {
@@ -429,6 +858,14 @@ func otherFileInfo(dir, name string) (fileInfo, error) {
 	} else {
 		info.tags = tags
 	}
+	switch info.category {
+	case cExt, hExt, sExt, csExt:
+		includes, err := readIncludes(info.path)
+		if err != nil {
+			return fileInfo{}, err
+		}
+		info.includes = includes
+	}
 	return info, nil
 }
 
@@ -459,46 +896,142 @@ func readTags(path string) ([]string, error) {
 		return nil, err
 	}
 	defer f.Close()
+	buf := scanBufPool.Get().(*[]byte)
+	defer scanBufPool.Put(buf)
 	scanner := bufio.NewScanner(f)
+	scanner.Buffer(*buf, bufio.MaxScanTokenSize)
 
-	// Pass 1: Identify leading run of // comments and blank lines,
-	// which must be followed by a blank line.
-	var lines []string
-	end := 0
+	// Find the leading run of // comments and blank lines, which must be
+	// followed by a blank line. +build lines are kept in pending until the
+	// next blank line is found.
+	var buildComments, pending []string
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			end = len(lines)
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			buildComments = append(buildComments, pending...)
+			pending = pending[:0]
+			continue
+		}
+		if !bytes.HasPrefix(line, slashSlash) {
+			break
+		}
+		line = bytes.TrimSpace(line[len(slashSlash):])
+		if !bytes.HasPrefix(line, plusBuild) {
 			continue
 		}
-		if strings.HasPrefix(line, "//") {
-			lines = append(lines, line[len("//"):])
+		line = line[len(plusBuild):]
+		if r, _ := utf8.DecodeRune(line); len(line) > 0 && !unicode.IsSpace(r) {
 			continue
 		}
-		break
+		pending = append(pending, strings.Join(strings.Fields(string(line)), " "))
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
-	lines = lines[:end]
+	return buildComments, nil
+}
 
-	// Pass 2: Process each line in the run.
-	var buildComments []string
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) > 0 && fields[0] == "+build" {
-			buildComments = append(buildComments, strings.Join(fields[1:], " "))
+// readIncludes returns the paths in #include "..." directives in the file
+// at path. Directives are found without preprocessing the file, so
+// includes in conditional blocks are returned too.
+func readIncludes(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := scanBufPool.Get().(*[]byte)
+	defer scanBufPool.Put(buf)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(*buf, bufio.MaxScanTokenSize)
+
+	var includes []string
+	for scanner.Scan() {
+		if inc, ok := parseInclude(scanner.Text()); ok {
+			includes = append(includes, inc)
 		}
 	}
-	return buildComments, nil
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return includes, nil
+}
+
+// parseInclude returns the path in line if it's an #include "..."
+// directive. Spaces are allowed around the '#', as in C.
+func parseInclude(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "#") {
+		return "", false
+	}
+	line = strings.TrimSpace(line[1:])
+	if !strings.HasPrefix(line, "include") {
+		return "", false
+	}
+	line = strings.TrimSpace(line[len("include"):])
+	if len(line) < 2 || line[0] != '"' {
+		return "", false
+	}
+	end := strings.IndexByte(line[1:], '"')
+	if end <= 0 {
+		return "", false
+	}
+	return line[1 : end+1], true
 }
 
+var (
+	slashSlash = []byte("//")
+	plusBuild  = []byte("+build")
+
+	// scanBufPool holds buffers for scanning files in readTags.
+	scanBufPool = sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, 4096)
+			return &buf
+		},
+	}
+)
+
 // hasConstraints returns true if a file has goos, goarch filename suffixes
 // or build tags.
 func (fi *fileInfo) hasConstraints() bool {
 	return fi.goos != "" || fi.goarch != "" || len(fi.tags) > 0
 }
 
+// hasTag returns whether tag appears in the file's build constraint lines,
+// negated or not.
+func (fi *fileInfo) hasTag(tag string) bool {
+	for _, line := range fi.tags {
+		for _, t := range strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == ',' }) {
+			if strings.TrimPrefix(t, "!") == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isGeneric returns whether a file should be built on all platforms.
+// needsCgo tells whether the file can only be built with cgo.
+//
+// Usually, this is true if the file's constraints are satisfied by
+// c.GenericTags. When cgo is only available on some platforms, files that
+// need cgo or mention the "cgo" tag are checked on each platform instead.
+// Otherwise, a cgo file with "// +build !windows" would be built on windows
+// even if cgo is unavailable there, and a "// +build !cgo" fallback would be
+// built alongside the cgo code it replaces.
+func (fi *fileInfo) isGeneric(c *config.Config, needsCgo bool) bool {
+	if !c.CgoVaries() || len(c.Platforms) == 0 || !needsCgo && !fi.hasTag("cgo") {
+		return !fi.hasConstraints() || fi.checkConstraints(c.GenericTags)
+	}
+	for _, tags := range c.Platforms {
+		if needsCgo && !tags["cgo"] || !fi.checkConstraints(tags) {
+			return false
+		}
+	}
+	return true
+}
+
 // checkConstraints determines whether a file should be built on a platform
 // with the given tags. It returns true for files without constraints.
 func (fi *fileInfo) checkConstraints(tags map[string]bool) bool {
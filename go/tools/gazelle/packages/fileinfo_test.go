@@ -141,13 +141,90 @@ package route
 				tags:        []string{"darwin dragonfly freebsd netbsd openbsd"},
 			},
 		},
+		{
+			"test functions",
+			"foo_test.go",
+			`package foo
+
+import "testing"
+
+func TestMain(m *testing.M) {}
+
+func BenchmarkFoo(b *testing.B) {}
+
+func Example_foo() {}
+
+func Testing() {}
+
+func (x) TestMethod(t *testing.T) {}
+`,
+			fileInfo{
+				packageName: "foo",
+				isTest:      true,
+				testFuncs:   TestFuncs{Benchmarks: true, Examples: true, TestMain: true},
+			},
+		},
+		{
+			"fuzz functions",
+			"foo_test.go",
+			`package foo
+
+func Test(t *testing.T) {}
+
+func FuzzFoo(f *testing.F) {}
+`,
+			fileInfo{
+				packageName: "foo",
+				isTest:      true,
+				testFuncs:   TestFuncs{Tests: true, Fuzz: true},
+			},
+		},
+		{
+			"network and sleep",
+			"foo_test.go",
+			`package foo
+
+import (
+	"net/http/httptest"
+	clock "time"
+)
+
+func TestFoo(t *testing.T) {
+	clock.Sleep(clock.Second)
+}
+`,
+			fileInfo{
+				packageName: "foo",
+				isTest:      true,
+				testFuncs:   TestFuncs{Tests: true},
+				usesNetwork: true,
+				sleeps:      true,
+			},
+		},
+		{
+			"embed patterns",
+			"foo.go",
+			`package foo
+
+import _ "embed"
+
+//go:embed version.txt "static/a b.html" all:static
+var f string
+
+//go:embedded not a pattern
+`,
+			fileInfo{
+				packageName: "foo",
+				embeds:      []string{"version.txt", "static/a b.html", "all:static"},
+			},
+		},
 	} {
 		if err := ioutil.WriteFile(tc.name, []byte(tc.source), 0600); err != nil {
 			t.Fatal(err)
 		}
 		defer os.Remove(tc.name)
 
-		got, err := goFileInfo(c, dir, tc.name)
+		got, err := NewScanner(c, BuildScanOptions).goFileInfo(dir, tc.name)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -160,6 +237,10 @@ package route
 			imports:     got.imports,
 			isCgo:       got.isCgo,
 			tags:        got.tags,
+			testFuncs:   got.testFuncs,
+			usesNetwork: got.usesNetwork,
+			sleeps:      got.sleeps,
+			embeds:      got.embeds,
 		}
 
 		if !reflect.DeepEqual(got, tc.want) {
@@ -191,13 +272,16 @@ import "C"
 			"invalid #cgo line",
 		},
 		{
-			"cgo in test",
-			"foo_test.go",
+			"embed error",
+			"foo.go",
 			`package foo
 
-import "C"
+import _ "embed"
+
+//go:embed "unterminated
+var f string
 `,
-			"use of cgo in test not supported",
+			"unterminated quoted string",
 		},
 	} {
 		if err := ioutil.WriteFile(tc.name, []byte(tc.source), 0600); err != nil {
@@ -206,7 +290,7 @@ import "C"
 		defer os.Remove(tc.name)
 
 		var errorText string
-		if _, err := goFileInfo(c, dir, tc.name); err != nil {
+		if _, err := NewScanner(c, BuildScanOptions).goFileInfo(dir, tc.name); err != nil {
 			errorText = err.Error()
 		}
 
@@ -494,6 +578,29 @@ func TestFileNameInfo(t *testing.T) {
 				category: ignoredExt,
 			},
 		},
+		{
+			"ignored file with known suffix",
+			"foo.xgo",
+			fileInfo{
+				ext:      ".xgo",
+				category: ignoredExt,
+			},
+		},
+		{
+			"known extension after another",
+			"foo.pb.go",
+			fileInfo{
+				ext:      ".go",
+				category: goExt,
+			},
+		},
+		{
+			"no extension",
+			"go",
+			fileInfo{
+				category: ignoredExt,
+			},
+		},
 	} {
 		tc.want.name = tc.name
 		tc.want.dir = "dir"
@@ -505,6 +612,27 @@ func TestFileNameInfo(t *testing.T) {
 	}
 }
 
+func BenchmarkFileNameInfo(b *testing.B) {
+	names := []string{
+		"foo.go",
+		"foo_test.go",
+		"foo_linux_amd64.go",
+		"foo_windows_test.go",
+		"foo.pb.go",
+		"foo.cc",
+		"foo.h",
+		"foo_amd64.s",
+		"foo.proto",
+		"README.md",
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, name := range names {
+			fileNameInfo("dir", name)
+		}
+	}
+}
+
 func TestCgo(t *testing.T) {
 	c := &config.Config{}
 	dir := "."
@@ -581,6 +709,26 @@ import "C"
 				},
 			},
 		},
+		{
+			"quoted flags",
+			`package foo
+
+/*
+#cgo CFLAGS: -DNAME="some value" '-DOTHER=x'
+#cgo LDFLAGS: -Wl,-rpath,'/opt/my libs' -lfoo
+*/
+import "C"
+`,
+			fileInfo{
+				isCgo: true,
+				copts: []taggedOpts{
+					{opts: "'-DNAME=some value' -DOTHER=x"},
+				},
+				clinkopts: []taggedOpts{
+					{opts: "'-Wl,-rpath,/opt/my libs' -lfoo"},
+				},
+			},
+		},
 		{
 			"comment above single import group",
 			`package foo
@@ -604,7 +752,7 @@ import ("C")
 		}
 		defer os.Remove(path)
 
-		got, err := goFileInfo(c, dir, path)
+		got, err := NewScanner(c, BuildScanOptions).goFileInfo(dir, path)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -656,6 +804,24 @@ import "C"
 `,
 			"malformed #cgo argument",
 		},
+		{
+			"bad quoted cgo flag",
+			`package foo
+
+// #cgo CFLAGS: '-DNAME=some;value'
+import "C"
+`,
+			"malformed #cgo argument",
+		},
+		{
+			"unconfigured cgo variable",
+			`package foo
+
+// #cgo LDFLAGS: -L${PKG_CONFIG_PATH}/lib
+import "C"
+`,
+			"${PKG_CONFIG_PATH} is not allowed",
+		},
 	} {
 		path := "TestCgoFailures.go"
 		if err := ioutil.WriteFile(path, []byte(tc.source), 0600); err != nil {
@@ -664,7 +830,7 @@ import "C"
 		defer os.Remove(path)
 
 		var errorText string
-		if _, err := goFileInfo(c, dir, path); err != nil {
+		if _, err := NewScanner(c, BuildScanOptions).goFileInfo(dir, path); err != nil {
 			errorText = err.Error()
 		}
 
@@ -707,6 +873,45 @@ func TestExpandSrcDir(t *testing.T) {
 	}
 }
 
+func TestExpandCgoVars(t *testing.T) {
+	c := &config.Config{
+		CgoVars: map[string]config.CgoVar{
+			"GEN":     {Policy: config.MapCgoVar, Value: "$(GENDIR)/include"},
+			"PREFIX":  {Policy: config.PassCgoVar},
+			"FORBIDS": {Policy: config.RejectCgoVar},
+		},
+	}
+	for _, tc := range []struct {
+		opt, want, wantErr string
+	}{
+		{opt: "-O2", want: "-O2"},
+		{opt: "-I${GEN}", want: "-I$(GENDIR)/include"},
+		{opt: "-L${PREFIX}/lib", want: "-L$${PREFIX}/lib"},
+		{opt: "-I${SRCDIR}/a:${GEN}", want: "-I/src/a:$(GENDIR)/include"},
+		{opt: "${GEN}", want: "$(GENDIR)/include"},
+		{opt: "-L${FORBIDS}", wantErr: "${FORBIDS} is not allowed"},
+		{opt: "-L${OTHER}", wantErr: "${OTHER} is not allowed"},
+		{opt: "-I${GEN};", wantErr: "malformed"},
+		{opt: "-I${not-a-var}", wantErr: "malformed"},
+		{opt: "", wantErr: "malformed"},
+	} {
+		got, err := expandCgoVars(c, tc.opt, "/src")
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expandCgoVars(%q): got %q, %v; want error containing %q", tc.opt, got, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandCgoVars(%q) failed: %v", tc.opt, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expandCgoVars(%q): got %q; want %q", tc.opt, got, tc.want)
+		}
+	}
+}
+
 // Copied from go/build build_test.go
 func TestShellSafety(t *testing.T) {
 	tests := []struct {
@@ -731,6 +936,63 @@ func TestShellSafety(t *testing.T) {
 	}
 }
 
+func TestExpandQuotedSrcDir(t *testing.T) {
+	for _, tc := range []struct {
+		input, srcdir string
+		flag          bool
+		want          string
+		ok            bool
+	}{
+		{"-DNAME=some value", "/src", true, "-DNAME=some value", true},
+		{"-I${SRCDIR}/my include", "/projects/src/issue 11868", true, "-I/projects/src/issue 11868/my include", true},
+		{"-DNAME=some;value", "/src", true, "", false},
+		{"-DNAME=a b;c", "/src", true, "", false},
+		{"foo bar", "/src", false, "foo bar", false},
+		{"-I/tmp", "/src", true, "-I/tmp", true},
+	} {
+		got, ok := expandQuotedSrcDir(tc.input, tc.srcdir, tc.flag)
+		if ok != tc.ok || ok && got != tc.want {
+			t.Errorf("expandQuotedSrcDir(%q, %q, %t): got %q, %t; want %q, %t", tc.input, tc.srcdir, tc.flag, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestQuoteOpt(t *testing.T) {
+	for _, tc := range []struct {
+		opt, want string
+	}{
+		{"-O2", "-O2"},
+		{"-DNAME=some value", "'-DNAME=some value'"},
+		{"-I/projects/src/issue 11868/include", "'-I/projects/src/issue 11868/include'"},
+		{"it's", `'it'\''s'`},
+		{"", "''"},
+	} {
+		if got := quoteOpt(tc.opt); got != tc.want {
+			t.Errorf("quoteOpt(%q): got %q; want %q", tc.opt, got, tc.want)
+		}
+	}
+}
+
+func TestParseInclude(t *testing.T) {
+	for _, tc := range []struct {
+		line, want string
+		ok         bool
+	}{
+		{`#include "foo.h"`, "foo.h", true},
+		{`  #  include  "sub/foo.h" // comment`, "sub/foo.h", true},
+		{`#include <stdio.h>`, "", false},
+		{`#include ""`, "", false},
+		{`#include "foo.h`, "", false},
+		{`#includes "foo.h"`, "", false},
+		{`#define INCLUDE "foo.h"`, "", false},
+		{`// #include "foo.h"`, "", false},
+	} {
+		if got, ok := parseInclude(tc.line); got != tc.want || ok != tc.ok {
+			t.Errorf("parseInclude(%q): got %q, %v; want %q, %v", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
 func TestIsStandard(t *testing.T) {
 	for _, tc := range []struct {
 		goPrefix, importpath string
@@ -835,6 +1097,37 @@ package main`,
 	}
 }
 
+func BenchmarkReadTags(b *testing.B) {
+	f, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "BenchmarkReadTags")
+	if err != nil {
+		b.Fatal(err)
+	}
+	path := f.Name()
+	defer os.Remove(path)
+	content := `// Copyright 2017 The Bazel Authors. All rights reserved.
+
+// +build linux darwin
+// +build amd64
+
+package foo
+
+import "fmt"
+`
+	if _, err := f.WriteString(content); err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := readTags(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestCheckConstraints(t *testing.T) {
 	for _, tc := range []struct {
 		desc string
@@ -0,0 +1,137 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"go/ast"
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+// stdPackageVersions maps standard packages to the Go versions that added
+// them. Only packages added after Go 1.0 are listed.
+var stdPackageVersions = map[string]config.GoVersion{
+	"context":        go1(7),
+	"plugin":         go1(8),
+	"math/bits":      go1(9),
+	"crypto/ed25519": go1(13),
+	"hash/maphash":   go1(14),
+	"embed":          go1(16),
+	"io/fs":          go1(16),
+}
+
+// stdSymbolVersions maps standard packages to exported names added to them
+// after the packages themselves, and the Go versions that added them. It's
+// a selection of commonly used names, not a complete list.
+var stdSymbolVersions = map[string]map[string]config.GoVersion{
+	"errors":  {"As": go1(13), "Is": go1(13), "Unwrap": go1(13)},
+	"io":      {"Discard": go1(16), "NopCloser": go1(16), "ReadAll": go1(16)},
+	"os":      {"ReadDir": go1(16), "ReadFile": go1(16), "WriteFile": go1(16)},
+	"sort":    {"Slice": go1(8), "SliceStable": go1(8)},
+	"strings": {"Builder": go1(10)},
+	"sync":    {"Map": go1(9)},
+	"testing": {"F": go1(18)},
+}
+
+// go1 returns the Go version 1.minor.
+func go1(minor int) config.GoVersion {
+	return config.GoVersion{Major: 1, Minor: minor}
+}
+
+// detectGoVersion returns the minimum Go version needed to compile f and a
+// short description of the feature that needs it, like "type alias". It
+// returns a zero version if f doesn't need anything newer than Go 1.0.
+// Language features are recognized syntactically, and standard library
+// names are recognized from the tables above, so this is a lower bound.
+func detectGoVersion(f *ast.File) (config.GoVersion, string) {
+	var version config.GoVersion
+	var reason string
+	require := func(v config.GoVersion, why string) {
+		if version.Less(v) {
+			version, reason = v, why
+		}
+	}
+
+	imports := make(map[string]string)
+	for _, spec := range f.Imports {
+		imp, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		if v, ok := stdPackageVersions[imp]; ok {
+			require(v, "package "+imp)
+		}
+		name := path.Base(imp)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		if name != "_" && name != "." {
+			imports[name] = imp
+		}
+	}
+
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.TypeSpec:
+			if n.Assign.IsValid() {
+				require(go1(9), "type alias")
+			}
+		case *ast.BasicLit:
+			if n.Kind == token.INT || n.Kind == token.FLOAT || n.Kind == token.IMAG {
+				lit := strings.ToLower(n.Value)
+				if strings.Contains(lit, "_") || strings.HasPrefix(lit, "0b") || strings.HasPrefix(lit, "0o") {
+					require(go1(13), "number literal "+n.Value)
+				}
+			}
+		case *ast.SelectorExpr:
+			x, ok := n.X.(*ast.Ident)
+			if !ok || x.Obj != nil {
+				// Package names are never resolved to objects by the parser,
+				// so x is a local variable or type if Obj is set.
+				return true
+			}
+			if imp, ok := imports[x.Name]; ok {
+				if v, ok := stdSymbolVersions[imp][n.Sel.Name]; ok {
+					require(v, imp+"."+n.Sel.Name)
+				}
+			}
+		}
+		return true
+	})
+	return version, reason
+}
+
+// releaseTagVersion returns the newest Go version named by a release tag,
+// like "go1.9", in tags without being negated. Files with these constraints
+// are only built by that version and later, so they may use its features.
+func releaseTagVersion(tags []string) config.GoVersion {
+	var version config.GoVersion
+	for _, line := range tags {
+		for _, term := range strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == ',' }) {
+			if !strings.HasPrefix(term, "go1.") {
+				continue
+			}
+			if v, err := config.ParseGoVersion(term); err == nil && version.Less(v) {
+				version = v
+			}
+		}
+	}
+	return version
+}
@@ -0,0 +1,129 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+func TestDetectGoVersion(t *testing.T) {
+	for _, tc := range []struct {
+		desc, source string
+		want         config.GoVersion
+		wantReason   string
+	}{
+		{
+			desc: "go1",
+			source: `package foo
+
+import "fmt"
+
+func F() { fmt.Println("hello") }
+`,
+		}, {
+			desc: "type alias",
+			source: `package foo
+
+import "context"
+
+type Context = context.Context
+`,
+			want:       go1(9),
+			wantReason: "type alias",
+		}, {
+			desc: "new package",
+			source: `package foo
+
+import "math/bits"
+
+var n = bits.OnesCount(7)
+`,
+			want:       go1(9),
+			wantReason: "package math/bits",
+		}, {
+			desc: "new symbol",
+			source: `package foo
+
+import str "strings"
+
+var b str.Builder
+`,
+			want:       go1(10),
+			wantReason: "strings.Builder",
+		}, {
+			desc: "shadowed package name",
+			source: `package foo
+
+import "os"
+
+type T struct{ ReadFile func() }
+
+func F(os T) { os.ReadFile() }
+`,
+		}, {
+			desc: "number literal",
+			source: `package foo
+
+const Mask = 0b1010
+`,
+			want:       go1(13),
+			wantReason: "number literal 0b1010",
+		}, {
+			desc: "newest feature",
+			source: `package foo
+
+import "os"
+
+type Bytes = []byte
+
+func Read() (Bytes, error) { return os.ReadFile("x") }
+`,
+			want:       go1(16),
+			wantReason: "os.ReadFile",
+		},
+	} {
+		f, err := parser.ParseFile(token.NewFileSet(), "foo.go", tc.source, parser.ParseComments)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		got, gotReason := detectGoVersion(f)
+		if got != tc.want || gotReason != tc.wantReason {
+			t.Errorf("%s: got %v, %q; want %v, %q", tc.desc, got, gotReason, tc.want, tc.wantReason)
+		}
+	}
+}
+
+func TestReleaseTagVersion(t *testing.T) {
+	for _, tc := range []struct {
+		tags []string
+		want config.GoVersion
+	}{
+		{tags: nil},
+		{tags: []string{"linux"}},
+		{tags: []string{"go1.9"}, want: go1(9)},
+		{tags: []string{"linux,go1.8 darwin", "go1.10"}, want: go1(10)},
+		{tags: []string{"!go1.9"}},
+	} {
+		if got := releaseTagVersion(tc.tags); got != tc.want {
+			t.Errorf("releaseTagVersion(%q) = %v; want %v", tc.tags, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import "sync"
+
+// stringTable interns strings read from files, so equal strings share
+// memory. Each file's imports, build tags, and cgo flags are separate
+// allocations when they're parsed, but the same import paths appear in
+// thousands of files in a large repository, and they're kept in every
+// Package for the length of a run. A stringTable may be used concurrently.
+// A nil *stringTable doesn't intern anything.
+type stringTable struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+// newStringTable returns an empty stringTable.
+func newStringTable() *stringTable {
+	return &stringTable{m: make(map[string]string)}
+}
+
+// intern returns a string equal to s. The first string added with a given
+// value is returned for all later equal strings.
+func (t *stringTable) intern(s string) string {
+	if t == nil {
+		return s
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if is, ok := t.m[s]; ok {
+		return is
+	}
+	t.m[s] = s
+	return s
+}
+
+// internAll replaces each string in ss with its interned copy.
+func (t *stringTable) internAll(ss []string) {
+	for i, s := range ss {
+		ss[i] = t.intern(s)
+	}
+}
+
+// fileInfoPool holds slices used by buildPackage to collect information about
+// a directory's .go files. The fileInfo values are only needed while the
+// package is built, so the slices are reused across directories instead of
+// being grown from scratch each time.
+var fileInfoPool = sync.Pool{
+	New: func() interface{} {
+		infos := make([]fileInfo, 0, 16)
+		return &infos
+	},
+}
+
+// getFileInfos returns an empty slice from fileInfoPool.
+func getFileInfos() *[]fileInfo {
+	return fileInfoPool.Get().(*[]fileInfo)
+}
+
+// putFileInfos clears infos and returns it to fileInfoPool. infos is
+// cleared so the pool doesn't keep the strings it refers to alive.
+func putFileInfos(p *[]fileInfo, infos []fileInfo) {
+	for i := range infos {
+		infos[i] = fileInfo{}
+	}
+	*p = infos[:0]
+	fileInfoPool.Put(p)
+}
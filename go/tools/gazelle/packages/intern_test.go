@@ -0,0 +1,164 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+// stringData returns a pointer to the bytes of s, so tests can tell whether
+// two equal strings share memory.
+func stringData(s string) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&s))
+}
+
+func TestStringTable(t *testing.T) {
+	st := newStringTable()
+	a := st.intern(string([]byte("example.com/repo/lib")))
+	b := st.intern(string([]byte("example.com/repo/lib")))
+	if a != b || stringData(a) != stringData(b) {
+		t.Errorf("interned strings %q and %q don't share memory", a, b)
+	}
+
+	ss := []string{string([]byte("example.com/repo/lib")), "example.com/repo/other"}
+	st.internAll(ss)
+	if stringData(ss[0]) != stringData(a) {
+		t.Errorf("internAll didn't replace %q with its interned copy", ss[0])
+	}
+
+	var nilTable *stringTable
+	if got := nilTable.intern("x"); got != "x" {
+		t.Errorf("nil table: got %q; want %q", got, "x")
+	}
+}
+
+func TestScannerInternsImports(t *testing.T) {
+	dir, err := createImportTree(2, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := importTreeConfig(dir)
+	s := NewScanner(c, BuildScanOptions)
+	var infos []fileInfo
+	for _, rel := range []string{"pkg0/file0.go", "pkg1/file1.go"} {
+		info, err := s.goFileInfo(filepath.Join(dir, filepath.Dir(rel)), filepath.Base(rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, info)
+	}
+	for i, imp := range infos[0].imports {
+		if stringData(imp) != stringData(infos[1].imports[i]) {
+			t.Errorf("import %q is not shared between files", imp)
+		}
+	}
+}
+
+// BenchmarkBuildPackage measures memory used by packages built from a tree
+// where each file imports the same set of packages, with and without
+// interning. Besides allocations, the heap still in use by the packages
+// after they're built is logged, since that's what interning reduces.
+func BenchmarkBuildPackage(b *testing.B) {
+	const numPkgs, numFiles, numImports = 100, 10, 30
+	dir, err := createImportTree(numPkgs, numFiles, numImports)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := importTreeConfig(dir)
+
+	for _, intern := range []bool{false, true} {
+		b.Run(fmt.Sprintf("intern=%v", intern), func(b *testing.B) {
+			b.ReportAllocs()
+			var retained int64
+			for i := 0; i < b.N; i++ {
+				s := NewScanner(c, BuildScanOptions)
+				if !intern {
+					s.strings = nil
+				}
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				pkgs := make([]*Package, 0, numPkgs)
+				for p := 0; p < numPkgs; p++ {
+					pkgDir := filepath.Join(dir, fmt.Sprintf("pkg%d", p))
+					var goFiles []string
+					for f := 0; f < numFiles; f++ {
+						goFiles = append(goFiles, fmt.Sprintf("file%d.go", f))
+					}
+					pkgs = append(pkgs, buildPackage(s, pkgDir, nil, goFiles, nil, nil, false, false, false))
+				}
+				s = nil
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained += int64(after.HeapAlloc) - int64(before.HeapAlloc)
+				runtime.KeepAlive(pkgs)
+			}
+			b.Logf("heap retained by %d packages: %d bytes", numPkgs, retained/int64(b.N))
+		})
+	}
+}
+
+// createImportTree creates a temporary directory with numPkgs packages, each
+// with numFiles .go files that import the same numImports packages.
+func createImportTree(numPkgs, numFiles, numImports int) (string, error) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "intern")
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("package lib\n\nimport (\n")
+	for i := 0; i < numImports; i++ {
+		fmt.Fprintf(&buf, "\t_ \"example.com/some/long/import/path/dep%d\"\n", i)
+	}
+	buf.WriteString(")\n")
+	for p := 0; p < numPkgs; p++ {
+		pkgDir := filepath.Join(dir, fmt.Sprintf("pkg%d", p))
+		if err := os.MkdirAll(pkgDir, 0777); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		for f := 0; f < numFiles; f++ {
+			if err := ioutil.WriteFile(filepath.Join(pkgDir, fmt.Sprintf("file%d.go", f)), buf.Bytes(), 0666); err != nil {
+				os.RemoveAll(dir)
+				return "", err
+			}
+		}
+	}
+	return dir, nil
+}
+
+// importTreeConfig returns a configuration for a tree made by
+// createImportTree.
+func importTreeConfig(dir string) *config.Config {
+	return &config.Config{
+		RepoRoot:    dir,
+		GoPrefix:    "example.com/repo",
+		GenericTags: config.BuildTags{"gc": true},
+		Platforms:   config.DefaultPlatformTags,
+	}
+}
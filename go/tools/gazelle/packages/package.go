@@ -16,7 +16,6 @@ limitations under the License.
 package packages
 
 import (
-	"fmt"
 	"sort"
 	"strings"
 
@@ -41,15 +40,75 @@ type Package struct {
 
 	Library, CgoLibrary, Binary, Test, XTest Target
 
+	// CLibrary holds the C and C++ sources, preprocessed assembly files,
+	// and headers of the cgo library, when they're built with a separate
+	// cc_library. This is enabled with a "# gazelle:cgo_cc_library"
+	// directive. Its COpts are a copy of the cgo library's.
+	CLibrary Target
+
+	// StandaloneTest is true if Test includes the sources, imports, and
+	// options of Library and CgoLibrary instead of embedding them. This is
+	// the case when the internal test and the library both use cgo, since
+	// each rule can only have its own cgo code.
+	StandaloneTest bool
+
+	// Protos lists the .proto files in the package directory. It's empty
+	// in DisableProtoMode.
 	Protos      []string
 	HasPbGo     bool
 	HasTestdata bool
+
+	// Generate lists the "//go:generate" directives in the package's .go
+	// files, in file name order. It's only set by Scan.
+	Generate []GenerateDirective
 }
 
 // Target contains metadata about a buildable Go target in a package.
 type Target struct {
 	Sources, Imports PlatformStrings
 	COpts, CLinkOpts PlatformStrings
+
+	// Hdrs lists the header files the target's C or assembly sources may
+	// include. They're kept apart from Sources, since headers included by
+	// cgo code may be listed in a cc_library instead; see
+	// config.HeaderMode.
+	Hdrs PlatformStrings
+
+	// TestFuncs records the kinds of test functions declared in the
+	// target's files. It's only set for test targets.
+	TestFuncs TestFuncs
+
+	// TestStats describes the target's .go files, for choosing a test size.
+	// It's only set for test targets.
+	TestStats config.TestStats
+
+	// Data is a list of files the target needs at run time, like files
+	// matched by "//go:embed" patterns. Paths are slash-separated and
+	// relative to the package directory.
+	Data PlatformStrings
+
+	// Cgo is true if any .go file in the target imports "C". For test
+	// targets, this means the test must be built with cgo enabled.
+	Cgo bool
+
+	// GoVersion is the minimum Go version needed to compile the target's
+	// sources, and GoVersionReason describes the feature that needs it,
+	// like "type alias in foo.go". These are only set if Go version
+	// detection is enabled; see config.Config.DetectGoVersion.
+	GoVersion       config.GoVersion
+	GoVersionReason string
+}
+
+// TestFuncs records which kinds of functions recognized by "go test" are
+// declared in a set of test files.
+type TestFuncs struct {
+	Tests, Benchmarks, Examples, Fuzz, TestMain bool
+}
+
+// BenchmarksOnly returns whether there are benchmarks, but no tests,
+// examples, or fuzz targets.
+func (f TestFuncs) BenchmarksOnly() bool {
+	return f.Benchmarks && !f.Tests && !f.Examples && !f.Fuzz
 }
 
 // PlatformStrings contains a set of strings associated with a buildable
@@ -59,6 +118,11 @@ type PlatformStrings struct {
 	// Generic is a list of strings not specific to any platform.
 	Generic []string
 
+	// OS is a map of lists of strings used on every architecture of an
+	// operating system. The map is keyed by the label of the OS's
+	// config_setting, like "@io_bazel_rules_go//go/platform:linux".
+	OS map[string][]string
+
 	// Platform is a map of lists of platform-specific strings. The map is keyed
 	// by the name of the platform.
 	Platform map[string][]string
@@ -98,6 +162,35 @@ func (t *Target) HasGo() bool {
 	return t.Sources.HasGo()
 }
 
+// SourcesAndHdrs returns the target's sources and headers, in the order
+// files are read by the walker: .go files first, then other files sorted by
+// name. Files listed as both a source and a header appear once.
+func (t *Target) SourcesAndHdrs() PlatformStrings {
+	ps := concatPlatformStrings(t.Sources, t.Hdrs)
+	ps.Generic = sortSourceFiles(ps.Generic)
+	for _, m := range ps.PlatformMaps() {
+		for n, ss := range m {
+			m[n] = sortSourceFiles(ss)
+		}
+	}
+	return ps
+}
+
+// sortSourceFiles sorts and de-duplicates the files in ss that aren't .go
+// files and moves them after the .go files, which keep their order.
+func sortSourceFiles(ss []string) []string {
+	var goFiles, otherFiles []string
+	for _, s := range ss {
+		if strings.HasSuffix(s, ".go") {
+			goFiles = append(goFiles, s)
+		} else {
+			otherFiles = append(otherFiles, s)
+		}
+	}
+	sort.Strings(otherFiles)
+	return append(uniq(goFiles), uniq(otherFiles)...)
+}
+
 func (t *Target) firstGoFile() string {
 	return t.Sources.firstGoFile()
 }
@@ -110,24 +203,38 @@ func (ts *PlatformStrings) IsEmpty() bool {
 	if len(ts.Generic) > 0 {
 		return false
 	}
-	for _, s := range ts.Platform {
-		if len(s) > 0 {
-			return false
+	for _, m := range ts.PlatformMaps() {
+		for _, s := range m {
+			if len(s) > 0 {
+				return false
+			}
 		}
 	}
 	return true
 }
 
+// PlatformMaps returns the maps of platform-specific strings in ts, from the
+// broadest to the narrowest: OS and Platform. Each map becomes a separate
+// select when a rule is generated, so a string may be listed for an OS and
+// also for one of its platforms. Gazelle only fills in Platform when it
+// reads a package; OS is filled in when rules are generated. Maps may be
+// nil.
+func (ts *PlatformStrings) PlatformMaps() []map[string][]string {
+	return []map[string][]string{ts.OS, ts.Platform}
+}
+
 func (ts *PlatformStrings) firstGoFile() string {
 	for _, f := range ts.Generic {
 		if strings.HasSuffix(f, ".go") {
 			return f
 		}
 	}
-	for _, fs := range ts.Platform {
-		for _, f := range fs {
-			if strings.HasSuffix(f, ".go") {
-				return f
+	for _, m := range ts.PlatformMaps() {
+		for _, fs := range m {
+			for _, f := range fs {
+				if strings.HasSuffix(f, ".go") {
+					return f
+				}
 			}
 		}
 	}
@@ -138,59 +245,233 @@ func (ts *PlatformStrings) firstGoFile() string {
 // the file is buildable.
 //
 // "cgo" tells whether a ".go" file in the package contains cgo code. This
-// affects whether C files are added to targets.
+// affects whether C files are added to targets. C files are added to the cgo
+// library if there is one. Otherwise, they're added to the test that uses
+// cgo, since the test is built with cgo enabled. This means .go files must
+// be added before other files.
 //
-// An error is returned if a file is buildable but invalid (for example, a
-// test .go file containing cgo code). Files that are not buildable will not
-// be added to any target (for example, .txt files).
+// An error is returned if a file is buildable but invalid. Files that are not
+// buildable will not be added to any target (for example, .txt files).
 func (p *Package) addFile(c *config.Config, info fileInfo, cgo bool) error {
 	switch {
 	case info.category == ignoredExt || info.category == unsupportedExt:
 		return nil
 	case info.isXTest:
-		if info.isCgo {
-			return fmt.Errorf("%s: use of cgo in test not supported", info.path)
-		}
 		p.XTest.addFile(c, info)
 	case info.isTest:
-		if info.isCgo {
-			return fmt.Errorf("%s: use of cgo in test not supported", info.path)
-		}
 		p.Test.addFile(c, info)
-	case info.isCgo || cgo && (info.category == cExt || info.category == hExt || info.category == csExt):
+	case info.isCgo:
 		p.CgoLibrary.addFile(c, info)
+	case cgo && (info.category == cExt || info.category == hExt || info.category == csExt):
+		p.cgoTarget().addFile(c, info)
+	case info.category == hExt && toolchainHeaders[info.name]:
+		// Go assembly includes these from the toolchain. Copies in the
+		// package aren't needed, and they may not match the toolchain.
+		return nil
 	case info.category == goExt || info.category == sExt || info.category == hExt:
 		p.Library.addFile(c, info)
-	case info.category == protoExt:
+	case info.category == protoExt && c.ProtoMode != config.DisableProtoMode:
 		p.Protos = append(p.Protos, info.name)
 	}
 
 	if strings.HasSuffix(info.name, ".pb.go") {
 		p.HasPbGo = true
 	}
+	for _, cmd := range info.generate {
+		p.Generate = append(p.Generate, GenerateDirective{File: info.name, Command: cmd})
+	}
 
 	return nil
 }
 
+// toolchainHeaders are headers Go assembly files may include without the
+// package providing them. Most come from the Go distribution's pkg/include
+// directory; go_asm.h is written by the compiler.
+var toolchainHeaders = map[string]bool{
+	"asm_amd64.h":  true,
+	"asm_ppc64x.h": true,
+	"funcdata.h":   true,
+	"go_asm.h":     true,
+	"textflag.h":   true,
+}
+
+// cgoTarget returns the target C files should be added to: the cgo library
+// if it has .go files, otherwise a test that uses cgo.
+func (p *Package) cgoTarget() *Target {
+	switch {
+	case p.CgoLibrary.HasGo():
+		return &p.CgoLibrary
+	case p.Test.Cgo:
+		return &p.Test
+	case p.XTest.Cgo:
+		return &p.XTest
+	default:
+		return &p.CgoLibrary
+	}
+}
+
+// inlineLibrary adds the sources, imports, options, and data of the library
+// and cgo library to the internal test, ahead of the test's own, and sets
+// StandaloneTest. The test is then built with cgo enabled without embedding
+// the cgo library.
+func (p *Package) inlineLibrary() {
+	test := &p.Test
+	test.Sources = concatPlatformStrings(p.CLibrary.Sources, test.Sources)
+	test.Hdrs = concatPlatformStrings(p.CLibrary.Hdrs, test.Hdrs)
+	for _, t := range []*Target{&p.CgoLibrary, &p.Library} {
+		test.Sources = concatPlatformStrings(t.Sources, test.Sources)
+		test.Hdrs = concatPlatformStrings(t.Hdrs, test.Hdrs)
+		test.Imports = concatPlatformStrings(t.Imports, test.Imports)
+		test.COpts = concatPlatformStrings(t.COpts, test.COpts)
+		test.CLinkOpts = concatPlatformStrings(t.CLinkOpts, test.CLinkOpts)
+		test.Data = concatPlatformStrings(t.Data, test.Data)
+		if test.GoVersion.Less(t.GoVersion) {
+			test.GoVersion = t.GoVersion
+			test.GoVersionReason = t.GoVersionReason
+		}
+	}
+	p.StandaloneTest = true
+}
+
+// splitCLibrary moves the C and C++ sources, preprocessed assembly files,
+// and headers of the cgo library to CLibrary. The cgo library keeps its
+// .go files and options.
+func (p *Package) splitCLibrary() {
+	lib := &p.CgoLibrary
+	p.CLibrary.Sources, lib.Sources = lib.Sources.partition(isCSource)
+	p.CLibrary.Hdrs, lib.Hdrs = lib.Hdrs, PlatformStrings{}
+	p.CLibrary.COpts = lib.COpts.clone()
+}
+
+// isCSource returns whether name is a file cgo builds with the C compiler,
+// other than a header.
+func isCSource(name string) bool {
+	_, category, ok := extTrie.lookup(name)
+	return ok && (category == cExt || category == csExt)
+}
+
 func (t *Target) addFile(c *config.Config, info fileInfo) {
-	if !info.hasConstraints() || info.checkConstraints(c.GenericTags) {
-		t.Sources.addGenericStrings(info.name)
+	t.Cgo = t.Cgo || info.isCgo
+	t.TestFuncs.Tests = t.TestFuncs.Tests || info.testFuncs.Tests
+	t.TestFuncs.Benchmarks = t.TestFuncs.Benchmarks || info.testFuncs.Benchmarks
+	t.TestFuncs.Examples = t.TestFuncs.Examples || info.testFuncs.Examples
+	t.TestFuncs.Fuzz = t.TestFuncs.Fuzz || info.testFuncs.Fuzz
+	t.TestFuncs.TestMain = t.TestFuncs.TestMain || info.testFuncs.TestMain
+	if info.isTest {
+		t.addTestStats(info)
+	}
+	// Files that import "C", and C files built by cgo, can only be built on
+	// platforms where cgo is available.
+	needsCgo := info.isCgo || t.Cgo && (info.category == cExt || info.category == hExt || info.category == csExt)
+	srcs := &t.Sources
+	if info.category == hExt {
+		srcs = &t.Hdrs
+	}
+	if info.isGeneric(c, needsCgo) {
+		t.requireGoVersion(info)
+		srcs.addGenericStrings(info.name)
 		t.Imports.addGenericStrings(info.imports...)
+		t.Data.addGenericStrings(info.data...)
 		t.COpts.addGenericOpts(c.Platforms, info.copts)
 		t.CLinkOpts.addGenericOpts(c.Platforms, info.clinkopts)
 		return
 	}
 
 	for name, tags := range c.Platforms {
-		if info.checkConstraints(tags) {
-			t.Sources.addPlatformStrings(name, info.name)
+		if (!needsCgo || tags["cgo"]) && info.checkConstraints(tags) {
+			t.requireGoVersion(info)
+			srcs.addPlatformStrings(name, info.name)
 			t.Imports.addPlatformStrings(name, info.imports...)
+			t.Data.addPlatformStrings(name, info.data...)
 			t.COpts.addTaggedOpts(name, info.copts, tags)
 			t.CLinkOpts.addTaggedOpts(name, info.clinkopts, tags)
 		}
 	}
 }
 
+// addTestStats adds the test file described by info to t.TestStats.
+func (t *Target) addTestStats(info fileInfo) {
+	s := &t.TestStats
+	s.Files++
+	s.Network = s.Network || info.usesNetwork
+	s.Sleep = s.Sleep || info.sleeps
+	for _, line := range info.tags {
+		for _, tag := range strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == ',' }) {
+			if s.Tags == nil {
+				s.Tags = make(map[string]bool)
+			}
+			s.Tags[strings.TrimPrefix(tag, "!")] = true
+		}
+	}
+}
+
+// requireGoVersion raises the Go version the target needs to the version
+// the file described by info needs, if that's newer.
+func (t *Target) requireGoVersion(info fileInfo) {
+	if t.GoVersion.Less(info.goVersion) {
+		t.GoVersion = info.goVersion
+		t.GoVersionReason = info.goVersionReason + " in " + info.name
+	}
+}
+
+// clone returns a deep copy of ps.
+func (ps *PlatformStrings) clone() PlatformStrings {
+	var c PlatformStrings
+	if ps.Generic != nil {
+		c.Generic = append([]string(nil), ps.Generic...)
+	}
+	c.OS = cloneStringsMap(ps.OS)
+	c.Platform = cloneStringsMap(ps.Platform)
+	return c
+}
+
+// cloneStringsMap returns a deep copy of m, or nil if m is nil.
+func cloneStringsMap(m map[string][]string) map[string][]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string][]string)
+	for n, ss := range m {
+		c[n] = append([]string(nil), ss...)
+	}
+	return c
+}
+
+// concatPlatformStrings returns a new PlatformStrings with the generic and
+// platform-specific strings of each argument, in order.
+func concatPlatformStrings(pss ...PlatformStrings) PlatformStrings {
+	var c PlatformStrings
+	for _, ps := range pss {
+		c.addGenericStrings(ps.Generic...)
+		for n, ss := range ps.Platform {
+			c.addPlatformStrings(n, ss...)
+		}
+	}
+	return c
+}
+
+// partition returns the strings in ps for which f returns true, and the
+// other strings.
+func (ps *PlatformStrings) partition(f func(string) bool) (in, out PlatformStrings) {
+	for _, s := range ps.Generic {
+		if f(s) {
+			in.addGenericStrings(s)
+		} else {
+			out.addGenericStrings(s)
+		}
+	}
+	for n, ss := range ps.Platform {
+		for _, s := range ss {
+			if f(s) {
+				in.addPlatformStrings(n, s)
+			} else {
+				out.addPlatformStrings(n, s)
+			}
+		}
+	}
+	return in, out
+}
+
 func (ps *PlatformStrings) addGenericStrings(ss ...string) {
 	ps.Generic = append(ps.Generic, ss...)
 }
@@ -234,6 +515,13 @@ func (ps *PlatformStrings) addTaggedOpts(name string, opts []taggedOpts, tags ma
 // Clean sorts and de-duplicates PlatformStrings. It also removes any
 // strings from platform-specific lists that also appear in the generic list.
 // This is useful for imports.
+//
+// Strings are sorted by their bytes. For valid UTF-8, this is the same as
+// sorting by Unicode code point, so non-ASCII file names and import paths
+// are ordered the same way regardless of locale or Go version. This is also
+// the order buildifier uses, so formatting doesn't reorder lists. Strings
+// are not normalized: a name written in composed and decomposed forms is
+// treated as two different names.
 func (ps *PlatformStrings) Clean() {
 	sort.Strings(ps.Generic)
 	ps.Generic = uniq(ps.Generic)
@@ -243,21 +531,40 @@ func (ps *PlatformStrings) Clean() {
 		genSet[s] = true
 	}
 
-	if ps.Platform == nil {
-		return
-	}
+	ps.OS = cleanStringsMap(ps.OS, genSet)
+	ps.Platform = cleanStringsMap(ps.Platform, genSet)
+}
 
-	for n, ss := range ps.Platform {
+// cleanStringsMap sorts and de-duplicates the lists in m and removes strings
+// in genSet from them. Empty lists are deleted. nil is returned if no lists
+// remain.
+func cleanStringsMap(m map[string][]string, genSet map[string]bool) map[string][]string {
+	for n, ss := range m {
 		ss = remove(ss, genSet)
 		if len(ss) == 0 {
-			delete(ps.Platform, n)
+			delete(m, n)
 			continue
 		}
 		sort.Strings(ss)
-		ps.Platform[n] = uniq(ss)
+		m[n] = uniq(ss)
+	}
+	if len(m) == 0 {
+		return nil
 	}
-	if len(ps.Platform) == 0 {
-		ps.Platform = nil
+	return m
+}
+
+// CleanOpts removes adjacent repeats from PlatformStrings holding compiler
+// or linker flags, like COpts and CLinkOpts. Unlike Clean, it doesn't sort
+// the strings, since the order of flags is significant: libraries must be
+// linked after the libraries that use them. Repeats that aren't adjacent
+// are kept for the same reason.
+func (ps *PlatformStrings) CleanOpts() {
+	ps.Generic = uniq(ps.Generic)
+	for _, m := range ps.PlatformMaps() {
+		for n, ss := range m {
+			m[n] = uniq(ss)
+		}
 	}
 }
 
@@ -301,19 +608,28 @@ func (ps *PlatformStrings) Map(f func(string) (string, error)) (PlatformStrings,
 		}
 	}
 
-	if ps.Platform != nil {
-		result.Platform = make(map[string][]string)
-		for n, ss := range ps.Platform {
-			result.Platform[n] = make([]string, 0, len(ss))
-			for _, s := range ss {
-				if r, err := f(s); err != nil {
-					errors = append(errors, err)
-				} else {
-					result.Platform[n] = append(result.Platform[n], r)
-				}
+	result.OS = mapStringsMap(ps.OS, f, &errors)
+	result.Platform = mapStringsMap(ps.Platform, f, &errors)
+
+	return result, errors
+}
+
+// mapStringsMap applies f to the strings in m and returns a new map with the
+// results. Errors are appended to errors. nil is returned if m is nil.
+func mapStringsMap(m map[string][]string, f func(string) (string, error), errors *[]error) map[string][]string {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string][]string)
+	for n, ss := range m {
+		result[n] = make([]string, 0, len(ss))
+		for _, s := range ss {
+			if r, err := f(s); err != nil {
+				*errors = append(*errors, err)
+			} else {
+				result[n] = append(result[n], r)
 			}
 		}
 	}
-
-	return result, errors
+	return result
 }
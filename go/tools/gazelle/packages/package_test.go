@@ -44,6 +44,15 @@ func TestCleanPlatformStrings(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "sort non-ascii by code point",
+			ps: PlatformStrings{
+				Generic: []string{"日本.go", "z.go", "\u00e9.go", "e\u0301.go", "Z.go", "a.go", "\U0001f600.go"},
+			},
+			want: PlatformStrings{
+				Generic: []string{"Z.go", "a.go", "e\u0301.go", "z.go", "\u00e9.go", "日本.go", "\U0001f600.go"},
+			},
+		},
 		{
 			desc: "remove generic string from platform",
 			ps: PlatformStrings{
@@ -64,6 +73,25 @@ func TestCleanPlatformStrings(t *testing.T) {
 	}
 }
 
+func TestCleanOptsPlatformStrings(t *testing.T) {
+	ps := PlatformStrings{
+		Generic: []string{"-lSDL2main", "-lSDL2", "-lSDL2", "-lm", "-lSDL2"},
+		Platform: map[string][]string{
+			"linux_amd64": []string{"-ldl", "-ldl", "-lpthread"},
+		},
+	}
+	want := PlatformStrings{
+		Generic: []string{"-lSDL2main", "-lSDL2", "-lm", "-lSDL2"},
+		Platform: map[string][]string{
+			"linux_amd64": []string{"-ldl", "-lpthread"},
+		},
+	}
+	ps.CleanOpts()
+	if !reflect.DeepEqual(ps, want) {
+		t.Errorf("got %#v; want %#v", ps, want)
+	}
+}
+
 func TestMapPlatformStrings(t *testing.T) {
 	f := func(s string) (string, error) {
 		if len(s) > 0 && s[0] == 'e' {
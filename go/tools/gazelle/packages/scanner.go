@@ -0,0 +1,176 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"go/ast"
+	"strings"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+// ScanOptions selects the information a Scanner reads from .go files.
+// Reading less is faster: without any options, only package clauses and
+// build constraints are read, and test files are parsed to find test
+// functions.
+type ScanOptions struct {
+	// Imports enables recording the packages imported by each file.
+	Imports bool
+
+	// Cgo enables reading #cgo directives in the comment above import "C".
+	// Whether a file imports "C" is known if any option is set, since
+	// import declarations are parsed.
+	Cgo bool
+
+	// Embeds enables reading patterns in "//go:embed" comments.
+	Embeds bool
+
+	// Generate enables reading "//go:generate" directives. Files are parsed
+	// completely to find them.
+	Generate bool
+
+	// GoVersion enables detecting the minimum Go version each file needs
+	// from the language features and standard packages it uses. Files are
+	// parsed completely.
+	GoVersion bool
+}
+
+var (
+	// BuildScanOptions reads what's needed to generate build files. It's
+	// used by Walk and WalkDirs.
+	BuildScanOptions = ScanOptions{Imports: true, Cgo: true, Embeds: true}
+
+	// FullScanOptions reads everything a Scanner can read. It's used by
+	// Scan, which describes packages to other tools.
+	FullScanOptions = ScanOptions{Imports: true, Cgo: true, Embeds: true, Generate: true, GoVersion: true}
+)
+
+// Scanner reads information about individual files in a package. A Scanner
+// may be used concurrently.
+type Scanner struct {
+	c    *config.Config
+	opts ScanOptions
+
+	// strings interns strings read from files, so files that import the
+	// same packages or set the same flags share memory.
+	strings *stringTable
+}
+
+// NewScanner returns a Scanner that reads the information selected by opts.
+// c determines which imports are in the standard library and how variables
+// in #cgo directives are expanded.
+func NewScanner(c *config.Config, opts ScanOptions) *Scanner {
+	return &Scanner{c: c, opts: opts, strings: newStringTable()}
+}
+
+// FileInfo describes a file read by a Scanner. Fields for information the
+// Scanner's options don't select are empty.
+type FileInfo struct {
+	// Path is the path to the file.
+	Path string
+
+	// PackageName is the package name declared in a .go file, without the
+	// "_test" suffix of external tests.
+	PackageName string
+
+	IsTest, IsXTest, IsCgo bool
+
+	// GOOS and GOARCH are the OS and architecture suffixes in the file name,
+	// if present.
+	GOOS, GOARCH string
+
+	// Tags is a list of build tag lines. Each entry is the trimmed text of
+	// a line after a "+build" prefix.
+	Tags []string
+
+	// Imports lists packages imported by a .go file, excluding "C" and the
+	// standard library.
+	Imports []string
+
+	// Embeds lists patterns in "//go:embed" comments.
+	Embeds []string
+
+	// Generate lists the commands in "//go:generate" directives.
+	Generate []string
+
+	// GoVersion is the minimum Go version needed to compile a .go file, and
+	// GoVersionReason describes the feature that needs it, like
+	// "type alias". GoVersion is zero if the file's build constraints
+	// already require that version.
+	GoVersion       config.GoVersion
+	GoVersionReason string
+}
+
+// ScanFile returns information about the file name in the directory dir.
+// Files with extensions Gazelle doesn't support are reported as errors.
+func (s *Scanner) ScanFile(dir, name string) (FileInfo, error) {
+	var info fileInfo
+	var err error
+	if strings.HasSuffix(name, ".go") {
+		info, err = s.goFileInfo(dir, name)
+	} else {
+		info, err = otherFileInfo(dir, name)
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{
+		Path:            info.path,
+		PackageName:     info.packageName,
+		IsTest:          info.isTest,
+		IsXTest:         info.isXTest,
+		IsCgo:           info.isCgo,
+		GOOS:            info.goos,
+		GOARCH:          info.goarch,
+		Tags:            info.tags,
+		Imports:         info.imports,
+		Embeds:          info.embeds,
+		Generate:        info.generate,
+		GoVersion:       info.goVersion,
+		GoVersionReason: info.goVersionReason,
+	}, nil
+}
+
+// GenerateDirective is a "//go:generate" directive in a .go file.
+type GenerateDirective struct {
+	// File is the name of the file containing the directive.
+	File string
+
+	// Command is the text of the directive after "//go:generate".
+	Command string
+}
+
+// findGenerateDirectives returns the commands in "//go:generate" comments
+// in f. Like the go command, only line comments starting with exactly
+// "//go:generate" followed by a space or tab are recognized.
+func findGenerateDirectives(f *ast.File) []string {
+	var cmds []string
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if !strings.HasPrefix(c.Text, "//go:generate") {
+				continue
+			}
+			args := c.Text[len("//go:generate"):]
+			if args == "" || args[0] != ' ' && args[0] != '\t' {
+				continue
+			}
+			if cmd := strings.TrimSpace(args); cmd != "" {
+				cmds = append(cmds, cmd)
+			}
+		}
+	}
+	return cmds
+}
@@ -0,0 +1,137 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+)
+
+func TestScanFileOptions(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := `// +build linux
+
+//go:generate stringer -type=Kind
+//go:generated not a directive
+
+package foo
+
+/*
+#cgo CFLAGS: -DFOO
+*/
+import "C"
+
+import (
+	_ "embed"
+	"example.com/dep"
+	"fmt"
+)
+
+//go:embed data.txt
+var data string
+
+//go:generate	go run gen.go
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo_linux.go"), []byte(source), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &config.Config{GoPrefix: "example.com/repo"}
+	base := FileInfo{
+		Path:        filepath.Join(dir, "foo_linux.go"),
+		PackageName: "foo",
+		GOOS:        "linux",
+		Tags:        []string{"linux"},
+	}
+	for _, tc := range []struct {
+		desc string
+		opts ScanOptions
+		want func(FileInfo) FileInfo
+	}{
+		{
+			desc: "package clause only",
+			want: func(fi FileInfo) FileInfo { return fi },
+		},
+		{
+			desc: "imports",
+			opts: ScanOptions{Imports: true},
+			want: func(fi FileInfo) FileInfo {
+				fi.IsCgo = true
+				fi.Imports = []string{"example.com/dep"}
+				return fi
+			},
+		},
+		{
+			desc: "embeds",
+			opts: ScanOptions{Embeds: true},
+			want: func(fi FileInfo) FileInfo {
+				fi.IsCgo = true
+				fi.Embeds = []string{"data.txt"}
+				return fi
+			},
+		},
+		{
+			desc: "generate",
+			opts: ScanOptions{Generate: true},
+			want: func(fi FileInfo) FileInfo {
+				fi.IsCgo = true
+				fi.Generate = []string{"stringer -type=Kind", "go run gen.go"}
+				return fi
+			},
+		},
+		{
+			desc: "go version",
+			opts: ScanOptions{GoVersion: true},
+			want: func(fi FileInfo) FileInfo {
+				fi.IsCgo = true
+				fi.GoVersion = config.GoVersion{Major: 1, Minor: 16}
+				fi.GoVersionReason = "package embed"
+				return fi
+			},
+		},
+		{
+			desc: "full",
+			opts: FullScanOptions,
+			want: func(fi FileInfo) FileInfo {
+				fi.IsCgo = true
+				fi.Imports = []string{"example.com/dep"}
+				fi.Embeds = []string{"data.txt"}
+				fi.Generate = []string{"stringer -type=Kind", "go run gen.go"}
+				fi.GoVersion = config.GoVersion{Major: 1, Minor: 16}
+				fi.GoVersionReason = "package embed"
+				return fi
+			},
+		},
+	} {
+		got, err := NewScanner(c, tc.opts).ScanFile(dir, "foo_linux.go")
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if want := tc.want(base); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v; want %#v", tc.desc, got, want)
+		}
+	}
+}
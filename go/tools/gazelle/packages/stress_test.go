@@ -0,0 +1,234 @@
+/* Copyright 2016 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+)
+
+// stressIterations returns the number of random repositories stress tests
+// should check. It may be raised with $GAZELLE_STRESS_ITERATIONS, which the
+// race detector harness in tests/gazelle_race sets.
+func stressIterations() int {
+	if n, err := strconv.Atoi(os.Getenv("GAZELLE_STRESS_ITERATIONS")); err == nil && n > 0 {
+		return n
+	}
+	if testing.Short() {
+		return 2
+	}
+	return 10
+}
+
+// createRandomRepo creates a repository with a random tree of directories
+// containing Go packages with platform-specific files, build constraints,
+// cgo, tests, assembly, and imports of each other. Directories are
+// sometimes empty, testdata, or have build files with directives.
+func createRandomRepo(r *rand.Rand) (string, error) {
+	dirs := []string{""}
+	names := []string{"a", "b", "cmd", "internal", "lib", "testdata", "util"}
+	for n := 1 + r.Intn(30); len(dirs) < n; {
+		parent := dirs[r.Intn(len(dirs))]
+		if strings.Count(parent, "/") >= 4 {
+			continue
+		}
+		dirs = append(dirs, path.Join(parent, names[r.Intn(len(names))]+strconv.Itoa(len(dirs))))
+	}
+
+	var files []fileSpec
+	for _, dir := range dirs {
+		if r.Intn(5) == 0 {
+			files = append(files, fileSpec{path: dir + "/"})
+			continue
+		}
+		name := "p" + strconv.Itoa(r.Intn(1000))
+		if r.Intn(4) == 0 {
+			name = "main"
+		}
+		imports := func() string {
+			var imps []string
+			for i := r.Intn(4); i > 0; i-- {
+				switch r.Intn(3) {
+				case 0:
+					imps = append(imps, []string{"fmt", "os", "net/http", "sync"}[r.Intn(4)])
+				case 1:
+					imps = append(imps, path.Join("example.com/repo", dirs[r.Intn(len(dirs))]))
+				default:
+					imps = append(imps, []string{"github.com/x/y", "github.com/x/y/z", "golang.org/x/net/context"}[r.Intn(3)])
+				}
+			}
+			var buf bytes.Buffer
+			for _, imp := range imps {
+				fmt.Fprintf(&buf, "import _ %q\n", imp)
+			}
+			return buf.String()
+		}
+		srcs := []struct{ file, header string }{
+			{"a.go", ""},
+			{"b_linux.go", ""},
+			{"c_windows_amd64.go", ""},
+			{"d.go", "// +build darwin,!cgo\n\n"},
+			{"e.go", "// +build !linux\n\n"},
+		}
+		for _, src := range srcs {
+			if src.file != "a.go" && r.Intn(2) == 0 {
+				continue
+			}
+			files = append(files, fileSpec{
+				path:    path.Join(dir, src.file),
+				content: src.header + "package " + name + "\n\n" + imports(),
+			})
+		}
+		if r.Intn(3) == 0 {
+			files = append(files,
+				fileSpec{
+					path:    path.Join(dir, "cgo.go"),
+					content: "package " + name + "\n\n/*\n#cgo linux LDFLAGS: -lm\n#cgo CFLAGS: -DFOO\n*/\nimport \"C\"\n",
+				},
+				fileSpec{path: path.Join(dir, "cgo.c")},
+				fileSpec{path: path.Join(dir, "cgo.h")})
+		}
+		if r.Intn(3) == 0 {
+			files = append(files, fileSpec{path: path.Join(dir, "asm_amd64.s")})
+		}
+		if r.Intn(2) == 0 {
+			files = append(files, fileSpec{
+				path:    path.Join(dir, "a_test.go"),
+				content: "package " + name + "\n\nimport \"testing\"\n" + imports() + "\nfunc TestA(t *testing.T) {}\n",
+			})
+		}
+		if r.Intn(3) == 0 && name != "main" {
+			files = append(files, fileSpec{
+				path:    path.Join(dir, "x_test.go"),
+				content: "package " + name + "_test\n\nimport \"testing\"\n" + imports() + "\nfunc TestX(t *testing.T) {}\n",
+			})
+		}
+		if r.Intn(4) == 0 {
+			files = append(files, fileSpec{
+				path:    path.Join(dir, "BUILD"),
+				content: "# gazelle:exclude e.go\n# gazelle:merge deps=union\n",
+			})
+		}
+	}
+	return createFiles(files)
+}
+
+// walkAll walks the repository at c.RepoRoot and returns every directory
+// reported. If r is not nil, the callback randomly yields, so goroutines
+// reading directories are scheduled in different orders.
+func walkAll(c *config.Config, r *rand.Rand) []*packages.Dir {
+	var dirs []*packages.Dir
+	packages.WalkDirs(c, c.RepoRoot, func(d *packages.Dir) {
+		if r != nil && r.Intn(2) == 0 {
+			runtime.Gosched()
+		}
+		dirs = append(dirs, d)
+	})
+	return dirs
+}
+
+// TestWalkStress walks random repositories serially, then with several
+// concurrent walks that share a Config and each read directories
+// concurrently, and checks they report the same directories in the same
+// order. The packages are then modified concurrently. Run with -race, this
+// checks the walker doesn't write to the Config and that packages don't
+// share slices or maps with each other or with the walker's caches.
+func TestWalkStress(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for seed := 0; seed < stressIterations(); seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		dir, err := createRandomRepo(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &config.Config{
+			RepoRoot:            dir,
+			GoPrefix:            "example.com/repo",
+			ValidBuildFileNames: config.DefaultValidBuildFileNames,
+			GenericTags:         config.BuildTags{},
+			Platforms:           config.DefaultPlatformTags,
+			Jobs:                1,
+		}
+		c.PreprocessTags()
+		want := walkAll(c, nil)
+
+		runtime.GOMAXPROCS(1 + r.Intn(2*runtime.NumCPU()))
+		results := make([][]*packages.Dir, 4)
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				wc := *c
+				wc.Jobs = 2 << uint(i)
+				results[i] = walkAll(&wc, rand.New(rand.NewSource(int64(seed*len(results)+i))))
+			}(i)
+		}
+		wg.Wait()
+		for i, got := range results {
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("seed %d, walk %d: concurrent walk reported different directories than a serial walk", seed, i)
+			}
+		}
+
+		for _, dirs := range append(results, want) {
+			for _, d := range dirs {
+				if d.Package == nil {
+					continue
+				}
+				wg.Add(1)
+				go func(p *packages.Package) {
+					defer wg.Done()
+					mutatePackage(p)
+				}(d.Package)
+			}
+		}
+		wg.Wait()
+		os.RemoveAll(dir)
+	}
+}
+
+// mutatePackage modifies every PlatformStrings in p in place, the way rule
+// generators may.
+func mutatePackage(p *packages.Package) {
+	for _, tgt := range []*packages.Target{&p.Library, &p.CgoLibrary, &p.Binary, &p.Test, &p.XTest} {
+		for _, ps := range []*packages.PlatformStrings{&tgt.Sources, &tgt.Imports, &tgt.COpts, &tgt.CLinkOpts, &tgt.Hdrs} {
+			sort.Sort(sort.Reverse(sort.StringSlice(ps.Generic)))
+			for i := range ps.Generic {
+				ps.Generic[i] += "~"
+			}
+			for k, v := range ps.Platform {
+				for i := range v {
+					v[i] += "~"
+				}
+				ps.Platform[k] = append(v, "~")
+			}
+		}
+	}
+}
@@ -18,20 +18,122 @@ package packages
 import (
 	"go/build"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
 )
 
 // A WalkFunc is a callback called by Walk for each package.
 type WalkFunc func(pkg *Package, oldFile *bf.File)
 
+// Dir describes a directory visited by WalkDirs.
+type Dir struct {
+	// Path is the absolute path to the directory.
+	Path string
+
+	// Rel is the slash-separated path to the directory, relative to the
+	// repository root. It is "" for the root directory.
+	Rel string
+
+	// File is the existing build file in the directory. It is nil if there
+	// is no build file.
+	File *bf.File
+
+	// Files is a sorted list of names of regular files in the directory.
+	// Hidden files and files excluded with "# gazelle:exclude" comments are
+	// not included.
+	Files []string
+
+	// Package is the Go package in the directory. It is nil if the
+	// directory contains no buildable Go code.
+	Package *Package
+
+	// MergeStrategies maps attribute names to strategies for merging them
+	// in this directory. It starts with c.MergeStrategies and includes
+	// "# gazelle:merge" directives in build files in this directory and
+	// the directories above it.
+	MergeStrategies map[string]config.MergeStrategy
+
+	// XDefs maps fully qualified Go variables (like
+	// "example.com/pkg/version.Version") to values they should be set to at
+	// link time. It includes "# gazelle:x_def" directives in build files in
+	// this directory and the directories above it.
+	XDefs map[string]string
+
+	// MapKinds maps kinds of rules Gazelle generates to kinds that should
+	// be generated in their place. It includes "# gazelle:map_kind"
+	// directives in build files in this directory and the directories
+	// above it.
+	MapKinds map[string]MappedKind
+
+	// GcGoopts and GcLinkopts are options passed to the Go compiler and
+	// linker by rules generated in this directory. They include
+	// "# gazelle:gc_goopts" and "# gazelle:gc_linkopts" directives in build
+	// files in this directory and the directories above it.
+	GcGoopts, GcLinkopts PlatformStrings
+
+	// Test contains attributes of go_test rules set by
+	// "# gazelle:test_size", "# gazelle:test_timeout", and
+	// "# gazelle:test_shard_count" directives in build files in this
+	// directory and the directories above it.
+	Test TestAttrs
+
+	// GoVersion is the minimum Go version declared for packages in this
+	// directory with a "# gazelle:go_version" directive in a build file in
+	// this directory or the directories above it. It's zero if no version
+	// is declared.
+	GoVersion config.GoVersion
+
+	// DefaultVisibility is the default visibility of rules in new build
+	// files in this directory, set with a "# gazelle:default_visibility"
+	// directive in a build file in this directory or the directories above
+	// it. It's nil if no default is set.
+	DefaultVisibility []string
+
+	// AssetDirs lists directories of static files that go_embed_data rules
+	// should be generated for, declared with "# gazelle:embed_data"
+	// directives in the build file in this directory. Unlike most
+	// directives, these don't apply to subdirectories.
+	AssetDirs []AssetDir
+
+	// ManagedBy names the tool that owns the build file in this directory,
+	// declared with a "# gazelle:managed_by" directive. It's empty if the
+	// file is owned by Gazelle. Like AssetDirs, this doesn't apply to
+	// subdirectories.
+	ManagedBy string
+}
+
+// MappedKind describes a kind of rule generated in place of a kind Gazelle
+// generates, set with a directive like
+// "# gazelle:map_kind go_test my_go_test //tools:go.bzl".
+type MappedKind struct {
+	// FromKind is the kind Gazelle generates, like "go_test".
+	FromKind string
+
+	// KindName is the kind generated in its place, like "my_go_test".
+	KindName string
+
+	// KindLoad is the label of the .bzl file KindName is loaded from.
+	KindLoad string
+}
+
+// TestAttrs holds attributes of go_test rules set by directives. Attributes
+// with zero values are not set.
+type TestAttrs struct {
+	Size, Timeout string
+	ShardCount    int
+}
+
+// A DirFunc is a callback called by WalkDirs for each directory.
+type DirFunc func(dir *Dir)
+
 // Walk walks through directories under "root".
 // It calls back "f" for each package. If an existing BUILD file is present
 // in the directory, it will be parsed and passed to "f" as well.
@@ -47,103 +149,424 @@ type WalkFunc func(pkg *Package, oldFile *bf.File)
 // other packages will be silently ignored. If none of the package names match
 // the directory name, or if some other error occurs, an error will be logged,
 // and "f" will not be called.
+//
+// Directories matched by c.ExcludedPaths or c.IgnoredPaths are skipped
+// entirely, together with their subdirectories. Symbolic links to directories
+// are only followed if c.FollowSymlinks is set. If c.UpdateDirs is set, "f" is
+// only called for packages in those directories, and other parts of the tree
+// are not visited.
+//
+// Up to c.Jobs directories are read concurrently. "f" is still called
+// serially, in the same order as a sequential post-order traversal, so the
+// output of Walk doesn't depend on c.Jobs.
 func Walk(c *config.Config, dir string, f WalkFunc) {
-	// visit walks the directory tree in post-order. It returns whether the
-	// the directory it was called on or any subdirectory contains a Bazel
-	// package. This affects whether "testdata" directories are considered
-	// data dependencies.
-	var visit func(string) bool
-	visit = func(path string) bool {
-		// Look for an existing BUILD file. Directives in this file may influence
-		// the rest of the process.
-		var oldFile *bf.File
-		haveError := false
-		for _, base := range c.ValidBuildFileNames {
-			oldPath := filepath.Join(path, base)
-			st, err := os.Stat(oldPath)
-			if os.IsNotExist(err) || err == nil && st.IsDir() {
-				continue
-			}
-			oldData, err := ioutil.ReadFile(oldPath)
-			if err != nil {
-				log.Print(err)
-				haveError = true
-				continue
-			}
-			if oldFile != nil {
-				log.Printf("in directory %s, multiple Bazel files are present: %s, %s",
-					path, filepath.Base(oldFile.Path), base)
-				haveError = true
-				continue
-			}
-			oldFile, err = bf.Parse(oldPath, oldData)
-			if err != nil {
-				log.Print(err)
-				haveError = true
-				continue
+	WalkDirs(c, dir, func(d *Dir) {
+		if d.Package != nil {
+			f(d.Package, d.File)
+		}
+	})
+}
+
+// WalkDirs is like Walk, but it calls "f" for every directory it visits,
+// including directories with no buildable Go code. It is intended for
+// generating rules for languages other than Go. Directories are visited in
+// the same order and with the same restrictions as in Walk. Directories
+// where an error occurs while reading the build file are skipped. If
+// c.DetectGoVersion is set, targets record the Go versions their files need.
+func WalkDirs(c *config.Config, dir string, f DirFunc) {
+	opts := BuildScanOptions
+	opts.GoVersion = c.DetectGoVersion
+	walkDirs(c, dir, opts, f)
+}
+
+// walkDirs is like WalkDirs, but it reads the information selected by opts
+// from .go files.
+func walkDirs(c *config.Config, dir string, opts ScanOptions, f DirFunc) {
+	jobs := c.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	w := &walker{c: c, s: NewScanner(c, opts), f: f, sem: make(chan struct{}, jobs)}
+	parent := &dirFrame{directives: inheritedDirectives(c, dir)}
+	if jobs == 1 {
+		w.walkSerial(dir, parent)
+		return
+	}
+	start := make(chan struct{})
+	close(start)
+	done := make(chan struct{})
+	result := make(chan bool, 1)
+	go w.visit(dir, parent, start, done, result)
+	<-result
+	<-done
+}
+
+// maxRepeatedDirName is the number of times a directory name may appear in
+// a path before the directory is considered part of a pathological tree,
+// like nested node_modules directories or a recursive generated tree. Such
+// directories are skipped.
+const maxRepeatedDirName = 4
+
+// walker holds the state of a call to Walk.
+//
+// Directories are visited concurrently, using up to c.Jobs goroutines for
+// reading files. Packages are still passed to the callback one at a time in
+// the same order as a sequential post-order traversal: each directory waits
+// for everything before it in that order to be reported before reporting its
+// own package. When c.Jobs is 1, the tree is walked iteratively in a single
+// goroutine, so deep trees don't need deep stacks.
+type walker struct {
+	c   *config.Config
+	s   *Scanner
+	f   DirFunc
+	sem chan struct{}
+}
+
+// dirFrame holds the state of a directory being visited.
+type dirFrame struct {
+	path, rel, base string
+
+	// ancestors contains the resolved paths of this directory and the
+	// directories above it. It is used to detect cycles when following
+	// symbolic links.
+	ancestors []string
+
+	// directives contains settings from directives in build files in this
+	// directory and parent directories. Its maps must not be modified,
+	// since they may be shared with other directories.
+	directives directives
+
+	d dirInfo
+
+	// next is the index of the next subdirectory to visit in a serial walk.
+	next int
+
+	hasTestdata, subdirHasPackage bool
+}
+
+// walkSerial walks the tree rooted at dir in post-order without recursion.
+// parent holds the state inherited from directories above dir.
+func (w *walker) walkSerial(dir string, parent *dirFrame) {
+	root, _ := w.enter(dir, parent)
+	if root == nil {
+		return
+	}
+	stack := []*dirFrame{root}
+	for len(stack) > 0 {
+		fr := stack[len(stack)-1]
+		if fr.next < len(fr.d.subdirs) {
+			sub := fr.d.subdirs[fr.next]
+			fr.next++
+			if child, hasPackage := w.enter(filepath.Join(fr.path, sub), fr); child != nil {
+				stack = append(stack, child)
+			} else {
+				fr.addSubdir(sub, hasPackage)
 			}
+			continue
 		}
 
-		var excluded map[string]bool
-		if oldFile != nil {
-			excluded = findExcludedFiles(oldFile)
+		stack[len(stack)-1] = nil
+		stack = stack[:len(stack)-1]
+		d, hasPackage := w.exit(fr)
+		if d != nil {
+			w.f(d)
 		}
+		if len(stack) > 0 {
+			stack[len(stack)-1].addSubdir(fr.base, hasPackage)
+		}
+	}
+}
 
-		// List files and subdirectories.
-		files, err := ioutil.ReadDir(path)
-		if err != nil {
-			log.Print(err)
-			return false
+// visit walks the directory tree in post-order, visiting each subdirectory
+// in a new goroutine. It sends whether the directory it was called on or any
+// subdirectory contains a Bazel package on result as soon as that's known.
+// prev is closed after packages before this directory in post-order have
+// been reported. done is closed after packages in this directory and its
+// subdirectories have been reported. Only the immutable fields of parent,
+// ancestors and directives, may be read, since it is still being visited.
+func (w *walker) visit(path string, parent *dirFrame, prev <-chan struct{}, done chan<- struct{}, result chan<- bool) {
+	var d *Dir
+	defer func() {
+		<-prev
+		if d != nil {
+			w.f(d)
 		}
+		close(done)
+	}()
 
-		var goFiles, otherFiles, subdirs []string
-		for _, f := range files {
-			base := f.Name()
-			switch {
-			case base == "" || base[0] == '.' || base[0] == '_' || excluded != nil && excluded[base]:
-				continue
+	fr, hasPackage := w.enter(path, parent)
+	if fr == nil {
+		result <- hasPackage
+		return
+	}
 
-			case f.IsDir():
-				subdirs = append(subdirs, base)
+	// Recurse into subdirectories. Each subdirectory reports its packages
+	// after the one before it.
+	results := make([]chan bool, len(fr.d.subdirs))
+	for i, sub := range fr.d.subdirs {
+		subDone := make(chan struct{})
+		results[i] = make(chan bool, 1)
+		go w.visit(filepath.Join(path, sub), fr, prev, subDone, results[i])
+		prev = subDone
+	}
+	for i, sub := range fr.d.subdirs {
+		fr.addSubdir(sub, <-results[i])
+	}
 
-			case strings.HasSuffix(base, ".go"):
-				goFiles = append(goFiles, base)
+	d, hasPackage = w.exit(fr)
+	result <- hasPackage
+}
 
-			default:
-				otherFiles = append(otherFiles, base)
+// enter checks whether the directory path should be visited, then reads its
+// build file and lists its contents. parent is the frame of the directory
+// above path. It returns nil if the directory should be skipped, together
+// with whether the skipped directory contains a Bazel package.
+func (w *walker) enter(path string, parent *dirFrame) (*dirFrame, bool) {
+	c := w.c
+	rel, err := filepath.Rel(c.RepoRoot, path)
+	if err != nil {
+		logging.Error(err)
+		return nil, false
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		rel = ""
+	}
+	// Skip directories excluded with .bazelignore or -exclude, along with
+	// everything beneath them.
+	if c.IsExcludedPath(rel) {
+		return nil, false
+	}
+	// Skip directories that contain no directories being updated. Whether
+	// they contain a package still matters to the directory above, for
+	// example, to decide whether "testdata" is data, so that a partial run
+	// generates the same rules as a full one. A build file is taken as the
+	// sign of a package, since the directory isn't read.
+	if !c.ShouldVisitDir(rel) {
+		return nil, hasBuildFile(c, path)
+	}
+	if c.MaxDepth > 0 && rel != "" && strings.Count(rel, "/")+1 > c.MaxDepth {
+		logging.Warningf(logging.DepthLimit, path, "%s: skipping directory more than %d levels deep", path, c.MaxDepth)
+		return nil, false
+	}
+	if name, ok := repeatedDirName(rel); ok {
+		logging.Warningf(logging.RepeatedDirectory, path, "%s: skipping directory, since %q appears more than %d times in its path", path, name, maxRepeatedDirName)
+		return nil, false
+	}
+
+	ancestors := parent.ancestors
+	if c.FollowSymlinks {
+		realPath, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			logging.Error(err)
+			return nil, false
+		}
+		for _, a := range ancestors {
+			if a == realPath {
+				return nil, false
 			}
 		}
+		ancestors = append(ancestors[:len(ancestors):len(ancestors)], realPath)
+	}
 
-		// Recurse into subdirectories.
-		hasTestdata := false
-		subdirHasPackage := false
-		for _, sub := range subdirs {
-			hasPackage := visit(filepath.Join(path, sub))
-			if sub == "testdata" && !hasPackage {
-				hasTestdata = true
-			}
-			subdirHasPackage = subdirHasPackage || hasPackage
+	w.sem <- struct{}{}
+	d, ok := w.readDir(path)
+	<-w.sem
+	if !ok {
+		return nil, false
+	}
+	dirs := parent.directives
+	if d.oldFile != nil {
+		dirs = dirs.apply(d.oldFile)
+	}
+	return &dirFrame{
+		path:       path,
+		rel:        rel,
+		base:       filepath.Base(path),
+		ancestors:  ancestors,
+		directives: dirs,
+		d:          d,
+	}, false
+}
+
+// addSubdir records whether the subdirectory sub contains a Bazel package.
+// This affects whether "testdata" directories are considered data
+// dependencies.
+func (fr *dirFrame) addSubdir(sub string, hasPackage bool) {
+	if sub == "testdata" && !hasPackage {
+		fr.hasTestdata = true
+	}
+	fr.subdirHasPackage = fr.subdirHasPackage || hasPackage
+}
+
+// exit builds a package from files in a directory after its subdirectories
+// have been visited. It returns the directory to pass to the callback, if
+// any, and whether the directory or any subdirectory contains a Bazel
+// package.
+func (w *walker) exit(fr *dirFrame) (*Dir, bool) {
+	hasPackage := fr.subdirHasPackage || fr.d.oldFile != nil
+	if fr.d.haveError {
+		return nil, hasPackage
+	}
+
+	var genGoFiles []string
+	if fr.d.oldFile != nil {
+		genGoFiles = findGenGoFiles(fr.d.oldFile, fr.d.excluded)
+	}
+	// Files generated by go_embed_data rules are added to the library, even
+	// if the rules haven't been generated yet.
+	for _, a := range fr.d.assetDirs {
+		if out := a.Out(); !fr.d.excluded[out] && !containsString(genGoFiles, out) {
+			genGoFiles = append(genGoFiles, out)
 		}
+	}
+	w.sem <- struct{}{}
+	pkg := buildPackage(w.s, fr.path, fr.d.oldFile, fr.d.goFiles, genGoFiles, fr.d.otherFiles, fr.hasTestdata, fr.directives.dataLiterals, fr.directives.cgoCcLibrary)
+	<-w.sem
+	if pkg != nil {
+		hasPackage = true
+	}
+	if !w.c.ShouldUpdateDir(fr.rel) {
+		return nil, hasPackage
+	}
+	return &Dir{
+		Path:              fr.path,
+		Rel:               fr.rel,
+		File:              fr.d.oldFile,
+		Files:             fr.d.files,
+		Package:           pkg,
+		MergeStrategies:   fr.directives.strategies,
+		XDefs:             fr.directives.xDefs,
+		MapKinds:          fr.directives.mapKinds,
+		GcGoopts:          fr.directives.gcGoopts,
+		GcLinkopts:        fr.directives.gcLinkopts,
+		Test:              fr.directives.test,
+		GoVersion:         fr.directives.goVersion,
+		DefaultVisibility: fr.directives.defaultVisibility,
+		AssetDirs:         fr.d.assetDirs,
+		ManagedBy:         fr.d.managedBy,
+	}, hasPackage
+}
 
-		hasPackage := subdirHasPackage || oldFile != nil
-		if haveError {
-			return hasPackage
+// repeatedDirName returns a directory name that appears more than
+// maxRepeatedDirName times in the slash-separated path rel, if there is one.
+func repeatedDirName(rel string) (string, bool) {
+	if strings.Count(rel, "/") < maxRepeatedDirName {
+		return "", false
+	}
+	counts := make(map[string]int)
+	for _, name := range strings.Split(rel, "/") {
+		counts[name]++
+		if counts[name] > maxRepeatedDirName {
+			return name, true
 		}
+	}
+	return "", false
+}
+
+// dirInfo describes the contents of a directory read by walker.readDir.
+type dirInfo struct {
+	oldFile                      *bf.File
+	excluded                     map[string]bool
+	goFiles, otherFiles, subdirs []string
+	assetDirs                    []AssetDir
+	managedBy                    string
 
-		// Build a package from files in this directory.
-		var genGoFiles []string
-		if oldFile != nil {
-			genGoFiles = findGenGoFiles(oldFile, excluded)
+	// files contains goFiles and otherFiles, sorted together.
+	files []string
+
+	// haveError is true if an error was logged while reading the build file.
+	haveError bool
+}
+
+// readDir reads the build file in the directory path and lists its files
+// and subdirectories. It returns false if the directory could not be listed.
+func (w *walker) readDir(path string) (d dirInfo, ok bool) {
+	c := w.c
+
+	// Look for an existing BUILD file. Directives in this file may influence
+	// the rest of the process.
+	for _, base := range c.ValidBuildFileNames {
+		oldPath := filepath.Join(path, base)
+		st, err := os.Stat(oldPath)
+		if os.IsNotExist(err) || err == nil && st.IsDir() {
+			continue
+		}
+		oldData, err := ioutil.ReadFile(oldPath)
+		if err != nil {
+			logging.Error(err)
+			d.haveError = true
+			continue
+		}
+		if d.oldFile != nil {
+			logging.Errorf(logging.MultipleBuildFiles, path,
+				"in directory %s, multiple Bazel files are present: %s, %s",
+				path, filepath.Base(d.oldFile.Path), base)
+			d.haveError = true
+			continue
 		}
-		pkg := buildPackage(c, path, oldFile, goFiles, genGoFiles, otherFiles, hasTestdata)
-		if pkg != nil {
-			f(pkg, oldFile)
-			hasPackage = true
+		d.oldFile, err = bf.Parse(oldPath, oldData)
+		if err != nil {
+			logging.Errorf(logging.ParseError, oldPath, "%v", err)
+			d.haveError = true
+			continue
 		}
-		return hasPackage
 	}
 
-	visit(dir)
+	if d.oldFile != nil {
+		d.excluded = findExcludedFiles(d.oldFile)
+		d.assetDirs = findAssetDirs(w.c, path, d.oldFile)
+		d.managedBy = ManagedBy(d.oldFile)
+	}
+
+	// List files and subdirectories.
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		logging.Error(err)
+		return dirInfo{}, false
+	}
+
+	for _, f := range files {
+		base := f.Name()
+		switch {
+		case base == "" || base[0] == '.' || base[0] == '_' || d.excluded != nil && d.excluded[base]:
+			continue
+
+		case f.IsDir():
+			d.subdirs = append(d.subdirs, base)
+
+		case c.FollowSymlinks && f.Mode()&os.ModeSymlink != 0 && isDir(filepath.Join(path, base)):
+			d.subdirs = append(d.subdirs, base)
+
+		case strings.HasSuffix(base, ".go"):
+			d.goFiles = append(d.goFiles, base)
+			d.files = append(d.files, base)
+
+		default:
+			d.otherFiles = append(d.otherFiles, base)
+			d.files = append(d.files, base)
+		}
+	}
+	return d, true
+}
+
+// Scan is like Walk, but it does not pass existing build files to f. It is
+// intended for tools that need information about Go packages but don't
+// generate or modify build files. Files are read with FullScanOptions, so
+// packages include information rules don't need, like Generate. Errors are
+// logged, and directories where errors occur are skipped.
+func Scan(c *config.Config, dir string, f func(pkg *Package)) {
+	walkDirs(c, dir, FullScanOptions, func(d *Dir) {
+		if d.Package != nil {
+			f(d.Package)
+		}
+	})
+}
+
+// isDir returns whether path names a directory, following symbolic links.
+func isDir(path string) bool {
+	st, err := os.Stat(path)
+	return err == nil && st.IsDir()
 }
 
 // buildPackage reads source files in a given directory and returns a Package
@@ -154,10 +577,16 @@ func Walk(c *config.Config, dir string, f WalkFunc) {
 // name matches the directory base name will be returned. If there is no such
 // package or if an error occurs, an error will be logged, and nil will be
 // returned.
-func buildPackage(c *config.Config, dir string, oldFile *bf.File, goFiles, genGoFiles, otherFiles []string, hasTestdata bool) *Package {
+//
+// Files matched by "//go:embed" patterns are added to the data of the
+// targets that embed them. If dataLiterals is true, files named by string
+// literals are added too. If cLibrary is true, the C files of the cgo
+// library are moved to Package.CLibrary. Files are read with s.
+func buildPackage(s *Scanner, dir string, oldFile *bf.File, goFiles, genGoFiles, otherFiles []string, hasTestdata, dataLiterals, cLibrary bool) *Package {
+	c := s.c
 	rel, err := filepath.Rel(c.RepoRoot, dir)
 	if err != nil {
-		log.Print(err)
+		logging.Error(err)
 		return nil
 	}
 	rel = filepath.ToSlash(rel)
@@ -166,19 +595,29 @@ func buildPackage(c *config.Config, dir string, oldFile *bf.File, goFiles, genGo
 	}
 
 	// Process the .go files first.
-	packageMap := make(map[string]*Package)
-	cgo := false
+	goInfosPtr := getFileInfos()
+	goInfos := *goInfosPtr
+	defer func() { putFileInfos(goInfosPtr, goInfos) }()
 	for _, goFile := range goFiles {
-		info, err := goFileInfo(c, dir, goFile)
+		info, err := s.goFileInfo(dir, goFile)
 		if err != nil {
-			log.Print(err)
+			logging.Warning(err)
 			continue
 		}
 		if info.packageName == "documentation" {
 			// go/build ignores this package
 			continue
 		}
+		info.data = embedFiles(c, dir, info.embeds)
+		if dataLiterals {
+			info.data = append(info.data, literalFiles(c, dir, info)...)
+		}
+		goInfos = append(goInfos, info)
+	}
 
+	packageMap := make(map[string]*Package)
+	cgo := false
+	for _, info := range goInfos {
 		cgo = cgo || info.isCgo
 
 		if _, ok := packageMap[info.packageName]; !ok {
@@ -191,7 +630,7 @@ func buildPackage(c *config.Config, dir string, oldFile *bf.File, goFiles, genGo
 		}
 		err = packageMap[info.packageName].addFile(c, info, false)
 		if err != nil {
-			log.Print(err)
+			logging.Warning(err)
 		}
 	}
 
@@ -199,7 +638,7 @@ func buildPackage(c *config.Config, dir string, oldFile *bf.File, goFiles, genGo
 	pkg, err := selectPackage(c, dir, packageMap)
 	if err != nil {
 		if _, ok := err.(*build.NoGoError); !ok {
-			log.Print(err)
+			logging.Error(err)
 		}
 		return nil
 	}
@@ -216,23 +655,53 @@ func buildPackage(c *config.Config, dir string, oldFile *bf.File, goFiles, genGo
 		info := fileNameInfo(dir, goFile)
 		err := pkg.addFile(c, info, false)
 		if err != nil {
-			log.Print(err)
+			logging.Warning(err)
 		}
 	}
 
-	// Process the other files.
+	// Process the other files. includes records what each file in dir
+	// includes, including files that include nothing, so excluded headers
+	// aren't added back when they're included.
+	includes := make(map[string][]string)
+	for _, info := range goInfos {
+		includes[info.name] = info.includes
+	}
 	for _, file := range otherFiles {
 		info, err := otherFileInfo(dir, file)
 		if err != nil {
-			log.Print(err)
+			logging.Warning(err)
 			continue
 		}
+		includes[info.name] = info.includes
 		err = pkg.addFile(c, info, cgo)
 		if err != nil {
-			log.Print(err)
+			logging.Warning(err)
 		}
 	}
 
+	// Add headers the C and assembly files include that weren't added with
+	// them, like headers in subdirectories, or headers with platform
+	// suffixes that are included on every platform.
+	for _, t := range []*Target{&pkg.Library, &pkg.CgoLibrary, &pkg.Test, &pkg.XTest} {
+		addIncludedHeaders(c, dir, t, includes)
+	}
+
+	if cLibrary && pkg.CgoLibrary.HasGo() {
+		pkg.splitCLibrary()
+	}
+
+	// An internal test that uses cgo can't embed a library that also uses
+	// cgo, since each can only have its own cgo code. Build the test from
+	// the library's sources instead.
+	if pkg.Test.Cgo && pkg.CgoLibrary.HasGo() {
+		pkg.inlineLibrary()
+	}
+
+	for _, t := range []*Target{&pkg.Library, &pkg.CgoLibrary, &pkg.CLibrary, &pkg.Binary, &pkg.Test, &pkg.XTest} {
+		t.COpts.CleanOpts()
+		t.CLinkOpts.CleanOpts()
+	}
+
 	return pkg
 }
 
@@ -308,6 +777,15 @@ func findGenGoFiles(f *bf.File, excluded map[string]bool) []string {
 	return goFiles
 }
 
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
 const gazelleExclude = "# gazelle:exclude " // marker in a BUILD file to exclude source files.
 
 func findExcludedFiles(f *bf.File) map[string]bool {
@@ -323,3 +801,441 @@ func findExcludedFiles(f *bf.File) map[string]bool {
 	}
 	return excluded
 }
+
+// directives holds settings from directives in build files that apply to a
+// directory and its subdirectories.
+type directives struct {
+	strategies           map[string]config.MergeStrategy
+	xDefs                map[string]string
+	mapKinds             map[string]MappedKind
+	gcGoopts, gcLinkopts PlatformStrings
+	test                 TestAttrs
+	dataLiterals         bool
+	cgoCcLibrary         bool
+	goVersion            config.GoVersion
+	defaultVisibility    []string
+}
+
+// apply returns d updated with directives in f. d is not modified.
+func (d directives) apply(f *bf.File) directives {
+	return directives{
+		strategies:        applyMergeDirectives(f, d.strategies),
+		xDefs:             applyXDefDirectives(f, d.xDefs),
+		mapKinds:          applyMapKindDirectives(f, d.mapKinds),
+		gcGoopts:          applyOptsDirectives(f, gazelleGcGoopts, d.gcGoopts),
+		gcLinkopts:        applyOptsDirectives(f, gazelleGcLinkopts, d.gcLinkopts),
+		test:              applyTestDirectives(f, d.test),
+		dataLiterals:      applyDataLiteralsDirective(f, d.dataLiterals),
+		cgoCcLibrary:      applyCgoCcLibraryDirective(f, d.cgoCcLibrary),
+		goVersion:         applyGoVersionDirective(f, d.goVersion),
+		defaultVisibility: applyDefaultVisibilityDirective(f, d.defaultVisibility),
+	}
+}
+
+// gazelleMerge is a marker in a build file that sets the strategy for
+// merging an attribute, for example, "# gazelle:merge deps union". It
+// applies to the directory and its subdirectories.
+const gazelleMerge = "# gazelle:merge "
+
+// applyMergeDirectives returns strategies updated with "# gazelle:merge"
+// directives in f. strategies is not modified; a copy is returned if there
+// are any directives.
+func applyMergeDirectives(f *bf.File, strategies map[string]config.MergeStrategy) map[string]config.MergeStrategy {
+	copied := false
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, c := range comments {
+			if !strings.HasPrefix(c.Token, gazelleMerge) {
+				continue
+			}
+			fields := strings.Fields(c.Token[len(gazelleMerge):])
+			if len(fields) != 2 {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: want attribute name and strategy", f.Path, c.Token)
+				continue
+			}
+			strategy, err := config.MergeStrategyFromString(fields[1])
+			if err != nil {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %v", f.Path, err)
+				continue
+			}
+			if !copied {
+				m := make(map[string]config.MergeStrategy)
+				for k, v := range strategies {
+					m[k] = v
+				}
+				strategies = m
+				copied = true
+			}
+			strategies[fields[0]] = strategy
+		}
+	}
+	return strategies
+}
+
+// gazelleXDef is a marker in a build file that sets the link-time value of
+// a Go variable in binaries and tests, for example,
+// "# gazelle:x_def example.com/pkg/version.Version={BUILD_EMBED_LABEL}". It
+// applies to the directory and its subdirectories.
+const gazelleXDef = "# gazelle:x_def "
+
+// applyXDefDirectives returns xDefs updated with "# gazelle:x_def"
+// directives in f. xDefs is not modified; a copy is returned if there are
+// any directives.
+func applyXDefDirectives(f *bf.File, xDefs map[string]string) map[string]string {
+	copied := false
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, c := range comments {
+			if !strings.HasPrefix(c.Token, gazelleXDef) {
+				continue
+			}
+			def := strings.TrimSpace(c.Token[len(gazelleXDef):])
+			i := strings.Index(def, "=")
+			if i < 0 || !isQualifiedVar(def[:i]) {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: want importpath.Var=value", f.Path, c.Token)
+				continue
+			}
+			if !copied {
+				m := make(map[string]string)
+				for k, v := range xDefs {
+					m[k] = v
+				}
+				xDefs = m
+				copied = true
+			}
+			xDefs[def[:i]] = def[i+1:]
+		}
+	}
+	return xDefs
+}
+
+// gazelleMapKind is a marker in a build file that replaces a kind of rule
+// Gazelle generates with another kind in the directory and its
+// subdirectories, for example,
+// "# gazelle:map_kind go_test my_go_test //tools:go.bzl". The third field is
+// the .bzl file the new kind is loaded from.
+const gazelleMapKind = "# gazelle:map_kind "
+
+// applyMapKindDirectives returns mapKinds updated with "# gazelle:map_kind"
+// directives in f. mapKinds is not modified; a copy is returned if there are
+// any directives.
+func applyMapKindDirectives(f *bf.File, mapKinds map[string]MappedKind) map[string]MappedKind {
+	copied := false
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, c := range comments {
+			if !strings.HasPrefix(c.Token, gazelleMapKind) {
+				continue
+			}
+			fields := strings.Fields(c.Token[len(gazelleMapKind):])
+			if len(fields) != 3 {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: want from_kind to_kind load_file", f.Path, c.Token)
+				continue
+			}
+			if !copied {
+				m := make(map[string]MappedKind)
+				for k, v := range mapKinds {
+					m[k] = v
+				}
+				mapKinds = m
+				copied = true
+			}
+			mapKinds[fields[0]] = MappedKind{FromKind: fields[0], KindName: fields[1], KindLoad: fields[2]}
+		}
+	}
+	return mapKinds
+}
+
+// gazelleGcGoopts and gazelleGcLinkopts are markers in a build file that add
+// options for the Go compiler and linker to rules in the directory and its
+// subdirectories, for example, "# gazelle:gc_goopts -N -l". If the first
+// field ends with a colon, it names the platform the options apply to, for
+// example, "# gazelle:gc_linkopts linux_amd64: -linkmode external".
+const (
+	gazelleGcGoopts   = "# gazelle:gc_goopts "
+	gazelleGcLinkopts = "# gazelle:gc_linkopts "
+)
+
+// applyOptsDirectives returns opts with options from directives in f that
+// start with prefix appended. opts is not modified; a copy is returned if
+// there are any directives. Options are not sorted or de-duplicated, since
+// their order matters.
+func applyOptsDirectives(f *bf.File, prefix string, opts PlatformStrings) PlatformStrings {
+	copied := false
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, c := range comments {
+			if !strings.HasPrefix(c.Token, prefix) {
+				continue
+			}
+			fields := strings.Fields(c.Token[len(prefix):])
+			platform := ""
+			if len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+				platform = strings.TrimSuffix(fields[0], ":")
+				fields = fields[1:]
+				if !isPlatformName(platform) {
+					logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: invalid platform %q", f.Path, c.Token, platform)
+					continue
+				}
+			}
+			if len(fields) == 0 {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: want options", f.Path, c.Token)
+				continue
+			}
+			if !copied {
+				opts = opts.clone()
+				copied = true
+			}
+			if platform == "" {
+				opts.addGenericStrings(fields...)
+			} else {
+				opts.addPlatformStrings(config.PlatformLabelPrefix+platform, fields...)
+			}
+		}
+	}
+	return opts
+}
+
+// gazelleTestSize, gazelleTestTimeout, and gazelleTestShardCount are markers
+// in a build file that set the size, timeout, and shard_count attributes of
+// go_test rules in the directory and its subdirectories, for example,
+// "# gazelle:test_size large".
+const (
+	gazelleTestSize       = "# gazelle:test_size "
+	gazelleTestTimeout    = "# gazelle:test_timeout "
+	gazelleTestShardCount = "# gazelle:test_shard_count "
+)
+
+// applyTestDirectives returns test updated with test attribute directives
+// in f. Invalid values are reported and ignored.
+func applyTestDirectives(f *bf.File, test TestAttrs) TestAttrs {
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, c := range comments {
+			switch {
+			case strings.HasPrefix(c.Token, gazelleTestSize):
+				v := strings.TrimSpace(c.Token[len(gazelleTestSize):])
+				if !config.ValidTestSizes[v] {
+					logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: invalid test size %q", f.Path, c.Token, v)
+					continue
+				}
+				test.Size = v
+			case strings.HasPrefix(c.Token, gazelleTestTimeout):
+				v := strings.TrimSpace(c.Token[len(gazelleTestTimeout):])
+				if !config.ValidTestTimeouts[v] {
+					logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: invalid test timeout %q", f.Path, c.Token, v)
+					continue
+				}
+				test.Timeout = v
+			case strings.HasPrefix(c.Token, gazelleTestShardCount):
+				v := strings.TrimSpace(c.Token[len(gazelleTestShardCount):])
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 1 {
+					logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: shard count must be a positive integer", f.Path, c.Token)
+					continue
+				}
+				test.ShardCount = n
+			}
+		}
+	}
+	return test
+}
+
+// gazelleDataLiterals is a marker in a build file that enables or disables
+// adding files named by string literals in .go files to the data attributes
+// of rules in the directory and its subdirectories, for example,
+// "# gazelle:data_literals true".
+const gazelleDataLiterals = "# gazelle:data_literals "
+
+// applyDataLiteralsDirective returns whether string literals should be
+// scanned for file names, according to directives in f.
+func applyDataLiteralsDirective(f *bf.File, enabled bool) bool {
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, c := range comments {
+			if !strings.HasPrefix(c.Token, gazelleDataLiterals) {
+				continue
+			}
+			v, err := strconv.ParseBool(strings.TrimSpace(c.Token[len(gazelleDataLiterals):]))
+			if err != nil {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: value must be true or false", f.Path, c.Token)
+				continue
+			}
+			enabled = v
+		}
+	}
+	return enabled
+}
+
+// gazelleCgoCcLibrary is a marker in a build file that enables or disables
+// building the C files of cgo libraries with a separate cc_library in the
+// directory and its subdirectories, for example,
+// "# gazelle:cgo_cc_library true".
+const gazelleCgoCcLibrary = "# gazelle:cgo_cc_library "
+
+// applyCgoCcLibraryDirective returns whether C files should be built with a
+// separate cc_library, according to directives in f.
+func applyCgoCcLibraryDirective(f *bf.File, enabled bool) bool {
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, c := range comments {
+			if !strings.HasPrefix(c.Token, gazelleCgoCcLibrary) {
+				continue
+			}
+			v, err := strconv.ParseBool(strings.TrimSpace(c.Token[len(gazelleCgoCcLibrary):]))
+			if err != nil {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: value must be true or false", f.Path, c.Token)
+				continue
+			}
+			enabled = v
+		}
+	}
+	return enabled
+}
+
+// gazelleGoVersion is a marker in a build file that declares the minimum Go
+// version packages in the directory and its subdirectories need, for
+// example, "# gazelle:go_version 1.9".
+const gazelleGoVersion = "# gazelle:go_version "
+
+// applyGoVersionDirective returns the Go version declared by directives in
+// f, or version if there are none.
+func applyGoVersionDirective(f *bf.File, version config.GoVersion) config.GoVersion {
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, c := range comments {
+			if !strings.HasPrefix(c.Token, gazelleGoVersion) {
+				continue
+			}
+			v, err := config.ParseGoVersion(strings.TrimSpace(c.Token[len(gazelleGoVersion):]))
+			if err != nil {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: %v", f.Path, c.Token, err)
+				continue
+			}
+			version = v
+		}
+	}
+	return version
+}
+
+// ManagedByPrefix starts a marker in a build file that declares the file is
+// owned by another tool, for example, "# gazelle:managed_by protoc-gen-bazel".
+// It only applies to the directory containing the build file.
+const ManagedByPrefix = "# gazelle:managed_by"
+
+// ManagedBy returns the name of the tool a "# gazelle:managed_by" directive
+// in f says owns it, or "" if there is no directive. A directive without a
+// name is reported, and "unknown" is returned, so the file is still left
+// alone.
+func ManagedBy(f *bf.File) string {
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, c := range comments {
+			if c.Token != ManagedByPrefix && !strings.HasPrefix(c.Token, ManagedByPrefix+" ") {
+				continue
+			}
+			tool := strings.TrimSpace(c.Token[len(ManagedByPrefix):])
+			if tool == "" {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: want the name of the tool that owns the file", f.Path, c.Token)
+				tool = "unknown"
+			}
+			return tool
+		}
+	}
+	return ""
+}
+
+// isPlatformName returns whether name could name a platform, like
+// "linux_amd64".
+func isPlatformName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// isQualifiedVar returns whether name looks like a Go variable qualified
+// by an import path, like "example.com/pkg/version.Version".
+func isQualifiedVar(name string) bool {
+	i := strings.LastIndex(name, ".")
+	return i > 0 && i < len(name)-1 && !strings.ContainsAny(name, " \t") &&
+		!strings.Contains(name[i+1:], "/")
+}
+
+// inheritedDirectives returns the directives that apply to dir, starting
+// with c.MergeStrategies and applying directives in build files in the
+// directories between c.RepoRoot and dir, not including dir itself.
+func inheritedDirectives(c *config.Config, dir string) directives {
+	d := directives{strategies: c.MergeStrategies}
+	rel, err := filepath.Rel(c.RepoRoot, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return d
+	}
+	p := c.RepoRoot
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if f := readBuildFile(c, p); f != nil {
+			d = d.apply(f)
+		}
+		p = filepath.Join(p, name)
+	}
+	return d
+}
+
+// readBuildFile parses the build file in dir. It returns nil if there is
+// no build file or it can't be read; errors are reported when the
+// directory itself is visited.
+func readBuildFile(c *config.Config, dir string) *bf.File {
+	for _, base := range c.ValidBuildFileNames {
+		p := filepath.Join(dir, base)
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		f, err := bf.Parse(p, data)
+		if err != nil {
+			return nil
+		}
+		return f
+	}
+	return nil
+}
+
+// gazelleDefaultVisibility is a marker in a build file that sets the
+// default visibility of rules in new build files in the directory and its
+// subdirectories, for example,
+// "# gazelle:default_visibility //foo:__subpackages__". Several labels may
+// be listed, separated by commas or spaces.
+const gazelleDefaultVisibility = "# gazelle:default_visibility "
+
+// applyDefaultVisibilityDirective returns the default visibility set by
+// directives in f, or visibility if there are none.
+func applyDefaultVisibilityDirective(f *bf.File, visibility []string) []string {
+	for _, s := range f.Stmt {
+		comments := append(s.Comment().Before, s.Comment().After...)
+		for _, c := range comments {
+			if !strings.HasPrefix(c.Token, gazelleDefaultVisibility) {
+				continue
+			}
+			labels := strings.FieldsFunc(c.Token[len(gazelleDefaultVisibility):], func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})
+			valid := len(labels) > 0
+			for _, l := range labels {
+				if !strings.HasPrefix(l, "//") && !strings.HasPrefix(l, "@") {
+					valid = false
+				}
+			}
+			if !valid {
+				logging.Warningf(logging.InvalidDirective, f.Path, "%s: %q: want absolute labels", f.Path, c.Token)
+				continue
+			}
+			visibility = labels
+		}
+	}
+	return visibility
+}
@@ -16,10 +16,13 @@ limitations under the License.
 package packages_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -355,6 +358,469 @@ import "github.com/jr_hacker/stuff"
 	checkFiles(t, files, "", want)
 }
 
+func TestCgoTest(t *testing.T) {
+	files := []fileSpec{
+		{path: "lib.go", content: "package lib"},
+		{
+			path: "lib_test.go",
+			content: `package lib
+
+import "C"
+`,
+		},
+		{path: "helper.c"},
+		{path: "helper.h"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go"},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib_test.go", "helper.c"},
+				},
+				Hdrs: packages.PlatformStrings{
+					Generic: []string{"helper.h"},
+				},
+				TestStats: config.TestStats{Files: 1},
+				Cgo:       true,
+			},
+		},
+	}
+	checkFiles(t, files, "", want)
+}
+
+func TestAsmToolchainHeaders(t *testing.T) {
+	files := []fileSpec{
+		{path: "lib.go", content: "package lib"},
+		{path: "lib.s", content: `#include "textflag.h"`},
+		{path: "textflag.h"},
+		{path: "go_asm.h"},
+		{path: "consts.h"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go", "lib.s"},
+				},
+				Hdrs: packages.PlatformStrings{
+					Generic: []string{"consts.h"},
+				},
+			},
+		},
+	}
+	checkFiles(t, files, "", want)
+}
+
+func TestNoCgoPlatforms(t *testing.T) {
+	files := []fileSpec{
+		{path: "foo.go", content: "package foo"},
+		{
+			path: "foo_cgo.go",
+			content: `// +build !windows
+
+package foo
+
+import "C"
+`,
+		},
+		{path: "foo_cgo.c"},
+		{
+			path: "foo_nocgo.go",
+			content: `// +build !cgo
+
+package foo
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	darwin := config.Platform{OS: "darwin", Arch: "amd64"}.Label()
+	linux := config.Platform{OS: "linux", Arch: "amd64"}.Label()
+	windows := config.Platform{OS: "windows", Arch: "amd64"}.Label()
+	c := &config.Config{
+		RepoRoot:            dir,
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+		GenericTags:         config.BuildTags{},
+		Platforms:           config.DefaultPlatformTags,
+		NoCgoPlatforms:      map[string]bool{darwin: true, windows: true},
+	}
+	c.PreprocessTags()
+	var got *packages.Package
+	packages.Walk(c, dir, func(pkg *packages.Package, _ *bf.File) {
+		got = pkg
+	})
+
+	// The cgo files are only built on linux, and the fallback is built on
+	// the platforms without cgo.
+	wantLib := packages.PlatformStrings{
+		Generic: []string{"foo.go"},
+		Platform: map[string][]string{
+			darwin:  {"foo_nocgo.go"},
+			windows: {"foo_nocgo.go"},
+		},
+	}
+	wantCgoLib := packages.PlatformStrings{
+		Platform: map[string][]string{
+			linux: {"foo_cgo.go", "foo_cgo.c"},
+		},
+	}
+	if !reflect.DeepEqual(got.Library.Sources, wantLib) {
+		t.Errorf("got library srcs %#v; want %#v", got.Library.Sources, wantLib)
+	}
+	if !reflect.DeepEqual(got.CgoLibrary.Sources, wantCgoLib) {
+		t.Errorf("got cgo library srcs %#v; want %#v", got.CgoLibrary.Sources, wantCgoLib)
+	}
+}
+
+func TestCgoHeaders(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "foo.go",
+			content: `package foo
+
+import "C"
+`,
+		},
+		{path: "foo.c"},
+		{path: "foo.h"},
+		{path: "foo_linux.h"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+		GenericTags:         config.BuildTags{},
+		Platforms:           config.DefaultPlatformTags,
+	}
+	c.PreprocessTags()
+	var got *packages.Package
+	packages.Walk(c, dir, func(pkg *packages.Package, _ *bf.File) {
+		got = pkg
+	})
+
+	wantSrcs := []string{"foo.go", "foo.c"}
+	if !reflect.DeepEqual(got.CgoLibrary.Sources.Generic, wantSrcs) {
+		t.Errorf("got cgo library srcs %v; want %v", got.CgoLibrary.Sources.Generic, wantSrcs)
+	}
+	wantHdrs := []string{"foo.h"}
+	if !reflect.DeepEqual(got.CgoLibrary.Hdrs.Generic, wantHdrs) {
+		t.Errorf("got cgo library hdrs %v; want %v", got.CgoLibrary.Hdrs.Generic, wantHdrs)
+	}
+	for label, hdrs := range got.CgoLibrary.Hdrs.Platform {
+		want := []string(nil)
+		if strings.HasPrefix(label, config.PlatformLabelPrefix+"linux_") {
+			want = []string{"foo_linux.h"}
+		}
+		if !reflect.DeepEqual(hdrs, want) {
+			t.Errorf("got hdrs %v on %s; want %v", hdrs, label, want)
+		}
+	}
+	if len(got.CgoLibrary.Hdrs.Platform) == 0 {
+		t.Errorf("got no platform-specific hdrs; want foo_linux.h on linux")
+	}
+}
+
+func TestIncludedHeaders(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "foo.go",
+			content: `package foo
+
+// #include <stdlib.h>
+// #include "sub/api.h"
+import "C"
+`,
+		},
+		{path: "foo.c", content: `#include "foo_linux.h"` + "\n"},
+		{path: "foo_linux.h"},
+		{path: "sub/api.h", content: `#include "inner.h"` + "\n"},
+		{path: "sub/inner.h"},
+		{path: "pkg/BUILD"},
+		{path: "pkg/other.h"},
+		{path: "unused.h", content: "// +build ignore\n\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+		GenericTags:         config.BuildTags{},
+		Platforms:           config.DefaultPlatformTags,
+	}
+	c.PreprocessTags()
+	var got *packages.Package
+	packages.Walk(c, dir, func(pkg *packages.Package, _ *bf.File) {
+		if pkg.Rel == "" {
+			got = pkg
+		}
+	})
+
+	// foo_linux.h is included by a file built on every platform, so it's
+	// listed on every platform.
+	wantHdrs := []string{"foo_linux.h", "sub/api.h", "sub/inner.h"}
+	if !reflect.DeepEqual(got.CgoLibrary.Hdrs.Generic, wantHdrs) {
+		t.Errorf("got hdrs %v; want %v", got.CgoLibrary.Hdrs.Generic, wantHdrs)
+	}
+	if len(got.CgoLibrary.Hdrs.Platform) != 0 {
+		t.Errorf("got platform-specific hdrs %v; want none", got.CgoLibrary.Hdrs.Platform)
+	}
+}
+
+func TestCgoLinkOrder(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "sdl/sdl.go",
+			content: `package sdl
+
+// #cgo LDFLAGS: -lSDL2main
+// #cgo LDFLAGS: -lSDL2
+// #cgo LDFLAGS: -lm
+import "C"
+`,
+		},
+		{
+			path: "sqlite3/sqlite3.go",
+			content: `package sqlite3
+
+// #cgo CFLAGS: -std=gnu99
+// #cgo CFLAGS: -DSQLITE_ENABLE_RTREE -DSQLITE_THREADSAFE=1
+// #cgo LDFLAGS: -lsqlite3
+import "C"
+`,
+		},
+		{
+			path: "sqlite3/sqlite3_load_extension.go",
+			content: `package sqlite3
+
+// #cgo LDFLAGS: -lsqlite3
+// #cgo LDFLAGS: -ldl
+import "C"
+`,
+		},
+	}
+	want := []*packages.Package{
+		{
+			Name: "sdl",
+			Rel:  "sdl",
+			CgoLibrary: packages.Target{
+				Sources:   packages.PlatformStrings{Generic: []string{"sdl.go"}},
+				CLinkOpts: packages.PlatformStrings{Generic: []string{"-lSDL2main", "-lSDL2", "-lm"}},
+				Cgo:       true,
+			},
+		},
+		{
+			Name: "sqlite3",
+			Rel:  "sqlite3",
+			CgoLibrary: packages.Target{
+				Sources:   packages.PlatformStrings{Generic: []string{"sqlite3.go", "sqlite3_load_extension.go"}},
+				COpts:     packages.PlatformStrings{Generic: []string{"-std=gnu99", "-DSQLITE_ENABLE_RTREE -DSQLITE_THREADSAFE=1"}},
+				CLinkOpts: packages.PlatformStrings{Generic: []string{"-lsqlite3", "-ldl"}},
+				Cgo:       true,
+			},
+		},
+	}
+	checkFiles(t, files, "example.com/repo", want)
+}
+
+func TestCgoTestWithCgoLibrary(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "lib.go",
+			content: `package lib
+
+import "C"
+`,
+		},
+		{
+			path: "lib_test.go",
+			content: `package lib
+
+import "C"
+`,
+		},
+		{
+			path: "lib_x_test.go",
+			content: `package lib_test
+
+import "C"
+`,
+		},
+		{path: "helper.c"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			CgoLibrary: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go", "helper.c"},
+				},
+				Cgo: true,
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go", "helper.c", "lib_test.go"},
+				},
+				TestStats: config.TestStats{Files: 1},
+				Cgo:       true,
+			},
+			XTest: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib_x_test.go"},
+				},
+				TestStats: config.TestStats{Files: 1},
+				Cgo:       true,
+			},
+			StandaloneTest: true,
+		},
+	}
+	checkFiles(t, files, "", want)
+}
+
+func TestCgoCcLibraryDirective(t *testing.T) {
+	files := []fileSpec{
+		{path: "BUILD", content: "# gazelle:cgo_cc_library true\n"},
+		{path: "lib.go", content: "package lib"},
+		{
+			path: "cgo.go",
+			content: `package lib
+
+// #cgo CFLAGS: -DFOO
+// #cgo LDFLAGS: -lm
+import "C"
+`,
+		},
+		{path: "helper.c"},
+		{path: "helper.h"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"lib.go"}},
+			},
+			CgoLibrary: packages.Target{
+				Sources:   packages.PlatformStrings{Generic: []string{"cgo.go"}},
+				COpts:     packages.PlatformStrings{Generic: []string{"-DFOO"}},
+				CLinkOpts: packages.PlatformStrings{Generic: []string{"-lm"}},
+				Cgo:       true,
+			},
+			CLibrary: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"helper.c"}},
+				Hdrs:    packages.PlatformStrings{Generic: []string{"helper.h"}},
+				COpts:   packages.PlatformStrings{Generic: []string{"-DFOO"}},
+			},
+		},
+	}
+	checkFiles(t, files, "", want)
+}
+
+func TestEmbedData(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "lib.go",
+			content: `package lib
+
+import "embed"
+
+//go:embed version.txt static
+var content embed.FS
+`,
+		},
+		{
+			path: "lib_test.go",
+			content: `package lib
+
+import _ "embed"
+
+//go:embed all:golden
+var golden string
+`,
+		},
+		{path: "version.txt"},
+		{path: "static/index.html"},
+		{path: "static/.hidden"},
+		{path: "static/sub/BUILD"},
+		{path: "static/sub/other.html"},
+		{path: "golden/.hidden"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go"},
+				},
+				Data: packages.PlatformStrings{
+					Generic: []string{"version.txt", "static/index.html"},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib_test.go"},
+				},
+				TestStats: config.TestStats{Files: 1},
+				Data: packages.PlatformStrings{
+					Generic: []string{"golden/.hidden"},
+				},
+			},
+		},
+	}
+	checkFiles(t, files, "", want)
+}
+
+func TestDataLiterals(t *testing.T) {
+	files := []fileSpec{
+		{path: "BUILD", content: "# gazelle:data_literals true"},
+		{
+			path: "lib.go",
+			content: `package lib
+
+var (
+	tmpl    = "templates/index.html"
+	missing = "templates/missing.html"
+	source  = "lib.go"
+	parent  = "../BUILD"
+)
+`,
+		},
+		{path: "templates/index.html"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go"},
+				},
+				Data: packages.PlatformStrings{
+					Generic: []string{"templates/index.html"},
+				},
+			},
+		},
+	}
+	checkFiles(t, files, "", want)
+}
+
 func TestExcluded(t *testing.T) {
 	files := []fileSpec{
 		{
@@ -362,45 +828,570 @@ func TestExcluded(t *testing.T) {
 			content: `
 # gazelle:exclude do.go
 
-# gazelle:exclude not.go
-x = 0
-# gazelle:exclude build.go
+# gazelle:exclude not.go
+x = 0
+# gazelle:exclude build.go
+
+genrule(
+    name = "gen_build",
+    outs = ["build.go"],
+)
+`,
+		},
+		{
+			path:    "exclude/do.go",
+			content: "",
+		},
+		{
+			path:    "exclude/not.go",
+			content: "",
+		},
+		{
+			path:    "exclude/build.go",
+			content: "",
+		},
+		{
+			path:    "exclude/real.go",
+			content: "package exclude",
+		},
+	}
+	want := []*packages.Package{
+		{
+			Name: "exclude",
+			Rel:  "exclude",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"real.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, files, "", want)
+}
+
+func TestExcludedPaths(t *testing.T) {
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/b/b.go", content: "package b"},
+		{path: "node_modules/x/x.go", content: "package x"},
+		{path: "bazel-out/y.go", content: "package y"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+		ExcludedPaths:       []string{"a/b", "node_modules", "bazel-*"},
+	}
+	var got []*packages.Package
+	packages.Walk(c, dir, func(pkg *packages.Package, _ *bf.File) {
+		got = append(got, pkg)
+	})
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  filepath.Join(dir, "a"),
+			Rel:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+		},
+	}
+	checkPackages(t, got, want)
+}
+
+func TestMergeDirectives(t *testing.T) {
+	files := []fileSpec{
+		{path: "BUILD", content: "# gazelle:merge deps union\n"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/b/BUILD", content: "# gazelle:merge deps keep\n# gazelle:merge srcs union\n"},
+		{path: "a/b/b.go", content: "package b"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		GoPrefix:            "example.com/repo",
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+		MergeStrategies:     map[string]config.MergeStrategy{"copts": config.KeepStrategy},
+	}
+	want := map[string]map[string]config.MergeStrategy{
+		"a/b": {"copts": config.KeepStrategy, "deps": config.KeepStrategy, "srcs": config.UnionStrategy},
+		"a":   {"copts": config.KeepStrategy, "deps": config.UnionStrategy},
+	}
+	// Directives in parent directories apply even when the walk starts in
+	// a subdirectory.
+	for _, start := range []string{dir, filepath.Join(dir, "a")} {
+		got := make(map[string]map[string]config.MergeStrategy)
+		packages.WalkDirs(c, start, func(d *packages.Dir) {
+			if d.Rel != "" {
+				got[d.Rel] = d.MergeStrategies
+			}
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("walk from %s: got %v; want %v", start, got, want)
+		}
+	}
+	if len(c.MergeStrategies) != 1 {
+		t.Errorf("c.MergeStrategies was modified: %v", c.MergeStrategies)
+	}
+}
+
+func TestXDefDirectives(t *testing.T) {
+	files := []fileSpec{
+		{path: "BUILD", content: "# gazelle:x_def example.com/repo/version.Version={BUILD_EMBED_LABEL}\n"},
+		{path: "cmd/main.go", content: "package main"},
+		{path: "cmd/BUILD", content: "# gazelle:x_def example.com/repo/version.Commit={BUILD_SCM_REVISION}\n# gazelle:x_def bad\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		GoPrefix:            "example.com/repo",
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+	}
+	got := make(map[string]map[string]string)
+	packages.WalkDirs(c, dir, func(d *packages.Dir) {
+		got[d.Rel] = d.XDefs
+	})
+	want := map[string]map[string]string{
+		"": {"example.com/repo/version.Version": "{BUILD_EMBED_LABEL}"},
+		"cmd": {
+			"example.com/repo/version.Version": "{BUILD_EMBED_LABEL}",
+			"example.com/repo/version.Commit":  "{BUILD_SCM_REVISION}",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestMapKindDirectives(t *testing.T) {
+	files := []fileSpec{
+		{path: "BUILD", content: "# gazelle:map_kind go_test my_go_test //tools:go.bzl\n"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/BUILD", content: "# gazelle:map_kind go_fuzz_test fuzz_test //tools:fuzz.bzl\n# gazelle:map_kind bad\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
 
-genrule(
-    name = "gen_build",
-    outs = ["build.go"],
-)
-`,
-		},
-		{
-			path:    "exclude/do.go",
-			content: "",
+	c := &config.Config{
+		RepoRoot:            dir,
+		GoPrefix:            "example.com/repo",
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+	}
+	got := make(map[string]map[string]packages.MappedKind)
+	packages.WalkDirs(c, dir, func(d *packages.Dir) {
+		got[d.Rel] = d.MapKinds
+	})
+	goTest := packages.MappedKind{FromKind: "go_test", KindName: "my_go_test", KindLoad: "//tools:go.bzl"}
+	want := map[string]map[string]packages.MappedKind{
+		"": {"go_test": goTest},
+		"a": {
+			"go_test":      goTest,
+			"go_fuzz_test": {FromKind: "go_fuzz_test", KindName: "fuzz_test", KindLoad: "//tools:fuzz.bzl"},
 		},
-		{
-			path:    "exclude/not.go",
-			content: "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestOptsDirectives(t *testing.T) {
+	files := []fileSpec{
+		{path: "BUILD", content: "# gazelle:gc_goopts -N -l\n# gazelle:gc_linkopts linux_amd64: -linkmode external\n"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/BUILD", content: "# gazelle:gc_linkopts -s\n# gazelle:gc_goopts Bad/Platform: -B\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		GoPrefix:            "example.com/repo",
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+	}
+	var got *packages.Dir
+	packages.WalkDirs(c, dir, func(d *packages.Dir) {
+		if d.Rel == "a" {
+			got = d
+		}
+	})
+	if got == nil {
+		t.Fatal("directory a not visited")
+	}
+	wantGoopts := packages.PlatformStrings{Generic: []string{"-N", "-l"}}
+	if !reflect.DeepEqual(got.GcGoopts, wantGoopts) {
+		t.Errorf("got gc_goopts %#v; want %#v", got.GcGoopts, wantGoopts)
+	}
+	wantLinkopts := packages.PlatformStrings{
+		Generic: []string{"-s"},
+		Platform: map[string][]string{
+			"@io_bazel_rules_go//go/platform:linux_amd64": {"-linkmode", "external"},
 		},
+	}
+	if !reflect.DeepEqual(got.GcLinkopts, wantLinkopts) {
+		t.Errorf("got gc_linkopts %#v; want %#v", got.GcLinkopts, wantLinkopts)
+	}
+}
+
+func TestTestDirectives(t *testing.T) {
+	files := []fileSpec{
+		{path: "BUILD", content: "# gazelle:test_size large\n# gazelle:test_shard_count 4\n"},
+		{path: "a/a_test.go", content: "package a"},
+		{path: "a/BUILD", content: "# gazelle:test_timeout eternal\n# gazelle:test_size huge\n# gazelle:test_shard_count 0\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		GoPrefix:            "example.com/repo",
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+	}
+	got := make(map[string]packages.TestAttrs)
+	packages.WalkDirs(c, dir, func(d *packages.Dir) {
+		got[d.Rel] = d.Test
+	})
+	want := map[string]packages.TestAttrs{
+		"":  {Size: "large", ShardCount: 4},
+		"a": {Size: "large", Timeout: "eternal", ShardCount: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestDefaultVisibilityDirective(t *testing.T) {
+	files := []fileSpec{
+		{path: "BUILD", content: "# gazelle:default_visibility //a:__subpackages__, //b:__pkg__\n"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/b/BUILD", content: "# gazelle:default_visibility //visibility:public\n"},
+		{path: "a/b/b.go", content: "package b"},
+		{path: "c/BUILD", content: "# gazelle:default_visibility __pkg__\n"},
+		{path: "c/c.go", content: "package c"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		GoPrefix:            "example.com/repo",
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+	}
+	got := make(map[string][]string)
+	packages.WalkDirs(c, dir, func(d *packages.Dir) {
+		got[d.Rel] = d.DefaultVisibility
+	})
+	want := map[string][]string{
+		"":    {"//a:__subpackages__", "//b:__pkg__"},
+		"a":   {"//a:__subpackages__", "//b:__pkg__"},
+		"a/b": {"//visibility:public"},
+		"c":   {"//a:__subpackages__", "//b:__pkg__"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestUpdateDirs(t *testing.T) {
+	files := []fileSpec{
+		{path: "root.go", content: "package root"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/b/b.go", content: "package b"},
+		{path: "c/c.go", content: "package c"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+		UpdateDirs:          map[string]bool{"a/b": true},
+	}
+	var got []*packages.Package
+	packages.Walk(c, dir, func(pkg *packages.Package, _ *bf.File) {
+		got = append(got, pkg)
+	})
+	want := []*packages.Package{
 		{
-			path:    "exclude/build.go",
-			content: "",
+			Name: "b",
+			Dir:  filepath.Join(dir, "a", "b"),
+			Rel:  "a/b",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"b.go"},
+				},
+			},
 		},
+	}
+	checkPackages(t, got, want)
+}
+
+func TestUpdateDirsTestdataPackage(t *testing.T) {
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/testdata/BUILD", content: ""},
+		{path: "a/testdata/x.txt", content: ""},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// testdata isn't visited, but it has a build file, so it isn't data,
+	// just as in a full run.
+	c := &config.Config{
+		RepoRoot:            dir,
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+		UpdateDirs:          map[string]bool{"a": true},
+	}
+	var got []*packages.Package
+	packages.Walk(c, dir, func(pkg *packages.Package, _ *bf.File) {
+		got = append(got, pkg)
+	})
+	want := []*packages.Package{
 		{
-			path:    "exclude/real.go",
-			content: "package exclude",
+			Name: "a",
+			Dir:  filepath.Join(dir, "a"),
+			Rel:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
 		},
 	}
+	checkPackages(t, got, want)
+}
+
+func TestScan(t *testing.T) {
+	files := []fileSpec{
+		{path: "a.go", content: "package a"},
+		{path: "sub/c.go", content: "package c"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		GoPrefix:            "example.com/repo",
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+	}
+	var got []*packages.Package
+	packages.Scan(c, dir, func(pkg *packages.Package) {
+		got = append(got, pkg)
+	})
 	want := []*packages.Package{
 		{
-			Name: "exclude",
-			Rel:  "exclude",
+			Name: "c",
+			Dir:  filepath.Join(dir, "sub"),
+			Rel:  "sub",
 			Library: packages.Target{
 				Sources: packages.PlatformStrings{
-					Generic: []string{"real.go"},
+					Generic: []string{"c.go"},
+				},
+			},
+		}, {
+			Name: "a",
+			Dir:  dir,
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
 				},
 			},
 		},
 	}
-	checkFiles(t, files, "", want)
+	checkPackages(t, got, want)
+}
+
+func TestWalkDirs(t *testing.T) {
+	files := []fileSpec{
+		{path: "a.go", content: "package a"},
+		{path: "a.proto"},
+		{path: ".hidden"},
+		{path: "protos/b.proto"},
+		{path: "empty/"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{
+		RepoRoot:            dir,
+		GoPrefix:            "example.com/repo",
+		ValidBuildFileNames: config.DefaultValidBuildFileNames,
+	}
+	type dirSummary struct {
+		rel        string
+		files      []string
+		hasPackage bool
+	}
+	var got []dirSummary
+	packages.WalkDirs(c, dir, func(d *packages.Dir) {
+		got = append(got, dirSummary{d.Rel, d.Files, d.Package != nil})
+	})
+	want := []dirSummary{
+		{rel: "empty"},
+		{rel: "protos", files: []string{"b.proto"}},
+		{rel: "", files: []string{"a.go", "a.proto"}, hasPackage: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestDeepTree(t *testing.T) {
+	// Each directory has a distinct name, so the tree isn't skipped as a
+	// pathological tree.
+	const depth = 200
+	var files []fileSpec
+	rel := ""
+	for i := 0; i < depth; i++ {
+		rel = path.Join(rel, fmt.Sprintf("d%d", i))
+		files = append(files, fileSpec{path: rel + "/a.go", content: "package a"})
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		jobs, maxDepth, want int
+	}{
+		{jobs: 1, want: depth},
+		{jobs: 4, want: depth},
+		{jobs: 1, maxDepth: 10, want: 10},
+		{jobs: 4, maxDepth: 10, want: 10},
+	} {
+		c := &config.Config{
+			RepoRoot:            dir,
+			ValidBuildFileNames: config.DefaultValidBuildFileNames,
+			Jobs:                tc.jobs,
+			MaxDepth:            tc.maxDepth,
+		}
+		var got []string
+		packages.Walk(c, dir, func(pkg *packages.Package, _ *bf.File) {
+			got = append(got, pkg.Rel)
+		})
+		if len(got) != tc.want {
+			t.Errorf("jobs=%d max_depth=%d: got %d packages; want %d", tc.jobs, tc.maxDepth, len(got), tc.want)
+			continue
+		}
+		// Packages are reported in post-order, deepest first.
+		if want := strings.Count(got[0], "/") + 1; want != tc.want {
+			t.Errorf("jobs=%d max_depth=%d: got first package %q; want one at depth %d", tc.jobs, tc.maxDepth, got[0], tc.want)
+		}
+	}
+}
+
+func TestRepeatedDirectories(t *testing.T) {
+	files := []fileSpec{
+		{path: "a.go", content: "package root"},
+		{path: "node_modules/x/node_modules/y/node_modules/z/node_modules/a.go", content: "package a"},
+		{path: "node_modules/x/node_modules/y/node_modules/z/node_modules/w/node_modules/b.go", content: "package b"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got []string
+	for _, pkg := range walkPackages(dir, "", dir) {
+		got = append(got, pkg.Rel)
+	}
+	want := []string{"node_modules/x/node_modules/y/node_modules/z/node_modules", ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	files := []fileSpec{
+		{path: "real/a.go", content: "package a"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink(filepath.Join(dir, "real"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(dir, "real", "cycle")); err != nil {
+		t.Fatal(err)
+	}
+
+	lib := packages.Target{
+		Sources: packages.PlatformStrings{
+			Generic: []string{"a.go"},
+		},
+	}
+	for _, tc := range []struct {
+		follow bool
+		want   []*packages.Package
+	}{
+		{
+			follow: false,
+			want: []*packages.Package{
+				{Name: "a", Dir: filepath.Join(dir, "real"), Rel: "real", Library: lib},
+			},
+		}, {
+			follow: true,
+			want: []*packages.Package{
+				{Name: "a", Dir: filepath.Join(dir, "link"), Rel: "link", Library: lib},
+				{Name: "a", Dir: filepath.Join(dir, "real"), Rel: "real", Library: lib},
+			},
+		},
+	} {
+		c := &config.Config{
+			RepoRoot:            dir,
+			ValidBuildFileNames: config.DefaultValidBuildFileNames,
+			FollowSymlinks:      tc.follow,
+		}
+		var got []*packages.Package
+		packages.Walk(c, dir, func(pkg *packages.Package, _ *bf.File) {
+			got = append(got, pkg)
+		})
+		checkPackages(t, got, tc.want)
+	}
 }
 
 func TestMalformedBuildFile(t *testing.T) {
@@ -439,3 +1430,74 @@ func TestMalformedGoFile(t *testing.T) {
 	}
 	checkFiles(t, files, "", want)
 }
+
+// createTree creates a tree of Go packages with the given depth, where each
+// directory has width subdirectories. It returns the root of the tree.
+func createTree(depth, width int) (string, error) {
+	var files []fileSpec
+	var add func(rel string, depth int)
+	add = func(rel string, depth int) {
+		name := "p" + strings.Replace(rel, "/", "_", -1)
+		files = append(files,
+			fileSpec{path: path.Join(rel, "a.go"), content: "package " + name + "\n\nimport \"fmt\"\n"},
+			fileSpec{path: path.Join(rel, "a_test.go"), content: "package " + name + "\n\nimport \"testing\"\n"},
+			fileSpec{path: path.Join(rel, "testdata/data.txt")})
+		if depth == 0 {
+			return
+		}
+		for i := 0; i < width; i++ {
+			add(path.Join(rel, fmt.Sprintf("d%d", i)), depth-1)
+		}
+	}
+	add("", depth)
+	return createFiles(files)
+}
+
+func TestWalkConcurrent(t *testing.T) {
+	dir, err := createTree(3, 3)
+	if err != nil {
+		t.Fatalf("createTree() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	walk := func(jobs int) []*packages.Package {
+		c := &config.Config{
+			RepoRoot:            dir,
+			ValidBuildFileNames: config.DefaultValidBuildFileNames,
+			Jobs:                jobs,
+		}
+		var pkgs []*packages.Package
+		packages.Walk(c, dir, func(pkg *packages.Package, _ *bf.File) {
+			pkgs = append(pkgs, pkg)
+		})
+		return pkgs
+	}
+	want := walk(1)
+	if len(want) != 40 {
+		t.Fatalf("got %d packages; want 40", len(want))
+	}
+	for i := 0; i < 5; i++ {
+		checkPackages(t, walk(8), want)
+	}
+}
+
+func BenchmarkWalk(b *testing.B) {
+	dir, err := createTree(4, 5)
+	if err != nil {
+		b.Fatalf("createTree() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, jobs := range []int{1, 2, 4, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			c := &config.Config{
+				RepoRoot:            dir,
+				ValidBuildFileNames: config.DefaultValidBuildFileNames,
+				Jobs:                jobs,
+			}
+			for i := 0; i < b.N; i++ {
+				packages.Walk(c, dir, func(*packages.Package, *bf.File) {})
+			}
+		})
+	}
+}
@@ -39,6 +39,12 @@ const (
 	DefaultProtosName = "go_default_library_protos"
 	// defaultCgoLibName is the name of the default cgo_library rule in a Go package directory.
 	DefaultCgoLibName = "cgo_default_library"
+	// DefaultHdrsName is the name of the cc_library created for headers
+	// included by cgo code, when they aren't listed in srcs.
+	DefaultHdrsName = "go_default_library_hdrs"
+	// DefaultCLibName is the name of the cc_library created for the C files
+	// of a cgo library, when they're built separately.
+	DefaultCLibName = "c_default_library"
 )
 
 // A LabelResolver resolves a Go importpath into a label in Bazel.
@@ -72,35 +78,129 @@ func (l Label) String() string {
 	return fmt.Sprintf("%s//%s:%s", repo, l.Pkg, l.Name)
 }
 
+// ParseLabel parses a label string such as "@repo//pkg:name", "//pkg",
+// or ":name". Labels without a package or repository are relative.
+func ParseLabel(s string) (Label, error) {
+	var l Label
+	origStr := s
+	if strings.HasPrefix(s, "@") {
+		i := strings.Index(s, "//")
+		if i < 0 {
+			return Label{}, fmt.Errorf("label %q: repository must be followed by a package", origStr)
+		}
+		l.Repo = s[len("@"):i]
+		s = s[i:]
+	}
+	if strings.HasPrefix(s, "//") {
+		s = s[len("//"):]
+		if i := strings.IndexByte(s, ':'); i >= 0 {
+			l.Pkg, l.Name = s[:i], s[i+1:]
+		} else {
+			l.Pkg, l.Name = s, path.Base(s)
+		}
+	} else if strings.HasPrefix(s, ":") {
+		l.Name = s[1:]
+		l.Relative = true
+	} else {
+		return Label{}, fmt.Errorf("label %q: must start with \"//\", \"@\", or \":\"", origStr)
+	}
+	if l.Name == "" || l.Name == "." || strings.Contains(l.Name, ":") {
+		return Label{}, fmt.Errorf("label %q: invalid target name", origStr)
+	}
+	return l, nil
+}
+
 func NewLabelResolver(c *config.Config) LabelResolver {
 	var e LabelResolver
 	switch c.DepMode {
 	case config.ExternalMode:
-		e = newExternalResolver(c.KnownImports)
+		e = newExternalResolver(c.KnownImports, c.Hermetic)
 	case config.VendorMode:
 		e = vendoredResolver{}
 	}
 
 	return &unifiedResolver{
+		c:        c,
 		goPrefix: c.GoPrefix,
 		local:    structuredResolver{c.GoPrefix},
 		external: e,
+		cache:    newResolveCache(),
 	}
 }
 
+// unifiedResolver resolves imports in build files owned by other tools,
+// in repositories listed in c.Repos, in the current repository, and in
+// external repositories, in that order. It's shared by all directories
+// in a run, so results that don't depend on the importing directory are
+// cached.
 type unifiedResolver struct {
+	c               *config.Config
 	goPrefix        string
 	local, external LabelResolver
+
+	// cache memoizes resolveRepo. If nil, nothing is cached.
+	cache *resolveCache
 }
 
 func (r *unifiedResolver) Resolve(importpath, dir string) (Label, error) {
-	if importpath != r.goPrefix && !strings.HasPrefix(importpath, r.goPrefix+"/") && !isRelative(importpath) {
-		return r.external.Resolve(importpath, dir)
+	if s, ok := r.c.ManagedImports[importpath]; ok {
+		return resolveManaged(s, dir)
+	}
+	if isRelative(importpath) {
+		return r.local.Resolve(importpath, dir)
+	}
+	e, ok := r.cache.get(importpath)
+	if !ok {
+		e = r.resolveRepo(importpath, dir)
+		r.cache.put(importpath, e)
+	}
+	if e.local {
+		return r.local.Resolve(importpath, dir)
+	}
+	return e.label, e.err
+}
+
+// resolveRepo determines which repository importpath is in. If it's in the
+// current repository, the returned entry is marked local. Otherwise, the
+// entry holds the label of the library in the other repository. Labels in
+// other repositories don't depend on dir.
+func (r *unifiedResolver) resolveRepo(importpath, dir string) resolveCacheEntry {
+	if repo := r.c.RepoForImport(importpath); repo != nil {
+		l, err := resolveInRepo(*repo, importpath)
+		return resolveCacheEntry{label: l, err: err}
+	}
+	if importpath != r.goPrefix && !strings.HasPrefix(importpath, r.goPrefix+"/") {
+		l, err := r.external.Resolve(importpath, dir)
+		return resolveCacheEntry{label: l, err: err}
 	}
-	return r.local.Resolve(importpath, dir)
+	return resolveCacheEntry{local: true}
 }
 
 // isRelative determines if an importpath is relative.
 func isRelative(importpath string) bool {
 	return strings.HasPrefix(importpath, "./") || strings.HasPrefix(importpath, "..")
 }
+
+// resolveInRepo resolves importpath, a package in repo, to the label of its
+// library in that repository.
+func resolveInRepo(repo config.Repo, importpath string) (Label, error) {
+	l, err := structuredResolver{repo.Prefix}.Resolve(importpath, "")
+	if err != nil {
+		return Label{}, err
+	}
+	l.Repo, l.Relative = repo.Name, false
+	return l, nil
+}
+
+// resolveManaged parses s, the label of a library in a build file owned by
+// another tool, for an import in dir. Labels in dir are made relative.
+func resolveManaged(s, dir string) (Label, error) {
+	l, err := ParseLabel(s)
+	if err != nil {
+		return Label{}, err
+	}
+	if l.Repo == "" && !l.Relative && l.Pkg == dir {
+		l = Label{Name: l.Name, Relative: true}
+	}
+	return l, nil
+}
@@ -0,0 +1,72 @@
+/* Copyright 2016 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import "sync"
+
+// resolveCache memoizes how import paths are resolved, so that imports
+// shared by many directories are only matched against repository prefixes
+// and converted to external repository names once. Only results that don't
+// depend on the importing directory are stored: labels in other
+// repositories, and whether an import is in the current repository.
+// Labels in the current repository are cheap to compute and may be relative
+// to the importing directory, so they're resolved each time.
+//
+// resolveCache is safe for concurrent use. A nil *resolveCache stores
+// nothing.
+type resolveCache struct {
+	mu      sync.RWMutex
+	entries map[string]resolveCacheEntry
+}
+
+type resolveCacheEntry struct {
+	// label and err are the result of resolving an import outside the
+	// current repository.
+	label Label
+	err   error
+
+	// local is true if the import is in the current repository, and should
+	// be resolved relative to the importing directory.
+	local bool
+}
+
+func newResolveCache() *resolveCache {
+	return &resolveCache{entries: make(map[string]resolveCacheEntry)}
+}
+
+// get returns the entry for importpath and whether one was found.
+func (c *resolveCache) get(importpath string) (resolveCacheEntry, bool) {
+	if c == nil {
+		return resolveCacheEntry{}, false
+	}
+	c.mu.RLock()
+	e, ok := c.entries[importpath]
+	c.mu.RUnlock()
+	return e, ok
+}
+
+// put stores the entry for importpath. Concurrent lookups of the same
+// import may both miss and store the same entry; that's harmless, since
+// resolution is deterministic and the external resolver has its own cache
+// of network lookups.
+func (c *resolveCache) put(importpath string, e resolveCacheEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.entries[importpath] = e
+	c.mu.Unlock()
+}
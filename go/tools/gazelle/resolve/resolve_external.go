@@ -19,7 +19,9 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"sync"
 
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
 	"golang.org/x/tools/go/vcs"
 )
 
@@ -29,11 +31,21 @@ import (
 // The prefix is converted to a Bazel external name repo according to the
 // guidelines in http://bazel.io/docs/be/functions.html#workspace. The remaining
 // portion of the import path is treated as the package name.
+//
+// externalResolver is safe for concurrent use.
 type externalResolver struct {
 	// repoRootForImportPath is vcs.RepoRootForImportPath by default. It may
 	// be overridden by tests.
 	repoRootForImportPath func(string, bool) (*vcs.RepoRoot, error)
 
+	// hermetic, if not nil, forbids network lookups. Import paths that
+	// aren't in the cache can't be resolved.
+	hermetic *config.Hermetic
+
+	// mu guards cache. It is held while the network is accessed, so that
+	// concurrent lookups of the same repository only fetch it once.
+	mu sync.Mutex
+
 	// cache stores lookup results, both positive and negative to reduce
 	// network fetches when there are multiple imports on the same external repo.
 	cache map[string]repoRootCacheEntry
@@ -41,7 +53,7 @@ type externalResolver struct {
 
 var _ LabelResolver = (*externalResolver)(nil)
 
-func newExternalResolver(extraKnownImports []string) *externalResolver {
+func newExternalResolver(extraKnownImports []string, hermetic *config.Hermetic) *externalResolver {
 	cache := make(map[string]repoRootCacheEntry)
 	for _, e := range []repoRootCacheEntry{
 		{prefix: "golang.org/x", missing: 1},
@@ -57,8 +69,9 @@ func newExternalResolver(extraKnownImports []string) *externalResolver {
 	}
 
 	return &externalResolver{
-		cache: cache,
+		cache:                 cache,
 		repoRootForImportPath: vcs.RepoRootForImportPath,
+		hermetic:              hermetic,
 	}
 }
 
@@ -87,6 +100,9 @@ func (r *externalResolver) Resolve(importpath, dir string) (Label, error) {
 // lookupPrefix determines the prefix of "importpath" that corresponds to
 // the root of the repository. Results are cached.
 func (r *externalResolver) lookupPrefix(importpath string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	// subpaths contains slices of importpath with components removed. For
 	// example:
 	//   golang.org/x/tools/go/vcs
@@ -116,6 +132,10 @@ func (r *externalResolver) lookupPrefix(importpath string) (string, error) {
 	}
 
 	// Look up the import path using vcs.
+	if err := r.hermetic.Forbid("finding the repository root of %q needs network access", importpath); err != nil {
+		r.cache[importpath] = repoRootCacheEntry{prefix: importpath, err: err}
+		return "", err
+	}
 	root, err := r.repoRootForImportPath(importpath, false)
 	if err != nil {
 		r.cache[importpath] = repoRootCacheEntry{prefix: importpath, err: err}
@@ -21,6 +21,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
 	"golang.org/x/tools/go/vcs"
 )
 
@@ -111,8 +112,31 @@ func TestExternalResolver(t *testing.T) {
 	}
 }
 
+func TestExternalResolverHermetic(t *testing.T) {
+	h := &config.Hermetic{}
+	r := newExternalResolver(nil, h)
+	r.repoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+		t.Fatalf("network lookup of %q in hermetic mode", importpath)
+		return nil, nil
+	}
+
+	if l, err := r.Resolve("github.com/foo/bar/baz", "some/package"); err != nil {
+		t.Errorf("known prefix: got error %v; want success", err)
+	} else if want := (Label{Repo: "com_github_foo_bar", Pkg: "baz", Name: DefaultLibName}); l != want {
+		t.Errorf("known prefix: got %s; want %s", l, want)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Resolve("example.com/repo/lib", "some/package"); err == nil || !strings.Contains(err.Error(), "-hermetic") {
+			t.Errorf("unknown prefix: got error %v; want hermetic error", err)
+		}
+	}
+	if n := h.ViolationCount(); n != 1 {
+		t.Errorf("got %d violations; want 1", n)
+	}
+}
+
 func newStubExternalResolver(extraKnown []string) *externalResolver {
-	r := newExternalResolver(extraKnown)
+	r := newExternalResolver(extraKnown, nil)
 	r.repoRootForImportPath = stubRepoRootForImportPath
 	return r
 }
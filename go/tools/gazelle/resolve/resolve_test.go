@@ -16,7 +16,13 @@ limitations under the License.
 package resolve
 
 import (
+	"fmt"
+	"runtime"
+	"sync"
 	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"golang.org/x/tools/go/vcs"
 )
 
 func TestLabelString(t *testing.T) {
@@ -54,3 +60,284 @@ func TestLabelString(t *testing.T) {
 		}
 	}
 }
+
+func TestParseLabel(t *testing.T) {
+	for _, spec := range []struct {
+		s       string
+		want    Label
+		wantErr bool
+	}{
+		{s: "//:foo", want: Label{Name: "foo"}},
+		{s: "//foo/bar:baz", want: Label{Pkg: "foo/bar", Name: "baz"}},
+		{s: "//foo/bar", want: Label{Pkg: "foo/bar", Name: "bar"}},
+		{s: "@com_example_repo//foo/bar:baz", want: Label{Repo: "com_example_repo", Pkg: "foo/bar", Name: "baz"}},
+		{s: ":foo", want: Label{Relative: true, Name: "foo"}},
+		{s: "foo", wantErr: true},
+		{s: "@repo", wantErr: true},
+		{s: "//foo:", wantErr: true},
+		{s: "//", wantErr: true},
+	} {
+		got, err := ParseLabel(spec.s)
+		if spec.wantErr {
+			if err == nil {
+				t.Errorf("ParseLabel(%q) succeeded; want error", spec.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLabel(%q) failed: %v", spec.s, err)
+			continue
+		}
+		if got != spec.want {
+			t.Errorf("ParseLabel(%q) = %#v; want %#v", spec.s, got, spec.want)
+		}
+	}
+}
+
+func TestResolveRepos(t *testing.T) {
+	c := &config.Config{
+		GoPrefix: "example.com/repo",
+		DepMode:  config.VendorMode,
+		Repos: []config.Repo{
+			{Name: "com_example_lib", Prefix: "example.com/lib", Root: "../lib"},
+		},
+	}
+	r := NewLabelResolver(c)
+	for _, tc := range []struct {
+		imp, dir, want string
+	}{
+		{"example.com/lib", "a", "@com_example_lib//:go_default_library"},
+		{"example.com/lib/foo/bar", "a", "@com_example_lib//foo/bar:go_default_library"},
+		{"example.com/lib/foo", "foo", "@com_example_lib//foo:go_default_library"},
+		{"example.com/repo/foo", "a", "//foo:go_default_library"},
+		{"example.com/libx", "a", "//vendor/example.com/libx:go_default_library"},
+	} {
+		l, err := r.Resolve(tc.imp, tc.dir)
+		if err != nil {
+			t.Errorf("Resolve(%q, %q) failed: %v", tc.imp, tc.dir, err)
+			continue
+		}
+		if got := l.String(); got != tc.want {
+			t.Errorf("Resolve(%q, %q) = %s; want %s", tc.imp, tc.dir, got, tc.want)
+		}
+	}
+}
+
+func TestResolveManaged(t *testing.T) {
+	c := &config.Config{
+		GoPrefix: "example.com/repo",
+		DepMode:  config.VendorMode,
+		ManagedImports: map[string]string{
+			"example.com/repo/gen/api": "//gen/api:api_go",
+			"example.com/api/v2":       "//third_party/api:go_default_library",
+		},
+	}
+	r := NewLabelResolver(c)
+	for _, tc := range []struct {
+		imp, dir, want string
+	}{
+		{"example.com/repo/gen/api", "a", "//gen/api:api_go"},
+		{"example.com/repo/gen/api", "gen/api", ":api_go"},
+		{"example.com/api/v2", "a", "//third_party/api:go_default_library"},
+		{"example.com/repo/gen", "a", "//gen:go_default_library"},
+	} {
+		l, err := r.Resolve(tc.imp, tc.dir)
+		if err != nil {
+			t.Errorf("Resolve(%q, %q) failed: %v", tc.imp, tc.dir, err)
+			continue
+		}
+		if got := l.String(); got != tc.want {
+			t.Errorf("Resolve(%q, %q) = %s; want %s", tc.imp, tc.dir, got, tc.want)
+		}
+	}
+}
+
+// TestResolveConcurrent resolves imports from many goroutines with one
+// resolver, as gazelle does when generating rules for directories
+// concurrently. Run with -race, it checks the resolver's cache is safe to
+// share, and it checks each repository root is looked up only once.
+func TestResolveConcurrent(t *testing.T) {
+	c := &config.Config{
+		GoPrefix:     "example.com/repo",
+		DepMode:      config.ExternalMode,
+		KnownImports: []string{"private.com/my/repo"},
+	}
+	imports := []string{
+		"example.com/repo/lib",
+		"example.com/repo/lib/sub",
+		"example.com/other/a",
+		"example.com/other/b/c",
+		"github.com/x/y",
+		"github.com/x/y/z",
+		"golang.org/x/net/context",
+		"private.com/my/repo/pkg",
+	}
+	newResolver := func(lookups map[string]int, mu *sync.Mutex) LabelResolver {
+		r := NewLabelResolver(c)
+		r.(*unifiedResolver).external.(*externalResolver).repoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			lookups[importpath]++
+			return &vcs.RepoRoot{Root: "example.com/other"}, nil
+		}
+		return r
+	}
+
+	var mu sync.Mutex
+	want := make(map[string]Label)
+	serial := newResolver(make(map[string]int), &mu)
+	for _, imp := range imports {
+		l, err := serial.Resolve(imp, "some/package")
+		if err != nil {
+			t.Fatalf("Resolve(%q): %v", imp, err)
+		}
+		want[imp] = l
+	}
+
+	lookups := make(map[string]int)
+	r := newResolver(lookups, &mu)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				imp := imports[(i*7+j)%len(imports)]
+				if l, err := r.Resolve(imp, "some/package"); err != nil {
+					t.Errorf("Resolve(%q): %v", imp, err)
+				} else if l != want[imp] {
+					t.Errorf("Resolve(%q) = %s; want %s", imp, l, want[imp])
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	n := 0
+	for _, count := range lookups {
+		n += count
+	}
+	if n != 1 {
+		t.Errorf("got %d network lookups %v; want 1 for example.com/other", n, lookups)
+	}
+}
+
+// countingResolver counts calls to Resolve, for checking what's cached.
+type countingResolver struct {
+	LabelResolver
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (r *countingResolver) Resolve(importpath, dir string) (Label, error) {
+	r.mu.Lock()
+	r.calls[importpath]++
+	r.mu.Unlock()
+	return r.LabelResolver.Resolve(importpath, dir)
+}
+
+func TestResolveCache(t *testing.T) {
+	c := &config.Config{
+		GoPrefix: "example.com/repo",
+		DepMode:  config.VendorMode,
+		Repos: []config.Repo{
+			{Name: "com_example_lib", Prefix: "example.com/lib", Root: "../lib"},
+		},
+	}
+	r := NewLabelResolver(c)
+	ext := &countingResolver{LabelResolver: vendoredResolver{}, calls: make(map[string]int)}
+	r.(*unifiedResolver).external = ext
+
+	// Each import is resolved twice from different directories. Labels in
+	// the current repository must still be relative to the importing
+	// directory when the second lookup hits the cache.
+	for _, tc := range []struct {
+		imp, dir, want string
+	}{
+		{"example.com/repo/foo", "a", "//foo:go_default_library"},
+		{"example.com/repo/foo", "foo", ":go_default_library"},
+		{"example.com/lib/foo", "a", "@com_example_lib//foo:go_default_library"},
+		{"example.com/lib/foo", "foo", "@com_example_lib//foo:go_default_library"},
+		{"example.com/ext", "a", "//vendor/example.com/ext:go_default_library"},
+		{"example.com/ext", "b", "//vendor/example.com/ext:go_default_library"},
+		{"./sub", "a", "//a/sub:go_default_library"},
+		{"./sub", "b", "//b/sub:go_default_library"},
+	} {
+		l, err := r.Resolve(tc.imp, tc.dir)
+		if err != nil {
+			t.Errorf("Resolve(%q, %q) failed: %v", tc.imp, tc.dir, err)
+			continue
+		}
+		if got := l.String(); got != tc.want {
+			t.Errorf("Resolve(%q, %q) = %s; want %s", tc.imp, tc.dir, got, tc.want)
+		}
+	}
+	if got := ext.calls["example.com/ext"]; got != 1 {
+		t.Errorf("got %d external lookups of example.com/ext; want 1", got)
+	}
+}
+
+// BenchmarkResolve resolves imports as gazelle does for a large repository:
+// 10,000 packages, each importing a few packages in the same repository and
+// a few in external repositories, resolved from many goroutines.
+func BenchmarkResolve(b *testing.B) {
+	const numPkgs, numImports = 10000, 10
+	c := &config.Config{
+		GoPrefix:     "example.com/repo",
+		DepMode:      config.ExternalMode,
+		KnownImports: []string{"private.com/my/repo"},
+	}
+	for i := 0; i < 20; i++ {
+		c.Repos = append(c.Repos, config.Repo{
+			Name:   fmt.Sprintf("com_example_lib%d", i),
+			Prefix: fmt.Sprintf("example.com/lib%d", i),
+		})
+	}
+	dirs := make([]string, numPkgs)
+	imports := make([][]string, numPkgs)
+	for i := range dirs {
+		dirs[i] = fmt.Sprintf("pkg%d/sub%d", i/100, i%100)
+		for j := 0; j < numImports; j++ {
+			var imp string
+			switch j % 5 {
+			case 0, 1:
+				imp = fmt.Sprintf("example.com/repo/pkg%d/sub%d", (i+j)%100, j)
+			case 2:
+				imp = fmt.Sprintf("github.com/org%d/repo/pkg%d", j, i%50)
+			case 3:
+				imp = fmt.Sprintf("example.com/lib%d/pkg", (i+j)%20)
+			case 4:
+				imp = fmt.Sprintf("private.com/my/repo/pkg%d", i%30)
+			}
+			imports[i] = append(imports[i], imp)
+		}
+	}
+
+	for _, cache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%v", cache), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				r := NewLabelResolver(c)
+				if !cache {
+					r.(*unifiedResolver).cache = nil
+				}
+				var wg sync.WaitGroup
+				jobs := runtime.NumCPU()
+				for w := 0; w < jobs; w++ {
+					wg.Add(1)
+					go func(w int) {
+						defer wg.Done()
+						for i := w; i < numPkgs; i += jobs {
+							for _, imp := range imports[i] {
+								if _, err := r.Resolve(imp, dirs[i]); err != nil {
+									b.Error(err)
+									return
+								}
+							}
+						}
+					}(w)
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
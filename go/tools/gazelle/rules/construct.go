@@ -22,28 +22,88 @@ import (
 	"sort"
 
 	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/schema"
 )
 
-type keyvalue struct {
-	key   string
-	value interface{}
+// KeyValue is a keyword argument of a rule. The value may be any type
+// accepted by NewValue.
+type KeyValue struct {
+	Key   string
+	Value interface{}
 }
 
-type globvalue struct {
-	patterns []string
-	excludes []string
+// GlobValue is converted by NewValue to a call to glob. Excludes are passed
+// with the exclude keyword if there are any.
+type GlobValue struct {
+	Patterns []string
+	Excludes []string
 }
 
-func newRule(kind string, args []interface{}, kwargs []keyvalue) *bf.Rule {
+// ConcatValue is converted by NewValue to its elements joined with the +
+// operator. It may be used to chain lists and select expressions, for
+// example, a list of generic sources followed by selects for platforms and
+// build modes. Empty lists are omitted. An empty ConcatValue is converted to
+// an empty list.
+type ConcatValue []interface{}
+
+// DictValue is converted by NewValue to a dict expression with sorted keys.
+// Other maps are converted to select expressions.
+type DictValue map[string]interface{}
+
+// isDefaultAttr returns whether val is the default value of the attribute
+// key for rules of the given kind, according to schema.Default. Empty lists,
+// maps, and PlatformStrings are considered equal.
+func isDefaultAttr(kind, key string, val interface{}) bool {
+	def, ok := schema.Default(kind, key)
+	if !ok {
+		return false
+	}
+	if isEmptyValue(val) && isEmptyValue(def) {
+		return true
+	}
+	return reflect.DeepEqual(val, def)
+}
+
+func isEmptyValue(val interface{}) bool {
+	switch val := val.(type) {
+	case packages.PlatformStrings:
+		return val.IsEmpty()
+	case ConcatValue:
+		for _, v := range val {
+			if !isEmptyValue(v) {
+				return false
+			}
+		}
+		return true
+	}
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return rv.Len() == 0
+	}
+	return false
+}
+
+// NewRule returns a rule of the given kind. args are converted with NewValue
+// and passed as positional arguments. kwargs are converted with NewValue and
+// passed as keyword arguments in the order given. Keyword arguments equal to
+// the default values of their attributes are omitted; see schema.Kind.
+// To match the output of bf.Rewrite without calling it, pass "name" first,
+// followed by other attributes in buildifier's order.
+func NewRule(kind string, args []interface{}, kwargs []KeyValue) *bf.Rule {
 	var list []bf.Expr
 	for _, arg := range args {
-		list = append(list, newValue(arg))
+		list = append(list, NewValue(arg))
 	}
 	for _, arg := range kwargs {
-		expr := newValue(arg.value)
+		if isDefaultAttr(kind, arg.Key, arg.Value) {
+			continue
+		}
+		expr := NewValue(arg.Value)
 		list = append(list, &bf.BinaryExpr{
-			X:  &bf.LiteralExpr{Token: arg.key},
+			X:  &bf.LiteralExpr{Token: arg.Key},
 			Op: "=",
 			Y:  expr,
 		})
@@ -57,10 +117,39 @@ func newRule(kind string, args []interface{}, kwargs []keyvalue) *bf.Rule {
 	}
 }
 
-// newValue converts a Go value into the corresponding expression in Bazel BUILD file.
-func newValue(val interface{}) bf.Expr {
+// NewValue converts a Go value into the corresponding expression in a Bazel
+// BUILD file. The following values are supported:
+//
+//   - nil, converted to None
+//   - bools, converted to True or False
+//   - integers and floating point numbers
+//   - strings
+//   - slices and arrays of supported values, converted to lists
+//   - maps with string or config.Platform keys, converted to a select
+//     expression with sorted keys and an empty "//conditions:default" case
+//   - DictValue, converted to a dict with sorted keys
+//   - GlobValue and ConcatValue
+//   - packages.PlatformStrings, converted to the generic list followed by a
+//     select for each of the OS and Platform maps that isn't empty
+//   - bf.Expr, returned as is
+//
+// NewValue panics if val has any other type.
+func NewValue(val interface{}) bf.Expr {
+	if val == nil {
+		return &bf.LiteralExpr{Token: "None"}
+	}
+	if e, ok := val.(bf.Expr); ok {
+		return e
+	}
+
 	rv := reflect.ValueOf(val)
 	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return &bf.LiteralExpr{Token: "True"}
+		}
+		return &bf.LiteralExpr{Token: "False"}
+
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
 		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return &bf.LiteralExpr{Token: fmt.Sprintf("%d", val)}
@@ -69,48 +158,36 @@ func newValue(val interface{}) bf.Expr {
 		return &bf.LiteralExpr{Token: fmt.Sprintf("%f", val)}
 
 	case reflect.String:
-		return &bf.StringExpr{Value: val.(string)}
+		return &bf.StringExpr{Value: rv.String()}
 
 	case reflect.Slice, reflect.Array:
+		if concat, ok := val.(ConcatValue); ok {
+			return newConcat(concat)
+		}
 		var list []bf.Expr
 		for i := 0; i < rv.Len(); i++ {
-			elem := newValue(rv.Index(i).Interface())
+			elem := NewValue(rv.Index(i).Interface())
 			list = append(list, elem)
 		}
 		return &bf.ListExpr{List: list}
 
 	case reflect.Map:
-		rkeys := rv.MapKeys()
-		sort.Sort(byString(rkeys))
-		args := make([]bf.Expr, len(rkeys))
-		for i, rk := range rkeys {
-			k := &bf.StringExpr{Value: rk.String()}
-			v := newValue(rv.MapIndex(rk).Interface())
-			if l, ok := v.(*bf.ListExpr); ok {
-				l.ForceMultiLine = true
-			}
-			args[i] = &bf.KeyValueExpr{Key: k, Value: v}
+		if dict, ok := val.(DictValue); ok {
+			return newDict(dict)
 		}
-		args = append(args, &bf.KeyValueExpr{
-			Key:   &bf.StringExpr{Value: "//conditions:default"},
-			Value: &bf.ListExpr{},
-		})
-		sel := &bf.CallExpr{
-			X:    &bf.LiteralExpr{Token: "select"},
-			List: []bf.Expr{&bf.DictExpr{List: args, ForceMultiLine: true}},
-		}
-		return sel
+		return newSelect(rv)
 
 	case reflect.Struct:
 		switch val := val.(type) {
-		case globvalue:
-			patternsValue := newValue(val.patterns)
+		case GlobValue:
+			patternsValue := NewValue(val.Patterns)
 			globArgs := []bf.Expr{patternsValue}
-			if len(val.excludes) > 0 {
-				excludesValue := newValue(val.excludes)
-				globArgs = append(globArgs, &bf.KeyValueExpr{
-					Key:   &bf.StringExpr{Value: "excludes"},
-					Value: excludesValue,
+			if len(val.Excludes) > 0 {
+				excludesValue := NewValue(val.Excludes)
+				globArgs = append(globArgs, &bf.BinaryExpr{
+					X:  &bf.LiteralExpr{Token: "exclude"},
+					Op: "=",
+					Y:  excludesValue,
 				})
 			}
 			return &bf.CallExpr{
@@ -119,20 +196,16 @@ func newValue(val interface{}) bf.Expr {
 			}
 
 		case packages.PlatformStrings:
-			gen := newValue(val.Generic)
-			if len(val.Platform) == 0 {
-				return gen
-			}
-
-			sel := newValue(val.Platform)
-			if len(val.Generic) == 0 {
-				return sel
+			var concat ConcatValue
+			if len(val.Generic) > 0 {
+				concat = append(concat, val.Generic)
 			}
-
-			if genList, ok := gen.(*bf.ListExpr); ok {
-				genList.ForceMultiLine = true
+			for _, m := range val.PlatformMaps() {
+				if len(m) > 0 {
+					concat = append(concat, m)
+				}
 			}
-			return &bf.BinaryExpr{X: gen, Op: "+", Y: sel}
+			return newConcat(concat)
 		}
 	}
 
@@ -140,18 +213,94 @@ func newValue(val interface{}) bf.Expr {
 	return nil
 }
 
-type byString []reflect.Value
+// newDict converts dict into a dict expression with keys in sorted order.
+func newDict(dict DictValue) bf.Expr {
+	keys := make([]string, 0, len(dict))
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]bf.Expr, len(keys))
+	for i, k := range keys {
+		args[i] = &bf.KeyValueExpr{
+			Key:   &bf.StringExpr{Value: k},
+			Value: NewValue(dict[k]),
+		}
+	}
+	return &bf.DictExpr{List: args, ForceMultiLine: true}
+}
 
-var _ sort.Interface = byString{}
+// newSelect converts a map into a select expression. Keys may be strings,
+// which are used as labels as is, or config.Platform values, which are
+// converted to canonical platform labels. Cases are sorted by label, and an
+// empty "//conditions:default" case is added at the end. newSelect panics
+// if two keys have the same label or if a key has an unsupported type.
+func newSelect(rv reflect.Value) bf.Expr {
+	values := make(map[string]bf.Expr)
+	labels := make([]string, 0, rv.Len())
+	for _, rk := range rv.MapKeys() {
+		var label string
+		switch k := rk.Interface().(type) {
+		case config.Platform:
+			label = k.Label()
+		default:
+			kv := reflect.ValueOf(k)
+			if kv.Kind() != reflect.String {
+				log.Panicf("select key type not supported: %T", k)
+			}
+			label = kv.String()
+		}
+		if _, ok := values[label]; ok {
+			log.Panicf("duplicate select key: %q", label)
+		}
+		v := NewValue(rv.MapIndex(rk).Interface())
+		if l, ok := v.(*bf.ListExpr); ok {
+			l.ForceMultiLine = true
+		}
+		values[label] = v
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
 
-func (s byString) Len() int {
-	return len(s)
+	args := make([]bf.Expr, 0, len(labels)+1)
+	for _, label := range labels {
+		args = append(args, &bf.KeyValueExpr{
+			Key:   &bf.StringExpr{Value: label},
+			Value: values[label],
+		})
+	}
+	args = append(args, &bf.KeyValueExpr{
+		Key:   &bf.StringExpr{Value: "//conditions:default"},
+		Value: &bf.ListExpr{},
+	})
+	return &bf.CallExpr{
+		X:    &bf.LiteralExpr{Token: "select"},
+		List: []bf.Expr{&bf.DictExpr{List: args, ForceMultiLine: true}},
+	}
 }
 
-func (s byString) Less(i, j int) bool {
-	return s[i].String() < s[j].String()
-}
+// newConcat converts the non-empty values in concat and joins them with +.
+// Lists on the left side of + are always split across lines, since they
+// are hard to read otherwise.
+func newConcat(concat ConcatValue) bf.Expr {
+	var exprs []bf.Expr
+	for _, v := range concat {
+		e := NewValue(v)
+		if l, ok := e.(*bf.ListExpr); ok && len(l.List) == 0 {
+			continue
+		}
+		exprs = append(exprs, e)
+	}
+	if len(exprs) == 0 {
+		return &bf.ListExpr{}
+	}
 
-func (s byString) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
+	expr := exprs[0]
+	for _, e := range exprs[1:] {
+		if l, ok := expr.(*bf.ListExpr); ok {
+			l.ForceMultiLine = true
+		}
+		expr = &bf.BinaryExpr{X: expr, Op: "+", Y: e}
+	}
+	return expr
 }
@@ -0,0 +1,230 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules_test
+
+import (
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/rules"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/schema"
+)
+
+func TestNewValue(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		val  interface{}
+		want string
+	}{
+		{"none", nil, `None`},
+		{"true", true, `True`},
+		{"false", false, `False`},
+		{"int", 42, `42`},
+		{"string", "foo", `"foo"`},
+		{"list", []interface{}{"a", 1, false}, `[
+    "a",
+    1,
+    False,
+]`},
+		{"expr", &bf.LiteralExpr{Token: "CONSTANT"}, `CONSTANT`},
+		{
+			"glob",
+			rules.GlobValue{Patterns: []string{"*.go"}, Excludes: []string{"*_test.go"}},
+			`glob(
+    ["*.go"],
+    exclude = ["*_test.go"],
+)`,
+		}, {
+			"select",
+			map[string][]string{"@io_bazel_rules_go//go/platform:linux_amd64": {"a.go"}},
+			`select({
+    "@io_bazel_rules_go//go/platform:linux_amd64": [
+        "a.go",
+    ],
+    "//conditions:default": [],
+})`,
+		}, {
+			"concat",
+			rules.ConcatValue{
+				[]string{"a.go"},
+				[]string{},
+				map[string][]string{"@io_bazel_rules_go//go/platform:linux_amd64": {"b.go"}},
+				map[string][]string{"//:race": {"c.go"}},
+			},
+			`[
+    "a.go",
+] + select({
+    "@io_bazel_rules_go//go/platform:linux_amd64": [
+        "b.go",
+    ],
+    "//conditions:default": [],
+}) + select({
+    "//:race": [
+        "c.go",
+    ],
+    "//conditions:default": [],
+})`,
+		}, {
+			"empty concat",
+			rules.ConcatValue{[]string{}},
+			`[]`,
+		}, {
+			"platform strings",
+			packages.PlatformStrings{Generic: []string{"a.go"}},
+			`["a.go"]`,
+		}, {
+			"platform strings with tiers",
+			packages.PlatformStrings{
+				Generic:  []string{"a.go"},
+				OS:       map[string][]string{"@io_bazel_rules_go//go/platform:linux": {"b.go"}},
+				Platform: map[string][]string{"@io_bazel_rules_go//go/platform:linux_arm64": {"d.go"}},
+			},
+			`[
+    "a.go",
+] + select({
+    "@io_bazel_rules_go//go/platform:linux": [
+        "b.go",
+    ],
+    "//conditions:default": [],
+}) + select({
+    "@io_bazel_rules_go//go/platform:linux_arm64": [
+        "d.go",
+    ],
+    "//conditions:default": [],
+})`,
+		},
+	} {
+		if got := bf.FormatString(rules.NewValue(tc.val)); got != tc.want {
+			t.Errorf("%s: got %s; want %s", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestNewValueSelectKeys(t *testing.T) {
+	val := map[interface{}][]string{
+		config.Platform{OS: "linux", Arch: "amd64"}: {"a.go"},
+		config.Platform{OS: "darwin"}:               {"b.go"},
+		"//:race":                                   {"c.go"},
+	}
+	sel := rules.NewValue(val).(*bf.CallExpr)
+	var got []string
+	for _, e := range sel.List[0].(*bf.DictExpr).List {
+		got = append(got, e.(*bf.KeyValueExpr).Key.(*bf.StringExpr).Value)
+	}
+	want := []string{
+		"//:race",
+		"@io_bazel_rules_go//go/platform:darwin",
+		"@io_bazel_rules_go//go/platform:linux_amd64",
+		"//conditions:default",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %q; want %q", got, want)
+	}
+}
+
+func TestNewValueDuplicateSelectKeys(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewValue did not panic")
+		}
+	}()
+	rules.NewValue(map[interface{}][]string{
+		config.Platform{OS: "linux"}:            {"a.go"},
+		"@io_bazel_rules_go//go/platform:linux": {"b.go"},
+	})
+}
+
+func TestNewRule(t *testing.T) {
+	r := rules.NewRule("go_test", nil, []rules.KeyValue{
+		{Key: "name", Value: "go_default_test"},
+		{Key: "srcs", Value: []string{"a_test.go"}},
+		{Key: "pure", Value: true},
+		{Key: "deps", Value: nil},
+	})
+	got := bf.FormatString(r.Call)
+	want := `go_test(
+    name = "go_default_test",
+    srcs = ["a_test.go"],
+    pure = True,
+    deps = None,
+)`
+	if got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+}
+
+func TestNewRuleOmitsDefaults(t *testing.T) {
+	schema.Register(schema.Kind{
+		Name: "fake_library",
+		Defaults: map[string]interface{}{
+			"strict":   true,
+			"opts":     nil,
+			"testonly": true,
+		},
+	})
+	for _, tc := range []struct {
+		desc, kind string
+		kwargs     []rules.KeyValue
+		want       []string
+	}{
+		{
+			desc: "common",
+			kind: "go_library",
+			kwargs: []rules.KeyValue{
+				{Key: "name", Value: "go_default_library"},
+				{Key: "srcs", Value: []string{"a.go"}},
+				{Key: "testonly", Value: false},
+				{Key: "tags", Value: []string(nil)},
+				{Key: "cgo", Value: false},
+				{Key: "x_defs", Value: map[string]string{}},
+			},
+			want: []string{"name", "srcs"},
+		}, {
+			desc: "not default",
+			kind: "go_test",
+			kwargs: []rules.KeyValue{
+				{Key: "name", Value: "go_default_test"},
+				{Key: "testonly", Value: true},
+				{Key: "tags", Value: []string{"manual"}},
+				{Key: "cgo", Value: true},
+			},
+			want: []string{"name", "testonly", "tags", "cgo"},
+		}, {
+			desc: "custom",
+			kind: "fake_library",
+			kwargs: []rules.KeyValue{
+				{Key: "name", Value: "fake"},
+				{Key: "strict", Value: true},
+				{Key: "opts", Value: nil},
+				{Key: "testonly", Value: false},
+				{Key: "tags", Value: []string{}},
+			},
+			want: []string{"name", "testonly"},
+		},
+	} {
+		r := rules.NewRule(tc.kind, nil, tc.kwargs)
+		var got []string
+		for _, arg := range r.Call.List {
+			got = append(got, arg.(*bf.BinaryExpr).X.(*bf.LiteralExpr).Token)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got attributes %q; want %q", tc.desc, got, tc.want)
+		}
+	}
+}
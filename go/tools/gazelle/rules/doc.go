@@ -14,4 +14,12 @@ limitations under the License.
 */
 
 // Package rules provides Bazel rule generation for Go build targets.
+//
+// Rules for other languages may be generated in the same pass by
+// implementing Language and calling RegisterLanguage from an init function
+// in a package linked into the gazelle binary. Go is always the first
+// registered language. NewRule and NewValue build rules from Go values, so
+// languages don't need to construct syntax trees directly. Where each kind
+// of rule is loaded from and which of its attributes have defaults is
+// described by package schema.
 package rules
@@ -16,20 +16,21 @@ limitations under the License.
 package rules
 
 import (
+	"flag"
 	"fmt"
-	"log"
+	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	bf "github.com/bazelbuild/buildtools/build"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/merger"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
 	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
-)
-
-const (
-	// goRulesBzl is the label of the Skylark file which provides Go rules
-	goRulesBzl = "@io_bazel_rules_go//go:def.bzl"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/schema"
 )
 
 // Generator generates Bazel build rules for Go build targets
@@ -51,26 +52,111 @@ type generator struct {
 	c                   *config.Config
 	r                   resolve.LabelResolver
 	shouldSetVisibility bool
+
+	// defaultVisibility is the default visibility of rules in a new build
+	// file, set with a directive. Visibility attributes with this value
+	// are redundant and aren't generated. See packages.Dir.DefaultVisibility.
+	defaultVisibility []string
+
+	// xDefs maps qualified Go variables to values they are set to at link
+	// time. See packages.Dir.XDefs.
+	xDefs map[string]string
+
+	// mapKinds maps kinds of rules to the kinds generated in their place.
+	// See packages.Dir.MapKinds.
+	mapKinds map[string]packages.MappedKind
+
+	// gcGoopts and gcLinkopts are options for the Go compiler and linker
+	// from directives. See packages.Dir.GcGoopts.
+	gcGoopts, gcLinkopts packages.PlatformStrings
+
+	// test holds attributes for go_test rules from directives.
+	test packages.TestAttrs
+
+	// assetDirs lists directories go_embed_data rules are generated for.
+	assetDirs []packages.AssetDir
+
+	// goVersion is the minimum Go version declared for the package. See
+	// packages.Dir.GoVersion.
+	goVersion config.GoVersion
+
+	// cLibrary is the name of the cc_library built from the C files of the
+	// cgo library, or "" if they're built with the cgo library. See
+	// packages.Package.CLibrary.
+	cLibrary string
+
+	// cgoPlatforms lists the labels of the platforms the cgo library has
+	// .go files for, if it doesn't have them for all platforms. The cgo
+	// library is only embedded on these platforms.
+	cgoPlatforms []string
 }
 
 func (g *generator) Generate(pkg *packages.Package) *bf.File {
-	f := &bf.File{
-		Path: filepath.Join(pkg.Dir, g.c.DefaultBuildFileName()),
-	}
 	rs := g.generateRules(pkg)
-	if load := g.generateLoad(rs); load != nil {
-		f.Stmt = append(f.Stmt, load)
-	}
-	for _, r := range rs {
-		f.Stmt = append(f.Stmt, r.Call)
-	}
-	return f
+	return NewFile(g.c, pkg.Dir, []Language{&goLanguage{}}, rs)
+}
+
+// goLanguage is the Language implementation for Go. It is always
+// registered first. Flags for Go are registered by gazelle itself, since
+// they are shared with other commands.
+type goLanguage struct {
+	r resolve.LabelResolver
+}
+
+func (l *goLanguage) Name() string { return "go" }
+
+func (l *goLanguage) Kinds() []schema.Kind { return schema.GoKinds }
+
+func (l *goLanguage) RegisterFlags(fs *flag.FlagSet) {}
+
+func (l *goLanguage) Configure(c *config.Config) error {
+	l.r = resolve.NewLabelResolver(c)
+	return nil
+}
+
+func (l *goLanguage) Resolve(imp, rel string) (resolve.Label, error) {
+	return l.r.Resolve(imp, rel)
+}
+
+// GenerateRules generates rules for the Go package in dir, if there is one.
+// A go_prefix rule is generated in the repository root directory, even if
+// it contains no Go package.
+func (l *goLanguage) GenerateRules(c *config.Config, r resolve.LabelResolver, dir *packages.Dir) []*bf.Rule {
+	pkg := dir.Package
+	if pkg == nil {
+		// In DefaultProtoMode, a go_proto_library is generated for .proto
+		// files even if there are no .go files.
+		var protos []string
+		if c.ProtoMode == config.DefaultProtoMode {
+			protos = protoFiles(dir.Files)
+		}
+		if dir.Rel != "" && len(protos) == 0 {
+			return nil
+		}
+		pkg = &packages.Package{Dir: dir.Path, Rel: dir.Rel, Protos: protos}
+	}
+	g := &generator{
+		c:                   c,
+		r:                   r,
+		shouldSetVisibility: dir.File == nil || !hasDefaultVisibility(dir.File),
+		xDefs:               dir.XDefs,
+		mapKinds:            dir.MapKinds,
+		gcGoopts:            dir.GcGoopts,
+		gcLinkopts:          dir.GcLinkopts,
+		test:                dir.Test,
+		assetDirs:           dir.AssetDirs,
+		goVersion:           dir.GoVersion,
+	}
+	if dir.File == nil {
+		g.defaultVisibility = dir.DefaultVisibility
+	}
+	return g.generateRules(pkg)
 }
 
 func (g *generator) generateRules(pkg *packages.Package) []*bf.Rule {
 	var rules []*bf.Rule
 	if pkg.Rel == "" {
-		rules = append(rules, newRule("go_prefix", []interface{}{g.c.GoPrefix}, nil))
+		rules = append(rules, NewRule("go_prefix", []interface{}{g.c.GoPrefix}, nil))
 	}
 
 	cgoLibrary, r := g.generateCgoLib(pkg)
@@ -78,27 +164,41 @@ func (g *generator) generateRules(pkg *packages.Package) []*bf.Rule {
 		rules = append(rules, r)
 	}
 
-	library, r := g.generateLib(pkg, cgoLibrary)
-	if r != nil {
+	if r := g.generateCLib(pkg); r != nil {
 		rules = append(rules, r)
 	}
 
-	if r := g.generateBin(pkg, library); r != nil {
+	if r := g.generateHdrs(pkg); r != nil {
 		rules = append(rules, r)
 	}
 
-	if r := g.filegroup(pkg); r != nil {
-		rules = append(rules, r)
+	rules = append(rules, g.generateEmbedData(pkg)...)
+
+	var library string
+	goProto := g.useGoProto(pkg, cgoLibrary)
+	if goProto {
+		library = resolve.DefaultLibName
+		rules = append(rules, g.generateProto(pkg))
+	} else {
+		library, r = g.generateLib(pkg, cgoLibrary)
+		if r != nil {
+			rules = append(rules, r)
+		}
 	}
 
-	if r := g.generateTest(pkg, library); r != nil {
+	if r := g.generateBin(pkg, library); r != nil {
 		rules = append(rules, r)
 	}
 
-	if r := g.generateXTest(pkg, library); r != nil {
-		rules = append(rules, r)
+	if !goProto {
+		if r := g.filegroup(pkg); r != nil {
+			rules = append(rules, r)
+		}
 	}
 
+	rules = append(rules, g.generateTest(pkg, library)...)
+	rules = append(rules, g.generateXTest(pkg, library)...)
+
 	return rules
 }
 
@@ -130,16 +230,53 @@ func (g *generator) generateLib(pkg *packages.Package, cgoName string) (string,
 }
 
 func (g *generator) generateCgoLib(pkg *packages.Package) (string, *bf.Rule) {
+	g.cLibrary = ""
 	if !pkg.CgoLibrary.HasGo() {
 		return "", nil
 	}
 
+	if !pkg.CLibrary.Sources.IsEmpty() || !pkg.CLibrary.Hdrs.IsEmpty() {
+		g.cLibrary = resolve.DefaultCLibName
+	}
 	name := resolve.DefaultCgoLibName
 	visibility := "//visibility:private"
 	rule := g.generateRule(pkg.Rel, "cgo_library", name, visibility, "", false, pkg.CgoLibrary)
+	g.cgoPlatforms = nil
+	if !hasGoFile(pkg.CgoLibrary.Sources.Generic) {
+		for label, srcs := range pkg.CgoLibrary.Sources.Platform {
+			if hasGoFile(srcs) {
+				g.cgoPlatforms = append(g.cgoPlatforms, label)
+			}
+		}
+	}
 	return name, rule
 }
 
+// hasGoFile returns whether srcs contains a .go file.
+func hasGoFile(srcs []string) bool {
+	for _, src := range srcs {
+		if strings.HasSuffix(src, ".go") {
+			return true
+		}
+	}
+	return false
+}
+
+// embedValue returns the value of the embed attribute of a rule that embeds
+// library. When cgo is unavailable on some platforms, the cgo library is
+// embedded only on the platforms it has sources for. Elsewhere, the library
+// is built from its pure Go files.
+func (g *generator) embedValue(library string) interface{} {
+	if library != resolve.DefaultCgoLibName || len(g.cgoPlatforms) == 0 {
+		return []string{":" + library}
+	}
+	embed := packages.PlatformStrings{Platform: make(map[string][]string)}
+	for _, label := range g.cgoPlatforms {
+		embed.Platform[label] = []string{":" + library}
+	}
+	return embed
+}
+
 // hasDefaultVisibility returns whether oldFile contains a "package" rule with
 // a "default_visibility" attribute. Rules generated by Gazelle should not
 // have their own visibility attributes if this is the case.
@@ -157,6 +294,13 @@ func hasDefaultVisibility(oldFile *bf.File) bool {
 	return false
 }
 
+// isDefaultVisibility returns whether a rule with the given visibility
+// doesn't need a visibility attribute, since it has the default visibility
+// of its build file.
+func (g *generator) isDefaultVisibility(visibility string) bool {
+	return len(g.defaultVisibility) == 1 && g.defaultVisibility[0] == visibility
+}
+
 // checkInternalVisibility overrides the given visibility if the package is
 // internal.
 func checkInternalVisibility(rel, visibility string) string {
@@ -168,6 +312,118 @@ func checkInternalVisibility(rel, visibility string) string {
 	return visibility
 }
 
+// generateEmbedData generates a go_embed_data rule for each asset directory
+// declared in the package's build file. The generated .go files were added
+// to the library's sources when the package was built.
+func (g *generator) generateEmbedData(pkg *packages.Package) []*bf.Rule {
+	if pkg.Name == "" {
+		return nil
+	}
+	var rules []*bf.Rule
+	for _, a := range g.assetDirs {
+		attrs := []KeyValue{
+			{"name", a.RuleName()},
+			{"srcs", GlobValue{Patterns: []string{a.Dir + "/**"}}},
+			{"out", a.Out()},
+			{"package", pkg.Name},
+		}
+		if a.Var != "" {
+			attrs = append(attrs, KeyValue{"var", a.Var})
+		}
+		rules = append(rules, NewRule("go_embed_data", nil, attrs))
+	}
+	return rules
+}
+
+// useGoProto returns whether a go_proto_library should be generated for pkg
+// in place of a go_library. This is done in DefaultProtoMode when the
+// package has .proto files and its library has no sources other than
+// checked-in .pb.go files. Both rules would be named go_default_library, so
+// a package with other sources is built from its .pb.go files instead.
+func (g *generator) useGoProto(pkg *packages.Package, cgoLibrary string) bool {
+	if g.c.ProtoMode != config.DefaultProtoMode || len(pkg.Protos) == 0 {
+		return false
+	}
+	if cgoLibrary == "" && onlyPbGo(pkg.Library.Sources) {
+		return true
+	}
+	logging.Warningf(logging.MixedProtoPackage, pkg.Dir, "%s: package has .proto files and Go sources other than .pb.go files; building the checked-in .pb.go files instead of generating go_proto_library", pkg.Dir)
+	return false
+}
+
+// onlyPbGo returns whether every file in srcs is a .pb.go file.
+func onlyPbGo(srcs packages.PlatformStrings) bool {
+	for _, src := range srcs.Generic {
+		if !strings.HasSuffix(src, ".pb.go") {
+			return false
+		}
+	}
+	for _, platformSrcs := range srcs.Platform {
+		for _, src := range platformSrcs {
+			if !strings.HasSuffix(src, ".pb.go") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// generateProto generates a go_proto_library rule for the .proto files in
+// pkg. deps are found from the files' imports, which are interpreted
+// relative to the repository root.
+func (g *generator) generateProto(pkg *packages.Package) *bf.Rule {
+	hasServices := false
+	depSet := make(map[string]bool)
+	for _, name := range pkg.Protos {
+		info, err := readProtoFile(filepath.Join(pkg.Dir, name))
+		if err != nil {
+			logging.Warning(err)
+			continue
+		}
+		hasServices = hasServices || info.hasServices
+		for _, imp := range info.imports {
+			if l, ok := protoImportLabel(imp, pkg.Rel); ok {
+				depSet[l] = true
+			}
+		}
+	}
+	var deps []string
+	for l := range depSet {
+		deps = append(deps, l)
+	}
+	sort.Strings(deps)
+
+	attrs := []KeyValue{
+		{"name", resolve.DefaultLibName},
+		{"srcs", pkg.Protos},
+	}
+	if hasServices {
+		attrs = append(attrs, KeyValue{"has_services", 1})
+	}
+	if importmap := g.importMap(pkg.Rel); importmap != "" {
+		attrs = append(attrs, KeyValue{"importmap", importmap})
+	}
+	if visibility := checkInternalVisibility(pkg.Rel, "//visibility:public"); g.shouldSetVisibility && !g.isDefaultVisibility(visibility) {
+		attrs = append(attrs, KeyValue{"visibility", []string{visibility}})
+	}
+	if len(deps) > 0 {
+		attrs = append(attrs, KeyValue{"deps", deps})
+	}
+	return NewRule("go_proto_library", nil, attrs)
+}
+
+// importMap returns the importmap attribute for a library in the directory
+// rel, or "" if it doesn't need one. Libraries under a vendor directory
+// have the import path of the vendored package, which may be vendored in
+// more than one place. They're compiled as their full path instead, so the
+// copies don't clash when linked into the same binary.
+func (g *generator) importMap(rel string) string {
+	if !strings.Contains("/"+rel+"/", "/vendor/") {
+		return ""
+	}
+	return path.Join(g.c.GoPrefix, rel)
+}
+
 // filegroup is a small hack for directories with pre-generated .pb.go files
 // and also source .proto files.  This creates a filegroup for the .proto in
 // addition to the usual go_library for the .pb.go files.
@@ -175,14 +431,71 @@ func (g *generator) filegroup(pkg *packages.Package) *bf.Rule {
 	if !pkg.HasPbGo || len(pkg.Protos) == 0 {
 		return nil
 	}
-	return newRule("filegroup", nil, []keyvalue{
-		{key: "name", value: resolve.DefaultProtosName},
-		{key: "srcs", value: pkg.Protos},
-		{key: "visibility", value: []string{"//visibility:public"}},
+	return NewRule("filegroup", nil, []KeyValue{
+		{Key: "name", Value: resolve.DefaultProtosName},
+		{Key: "srcs", Value: pkg.Protos},
+		{Key: "visibility", Value: []string{"//visibility:public"}},
 	})
 }
 
-func (g *generator) generateTest(pkg *packages.Package, library string) *bf.Rule {
+// generateCLib generates a cc_library for the C files of the cgo library,
+// if they're built separately. It's compiled with the options from the
+// cgo library's "#cgo" directives.
+func (g *generator) generateCLib(pkg *packages.Package) *bf.Rule {
+	if g.cLibrary == "" {
+		return nil
+	}
+	attrs := []KeyValue{{"name", g.cLibrary}}
+	if !pkg.CLibrary.Sources.IsEmpty() {
+		attrs = append(attrs, KeyValue{"srcs", pkg.CLibrary.Sources})
+	}
+	if !pkg.CLibrary.Hdrs.IsEmpty() {
+		attrs = append(attrs, KeyValue{"hdrs", pkg.CLibrary.Hdrs})
+	}
+	if !pkg.CLibrary.COpts.IsEmpty() {
+		attrs = append(attrs, KeyValue{"copts", pkg.CLibrary.COpts})
+	}
+	if g.c.HeaderMode == config.ExportHeaderMode {
+		if visibility := checkInternalVisibility(pkg.Rel, "//visibility:public"); g.shouldSetVisibility && !g.isDefaultVisibility(visibility) {
+			attrs = append(attrs, KeyValue{"visibility", []string{visibility}})
+		}
+	}
+	return NewRule("cc_library", nil, attrs)
+}
+
+// generateHdrs generates a cc_library for the headers included by cgo code
+// in pkg, unless they're listed in srcs. Headers are only added to one
+// target, the one that builds the package's C files, so that target's
+// headers are used.
+func (g *generator) generateHdrs(pkg *packages.Package) *bf.Rule {
+	for _, t := range []packages.Target{pkg.CgoLibrary, pkg.Test, pkg.XTest} {
+		if !g.hdrsInCcLibrary(t) {
+			continue
+		}
+		attrs := []KeyValue{
+			{"name", resolve.DefaultHdrsName},
+			{"hdrs", t.Hdrs},
+		}
+		if g.c.HeaderMode == config.ExportHeaderMode {
+			if visibility := checkInternalVisibility(pkg.Rel, "//visibility:public"); g.shouldSetVisibility && !g.isDefaultVisibility(visibility) {
+				attrs = append(attrs, KeyValue{"visibility", []string{visibility}})
+			}
+		}
+		return NewRule("cc_library", nil, attrs)
+	}
+	return nil
+}
+
+// hdrsInCcLibrary returns whether the headers of target are listed in the
+// cc_library generated by generateHdrs instead of in srcs.
+func (g *generator) hdrsInCcLibrary(target packages.Target) bool {
+	return g.c.HeaderMode != config.SrcsHeaderMode && target.Cgo && !target.Hdrs.IsEmpty()
+}
+
+// generateTest returns the go_test rule for the internal test of pkg, if
+// it has one, followed by a rule for its fuzz targets, if any. See
+// generateFuzzTest.
+func (g *generator) generateTest(pkg *packages.Package, library string) []*bf.Rule {
 	if !pkg.Test.HasGo() {
 		return nil
 	}
@@ -193,11 +506,20 @@ func (g *generator) generateTest(pkg *packages.Package, library string) *bf.Rule
 	} else {
 		name = library + "_test"
 	}
+	if pkg.StandaloneTest {
+		library = ""
+	}
 
-	return g.generateRule(pkg.Rel, "go_test", name, "", library, pkg.HasTestdata, pkg.Test)
+	rules := []*bf.Rule{g.generateRule(pkg.Rel, "go_test", name, "", library, pkg.HasTestdata, pkg.Test)}
+	if r := g.generateFuzzTest(pkg.Rel, name, library, pkg.HasTestdata, pkg.Test); r != nil {
+		rules = append(rules, r)
+	}
+	return rules
 }
 
-func (g *generator) generateXTest(pkg *packages.Package, library string) *bf.Rule {
+// generateXTest returns the go_test rule for the external test of pkg, if
+// it has one, followed by a rule for its fuzz targets, if any.
+func (g *generator) generateXTest(pkg *packages.Package, library string) []*bf.Rule {
 	if !pkg.XTest.HasGo() {
 		return nil
 	}
@@ -209,85 +531,352 @@ func (g *generator) generateXTest(pkg *packages.Package, library string) *bf.Rul
 		name = library + "_xtest"
 	}
 
-	return g.generateRule(pkg.Rel, "go_test", name, "", "", pkg.HasTestdata, pkg.XTest)
+	rules := []*bf.Rule{g.generateRule(pkg.Rel, "go_test", name, "", "", pkg.HasTestdata, pkg.XTest)}
+	if r := g.generateFuzzTest(pkg.Rel, name, "", pkg.HasTestdata, pkg.XTest); r != nil {
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// fuzzTestKind is the kind of rule generated for the fuzz targets of a test.
+// rules_go doesn't provide it, so it must be mapped to a real kind with a
+// directive like "# gazelle:map_kind go_fuzz_test fuzz_test //tools:fuzz.bzl".
+const fuzzTestKind = "go_fuzz_test"
+
+// generateFuzzTest returns a rule of fuzzTestKind for the fuzz targets in
+// target, the test built by the go_test named testName, if it has any and
+// fuzzTestKind is mapped to another kind. The rule has the same sources and
+// dependencies as the go_test, which still runs the test's other tests,
+// benchmarks, and examples. nil is returned otherwise.
+func (g *generator) generateFuzzTest(rel, testName, library string, hasTestdata bool, target packages.Target) *bf.Rule {
+	if !target.TestFuncs.Fuzz {
+		return nil
+	}
+	if _, ok := g.mapKinds[fuzzTestKind]; !ok {
+		return nil
+	}
+	return g.generateRule(rel, fuzzTestKind, testName+"_fuzz", "", library, hasTestdata, target)
+}
+
+func isTestKind(kind string) bool {
+	return kind == "go_test" || kind == fuzzTestKind
 }
 
 func (g *generator) generateRule(rel, kind, name, visibility, library string, hasTestdata bool, target packages.Target) *bf.Rule {
 	// Construct attrs in the same order that bf.Rewrite uses. See
 	// namePriority in github.com/bazelbuild/buildtools/build/rewrite.go.
-	attrs := []keyvalue{
+	attrs := []KeyValue{
 		{"name", name},
 	}
-	if !target.Sources.IsEmpty() {
-		attrs = append(attrs, keyvalue{"srcs", target.Sources})
+	if isTestKind(kind) {
+		size, timeout := g.test.Size, g.test.Timeout
+		if r := g.c.TestSizePolicy.Choose(target.TestStats); r != nil {
+			// Directives take precedence over the policy.
+			if size == "" {
+				size = r.Size
+			}
+			if timeout == "" {
+				timeout = r.Timeout
+			}
+		}
+		if size != "" {
+			attrs = append(attrs, KeyValue{"size", size})
+		}
+		if timeout != "" {
+			attrs = append(attrs, KeyValue{"timeout", timeout})
+		}
+	}
+	srcs := target.SourcesAndHdrs()
+	var cdeps []string
+	if kind == "cgo_library" && g.cLibrary != "" {
+		cdeps = append(cdeps, ":"+g.cLibrary)
+	}
+	if g.hdrsInCcLibrary(target) {
+		srcs = target.Sources
+		cdeps = append(cdeps, ":"+resolve.DefaultHdrsName)
+	}
+	if !srcs.IsEmpty() {
+		attrs = append(attrs, KeyValue{"srcs", srcs})
+	}
+	if len(cdeps) > 0 {
+		attrs = append(attrs, KeyValue{"cdeps", cdeps})
+	}
+	if isTestKind(kind) && target.Cgo {
+		// Tests aren't split into a cgo_library and a go_library. The test
+		// builds its own cgo code, including any C files added to it.
+		attrs = append(attrs, KeyValue{"cgo", true})
 	}
 	if !target.CLinkOpts.IsEmpty() {
-		attrs = append(attrs, keyvalue{"clinkopts", target.CLinkOpts})
+		attrs = append(attrs, KeyValue{"clinkopts", target.CLinkOpts})
 	}
 	if !target.COpts.IsEmpty() {
-		attrs = append(attrs, keyvalue{"copts", target.COpts})
+		attrs = append(attrs, KeyValue{"copts", target.COpts})
 	}
-	if hasTestdata {
-		glob := globvalue{patterns: []string{"testdata/**"}}
-		attrs = append(attrs, keyvalue{"data", glob})
+	if data := ruleData(target, hasTestdata); data != nil {
+		attrs = append(attrs, KeyValue{"data", data})
 	}
 	if library != "" {
-		attrs = append(attrs, keyvalue{"library", ":" + library})
+		attrs = append(attrs, KeyValue{"embed", g.embedValue(library)})
+	}
+	if kind == "go_library" {
+		if importmap := g.importMap(rel); importmap != "" {
+			attrs = append(attrs, KeyValue{"importmap", importmap})
+		}
 	}
-	if g.shouldSetVisibility && visibility != "" {
-		attrs = append(attrs, keyvalue{"visibility", []string{visibility}})
+	if isTestKind(kind) && g.test.ShardCount > 0 {
+		attrs = append(attrs, KeyValue{"shard_count", g.test.ShardCount})
+	}
+	if g.shouldSetVisibility && visibility != "" && !g.isDefaultVisibility(visibility) {
+		attrs = append(attrs, KeyValue{"visibility", []string{visibility}})
 	}
 	if !target.Imports.IsEmpty() {
 		deps := g.dependencies(target.Imports, rel)
-		attrs = append(attrs, keyvalue{"deps", deps})
+		attrs = append(attrs, KeyValue{"deps", deps})
+	}
+	if kind != "cgo_library" && !g.gcGoopts.IsEmpty() {
+		attrs = append(attrs, KeyValue{"gc_goopts", g.gcGoopts})
+	}
+	if (kind == "go_binary" || isTestKind(kind)) && !g.gcLinkopts.IsEmpty() {
+		attrs = append(attrs, KeyValue{"gc_linkopts", g.gcLinkopts})
+	}
+	if isTestKind(kind) && target.TestFuncs.BenchmarksOnly() {
+		// Tests with only benchmarks pass without doing anything. Tag
+		// them, so they can be filtered with --test_tag_filters.
+		attrs = append(attrs, KeyValue{"tags", []string{"benchmark"}})
+	}
+	if xDefs := g.ruleXDefs(kind); len(xDefs) > 0 {
+		attrs = append(attrs, KeyValue{"x_defs", xDefs})
+	}
+	if g.c.CollapseOSSelects {
+		for i, kv := range attrs {
+			if ps, ok := kv.Value.(packages.PlatformStrings); ok && isSelectAttr(kv.Key) {
+				attrs[i].Value = collapseOSPlatforms(ps, g.c.Platforms)
+			}
+		}
+	}
+	if g.c.MaxSelectBranches > 0 && kind != "cgo_library" && !target.Cgo {
+		for i, kv := range attrs {
+			if ps, ok := kv.Value.(packages.PlatformStrings); ok && kv.Key == "srcs" && selectCases(ps) > g.c.MaxSelectBranches {
+				dir := filepath.Join(g.c.RepoRoot, filepath.FromSlash(rel))
+				if glob, ok := globPlatformSources(dir, ps, isTestKind(kind)); ok {
+					attrs[i].Value = glob
+				}
+			}
+		}
+	}
+	r := NewRule(kind, nil, attrs)
+	g.noteGoVersion(r, rel, name, target)
+	if g.c.SelectSummaryThreshold > 0 {
+		if summary := platformSummary(attrs, g.c.SelectSummaryThreshold); summary != "" {
+			r.Call.Comment().Suffix = append(r.Call.Comment().Suffix, bf.Comment{
+				Token:  merger.PlatformSummaryPrefix + " " + summary,
+				Suffix: true,
+			})
+		}
 	}
-	return newRule(kind, nil, attrs)
+	return r
 }
 
-func (g *generator) generateLoad(rs []*bf.Rule) bf.Expr {
-	loadableKinds := []string{
-		// keep sorted
-		"cgo_library",
-		"go_binary",
-		"go_library",
-		"go_prefix",
-		"go_test",
+// noteGoVersion adds a comment to r, the rule named name, noting the Go
+// version its sources need, if it's known. This is the newer of the version
+// detected from target's files and the version declared with
+// "# gazelle:go_version". If it's newer than g.c.GoVersion, a warning is
+// reported, since the target won't build.
+func (g *generator) noteGoVersion(r *bf.Rule, rel, name string, target packages.Target) {
+	version, reason := target.GoVersion, target.GoVersionReason
+	if version.Less(g.goVersion) {
+		version, reason = g.goVersion, "declared with \"# gazelle:go_version\""
+	}
+	if version.IsZero() {
+		return
+	}
+	r.Call.Comment().Suffix = append(r.Call.Comment().Suffix, bf.Comment{
+		Token:  merger.GoVersionPrefix + " go" + version.String(),
+		Suffix: true,
+	})
+	if !g.c.GoVersion.IsZero() && g.c.GoVersion.Less(version) {
+		logging.Warningf(logging.UnsupportedGoVersion, rel, "in dir %q, %s requires Go %s (%s), but -go_version is %s", rel, name, version, reason, g.c.GoVersion)
 	}
+}
 
-	kinds := make(map[string]bool)
-	for _, r := range rs {
-		kinds[r.Kind()] = true
+// ruleData returns the data attribute for a target, or nil if it has no
+// data. If hasTestdata is true, the testdata directory is included with a
+// glob, and files inside it are omitted from the list.
+func ruleData(target packages.Target, hasTestdata bool) interface{} {
+	keep := func(f string) bool {
+		return !hasTestdata || !strings.HasPrefix(f, "testdata/")
+	}
+	var files packages.PlatformStrings
+	for _, f := range target.Data.Generic {
+		if keep(f) {
+			files.Generic = append(files.Generic, f)
+		}
 	}
-	args := make([]bf.Expr, 0, len(kinds)+1)
-	args = append(args, &bf.StringExpr{Value: goRulesBzl})
-	for _, k := range loadableKinds {
-		if kinds[k] {
-			args = append(args, &bf.StringExpr{Value: k})
+	for name, fs := range target.Data.Platform {
+		for _, f := range fs {
+			if keep(f) {
+				if files.Platform == nil {
+					files.Platform = make(map[string][]string)
+				}
+				files.Platform[name] = append(files.Platform[name], f)
+			}
+		}
+	}
+	files.Clean()
+
+	if !hasTestdata {
+		if files.IsEmpty() {
+			return nil
 		}
+		return files
 	}
-	if len(args) == 1 {
+	glob := GlobValue{Patterns: []string{"testdata/**"}}
+	if files.IsEmpty() {
+		return glob
+	}
+	return ConcatValue{files, glob}
+}
+
+// ruleXDefs returns the x_defs attribute for a rule of the given kind.
+// Binaries and tests are stamped with all variables set by
+// "# gazelle:x_def" directives, since variables are set when they're
+// linked. go_library has no x_defs attribute, so libraries get nothing.
+func (g *generator) ruleXDefs(kind string) DictValue {
+	if kind != "go_binary" && !isTestKind(kind) {
 		return nil
 	}
-	return &bf.CallExpr{
-		X:            &bf.LiteralExpr{Token: "load"},
-		List:         args,
-		ForceCompact: true,
+	var xDefs DictValue
+	for name, value := range g.xDefs {
+		if xDefs == nil {
+			xDefs = make(DictValue)
+		}
+		xDefs[name] = value
 	}
+	return xDefs
 }
 
+// dependencies resolves imports of a target in dir to labels. Labels for
+// platform-specific imports are only listed under the platforms that need
+// them. Imports that resolve to packages in this repository that don't
+// exist keep their labels, but are reported, since the target won't build
+// until the package is added. Platform-specific imports that can't be
+// resolved or don't exist are reported as errors naming the platforms that
+// need them. Generic ones are reported as warnings.
 func (g *generator) dependencies(imports packages.PlatformStrings, dir string) packages.PlatformStrings {
-	resolve := func(imp string) (string, error) {
-		if l, err := g.r.Resolve(imp, dir); err != nil {
-			return "", fmt.Errorf("in dir %q, could not resolve import path %q: %v", dir, imp, err)
-		} else {
-			return l.String(), nil
+	deps := packages.PlatformStrings{Generic: make([]string, 0, len(imports.Generic))}
+	generic := make(map[string]bool)
+	for _, imp := range imports.Generic {
+		generic[imp] = true
+		l, err := g.resolveImport(imp, dir)
+		if err != nil {
+			logging.Warningf(logging.UnresolvedImport, dir, "%v", err)
+			continue
+		}
+		if err := g.checkPackageExists(l, imp, dir); err != nil {
+			logging.Warningf(logging.UnresolvedImport, dir, "%v", err)
+		}
+		deps.Generic = append(deps.Generic, l.String())
+	}
+
+	// Each platform-specific import is resolved once, even if several
+	// platforms need it. Imports that are also generic were already
+	// resolved and reported above.
+	type platformDep struct {
+		label     string
+		err       error
+		platforms []string
+	}
+	platformDeps := make(map[string]*platformDep)
+	var failed []string
+	for platform, platformImports := range imports.Platform {
+		seen := make(map[string]bool)
+		for _, imp := range platformImports {
+			if generic[imp] || seen[imp] {
+				continue
+			}
+			seen[imp] = true
+			d, ok := platformDeps[imp]
+			if !ok {
+				d = &platformDep{}
+				l, err := g.resolveImport(imp, dir)
+				if err == nil {
+					d.label = l.String()
+					err = g.checkPackageExists(l, imp, dir)
+				}
+				d.err = err
+				platformDeps[imp] = d
+				if err != nil {
+					failed = append(failed, imp)
+				}
+			}
+			if d.err != nil {
+				d.platforms = append(d.platforms, platform)
+			}
+			if d.label == "" {
+				continue
+			}
+			if deps.Platform == nil {
+				deps.Platform = make(map[string][]string)
+			}
+			deps.Platform[platform] = append(deps.Platform[platform], d.label)
 		}
 	}
-
-	deps, errors := imports.Map(resolve)
-	for _, err := range errors {
-		log.Print(err)
+	sort.Strings(failed)
+	for _, imp := range failed {
+		d := platformDeps[imp]
+		sort.Strings(d.platforms)
+		logging.Errorf(logging.UnresolvedImport, dir, "%v (needed on %s)", d.err, strings.Join(d.platforms, ", "))
 	}
+
 	deps.Clean()
 	return deps
 }
+
+// resolveImport resolves an import of a target in dir to a label.
+func (g *generator) resolveImport(imp, dir string) (resolve.Label, error) {
+	g.checkImportPolicy(imp, dir)
+	l, err := g.r.Resolve(imp, dir)
+	if err != nil {
+		return resolve.Label{}, fmt.Errorf("in dir %q, could not resolve import path %q: %v", dir, imp, err)
+	}
+	return l, nil
+}
+
+// checkPackageExists returns an error if l, the label imp resolved to, is
+// in a directory of this repository or one of g.c.Repos that doesn't
+// exist. A package only some platforms need is easy to miss, so the error
+// names them when it's reported.
+func (g *generator) checkPackageExists(l resolve.Label, imp, dir string) error {
+	if l.Relative {
+		return nil
+	}
+	root := g.c.RepoRoot
+	if l.Repo != "" {
+		r := g.c.RepoByName(l.Repo)
+		if r == nil {
+			return nil
+		}
+		root = g.c.RootDir(*r)
+	}
+	if root == "" {
+		return nil
+	}
+	if st, err := os.Stat(filepath.Join(root, filepath.FromSlash(l.Pkg))); err != nil || !st.IsDir() {
+		return fmt.Errorf("in dir %q, import path %q resolves to %s, but there is no such package", dir, imp, l)
+	}
+	return nil
+}
+
+// checkImportPolicy reports an error or warning if the import policy
+// forbids packages in dir from importing imp.
+func (g *generator) checkImportPolicy(imp, dir string) {
+	r := g.c.ImportPolicy.Check(dir, imp)
+	if r == nil {
+		return
+	}
+	if r.Level == config.ErrorPolicy {
+		logging.Errorf(logging.ForbiddenImport, dir, "in dir %q, import of %q is forbidden by import policy rule %q", dir, imp, r.Pattern)
+	} else {
+		logging.Warningf(logging.ForbiddenImport, dir, "in dir %q, import of %q is forbidden by import policy rule %q", dir, imp, r.Pattern)
+	}
+}
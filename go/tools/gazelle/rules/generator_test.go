@@ -16,9 +16,13 @@ limitations under the License.
 package rules_test
 
 import (
+	"bytes"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	bf "github.com/bazelbuild/buildtools/build"
@@ -98,6 +102,35 @@ func TestGenerator(t *testing.T) {
 	}
 }
 
+// TestGeneratorDeterministic generates the build file for a package with
+// many platform-specific sources and deps several times, each with a new
+// generator. Platforms are stored in maps, so each run iterates over them
+// in a different order, but the output must always be the same as the
+// first run's, which must match the golden file.
+func TestGeneratorDeterministic(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	dir := filepath.Join(repoRoot, "platforms")
+	want, err := ioutil.ReadFile(filepath.Join(dir, "BUILD.want"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first string
+	for i := 0; i < 10; i++ {
+		pkg, oldFile := packageFromDir(c, dir)
+		g := rules.NewGenerator(c, resolve.NewLabelResolver(c), oldFile)
+		got := string(bf.Format(g.Generate(pkg)))
+		if i == 0 {
+			first = got
+			if got != string(want) {
+				t.Errorf("run 0: got:\n%s\nwant:\n%s", got, want)
+			}
+		} else if got != first {
+			t.Fatalf("run %d differs from run 0: got:\n%s\nrun 0:\n%s", i, got, first)
+		}
+	}
+}
+
 func TestGeneratorGoPrefixLib(t *testing.T) {
 	repoRoot := filepath.Join(testdata.Dir(), "repo", "lib")
 	goPrefix := "example.com/repo/lib"
@@ -126,6 +159,1011 @@ func TestGeneratorGoPrefixRoot(t *testing.T) {
 	}
 }
 
+func TestGeneratorXDefs(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "bin"),
+		Rel:  "bin",
+		XDefs: map[string]string{
+			"example.com/repo/bin.Version":     "{BUILD_EMBED_LABEL}",
+			"example.com/repo/version.Version": "1.0",
+		},
+	}
+	dir.Package, _ = packageFromDir(c, dir.Path)
+	dir.Package.Test.Sources = packages.PlatformStrings{Generic: []string{"main_test.go"}}
+
+	got := make(map[string][]string)
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		kind := r.Call.X.(*bf.LiteralExpr).Token
+		for _, arg := range r.Call.List {
+			kv, ok := arg.(*bf.BinaryExpr)
+			if !ok || kv.X.(*bf.LiteralExpr).Token != "x_defs" {
+				continue
+			}
+			for _, e := range kv.Y.(*bf.DictExpr).List {
+				got[kind] = append(got[kind], e.(*bf.KeyValueExpr).Key.(*bf.StringExpr).Value)
+			}
+		}
+	}
+	want := map[string][]string{
+		"go_binary": {"example.com/repo/bin.Version", "example.com/repo/version.Version"},
+		"go_test":   {"example.com/repo/bin.Version", "example.com/repo/version.Version"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got x_defs keys %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorGcOpts(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path:       filepath.Join(repoRoot, "bin_with_tests"),
+		Rel:        "bin_with_tests",
+		GcGoopts:   packages.PlatformStrings{Generic: []string{"-N", "-l"}},
+		GcLinkopts: packages.PlatformStrings{Generic: []string{"-s"}},
+	}
+	dir.Package, _ = packageFromDir(c, dir.Path)
+
+	got := make(map[string][]string)
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		kind := r.Call.X.(*bf.LiteralExpr).Token
+		for _, arg := range r.Call.List {
+			key := arg.(*bf.BinaryExpr).X.(*bf.LiteralExpr).Token
+			if key == "gc_goopts" || key == "gc_linkopts" {
+				got[kind] = append(got[kind], key)
+			}
+		}
+	}
+	want := map[string][]string{
+		"go_library": {"gc_goopts"},
+		"go_binary":  {"gc_goopts", "gc_linkopts"},
+		"go_test":    {"gc_goopts", "gc_linkopts"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got attributes %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorTestAttrs(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "bin_with_tests"),
+		Rel:  "bin_with_tests",
+		Test: packages.TestAttrs{Size: "large", ShardCount: 3},
+	}
+	dir.Package, _ = packageFromDir(c, dir.Path)
+
+	got := make(map[string][]string)
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		kind := r.Call.X.(*bf.LiteralExpr).Token
+		for _, arg := range r.Call.List {
+			key := arg.(*bf.BinaryExpr).X.(*bf.LiteralExpr).Token
+			switch key {
+			case "size", "timeout", "shard_count":
+				got[kind] = append(got[kind], key)
+			}
+		}
+	}
+	want := map[string][]string{"go_test": {"size", "shard_count"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got attributes %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorTestSizePolicy(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	c.TestSizePolicy = &config.TestSizePolicy{Rules: []config.TestSizeRule{
+		{Size: "medium", Timeout: "moderate", Network: true},
+		{Size: "large", Sleep: true},
+	}}
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		Package: &packages.Package{
+			Name:    "foo",
+			Dir:     filepath.Join(repoRoot, "foo"),
+			Rel:     "foo",
+			Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"foo.go"}}},
+			Test: packages.Target{
+				Sources:   packages.PlatformStrings{Generic: []string{"foo_test.go"}},
+				TestStats: config.TestStats{Files: 1, Network: true},
+			},
+			XTest: packages.Target{
+				Sources:   packages.PlatformStrings{Generic: []string{"bar_test.go"}},
+				TestStats: config.TestStats{Files: 1, Sleep: true},
+			},
+		},
+	}
+
+	// The policy chooses attributes the directory's directives don't set.
+	for _, tc := range []struct {
+		test packages.TestAttrs
+		want map[string][]string
+	}{
+		{
+			want: map[string][]string{
+				"go_default_test":  {"size=medium", "timeout=moderate"},
+				"go_default_xtest": {"size=large"},
+			},
+		}, {
+			test: packages.TestAttrs{Size: "small"},
+			want: map[string][]string{
+				"go_default_test":  {"size=small", "timeout=moderate"},
+				"go_default_xtest": {"size=small"},
+			},
+		},
+	} {
+		dir.Test = tc.test
+		got := make(map[string][]string)
+		for _, r := range goLang.GenerateRules(c, goLang, dir) {
+			var name string
+			var attrs []string
+			for _, arg := range r.Call.List {
+				kv := arg.(*bf.BinaryExpr)
+				key := kv.X.(*bf.LiteralExpr).Token
+				switch key {
+				case "name":
+					name = kv.Y.(*bf.StringExpr).Value
+				case "size", "timeout":
+					attrs = append(attrs, key+"="+kv.Y.(*bf.StringExpr).Value)
+				}
+			}
+			if attrs != nil {
+				got[name] = attrs
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("with directives %+v, got attributes %v; want %v", tc.test, got, tc.want)
+		}
+	}
+}
+
+func TestGeneratorCgoTest(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		Package: &packages.Package{
+			Name:    "foo",
+			Dir:     filepath.Join(repoRoot, "foo"),
+			Rel:     "foo",
+			Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"foo.go"}}},
+			Test: packages.Target{
+				Sources:   packages.PlatformStrings{Generic: []string{"foo_test.go", "helper.c"}},
+				CLinkOpts: packages.PlatformStrings{Generic: []string{"-lm"}},
+				Cgo:       true,
+			},
+		},
+	}
+
+	got := make(map[string][]string)
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		kind := r.Call.X.(*bf.LiteralExpr).Token
+		for _, arg := range r.Call.List {
+			key := arg.(*bf.BinaryExpr).X.(*bf.LiteralExpr).Token
+			switch key {
+			case "cgo", "clinkopts":
+				got[kind] = append(got[kind], key)
+			}
+		}
+	}
+	want := map[string][]string{"go_test": {"cgo", "clinkopts"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got attributes %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorStandaloneTest(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		Package: &packages.Package{
+			Name: "foo",
+			Dir:  filepath.Join(repoRoot, "foo"),
+			Rel:  "foo",
+			CgoLibrary: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"foo.go", "helper.c"}},
+				Cgo:     true,
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"foo.go", "helper.c", "foo_test.go"}},
+				Cgo:     true,
+			},
+			StandaloneTest: true,
+		},
+	}
+
+	var got []string
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		if r.Call.X.(*bf.LiteralExpr).Token != "go_test" {
+			continue
+		}
+		for _, arg := range r.Call.List {
+			got = append(got, arg.(*bf.BinaryExpr).X.(*bf.LiteralExpr).Token)
+		}
+	}
+	want := []string{"name", "srcs", "cgo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got go_test attributes %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorNoCgoPlatforms(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	linux := config.Platform{OS: "linux", Arch: "amd64"}.Label()
+	windows := config.Platform{OS: "windows", Arch: "amd64"}.Label()
+	c.NoCgoPlatforms = map[string]bool{windows: true}
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		Package: &packages.Package{
+			Name: "foo",
+			Dir:  filepath.Join(repoRoot, "foo"),
+			Rel:  "foo",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Platform: map[string][]string{windows: {"foo_nocgo.go"}},
+				},
+			},
+			CgoLibrary: packages.Target{
+				Sources: packages.PlatformStrings{
+					Platform: map[string][]string{linux: {"foo_cgo.go", "foo.c"}},
+				},
+				Cgo: true,
+			},
+		},
+	}
+
+	// The cgo library is only embedded on the platforms it has sources for.
+	var got []string
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		if r.Call.X.(*bf.LiteralExpr).Token != "go_library" {
+			continue
+		}
+		for _, arg := range r.Call.List {
+			kv := arg.(*bf.BinaryExpr)
+			if kv.X.(*bf.LiteralExpr).Token != "embed" {
+				continue
+			}
+			call, ok := kv.Y.(*bf.CallExpr)
+			if !ok {
+				t.Fatalf("got embed %#v; want a select", kv.Y)
+			}
+			for _, e := range call.List[0].(*bf.DictExpr).List {
+				kv := e.(*bf.KeyValueExpr)
+				var values []string
+				for _, v := range kv.Value.(*bf.ListExpr).List {
+					values = append(values, v.(*bf.StringExpr).Value)
+				}
+				got = append(got, kv.Key.(*bf.StringExpr).Value+"="+strings.Join(values, ","))
+			}
+		}
+	}
+	want := []string{
+		linux + "=:cgo_default_library",
+		"//conditions:default=",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got embed select %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorHeaderMode(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	for _, tc := range []struct {
+		mode               config.HeaderMode
+		wantCgoLib, wantCc []string
+	}{
+		{
+			mode:       config.SrcsHeaderMode,
+			wantCgoLib: []string{"name", "srcs", "visibility"},
+		}, {
+			mode:       config.CcLibraryHeaderMode,
+			wantCgoLib: []string{"name", "srcs", "cdeps", "visibility"},
+			wantCc:     []string{"name", "hdrs"},
+		}, {
+			mode:       config.ExportHeaderMode,
+			wantCgoLib: []string{"name", "srcs", "cdeps", "visibility"},
+			wantCc:     []string{"name", "hdrs", "visibility"},
+		},
+	} {
+		c := testConfig(repoRoot, "example.com/repo")
+		c.HeaderMode = tc.mode
+		goLang := rules.Languages()[0]
+		if err := goLang.Configure(c); err != nil {
+			t.Fatal(err)
+		}
+		dir := &packages.Dir{
+			Path: filepath.Join(repoRoot, "foo"),
+			Rel:  "foo",
+			Package: &packages.Package{
+				Name: "foo",
+				Dir:  filepath.Join(repoRoot, "foo"),
+				Rel:  "foo",
+				CgoLibrary: packages.Target{
+					Sources: packages.PlatformStrings{Generic: []string{"foo.go", "foo.c"}},
+					Hdrs:    packages.PlatformStrings{Generic: []string{"foo.h"}},
+					Cgo:     true,
+				},
+			},
+		}
+
+		got := make(map[string][]string)
+		for _, r := range goLang.GenerateRules(c, goLang, dir) {
+			kind := r.Call.X.(*bf.LiteralExpr).Token
+			for _, arg := range r.Call.List {
+				got[kind] = append(got[kind], arg.(*bf.BinaryExpr).X.(*bf.LiteralExpr).Token)
+			}
+		}
+		if !reflect.DeepEqual(got["cgo_library"], tc.wantCgoLib) {
+			t.Errorf("mode %d: got cgo_library attributes %v; want %v", tc.mode, got["cgo_library"], tc.wantCgoLib)
+		}
+		if !reflect.DeepEqual(got["cc_library"], tc.wantCc) {
+			t.Errorf("mode %d: got cc_library attributes %v; want %v", tc.mode, got["cc_library"], tc.wantCc)
+		}
+	}
+}
+
+func TestGeneratorCLibrary(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		Package: &packages.Package{
+			Name: "foo",
+			Dir:  filepath.Join(repoRoot, "foo"),
+			Rel:  "foo",
+			CgoLibrary: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"foo.go"}},
+				COpts:   packages.PlatformStrings{Generic: []string{"-DFOO"}},
+				Cgo:     true,
+			},
+			CLibrary: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"foo.c"}},
+				Hdrs:    packages.PlatformStrings{Generic: []string{"foo.h"}},
+				COpts:   packages.PlatformStrings{Generic: []string{"-DFOO"}},
+			},
+		},
+	}
+
+	got := make(map[string][]string)
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		kind := r.Call.X.(*bf.LiteralExpr).Token
+		for _, arg := range r.Call.List {
+			got[kind] = append(got[kind], arg.(*bf.BinaryExpr).X.(*bf.LiteralExpr).Token)
+		}
+	}
+	for kind, want := range map[string][]string{
+		"cgo_library": {"name", "srcs", "cdeps", "copts", "visibility"},
+		"cc_library":  {"name", "srcs", "hdrs", "copts"},
+	} {
+		if !reflect.DeepEqual(got[kind], want) {
+			t.Errorf("got %s attributes %v; want %v", kind, got[kind], want)
+		}
+	}
+}
+
+func TestGeneratorGoVersion(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path:      filepath.Join(repoRoot, "foo"),
+		Rel:       "foo",
+		GoVersion: config.GoVersion{Major: 1, Minor: 8},
+		Package: &packages.Package{
+			Name: "foo",
+			Dir:  filepath.Join(repoRoot, "foo"),
+			Rel:  "foo",
+			Library: packages.Target{
+				Sources:         packages.PlatformStrings{Generic: []string{"foo.go"}},
+				GoVersion:       config.GoVersion{Major: 1, Minor: 9},
+				GoVersionReason: "type alias in foo.go",
+			},
+			Test: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"foo_test.go"}}},
+		},
+	}
+
+	got := make(map[string][]string)
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		kind := r.Call.X.(*bf.LiteralExpr).Token
+		for _, com := range r.Call.Comment().Suffix {
+			got[kind] = append(got[kind], com.Token)
+		}
+	}
+	want := map[string][]string{
+		"go_library": {"# gazelle:requires go1.9"},
+		"go_test":    {"# gazelle:requires go1.8"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got comments %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorDefaultVisibility(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		defaultVisibility []string
+		want              map[string][]string
+	}{
+		// The library of a command is always private. Other rules are public,
+		// and their visibility is left out when it's the default.
+		{
+			defaultVisibility: []string{"//visibility:public"},
+			want: map[string][]string{
+				"go_library": {"//visibility:private"},
+			},
+		}, {
+			defaultVisibility: []string{"//bin:__subpackages__"},
+			want: map[string][]string{
+				"go_library": {"//visibility:private"},
+				"go_binary":  {"//visibility:public"},
+			},
+		},
+	} {
+		dir := &packages.Dir{
+			Path:              filepath.Join(repoRoot, "bin"),
+			Rel:               "bin",
+			DefaultVisibility: tc.defaultVisibility,
+		}
+		dir.Package, _ = packageFromDir(c, dir.Path)
+
+		got := make(map[string][]string)
+		for _, r := range goLang.GenerateRules(c, goLang, dir) {
+			kind := r.Call.X.(*bf.LiteralExpr).Token
+			for _, arg := range r.Call.List {
+				kv, ok := arg.(*bf.BinaryExpr)
+				if !ok || kv.X.(*bf.LiteralExpr).Token != "visibility" {
+					continue
+				}
+				for _, e := range kv.Y.(*bf.ListExpr).List {
+					got[kind] = append(got[kind], e.(*bf.StringExpr).Value)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("with default_visibility %v, got visibility %v; want %v", tc.defaultVisibility, got, tc.want)
+		}
+	}
+}
+
+func TestGeneratorImportMap(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		rel, want string
+	}{
+		{"lib", ""},
+		{"vendor/golang.org/x/lib", "example.com/repo/vendor/golang.org/x/lib"},
+		{"tools/vendor/golang.org/x/lib", "example.com/repo/tools/vendor/golang.org/x/lib"},
+		{"vendored/lib", ""},
+	} {
+		dir := &packages.Dir{
+			Path: filepath.Join(repoRoot, "lib"),
+			Rel:  tc.rel,
+			Package: &packages.Package{
+				Name:    "lib",
+				Dir:     filepath.Join(repoRoot, "lib"),
+				Rel:     tc.rel,
+				Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"lib.go"}}},
+				Test:    packages.Target{Sources: packages.PlatformStrings{Generic: []string{"lib_test.go"}}},
+			},
+		}
+
+		got := make(map[string]string)
+		for _, r := range goLang.GenerateRules(c, goLang, dir) {
+			kind := r.Call.X.(*bf.LiteralExpr).Token
+			for _, arg := range r.Call.List {
+				kv := arg.(*bf.BinaryExpr)
+				if kv.X.(*bf.LiteralExpr).Token == "importmap" {
+					got[kind] = kv.Y.(*bf.StringExpr).Value
+				}
+			}
+		}
+		want := map[string]string{}
+		if tc.want != "" {
+			want["go_library"] = tc.want
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got importmap %v; want %v", tc.rel, got, want)
+		}
+	}
+}
+
+func TestGeneratorData(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		Package: &packages.Package{
+			Name: "foo",
+			Dir:  filepath.Join(repoRoot, "foo"),
+			Rel:  "foo",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"foo.go"}},
+				Data:    packages.PlatformStrings{Generic: []string{"version.txt"}},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"foo_test.go"}},
+				Data:    packages.PlatformStrings{Generic: []string{"testdata/golden.txt"}},
+			},
+			XTest: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"foo_x_test.go"}},
+				Data:    packages.PlatformStrings{Generic: []string{"static/index.html"}},
+			},
+			HasTestdata: true,
+		},
+	}
+
+	got := make(map[string]string)
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		name := ""
+		var data bf.Expr
+		for _, arg := range r.Call.List {
+			kv := arg.(*bf.BinaryExpr)
+			switch kv.X.(*bf.LiteralExpr).Token {
+			case "name":
+				name = kv.Y.(*bf.StringExpr).Value
+			case "data":
+				data = kv.Y
+			}
+		}
+		switch data.(type) {
+		case *bf.ListExpr:
+			got[name] = "list"
+		case *bf.CallExpr:
+			got[name] = "glob"
+		case *bf.BinaryExpr:
+			got[name] = "list + glob"
+		}
+	}
+	want := map[string]string{
+		"go_default_library": "list",
+		"go_default_test":    "glob",
+		"go_default_xtest":   "list + glob",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got data %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorEmbedData(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		Package: &packages.Package{
+			Name: "foo",
+			Dir:  filepath.Join(repoRoot, "foo"),
+			Rel:  "foo",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"foo.go", "web_static_data.go"}},
+			},
+		},
+		AssetDirs: []packages.AssetDir{{Dir: "web/static", Var: "Static"}},
+	}
+
+	var kinds []string
+	got := make(map[string]string)
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		kind := r.Call.X.(*bf.LiteralExpr).Token
+		kinds = append(kinds, kind)
+		if kind != "go_embed_data" {
+			continue
+		}
+		for _, arg := range r.Call.List {
+			kv := arg.(*bf.BinaryExpr)
+			key := kv.X.(*bf.LiteralExpr).Token
+			switch v := kv.Y.(type) {
+			case *bf.StringExpr:
+				got[key] = v.Value
+			case *bf.CallExpr:
+				got[key] = v.X.(*bf.LiteralExpr).Token
+			}
+		}
+	}
+	if want := []string{"go_embed_data", "go_library"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got rules %v; want %v", kinds, want)
+	}
+	want := map[string]string{
+		"name":    "web_static_data",
+		"srcs":    "glob",
+		"out":     "web_static_data.go",
+		"package": "foo",
+		"var":     "Static",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got attributes %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorPlatformDeps(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		Package: &packages.Package{
+			Name: "foo",
+			Dir:  filepath.Join(repoRoot, "foo"),
+			Rel:  "foo",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{Generic: []string{"foo.go"}},
+				Imports: packages.PlatformStrings{
+					Generic: []string{"example.com/repo/lib"},
+					Platform: map[string][]string{
+						"linux_amd64":  {"example.com/repo/lib", "example.com/repo/platforms", "example.com/repo/missing"},
+						"linux_arm":    {"example.com/repo/missing", "example.com/repo/missing"},
+						"darwin_amd64": {"golang.org/x/sys/unix"},
+					},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	rs := goLang.GenerateRules(c, goLang, dir)
+
+	got := make(map[string][]string)
+	for _, r := range rs {
+		for _, arg := range r.Call.List {
+			kv := arg.(*bf.BinaryExpr)
+			if kv.X.(*bf.LiteralExpr).Token != "deps" {
+				continue
+			}
+			var lists []bf.Expr
+			if concat, ok := kv.Y.(*bf.BinaryExpr); ok {
+				lists = []bf.Expr{concat.X, concat.Y}
+			} else {
+				lists = []bf.Expr{kv.Y}
+			}
+			for _, e := range lists {
+				switch e := e.(type) {
+				case *bf.ListExpr:
+					for _, dep := range e.List {
+						got[""] = append(got[""], dep.(*bf.StringExpr).Value)
+					}
+				case *bf.CallExpr:
+					for _, entry := range e.List[0].(*bf.DictExpr).List {
+						kv := entry.(*bf.KeyValueExpr)
+						key := kv.Key.(*bf.StringExpr).Value
+						for _, dep := range kv.Value.(*bf.ListExpr).List {
+							got[key] = append(got[key], dep.(*bf.StringExpr).Value)
+						}
+					}
+				}
+			}
+		}
+	}
+	want := map[string][]string{
+		"":             {"//lib:go_default_library"},
+		"darwin_amd64": {"@org_golang_x_sys//unix:go_default_library"},
+		"linux_amd64":  {"//missing:go_default_library", "//platforms:go_default_library"},
+		"linux_arm":    {"//missing:go_default_library"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got deps %v; want %v", got, want)
+	}
+	if msg := buf.String(); strings.Count(msg, "example.com/repo/missing") != 1 || !strings.Contains(msg, "needed on linux_amd64, linux_arm") {
+		t.Errorf("got log output %q; want one error for example.com/repo/missing naming linux_amd64 and linux_arm", msg)
+	}
+}
+
+func TestGeneratorPlatformSelects(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	linuxAMD64 := config.Platform{OS: "linux", Arch: "amd64"}.Label()
+	linuxARM64 := config.Platform{OS: "linux", Arch: "arm64"}.Label()
+	darwinAMD64 := config.Platform{OS: "darwin", Arch: "amd64"}.Label()
+	windowsAMD64 := config.Platform{OS: "windows", Arch: "amd64"}.Label()
+	c.Platforms = config.PlatformTags{
+		linuxAMD64:   {"linux": true, "amd64": true},
+		linuxARM64:   {"linux": true, "arm64": true},
+		darwinAMD64:  {"darwin": true, "amd64": true},
+		windowsAMD64: {"windows": true, "amd64": true},
+	}
+	c.SelectSummaryThreshold = 3
+	c.CollapseOSSelects = true
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		Package: &packages.Package{
+			Name: "foo",
+			Dir:  filepath.Join(repoRoot, "foo"),
+			Rel:  "foo",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"foo.go"},
+					Platform: map[string][]string{
+						linuxAMD64:  {"foo_linux.go", "foo_unix.go"},
+						linuxARM64:  {"foo_linux.go", "foo_linux_arm64.go", "foo_unix.go"},
+						darwinAMD64: {"foo_unix.go"},
+					},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Platform: map[string][]string{
+						linuxAMD64: {"foo_linux_test.go"},
+						linuxARM64: {"foo_linux_test.go"},
+					},
+				},
+			},
+		},
+	}
+
+	gotKeys := make(map[string][]string)
+	gotComments := make(map[string][]string)
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		kind := r.Call.X.(*bf.LiteralExpr).Token
+		for _, com := range r.Call.Comment().Suffix {
+			gotComments[kind] = append(gotComments[kind], com.Token)
+		}
+		for _, arg := range r.Call.List {
+			kv := arg.(*bf.BinaryExpr)
+			if kv.X.(*bf.LiteralExpr).Token != "srcs" {
+				continue
+			}
+			var sels []bf.Expr
+			e := kv.Y
+			for {
+				b, ok := e.(*bf.BinaryExpr)
+				if !ok {
+					sels = append([]bf.Expr{e}, sels...)
+					break
+				}
+				sels = append([]bf.Expr{b.Y}, sels...)
+				e = b.X
+			}
+			for _, sel := range sels {
+				call, ok := sel.(*bf.CallExpr)
+				if !ok {
+					continue
+				}
+				for _, e := range call.List[0].(*bf.DictExpr).List {
+					gotKeys[kind] = append(gotKeys[kind], e.(*bf.KeyValueExpr).Key.(*bf.StringExpr).Value)
+				}
+			}
+		}
+	}
+	wantKeys := map[string][]string{
+		"go_library": {
+			config.Platform{OS: "darwin"}.Label(),
+			config.Platform{OS: "linux"}.Label(),
+			"//conditions:default",
+			linuxARM64,
+			"//conditions:default",
+		},
+		"go_test": {
+			config.Platform{OS: "linux"}.Label(),
+			"//conditions:default",
+		},
+	}
+	if !reflect.DeepEqual(gotKeys, wantKeys) {
+		t.Errorf("got select keys %v; want %v", gotKeys, wantKeys)
+	}
+	wantComments := map[string][]string{
+		"go_library": {"# gazelle:platforms srcs 3 platforms x 3 files"},
+	}
+	if !reflect.DeepEqual(gotComments, wantComments) {
+		t.Errorf("got comments %v; want %v", gotComments, wantComments)
+	}
+}
+
+func TestGeneratorMaxSelectBranches(t *testing.T) {
+	repoRoot, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "max_select_branches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoRoot)
+	if err := os.Mkdir(filepath.Join(repoRoot, "foo"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"foo.go", "foo_linux.go", "foo_darwin.go", "foo_windows.go", "foo_amd64.s", "foo_test.go", "foo_linux_test.go", "mkerrors.go", "README"} {
+		if err := ioutil.WriteFile(filepath.Join(repoRoot, "foo", name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := testConfig(repoRoot, "example.com/repo")
+	linuxAMD64 := config.Platform{OS: "linux", Arch: "amd64"}.Label()
+	darwinAMD64 := config.Platform{OS: "darwin", Arch: "amd64"}.Label()
+	windowsAMD64 := config.Platform{OS: "windows", Arch: "amd64"}.Label()
+	c.Platforms = config.PlatformTags{
+		linuxAMD64:   {"linux": true, "amd64": true},
+		darwinAMD64:  {"darwin": true, "amd64": true},
+		windowsAMD64: {"windows": true, "amd64": true},
+	}
+	c.MaxSelectBranches = 2
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		Package: &packages.Package{
+			Name: "foo",
+			Dir:  filepath.Join(repoRoot, "foo"),
+			Rel:  "foo",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"foo.go"},
+					Platform: map[string][]string{
+						linuxAMD64:   {"foo_amd64.s", "foo_linux.go"},
+						darwinAMD64:  {"foo_amd64.s", "foo_darwin.go"},
+						windowsAMD64: {"foo_amd64.s", "foo_windows.go"},
+					},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic:  []string{"foo_test.go"},
+					Platform: map[string][]string{linuxAMD64: {"foo_linux_test.go"}},
+				},
+			},
+		},
+	}
+
+	got := make(map[string]string)
+	for _, r := range goLang.GenerateRules(c, goLang, dir) {
+		kind := r.Call.X.(*bf.LiteralExpr).Token
+		for _, arg := range r.Call.List {
+			kv := arg.(*bf.BinaryExpr)
+			if kv.X.(*bf.LiteralExpr).Token != "srcs" {
+				continue
+			}
+			call, ok := kv.Y.(*bf.CallExpr)
+			if !ok || call.X.(*bf.LiteralExpr).Token != "glob" {
+				got[kind] = "no glob"
+				continue
+			}
+			var parts []string
+			for _, e := range call.List {
+				if b, ok := e.(*bf.BinaryExpr); ok {
+					parts = append(parts, "exclude")
+					e = b.Y
+				}
+				for _, s := range e.(*bf.ListExpr).List {
+					parts = append(parts, s.(*bf.StringExpr).Value)
+				}
+			}
+			got[kind] = strings.Join(parts, " ")
+		}
+	}
+	want := map[string]string{
+		"go_library": "*.go *.s exclude *_test.go mkerrors.go",
+		"go_test":    "no glob",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got srcs %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorTestFuncs(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	dir := &packages.Dir{
+		Path: filepath.Join(repoRoot, "foo"),
+		Rel:  "foo",
+		MapKinds: map[string]packages.MappedKind{
+			"go_fuzz_test": {FromKind: "go_fuzz_test", KindName: "fuzz_test", KindLoad: "@fuzz//:def.bzl"},
+		},
+		Package: &packages.Package{
+			Name:    "foo",
+			Dir:     filepath.Join(repoRoot, "foo"),
+			Rel:     "foo",
+			Library: packages.Target{Sources: packages.PlatformStrings{Generic: []string{"foo.go"}}},
+			Test: packages.Target{
+				Sources:   packages.PlatformStrings{Generic: []string{"bench_test.go"}},
+				TestFuncs: packages.TestFuncs{Benchmarks: true},
+			},
+			XTest: packages.Target{
+				Sources:   packages.PlatformStrings{Generic: []string{"fuzz_test.go"}},
+				TestFuncs: packages.TestFuncs{Tests: true, Fuzz: true},
+			},
+		},
+	}
+	rs := goLang.GenerateRules(c, goLang, dir)
+	rules.MapKinds(rs, dir.MapKinds)
+
+	type ruleInfo struct {
+		kind string
+		tags bool
+	}
+	var got []ruleInfo
+	for _, r := range rs {
+		info := ruleInfo{kind: r.Call.X.(*bf.LiteralExpr).Token}
+		for _, arg := range r.Call.List {
+			if arg.(*bf.BinaryExpr).X.(*bf.LiteralExpr).Token == "tags" {
+				info.tags = true
+			}
+		}
+		got = append(got, info)
+	}
+	want := []ruleInfo{{"go_library", false}, {"go_test", true}, {"go_test", false}, {"fuzz_test", false}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got rules %v; want %v", got, want)
+	}
+}
+
 func findGoPrefix(f *bf.File) string {
 	for _, s := range f.Stmt {
 		c, ok := s.(*bf.CallExpr)
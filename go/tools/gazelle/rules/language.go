@@ -0,0 +1,211 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/merger"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/schema"
+)
+
+// Language generates rules for source files written in one language.
+// Gazelle generates rules for all registered languages from a single walk
+// of the repository, and it merges rules from all languages into one build
+// file per directory.
+type Language interface {
+	// Name returns a short, unique name for the language, like "go".
+	Name() string
+
+	// Kinds describes each kind of rule generated by the language: the
+	// .bzl file it's loaded from, its mergeable attributes, and defaults.
+	// Kinds are added to the schema table when the language is registered.
+	Kinds() []schema.Kind
+
+	// RegisterFlags registers command line flags used to configure the
+	// language. Flag names should be prefixed with the language name to
+	// avoid conflicts.
+	RegisterFlags(fs *flag.FlagSet)
+
+	// Configure is called once after flags are parsed and before any rules
+	// are generated. It returns an error if flags are invalid.
+	Configure(c *config.Config) error
+
+	// Resolve converts an import string found in a source file in the
+	// directory rel into a label. Language implements
+	// resolve.LabelResolver, so a Language is normally passed as the
+	// resolver to its own GenerateRules method.
+	Resolve(imp, rel string) (resolve.Label, error)
+
+	// GenerateRules returns rules for files in dir. Imports should be
+	// converted to labels with r. GenerateRules may be called concurrently
+	// for different directories.
+	GenerateRules(c *config.Config, r resolve.LabelResolver, dir *packages.Dir) []*bf.Rule
+}
+
+// languages is the list of registered languages. Go is always first.
+var languages = []Language{&goLanguage{}}
+
+// RegisterLanguage adds l to the list of languages Gazelle generates rules
+// for. It should be called from an init function in a package linked into
+// the gazelle binary. The language's kinds are registered with
+// schema.Register. RegisterLanguage panics if a language with the same name
+// is already registered.
+func RegisterLanguage(l Language) {
+	for _, other := range languages {
+		if other.Name() == l.Name() {
+			panic(fmt.Sprintf("language %q registered twice", l.Name()))
+		}
+	}
+	for _, k := range l.Kinds() {
+		schema.Register(k)
+	}
+	languages = append(languages, l)
+}
+
+// Languages returns the registered languages in the order they were
+// registered. The returned slice must not be modified.
+func Languages() []Language {
+	return languages
+}
+
+// NewFile returns a syntax tree for a build file in dir containing rs. rs
+// should be rules generated by langs. Load statements are added for each kind
+// of rule in rs, grouped by .bzl file in the order of langs. Rules are
+// annotated if c.Annotation is set, and marked as owned by Gazelle if
+// c.OwnedRulesOnly is set.
+func NewFile(c *config.Config, dir string, langs []Language, rs []*bf.Rule) *bf.File {
+	f := &bf.File{
+		Path: c.NewBuildFilePath(dir),
+	}
+	f.Stmt = append(f.Stmt, generateLoads(langs, rs)...)
+	for _, r := range rs {
+		if c.Annotation != "" {
+			r.Call.Comment().Suffix = append(r.Call.Comment().Suffix, bf.Comment{
+				Token:  merger.AnnotationPrefix + " " + c.Annotation,
+				Suffix: true,
+			})
+		} else if c.OwnedRulesOnly {
+			r.Call.Comment().Suffix = append(r.Call.Comment().Suffix, bf.Comment{
+				Token:  merger.AnnotationPrefix,
+				Suffix: true,
+			})
+		}
+		f.Stmt = append(f.Stmt, r.Call)
+	}
+	return f
+}
+
+// MapKinds replaces the kinds of rules in rs that are mapped to other kinds
+// by "# gazelle:map_kind" directives. See packages.Dir.MapKinds. Each kind
+// that's used is registered with schema.Register, so it's loaded from the
+// file named in the directive and merged like the kind it replaces.
+func MapKinds(rs []*bf.Rule, mapKinds map[string]packages.MappedKind) {
+	for _, r := range rs {
+		m, ok := mapKinds[r.Kind()]
+		if !ok {
+			continue
+		}
+		k, ok := schema.Lookup(m.FromKind)
+		if !ok && m.FromKind == fuzzTestKind {
+			k, ok = schema.Lookup("go_test")
+		}
+		if !ok {
+			k = schema.Kind{}
+		}
+		k.Name = m.KindName
+		k.Load = m.KindLoad
+		schema.Register(k)
+		r.Call.X = &bf.LiteralExpr{Token: m.KindName}
+	}
+}
+
+// generateLoads returns load statements for the kinds of rules in rs. There
+// is one statement for each .bzl file, and symbols are sorted within each
+// statement. Kinds not described by any language in langs are loaded from
+// the file in their schema entry, if there is one. Kinds with no .bzl file,
+// like filegroup, are not loaded.
+func generateLoads(langs []Language, rs []*bf.Rule) []bf.Expr {
+	used := make(map[string]bool)
+	for _, r := range rs {
+		used[r.Kind()] = true
+	}
+
+	var files []string
+	kindsByFile := make(map[string][]string)
+	for _, l := range langs {
+		langKinds := l.Kinds()
+		loadByKind := make(map[string]string)
+		kinds := make([]string, 0, len(langKinds))
+		for _, k := range langKinds {
+			if k.Load == "" {
+				continue
+			}
+			loadByKind[k.Name] = k.Load
+			kinds = append(kinds, k.Name)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			if !used[kind] {
+				continue
+			}
+			file := loadByKind[kind]
+			if _, ok := kindsByFile[file]; !ok {
+				files = append(files, file)
+			}
+			kindsByFile[file] = append(kindsByFile[file], kind)
+			delete(used, kind)
+		}
+	}
+	var others []string
+	for kind := range used {
+		others = append(others, kind)
+	}
+	sort.Strings(others)
+	for _, kind := range others {
+		k, ok := schema.Lookup(kind)
+		if !ok || k.Load == "" {
+			continue
+		}
+		if _, ok := kindsByFile[k.Load]; !ok {
+			files = append(files, k.Load)
+		}
+		kindsByFile[k.Load] = append(kindsByFile[k.Load], kind)
+	}
+
+	var loads []bf.Expr
+	for _, file := range files {
+		kinds := kindsByFile[file]
+		sort.Strings(kinds)
+		args := make([]bf.Expr, 0, len(kinds)+1)
+		args = append(args, &bf.StringExpr{Value: file})
+		for _, k := range kinds {
+			args = append(args, &bf.StringExpr{Value: k})
+		}
+		loads = append(loads, &bf.CallExpr{
+			X:            &bf.LiteralExpr{Token: "load"},
+			List:         args,
+			ForceCompact: true,
+		})
+	}
+	return loads
+}
@@ -0,0 +1,127 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules_test
+
+import (
+	"flag"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/rules"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/schema"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/testdata"
+)
+
+// fakeLanguage generates a fake_library rule for each directory containing
+// .fake files.
+type fakeLanguage struct{}
+
+func (fakeLanguage) Name() string { return "fake" }
+
+func (fakeLanguage) Kinds() []schema.Kind {
+	return []schema.Kind{{
+		Name:           "fake_library",
+		Load:           "@fake//:def.bzl",
+		MergeableAttrs: map[string]bool{"srcs": true},
+	}}
+}
+
+func (fakeLanguage) RegisterFlags(fs *flag.FlagSet) {}
+
+func (fakeLanguage) Configure(c *config.Config) error { return nil }
+
+func (fakeLanguage) Resolve(imp, rel string) (resolve.Label, error) {
+	return resolve.Label{Pkg: rel, Name: imp}, nil
+}
+
+func (fakeLanguage) GenerateRules(c *config.Config, r resolve.LabelResolver, dir *packages.Dir) []*bf.Rule {
+	var srcs []string
+	for _, f := range dir.Files {
+		if strings.HasSuffix(f, ".fake") {
+			srcs = append(srcs, f)
+		}
+	}
+	if len(srcs) == 0 {
+		return nil
+	}
+	return []*bf.Rule{rules.NewRule("fake_library", nil, []rules.KeyValue{
+		{Key: "name", Value: "fake"},
+		{Key: "srcs", Value: srcs},
+	})}
+}
+
+func TestLanguagesGoFirst(t *testing.T) {
+	langs := rules.Languages()
+	if len(langs) == 0 || langs[0].Name() != "go" {
+		t.Errorf("got %d languages; want go first", len(langs))
+	}
+}
+
+func TestNewFileLoads(t *testing.T) {
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	c := testConfig(repoRoot, "example.com/repo")
+	goLang := rules.Languages()[0]
+	if err := goLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	langs := []rules.Language{goLang, fakeLanguage{}}
+
+	dir := &packages.Dir{
+		Path:  filepath.Join(repoRoot, "lib"),
+		Rel:   "lib",
+		Files: []string{"a.fake", "b.fake"},
+	}
+	dir.Package, _ = packageFromDir(c, dir.Path)
+	var rs []*bf.Rule
+	for _, l := range langs {
+		rs = append(rs, l.GenerateRules(c, l, dir)...)
+	}
+	f := rules.NewFile(c, dir.Path, langs, rs)
+
+	var gotLoads [][]string
+	var gotKinds []string
+	for _, s := range f.Stmt {
+		call := s.(*bf.CallExpr)
+		kind := call.X.(*bf.LiteralExpr).Token
+		if kind != "load" {
+			gotKinds = append(gotKinds, kind)
+			continue
+		}
+		var args []string
+		for _, arg := range call.List {
+			args = append(args, arg.(*bf.StringExpr).Value)
+		}
+		gotLoads = append(gotLoads, args)
+	}
+
+	wantLoads := [][]string{
+		{"@io_bazel_rules_go//go:def.bzl", "go_library", "go_test"},
+		{"@fake//:def.bzl", "fake_library"},
+	}
+	if !reflect.DeepEqual(gotLoads, wantLoads) {
+		t.Errorf("got loads %q; want %q", gotLoads, wantLoads)
+	}
+	wantKinds := []string{"go_library", "go_test", "go_test", "fake_library"}
+	if !reflect.DeepEqual(gotKinds, wantKinds) {
+		t.Errorf("got rule kinds %q; want %q", gotKinds, wantKinds)
+	}
+}
@@ -0,0 +1,241 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/logging"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/schema"
+)
+
+func init() {
+	RegisterLanguage(&protoLanguage{})
+}
+
+// protoLanguage exports .proto files that are imported by .proto files in
+// other directories, so rules in other packages may refer to them. Proto
+// import paths are interpreted relative to the repository root, which is
+// how proto_library finds imports without strip_import_prefix.
+type protoLanguage struct {
+	// exported is the set of slash-separated paths, relative to the
+	// repository root, of .proto files imported from other directories.
+	// It's built by Configure and only read afterward.
+	exported map[string]bool
+}
+
+func (l *protoLanguage) Name() string { return "proto" }
+
+func (l *protoLanguage) Kinds() []schema.Kind {
+	return []schema.Kind{{
+		Name:           "exports_files",
+		MergeableAttrs: map[string]bool{"srcs": true},
+	}}
+}
+
+func (l *protoLanguage) RegisterFlags(fs *flag.FlagSet) {}
+
+// Configure scans .proto files in the whole repository for imports. Files
+// are imported across directories, so the directories Gazelle is updating
+// aren't enough. Nothing is scanned in DisableProtoMode.
+func (l *protoLanguage) Configure(c *config.Config) error {
+	if c.ProtoMode == config.DisableProtoMode {
+		return nil
+	}
+	exported, err := findExportedProtos(c)
+	if err != nil {
+		return err
+	}
+	l.exported = exported
+	return nil
+}
+
+func (l *protoLanguage) Resolve(imp, rel string) (resolve.Label, error) {
+	return resolve.Label{}, fmt.Errorf("proto imports are not resolved to labels: %q", imp)
+}
+
+// GenerateRules generates an exports_files rule listing the .proto files in
+// dir that are imported from other directories. srcs is written as a
+// keyword argument, so the rule can be merged with an existing one. If the
+// existing build file already has an exports_files rule with unnamed
+// arguments, no rule is generated, since it couldn't be merged.
+func (l *protoLanguage) GenerateRules(c *config.Config, r resolve.LabelResolver, dir *packages.Dir) []*bf.Rule {
+	if c.ProtoMode == config.DisableProtoMode {
+		return nil
+	}
+	var srcs []string
+	for _, f := range dir.Files {
+		if strings.HasSuffix(f, ".proto") && l.exported[path.Join(dir.Rel, f)] {
+			srcs = append(srcs, f)
+		}
+	}
+	if len(srcs) == 0 || hasPositionalExportsFiles(dir.File) {
+		return nil
+	}
+	return []*bf.Rule{NewRule("exports_files", nil, []KeyValue{
+		{Key: "srcs", Value: srcs},
+	})}
+}
+
+// hasPositionalExportsFiles returns whether f contains an exports_files
+// rule with unnamed arguments. f may be nil.
+func hasPositionalExportsFiles(f *bf.File) bool {
+	if f == nil {
+		return false
+	}
+	for _, r := range f.Rules("exports_files") {
+		for _, arg := range r.Call.List {
+			if _, ok := arg.(*bf.BinaryExpr); !ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// protoImportRe matches import statements in .proto files and captures the
+// imported path.
+var protoImportRe = regexp.MustCompile(`^\s*import\s+(?:public\s+|weak\s+)?"([^"]+)"\s*;`)
+
+// findExportedProtos returns the set of .proto files in the repository
+// that are imported by .proto files in other directories. Paths are
+// slash-separated and relative to c.RepoRoot. Hidden directories, those
+// starting with "_", and excluded paths are skipped.
+func findExportedProtos(c *config.Config) (map[string]bool, error) {
+	exported := make(map[string]bool)
+	err := filepath.Walk(c.RepoRoot, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			logging.Warning(err)
+			return nil
+		}
+		rel, err := filepath.Rel(c.RepoRoot, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			base := fi.Name()
+			if rel != "." && (base[0] == '.' || base[0] == '_' || c.IsExcludedPath(rel)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(p, ".proto") {
+			return nil
+		}
+		info, err := readProtoFile(p)
+		if err != nil {
+			logging.Warning(err)
+			return nil
+		}
+		for _, imp := range info.imports {
+			if path.Dir(imp) != path.Dir(rel) {
+				exported[imp] = true
+			}
+		}
+		return nil
+	})
+	return exported, err
+}
+
+// protoServiceRe matches service definitions in .proto files.
+var protoServiceRe = regexp.MustCompile(`^\s*service\s+\w+`)
+
+// protoFileInfo describes a .proto file.
+type protoFileInfo struct {
+	// imports are the paths imported by the file.
+	imports []string
+
+	// hasServices is true if the file defines any services.
+	hasServices bool
+}
+
+// readProtoFile reads the .proto file at p.
+func readProtoFile(p string) (protoFileInfo, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return protoFileInfo{}, err
+	}
+	defer f.Close()
+
+	var info protoFileInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := protoImportRe.FindStringSubmatch(line); m != nil {
+			info.imports = append(info.imports, path.Clean(m[1]))
+		} else if protoServiceRe.MatchString(line) {
+			info.hasServices = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return protoFileInfo{}, err
+	}
+	return info, nil
+}
+
+// protoFiles returns the names of the .proto files in files.
+func protoFiles(files []string) []string {
+	var protos []string
+	for _, f := range files {
+		if strings.HasSuffix(f, ".proto") {
+			protos = append(protos, f)
+		}
+	}
+	return protos
+}
+
+// wellKnownProtoLabels maps well-known .proto files to the Go libraries
+// generated from them in github.com/golang/protobuf.
+var wellKnownProtoLabels = map[string]string{
+	"google/protobuf/any.proto":        "@com_github_golang_protobuf//ptypes/any:go_default_library",
+	"google/protobuf/descriptor.proto": "@com_github_golang_protobuf//protoc-gen-go/descriptor:go_default_library",
+	"google/protobuf/duration.proto":   "@com_github_golang_protobuf//ptypes/duration:go_default_library",
+	"google/protobuf/empty.proto":      "@com_github_golang_protobuf//ptypes/empty:go_default_library",
+	"google/protobuf/struct.proto":     "@com_github_golang_protobuf//ptypes/struct:go_default_library",
+	"google/protobuf/timestamp.proto":  "@com_github_golang_protobuf//ptypes/timestamp:go_default_library",
+	"google/protobuf/wrappers.proto":   "@com_github_golang_protobuf//ptypes/wrappers:go_default_library",
+}
+
+// protoImportLabel returns the label a go_proto_library in the directory
+// rel needs in deps to import imp, a path relative to the repository root.
+// false is returned for files in rel itself, since they're in the same
+// rule, and for other files in google/protobuf, which go_proto_library
+// provides itself.
+func protoImportLabel(imp, rel string) (string, bool) {
+	if l, ok := wellKnownProtoLabels[imp]; ok {
+		return l, true
+	}
+	dir := path.Dir(imp)
+	if dir == "." {
+		dir = ""
+	}
+	if dir == rel || strings.HasPrefix(imp, "google/protobuf/") {
+		return "", false
+	}
+	return resolve.Label{Pkg: dir, Name: resolve.DefaultLibName}.String(), true
+}
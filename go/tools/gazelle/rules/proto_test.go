@@ -0,0 +1,208 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/rules"
+)
+
+func TestProtoExportsFiles(t *testing.T) {
+	repoRoot, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "proto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoRoot)
+	files := map[string]string{
+		"api/service.proto": `syntax = "proto3";
+import "api/types.proto";
+import public "common/time.proto";
+  import weak "common/money.proto" ;
+`,
+		"api/types.proto":     `syntax = "proto3";`,
+		"common/time.proto":   `syntax = "proto3";`,
+		"common/money.proto":  `syntax = "proto3";`,
+		"common/unused.proto": `syntax = "proto3";`,
+		"_skipped/x.proto":    `import "common/unused.proto";`,
+	}
+	for name, content := range files {
+		p := filepath.Join(repoRoot, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := testConfig(repoRoot, "example.com/repo")
+	var protoLang rules.Language
+	for _, l := range rules.Languages() {
+		if l.Name() == "proto" {
+			protoLang = l
+		}
+	}
+	if protoLang == nil {
+		t.Fatal("proto language not registered")
+	}
+	if err := protoLang.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		rel   string
+		files []string
+		want  []string
+	}{
+		{"api", []string{"service.proto", "types.proto"}, nil},
+		{"common", []string{"money.proto", "time.proto", "unused.proto"}, []string{"money.proto", "time.proto"}},
+	} {
+		dir := &packages.Dir{
+			Path:  filepath.Join(repoRoot, tc.rel),
+			Rel:   tc.rel,
+			Files: tc.files,
+		}
+		var got []string
+		for _, r := range protoLang.GenerateRules(c, protoLang, dir) {
+			if kind := r.Call.X.(*bf.LiteralExpr).Token; kind != "exports_files" {
+				t.Errorf("in %s, got rule of kind %s; want exports_files", tc.rel, kind)
+				continue
+			}
+			srcs := r.Call.List[0].(*bf.BinaryExpr).Y.(*bf.ListExpr)
+			for _, e := range srcs.List {
+				got = append(got, e.(*bf.StringExpr).Value)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("in %s, got exported files %v; want %v", tc.rel, got, tc.want)
+		}
+	}
+}
+
+func TestGeneratorProtoMode(t *testing.T) {
+	repoRoot, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "proto_mode_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoRoot)
+	apiDir := filepath.Join(repoRoot, "api")
+	if err := os.MkdirAll(apiDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := `syntax = "proto3";
+import "api/types.proto";
+import "common/time.proto";
+import "google/protobuf/any.proto";
+import "google/protobuf/source_context.proto";
+
+service Greeter {
+  rpc Greet(Request) returns (Reply);
+}
+`
+	if err := ioutil.WriteFile(filepath.Join(apiDir, "service.proto"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newDir := func(libSrcs ...string) *packages.Dir {
+		return &packages.Dir{
+			Path:  apiDir,
+			Rel:   "api",
+			Files: append([]string{"service.proto"}, libSrcs...),
+			Package: &packages.Package{
+				Name:    "api",
+				Dir:     apiDir,
+				Rel:     "api",
+				Library: packages.Target{Sources: packages.PlatformStrings{Generic: libSrcs}},
+				Protos:  []string{"service.proto"},
+				HasPbGo: true,
+			},
+		}
+	}
+	for _, tc := range []struct {
+		desc string
+		mode config.ProtoMode
+		dir  *packages.Dir
+		want map[string]map[string]bool
+	}{
+		{
+			desc: "default",
+			mode: config.DefaultProtoMode,
+			dir:  newDir("service.pb.go"),
+			want: map[string]map[string]bool{"go_proto_library": {"srcs": true, "has_services": true, "visibility": true, "deps": true}},
+		}, {
+			desc: "default without Go",
+			mode: config.DefaultProtoMode,
+			dir:  &packages.Dir{Path: apiDir, Rel: "api", Files: []string{"service.proto"}},
+			want: map[string]map[string]bool{"go_proto_library": {"srcs": true, "has_services": true, "visibility": true, "deps": true}},
+		}, {
+			desc: "default with other Go",
+			mode: config.DefaultProtoMode,
+			dir:  newDir("extra.go", "service.pb.go"),
+			want: map[string]map[string]bool{"go_library": {"srcs": true, "visibility": true}, "filegroup": {"srcs": true, "visibility": true}},
+		}, {
+			desc: "legacy",
+			mode: config.LegacyProtoMode,
+			dir:  newDir("service.pb.go"),
+			want: map[string]map[string]bool{"go_library": {"srcs": true, "visibility": true}, "filegroup": {"srcs": true, "visibility": true}},
+		}, {
+			desc: "disable without Go",
+			mode: config.DisableProtoMode,
+			dir:  &packages.Dir{Path: apiDir, Rel: "api", Files: []string{"service.proto"}},
+			want: map[string]map[string]bool{},
+		},
+	} {
+		c := testConfig(repoRoot, "example.com/repo")
+		c.ProtoMode = tc.mode
+		goLang := rules.Languages()[0]
+		if err := goLang.Configure(c); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		got := make(map[string]map[string]bool)
+		for _, r := range goLang.GenerateRules(c, goLang, tc.dir) {
+			kind := r.Call.X.(*bf.LiteralExpr).Token
+			got[kind] = make(map[string]bool)
+			for _, arg := range r.Call.List {
+				kv := arg.(*bf.BinaryExpr)
+				key := kv.X.(*bf.LiteralExpr).Token
+				if key == "name" {
+					continue
+				}
+				got[kind][key] = true
+				if kind == "go_proto_library" && key == "deps" {
+					var deps []string
+					for _, e := range kv.Y.(*bf.ListExpr).List {
+						deps = append(deps, e.(*bf.StringExpr).Value)
+					}
+					wantDeps := []string{"//common:go_default_library", "@com_github_golang_protobuf//ptypes/any:go_default_library"}
+					if !reflect.DeepEqual(deps, wantDeps) {
+						t.Errorf("%s: got deps %v; want %v", tc.desc, deps, wantDeps)
+					}
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got rules %v; want %v", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+)
+
+// selectAttrs lists the attributes whose platform-specific values are
+// collapsed by OS and described in platform summaries, and the nouns used
+// for their values in summaries.
+var selectAttrs = []struct{ key, noun string }{
+	{"srcs", "files"},
+	{"deps", "labels"},
+}
+
+// isSelectAttr returns whether key is one of selectAttrs.
+func isSelectAttr(key string) bool {
+	for _, sa := range selectAttrs {
+		if sa.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePlatformLabel returns the platform named by a config_setting label in
+// PlatformLabelPrefix, like "@io_bazel_rules_go//go/platform:linux_amd64".
+// It returns false for other labels and for labels that don't name both an
+// OS and an architecture.
+func parsePlatformLabel(label string) (config.Platform, bool) {
+	if !strings.HasPrefix(label, config.PlatformLabelPrefix) {
+		return config.Platform{}, false
+	}
+	name := label[len(config.PlatformLabelPrefix):]
+	i := strings.LastIndex(name, "_")
+	if i <= 0 || i == len(name)-1 {
+		return config.Platform{}, false
+	}
+	return config.Platform{OS: name[:i], Arch: name[i+1:]}, true
+}
+
+// collapseOSPlatforms returns a copy of ps where strings used on every
+// platform in platforms with an operating system are moved from the
+// platform-specific lists to a list for the OS, keyed by a label like
+// "@io_bazel_rules_go//go/platform:linux". Strings used on only some of an
+// OS's platforms stay in the platform-specific lists. OS and platform lists
+// are converted to separate selects, so a linux-only file is listed once,
+// even if another file is only used on linux_arm64. There's no architecture
+// tier, since go/platform has no config_settings for architectures: each
+// setting matches one --cpu value, so one can't match an architecture on
+// every OS.
+func collapseOSPlatforms(ps packages.PlatformStrings, platforms config.PlatformTags) packages.PlatformStrings {
+	if len(ps.Platform) == 0 {
+		return ps
+	}
+	// Platforms are visited in sorted order, so the order of strings in an
+	// OS's list doesn't depend on map iteration order.
+	osLabels := make(map[string][]string)
+	var oses []string
+	for label := range platforms {
+		if p, ok := parsePlatformLabel(label); ok {
+			if _, ok := osLabels[p.OS]; !ok {
+				oses = append(oses, p.OS)
+			}
+			osLabels[p.OS] = append(osLabels[p.OS], label)
+		}
+	}
+	sort.Strings(oses)
+
+	collapsed := packages.PlatformStrings{
+		Generic:  ps.Generic,
+		OS:       make(map[string][]string),
+		Platform: make(map[string][]string),
+	}
+	for label, ss := range ps.OS {
+		collapsed.OS[label] = ss
+	}
+	for label, ss := range ps.Platform {
+		collapsed.Platform[label] = ss
+	}
+	for _, os := range oses {
+		labels := osLabels[os]
+		sort.Strings(labels)
+		common := ps.Platform[labels[0]]
+		for _, label := range labels[1:] {
+			common = intersectStrings(common, ps.Platform[label])
+		}
+		if len(common) == 0 {
+			continue
+		}
+		osLabel := config.Platform{OS: os}.Label()
+		collapsed.OS[osLabel] = append(collapsed.OS[osLabel], common...)
+		move := make(map[string]bool)
+		for _, s := range common {
+			move[s] = true
+		}
+		for _, label := range labels {
+			var rest []string
+			for _, s := range collapsed.Platform[label] {
+				if !move[s] {
+					rest = append(rest, s)
+				}
+			}
+			if len(rest) == 0 {
+				delete(collapsed.Platform, label)
+			} else {
+				collapsed.Platform[label] = rest
+			}
+		}
+	}
+	if len(collapsed.OS) == 0 {
+		collapsed.OS = nil
+	}
+	if len(collapsed.Platform) == 0 {
+		collapsed.Platform = nil
+	}
+	return collapsed
+}
+
+// intersectStrings returns the strings in a that are also in b, in the order
+// they appear in a.
+func intersectStrings(a, b []string) []string {
+	inB := make(map[string]bool)
+	for _, s := range b {
+		inB[s] = true
+	}
+	var r []string
+	for _, s := range a {
+		if inB[s] {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+// selectCases returns the number of cases, other than the default case, in
+// the selects ps is converted to.
+func selectCases(ps packages.PlatformStrings) int {
+	n := 0
+	for _, m := range ps.PlatformMaps() {
+		n += len(m)
+	}
+	return n
+}
+
+// platformSummary returns a description of the platform-specific values of
+// the attributes in selectAttrs, like "srcs 3 platforms x 12 files", if
+// any of them has at least threshold values across all its platforms.
+// Otherwise, it returns "". threshold must be positive.
+func platformSummary(attrs []KeyValue, threshold int) string {
+	var parts []string
+	large := false
+	for _, sa := range selectAttrs {
+		for _, kv := range attrs {
+			if kv.Key != sa.key {
+				continue
+			}
+			ps, ok := kv.Value.(packages.PlatformStrings)
+			if !ok || selectCases(ps) == 0 {
+				continue
+			}
+			total := 0
+			distinct := make(map[string]bool)
+			for _, m := range ps.PlatformMaps() {
+				for _, ss := range m {
+					total += len(ss)
+					for _, s := range ss {
+						distinct[s] = true
+					}
+				}
+			}
+			if total >= threshold {
+				large = true
+			}
+			parts = append(parts, fmt.Sprintf("%s %d platforms x %d %s", sa.key, selectCases(ps), len(distinct), sa.noun))
+		}
+	}
+	if !large {
+		return ""
+	}
+	return strings.Join(parts, ", ")
+}
+
+// globPlatformSources returns a glob that may replace the platform-specific
+// sources ps of a rule in dir, when a select would have too many cases. The
+// glob matches files in dir with the extensions of the sources, and
+// excludes those that aren't sources on any platform. Files for other
+// platforms are filtered out by build constraints when the rule is built.
+// Test files are excluded by pattern unless test is true. It returns false
+// if some sources aren't in dir, like generated files, or if dir can't be
+// read.
+func globPlatformSources(dir string, ps packages.PlatformStrings, test bool) (GlobValue, bool) {
+	srcs := make(map[string]bool)
+	for _, s := range ps.Generic {
+		srcs[s] = true
+	}
+	for _, m := range ps.PlatformMaps() {
+		for _, ss := range m {
+			for _, s := range ss {
+				srcs[s] = true
+			}
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return GlobValue{}, false
+	}
+	inDir := make(map[string]bool)
+	for _, f := range files {
+		if !f.IsDir() {
+			inDir[f.Name()] = true
+		}
+	}
+
+	var glob GlobValue
+	exts := make(map[string]bool)
+	for s := range srcs {
+		if !inDir[s] || path.Ext(s) == "" {
+			return GlobValue{}, false
+		}
+		exts[path.Ext(s)] = true
+	}
+	for ext := range exts {
+		glob.Patterns = append(glob.Patterns, "*"+ext)
+	}
+	sort.Strings(glob.Patterns)
+	if !test && exts[".go"] {
+		glob.Excludes = append(glob.Excludes, "*_test.go")
+	}
+	var excluded []string
+	for name := range inDir {
+		if srcs[name] || !exts[path.Ext(name)] || !test && strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		excluded = append(excluded, name)
+	}
+	sort.Strings(excluded)
+	glob.Excludes = append(glob.Excludes, excluded...)
+	return glob, true
+}
@@ -5,20 +5,12 @@ import (
 	"strings"
 
 	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/schema"
 )
 
-var (
-	goRuleKinds = map[string]bool{
-		"cgo_library": true,
-		"go_binary":   true,
-		"go_library":  true,
-		"go_test":     true,
-	}
-	sortedAttrs = []string{"srcs", "deps"}
-)
-
-// SortLabels sorts lists of strings in "srcs" and "deps" attributes of
-// Go rules using the same order as buildifier. Buildifier also sorts string
+// SortLabels sorts lists of strings in attributes listed in
+// schema.Kind.SortedAttrs, like "srcs" and "deps" in Go rules, using the
+// same order as buildifier. Buildifier also sorts string
 // lists, but not those involved with "select" expressions.
 // TODO(jayconrod): remove this when bazelbuild/buildtools#122 is fixed.
 func SortLabels(f *bf.File) {
@@ -28,10 +20,11 @@ func SortLabels(f *bf.File) {
 			continue
 		}
 		r := bf.Rule{c}
-		if !goRuleKinds[r.Kind()] {
+		k, ok := schema.Lookup(r.Kind())
+		if !ok {
 			continue
 		}
-		for _, key := range []string{"srcs", "deps"} {
+		for _, key := range k.SortedAttrs {
 			attr := r.AttrDefn(key)
 			if attr == nil {
 				continue
@@ -74,6 +67,11 @@ func sortExprLabels(e bf.Expr, _ []bf.Expr) {
 // beginning with "@". The next significant part of the comparison is the list
 // of elements in the value, where elements are split at `.' and `:'. Finally
 // we compare by value and break ties by original index.
+//
+// Elements and values are compared by bytes, which for UTF-8 strings is the
+// same as comparing by Unicode code point. Splitting is safe for non-ASCII
+// strings, since `.' and `:' never appear within multi-byte UTF-8 sequences.
+// Ties are always broken, so the order doesn't depend on the sort algorithm.
 type stringSortKey struct {
 	phase    int
 	split    []string
@@ -0,0 +1,83 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules_test
+
+import (
+	"testing"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/rules"
+)
+
+func TestSortLabelsNonASCII(t *testing.T) {
+	// Lists are sorted by code point, both inside and outside select
+	// expressions. Composed and decomposed forms of the same character are
+	// different strings. The second "é" below is "e" followed by U+0301.
+	old := `go_library(
+    name = "go_default_library",
+    srcs = [
+        "日本.go",
+        "z.go",
+        "é.go",
+        "é.go",
+        "a.go",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": [
+            "ü_linux.go",
+            "u_linux.go",
+        ],
+        "//conditions:default": [],
+    }),
+    deps = [
+        "//ünicode:go_default_library",
+        "//unicode:go_default_library",
+    ],
+)
+`
+	want := `go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "é.go",
+        "z.go",
+        "é.go",
+        "日本.go",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": [
+            "u_linux.go",
+            "ü_linux.go",
+        ],
+        "//conditions:default": [],
+    }),
+    deps = [
+        "//unicode:go_default_library",
+        "//ünicode:go_default_library",
+    ],
+)
+`
+	f, err := bf.Parse("BUILD", []byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// Sorting again, and formatting, must not change the order.
+		rules.SortLabels(f)
+		bf.Rewrite(f, nil)
+		if got := string(bf.Format(f)); got != want {
+			t.Errorf("iteration %d: got:\n%s\nwant:\n%s", i, got, want)
+		}
+	}
+}
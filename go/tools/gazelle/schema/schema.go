@@ -0,0 +1,223 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schema describes the kinds of rules Gazelle generates: where each
+// kind is loaded from, which attributes Gazelle manages, and the default
+// values of attributes. The generator, the merger, and the edit command all
+// consult the same table, so supporting a new kind of rule only requires a
+// new entry.
+package schema
+
+import "sync"
+
+// GoRulesBzl is the label of the Skylark file which provides Go rules.
+const GoRulesBzl = "@io_bazel_rules_go//go:def.bzl"
+
+// GoProtoBzl is the label of the Skylark file which provides
+// go_proto_library.
+const GoProtoBzl = "@io_bazel_rules_go//proto:go_proto_library.bzl"
+
+// Kind describes a kind of rule.
+type Kind struct {
+	// Name is the name of the rule kind, for example, "go_library".
+	Name string
+
+	// Load is the label of the .bzl file the kind is loaded from. It is
+	// empty for native rules like filegroup.
+	Load string
+
+	// MergeableAttrs is the set of attributes Gazelle regenerates when it
+	// merges rules. Values of these attributes in existing rules are
+	// discarded unless Gazelle generates them too or they are marked with a
+	// "# keep" comment. Other attributes are left alone.
+	MergeableAttrs map[string]bool
+
+	// ReplaceableAttrs is the set of attributes that are replaced by
+	// generated values when Gazelle generates them, unless the existing
+	// value is marked with a "# keep" comment. Unlike mergeable attributes,
+	// existing values are left alone when nothing is generated.
+	ReplaceableAttrs map[string]bool
+
+	// SortedAttrs lists attributes whose string lists are sorted the same
+	// way buildifier sorts them, including lists inside select expressions.
+	SortedAttrs []string
+
+	// OrderedAttrs is the set of mergeable attributes whose order is
+	// significant, like linker flags. When they're merged, values keep the
+	// generated order instead of the order in the existing rule.
+	OrderedAttrs map[string]bool
+
+	// Defaults maps attribute names to their default values. Attributes
+	// equal to their defaults are omitted from generated rules.
+	Defaults map[string]interface{}
+}
+
+// DefaultMergeableAttrs is the set of mergeable attributes for kinds with no
+// entry in the table.
+var DefaultMergeableAttrs = map[string]bool{
+	"srcs":      true,
+	"deps":      true,
+	"embed":     true,
+	"library":   true,
+	"copts":     true,
+	"clinkopts": true,
+}
+
+// DefaultOrderedAttrs is the set of ordered attributes for kinds with no
+// entry in the table.
+var DefaultOrderedAttrs = map[string]bool{
+	"copts":     true,
+	"clinkopts": true,
+}
+
+// CommonDefaults maps attributes common to all rules to their default
+// values. Defaults in a Kind take precedence.
+var CommonDefaults = map[string]interface{}{
+	"testonly": false,
+	"tags":     []string{},
+}
+
+var goDefaults = map[string]interface{}{
+	"cgo":         false,
+	"gc_goopts":   []string{},
+	"gc_linkopts": []string{},
+	"x_defs":      map[string]string{},
+}
+
+// GoKinds describes the kinds of rules generated for Go packages.
+var GoKinds = []Kind{
+	{
+		Name:           "cgo_library",
+		Load:           GoRulesBzl,
+		MergeableAttrs: DefaultMergeableAttrs,
+		SortedAttrs:    []string{"srcs", "deps"},
+		OrderedAttrs:   DefaultOrderedAttrs,
+		Defaults:       goDefaults,
+	}, {
+		Name:           "go_binary",
+		Load:           GoRulesBzl,
+		MergeableAttrs: DefaultMergeableAttrs,
+		SortedAttrs:    []string{"srcs", "deps"},
+		OrderedAttrs:   DefaultOrderedAttrs,
+		Defaults:       goDefaults,
+	}, {
+		Name:             "go_embed_data",
+		Load:             GoRulesBzl,
+		MergeableAttrs:   map[string]bool{"srcs": true},
+		ReplaceableAttrs: map[string]bool{"out": true, "package": true, "var": true},
+	}, {
+		Name:             "go_library",
+		Load:             GoRulesBzl,
+		MergeableAttrs:   DefaultMergeableAttrs,
+		ReplaceableAttrs: map[string]bool{"importmap": true},
+		SortedAttrs:      []string{"srcs", "deps"},
+		OrderedAttrs:     DefaultOrderedAttrs,
+		Defaults:         goDefaults,
+	}, {
+		Name:             "go_proto_library",
+		Load:             GoProtoBzl,
+		MergeableAttrs:   map[string]bool{"srcs": true, "deps": true, "has_services": true},
+		ReplaceableAttrs: map[string]bool{"importmap": true},
+		SortedAttrs:      []string{"srcs", "deps"},
+	}, {
+		Name: "go_prefix",
+		Load: GoRulesBzl,
+	}, {
+		Name:             "go_test",
+		Load:             GoRulesBzl,
+		MergeableAttrs:   DefaultMergeableAttrs,
+		ReplaceableAttrs: map[string]bool{"size": true, "timeout": true, "shard_count": true},
+		SortedAttrs:      []string{"srcs", "deps"},
+		OrderedAttrs:     DefaultOrderedAttrs,
+		Defaults:         goDefaults,
+	}, {
+		Name:           "filegroup",
+		MergeableAttrs: map[string]bool{"srcs": true},
+	}, {
+		Name:           "cc_library",
+		MergeableAttrs: map[string]bool{"srcs": true, "hdrs": true, "copts": true},
+		SortedAttrs:    []string{"srcs", "hdrs"},
+		OrderedAttrs:   map[string]bool{"copts": true},
+	},
+}
+
+var (
+	mu    sync.RWMutex
+	kinds = make(map[string]Kind)
+)
+
+func init() {
+	for _, k := range GoKinds {
+		Register(k)
+	}
+}
+
+// Register adds k to the table, replacing any existing kind with the same
+// name. It should be called from an init function or before rules are
+// generated.
+func Register(k Kind) {
+	mu.Lock()
+	defer mu.Unlock()
+	kinds[k.Name] = k
+}
+
+// Lookup returns the description of the named kind and whether it was
+// found.
+func Lookup(name string) (Kind, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	k, ok := kinds[name]
+	return k, ok
+}
+
+// IsMergeable returns whether the attribute attr of rules of the given kind
+// is regenerated when rules are merged. DefaultMergeableAttrs is used for
+// kinds that aren't in the table.
+func IsMergeable(kind, attr string) bool {
+	if k, ok := Lookup(kind); ok {
+		return k.MergeableAttrs[attr]
+	}
+	return DefaultMergeableAttrs[attr]
+}
+
+// IsOrdered returns whether the order of the attribute attr of rules of the
+// given kind is significant. See Kind.OrderedAttrs. DefaultOrderedAttrs is
+// used for kinds that aren't in the table.
+func IsOrdered(kind, attr string) bool {
+	if k, ok := Lookup(kind); ok {
+		return k.OrderedAttrs[attr]
+	}
+	return DefaultOrderedAttrs[attr]
+}
+
+// IsReplaceable returns whether the attribute attr of rules of the given
+// kind is replaced by a generated value when rules are merged. See
+// Kind.ReplaceableAttrs.
+func IsReplaceable(kind, attr string) bool {
+	k, ok := Lookup(kind)
+	return ok && k.ReplaceableAttrs[attr]
+}
+
+// Default returns the default value of the attribute attr of rules of the
+// given kind and whether there is one.
+func Default(kind, attr string) (interface{}, bool) {
+	if k, ok := Lookup(kind); ok {
+		if v, ok := k.Defaults[attr]; ok {
+			return v, true
+		}
+	}
+	v, ok := CommonDefaults[attr]
+	return v, ok
+}
@@ -0,0 +1,79 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsMergeable(t *testing.T) {
+	Register(Kind{Name: "custom_library", MergeableAttrs: map[string]bool{"data": true}})
+	for _, tc := range []struct {
+		kind, attr string
+		want       bool
+	}{
+		{"go_library", "srcs", true},
+		{"go_library", "visibility", false},
+		{"filegroup", "srcs", true},
+		{"filegroup", "deps", false},
+		{"go_prefix", "srcs", false},
+		{"custom_library", "data", true},
+		{"custom_library", "srcs", false},
+		{"unknown", "deps", true},
+		{"unknown", "data", false},
+	} {
+		if got := IsMergeable(tc.kind, tc.attr); got != tc.want {
+			t.Errorf("IsMergeable(%q, %q) = %v; want %v", tc.kind, tc.attr, got, tc.want)
+		}
+	}
+}
+
+func TestIsReplaceable(t *testing.T) {
+	for _, tc := range []struct {
+		kind, attr string
+		want       bool
+	}{
+		{"go_test", "size", true},
+		{"go_test", "srcs", false},
+		{"go_library", "size", false},
+		{"go_library", "importmap", true},
+		{"unknown", "size", false},
+	} {
+		if got := IsReplaceable(tc.kind, tc.attr); got != tc.want {
+			t.Errorf("IsReplaceable(%q, %q) = %v; want %v", tc.kind, tc.attr, got, tc.want)
+		}
+	}
+}
+
+func TestDefault(t *testing.T) {
+	for _, tc := range []struct {
+		kind, attr string
+		want       interface{}
+		wantOk     bool
+	}{
+		{"go_library", "cgo", false, true},
+		{"go_library", "testonly", false, true},
+		{"filegroup", "cgo", nil, false},
+		{"unknown", "tags", []string{}, true},
+		{"go_test", "srcs", nil, false},
+	} {
+		got, ok := Default(tc.kind, tc.attr)
+		if ok != tc.wantOk || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Default(%q, %q) = %v, %v; want %v, %v", tc.kind, tc.attr, got, ok, tc.want, tc.wantOk)
+		}
+	}
+}
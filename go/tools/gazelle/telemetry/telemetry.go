@@ -0,0 +1,107 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package telemetry lets programs that embed Gazelle receive statistics
+// about each run, so they can be aggregated across many developers' runs.
+//
+// Nothing is recorded unless a Recorder is installed with SetRecorder, which
+// should be done from an init function in a package linked into the gazelle
+// binary. Gazelle doesn't send statistics anywhere itself.
+//
+// Statistics are anonymized: they contain durations, counts, and the kinds
+// of problems that were reported, but no paths, import paths, labels, or
+// messages.
+package telemetry
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats describes one run of Gazelle.
+type Stats struct {
+	// Version identifies the build of Gazelle, as in rule annotations.
+	Version string
+
+	// GOOS and GOARCH are the platform Gazelle ran on.
+	GOOS, GOARCH string
+
+	// Duration is the wall time of the run.
+	Duration time.Duration
+
+	// Phases is the time spent in each phase of the run, like "walk" and
+	// "generate". Since phases run concurrently, this is the sum of the time
+	// spent by each goroutine, and it may be more than Duration.
+	Phases map[string]time.Duration
+
+	// Dirs is the number of directories visited.
+	Dirs int
+
+	// Files is the number of build files emitted.
+	Files int
+
+	// Errors and Warnings count the errors and warnings reported, keyed by
+	// kind, like "parse_error". Messages without a kind are counted under
+	// the empty string. Messages are counted even if the verbosity was too
+	// low for them to be written.
+	Errors, Warnings map[string]int
+
+	// Failed is true if the run ended with an error.
+	Failed bool
+}
+
+// Recorder receives statistics about runs.
+type Recorder interface {
+	// RecordRun is called once at the end of each run, before Gazelle exits.
+	// s must not be modified or retained after RecordRun returns.
+	RecordRun(s *Stats)
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) RecordRun(*Stats) {}
+
+var (
+	mu       sync.Mutex
+	recorder Recorder = nopRecorder{}
+)
+
+// SetRecorder sets the Recorder statistics are passed to. If r is nil,
+// statistics are discarded, which is the default.
+func SetRecorder(r Recorder) {
+	mu.Lock()
+	defer mu.Unlock()
+	if r == nil {
+		r = nopRecorder{}
+	}
+	recorder = r
+}
+
+// Enabled returns whether a Recorder has been set. Gazelle only collects
+// statistics when it is true.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := recorder.(nopRecorder)
+	return !ok
+}
+
+// Record passes s to the current Recorder.
+func Record(s *Stats) {
+	mu.Lock()
+	r := recorder
+	mu.Unlock()
+	r.RecordRun(s)
+}
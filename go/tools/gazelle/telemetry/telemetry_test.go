@@ -0,0 +1,50 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package telemetry
+
+import "testing"
+
+type testRecorder struct {
+	runs []*Stats
+}
+
+func (r *testRecorder) RecordRun(s *Stats) {
+	r.runs = append(r.runs, s)
+}
+
+func TestSetRecorder(t *testing.T) {
+	defer SetRecorder(nil)
+	if Enabled() {
+		t.Errorf("telemetry enabled by default")
+	}
+	Record(&Stats{Dirs: 1})
+
+	r := &testRecorder{}
+	SetRecorder(r)
+	if !Enabled() {
+		t.Errorf("telemetry not enabled after SetRecorder")
+	}
+	s := &Stats{Dirs: 2}
+	Record(s)
+	if len(r.runs) != 1 || r.runs[0] != s {
+		t.Errorf("got runs %v; want [%v]", r.runs, s)
+	}
+
+	SetRecorder(nil)
+	if Enabled() {
+		t.Errorf("telemetry enabled after SetRecorder(nil)")
+	}
+}
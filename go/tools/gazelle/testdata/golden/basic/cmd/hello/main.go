@@ -0,0 +1,13 @@
+package main
+
+import (
+	"log"
+
+	"example.com/basic/lib"
+)
+
+func main() {
+	if err := lib.Check(true); err != nil {
+		log.Fatal(err)
+	}
+}
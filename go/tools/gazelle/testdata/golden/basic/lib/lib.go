@@ -0,0 +1,10 @@
+package lib
+
+import "github.com/pkg/errors"
+
+func Check(ok bool) error {
+	if !ok {
+		return errors.New("not ok")
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package lib
+
+import "testing"
+
+func TestCheck(t *testing.T) {
+	if err := Check(true); err != nil {
+		t.Error(err)
+	}
+}
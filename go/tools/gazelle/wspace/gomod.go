@@ -0,0 +1,248 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wspace
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const goModFile = "go.mod"
+
+// Replacement is a replace directive in a go.mod file, like
+// "replace example.com/foo => ../foo".
+type Replacement struct {
+	// Old is the path of the module being replaced. OldVersion is empty if
+	// all versions are replaced.
+	Old, OldVersion string
+
+	// New is the path of the replacement module, or a directory if the
+	// replacement is local. NewVersion is empty for local replacements.
+	New, NewVersion string
+}
+
+// IsLocal returns whether r replaces a module with a directory. Like the go
+// command, paths that are absolute or start with "./" or "../" are
+// directories. Relative directories are relative to the directory
+// containing the go.mod file.
+func (r Replacement) IsLocal() bool {
+	return strings.HasPrefix(r.New, "./") || strings.HasPrefix(r.New, "../") ||
+		strings.HasPrefix(r.New, "/") || filepath.IsAbs(r.New)
+}
+
+// ReadGoModReplacements reads the replace directives in the go.mod file in
+// the directory root. If there is no go.mod file, ReadGoModReplacements
+// returns nil without an error. Other directives are skipped.
+func ReadGoModReplacements(root string) ([]Replacement, error) {
+	var reps []Replacement
+	err := readGoModDirectives(root, "replace", func(fields []string) error {
+		r, err := parseReplacement(fields)
+		if err != nil {
+			return err
+		}
+		reps = append(reps, r)
+		return nil
+	})
+	return reps, err
+}
+
+// Requirement is a require directive in a go.mod file, like
+// "require example.com/foo v1.2.0".
+type Requirement struct {
+	Path, Version string
+}
+
+// ReadGoModRequirements reads the require directives in the go.mod file in
+// the directory root, including indirect requirements. If there is no
+// go.mod file, ReadGoModRequirements returns nil without an error.
+func ReadGoModRequirements(root string) ([]Requirement, error) {
+	var reqs []Requirement
+	err := readGoModDirectives(root, "require", func(fields []string) error {
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid require directive: want path version")
+		}
+		reqs = append(reqs, Requirement{Path: fields[0], Version: fields[1]})
+		return nil
+	})
+	return reqs, err
+}
+
+// readGoModDirectives calls f with the fields after the keyword of each
+// directive named verb in the go.mod file in the directory root, whether
+// it's on its own line or in a block. Errors returned by f are reported
+// with the line they occur on. If there is no go.mod file,
+// readGoModDirectives returns nil without calling f.
+func readGoModDirectives(root, verb string, f func(fields []string) error) error {
+	path := filepath.Join(root, goModFile)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	inBlock := false
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		fields, err := goModFields(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		switch {
+		case len(fields) == 0:
+			continue
+		case inBlock && fields[0] == ")":
+			inBlock = false
+			continue
+		case inBlock:
+		case fields[0] == verb && len(fields) == 2 && fields[1] == "(":
+			inBlock = true
+			continue
+		case fields[0] == verb:
+			fields = fields[1:]
+		default:
+			continue
+		}
+		if err := f(fields); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadGoSum reads the go.sum file in the directory root. It returns a map
+// from a module path and version separated by a space, like
+// "example.com/foo v1.2.0", to the hash of the module's zip file, like
+// "h1:...". Hashes of go.mod files alone are skipped. If there is no go.sum
+// file, ReadGoSum returns nil without an error.
+func ReadGoSum(root string) (map[string]string, error) {
+	path := filepath.Join(root, "go.sum")
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want module version hash", path, lineNum)
+		}
+		if strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		sums[fields[0]+" "+fields[1]] = fields[2]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// parseReplacement parses the fields of a replace directive after the
+// "replace" keyword.
+func parseReplacement(fields []string) (Replacement, error) {
+	var r Replacement
+	switch {
+	case len(fields) >= 3 && fields[1] == "=>":
+		r.Old, fields = fields[0], fields[2:]
+	case len(fields) >= 4 && fields[2] == "=>":
+		r.Old, r.OldVersion, fields = fields[0], fields[1], fields[3:]
+	default:
+		return Replacement{}, fmt.Errorf("invalid replace directive: want old [version] => new [version]")
+	}
+	switch len(fields) {
+	case 1:
+		r.New = fields[0]
+	case 2:
+		r.New, r.NewVersion = fields[0], fields[1]
+	default:
+		return Replacement{}, fmt.Errorf("invalid replace directive: want old [version] => new [version]")
+	}
+	if r.IsLocal() && r.NewVersion != "" {
+		return Replacement{}, fmt.Errorf("replacement directory %s can't have a version", r.New)
+	}
+	return r, nil
+}
+
+// goModFields splits a line of a go.mod file into fields. Comments are
+// removed, and quoted strings are unquoted.
+func goModFields(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || strings.HasPrefix(line, "//") {
+			return fields, nil
+		}
+		if line[0] == '"' || line[0] == '`' {
+			n := quotedLen(line)
+			if n < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			s, err := strconv.Unquote(line[:n])
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, s)
+			line = line[n:]
+			continue
+		}
+		n := strings.IndexAny(line, " \t")
+		if n < 0 {
+			n = len(line)
+		}
+		fields = append(fields, line[:n])
+		line = line[n:]
+	}
+}
+
+// quotedLen returns the length of the quoted string at the beginning of s,
+// including the quotes, or -1 if the quote isn't closed.
+func quotedLen(s string) int {
+	if s[0] == '`' {
+		if i := strings.IndexByte(s[1:], '`'); i >= 0 {
+			return i + 2
+		}
+		return -1
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
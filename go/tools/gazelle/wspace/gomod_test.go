@@ -0,0 +1,155 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wspace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadGoModReplacements(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if reps, err := ReadGoModReplacements(tmp); err != nil || reps != nil {
+		t.Errorf("without go.mod: got %v, %v; want nil, nil", reps, err)
+	}
+
+	content := `module example.com/repo
+
+require example.com/foo v1.0.0
+
+replace example.com/foo => ../foo // local checkout
+
+replace (
+	example.com/bar v1.2.0 => example.com/bar-fork v1.2.1
+	"example.com/baz" => /src/baz
+)
+`
+	if err := ioutil.WriteFile(filepath.Join(tmp, goModFile), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadGoModReplacements(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Replacement{
+		{Old: "example.com/foo", New: "../foo"},
+		{Old: "example.com/bar", OldVersion: "v1.2.0", New: "example.com/bar-fork", NewVersion: "v1.2.1"},
+		{Old: "example.com/baz", New: "/src/baz"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+	for i, wantLocal := range []bool{true, false, true} {
+		if got[i].IsLocal() != wantLocal {
+			t.Errorf("%#v.IsLocal() = %v; want %v", got[i], !wantLocal, wantLocal)
+		}
+	}
+
+	for _, bad := range []string{
+		"replace example.com/foo ../foo\n",
+		"replace example.com/foo => ../foo v1.0.0\n",
+		"replace example.com/foo => \"../foo\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, goModFile), []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadGoModReplacements(tmp); err == nil {
+			t.Errorf("%q: got success; want error", bad)
+		}
+	}
+}
+
+func TestReadGoModRequirements(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if reqs, err := ReadGoModRequirements(tmp); err != nil || reqs != nil {
+		t.Errorf("without go.mod: got %v, %v; want nil, nil", reqs, err)
+	}
+
+	content := `module example.com/repo
+
+require example.com/foo v1.0.0
+
+require (
+	example.com/bar v1.2.0 // indirect
+	"example.com/baz" v0.0.0-20170101000000-0123456789ab
+)
+
+replace example.com/foo => ../foo
+`
+	if err := ioutil.WriteFile(filepath.Join(tmp, goModFile), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadGoModRequirements(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Requirement{
+		{Path: "example.com/foo", Version: "v1.0.0"},
+		{Path: "example.com/bar", Version: "v1.2.0"},
+		{Path: "example.com/baz", Version: "v0.0.0-20170101000000-0123456789ab"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, goModFile), []byte("require example.com/foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadGoModRequirements(tmp); err == nil {
+		t.Errorf("require without version: got success; want error")
+	}
+}
+
+func TestReadGoSum(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if sums, err := ReadGoSum(tmp); err != nil || sums != nil {
+		t.Errorf("without go.sum: got %v, %v; want nil, nil", sums, err)
+	}
+
+	content := `example.com/foo v1.0.0 h1:foo=
+example.com/foo v1.0.0/go.mod h1:foomod=
+example.com/bar v1.2.0/go.mod h1:barmod=
+`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "go.sum"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadGoSum(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"example.com/foo v1.0.0": "h1:foo="}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
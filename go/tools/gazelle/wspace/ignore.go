@@ -0,0 +1,60 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wspace
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const bazelIgnoreFile = ".bazelignore"
+
+// ReadBazelIgnore reads the .bazelignore file in the workspace root
+// directory "root". It returns the listed directories as slash-separated
+// paths relative to root. Blank lines and lines starting with "#" are
+// skipped. If there is no .bazelignore file, ReadBazelIgnore returns nil
+// without an error.
+func ReadBazelIgnore(root string) ([]string, error) {
+	f, err := os.Open(filepath.Join(root, bazelIgnoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := path.Clean(filepath.ToSlash(line))
+		if p == "." {
+			continue
+		}
+		paths = append(paths, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
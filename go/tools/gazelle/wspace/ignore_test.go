@@ -0,0 +1,55 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wspace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadBazelIgnore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if got, err := ReadBazelIgnore(tmp); err != nil || got != nil {
+		t.Errorf("ReadBazelIgnore(%q) got %v, %v; want nil, nil", tmp, got, err)
+	}
+
+	content := `
+# comment
+node_modules
+bazel-out/
+  third_party//foo  
+.
+`
+	if err := ioutil.WriteFile(filepath.Join(tmp, bazelIgnoreFile), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBazelIgnore(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"node_modules", "bazel-out", "third_party/foo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadBazelIgnore(%q) got %q, want %q", tmp, got, want)
+	}
+}
@@ -0,0 +1,108 @@
+# Copyright 2017 The Bazel Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+"""Aspect that describes Go targets for gopackagesdriver.
+
+For each go_library, go_binary, and go_test rule it visits, go_pkg_info_aspect
+writes a JSON file named <name>.go_pkg.json next to the rule's outputs. The
+files for a target and everything it depends on are in the go_pkg_info output
+group, together with the files they name that are built: the compiled .a
+archives of libraries, read as export data, and Go files generated by cgo.
+Building the output group builds only those, not the targets' binaries or
+tests.
+"""
+
+load("@io_bazel_rules_go//go/private:go_toolchain.bzl", "go_toolchain_type")
+load("@io_bazel_rules_go//go/private:providers.bzl", "GoLibrary", "GoSource")
+
+GoPkgInfo = provider()
+
+_go_rule_kinds = ["go_library", "go_binary", "go_test"]
+
+def _go_pkg_info_aspect_impl(target, ctx):
+  deps = list(getattr(ctx.rule.attr, "deps", []))
+  embed = list(getattr(ctx.rule.attr, "embed", []))
+  library = getattr(ctx.rule.attr, "library", None)
+  if library:
+    embed = [library] + embed
+  pkg_json_files = depset()
+  output_files = depset()
+  for dep in deps + embed:
+    if GoPkgInfo in dep:
+      pkg_json_files += dep[GoPkgInfo].pkg_json_files
+      output_files += dep[GoPkgInfo].output_files
+
+  if ctx.rule.kind not in _go_rule_kinds:
+    return [
+        GoPkgInfo(pkg_json_files = pkg_json_files, output_files = output_files),
+        OutputGroupInfo(go_pkg_info = output_files),
+    ]
+
+  # Sources of embedded libraries are compiled into the same package, so
+  # their dependencies are dependencies of this target, but the libraries
+  # aren't.
+  # GoSource includes those sources and files generated by cgo, so it's used
+  # instead of srcs when it's available.
+  srcs = list(ctx.rule.files.srcs)
+  go_srcs = [f for f in srcs if f.basename.endswith(".go")]
+  pkg_path = ""
+  export_file = ""
+  if GoLibrary in target:
+    pkg_path = target[GoLibrary].importpath
+    export_file = target[GoLibrary].library.path
+    output_files += [target[GoLibrary].library]
+    go_srcs = list(target[GoSource].go_sources)
+    deps = target[GoLibrary].direct_deps
+  else:
+    for library in embed:
+      if GoLibrary not in library:
+        continue
+      pkg_path = library[GoLibrary].importpath
+      go_srcs += list(library[GoSource].go_sources)
+      deps += library[GoLibrary].direct_deps
+
+  dep_labels = []
+  for dep in deps:
+    label = str(dep.label)
+    if GoLibrary in dep and label not in dep_labels:
+      dep_labels.append(label)
+
+  go_toolchain = ctx.rule.attr._go_toolchain[go_toolchain_type]
+  info = struct(
+      id = str(ctx.label),
+      pkg_path = pkg_path,
+      go_files = [f.path for f in go_srcs],
+      other_files = [f.path for f in srcs if not f.basename.endswith(".go")],
+      export_file = export_file,
+      deps = dep_labels,
+      go = go_toolchain.go.path,
+      goroot = go_toolchain.env["GOROOT"],
+      goarch = go_toolchain.env["GOARCH"],
+  )
+  json_file = ctx.new_file(ctx.label.name + ".go_pkg.json")
+  ctx.file_action(output = json_file, content = info.to_json())
+  pkg_json_files += [json_file]
+
+  # Generated sources, like those written by cgo, only exist once they're
+  # built, so they're built with the JSON files that list them.
+  output_files += [json_file] + [f for f in go_srcs if not f.is_source]
+  return [
+      GoPkgInfo(pkg_json_files = pkg_json_files, output_files = output_files),
+      OutputGroupInfo(go_pkg_info = output_files),
+  ]
+
+go_pkg_info_aspect = aspect(
+    _go_pkg_info_aspect_impl,
+    attr_aspects = ["deps", "embed", "library"],
+)
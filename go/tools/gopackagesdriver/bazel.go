@@ -0,0 +1,181 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// aspect is the aspect that writes a .go_pkg.json file for each Go target.
+const aspect = "@io_bazel_rules_go//go/tools/gopackagesdriver:aspect.bzl%go_pkg_info_aspect"
+
+// bazelInfo holds directories reported by "bazel info".
+type bazelInfo struct {
+	workspace, executionRoot, outputBase, bazelBin string
+}
+
+// bazel runs Bazel commands in a workspace.
+type bazel struct {
+	cmd   string
+	flags []string
+	info  bazelInfo
+}
+
+// newBazel returns a bazel for the workspace containing dir.
+func newBazel(dir string) (*bazel, error) {
+	b := &bazel{cmd: os.Getenv("GOPACKAGESDRIVER_BAZEL")}
+	if b.cmd == "" {
+		b.cmd = "bazel"
+	}
+	b.flags = strings.Fields(os.Getenv("GOPACKAGESDRIVER_BAZEL_FLAGS"))
+	out, err := b.run(dir, "info", "workspace", "execution_root", "output_base", "bazel-bin")
+	if err != nil {
+		return nil, err
+	}
+	if b.info, err = parseBazelInfo(out); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// parseBazelInfo parses the output of
+// "bazel info workspace execution_root output_base bazel-bin".
+func parseBazelInfo(out []byte) (bazelInfo, error) {
+	var info bazelInfo
+	for _, line := range strings.Split(string(out), "\n") {
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[i+2:])
+		switch line[:i] {
+		case "workspace":
+			info.workspace = value
+		case "execution_root":
+			info.executionRoot = value
+		case "output_base":
+			info.outputBase = value
+		case "bazel-bin":
+			info.bazelBin = value
+		}
+	}
+	if info.workspace == "" || info.executionRoot == "" || info.outputBase == "" || info.bazelBin == "" {
+		return bazelInfo{}, fmt.Errorf("unexpected output from bazel info:\n%s", out)
+	}
+	return info, nil
+}
+
+// query returns the labels of the rules matched by a query expression.
+func (b *bazel) query(expr string) ([]string, error) {
+	out, err := b.run(b.info.workspace, "query", "--output=label", expr)
+	if err != nil {
+		return nil, err
+	}
+	var labels []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			labels = append(labels, line)
+		}
+	}
+	return labels, nil
+}
+
+// build builds targets with the aspect, writing .go_pkg.json files for them
+// and their dependencies.
+func (b *bazel) build(targets []string) error {
+	args := []string{"build", "--keep_going", "--aspects=" + aspect, "--output_groups=go_pkg_info", "--"}
+	_, err := b.run(b.info.workspace, append(args, targets...)...)
+	return err
+}
+
+// run runs a bazel command in dir and returns its stdout. Flags from
+// GOPACKAGESDRIVER_BAZEL_FLAGS are added after the command name.
+func (b *bazel) run(dir string, args ...string) ([]byte, error) {
+	args = append(append([]string{args[0]}, b.flags...), args[1:]...)
+	cmd := exec.Command(b.cmd, args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("%s %s: %v: %s", b.cmd, strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// pkgJSONPath returns the path of the .go_pkg.json file the aspect writes
+// for the target label.
+func (info bazelInfo) pkgJSONPath(label string) (string, error) {
+	repo, pkg, name, err := splitLabel(label)
+	if err != nil {
+		return "", err
+	}
+	dir := info.bazelBin
+	if repo != "" {
+		dir = filepath.Join(dir, "external", repo)
+	}
+	return filepath.Join(dir, filepath.FromSlash(pkg), name+".go_pkg.json"), nil
+}
+
+// splitLabel splits an absolute label, like @repo//pkg:name, into its parts.
+// The repository is empty for labels in the main workspace.
+func splitLabel(label string) (repo, pkg, name string, err error) {
+	s := label
+	if strings.HasPrefix(s, "@") {
+		i := strings.Index(s, "//")
+		if i < 0 {
+			return "", "", "", fmt.Errorf("invalid label %q", label)
+		}
+		repo, s = s[1:i], s[i:]
+	}
+	if !strings.HasPrefix(s, "//") {
+		return "", "", "", fmt.Errorf("invalid label %q: must be absolute", label)
+	}
+	s = s[2:]
+	if i := strings.Index(s, ":"); i >= 0 {
+		pkg, name = s[:i], s[i+1:]
+	} else {
+		pkg, name = s, s[strings.LastIndex(s, "/")+1:]
+	}
+	if name == "" {
+		return "", "", "", fmt.Errorf("invalid label %q: no target name", label)
+	}
+	return repo, pkg, name, nil
+}
+
+// absPath converts a path written by the aspect, which is relative to the
+// execution root, into an absolute path. Source files in the main workspace
+// are returned in the workspace rather than the execution root, so editors
+// see the files they have open.
+func (info bazelInfo) absPath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	p = filepath.FromSlash(p)
+	switch {
+	case strings.HasPrefix(p, "external"+string(filepath.Separator)):
+		return filepath.Join(info.outputBase, p)
+	case strings.HasPrefix(p, "bazel-out"+string(filepath.Separator)):
+		return filepath.Join(info.executionRoot, p)
+	default:
+		return filepath.Join(info.workspace, p)
+	}
+}
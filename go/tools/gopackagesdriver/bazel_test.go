@@ -0,0 +1,90 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseBazelInfo(t *testing.T) {
+	out := []byte(`workspace: /home/me/repo
+execution_root: /cache/execroot/repo
+output_base: /cache
+bazel-bin: /cache/execroot/repo/bazel-out/local-fastbuild/bin
+`)
+	got, err := parseBazelInfo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bazelInfo{
+		workspace:     "/home/me/repo",
+		executionRoot: "/cache/execroot/repo",
+		outputBase:    "/cache",
+		bazelBin:      "/cache/execroot/repo/bazel-out/local-fastbuild/bin",
+	}
+	if got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+
+	if _, err := parseBazelInfo([]byte("workspace: /home/me/repo\n")); err == nil {
+		t.Errorf("got success for incomplete output; want error")
+	}
+}
+
+func TestPkgJSONPath(t *testing.T) {
+	info := bazelInfo{bazelBin: filepath.FromSlash("/bin")}
+	for _, tc := range []struct {
+		label, want string
+	}{
+		{"//foo/bar:go_default_library", "/bin/foo/bar/go_default_library.go_pkg.json"},
+		{"@//foo:lib", "/bin/foo/lib.go_pkg.json"},
+		{"//:go_default_test", "/bin/go_default_test.go_pkg.json"},
+		{"@org_x//y/z", "/bin/external/org_x/y/z/z.go_pkg.json"},
+	} {
+		got, err := info.pkgJSONPath(tc.label)
+		if err != nil {
+			t.Errorf("%s: %v", tc.label, err)
+		} else if want := filepath.FromSlash(tc.want); got != want {
+			t.Errorf("%s: got %s; want %s", tc.label, got, want)
+		}
+	}
+	for _, label := range []string{":lib", "foo:lib", "@org_x", "//foo:"} {
+		if _, err := info.pkgJSONPath(label); err == nil {
+			t.Errorf("%s: got success; want error", label)
+		}
+	}
+}
+
+func TestAbsPath(t *testing.T) {
+	info := bazelInfo{
+		workspace:     filepath.FromSlash("/ws"),
+		executionRoot: filepath.FromSlash("/cache/execroot/ws"),
+		outputBase:    filepath.FromSlash("/cache"),
+	}
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"foo/foo.go", "/ws/foo/foo.go"},
+		{"external/org_x/y.go", "/cache/external/org_x/y.go"},
+		{"bazel-out/local-fastbuild/bin/foo/gen.go", "/cache/execroot/ws/bazel-out/local-fastbuild/bin/foo/gen.go"},
+		{"", ""},
+	} {
+		if got, want := info.absPath(tc.path), filepath.FromSlash(tc.want); got != want {
+			t.Errorf("%q: got %s; want %s", tc.path, got, want)
+		}
+	}
+}
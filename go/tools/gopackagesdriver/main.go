@@ -0,0 +1,134 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command gopackagesdriver loads Go packages from a Bazel workspace for
+// tools built on golang.org/x/tools/go/packages, like gopls and static
+// analyzers. Those tools run it instead of "go list" when the
+// GOPACKAGESDRIVER environment variable names it.
+//
+// The driver converts the requested patterns into a Bazel query for
+// go_library, go_binary, and go_test rules, builds them with an aspect that
+// writes a JSON description of each Go target, and converts those into the
+// packages go/packages expects. Standard packages are listed with the Go SDK
+// used by the workspace.
+//
+// Supported patterns are Bazel labels and target patterns, like
+// //foo:go_default_library and //foo/..., directories relative to the
+// current directory, like ./foo and ./..., "file=path" for the packages that
+// contain a file, and standard import paths, like fmt.
+//
+// Environment variables:
+//
+//	GOPACKAGESDRIVER_BAZEL        the bazel command (default "bazel")
+//	GOPACKAGESDRIVER_BAZEL_FLAGS  extra flags for bazel query and bazel build
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// driverRequest is the request go/packages writes to the driver's stdin.
+type driverRequest struct {
+	Mode       int               `json:"mode"`
+	Env        []string          `json:"env"`
+	BuildFlags []string          `json:"build_flags"`
+	Tests      bool              `json:"tests"`
+	Overlay    map[string][]byte `json:"overlay"`
+}
+
+// driverResponse is the response the driver writes to stdout.
+type driverResponse struct {
+	// NotHandled tells go/packages to fall back to "go list".
+	NotHandled bool `json:",omitempty"`
+
+	Sizes    *sizes           `json:",omitempty"`
+	Roots    []string         `json:",omitempty"`
+	Packages []*driverPackage `json:",omitempty"`
+}
+
+type sizes struct {
+	WordSize, MaxAlign int64
+}
+
+// driverPackage is a package in a driverResponse. Imports maps the import
+// paths used in the package's sources to package IDs.
+type driverPackage struct {
+	ID              string
+	Name            string            `json:",omitempty"`
+	PkgPath         string            `json:",omitempty"`
+	Errors          []packageError    `json:",omitempty"`
+	GoFiles         []string          `json:",omitempty"`
+	CompiledGoFiles []string          `json:",omitempty"`
+	OtherFiles      []string          `json:",omitempty"`
+	ExportFile      string            `json:",omitempty"`
+	Imports         map[string]string `json:",omitempty"`
+}
+
+type packageError struct {
+	Pos  string
+	Msg  string
+	Kind int
+}
+
+// listError is the Kind of errors found while loading packages.
+const listError = 1
+
+func main() {
+	log.SetPrefix("gopackagesdriver: ")
+	log.SetFlags(0)
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := run(os.Stdin, os.Stdout, wd, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(in io.Reader, out io.Writer, wd string, patterns []string) error {
+	var req driverRequest
+	if err := json.NewDecoder(in).Decode(&req); err != nil && err != io.EOF {
+		return fmt.Errorf("could not read request: %v", err)
+	}
+	b, err := newBazel(wd)
+	if err != nil {
+		return err
+	}
+	p, err := parsePatterns(patterns, wd, b.info.workspace)
+	if err != nil {
+		return err
+	}
+
+	var roots []string
+	if expr := p.queryExpr(req.Tests); expr != "" {
+		if roots, err = b.query(expr); err != nil {
+			return err
+		}
+		if err := b.build(roots); err != nil {
+			// The build fails if any target doesn't compile, but the aspect's
+			// files are still written. Load what's there.
+			log.Print(err)
+		}
+	}
+	resp, err := load(b.info, roots, p.std)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(out).Encode(resp)
+}
@@ -0,0 +1,224 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+)
+
+// pkgInfo is the content of a .go_pkg.json file written by the aspect. Paths
+// are relative to the execution root.
+type pkgInfo struct {
+	ID         string   `json:"id"`
+	PkgPath    string   `json:"pkg_path"`
+	GoFiles    []string `json:"go_files"`
+	OtherFiles []string `json:"other_files"`
+	ExportFile string   `json:"export_file"`
+	Deps       []string `json:"deps"`
+
+	// Go, GOROOT, and GOARCH describe the Go toolchain the target is built
+	// with.
+	Go     string `json:"go"`
+	GOROOT string `json:"goroot"`
+	GOARCH string `json:"goarch"`
+}
+
+// loader converts the .go_pkg.json files of targets and their dependencies
+// into driver packages.
+type loader struct {
+	info bazelInfo
+	pkgs map[string]*driverPackage
+
+	// ids maps labels passed to loadTarget to package IDs. They're usually
+	// the same, but the aspect may write labels in a different form.
+	ids map[string]string
+
+	// std is the set of standard packages imported by loaded packages.
+	std map[string]bool
+
+	// toolchain is the toolchain of the first target loaded. Standard
+	// packages are listed with it.
+	toolchain *pkgInfo
+}
+
+// load returns a response with the packages of the Bazel targets roots and
+// the standard packages std, and everything they import.
+func load(info bazelInfo, roots, std []string) (*driverResponse, error) {
+	l := &loader{
+		info: info,
+		pkgs: make(map[string]*driverPackage),
+		ids:  make(map[string]string),
+		std:  make(map[string]bool),
+	}
+	resp := &driverResponse{}
+	for _, label := range roots {
+		resp.Roots = append(resp.Roots, l.loadTarget(label))
+	}
+	for _, imp := range std {
+		l.std[imp] = true
+	}
+
+	goarch := ""
+	if len(l.std) > 0 {
+		goTool, goroot := "go", ""
+		if l.toolchain != nil {
+			goTool, goroot = info.absPath(l.toolchain.Go), info.absPath(l.toolchain.GOROOT)
+			goarch = l.toolchain.GOARCH
+		}
+		stdPkgs, err := listStd(goTool, goroot)
+		if err != nil {
+			return nil, err
+		}
+		addStd(l.pkgs, stdPkgs, l.std)
+		for _, imp := range std {
+			if _, ok := l.pkgs[imp]; ok {
+				resp.Roots = append(resp.Roots, imp)
+			}
+		}
+	}
+	resp.Sizes = archSizes(goarch)
+
+	ids := make([]string, 0, len(l.pkgs))
+	for id := range l.pkgs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		resp.Packages = append(resp.Packages, l.pkgs[id])
+	}
+	return resp, nil
+}
+
+// loadTarget loads the package of the target label and its dependencies and
+// returns its ID. If the target's .go_pkg.json file can't be read, a
+// package with an error is returned, so the problem is shown to the user.
+func (l *loader) loadTarget(label string) string {
+	if id, ok := l.ids[label]; ok {
+		return id
+	}
+	pi, err := l.readPkgInfo(label)
+	if err != nil {
+		l.ids[label] = label
+		l.pkgs[label] = &driverPackage{
+			ID:     label,
+			Errors: []packageError{{Msg: fmt.Sprintf("no package information for %s; the target may have failed to build: %v", label, err), Kind: listError}},
+		}
+		return label
+	}
+	l.ids[label] = pi.ID
+	if _, ok := l.pkgs[pi.ID]; ok {
+		return pi.ID
+	}
+	if l.toolchain == nil {
+		l.toolchain = pi
+	}
+
+	pkg := &driverPackage{
+		ID:         pi.ID,
+		PkgPath:    pi.PkgPath,
+		Imports:    make(map[string]string),
+		ExportFile: l.info.absPath(pi.ExportFile),
+	}
+	if pkg.PkgPath == "" {
+		pkg.PkgPath = pi.ID
+	}
+	if _, err := os.Stat(pkg.ExportFile); err != nil {
+		pkg.ExportFile = ""
+	}
+	for _, f := range pi.GoFiles {
+		pkg.GoFiles = append(pkg.GoFiles, l.info.absPath(f))
+	}
+	pkg.CompiledGoFiles = pkg.GoFiles
+	for _, f := range pi.OtherFiles {
+		pkg.OtherFiles = append(pkg.OtherFiles, l.info.absPath(f))
+	}
+	// Add the package before loading dependencies, so a cycle doesn't
+	// recurse forever.
+	l.pkgs[pkg.ID] = pkg
+
+	for _, dep := range pi.Deps {
+		depID := l.loadTarget(dep)
+		if depPkg := l.pkgs[depID]; depPkg.PkgPath != "" {
+			pkg.Imports[depPkg.PkgPath] = depID
+		}
+	}
+
+	// Imports of standard packages aren't dependencies in Bazel, so they're
+	// found by parsing the sources.
+	fset := token.NewFileSet()
+	for _, f := range pkg.GoFiles {
+		file, err := parser.ParseFile(fset, f, nil, parser.ImportsOnly)
+		if err != nil {
+			pkg.Errors = append(pkg.Errors, packageError{Pos: f, Msg: err.Error(), Kind: listError})
+			continue
+		}
+		if pkg.Name == "" {
+			pkg.Name = file.Name.Name
+		}
+		for _, spec := range file.Imports {
+			imp, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || imp == "C" {
+				continue
+			}
+			if _, ok := pkg.Imports[imp]; !ok && isStandard(imp) {
+				pkg.Imports[imp] = imp
+				l.std[imp] = true
+			}
+		}
+	}
+	return pkg.ID
+}
+
+func (l *loader) readPkgInfo(label string) (*pkgInfo, error) {
+	path, err := l.info.pkgJSONPath(label)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pi pkgInfo
+	if err := json.Unmarshal(data, &pi); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if pi.ID == "" {
+		pi.ID = label
+	}
+	return &pi, nil
+}
+
+// archSizes returns the sizes of types on goarch, which defaults to the
+// architecture the driver was built for.
+func archSizes(goarch string) *sizes {
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	switch goarch {
+	case "amd64", "arm64", "mips64", "mips64le", "ppc64", "ppc64le", "s390x":
+		return &sizes{WordSize: 8, MaxAlign: 8}
+	default:
+		return &sizes{WordSize: 4, MaxAlign: 4}
+	}
+}
@@ -0,0 +1,145 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "gopackagesdriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := bazelInfo{
+		workspace:     filepath.Join(dir, "ws"),
+		executionRoot: filepath.Join(dir, "execroot"),
+		outputBase:    filepath.Join(dir, "output"),
+		bazelBin:      filepath.Join(dir, "execroot", "bazel-out", "bin"),
+	}
+	files := map[string]string{
+		"ws/foo/foo.go": `package foo
+
+import (
+	"example.com/repo/bar"
+	"github.com/x/y"
+)
+`,
+		"ws/foo/foo_test.go": "package foo\n",
+		"ws/bar/bar.go":      "package bar\n",
+		"output/external/com_github_x_y/y.go": `package y
+
+import "C"
+`,
+		"execroot/bazel-out/bin/foo/go_default_library.go_pkg.json": `{
+	"id": "//foo:go_default_library",
+	"pkg_path": "example.com/repo/foo",
+	"go_files": ["foo/foo.go"],
+	"deps": ["//bar:go_default_library", "@com_github_x_y//:go_default_library"]
+}`,
+		"execroot/bazel-out/bin/foo/go_default_test.go_pkg.json": `{
+	"id": "//foo:go_default_test",
+	"pkg_path": "example.com/repo/foo",
+	"go_files": ["foo/foo.go", "foo/foo_test.go"],
+	"deps": ["//bar:go_default_library"]
+}`,
+		"execroot/bazel-out/bin/bar/go_default_library.go_pkg.json": `{
+	"id": "//bar:go_default_library",
+	"pkg_path": "example.com/repo/bar",
+	"go_files": ["bar/bar.go"],
+	"export_file": "bazel-out/bin/bar/go_default_library.a"
+}`,
+		"execroot/bazel-out/bin/bar/go_default_library.a": "",
+		"execroot/bazel-out/bin/external/com_github_x_y/go_default_library.go_pkg.json": `{
+	"id": "@com_github_x_y//:go_default_library",
+	"pkg_path": "github.com/x/y",
+	"go_files": ["external/com_github_x_y/y.go"],
+	"deps": ["//missing:go_default_library"]
+}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := load(info, []string{"//foo:go_default_library", "//foo:go_default_test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"//foo:go_default_library", "//foo:go_default_test"}; !reflect.DeepEqual(resp.Roots, want) {
+		t.Errorf("got roots %q; want %q", resp.Roots, want)
+	}
+	var ids []string
+	pkgs := make(map[string]*driverPackage)
+	for _, p := range resp.Packages {
+		ids = append(ids, p.ID)
+		pkgs[p.ID] = p
+	}
+	wantIDs := []string{
+		"//bar:go_default_library",
+		"//foo:go_default_library",
+		"//foo:go_default_test",
+		"//missing:go_default_library",
+		"@com_github_x_y//:go_default_library",
+	}
+	if !reflect.DeepEqual(ids, wantIDs) {
+		t.Fatalf("got packages %q; want %q", ids, wantIDs)
+	}
+
+	foo := pkgs["//foo:go_default_library"]
+	if foo.Name != "foo" {
+		t.Errorf("got foo name %q; want foo", foo.Name)
+	}
+	if want := []string{filepath.Join(info.workspace, "foo", "foo.go")}; !reflect.DeepEqual(foo.GoFiles, want) {
+		t.Errorf("got foo files %q; want %q", foo.GoFiles, want)
+	}
+	wantImports := map[string]string{
+		"example.com/repo/bar": "//bar:go_default_library",
+		"github.com/x/y":       "@com_github_x_y//:go_default_library",
+	}
+	if !reflect.DeepEqual(foo.Imports, wantImports) {
+		t.Errorf("got foo imports %v; want %v", foo.Imports, wantImports)
+	}
+
+	bar := pkgs["//bar:go_default_library"]
+	if want := filepath.Join(info.executionRoot, "bazel-out", "bin", "bar", "go_default_library.a"); bar.ExportFile != want {
+		t.Errorf("got bar export file %q; want %q", bar.ExportFile, want)
+	}
+
+	y := pkgs["@com_github_x_y//:go_default_library"]
+	if want := []string{filepath.Join(info.outputBase, "external", "com_github_x_y", "y.go")}; !reflect.DeepEqual(y.GoFiles, want) {
+		t.Errorf("got y files %q; want %q", y.GoFiles, want)
+	}
+	if len(y.Imports) != 0 {
+		t.Errorf("got y imports %v; want none", y.Imports)
+	}
+
+	missing := pkgs["//missing:go_default_library"]
+	if len(missing.Errors) != 1 || !strings.Contains(missing.Errors[0].Msg, "no package information") {
+		t.Errorf("got missing package errors %+v; want an error about package information", missing.Errors)
+	}
+}
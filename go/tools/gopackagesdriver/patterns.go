@@ -0,0 +1,119 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// patternSet holds the patterns of a request, sorted into Bazel target
+// expressions and standard import paths.
+type patternSet struct {
+	targets []string
+	std     []string
+}
+
+// parsePatterns converts go/packages patterns into Bazel query expressions.
+// Directories and files are interpreted relative to wd, and must be in the
+// workspace.
+func parsePatterns(patterns []string, wd, workspace string) (*patternSet, error) {
+	p := &patternSet{}
+	for _, pattern := range patterns {
+		switch {
+		case strings.HasPrefix(pattern, "file="):
+			rel, err := workspacePath(strings.TrimPrefix(pattern, "file="), wd, workspace)
+			if err != nil {
+				return nil, err
+			}
+			// The file is assumed to be in a package named after its directory.
+			// Bazel accepts paths of source files as labels.
+			p.targets = append(p.targets, fmt.Sprintf("rdeps(%s, %s, 1)", strconv.Quote(dirLabel(path.Dir(rel), ":*")), strconv.Quote(rel)))
+
+		case strings.HasPrefix(pattern, "//") || strings.HasPrefix(pattern, "@"):
+			p.targets = append(p.targets, strconv.Quote(pattern))
+
+		case pattern == "." || pattern == ".." || pattern == "..." || strings.HasPrefix(pattern, "./") || strings.HasPrefix(pattern, "../") || filepath.IsAbs(pattern):
+			dir, suffix := pattern, ":*"
+			if pattern == "..." || strings.HasSuffix(pattern, "/...") {
+				dir, suffix = strings.TrimSuffix(strings.TrimSuffix(pattern, "..."), "/"), "/..."
+			}
+			rel, err := workspacePath(dir, wd, workspace)
+			if err != nil {
+				return nil, err
+			}
+			p.targets = append(p.targets, strconv.Quote(dirLabel(rel, suffix)))
+
+		case isStandard(pattern):
+			p.std = append(p.std, pattern)
+
+		default:
+			return nil, fmt.Errorf("%s: import path patterns are only supported for standard packages; use a label, a directory like ./foo, or file=path", pattern)
+		}
+	}
+	return p, nil
+}
+
+// queryExpr returns a query for the Go rules matched by p, or "" if p has
+// no target expressions. go_test rules are only included if tests is true.
+func (p *patternSet) queryExpr(tests bool) string {
+	if len(p.targets) == 0 {
+		return ""
+	}
+	kinds := "go_(library|binary) rule"
+	if tests {
+		kinds = "go_(library|binary|test) rule"
+	}
+	return fmt.Sprintf("kind(%q, %s)", kinds, strings.Join(p.targets, " + "))
+}
+
+// workspacePath returns the slash-separated path of p, relative to
+// workspace. p may be absolute or relative to wd.
+func workspacePath(p, wd, workspace string) (string, error) {
+	if p == "" {
+		p = "."
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(wd, p)
+	}
+	rel, err := filepath.Rel(workspace, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not in the workspace %s", p, workspace)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// dirLabel returns a target pattern for the directory rel, like //rel:* or
+// //rel/..., depending on suffix.
+func dirLabel(rel, suffix string) string {
+	if rel == "." {
+		rel = ""
+	}
+	if rel == "" && suffix == "/..." {
+		return "//..."
+	}
+	return "//" + rel + suffix
+}
+
+// isStandard returns whether importpath is in the standard library, which
+// is assumed for paths whose first element has no dot.
+func isStandard(importpath string) bool {
+	first := strings.SplitN(importpath, "/", 2)[0]
+	return first != "" && !strings.Contains(first, ".")
+}
@@ -0,0 +1,77 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePatterns(t *testing.T) {
+	ws := filepath.FromSlash("/ws")
+	wd := filepath.Join(ws, "foo")
+	p, err := parsePatterns([]string{
+		"//bar:go_default_library",
+		"@org_x//y/...",
+		".",
+		"./...",
+		"../baz",
+		"...",
+		"file=" + filepath.Join(ws, "foo", "sub", "x.go"),
+		"file=y.go",
+		"fmt",
+		"builtin",
+	}, wd, ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTargets := []string{
+		`"//bar:go_default_library"`,
+		`"@org_x//y/..."`,
+		`"//foo:*"`,
+		`"//foo/..."`,
+		`"//baz:*"`,
+		`"//foo/..."`,
+		`rdeps("//foo/sub:*", "foo/sub/x.go", 1)`,
+		`rdeps("//foo:*", "foo/y.go", 1)`,
+	}
+	if !reflect.DeepEqual(p.targets, wantTargets) {
+		t.Errorf("got targets %q; want %q", p.targets, wantTargets)
+	}
+	if want := []string{"fmt", "builtin"}; !reflect.DeepEqual(p.std, want) {
+		t.Errorf("got std %q; want %q", p.std, want)
+	}
+
+	for _, bad := range []string{"example.com/foo", "../../outside", "file=/elsewhere/x.go"} {
+		if _, err := parsePatterns([]string{bad}, wd, ws); err == nil {
+			t.Errorf("%s: got success; want error", bad)
+		}
+	}
+}
+
+func TestQueryExpr(t *testing.T) {
+	p := &patternSet{targets: []string{`"//foo:*"`, `"//bar/..."`}}
+	if got, want := p.queryExpr(false), `kind("go_(library|binary) rule", "//foo:*" + "//bar/...")`; got != want {
+		t.Errorf("without tests: got %s; want %s", got, want)
+	}
+	if got, want := p.queryExpr(true), `kind("go_(library|binary|test) rule", "//foo:*" + "//bar/...")`; got != want {
+		t.Errorf("with tests: got %s; want %s", got, want)
+	}
+	if got := (&patternSet{std: []string{"fmt"}}).queryExpr(true); got != "" {
+		t.Errorf("std only: got %s; want empty", got)
+	}
+}
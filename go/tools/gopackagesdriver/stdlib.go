@@ -0,0 +1,116 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// stdPackage is a package printed by "go list -json".
+type stdPackage struct {
+	ImportPath string
+	Name       string
+	Dir        string
+	GoFiles    []string
+	Imports    []string
+	Error      *struct{ Err string }
+}
+
+// listStd lists the standard packages with goTool. If goroot is not empty,
+// it's used as GOROOT. cgo is disabled, so files that need it are excluded,
+// since they can't be type checked from source.
+func listStd(goTool, goroot string) (map[string]*stdPackage, error) {
+	cmd := exec.Command(goTool, "list", "-e", "-json", "std", "builtin")
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if goroot != "" {
+		cmd.Env = append(cmd.Env, "GOROOT="+goroot)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list standard packages: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return parseStd(bytes.NewReader(out))
+}
+
+// parseStd parses the output of "go list -json", which is a sequence of
+// JSON objects.
+func parseStd(r io.Reader) (map[string]*stdPackage, error) {
+	pkgs := make(map[string]*stdPackage)
+	d := json.NewDecoder(r)
+	for {
+		var p stdPackage
+		if err := d.Decode(&p); err == io.EOF {
+			return pkgs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse go list output: %v", err)
+		}
+		pkgs[p.ImportPath] = &p
+	}
+}
+
+// addStd adds the standard packages in needed, and the packages they
+// import, to pkgs.
+func addStd(pkgs map[string]*driverPackage, std map[string]*stdPackage, needed map[string]bool) {
+	var queue []string
+	for imp := range needed {
+		queue = append(queue, imp)
+	}
+	for len(queue) > 0 {
+		imp := queue[0]
+		queue = queue[1:]
+		if _, ok := pkgs[imp]; ok {
+			continue
+		}
+		p, ok := std[imp]
+		if !ok {
+			pkgs[imp] = &driverPackage{
+				ID:      imp,
+				PkgPath: imp,
+				Errors:  []packageError{{Msg: fmt.Sprintf("standard package %q not found", imp), Kind: listError}},
+			}
+			continue
+		}
+		pkg := &driverPackage{
+			ID:      p.ImportPath,
+			Name:    p.Name,
+			PkgPath: p.ImportPath,
+			Imports: make(map[string]string),
+		}
+		for _, f := range p.GoFiles {
+			pkg.GoFiles = append(pkg.GoFiles, filepath.Join(p.Dir, f))
+		}
+		pkg.CompiledGoFiles = pkg.GoFiles
+		if p.Error != nil {
+			pkg.Errors = append(pkg.Errors, packageError{Msg: p.Error.Err, Kind: listError})
+		}
+		// Packages vendored into the standard library are listed with their
+		// full paths, but imported without the vendor prefix.
+		for _, dep := range p.Imports {
+			pkg.Imports[strings.TrimPrefix(dep, "vendor/")] = dep
+			queue = append(queue, dep)
+		}
+		pkgs[imp] = pkg
+	}
+}
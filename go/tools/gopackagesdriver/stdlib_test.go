@@ -0,0 +1,92 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddStd(t *testing.T) {
+	std, err := parseStd(strings.NewReader(`{
+	"ImportPath": "fmt",
+	"Name": "fmt",
+	"Dir": "/goroot/src/fmt",
+	"GoFiles": ["print.go"],
+	"Imports": ["errors", "vendor/golang.org/x/text/unicode"]
+}
+{
+	"ImportPath": "errors",
+	"Name": "errors",
+	"Dir": "/goroot/src/errors",
+	"GoFiles": ["errors.go"]
+}
+{
+	"ImportPath": "vendor/golang.org/x/text/unicode",
+	"Name": "unicode",
+	"Dir": "/goroot/src/vendor/golang.org/x/text/unicode",
+	"GoFiles": ["unicode.go"],
+	"Error": {"Err": "broken"}
+}
+{
+	"ImportPath": "os",
+	"Name": "os",
+	"Dir": "/goroot/src/os"
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(std) != 4 {
+		t.Fatalf("got %d standard packages; want 4", len(std))
+	}
+
+	pkgs := make(map[string]*driverPackage)
+	addStd(pkgs, std, map[string]bool{"fmt": true, "nonexistent": true})
+
+	var ids []string
+	for id := range pkgs {
+		ids = append(ids, id)
+	}
+	if want := 4; len(ids) != want {
+		t.Errorf("got packages %q; want %d packages", ids, want)
+	}
+	fmtPkg := pkgs["fmt"]
+	if fmtPkg == nil {
+		t.Fatal("fmt not added")
+	}
+	wantImports := map[string]string{
+		"errors":                    "errors",
+		"golang.org/x/text/unicode": "vendor/golang.org/x/text/unicode",
+	}
+	if !reflect.DeepEqual(fmtPkg.Imports, wantImports) {
+		t.Errorf("got fmt imports %v; want %v", fmtPkg.Imports, wantImports)
+	}
+	if want := []string{filepath.Join("/goroot/src/fmt", "print.go")}; !reflect.DeepEqual(fmtPkg.GoFiles, want) {
+		t.Errorf("got fmt files %q; want %q", fmtPkg.GoFiles, want)
+	}
+	if p := pkgs["vendor/golang.org/x/text/unicode"]; p == nil || len(p.Errors) != 1 || p.Errors[0].Msg != "broken" {
+		t.Errorf("got vendored package %+v; want a package with an error", p)
+	}
+	if p := pkgs["nonexistent"]; p == nil || len(p.Errors) != 1 {
+		t.Errorf("got missing package %+v; want a package with an error", p)
+	}
+	if _, ok := pkgs["os"]; ok {
+		t.Errorf("os was added but not imported")
+	}
+}
@@ -0,0 +1,168 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package modproxy reads Go modules from module proxies, following the same
+// GOPROXY rules as the go command. It's shared by fetch_repo, which
+// downloads modules for go_repository, and wtool, which looks up their
+// latest versions.
+package modproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultGoProxy is used when GOPROXY is not set. It matches the go command.
+const DefaultGoProxy = "https://proxy.golang.org,direct"
+
+// ErrNotFound is returned by Get when a proxy doesn't have a file.
+var ErrNotFound = errors.New("not found")
+
+// Spec is an entry in GOPROXY.
+type Spec struct {
+	// URL is the proxy's base URL, or "direct" or "off".
+	URL string
+
+	// FallBackOnError is true if the next proxy should be tried after any
+	// error from this one. Otherwise, the next proxy is only tried if this
+	// one doesn't have the module. This is true for entries followed by
+	// "|" instead of ",".
+	FallBackOnError bool
+}
+
+// ParseList parses the value of GOPROXY.
+func ParseList(s string) ([]Spec, error) {
+	var specs []Spec
+	for s != "" {
+		i := strings.IndexAny(s, ",|")
+		var u string
+		fallBackOnError := false
+		if i < 0 {
+			u, s = s, ""
+		} else {
+			u = s[:i]
+			fallBackOnError = s[i] == '|'
+			s = s[i+1:]
+		}
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		specs = append(specs, Spec{URL: strings.TrimSuffix(u, "/"), FallBackOnError: fallBackOnError})
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("GOPROXY list is empty")
+	}
+	return specs, nil
+}
+
+// Get returns the file at rel, a slash-separated path like
+// "example.com/mod/@v/v1.0.0.zip", from the proxy at baseURL. ErrNotFound
+// is returned if the proxy doesn't have it. file:// URLs are read from the
+// local file system, so a mirror may be used offline.
+func Get(baseURL, rel string) ([]byte, error) {
+	if strings.HasPrefix(baseURL, "file://") {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(filepath.Join(filepath.FromSlash(u.Path), filepath.FromSlash(rel)))
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return data, err
+	}
+
+	resp, err := http.Get(baseURL + "/" + rel)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// EscapePath escapes a module path or version for use in a proxy URL.
+// Upper-case letters are replaced with "!" and the lower-case letter, since
+// proxies may be served from case-insensitive file systems.
+func EscapePath(s string) (string, error) {
+	var buf bytes.Buffer
+	for _, r := range s {
+		switch {
+		case r == '!' || r >= utf8.RuneSelf:
+			return "", fmt.Errorf("invalid module path or version %q", s)
+		case 'A' <= r && r <= 'Z':
+			buf.WriteByte('!')
+			buf.WriteRune(r + 'a' - 'A')
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String(), nil
+}
+
+// HashZip returns the "h1:" hash of a module zip file, as written in
+// go.sum. It's a SHA-256 hash of a summary listing the SHA-256 hash and name
+// of each file, sorted by name.
+func HashZip(data []byte) (string, error) {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	files := make(map[string]*zip.File)
+	var names []string
+	for _, f := range z.File {
+		if strings.Contains(f.Name, "\n") {
+			return "", fmt.Errorf("file name %q contains a newline", f.Name)
+		}
+		files[f.Name] = f
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+
+	summary := sha256.New()
+	for _, name := range names {
+		r, err := files[name].Open()
+		if err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(summary, "%x  %s\n", h.Sum(nil), name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(summary.Sum(nil)), nil
+}
@@ -0,0 +1,130 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package modproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	for _, tc := range []struct {
+		label, proxy string
+		want         []Spec
+	}{
+		{
+			label: "single",
+			proxy: "https://proxy.example.com/",
+			want:  []Spec{{URL: "https://proxy.example.com"}},
+		},
+		{
+			label: "fallback on not found",
+			proxy: "https://a.example.com,direct",
+			want:  []Spec{{URL: "https://a.example.com"}, {URL: "direct"}},
+		},
+		{
+			label: "fallback on error",
+			proxy: "https://a.example.com|https://b.example.com,off",
+			want: []Spec{
+				{URL: "https://a.example.com", FallBackOnError: true},
+				{URL: "https://b.example.com"},
+				{URL: "off"},
+			},
+		},
+	} {
+		got, err := ParseList(tc.proxy)
+		if err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("[%s] Expected %+v, got %+v", tc.label, tc.want, got)
+		}
+	}
+	if _, err := ParseList(" , "); err == nil {
+		t.Errorf("empty list: expected error")
+	}
+}
+
+func TestEscapePath(t *testing.T) {
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"example.com/mod", "example.com/mod"},
+		{"github.com/Azure/Go-Sdk", "github.com/!azure/!go-!sdk"},
+		{"v1.0.0-RC1", "v1.0.0-!r!c1"},
+	} {
+		if got, err := EscapePath(tc.path); err != nil {
+			t.Errorf("EscapePath(%q): %v", tc.path, err)
+		} else if got != tc.want {
+			t.Errorf("EscapePath(%q) = %q; want %q", tc.path, got, tc.want)
+		}
+	}
+	if _, err := EscapePath("example.com/!mod"); err == nil {
+		t.Errorf("EscapePath with '!': expected error")
+	}
+}
+
+func TestGet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/mod/@latest":
+			w.Write([]byte("latest"))
+		case "/example.com/gone/@latest":
+			http.Error(w, "gone", http.StatusGone)
+		default:
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "modproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "example.com", "mod", "@v"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "example.com", "mod", "@v", "list"), []byte("v1.0.0\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		baseURL, rel, want string
+		wantErr            error
+	}{
+		{baseURL: srv.URL, rel: "example.com/mod/@latest", want: "latest"},
+		{baseURL: srv.URL, rel: "example.com/gone/@latest", wantErr: ErrNotFound},
+		{baseURL: "file://" + filepath.ToSlash(dir), rel: "example.com/mod/@v/list", want: "v1.0.0\n"},
+		{baseURL: "file://" + filepath.ToSlash(dir), rel: "example.com/missing/@v/list", wantErr: ErrNotFound},
+	} {
+		got, err := Get(tc.baseURL, tc.rel)
+		if err != tc.wantErr {
+			t.Errorf("Get(%q, %q): got error %v; want %v", tc.baseURL, tc.rel, err, tc.wantErr)
+		} else if string(got) != tc.want {
+			t.Errorf("Get(%q, %q) = %q; want %q", tc.baseURL, tc.rel, got, tc.want)
+		}
+	}
+	if _, err := Get(srv.URL, "example.com/broken/@latest"); err == nil || err == ErrNotFound {
+		t.Errorf("Get with a server error: got %v; want another error", err)
+	}
+}
@@ -0,0 +1,430 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nogo runs static analyzers written with
+// golang.org/x/tools/go/analysis on Go packages while they're built, so
+// findings fail the build like compile errors do.
+//
+// A nogo binary is generated by the nogo rule in //go:def.bzl. It calls Main
+// with the analyzers it was built with. nogo_aspect runs the binary on each
+// go_library with its sources and the compiled archives of its
+// dependencies, which are used to type check the package.
+//
+// Analyzers may be configured with a JSON file mapping analyzer names to
+// Config values, to exempt files from an analyzer or to limit it to some
+// files, for example:
+//
+//	{
+//	  "printf": {
+//	    "exclude_files": {
+//	      "^third_party/": "third-party code isn't ours to fix"
+//	    }
+//	  }
+//	}
+//
+// Facts are only shared between analyzers within a package. Analyzers that
+// depend on facts about imported packages run, but see no facts for them.
+package nogo
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+// Config controls which files an analyzer's findings are reported for. Keys
+// of both maps are regular expressions matched against file paths, relative
+// to the execution root, like "foo/bar.go". Values describe why the entry is
+// there and are otherwise ignored.
+type Config struct {
+	// ExcludeFiles lists files whose findings are ignored.
+	ExcludeFiles map[string]string `json:"exclude_files"`
+
+	// OnlyFiles, if not empty, lists the only files findings are reported
+	// for.
+	OnlyFiles map[string]string `json:"only_files"`
+}
+
+// Main runs analyzers on the package described by the command line and
+// exits. It exits with status 1 if there are findings or errors.
+func Main(analyzers ...*analysis.Analyzer) {
+	log.SetPrefix("nogo: ")
+	log.SetFlags(0)
+	if err := Run(analyzers, os.Args[1:], os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Run runs analyzers on the package described by args. Findings are written
+// to the file named by -o, which is created even if there are none, so
+// Bazel has an output. If there are findings, they're also printed to
+// stderr, and an error is returned.
+func Run(analyzers []*analysis.Analyzer, args []string, stderr io.Writer) error {
+	fs := flag.NewFlagSet("nogo", flag.ContinueOnError)
+	importPath := fs.String("importpath", "", "import path of the package being checked")
+	configPath := fs.String("config", "", "JSON file mapping analyzer names to configurations")
+	stdlib := fs.String("stdlib", "", "directory containing compiled standard packages. If empty, the default importer is used for them")
+	out := fs.String("o", "", "file to write findings to")
+	archives := archiveFlag{}
+	fs.Var(archives, "archive", "importpath=file: compiled archive of a direct dependency (can specify multiple times)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *importPath == "" || *out == "" {
+		return errors.New("-importpath and -o must be set")
+	}
+
+	configs := make(map[string]Config)
+	if *configPath != "" {
+		data, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &configs); err != nil {
+			return fmt.Errorf("%s: %v", *configPath, err)
+		}
+	}
+	checks, err := newChecks(analyzers, configs)
+	if err != nil {
+		return err
+	}
+
+	fset := token.NewFileSet()
+	files, err := parseFiles(fset, fs.Args())
+	if err != nil {
+		return err
+	}
+	findings, err := checkPackage(fset, *importPath, files, newImporter(fset, archives, *stdlib), checks)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*out, []byte(strings.Join(findings, "")), 0666); err != nil {
+		return err
+	}
+	if len(findings) > 0 {
+		fmt.Fprint(stderr, strings.Join(findings, ""))
+		return fmt.Errorf("%s: %d findings", *importPath, len(findings))
+	}
+	return nil
+}
+
+// archiveFlag maps import paths to the files of compiled archives.
+type archiveFlag map[string]string
+
+func (f archiveFlag) String() string { return "" }
+
+func (f archiveFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid archive %q: want importpath=file", s)
+	}
+	f[s[:i]] = s[i+1:]
+	return nil
+}
+
+// check is an analyzer with its compiled configuration.
+type check struct {
+	analyzer           *analysis.Analyzer
+	excludeFiles, only []*regexp.Regexp
+}
+
+func newChecks(analyzers []*analysis.Analyzer, configs map[string]Config) ([]*check, error) {
+	var checks []*check
+	byName := make(map[string]*check)
+	for _, a := range analyzers {
+		c := &check{analyzer: a}
+		checks = append(checks, c)
+		byName[a.Name] = c
+	}
+	for name, config := range configs {
+		c, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("configuration for unknown analyzer %q", name)
+		}
+		var err error
+		if c.excludeFiles, err = compileRegexps(name, config.ExcludeFiles); err != nil {
+			return nil, err
+		}
+		if c.only, err = compileRegexps(name, config.OnlyFiles); err != nil {
+			return nil, err
+		}
+	}
+	return checks, nil
+}
+
+func compileRegexps(name string, patterns map[string]string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("analyzer %q: %v", name, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// reports returns whether findings in the file named filename are reported.
+func (c *check) reports(filename string) bool {
+	for _, re := range c.excludeFiles {
+		if re.MatchString(filename) {
+			return false
+		}
+	}
+	if len(c.only) == 0 {
+		return true
+	}
+	for _, re := range c.only {
+		if re.MatchString(filename) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFiles parses the files that match the build context, which is set
+// by GOOS, GOARCH, and related environment variables, like the compiler's.
+// Files generated by cgo are skipped.
+func parseFiles(fset *token.FileSet, filenames []string) ([]*ast.File, error) {
+	var files []*ast.File
+	for _, filename := range filenames {
+		dir, base := filepath.Split(filename)
+		if strings.HasPrefix(base, "_cgo") {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, base); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no Go files to check")
+	}
+	return files, nil
+}
+
+// newImporter returns an importer that reads packages from archives, and
+// standard packages from stdlib.
+func newImporter(fset *token.FileSet, archives map[string]string, stdlib string) types.Importer {
+	lookup := func(path string) (io.ReadCloser, error) {
+		if file, ok := archives[path]; ok {
+			return os.Open(file)
+		}
+		if stdlib != "" {
+			return os.Open(filepath.Join(stdlib, filepath.FromSlash(path)+".a"))
+		}
+		return nil, fmt.Errorf("no archive for %q", path)
+	}
+	if stdlib != "" {
+		return importer.ForCompiler(fset, "gc", lookup)
+	}
+	return &fallbackImporter{
+		archives: archives,
+		gc:       importer.ForCompiler(fset, "gc", lookup),
+		std:      importer.Default(),
+	}
+}
+
+// fallbackImporter imports packages in archives with gc and others with
+// std. It's used when standard packages aren't compiled, like in tests.
+type fallbackImporter struct {
+	archives map[string]string
+	gc, std  types.Importer
+}
+
+func (imp *fallbackImporter) Import(path string) (*types.Package, error) {
+	if _, ok := imp.archives[path]; ok {
+		return imp.gc.Import(path)
+	}
+	return imp.std.Import(path)
+}
+
+// checkPackage type checks a package and runs checks on it. It returns the
+// reported findings, sorted by position.
+func checkPackage(fset *token.FileSet, importPath string, files []*ast.File, imp types.Importer, checks []*check) ([]string, error) {
+	info := &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Implicits:  make(map[ast.Node]types.Object),
+		Scopes:     make(map[ast.Node]*types.Scope),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+	}
+	conf := types.Config{Importer: imp, FakeImportC: true}
+	pkg, err := conf.Check(importPath, fset, files, info)
+	if err != nil {
+		return nil, fmt.Errorf("type checking %s: %v", importPath, err)
+	}
+
+	r := &runner{
+		fset:    fset,
+		files:   files,
+		pkg:     pkg,
+		info:    info,
+		sizes:   types.SizesFor("gc", build.Default.GOARCH),
+		results: make(map[*analysis.Analyzer]*result),
+		facts:   make(map[factKey]analysis.Fact),
+	}
+	type finding struct {
+		pos token.Position
+		msg string
+	}
+	var found []finding
+	for _, c := range checks {
+		res := r.run(c.analyzer)
+		if res.err != nil {
+			return nil, fmt.Errorf("analyzer %s: %v", c.analyzer.Name, res.err)
+		}
+		for _, d := range res.diagnostics {
+			pos := fset.Position(d.Pos)
+			if c.reports(pos.Filename) {
+				found = append(found, finding{pos, fmt.Sprintf("%s: %s (%s)\n", pos, d.Message, c.analyzer.Name)})
+			}
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		a, b := found[i].pos, found[j].pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+	msgs := make([]string, len(found))
+	for i, f := range found {
+		msgs[i] = f.msg
+	}
+	return msgs, nil
+}
+
+// runner runs analyzers on a type-checked package, running each analyzer
+// once, after the analyzers it requires.
+type runner struct {
+	fset    *token.FileSet
+	files   []*ast.File
+	pkg     *types.Package
+	info    *types.Info
+	sizes   types.Sizes
+	results map[*analysis.Analyzer]*result
+	facts   map[factKey]analysis.Fact
+}
+
+type result struct {
+	value       interface{}
+	diagnostics []analysis.Diagnostic
+	err         error
+}
+
+// factKey identifies a fact about an object, or about the package if obj
+// is nil.
+type factKey struct {
+	obj types.Object
+	typ reflect.Type
+}
+
+func (r *runner) run(a *analysis.Analyzer) *result {
+	if res, ok := r.results[a]; ok {
+		return res
+	}
+	res := &result{}
+	r.results[a] = res
+	resultOf := make(map[*analysis.Analyzer]interface{})
+	for _, req := range a.Requires {
+		reqRes := r.run(req)
+		if reqRes.err != nil {
+			res.err = fmt.Errorf("required analyzer %s: %v", req.Name, reqRes.err)
+			return res
+		}
+		resultOf[req] = reqRes.value
+	}
+	pass := &analysis.Pass{
+		Analyzer:   a,
+		Fset:       r.fset,
+		Files:      r.files,
+		Pkg:        r.pkg,
+		TypesInfo:  r.info,
+		TypesSizes: r.sizes,
+		ResultOf:   resultOf,
+		Report: func(d analysis.Diagnostic) {
+			res.diagnostics = append(res.diagnostics, d)
+		},
+		ImportObjectFact: func(obj types.Object, fact analysis.Fact) bool {
+			return r.importFact(obj, fact)
+		},
+		ExportObjectFact: func(obj types.Object, fact analysis.Fact) {
+			r.facts[factKey{obj, reflect.TypeOf(fact)}] = fact
+		},
+		ImportPackageFact: func(pkg *types.Package, fact analysis.Fact) bool {
+			return pkg == r.pkg && r.importFact(nil, fact)
+		},
+		ExportPackageFact: func(fact analysis.Fact) {
+			r.facts[factKey{nil, reflect.TypeOf(fact)}] = fact
+		},
+		AllObjectFacts: func() []analysis.ObjectFact {
+			var facts []analysis.ObjectFact
+			for k, f := range r.facts {
+				if k.obj != nil {
+					facts = append(facts, analysis.ObjectFact{Object: k.obj, Fact: f})
+				}
+			}
+			return facts
+		},
+		AllPackageFacts: func() []analysis.PackageFact {
+			var facts []analysis.PackageFact
+			for k, f := range r.facts {
+				if k.obj == nil {
+					facts = append(facts, analysis.PackageFact{Package: r.pkg, Fact: f})
+				}
+			}
+			return facts
+		},
+	}
+	res.value, res.err = a.Run(pass)
+	return res
+}
+
+// importFact copies the fact of fact's type about obj into fact, and
+// returns whether there was one.
+func (r *runner) importFact(obj types.Object, fact analysis.Fact) bool {
+	f, ok := r.facts[factKey{obj, reflect.TypeOf(fact)}]
+	if !ok {
+		return false
+	}
+	reflect.ValueOf(fact).Elem().Set(reflect.ValueOf(f).Elem())
+	return true
+}
@@ -0,0 +1,164 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nogo
+
+import (
+	"bytes"
+	"go/ast"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+// noFoo reports functions named Foo. It exports a fact about each function
+// it visits and reports the count from a required analyzer's result, to
+// check that facts and results are passed along.
+var noFoo = &analysis.Analyzer{
+	Name:     "nofoo",
+	Doc:      "reports functions named Foo",
+	Requires: []*analysis.Analyzer{funcCount},
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		for _, f := range pass.Files {
+			for _, decl := range f.Decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.Name == "Foo" {
+					pass.Reportf(fn.Pos(), "don't name functions Foo (%d functions)", pass.ResultOf[funcCount].(int))
+				}
+			}
+		}
+		return nil, nil
+	},
+}
+
+type isFunc struct{}
+
+func (*isFunc) AFact() {}
+
+var funcCount = &analysis.Analyzer{
+	Name:      "funccount",
+	Doc:       "counts functions",
+	FactTypes: []analysis.Fact{new(isFunc)},
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		for _, obj := range pass.TypesInfo.Defs {
+			if fn, ok := obj.(*types.Func); ok && fn.Parent() == pass.Pkg.Scope() {
+				pass.ExportObjectFact(fn, new(isFunc))
+			}
+		}
+		n := 0
+		for _, f := range pass.AllObjectFacts() {
+			if _, ok := f.Fact.(*isFunc); ok {
+				n++
+			}
+		}
+		return n, nil
+	},
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "nogo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"foo.go": `package foo
+
+import "fmt"
+
+func Foo() { fmt.Println() }
+
+func Bar() {}
+`,
+		"gen/foo.go": `package foo
+
+func Baz() {}
+`,
+		"foo_plan9.go": `package foo
+
+func Foo() {}
+`,
+	}
+	var srcs []string
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, path)
+	}
+	out := filepath.Join(dir, "out.txt")
+
+	for _, tc := range []struct {
+		label, config, wantErr, want string
+	}{
+		{
+			label:   "no config",
+			wantErr: "1 findings",
+			want:    "foo.go:5:1: don't name functions Foo (3 functions) (nofoo)\n",
+		}, {
+			label:  "excluded",
+			config: `{"nofoo": {"exclude_files": {"/foo\\.go$": "testing"}}}`,
+		}, {
+			label:  "only other files",
+			config: `{"nofoo": {"only_files": {"/gen/": "testing"}}}`,
+		}, {
+			label:   "unknown analyzer",
+			config:  `{"nobar": {}}`,
+			wantErr: `unknown analyzer "nobar"`,
+		},
+	} {
+		args := []string{"-importpath", "example.com/foo", "-o", out}
+		if tc.config != "" {
+			configPath := filepath.Join(dir, "config.json")
+			if err := ioutil.WriteFile(configPath, []byte(tc.config), 0666); err != nil {
+				t.Fatal(err)
+			}
+			args = append(args, "-config", configPath)
+		}
+		os.Remove(out)
+		var stderr bytes.Buffer
+		err := Run([]*analysis.Analyzer{noFoo}, append(args, srcs...), &stderr)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("[%s] unexpected error: %v", tc.label, err)
+			continue
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("[%s] got error %v; want error containing %q", tc.label, err, tc.wantErr)
+			continue
+		}
+		if strings.Contains(tc.wantErr, "unknown") {
+			continue
+		}
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+			continue
+		}
+		if got := strings.Replace(string(data), dir+string(filepath.Separator), "", -1); got != tc.want {
+			t.Errorf("[%s] got findings %q; want %q", tc.label, got, tc.want)
+		}
+		if got := strings.Replace(stderr.String(), dir+string(filepath.Separator), "", -1); got != tc.want {
+			t.Errorf("[%s] got stderr %q; want %q", tc.label, got, tc.want)
+		}
+	}
+}
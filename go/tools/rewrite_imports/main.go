@@ -0,0 +1,97 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command rewrite_imports rewrites import paths in Go source files by
+// prefix. For example,
+//
+//	rewrite_imports -prefix github.com/foo/bar=example.com/third_party/bar dir
+//
+// changes imports of github.com/foo/bar and its subpackages in all .go files
+// under dir. Only import paths are changed; formatting is preserved.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pmcalpine/rules_go/go/tools/rewrite_imports/rewrite"
+)
+
+// multiFlag allows repeated string flags to be collected into a slice
+type multiFlag []string
+
+func (m *multiFlag) String() string {
+	if len(*m) == 0 {
+		return ""
+	}
+	return fmt.Sprint(*m)
+}
+
+func (m *multiFlag) Set(v string) error {
+	(*m) = append(*m, v)
+	return nil
+}
+
+func run(args []string) error {
+	prefixes := multiFlag{}
+	fs := flag.NewFlagSet("rewrite_imports", flag.ExitOnError)
+	fs.Var(&prefixes, "prefix", "old=new: rewrite import paths starting with old to start with new instead (can specify multiple times)")
+	list := fs.Bool("l", false, "list files whose imports would change, but don't modify them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(prefixes) == 0 {
+		return fmt.Errorf("at least one -prefix must be given")
+	}
+	m := make(rewrite.PrefixMap)
+	for _, p := range prefixes {
+		i := strings.Index(p, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid -prefix %q: want old=new", p)
+		}
+		m[p[:i]] = p[i+1:]
+	}
+
+	dirs := fs.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	var lastErr error
+	for _, dir := range dirs {
+		changed, err := m.Tree(dir, *list)
+		for _, p := range changed {
+			fmt.Println(p)
+		}
+		if err != nil {
+			log.Print(err)
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("some files could not be rewritten")
+	}
+	return nil
+}
+
+func main() {
+	log.SetPrefix("rewrite_imports: ")
+	log.SetFlags(0) // don't print timestamps
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
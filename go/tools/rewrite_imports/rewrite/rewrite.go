@@ -0,0 +1,200 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rewrite rewrites import paths in Go source files.
+//
+// Only import path literals (and "// import" comments on package clauses)
+// are changed. The rest of each file, including formatting and comments, is
+// preserved byte for byte.
+package rewrite
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PrefixMap maps import path prefixes to replacement prefixes. A prefix
+// matches an import path if it is equal to the path or if it is followed by
+// a slash in the path. If more than one prefix matches, the longest one
+// is used.
+type PrefixMap map[string]string
+
+// ImportPath returns the rewritten form of importpath and true if some
+// prefix in m matches. Otherwise, it returns importpath and false.
+func (m PrefixMap) ImportPath(importpath string) (string, bool) {
+	best := ""
+	found := false
+	for old := range m {
+		if importpath != old && !strings.HasPrefix(importpath, old+"/") {
+			continue
+		}
+		if !found || len(old) > len(best) {
+			best = old
+			found = true
+		}
+	}
+	if !found {
+		return importpath, false
+	}
+	return m[best] + importpath[len(best):], true
+}
+
+// Source rewrites import paths in the Go source src. filename is only used
+// in error messages. Source returns the new source and whether anything
+// was changed.
+func (m PrefixMap) Source(filename string, src []byte) ([]byte, bool, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var edits []edit
+	if c, ok := importComment(fset, f); ok {
+		if imp, err := strconv.Unquote(c.text); err == nil {
+			if newImp, ok := m.ImportPath(imp); ok && newImp != imp {
+				edits = append(edits, edit{c.start, c.end, strconv.Quote(newImp)})
+			}
+		}
+	}
+	for _, spec := range f.Imports {
+		imp, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		newImp, ok := m.ImportPath(imp)
+		if !ok || newImp == imp {
+			continue
+		}
+		start := fset.Position(spec.Path.Pos()).Offset
+		end := fset.Position(spec.Path.End()).Offset
+		edits = append(edits, edit{start, end, strconv.Quote(newImp)})
+	}
+	if len(edits) == 0 {
+		return src, false, nil
+	}
+
+	// The package clause comes before imports, so edits are already sorted.
+	out := make([]byte, 0, len(src))
+	last := 0
+	for _, e := range edits {
+		out = append(out, src[last:e.start]...)
+		out = append(out, e.text...)
+		last = e.end
+	}
+	out = append(out, src[last:]...)
+	return out, true, nil
+}
+
+// edit replaces the bytes between start and end with text.
+type edit struct {
+	start, end int
+	text       string
+}
+
+// importComment locates the quoted path in an import comment following
+// the package clause, like
+//
+//	package foo // import "example.com/foo"
+func importComment(fset *token.FileSet, f *ast.File) (edit, bool) {
+	line := fset.Position(f.Name.End()).Line
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if fset.Position(c.Pos()).Line != line || !strings.HasPrefix(c.Text, "//") {
+				continue
+			}
+			text := c.Text[len("//"):]
+			trimmed := strings.TrimLeft(text, " \t")
+			if !strings.HasPrefix(trimmed, "import ") {
+				continue
+			}
+			quoted := strings.TrimSpace(trimmed[len("import "):])
+			if len(quoted) < 2 || quoted[0] != '"' {
+				continue
+			}
+			offset := fset.Position(c.Pos()).Offset + len("//") + len(text) - len(trimmed)
+			offset += strings.Index(trimmed, quoted)
+			return edit{start: offset, end: offset + len(quoted), text: quoted}, true
+		}
+	}
+	return edit{}, false
+}
+
+// Tree rewrites import paths in all .go files in dir and its
+// subdirectories. Directories named "testdata" or starting with "." or
+// "_" are skipped, as the go tool does. If dryRun is true, files are not
+// modified. Tree returns the paths of the files that were (or would have
+// been) changed. Files that can't be parsed are left alone and reported
+// in the returned error after the rest of the tree has been processed.
+func (m PrefixMap) Tree(dir string, dryRun bool) ([]string, error) {
+	var changed []string
+	var parseErrs ErrorList
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		base := fi.Name()
+		if fi.IsDir() {
+			if p != dir && (base == "testdata" || strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(base, ".go") {
+			return nil
+		}
+		src, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		out, ok, err := m.Source(p, src)
+		if err != nil {
+			parseErrs = append(parseErrs, err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		changed = append(changed, p)
+		if dryRun {
+			return nil
+		}
+		return ioutil.WriteFile(p, out, fi.Mode().Perm())
+	})
+	if err != nil {
+		return changed, err
+	}
+	if len(parseErrs) > 0 {
+		return changed, parseErrs
+	}
+	return changed, nil
+}
+
+// ErrorList is a list of errors encountered while processing a tree.
+type ErrorList []error
+
+func (e ErrorList) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
@@ -0,0 +1,148 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rewrite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestImportPath(t *testing.T) {
+	m := PrefixMap{
+		"github.com/foo/bar":     "example.com/bar",
+		"github.com/foo/bar/baz": "example.com/baz",
+	}
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"github.com/foo/bar", "example.com/bar", true},
+		{"github.com/foo/bar/x", "example.com/bar/x", true},
+		{"github.com/foo/bar/baz/x", "example.com/baz/x", true},
+		{"github.com/foo/barbell", "github.com/foo/barbell", false},
+		{"fmt", "fmt", false},
+	} {
+		got, ok := m.ImportPath(tc.in)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("ImportPath(%q): got %q, %v; want %q, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestSource(t *testing.T) {
+	m := PrefixMap{"github.com/foo/bar": "example.com/repo/third_party/github.com/foo/bar"}
+	for _, tc := range []struct {
+		desc, src, want string
+	}{
+		{
+			desc: "unchanged",
+			src: `package foo
+
+import "fmt"
+`,
+			want: `package foo
+
+import "fmt"
+`,
+		}, {
+			desc: "imports",
+			src: `package foo
+
+import (
+	"fmt"
+	bar "github.com/foo/bar"  // comment
+	"github.com/foo/bar/baz"
+	"github.com/foo/barbell"
+)
+`,
+			want: `package foo
+
+import (
+	"fmt"
+	bar "example.com/repo/third_party/github.com/foo/bar"  // comment
+	"example.com/repo/third_party/github.com/foo/bar/baz"
+	"github.com/foo/barbell"
+)
+`,
+		}, {
+			desc: "import comment",
+			src: `package bar // import "github.com/foo/bar"
+
+import _ "github.com/foo/bar/baz"
+`,
+			want: `package bar // import "example.com/repo/third_party/github.com/foo/bar"
+
+import _ "example.com/repo/third_party/github.com/foo/bar/baz"
+`,
+		},
+	} {
+		got, changed, err := m.Source("foo.go", []byte(tc.src))
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", tc.desc, got, tc.want)
+		}
+		if wantChanged := tc.src != tc.want; changed != wantChanged {
+			t.Errorf("%s: got changed %v; want %v", tc.desc, changed, wantChanged)
+		}
+	}
+}
+
+func TestTree(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "rewrite_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.go":             "package a\n\nimport \"old/x\"\n",
+		"sub/b.go":         "package b\n\nimport \"fmt\"\n",
+		"testdata/c.go":    "package c\n\nimport \"old/x\"\n",
+		"sub/README.txt":   "import \"old/x\"\n",
+		"broken/broken.go": "not go",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := PrefixMap{"old": "new"}
+	changed, err := m.Tree(dir, false)
+	if _, ok := err.(ErrorList); !ok {
+		t.Errorf("got error %v; want ErrorList for broken.go", err)
+	}
+	if want := []string{filepath.Join(dir, "a.go")}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("got changed %q; want %q", changed, want)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "a.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "package a\n\nimport \"new/x\"\n"; string(got) != want {
+		t.Errorf("got a.go:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,321 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command vendor_repo copies an external Go repository into a directory of
+// the current workspace (by default, third_party/<importpath>) and generates
+// BUILD files for it. It is intended for organizations that check all of
+// their dependencies into their own repository instead of declaring them
+// with go_repository.
+//
+// The repository is either fetched (like fetch_repo does) or copied from a
+// directory where it was already fetched. BUILD files from upstream are
+// discarded. Import paths within the vendored code may optionally be
+// rewritten to point to the new location. Information about where the code
+// came from is recorded in a VENDORED.json file in the vendored directory.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	bf "github.com/bazelbuild/buildtools/build"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/config"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/formats"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/packages"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/rules"
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/wspace"
+	"github.com/pmcalpine/rules_go/go/tools/rewrite_imports/rewrite"
+	"golang.org/x/tools/go/vcs"
+)
+
+var (
+	importpath    = flag.String("importpath", "", "Go import path of the repository to vendor (required)")
+	src           = flag.String("src", "", "directory containing an already fetched copy of the repository. If not set,\n\tthe repository is fetched using -remote and -vcs, or by resolving -importpath.")
+	remote        = flag.String("remote", "", "The URI of the remote repository. Must be used with the --vcs flag.")
+	cmd           = flag.String("vcs", "", "Version control system to use to fetch the repository. Should be one of: git,hg,svn,bzr. Must be used with the --remote flag.")
+	rev           = flag.String("rev", "", "target revision")
+	repoRoot      = flag.String("repo_root", "", "path to the workspace root. If not set, it is found by searching upward for WORKSPACE.")
+	goPrefix      = flag.String("go_prefix", "", "go_prefix of the workspace. Required with -rewrite.")
+	thirdParty    = flag.String("third_party", "third_party", "directory, relative to the workspace root, that vendored repositories are copied into")
+	rewriteFlag   = flag.Bool("rewrite", false, "if true, rewrite import paths in the vendored code to its new location under -go_prefix")
+	force         = flag.Bool("force", false, "if true, replace an existing vendored copy of the repository")
+	buildFileName = flag.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names.\n\tThe first element of the list is the name of output build files to generate.")
+
+	// Used for overriding in tests to disable network calls.
+	repoRootForImportPath = vcs.RepoRootForImportPath
+)
+
+// provenanceFile is the name of the file written into the root of each
+// vendored repository that records where it came from. Its content is a
+// formats.Provenance.
+const provenanceFile = "VENDORED.json"
+
+func getRepoRoot(remote, cmd, importpath string) (*vcs.RepoRoot, error) {
+	if (cmd == "") != (remote == "") {
+		return nil, fmt.Errorf("--remote should be used with the --vcs flag. If this is an import path, use --importpath instead.")
+	}
+
+	if cmd != "" && remote != "" {
+		v := vcs.ByCmd(cmd)
+		if v == nil {
+			return nil, fmt.Errorf("invalid VCS type: %s", cmd)
+		}
+		return &vcs.RepoRoot{
+			VCS:  v,
+			Repo: remote,
+			Root: importpath,
+		}, nil
+	}
+
+	r, err := repoRootForImportPath(importpath, true)
+	if err != nil {
+		return nil, err
+	}
+	if importpath != r.Root {
+		return nil, fmt.Errorf("not a root of a repository: %s", importpath)
+	}
+	return r, nil
+}
+
+func run() error {
+	if *importpath == "" {
+		return errors.New("-importpath must be set")
+	}
+	if *rewriteFlag && *goPrefix == "" {
+		return errors.New("-go_prefix must be set when -rewrite is used")
+	}
+
+	root := *repoRoot
+	if root == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if root, err = wspace.Find(cwd); err != nil {
+			return fmt.Errorf("-repo_root not specified, and WORKSPACE cannot be found: %v", err)
+		}
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	rel := path.Join(filepath.ToSlash(*thirdParty), *importpath)
+	dest := filepath.Join(root, filepath.FromSlash(rel))
+	if _, err := os.Stat(dest); err == nil {
+		if !*force {
+			return fmt.Errorf("%s already exists. Use -force to replace it.", dest)
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	info := formats.Provenance{
+		Version:    formats.ProvenanceVersion,
+		ImportPath: *importpath,
+		Revision:   *rev,
+	}
+	srcDir := *src
+	if srcDir == "" {
+		r, err := getRepoRoot(*remote, *cmd, *importpath)
+		if err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempDir("", "vendor_repo")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		srcDir = filepath.Join(tmp, "repo")
+		if *rev == "" {
+			err = r.VCS.Create(srcDir, r.Repo)
+		} else {
+			err = r.VCS.CreateAtRev(srcDir, r.Repo, *rev)
+		}
+		if err != nil {
+			return err
+		}
+		info.VCS = r.VCS.Cmd
+		info.Remote = r.Repo
+	} else {
+		info.Source = srcDir
+	}
+
+	buildFileNames := strings.Split(*buildFileName, ",")
+	if err := copyTree(dest, srcDir, buildFileNames); err != nil {
+		return err
+	}
+
+	if *rewriteFlag {
+		info.RewrittenTo = path.Join(*goPrefix, rel)
+		m := rewrite.PrefixMap{*importpath: info.RewrittenTo}
+		if _, err := m.Tree(dest, false); err != nil {
+			if _, ok := err.(rewrite.ErrorList); !ok {
+				return err
+			}
+			// Files that can't be parsed are left alone. The build will report them.
+			log.Print(err)
+		}
+	}
+
+	c := &config.Config{
+		Dirs:                []string{dest},
+		RepoRoot:            root,
+		ValidBuildFileNames: buildFileNames,
+		GenericTags:         make(config.BuildTags),
+		Platforms:           config.DefaultPlatformTags,
+		GoPrefix:            *goPrefix,
+		DepMode:             config.ExternalMode,
+	}
+	c.PreprocessTags()
+	if err := generateBuildFiles(c, dest, rel, *importpath, *rewriteFlag); err != nil {
+		return err
+	}
+
+	return writeProvenance(dest, info)
+}
+
+// copyTree copies regular files from srcDir into dest, creating dest if
+// needed. Version control metadata, WORKSPACE files, and build files with
+// names in buildFileNames are not copied, since they describe the upstream
+// repository rather than the vendored copy.
+func copyTree(dest, srcDir string, buildFileNames []string) error {
+	skip := map[string]bool{"WORKSPACE": true}
+	for _, name := range buildFileNames {
+		skip[name] = true
+	}
+	return filepath.Walk(srcDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		base := fi.Name()
+		if fi.IsDir() {
+			switch base {
+			case ".git", ".hg", ".svn", ".bzr":
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(dest, rel), 0755)
+		}
+		if !fi.Mode().IsRegular() || skip[base] {
+			return nil
+		}
+		return copyFile(filepath.Join(dest, rel), p, fi.Mode().Perm())
+	})
+}
+
+func copyFile(dest, src string, perm os.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// vendoredResolver resolves imports within a vendored repository which kept
+// its original import paths to labels under the vendored directory. Other
+// imports are resolved by the next resolver.
+type vendoredResolver struct {
+	importpath, pkg string
+	next            resolve.LabelResolver
+}
+
+func (r *vendoredResolver) Resolve(importpath, dir string) (resolve.Label, error) {
+	if importpath != r.importpath && !strings.HasPrefix(importpath, r.importpath+"/") {
+		return r.next.Resolve(importpath, dir)
+	}
+	pkg := path.Join(r.pkg, strings.TrimPrefix(importpath, r.importpath))
+	if pkg == dir {
+		return resolve.Label{Name: resolve.DefaultLibName, Relative: true}, nil
+	}
+	return resolve.Label{Pkg: pkg, Name: resolve.DefaultLibName}, nil
+}
+
+// generateBuildFiles generates a BUILD file for each package in the vendored
+// directory dest. rel is the slash-separated path of dest relative to the
+// repository root. If the vendored code was not rewritten, go_library rules
+// are given an importpath attribute matching the original import path, since
+// it can't be derived from go_prefix.
+func generateBuildFiles(c *config.Config, dest, rel, importpath string, rewritten bool) error {
+	r := resolve.NewLabelResolver(c)
+	if !rewritten {
+		r = &vendoredResolver{importpath: importpath, pkg: rel, next: r}
+	}
+
+	var errs []error
+	packages.Walk(c, dest, func(pkg *packages.Package, oldFile *bf.File) {
+		g := rules.NewGenerator(c, r, oldFile)
+		f := g.Generate(pkg)
+		if !rewritten {
+			pkgImportpath := path.Join(importpath, strings.TrimPrefix(pkg.Rel, rel))
+			for _, lib := range f.Rules("go_library") {
+				lib.SetAttr("importpath", &bf.StringExpr{Value: pkgImportpath})
+			}
+		}
+		rules.SortLabels(f)
+		bf.Rewrite(f, nil)
+		if err := ioutil.WriteFile(f.Path, bf.Format(f), 0644); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func writeProvenance(dest string, info formats.Provenance) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	return ioutil.WriteFile(filepath.Join(dest, provenanceFile), data, 0644)
+}
+
+func main() {
+	log.SetPrefix("vendor_repo: ")
+	log.SetFlags(0) // don't print timestamps
+	flag.Parse()
+
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pmcalpine/rules_go/go/tools/gazelle/resolve"
+)
+
+func TestCopyTree(t *testing.T) {
+	src, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "vendor_repo_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "vendor_repo_dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	for _, p := range []string{
+		"WORKSPACE",
+		"BUILD",
+		"a.go",
+		".git/HEAD",
+		"sub/BUILD.bazel",
+		"sub/b.go",
+	} {
+		path := filepath.Join(src, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := copyTree(dest, src, []string{"BUILD.bazel", "BUILD"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		exists bool
+	}{
+		{"a.go", true},
+		{"sub/b.go", true},
+		{"WORKSPACE", false},
+		{"BUILD", false},
+		{"sub/BUILD.bazel", false},
+		{".git", false},
+	} {
+		_, err := os.Stat(filepath.Join(dest, filepath.FromSlash(tc.path)))
+		if exists := err == nil; exists != tc.exists {
+			t.Errorf("%s: got exists %v; want %v", tc.path, exists, tc.exists)
+		}
+	}
+}
+
+type fakeResolver struct{}
+
+func (fakeResolver) Resolve(importpath, dir string) (resolve.Label, error) {
+	return resolve.Label{Repo: "external", Name: resolve.DefaultLibName}, nil
+}
+
+func TestVendoredResolver(t *testing.T) {
+	r := &vendoredResolver{
+		importpath: "github.com/foo/bar",
+		pkg:        "third_party/github.com/foo/bar",
+		next:       fakeResolver{},
+	}
+	for _, tc := range []struct {
+		importpath, dir, want string
+	}{
+		{"github.com/foo/bar", "third_party/github.com/foo/bar/baz", "//third_party/github.com/foo/bar:go_default_library"},
+		{"github.com/foo/bar/baz", "third_party/github.com/foo/bar", "//third_party/github.com/foo/bar/baz:go_default_library"},
+		{"github.com/foo/bar/baz", "third_party/github.com/foo/bar/baz", ":go_default_library"},
+		{"github.com/foo/barbell", "third_party/github.com/foo/bar", "@external//:go_default_library"},
+	} {
+		l, err := r.Resolve(tc.importpath, tc.dir)
+		if err != nil {
+			t.Errorf("Resolve(%q, %q): %v", tc.importpath, tc.dir, err)
+			continue
+		}
+		if got := l.String(); got != tc.want {
+			t.Errorf("Resolve(%q, %q): got %q; want %q", tc.importpath, tc.dir, got, tc.want)
+		}
+	}
+}
@@ -12,6 +12,13 @@ If wtool cannot figure out the bazel -> Go mapping, try
 Other Usage:
   wtool -asis github.com/golang/glog
 which takes an importpath, and computes the bazel name + ls-remote as above.
+
+To add a dependency by hand instead, use
+  wtool -print github.com/golang/glog
+which prints a go_repository rule for the module providing each importpath,
+with its latest version and sum from the module proxy named by GOPROXY.
+The sum isn't checked against the checksum database, so check it against
+go.sum before relying on it.
 */
 package main
 
@@ -19,11 +26,13 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	bf "github.com/bazelbuild/buildtools/build"
@@ -33,8 +42,9 @@ import (
 )
 
 var (
-	asis    = flag.Bool("asis", false, "if true, leave the import names as-is (by default they are treated as bazel converted names like org_golang_x_net")
-	verbose = flag.Bool("verbose", false, "if true, logging extra information")
+	asis       = flag.Bool("asis", false, "if true, leave the import names as-is (by default they are treated as bazel converted names like org_golang_x_net")
+	verbose    = flag.Bool("verbose", false, "if true, logging extra information")
+	printRules = flag.Bool("print", false, "if true, print go_repository rules for the modules providing the given Go importpaths, at their latest versions, instead of editing WORKSPACE. Sums are not verified against the checksum database")
 
 	knownPaths = map[string]string{
 		"org_golang_google": "google.golang.org/",
@@ -50,6 +60,9 @@ func main() {
 }
 
 func run(args []string) error {
+	if *printRules {
+		return printRepositories(os.Stdout, os.Getenv("GOPROXY"), args)
+	}
 	cwd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -67,19 +80,96 @@ func run(args []string) error {
 	if err != nil {
 		return err
 	}
+	var rules []*bf.CallExpr
 	for _, arg := range args {
 		imp, err := findImport(arg)
 		if err != nil {
 			return err
 		}
 		// TODO(pmbethe09): ignore or maybe update sha1 if already defined in workspace.
-		f.Stmt = append(f.Stmt, imp)
+		rules = append(rules, imp)
+	}
+	sortRules(rules)
+	for _, r := range rules {
+		f.Stmt = append(f.Stmt, r)
 	}
 	updateLoad(f)
 	bf.Rewrite(f, nil)
 	return ioutil.WriteFile(f.Path, bf.Format(f), 0644)
 }
 
+// printRepositories writes a go_repository rule for the module providing
+// each of importpaths. Modules are found with the proxies in goproxy, the
+// value of GOPROXY, so the name is derived from the canonical module path,
+// even for vanity import paths. Rules are sorted by name, so the output
+// doesn't depend on the order of importpaths.
+//
+// The sum of each rule is only as trustworthy as the proxy, since it isn't
+// checked against the checksum database, so the rules say so in a comment.
+// Sums from go.sum, which the go command does check, are pinned by
+// "gazelle update-repos" instead.
+func printRepositories(w io.Writer, goproxy string, importpaths []string) error {
+	var rules []*bf.CallExpr
+	seen := make(map[string]bool)
+	for _, importpath := range importpaths {
+		mod, err := findModule(goproxy, importpath)
+		if err != nil {
+			return err
+		}
+		if seen[mod.path] {
+			continue
+		}
+		seen[mod.path] = true
+		rules = append(rules, &bf.CallExpr{
+			Comments: bf.Comments{
+				Before: []bf.Comment{{Token: "# sum is from the proxy, not the checksum database; check it against go.sum"}},
+			},
+			X: &bf.LiteralExpr{Token: "go_repository"},
+			List: []bf.Expr{
+				attr("name", resolve.ImportPathToBazelRepoName(mod.path)),
+				attr("importpath", mod.path),
+				attr("sum", mod.sum),
+				attr("version", mod.version),
+			},
+		})
+	}
+	sortRules(rules)
+	f := &bf.File{}
+	for _, r := range rules {
+		f.Stmt = append(f.Stmt, r)
+	}
+	_, err := w.Write(bf.Format(f))
+	return err
+}
+
+// sortRules sorts go_repository rules by name.
+func sortRules(rules []*bf.CallExpr) {
+	sort.Stable(byName(rules))
+}
+
+type byName []*bf.CallExpr
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return ruleName(s[i]) < ruleName(s[j]) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ruleName returns the value of the name attribute of a rule created by
+// attr, or "" if it has none.
+func ruleName(call *bf.CallExpr) string {
+	for _, e := range call.List {
+		kv, ok := e.(*bf.BinaryExpr)
+		if !ok {
+			continue
+		}
+		if k, ok := kv.X.(*bf.LiteralExpr); ok && k.Token == "name" {
+			if v, ok := kv.Y.(*bf.StringExpr); ok {
+				return v.Value
+			}
+		}
+	}
+	return ""
+}
+
 func nameAndImportpath(name string) (string, string, error) {
 	if *asis {
 		return resolve.ImportPathToBazelRepoName(name), name, nil
@@ -97,7 +187,7 @@ func nameAndImportpath(name string) (string, string, error) {
 	return name, strings.Join([]string{s[1] + "." + s[0], s[2], rest}, "/"), nil
 }
 
-func findImport(nameIn string) (bf.Expr, error) {
+func findImport(nameIn string) (*bf.CallExpr, error) {
 	name, importpath, err := nameAndImportpath(nameIn)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,113 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/modproxy"
+)
+
+// moduleVersion is the latest version of a module and the hash of its zip
+// file, in the format of go.sum. The hash is computed from the zip file the
+// proxy served; it isn't checked against the checksum database.
+type moduleVersion struct {
+	path, version, sum string
+}
+
+// findModule looks up the module that provides the package importpath with
+// the proxies in goproxy, the value of GOPROXY, like the go command: the
+// next proxy is tried if one doesn't have the module, or after any error if
+// the entry is followed by "|". The search stops with an error at "off",
+// and at "direct", since wtool can only look up versions with a proxy.
+func findModule(goproxy, importpath string) (moduleVersion, error) {
+	if goproxy == "" {
+		goproxy = modproxy.DefaultGoProxy
+	}
+	specs, err := modproxy.ParseList(goproxy)
+	if err != nil {
+		return moduleVersion{}, err
+	}
+	var errs []string
+	for _, spec := range specs {
+		switch spec.URL {
+		case "off":
+			errs = append(errs, "module lookups disabled by GOPROXY=off")
+			return moduleVersion{}, fmt.Errorf("%s: %s", importpath, strings.Join(errs, "; "))
+		case "direct":
+			errs = append(errs, `"direct" in GOPROXY isn't supported; wtool can only look up versions with a proxy`)
+			return moduleVersion{}, fmt.Errorf("%s: %s", importpath, strings.Join(errs, "; "))
+		}
+		mod, err := findModuleInProxy(spec.URL, importpath)
+		if err == nil {
+			return mod, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", spec.URL, err))
+		if err != modproxy.ErrNotFound && !spec.FallBackOnError {
+			break
+		}
+	}
+	return moduleVersion{}, fmt.Errorf("%s: no module provides the package: %s", importpath, strings.Join(errs, "; "))
+}
+
+// findModuleInProxy asks the proxy at baseURL for the module that provides
+// the package importpath, trying the path itself and then each of its
+// prefixes, like the go command. The latest version of the module is
+// downloaded to compute its sum. modproxy.ErrNotFound is returned if the
+// proxy has none of them.
+func findModuleInProxy(baseURL, importpath string) (moduleVersion, error) {
+	for modPath := importpath; modPath != "."; modPath = pathDir(modPath) {
+		escPath, err := modproxy.EscapePath(modPath)
+		if err != nil {
+			return moduleVersion{}, err
+		}
+		data, err := modproxy.Get(baseURL, escPath+"/@latest")
+		if err == modproxy.ErrNotFound {
+			continue
+		} else if err != nil {
+			return moduleVersion{}, fmt.Errorf("%s: %v", modPath, err)
+		}
+		var info struct{ Version string }
+		if err := json.Unmarshal(data, &info); err != nil {
+			return moduleVersion{}, fmt.Errorf("%s: invalid version info: %v", modPath, err)
+		}
+		escVersion, err := modproxy.EscapePath(info.Version)
+		if err != nil {
+			return moduleVersion{}, err
+		}
+		zipData, err := modproxy.Get(baseURL, escPath+"/@v/"+escVersion+".zip")
+		if err != nil {
+			return moduleVersion{}, fmt.Errorf("%s@%s: %v", modPath, info.Version, err)
+		}
+		sum, err := modproxy.HashZip(zipData)
+		if err != nil {
+			return moduleVersion{}, fmt.Errorf("%s@%s: %v", modPath, info.Version, err)
+		}
+		return moduleVersion{path: modPath, version: info.Version, sum: sum}, nil
+	}
+	return moduleVersion{}, modproxy.ErrNotFound
+}
+
+// pathDir returns importpath without its last element, or "." if it has
+// only one.
+func pathDir(importpath string) string {
+	if i := strings.LastIndex(importpath, "/"); i >= 0 {
+		return importpath[:i]
+	}
+	return "."
+}
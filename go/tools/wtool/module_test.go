@@ -0,0 +1,165 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/modproxy"
+)
+
+// moduleZip returns a module zip file for path at version containing files,
+// each holding a comment with its name.
+func moduleZip(t *testing.T, path, version string, files ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range files {
+		w, err := zw.Create(path + "@" + version + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("// " + name + "\n"))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFindModule(t *testing.T) {
+	zipData := moduleZip(t, "example.com/Mod", "v1.2.0", "go.mod", "sub/sub.go")
+	wantSum, err := modproxy.HashZip(zipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/!mod/@latest":
+			w.Write([]byte(`{"Version": "v1.2.0", "Time": "2019-01-01T00:00:00Z"}`))
+		case "/example.com/!mod/@v/v1.2.0.zip":
+			w.Write(zipData)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	got, err := findModule(srv.URL, "example.com/Mod/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := moduleVersion{path: "example.com/Mod", version: "v1.2.0", sum: wantSum}
+	if got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+
+	if _, err := findModule(srv.URL, "example.org/missing"); err == nil {
+		t.Errorf("got success for a missing module; want error")
+	}
+}
+
+func TestFindModuleProxyList(t *testing.T) {
+	zipData := moduleZip(t, "example.com/mod", "v1.0.0", "go.mod")
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/mod/@latest":
+			w.Write([]byte(`{"Version": "v1.0.0"}`))
+		case "/example.com/mod/@v/v1.0.0.zip":
+			w.Write(zipData)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer good.Close()
+	empty := httptest.NewServer(http.NotFoundHandler())
+	defer empty.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	for _, tc := range []struct {
+		label, goproxy string
+		wantErr        bool
+	}{
+		{label: "not found falls through", goproxy: empty.URL + "," + good.URL},
+		{label: "error stops", goproxy: broken.URL + "," + good.URL, wantErr: true},
+		{label: "error falls through after pipe", goproxy: broken.URL + "|" + good.URL},
+		{label: "off", goproxy: "off," + good.URL, wantErr: true},
+		{label: "direct", goproxy: empty.URL + ",direct", wantErr: true},
+	} {
+		got, err := findModule(tc.goproxy, "example.com/mod")
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("[%s] got %+v; want error", tc.label, got)
+			}
+		} else if err != nil {
+			t.Errorf("[%s] %v", tc.label, err)
+		} else if got.version != "v1.0.0" {
+			t.Errorf("[%s] got version %s; want v1.0.0", tc.label, got.version)
+		}
+	}
+}
+
+// TestPrintRepositories checks the rules printed for several modules
+// against a golden file. Import paths are given out of order and repeated,
+// but rules are printed once per module, sorted by name.
+func TestPrintRepositories(t *testing.T) {
+	zips := map[string][]byte{
+		"/example.com/b/@v/v0.1.0.zip": moduleZip(t, "example.com/b", "v0.1.0", "go.mod", "b.go"),
+		"/example.com/a/@v/v1.0.0.zip": moduleZip(t, "example.com/a", "v1.0.0", "go.mod", "a.go"),
+		"/example.org/c/@v/v2.0.0.zip": moduleZip(t, "example.org/c", "v2.0.0", "go.mod"),
+	}
+	latest := map[string]string{
+		"/example.com/b/@latest": "v0.1.0",
+		"/example.com/a/@latest": "v1.0.0",
+		"/example.org/c/@latest": "v2.0.0",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v, ok := latest[r.URL.Path]; ok {
+			w.Write([]byte(`{"Version": "` + v + `"}`))
+		} else if data, ok := zips[r.URL.Path]; ok {
+			w.Write(data)
+		} else {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	want, err := ioutil.ReadFile(filepath.Join("testdata", "print_repositories.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, importpaths := range [][]string{
+		{"example.org/c", "example.com/b/sub", "example.com/a", "example.com/b"},
+		{"example.com/a", "example.com/b", "example.org/c"},
+	} {
+		var buf bytes.Buffer
+		if err := printRepositories(&buf, srv.URL, importpaths); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != string(want) {
+			t.Errorf("printRepositories(%q): got:\n%s\nwant:\n%s", importpaths, got, want)
+		}
+	}
+}
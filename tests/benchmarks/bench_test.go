@@ -0,0 +1,29 @@
+package benchmarks
+
+import "testing"
+
+func sum(n int) int {
+	s := 0
+	for i := 0; i < n; i++ {
+		s += i
+	}
+	return s
+}
+
+func BenchmarkSum(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sum(100)
+	}
+}
+
+// Benchmarking is not a benchmark, since its name continues with a
+// lower-case letter.
+func Benchmarking(b *testing.B) {
+	b.Fatal("not a benchmark")
+}
+
+func TestSum(t *testing.T) {
+	if got := sum(4); got != 6 {
+		t.Errorf("sum(4) = %d; want 6", got)
+	}
+}
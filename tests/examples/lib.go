@@ -0,0 +1,10 @@
+package examples
+
+import "fmt"
+
+// Greet prints a greeting for each name.
+func Greet(names ...string) {
+	for _, name := range names {
+		fmt.Printf("hello, %s\n", name)
+	}
+}
@@ -0,0 +1,18 @@
+package examples
+
+func ExampleGreet() {
+	Greet("gopher")
+	// Output: hello, gopher
+}
+
+func ExampleGreet_unordered() {
+	Greet("b", "a")
+	// Unordered output:
+	// hello, a
+	// hello, b
+}
+
+// Examples without output comments are compiled, but not run.
+func ExampleGreet_noOutput() {
+	panic("not run")
+}
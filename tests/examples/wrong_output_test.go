@@ -0,0 +1,6 @@
+package examples
+
+func ExampleGreet() {
+	Greet("gopher")
+	// Output: goodbye, gopher
+}
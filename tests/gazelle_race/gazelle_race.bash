@@ -0,0 +1,16 @@
+#!/bin/bash
+
+# This test runs Gazelle's tests with the race detector. Gazelle reads
+# directories, generates rules, and writes files concurrently, so data races
+# in code that assumes it runs on one goroutine only show up under -race.
+# The stress tests for the walker and resolver check many more random
+# repositories here than in a normal test run.
+
+cd $(dirname "$0")
+source ../non_bazel_tests_common.bash
+
+bazel_test \
+  --features=race \
+  --test_env=GAZELLE_STRESS_ITERATIONS=100 \
+  --test_output=errors \
+  //go/tools/gazelle/...
@@ -1,7 +1,10 @@
 package go_embed_data
 
 import (
+	"bytes"
+	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -64,6 +67,22 @@ func TestString(t *testing.T) {
 	}
 }
 
+func TestCompressed(t *testing.T) {
+	for path, data := range compressed {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%q: %v", path, err)
+			continue
+		}
+		contents, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("%q: %v", path, err)
+			continue
+		}
+		checkFile(t, path, contents)
+	}
+}
+
 func checkFile(t *testing.T, path string, data []byte) {
 	f, err := os.Open(path)
 	if err != nil {
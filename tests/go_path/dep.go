@@ -0,0 +1,3 @@
+package dep
+
+var X = 1
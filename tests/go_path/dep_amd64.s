@@ -0,0 +1 @@
+// Assembled on amd64 only; go_path includes it either way.
@@ -0,0 +1,64 @@
+package go_path
+
+import (
+	"archive/zip"
+	"path/filepath"
+	"testing"
+)
+
+const prefix = "src/github.com/bazelbuild/rules_go/tests/go_path/"
+
+var files = []string{
+	prefix + "lib/lib.go",
+	prefix + "dep/dep.go",
+	prefix + "dep/dep_amd64.s",
+}
+
+func TestCopyPath(t *testing.T) {
+	checkTree(t, "copy_path", false)
+}
+
+func TestSymlinkPath(t *testing.T) {
+	checkTree(t, "symlink_path", true)
+}
+
+func TestArchivePath(t *testing.T) {
+	zr, err := zip.OpenReader("archive_path.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	got := make(map[string]bool)
+	for _, f := range zr.File {
+		got[f.Name] = true
+	}
+	for _, f := range files {
+		if !got[f] {
+			t.Errorf("%s not found in archive", f)
+		}
+	}
+	if len(got) != len(files) {
+		t.Errorf("got %d files in archive; want %d", len(got), len(files))
+	}
+}
+
+func checkTree(t *testing.T, dir string, link bool) {
+	for _, f := range files {
+		path := filepath.Join(dir, filepath.FromSlash(f))
+		// Runfiles are links themselves, so copies can only be told apart
+		// from links by where they point. Sources are in this directory, and
+		// copies are in the tree.
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if isSource := filepath.Base(filepath.Dir(target)) == "go_path"; isSource != link {
+			if link {
+				t.Errorf("%s resolves to %s; want a link to the source file", path, target)
+			} else {
+				t.Errorf("%s resolves to %s; want a copy in the tree", path, target)
+			}
+		}
+	}
+}
@@ -0,0 +1,5 @@
+package lib
+
+import "github.com/bazelbuild/rules_go/tests/go_path/dep"
+
+var X = dep.X
@@ -13,6 +13,7 @@ cd $(dirname "$0")
 prefix=">>>>>>"
 
 tests=(
+  gazelle_race/gazelle_race.bash
   gc_opts_unsafe/gc_opts_unsafe.bash
   popular_repos/popular_repos.bash
   test_chdir/test_chdir.bash
@@ -0,0 +1,15 @@
+package xml_report
+
+import "testing"
+
+func TestPass(t *testing.T) {
+	t.Log("logged by TestPass")
+}
+
+func TestSub(t *testing.T) {
+	t.Run("a", func(t *testing.T) {})
+}
+
+func TestSkip(t *testing.T) {
+	t.Skip("skipped on purpose")
+}